@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
 	"github.com/pepalonsocosta/fvp/internal/protocol"
 )
 
 var version string
 
+// reconnectDelay is the pause between rounds of reconnect attempts
+const reconnectDelay = 5 * time.Second
+
+// defaultConnectTimeout bounds the first connection, over every server in
+// the list
+const defaultConnectTimeout = 15 * time.Second
+
 func main() {
 	if err := protocol.InitProtocolVersion(version); err != nil {
 		fmt.Printf("Warning: Failed to initialize protocol version: %v\n", err)
@@ -45,32 +57,203 @@ func main() {
 
 func handleConnect() {
 	fs := flag.NewFlagSet("connect", flag.ExitOnError)
-	serverAddr := fs.String("server", "", "Server address (required)")
+	serverAddr := fs.String("server", "", "Server address, or comma-separated fallback addresses (required unless the config file sets server)")
+	keepAlive := fs.Int("keepalive", 30, "Seconds between keepalive pings")
+	compress := fs.Bool("compress", false, "Compress data payloads, for slow links")
+	interfaceName := fs.String("interface", client.DefaultInterfaceName, "Name of the TUN interface to create")
+	configPath := fs.String("config", "", "Client config file with client_id and key")
+	clientID := fs.Int("id", 0, "Client ID the pre-shared key is registered under")
+	keyStdin := fs.Bool("key-stdin", false, "Read the pre-shared key from stdin")
+	requestedIP := fs.String("ip", "", "Tunnel IP to request from the server")
+	insecure := fs.Bool("insecure-no-encryption", false, "Send tunnel traffic unencrypted, for protocol debugging only")
+	mtu := fs.Int("mtu", 0, "Largest IP packet the tunnel carries, matching the server's mtu, e.g. 9000 for jumbo frames; 0 for 1500")
+	clampMTU := fs.Int("clamp-mss", 0, "Clamp the TCP MSS of tunneled connections to fit this MTU, 0 to disable")
+	dscp := fs.Int("dscp", 0, "DSCP to mark tunnel datagrams with for QoS, e.g. 46 for EF, 0 for none")
+	maxUDPPayload := fs.Int("max-udp-payload", 0, "Drop packets whose datagram would exceed this many bytes, 0 for no limit")
+	localPort := fs.Int("local-port", 0, "UDP port to send from, 0 for a random port on every connect")
+	killSwitch := fs.Bool("kill-switch", false, "Block traffic outside the tunnel until the client exits, reconnects included; needs root")
+	verbose := fs.Bool("verbose", false, "Log every packet's header and the flow it carries, for debugging tunnels")
+	authTimeout := fs.Duration("auth-timeout", client.DefaultAuthTimeout, "How long to wait for each auth response")
+	authRetries := fs.Int("auth-retries", client.DefaultAuthRetries, "Times to resend an unanswered auth request before giving up")
+	timeout := fs.Duration("timeout", defaultConnectTimeout, "Give up if no server completes the handshake within this long")
+	statusSocket := fs.String("status-socket", "", "Unix socket fvpc status reads the connection status from (default fvpc-<interface>.sock in the temp directory)")
 	fs.Parse(os.Args[2:])
 
+	if *serverAddr == "" && *configPath != "" {
+		config, err := client.LoadConfig(*configPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		*serverAddr = config.Server
+	}
+
 	if *serverAddr == "" {
-		fmt.Println("Error: --server is required")
+		fmt.Println("Error: --server is required, or server in the config file")
 		showUsage()
 		os.Exit(1)
 	}
 
+	if *timeout <= 0 {
+		fmt.Println("Error: --timeout must be positive")
+		os.Exit(1)
+	}
+
+	err := network.ValidateInterfaceName(*interfaceName)
+	if err != nil {
+		fmt.Printf("Error: --interface: %v\n", err)
+		os.Exit(1)
+	}
+
+	id, key, err := loadPreSharedKey(*configPath, *clientID, *keyStdin)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	networkKey, err := loadNetworkKey(*configPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	serverIdentity, err := loadServerIdentity(*configPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	authWait, retries, err := loadAuthTimeout(*configPath, fs, *authTimeout, *authRetries)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	dscpValue, err := loadDSCP(*configPath, fs, *dscp)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	keepAliveInterval, err := loadKeepAlive(*configPath, fs, *keepAlive)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	c := client.NewClient(*serverAddr)
+	if key != nil {
+		c.SetPreSharedKey(id, key)
+	}
+	err = c.SetNetworkKey(networkKey)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetServerIdentity(serverIdentity)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetAuthTimeout(authWait, retries)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	c.SetKeepAliveInterval(keepAliveInterval)
+	c.SetCompression(*compress)
+	c.SetInterfaceName(*interfaceName)
+	if *requestedIP != "" {
+		err = c.SetRequestedIP(*requestedIP)
+		if err != nil {
+			fmt.Printf("Error: --ip: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	c.SetPacketTrace(*verbose)
+	err = c.SetLocalPort(*localPort)
+	if err != nil {
+		fmt.Printf("Error: --local-port: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetMTU(*mtu)
+	if err != nil {
+		fmt.Printf("Error: --mtu: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetClampMSS(*clampMTU)
+	if err != nil {
+		fmt.Printf("Error: --clamp-mss: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetDSCP(dscpValue)
+	if err != nil {
+		fmt.Printf("Error: --dscp: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetMaxUDPPayload(*maxUDPPayload)
+	if err != nil {
+		fmt.Printf("Error: --max-udp-payload: %v\n", err)
+		os.Exit(1)
+	}
+	err = c.SetKillSwitch(*killSwitch)
+	if err != nil {
+		fmt.Printf("Error: --kill-switch: %v\n", err)
+		os.Exit(1)
+	}
+	if *insecure {
+		err = c.SetInsecureNoEncryption(true)
+		if err != nil {
+			fmt.Printf("Error: --insecure-no-encryption: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("WARNING: encryption is disabled, tunnel traffic is sent in plaintext")
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// Ctrl+C cancels a handshake in progress as well as an open connection
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	err := c.Connect()
+	connectCtx, cancel := context.WithTimeout(ctx, *timeout)
+	err = c.ConnectContext(connectCtx)
+	cancel()
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Printf("Error: connection timed out, no server completed the handshake within %s\n", *timeout)
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Printf("Failed to connect to server: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Connected to VPN server at %s\n", *serverAddr)
+	fmt.Printf("Connected to VPN server at %s\n", c.GetServerAddr())
 	fmt.Printf("Client ID: %d\n", c.GetClientID())
 	fmt.Printf("Assigned IP: %s\n", c.GetAssignedIP())
 	fmt.Println("Press Ctrl+C to disconnect")
 
-	<-sigChan
+	if *statusSocket == "" {
+		*statusSocket = client.DefaultStatusSocket(*interfaceName)
+	}
+	statusListener, err := c.ServeStatus(*statusSocket)
+	if err != nil {
+		fmt.Printf("Warning: %v; fvpc status won't reach this client\n", err)
+	} else {
+		defer statusListener.Close()
+	}
+
+	// A server shutting down tells its clients, so fail over straight away
+session:
+	for {
+		select {
+		case <-ctx.Done():
+			break session
+		case <-c.ServerClosed():
+			fmt.Println("Server ended the session, reconnecting...")
+			if !reconnect(ctx, c) {
+				break session
+			}
+		}
+	}
 
 	err = c.Disconnect()
 	if err != nil {
@@ -81,14 +264,207 @@ func handleConnect() {
 	fmt.Println("Disconnected from VPN server")
 }
 
+// reconnect retries the server list until a connection succeeds, returning
+// false if ctx is cancelled first
+func reconnect(ctx context.Context, c *client.Client) bool {
+	for {
+		err := c.Reconnect(ctx)
+		if err == nil {
+			fmt.Printf("Reconnected to VPN server at %s\n", c.GetServerAddr())
+			fmt.Printf("Assigned IP: %s\n", c.GetAssignedIP())
+			return true
+		}
+
+		fmt.Printf("Failed to reconnect: %v\n", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// loadPreSharedKey returns the client ID and key to authenticate with, or a
+// nil key to have the server assign both. --id overrides the config file's
+// client_id; the key comes from stdin, FVPC_KEY or the config file, in that
+// order.
+func loadPreSharedKey(configPath string, clientID int, keyStdin bool) (uint8, []byte, error) {
+	if clientID < 0 || clientID > 255 {
+		return 0, nil, fmt.Errorf("--id must be between 1 and 255")
+	}
+
+	sources := client.KeySources{
+		Stdin:     os.Stdin,
+		FromStdin: keyStdin,
+		Env:       os.Getenv(client.KeyEnvVar),
+	}
+
+	if configPath != "" {
+		config, err := client.LoadConfig(configPath)
+		if err != nil {
+			return 0, nil, err
+		}
+		sources.File = config.Key
+		if clientID == 0 {
+			clientID = int(config.ClientID)
+		}
+	}
+
+	key, err := client.ResolveKey(sources)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if key != nil && clientID == 0 {
+		return 0, nil, fmt.Errorf("a pre-shared key needs a client ID, set --id or client_id in the config file")
+	}
+
+	return uint8(clientID), key, nil
+}
+
+// loadNetworkKey returns the network key from FVPC_NETWORK_KEY or the config
+// file's network_key, in that order, or nil if neither sets one
+func loadNetworkKey(configPath string) ([]byte, error) {
+	hexKey := os.Getenv(client.NetworkKeyEnvVar)
+	if hexKey == "" && configPath != "" {
+		config, err := client.LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		hexKey = config.NetworkKey
+	}
+
+	if hexKey == "" {
+		return nil, nil
+	}
+
+	key, err := client.ParseKey(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("network key: %w", err)
+	}
+	return key, nil
+}
+
+// loadServerIdentity returns the server identity pinned in the config file,
+// nil if there is none
+func loadServerIdentity(configPath string) ([]byte, error) {
+	if configPath == "" {
+		return nil, nil
+	}
+
+	config, err := client.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerIdentity == "" {
+		return nil, nil
+	}
+
+	publicKey, err := client.ParseKey(config.ServerIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("server identity: %w", err)
+	}
+	return publicKey, nil
+}
+
+// loadDSCP returns the DSCP to mark datagrams with, taking the config file's
+// dscp if --dscp wasn't given
+func loadDSCP(configPath string, fs *flag.FlagSet, dscp int) (int, error) {
+	if configPath == "" {
+		return dscp, nil
+	}
+
+	config, err := client.LoadConfig(configPath)
+	if err != nil {
+		return 0, err
+	}
+
+	given := false
+	fs.Visit(func(f *flag.Flag) { given = given || f.Name == "dscp" })
+	if !given && config.DSCP != 0 {
+		dscp = config.DSCP
+	}
+
+	return dscp, nil
+}
+
+// loadKeepAlive returns the interval between keepalive pings, taking the
+// config file's keepalive_seconds if --keepalive wasn't given
+func loadKeepAlive(configPath string, fs *flag.FlagSet, seconds int) (time.Duration, error) {
+	sources := client.KeepAliveSources{Flag: seconds}
+	fs.Visit(func(f *flag.Flag) { sources.FlagSet = sources.FlagSet || f.Name == "keepalive" })
+
+	if configPath != "" {
+		config, err := client.LoadConfig(configPath)
+		if err != nil {
+			return 0, err
+		}
+		sources.File = config.KeepAliveSeconds
+	}
+
+	return client.ResolveKeepAlive(sources)
+}
+
+// loadAuthTimeout returns the auth timeout and retry count, taking the config
+// file's auth_timeout and auth_retries for whichever flag wasn't given
+func loadAuthTimeout(configPath string, fs *flag.FlagSet, timeout time.Duration, retries int) (time.Duration, int, error) {
+	if configPath == "" {
+		return timeout, retries, nil
+	}
+
+	config, err := client.LoadConfig(configPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["auth-timeout"] && config.AuthTimeout != 0 {
+		timeout = config.AuthTimeout
+	}
+	if !given["auth-retries"] && config.AuthRetries != nil {
+		retries = *config.AuthRetries
+	}
+
+	return timeout, retries, nil
+}
+
 func handleDisconnect() {
 	fmt.Println("Disconnect command not implemented yet")
 	fmt.Println("Use Ctrl+C while connected to disconnect")
 }
 
 func handleStatus() {
-	fmt.Println("Status command not implemented yet")
-	fmt.Println("This will show connection status and statistics")
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	interfaceName := fs.String("interface", client.DefaultInterfaceName, "TUN interface of the client to show")
+	statusSocket := fs.String("status-socket", "", "Status socket of the client to show (default fvpc-<interface>.sock in the temp directory)")
+	fs.Parse(os.Args[2:])
+
+	if *statusSocket == "" {
+		*statusSocket = client.DefaultStatusSocket(*interfaceName)
+	}
+
+	fmt.Println("Client Status:")
+	status, err := client.QueryStatus(*statusSocket)
+	if err != nil {
+		fmt.Printf("  Status: not running (%v)\n", err)
+		return
+	}
+
+	state := "reconnecting"
+	if status.Connected {
+		state = "connected"
+	}
+	fmt.Printf("  Status: %s\n", state)
+	fmt.Printf("  Server: %s\n", status.Server)
+	fmt.Printf("  Client ID: %d\n", status.ClientID)
+	fmt.Printf("  Assigned IP: %s\n", status.AssignedIP)
+	fmt.Printf("  TUN Interface: %s\n", status.Interface)
+	if status.RTT > 0 {
+		fmt.Printf("  RTT: %s\n", status.RTT.Round(100*time.Microsecond))
+	} else {
+		fmt.Println("  RTT: not measured yet")
+	}
 }
 
 func handleVersion() {
@@ -114,9 +490,50 @@ func showUsage() {
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  fvpc connect --server 1.2.3.4:1194")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194,5.6.7.8:1194")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --keepalive 15")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --compress")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --interface fvp-office")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --config fvpc.yaml")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --ip 10.0.0.50")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --clamp-mss 1400")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --local-port 51820")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --verbose")
+	fmt.Println("  fvpc connect --server 1.2.3.4:1194 --kill-switch")
+	fmt.Println("  FVPC_KEY=<hex key> fvpc connect --server 1.2.3.4:1194 --id 2")
 	fmt.Println("  fvpc status")
 	fmt.Println("  fvpc version")
 	fmt.Println("")
 	fmt.Println("Flags:")
-	fmt.Println("  --server string  Server address (required for connect)")
+	fmt.Println("  --server string  Server address, or comma-separated fallbacks (required for connect")
+	fmt.Println("                   unless the config file sets server)")
+	fmt.Println("  --keepalive int  Seconds between keepalive pings (default 30)")
+	fmt.Println("  --compress       Compress data payloads, for slow links")
+	fmt.Println("  --interface name TUN interface to create (default fvp-client0)")
+	fmt.Println("  --config path    Config file with client_id, a pre-shared key and a network_key")
+	fmt.Println("  --id int         Client ID for a pre-shared key (overrides client_id)")
+	fmt.Println("  --key-stdin      Read the pre-shared key from stdin")
+	fmt.Println("  --ip address     Tunnel IP to request; the server assigns another if it's taken")
+	fmt.Println("  --mtu int        Largest tunneled IP packet, matching the server's mtu (default 1500)")
+	fmt.Println("  --clamp-mss mtu  Lower the TCP MSS of tunneled connections to fit this MTU")
+	fmt.Println("  --local-port int Send from this UDP port instead of a random one")
+	fmt.Println("  --dscp int       Mark tunnel datagrams with this DSCP for QoS, e.g. 46 for EF")
+	fmt.Println("  --max-udp-payload bytes")
+	fmt.Println("                   Drop packets whose datagram would be larger, instead of fragmenting")
+	fmt.Println("  --timeout duration")
+	fmt.Println("                   Give up connecting after this long, over all servers (default 15s)")
+	fmt.Println("  --auth-timeout duration")
+	fmt.Println("                   How long to wait for each auth response (default 3s)")
+	fmt.Println("  --auth-retries int")
+	fmt.Println("                   Times to resend an unanswered auth request (default 2)")
+	fmt.Println("  --kill-switch    Block traffic outside the tunnel until fvpc exits (Linux, needs root)")
+	fmt.Println("  --verbose        Log a line per packet sent and received, never its contents")
+	fmt.Println("  --status-socket path")
+	fmt.Println("                   Socket fvpc status reads from (default fvpc-<interface>.sock in the temp dir)")
+	fmt.Println("  --insecure-no-encryption")
+	fmt.Printf("                   Disable encryption for debugging; needs %s=1\n", crypto.InsecureEnvVar)
+	fmt.Println("")
+	fmt.Println("Environment:")
+	fmt.Printf("  %s         Pre-shared key, hex-encoded\n", client.KeyEnvVar)
+	fmt.Printf("  %s Network key of servers with network_key set, hex-encoded\n", client.NetworkKeyEnvVar)
 }
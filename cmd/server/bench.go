@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/server"
+)
+
+const (
+	// benchWindow is the most packets in flight at once, which keeps the
+	// loopback socket buffers from overflowing
+	benchWindow = 64
+
+	// benchIdleTimeout ends a run once no packet has arrived for this long
+	benchIdleTimeout = 2 * time.Second
+
+	// benchStampOffset is where the send timestamp sits, after the IPv4 header
+	benchStampOffset = 20
+	benchMinSize     = benchStampOffset + 8
+)
+
+// BenchOptions configures a loopback throughput run
+type BenchOptions struct {
+	Count    int    // Packets to send
+	Size     int    // IP packet size in bytes
+	Cipher   string // Server cipher; empty selects the default
+	Compress bool   // Negotiate payload compression
+}
+
+// BenchResult is the outcome of a loopback throughput run
+type BenchResult struct {
+	Sent      int
+	Delivered int
+	Elapsed   time.Duration
+	Latencies []time.Duration // Per-packet client TUN to server TUN, sorted
+}
+
+// PacketsPerSecond returns the delivered packet rate
+func (r *BenchResult) PacketsPerSecond() float64 {
+	return float64(r.Delivered) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which p percent of packets arrived
+func (r *BenchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	index := int(float64(len(r.Latencies)-1) * p / 100)
+	return r.Latencies[index]
+}
+
+// RunBenchmark starts a server and a client on loopback, both with callback
+// TUN interfaces, and times packets through the client's encrypt and send path
+// and the server's decode, decrypt and TUN write path. It needs no root.
+func RunBenchmark(opts BenchOptions) (*BenchResult, error) {
+	if opts.Size < benchMinSize {
+		return nil, fmt.Errorf("packet size must be at least %d bytes", benchMinSize)
+	}
+	if opts.Count <= 0 {
+		return nil, fmt.Errorf("packet count must be positive")
+	}
+
+	mtu := server.DefaultMTU
+	if opts.Size > mtu {
+		mtu = opts.Size
+	}
+
+	// Per-packet handshake and routing logs would swamp the output
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	delivered := make(chan []byte, benchWindow)
+	serverTUN := network.NewCallbackTun(func(packet []byte) {
+		delivered <- packet
+	})
+	srv, err := server.NewServerWithOptions(server.ServerOptions{
+		Port:   "127.0.0.1:0",
+		Cipher: opts.Cipher,
+		MTU:    mtu,
+		TUN:    serverTUN,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server: %w", err)
+	}
+
+	err = srv.Serve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+	defer srv.Stop()
+
+	clientTUN := network.NewCallbackTun(func([]byte) {})
+	vpnClient := client.NewClientWithTUN(srv.GetAddr().String(), clientTUN)
+	vpnClient.SetCompression(opts.Compress)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect client: %w", err)
+	}
+	defer vpnClient.Disconnect()
+
+	packet, err := newBenchPacket(vpnClient.GetAssignedIP(), opts.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BenchResult{Latencies: make([]time.Duration, 0, opts.Count)}
+	start := time.Now()
+	inFlight := 0
+
+wait:
+	for result.Sent < opts.Count || inFlight > 0 {
+		if result.Sent < opts.Count && inFlight < benchWindow {
+			// Each packet carries its send time relative to start
+			next := make([]byte, len(packet))
+			copy(next, packet)
+			binary.BigEndian.PutUint64(next[benchStampOffset:], uint64(time.Since(start)))
+			err = clientTUN.Inject(next)
+			if err != nil {
+				return nil, fmt.Errorf("failed to queue packet: %w", err)
+			}
+			result.Sent++
+			inFlight++
+			continue
+		}
+
+		select {
+		case received := <-delivered:
+			sentAt := time.Duration(binary.BigEndian.Uint64(received[benchStampOffset:]))
+			result.Latencies = append(result.Latencies, time.Since(start)-sentAt)
+			result.Delivered++
+			inFlight--
+		case <-time.After(benchIdleTimeout):
+			// Whatever is still in flight was lost
+			break wait
+		}
+	}
+
+	result.Elapsed = time.Since(start)
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result, nil
+}
+
+// newBenchPacket builds an IPv4 packet of the given size from the client's
+// tunnel address, filled with random data that doesn't compress
+func newBenchPacket(clientIP string, size int) ([]byte, error) {
+	src := net.ParseIP(clientIP).To4()
+	if src == nil {
+		return nil, fmt.Errorf("client was assigned an invalid IP %q", clientIP)
+	}
+
+	packet := make([]byte, size)
+	rand.Read(packet[benchStampOffset:])
+	packet[0] = 0x45 // IPv4, 20-byte header
+	binary.BigEndian.PutUint16(packet[2:4], uint16(size))
+	packet[8] = 64 // TTL
+	packet[9] = 17 // UDP
+	copy(packet[12:16], src)
+	copy(packet[16:20], net.IPv4(198, 51, 100, 1).To4())
+	return packet, nil
+}
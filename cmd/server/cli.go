@@ -4,32 +4,40 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/pepalonsocosta/fvp/internal/client"
 	"github.com/pepalonsocosta/fvp/internal/crypto"
 	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
 	"github.com/pepalonsocosta/fvp/internal/server"
 	"gopkg.in/yaml.v3"
 )
 
 type CLIServer struct {
-	server *server.Server
+	server     *server.Server
+	configPath string    // Server configuration file the commands work on
+	random     io.Reader // Source of generated client keys
 }
 
-func NewCLIServer() *CLIServer {
+func NewCLIServer(configPath string) *CLIServer {
 	return &CLIServer{
-		server: server.NewServer(),
+		server:     server.NewServer(),
+		configPath: configPath,
+		random:     rand.Reader,
 	}
 }
 
-type ServerConfig struct {
-	Server struct {
-		Port           string `yaml:"port"`
-		TimeoutMinutes int    `yaml:"timeout_minutes"`
-	} `yaml:"server"`
-	Clients []crypto.ClientConfig `yaml:"clients"`
-}
+// ServerConfig is the server.yaml layout; sharing it with the server keeps
+// settings like subnet and nat intact when the CLI rewrites the file
+type ServerConfig = server.ServerConfig
 
 type ClientInfo struct {
 	ID         uint8     `json:"id"`
@@ -38,17 +46,26 @@ type ClientInfo struct {
 	Connected  bool      `json:"connected"`
 }
 
-func (s *CLIServer) Setup(port string, timeoutMinutes int) error {
-	if _, err := os.Stat("server.yaml"); err == nil {
+func (s *CLIServer) Setup(port, listen string, timeoutMinutes int) error {
+	if _, err := os.Stat(s.configPath); err == nil {
 		return fmt.Errorf("configuration file already exists")
 	}
 
+	if listen != "" {
+		_, err := server.ListenAddress(listen, port)
+		if err != nil {
+			return err
+		}
+	}
+
 	config := ServerConfig{}
 	config.Server.Port = port
+	config.Server.ListenAddress = listen
 	config.Server.TimeoutMinutes = timeoutMinutes
+	config.Server.AdminSocket = server.DefaultAdminSocket
 	config.Clients = []crypto.ClientConfig{}
 
-	err := s.writeConfig("server.yaml", &config)
+	err := s.writeConfig(s.configPath, &config)
 	if err != nil {
 		return fmt.Errorf("failed to write config: %w", err)
 	}
@@ -64,7 +81,7 @@ func (s *CLIServer) Setup(port string, timeoutMinutes int) error {
 }
 
 func (s *CLIServer) AddClient() (uint8, string, error) {
-	config, err := s.loadConfig("server.yaml")
+	config, err := s.loadConfig(s.configPath)
 	if err != nil {
 		return 0, "", fmt.Errorf("no configuration found, run 'fvps setup' first")
 	}
@@ -74,18 +91,35 @@ func (s *CLIServer) AddClient() (uint8, string, error) {
 		return 0, "", fmt.Errorf("failed to generate key: %w", err)
 	}
 
-	nextID := s.findNextClientID(config.Clients)
+	clients, err := crypto.MergeClientsDir(s.configPath, config.Clients)
+	if err != nil {
+		return 0, "", err
+	}
+
+	nextID := s.findNextClientID(clients)
 	if nextID == 0 {
-		return 0, "", fmt.Errorf("maximum clients reached (255)")
+		return 0, "", fmt.Errorf("maximum clients reached (%d)", server.MaxClients)
 	}
 
 	client := crypto.ClientConfig{
 		ID:  nextID,
 		Key: key,
 	}
+
+	// Deployments that keep a file per client get one for this client too
+	clientsDir := filepath.Join(filepath.Dir(s.configPath), crypto.ClientsDir)
+	if info, err := os.Stat(clientsDir); err == nil && info.IsDir() {
+		path := filepath.Join(clientsDir, fmt.Sprintf("client-%d.yaml", nextID))
+		err = s.writeClientFile(path, []crypto.ClientConfig{client})
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to write client file: %w", err)
+		}
+		return nextID, key, nil
+	}
+
 	config.Clients = append(config.Clients, client)
 
-	err = s.writeConfig("server.yaml", config)
+	err = s.writeConfig(s.configPath, config)
 	if err != nil {
 		return 0, "", fmt.Errorf("failed to update config: %w", err)
 	}
@@ -93,14 +127,86 @@ func (s *CLIServer) AddClient() (uint8, string, error) {
 	return nextID, key, nil
 }
 
+// ExportClient writes a client config for clientID to path, with host as the
+// address clients reach this server at. host may leave out the port, which
+// then comes from the listen address in server.yaml.
+func (s *CLIServer) ExportClient(clientID uint8, host, path string) error {
+	config, err := s.loadConfig(s.configPath)
+	if err != nil {
+		return fmt.Errorf("no configuration found, run 'fvps setup' first")
+	}
+
+	clients, err := crypto.MergeClientsDir(s.configPath, config.Clients)
+	if err != nil {
+		return err
+	}
+
+	var key string
+	for _, c := range clients {
+		if c.ID == clientID {
+			key = c.Key
+		}
+	}
+	if key == "" {
+		return fmt.Errorf("client %d not found", clientID)
+	}
+
+	address, err := exportAddress(host, config.Server.Port)
+	if err != nil {
+		return err
+	}
+
+	identity, err := server.IdentityPublicKey(config.Server.IdentityKey)
+	if err != nil {
+		return err
+	}
+
+	return client.WriteConfig(path, &client.Config{
+		Server:         address,
+		ClientID:       clientID,
+		Key:            key,
+		NetworkKey:     config.Server.NetworkKey,
+		ServerIdentity: identity,
+	})
+}
+
+// exportAddress joins host with the port of the listen address port, unless
+// host already has one
+func exportAddress(host, port string) (string, error) {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return "", fmt.Errorf("invalid server address: must not be empty")
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+
+	if port == "" {
+		port = server.DefaultPort
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		_, listenPort, err := net.SplitHostPort(port)
+		if err != nil {
+			return "", fmt.Errorf("invalid port %q in server.yaml: %w", port, err)
+		}
+		port = listenPort
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
 func (s *CLIServer) ListClients() ([]ClientInfo, error) {
-	config, err := s.loadConfig("server.yaml")
+	config, err := s.loadConfig(s.configPath)
 	if err != nil {
 		return nil, fmt.Errorf("no configuration found, run 'fvps setup' first")
 	}
 
-	clients := make([]ClientInfo, len(config.Clients))
-	for i, client := range config.Clients {
+	configured, err := crypto.MergeClientsDir(s.configPath, config.Clients)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]ClientInfo, len(configured))
+	for i, client := range configured {
 		clients[i] = ClientInfo{
 			ID:        client.ID,
 			IP:        s.getClientIP(client.ID),
@@ -108,35 +214,71 @@ func (s *CLIServer) ListClients() ([]ClientInfo, error) {
 			Connected: false,        // Not available from config
 		}
 	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
 
 	return clients, nil
 }
 
 func (s *CLIServer) RemoveClient(clientID uint8) error {
-	config, err := s.loadConfig("server.yaml")
+	config, err := s.loadConfig(s.configPath)
 	if err != nil {
 		return fmt.Errorf("no configuration found, run 'fvps setup' first")
 	}
 
-	found := false
-	for i, client := range config.Clients {
-		if client.ID == clientID {
-			config.Clients = append(config.Clients[:i], config.Clients[i+1:]...)
-			found = true
-			break
+	var found bool
+	config.Clients, found = removeClientConfig(config.Clients, clientID)
+	if found {
+		err = s.writeConfig(s.configPath, config)
+		if err != nil {
+			return fmt.Errorf("failed to update config: %w", err)
 		}
+		return nil
 	}
 
-	if !found {
-		return fmt.Errorf("client %d not found", clientID)
+	files, err := crypto.ClientsDirFiles(s.configPath)
+	if err != nil {
+		return err
 	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read client file: %w", err)
+		}
+		var clientFile crypto.Config
+		err = yaml.Unmarshal(data, &clientFile)
+		if err != nil {
+			return fmt.Errorf("failed to parse client file %s: %w", file, err)
+		}
 
-	err = s.writeConfig("server.yaml", config)
-	if err != nil {
-		return fmt.Errorf("failed to update config: %w", err)
+		clientFile.Clients, found = removeClientConfig(clientFile.Clients, clientID)
+		if !found {
+			continue
+		}
+
+		// A file per client goes with its client
+		if len(clientFile.Clients) == 0 {
+			err = os.Remove(file)
+		} else {
+			err = s.writeClientFile(file, clientFile.Clients)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update client file: %w", err)
+		}
+		return nil
 	}
 
-	return nil
+	return fmt.Errorf("client %d not found", clientID)
+}
+
+// removeClientConfig returns clients without the one with ID clientID, and
+// whether it was there
+func removeClientConfig(clients []crypto.ClientConfig, clientID uint8) ([]crypto.ClientConfig, bool) {
+	for i, client := range clients {
+		if client.ID == clientID {
+			return append(clients[:i], clients[i+1:]...), true
+		}
+	}
+	return clients, false
 }
 
 
@@ -164,9 +306,20 @@ func (s *CLIServer) writeConfig(path string, config *ServerConfig) error {
 	return os.WriteFile(path, data, 0644)
 }
 
+// writeClientFile writes a clients.d file listing clients. It holds their
+// keys, so only the owner may read it.
+func (s *CLIServer) writeClientFile(path string, clients []crypto.ClientConfig) error {
+	data, err := yaml.Marshal(&crypto.Config{Clients: clients})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
 func (s *CLIServer) generateKey() (string, error) {
 	key := make([]byte, 32)
-	_, err := rand.Read(key)
+	_, err := io.ReadFull(s.random, key)
 	if err != nil {
 		return "", err
 	}
@@ -179,9 +332,9 @@ func (s *CLIServer) findNextClientID(clients []crypto.ClientConfig) uint8 {
 		used[client.ID] = true
 	}
 
-	for i := uint8(1); i != 0; i++ {
-		if !used[i] {
-			return i
+	for id := 1; id <= server.MaxClients; id++ {
+		if !used[uint8(id)] {
+			return uint8(id)
 		}
 	}
 	return 0
@@ -202,8 +355,77 @@ func (s *CLIServer) testTUNInterface() error {
 	return nil
 }
 
+// queryServer sends a command to the running server's admin socket, as
+// configured in the configuration file
+func (s *CLIServer) queryServer(command string) (*server.AdminResponse, error) {
+	config, err := s.loadConfig(s.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("no configuration found, run 'fvps setup' first")
+	}
+	if config.Server.AdminSocket == "" {
+		return nil, fmt.Errorf("no admin_socket configured in %s", s.configPath)
+	}
+
+	return server.AdminRequest(server.AdminSocketPath(s.configPath, config.Server.AdminSocket), command)
+}
+
+// Disconnect drops a client's session on the running server. The client may
+// reconnect if its key is still configured.
+func (s *CLIServer) Disconnect(clientID uint8) error {
+	_, err := s.queryServer(fmt.Sprintf("disconnect %d", clientID))
+	return err
+}
+
+// IsConnected reports whether the running server has a live session for the
+// client, false if the server can't be asked
+func (s *CLIServer) IsConnected(clientID uint8) bool {
+	response, err := s.queryServer("list-clients")
+	if err != nil {
+		return false
+	}
+
+	for _, client := range response.Clients {
+		if client.ID == clientID && client.Connected {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetStats zeroes the running server's packet and traffic counters
+func (s *CLIServer) ResetStats() error {
+	_, err := s.queryServer("stats reset")
+	return err
+}
+
+// Timeout returns the running server's client timeout, first changing it to
+// timeout unless that is zero
+func (s *CLIServer) Timeout(timeout time.Duration) (time.Duration, error) {
+	command := "timeout"
+	if timeout != 0 {
+		command = fmt.Sprintf("timeout %s", timeout)
+	}
+
+	response, err := s.queryServer(command)
+	if err != nil {
+		return 0, err
+	}
+	return response.Timeout, nil
+}
+
+// Reload makes the running server re-read client keys from server.yaml
+func (s *CLIServer) Reload() error {
+	_, err := s.queryServer("reload")
+	return err
+}
+
+// Status prints the running server's status from its admin socket, or that
+// it is stopped if the socket doesn't answer
 func (s *CLIServer) Status() error {
 	status := s.server.GetServerStatus()
+	if response, err := s.queryServer("status"); err == nil && response.Status != nil {
+		status = *response.Status
+	}
 	
 	fmt.Println("Server Status:")
 	fmt.Printf("  Status: %s\n", status.Status)
@@ -213,15 +435,218 @@ func (s *CLIServer) Status() error {
 		fmt.Printf("  TUN Interface: %s\n", status.TUNInterface)
 		fmt.Printf("  Total Clients: %d\n", status.TotalClients)
 		fmt.Printf("  Connected Clients: %d\n", status.ConnectedClients)
+		fmt.Printf("  Packets Received: %d\n", status.PacketsReceived)
+		fmt.Printf("  Dropped Oversized: %d\n", status.DroppedOversized)
+		fmt.Printf("  Dropped Network MAC: %d\n", status.DroppedNetworkMAC)
+		fmt.Printf("  Dropped TUN Queue: %d\n", status.DroppedTUNQueue)
+		fmt.Printf("  Dropped Too Large: %d\n", status.DroppedTooLarge)
+		fmt.Printf("  Dropped Banned: %d\n", status.DroppedBanned)
+		fmt.Printf("  Dropped UDP Send: %d\n", status.DroppedUDPSend)
+		fmt.Printf("  Dropped Malformed: %d\n", status.DroppedMalformed)
+		fmt.Printf("  Read Errors: %d\n", status.ReadErrors)
+		fmt.Printf("  TUN Queue: %d waiting, %d queued\n", status.TUNQueueDepth, status.TUNQueued)
 	}
 	
 	return nil
 }
 
+// Info prints the configuration the server would run with, marking values
+// that fall back to a default. It only reads server.yaml, so it works
+// whether or not the server is running.
+func (s *CLIServer) Info() error {
+	config, err := s.loadConfig(s.configPath)
+	if err != nil {
+		return fmt.Errorf("no configuration found, run 'fvps setup' first")
+	}
+
+	clients, err := crypto.MergeClientsDir(s.configPath, config.Clients)
+	if err != nil {
+		return err
+	}
+
+	port := config.Server.Port
+	portSource := "explicit"
+	if port == "" {
+		port = server.DefaultPort
+		portSource = "default"
+	}
+	if config.Server.ListenAddress != "" {
+		port, err = server.ListenAddress(config.Server.ListenAddress, config.Server.Port)
+		if err != nil {
+			return err
+		}
+		portSource = "explicit"
+	}
+
+	subnetValue := config.Server.Subnet
+	subnetSource := "explicit"
+	if subnetValue == "" {
+		subnetValue = server.DefaultSubnet
+		subnetSource = "default"
+	}
+	_, subnet, err := net.ParseCIDR(subnetValue)
+	if err != nil || subnet.IP.To4() == nil {
+		return fmt.Errorf("invalid subnet %q: must be an IPv4 CIDR", subnetValue)
+	}
+	_, usable := server.SubnetCapacity(subnet)
+
+	serverIP, err := server.ResolveServerIP(subnet, config.Server.ServerIP)
+	if err != nil {
+		return err
+	}
+	serverIPSource := "explicit"
+	if config.Server.ServerIP == "" {
+		serverIPSource = "derived"
+	}
+
+	cipher, err := crypto.CipherByName(config.Server.Cipher)
+	if err != nil {
+		return err
+	}
+	cipherSource := "explicit"
+	if config.Server.Cipher == "" {
+		cipherSource = "default"
+	}
+	cipherName := cipher.Name()
+	if config.Server.InsecureNoEncryption {
+		cipherName = "none, ENCRYPTION DISABLED"
+		cipherSource = "insecure_no_encryption"
+	}
+
+	timeout := server.DefaultTimeout
+	timeoutSource := "default"
+	if config.Server.TimeoutMinutes > 0 {
+		timeout = time.Duration(config.Server.TimeoutMinutes) * time.Minute
+		timeoutSource = "explicit"
+	}
+
+	nat := "disabled"
+	natSource := "default"
+	if config.Server.NAT {
+		nat = fmt.Sprintf("enabled via %s", config.Server.WANInterface)
+		natSource = "explicit"
+	}
+
+	interfaceName := config.Server.InterfaceName
+	interfaceSource := "explicit"
+	if interfaceName == "" {
+		interfaceName = server.DefaultInterfaceName
+		interfaceSource = "default"
+	}
+
+	mtu := server.DefaultMTU
+	mtuSource := "default"
+	if config.Server.MTU != 0 {
+		mtu = config.Server.MTU
+		mtuSource = "explicit"
+	}
+
+	mssClamp := "disabled"
+	mssClampSource := "default"
+	if config.Server.ClampMSS {
+		mssClamp = fmt.Sprintf("%d", network.MSSForMTU(mtu))
+		mssClampSource = "explicit"
+	}
+
+	health := "disabled"
+	healthSource := "default"
+	if config.Server.HealthAddr != "" {
+		health = config.Server.HealthAddr
+		healthSource = "explicit"
+	}
+
+	statsInterval := "disabled"
+	statsSource := "default"
+	if config.Server.StatsInterval > 0 {
+		statsInterval = config.Server.StatsInterval.String()
+		statsSource = "explicit"
+	}
+
+	pushRoutes, err := server.ParsePushRoutes(config.Server.PushRoutes)
+	if err != nil {
+		return err
+	}
+	routes := "none"
+	routesSource := "default"
+	if len(pushRoutes) > 0 {
+		names := make([]string, len(pushRoutes))
+		for i, route := range pushRoutes {
+			names[i] = route.String()
+		}
+		routes = strings.Join(names, ", ")
+		routesSource = "explicit"
+	}
+
+	identity, err := server.IdentityPublicKey(config.Server.IdentityKey)
+	if err != nil {
+		return err
+	}
+	identitySource := "explicit"
+	if identity == "" {
+		identity = "none, clients can't pin the server"
+		identitySource = "default"
+	}
+
+	fmt.Printf("Server Configuration (%s):\n", s.configPath)
+	fmt.Printf("  Port:             %s (%s)\n", port, portSource)
+	fmt.Printf("  Subnet:           %s (%s)\n", subnet, subnetSource)
+	fmt.Printf("  Server IP:        %s (%s)\n", serverIP, serverIPSource)
+	fmt.Printf("  TUN Interface:    %s (%s)\n", interfaceName, interfaceSource)
+	fmt.Printf("  MTU:              %d (%s)\n", mtu, mtuSource)
+	fmt.Printf("  TCP MSS Clamp:    %s (%s)\n", mssClamp, mssClampSource)
+	fmt.Printf("  Client Capacity:  %d addresses, %d configured\n", usable, len(clients))
+	fmt.Printf("  Cipher:           %s (%s)\n", cipherName, cipherSource)
+	fmt.Printf("  Server Identity:  %s (%s)\n", identity, identitySource)
+	fmt.Printf("  Protocol Version: %s (byte 0x%02x)\n", protocol.FormatVersion(protocol.ProtocolVersionByte), protocol.ProtocolVersionByte)
+	fmt.Printf("  Client Timeout:   %v (%s)\n", timeout, timeoutSource)
+	fmt.Printf("  Keepalive:        %v (client default, set with fvpc --keepalive)\n", client.DefaultKeepAliveInterval)
+	fmt.Printf("  NAT:              %s (%s)\n", nat, natSource)
+	fmt.Printf("  Push Routes:      %s (%s)\n", routes, routesSource)
+	fmt.Printf("  Health Endpoint:  %s (%s)\n", health, healthSource)
+	fmt.Printf("  Stats Interval:   %s (%s)\n", statsInterval, statsSource)
+
+	return nil
+}
+
+// DryRun runs the server's preflight checks against server.yaml and prints
+// the result of each. It returns true if every check passed.
+func (s *CLIServer) DryRun(checkTUN bool) bool {
+	checks := s.server.Preflight(s.configPath, checkTUN)
+	return printChecks("Dry run:", checks)
+}
+
+// VerifyConfig statically checks the configuration file at configPath and
+// prints the result of each check. It returns true if every check passed.
+func (s *CLIServer) VerifyConfig(configPath string) bool {
+	checks := server.VerifyConfig(configPath)
+	return printChecks("Verifying "+configPath+":", checks)
+}
+
+// printChecks prints a checklist under title, returning true if every check
+// passed
+func printChecks(title string, checks []server.PreflightCheck) bool {
+	passed := true
+	fmt.Println(title)
+	for _, check := range checks {
+		if check.Err != nil {
+			passed = false
+			fmt.Printf("  FAIL %s: %v\n", check.Name, check.Err)
+		} else {
+			fmt.Printf("  ok   %s\n", check.Name)
+		}
+	}
+
+	if passed {
+		fmt.Println("All checks passed")
+	} else {
+		fmt.Println("Some checks failed")
+	}
+	return passed
+}
+
 func (s *CLIServer) ListClientsRealtime() ([]server.ClientStatus, error) {
-	clients := s.server.GetClientStatus()
-	if len(clients) > 0 {
-		return clients, nil
+	if response, err := s.queryServer("list-clients"); err == nil && len(response.Clients) > 0 {
+		return response.Clients, nil
 	}
 	
 	// Fallback to config file if server not running
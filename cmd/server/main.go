@@ -1,16 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/protocol"
 	"github.com/pepalonsocosta/fvp/internal/server"
 )
 
+// limitPollInterval is how often a bounded run checks the packet count
+const limitPollInterval = 100 * time.Millisecond
+
+// defaultConfigPath is the server configuration file commands use unless
+// given --config, before the command or after it
+var defaultConfigPath = "server.yaml"
+
 // version is injected at build time via -ldflags "-X main.version=VERSION"
 // Example: go build -ldflags "-X main.version=1.2.3" -o fvps ./cmd/server
 var version string
@@ -21,6 +34,14 @@ func main() {
 		fmt.Printf("Warning: Failed to initialize protocol version: %v\n", err)
 		fmt.Println("Using default protocol version 1.0.0")
 	}
+
+	// Flags before the command apply to every command
+	global := flag.NewFlagSet("fvps", flag.ExitOnError)
+	global.StringVar(&defaultConfigPath, "config", defaultConfigPath, "Server configuration file")
+	global.Usage = showUsage
+	global.Parse(os.Args[1:])
+	os.Args = append(os.Args[:1], global.Args()...)
+
 	if len(os.Args) < 2 {
 		showUsage()
 		os.Exit(1)
@@ -35,12 +56,26 @@ func main() {
 		handleUp()
 	case "status":
 		handleStatus()
+	case "info":
+		handleInfo()
+	case "verify-config":
+		handleVerifyConfig()
+	case "bench":
+		handleBench()
 	case "add-client":
 		handleAddClient()
 	case "list-clients":
 		handleListClients()
 	case "remove-client":
 		handleRemoveClient()
+	case "disconnect":
+		handleDisconnect()
+	case "reload":
+		handleReload()
+	case "timeout":
+		handleTimeout()
+	case "stats":
+		handleStats()
 	case "version":
 		showVersion()
 	case "help":
@@ -52,10 +87,18 @@ func main() {
 	}
 }
 
+// configFlag adds the --config flag every command takes, defaulting to the
+// one given before the command
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", defaultConfigPath, "Server configuration file")
+}
+
 func handleSetup() {
 	flags := flag.NewFlagSet("setup", flag.ExitOnError)
+	configPath := configFlag(flags)
 	port := flags.String("port", "", "UDP port to listen on (required)")
 	timeout := flags.Int("timeout", 0, "Client timeout in minutes (required)")
+	listen := flags.String("listen", "", "IP address to listen on, instead of all interfaces")
 	
 	flags.Parse(os.Args[2:])
 
@@ -65,47 +108,143 @@ func handleSetup() {
 		os.Exit(1)
 	}
 
-	cliSrv := NewCLIServer()
+	cliSrv := NewCLIServer(*configPath)
 	
-	err := cliSrv.Setup(*port, *timeout)
+	err := cliSrv.Setup(*port, *listen, *timeout)
 	if err != nil {
 		fmt.Printf("Setup failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Configuration created: server.yaml\n")
-	fmt.Printf("Server will listen on port %s\n", *port)
+	fmt.Printf("Configuration created: %s\n", *configPath)
+	if *listen != "" {
+		fmt.Printf("Server will listen on port %s of %s\n", *port, *listen)
+	} else {
+		fmt.Printf("Server will listen on port %s\n", *port)
+	}
 	fmt.Printf("Client timeout: %d minutes\n", *timeout)
 	fmt.Println("Run 'fvps up' to start the server")
 }
 
 func handleUp() {
-	cliSrv := NewCLIServer()
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+	configPath := configFlag(flags)
+	pidFile := flags.String("pidfile", "", "Write the server PID to this file while running")
+	dryRun := flags.Bool("dry-run", false, "Validate the configuration, port and TUN interface, then exit")
+	skipTUN := flags.Bool("skip-tun", false, "With --dry-run, don't check TUN interface creation (no root needed)")
+	maxDuration := flags.Duration("max-duration", 0, "Stop the server after running this long, e.g. 30s (0 runs until signalled)")
+	maxPackets := flags.Uint64("max-packets", 0, "Stop the server after receiving this many packets (0 runs until signalled)")
+	stateFile := flags.String("state-file", "fvps.state", "File recording NAT rules to undo if the server crashes")
+	leaseFile := flags.String("lease-file", "fvps.leases", "File remembering each configured client's tunnel IP across restarts")
+	verbose := flags.Bool("verbose", false, "Log every packet's header and the flow it carries, for debugging tunnels")
+	listen := flags.String("listen", "", "IP address to listen on, overriding listen_address in server.yaml")
+	tunFD := flags.Int("tun-fd", -1, "Use the TUN interface already open as this file descriptor, as configured, instead of creating one")
+	
+	flags.Parse(os.Args[2:])
+
+	cliSrv := NewCLIServer(*configPath)
+	
+	if *dryRun {
+		if !cliSrv.DryRun(!*skipTUN) {
+			os.Exit(1)
+		}
+		return
+	}
+	
+	if *pidFile != "" {
+		err := writePIDFile(*pidFile)
+		if err != nil {
+			fmt.Printf("Failed to start server: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	
-	setupSignalHandling(cliSrv.server)
+	setupSignalHandling(cliSrv.server, *configPath, *pidFile)
+	cliSrv.server.SetPacketTrace(*verbose)
+	cliSrv.server.SetStateFile(*stateFile)
+	cliSrv.server.SetLeaseFile(*leaseFile)
+	cliSrv.server.SetTUNFD(*tunFD)
 	
-	err := cliSrv.server.LoadConfig("server.yaml")
+	err := cliSrv.server.LoadConfig(*configPath)
 	if err != nil {
 		fmt.Printf("Failed to load config: %v\n", err)
-		os.Exit(1)
+		exitUp(*pidFile)
 	}
 	
 	port := cliSrv.server.GetPort()
 	if port == "" {
-		port = ":1194" // Default port
+		port = server.DefaultPort
+	}
+	if *listen != "" {
+		// Keep the configured port number, on the given address instead
+		_, portNumber, _ := net.SplitHostPort(port)
+		port, err = server.ListenAddress(*listen, portNumber)
+		if err != nil {
+			fmt.Printf("Error: --listen: %v\n", err)
+			exitUp(*pidFile)
+		}
 	}
 	
-	err = cliSrv.server.Start("server.yaml", port)
+	err = cliSrv.server.Start(*configPath, port)
 	if err != nil {
 		fmt.Printf("Failed to start server: %v\n", err)
-		os.Exit(1)
+		exitUp(*pidFile)
+	}
+	
+	if *maxDuration > 0 || *maxPackets > 0 {
+		reason := waitForLimit(cliSrv.server, *maxDuration, *maxPackets)
+		fmt.Printf("%s, shutting down...\n", reason)
+		shutdown(cliSrv.server, *pidFile)
 	}
 	
 	<-make(chan struct{})
 }
 
+// waitForLimit blocks until the server has run for maxDuration or received
+// maxPackets packets, whichever comes first, ignoring limits that are zero.
+// It returns a description of the limit that was reached.
+func waitForLimit(srv *server.Server, maxDuration time.Duration, maxPackets uint64) string {
+	var deadline <-chan time.Time
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	
+	ticker := time.NewTicker(limitPollInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-deadline:
+			return fmt.Sprintf("Ran for %s", maxDuration)
+		case <-ticker.C:
+			if maxPackets == 0 {
+				continue
+			}
+			received := srv.GetServerStatus().PacketsReceived
+			if received >= maxPackets {
+				return fmt.Sprintf("Received %d packets", received)
+			}
+		}
+	}
+}
+
+// exitUp removes the PID file and exits after a failed start
+func exitUp(pidFile string) {
+	if pidFile != "" {
+		removePIDFile(pidFile)
+	}
+	os.Exit(1)
+}
+
 func handleStatus() {
-	cliSrv := NewCLIServer()
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := configFlag(flags)
+
+	flags.Parse(os.Args[2:])
+
+	cliSrv := NewCLIServer(*configPath)
 	
 	err := cliSrv.Status()
 	if err != nil {
@@ -114,8 +253,93 @@ func handleStatus() {
 	}
 }
 
+func handleInfo() {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	configPath := configFlag(flags)
+
+	flags.Parse(os.Args[2:])
+
+	cliSrv := NewCLIServer(*configPath)
+	
+	err := cliSrv.Info()
+	if err != nil {
+		fmt.Printf("Failed to show configuration: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func handleVerifyConfig() {
+	flags := flag.NewFlagSet("verify-config", flag.ExitOnError)
+	configPath := configFlag(flags)
+
+	flags.Parse(os.Args[2:])
+
+	// The file may also be given as an argument
+	if flags.NArg() > 0 {
+		*configPath = flags.Arg(0)
+	}
+
+	cliSrv := NewCLIServer(*configPath)
+	if !cliSrv.VerifyConfig(*configPath) {
+		os.Exit(1)
+	}
+}
+
+func handleBench() {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	count := flags.Int("count", 10000, "Number of packets to send")
+	size := flags.Int("size", 1400, "IP packet size in bytes")
+	cipher := flags.String("cipher", "", "Cipher to use (chacha20-poly1305 or aes-256-gcm)")
+	compress := flags.Bool("compress", false, "Negotiate compression, to measure its cost on incompressible data")
+
+	flags.Parse(os.Args[2:])
+
+	opts := BenchOptions{
+		Count:    *count,
+		Size:     *size,
+		Cipher:   *cipher,
+		Compress: *compress,
+	}
+
+	fmt.Printf("Sending %d packets of %d bytes through a loopback tunnel...\n", opts.Count, opts.Size)
+
+	result, err := RunBenchmark(opts)
+	if err != nil {
+		fmt.Printf("Benchmark failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	megabytes := float64(result.Delivered*opts.Size) / 1e6
+	fmt.Printf("Delivered:   %d of %d packets in %s\n", result.Delivered, result.Sent, result.Elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:  %.0f pkts/s, %.1f MB/s\n", result.PacketsPerSecond(), megabytes/result.Elapsed.Seconds())
+	fmt.Printf("Latency:     p50 %s, p99 %s\n", result.Percentile(50).Round(time.Microsecond), result.Percentile(99).Round(time.Microsecond))
+
+	if result.Delivered < result.Sent {
+		fmt.Printf("Warning: %d packets were lost\n", result.Sent-result.Delivered)
+	}
+}
+
 func handleAddClient() {
-	cliSrv := NewCLIServer()
+	flags := flag.NewFlagSet("add-client", flag.ExitOnError)
+	configPath := configFlag(flags)
+	export := flags.String("export", "", "Write a client config file for the new client to this path")
+	host := flags.String("host", "", "Public address clients reach this server at, for --export; asked for if not given")
+
+	flags.Parse(os.Args[2:])
+
+	// Ask before adding the client, so a missing address doesn't leave it
+	// added without a config
+	if *export != "" && *host == "" {
+		fmt.Print("Public address of this server: ")
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		*host = strings.TrimSpace(line)
+		if *host == "" {
+			fmt.Println("Error: --export needs the server's public address, set --host")
+			os.Exit(1)
+		}
+	}
+
+	cliSrv := NewCLIServer(*configPath)
 	
 	clientID, key, err := cliSrv.AddClient()
 	if err != nil {
@@ -125,12 +349,38 @@ func handleAddClient() {
 
 	fmt.Printf("Client added successfully\n")
 	fmt.Printf("Client ID: %d\n", clientID)
-	fmt.Printf("Key: %s\n", key)
-	fmt.Println("Add this key to your client configuration")
+
+	if *export == "" {
+		fmt.Printf("Key: %s\n", key)
+		fmt.Println("Add this key to your client configuration")
+		return
+	}
+
+	err = cliSrv.ExportClient(clientID, *host, *export)
+	if err != nil {
+		fmt.Printf("Failed to export client config: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Client config written to %s, use it with: fvpc connect --config %s\n", *export, *export)
 }
 
 func handleListClients() {
-	cliSrv := NewCLIServer()
+	flags := flag.NewFlagSet("list-clients", flag.ExitOnError)
+	configPath := configFlag(flags)
+	watch := flags.Bool("watch", false, "Redraw the table every second from the running server until interrupted")
+
+	flags.Parse(os.Args[2:])
+
+	cliSrv := NewCLIServer(*configPath)
+
+	if *watch {
+		_, err := cliSrv.queryServer("list-clients")
+		if err == nil {
+			watchClients(cliSrv)
+			return
+		}
+		fmt.Printf("Server not reachable (%v), showing configured clients once\n", err)
+	}
 	
 	clients, err := cliSrv.ListClientsRealtime()
 	if err != nil {
@@ -144,7 +394,50 @@ func handleListClients() {
 	}
 
 	fmt.Println("Client Status:")
-	fmt.Println("ID  IP         Status     Last Connection")
+	printClientTable(clients, time.Time{})
+}
+
+// watchInterval is how often list-clients --watch redraws the table
+const watchInterval = time.Second
+
+// watchClients redraws the running server's clients every watchInterval,
+// like top, until interrupted or the server stops answering
+func watchClients(cliSrv *CLIServer) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		response, err := cliSrv.queryServer("list-clients")
+		if err != nil {
+			fmt.Printf("Server stopped answering: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Move to the top left and clear the screen before each frame
+		now := time.Now()
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Every %s: fvps list-clients    %s\n\n", watchInterval, now.Format("2006-01-02 15:04:05"))
+		if len(response.Clients) == 0 {
+			fmt.Println("No clients connected")
+		} else {
+			printClientTable(response.Clients, now)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// printClientTable prints a row per client. Last connection times are shown
+// as ages relative to now, unless now is zero.
+func printClientTable(clients []server.ClientStatus, now time.Time) {
+	fmt.Println("ID  IP         Status     Last Connection       Rx          Tx          Wire Rx/Tx       RTT       Uptime")
 	for _, client := range clients {
 		status := "Disconnected"
 		if client.Connected {
@@ -152,16 +445,48 @@ func handleListClients() {
 		}
 		
 		lastSeen := "Never"
-		if !client.LastSeen.IsZero() {
+		if !client.LastSeen.IsZero() && !now.IsZero() {
+			lastSeen = now.Sub(client.LastSeen).Round(time.Second).String() + " ago"
+		} else if !client.LastSeen.IsZero() {
 			lastSeen = client.LastSeen.Format("2006-01-02 15:04:05")
 		}
-		fmt.Printf("%-3d %-10s %-11s %s\n", client.ID, client.IP, status, lastSeen)
+		rx := fmt.Sprintf("%s/%d", formatBytes(client.BytesRx), client.PacketsRx)
+		tx := fmt.Sprintf("%s/%d", formatBytes(client.BytesTx), client.PacketsTx)
+		wire := fmt.Sprintf("%s/%s", formatBytes(client.WireBytesRx), formatBytes(client.WireBytesTx))
+		rtt := "-"
+		if client.RTT > 0 {
+			rtt = client.RTT.Round(100 * time.Microsecond).String()
+		}
+		uptime := "-"
+		if client.Connected && client.Uptime > 0 {
+			uptime = client.Uptime.Round(time.Second).String()
+		}
+		fmt.Printf("%-3d %-10s %-11s %-20s %-11s %-11s %-16s %-9s %s\n", client.ID, client.IP, status, lastSeen, rx, tx, wire, rtt, uptime)
+	}
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5KiB"
+func formatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value := float64(bytes) / unit
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if value < unit || suffix == "TiB" {
+			return fmt.Sprintf("%.1f%s", value, suffix)
+		}
+		value /= unit
 	}
+	return ""
 }
 
 func handleRemoveClient() {
 	flags := flag.NewFlagSet("remove-client", flag.ExitOnError)
+	configPath := configFlag(flags)
 	clientID := flags.Int("id", 0, "Client ID to remove (required)")
+	pidFile := flags.String("pidfile", "", "Also disconnect the client from the server whose PID is in this file")
 	
 	flags.Parse(os.Args[2:])
 
@@ -171,8 +496,11 @@ func handleRemoveClient() {
 		os.Exit(1)
 	}
 
-	cliSrv := NewCLIServer()
-	
+	cliSrv := NewCLIServer(*configPath)
+
+	// Asked before the reload, which drops the session
+	connected := cliSrv.IsConnected(uint8(*clientID))
+
 	err := cliSrv.RemoveClient(uint8(*clientID))
 	if err != nil {
 		fmt.Printf("Failed to remove client: %v\n", err)
@@ -180,24 +508,167 @@ func handleRemoveClient() {
 	}
 
 	fmt.Printf("Client %d removed successfully\n", *clientID)
+
+	// A running server reachable on its admin socket drops the client now
+	if cliSrv.Reload() == nil {
+		if connected {
+			fmt.Printf("Running server disconnected client %d\n", *clientID)
+		} else {
+			fmt.Printf("Running server reloaded, client %d was not connected\n", *clientID)
+		}
+		return
+	}
+
+	if *pidFile != "" {
+		err = signalReload(*pidFile)
+		if err != nil {
+			fmt.Printf("Failed to disconnect client from the running server: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Running server told to disconnect client %d\n", *clientID)
+	}
 }
 
-func setupSignalHandling(srv *server.Server) {
+func handleDisconnect() {
+	flags := flag.NewFlagSet("disconnect", flag.ExitOnError)
+	configPath := configFlag(flags)
+	clientID := flags.Int("id", 0, "Live client ID to disconnect (required)")
+	
+	flags.Parse(os.Args[2:])
+
+	if *clientID <= 0 || *clientID > server.MaxClients {
+		fmt.Println("Error: --id is required")
+		fmt.Println("Usage: fvps disconnect --id <client_id>")
+		os.Exit(1)
+	}
+
+	cliSrv := NewCLIServer(*configPath)
+	
+	err := cliSrv.Disconnect(uint8(*clientID))
+	if err != nil {
+		fmt.Printf("Failed to disconnect client: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Client %d disconnected\n", *clientID)
+}
+
+func handleStats() {
+	if len(os.Args) < 3 || os.Args[2] != "reset" {
+		fmt.Println("Usage: fvps stats reset")
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("stats reset", flag.ExitOnError)
+	configPath := configFlag(flags)
+
+	flags.Parse(os.Args[3:])
+
+	cliSrv := NewCLIServer(*configPath)
+	
+	err := cliSrv.ResetStats()
+	if err != nil {
+		fmt.Printf("Failed to reset stats: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Traffic counters reset")
+}
+
+func handleTimeout() {
+	flags := flag.NewFlagSet("timeout", flag.ExitOnError)
+	configPath := configFlag(flags)
+
+	flags.Parse(os.Args[2:])
+
+	var timeout time.Duration
+	if flags.NArg() > 1 {
+		fmt.Println("Usage: fvps timeout [duration]")
+		os.Exit(1)
+	}
+	if flags.NArg() == 1 {
+		var err error
+		timeout, err = time.ParseDuration(flags.Arg(0))
+		if err != nil || timeout <= 0 {
+			fmt.Printf("Error: invalid timeout %q: must be a positive duration, e.g. 2h\n", flags.Arg(0))
+			os.Exit(1)
+		}
+	}
+
+	cliSrv := NewCLIServer(*configPath)
+
+	current, err := cliSrv.Timeout(timeout)
+	if err != nil {
+		fmt.Printf("Failed to query client timeout: %v\n", err)
+		os.Exit(1)
+	}
+
+	if timeout != 0 {
+		fmt.Printf("Client timeout set to %s until the server restarts\n", current)
+		return
+	}
+	fmt.Printf("Client timeout: %s\n", current)
+}
+
+func handleReload() {
+	flags := flag.NewFlagSet("reload", flag.ExitOnError)
+	configPath := configFlag(flags)
+
+	flags.Parse(os.Args[2:])
+
+	cliSrv := NewCLIServer(*configPath)
+	
+	err := cliSrv.Reload()
+	if err != nil {
+		fmt.Printf("Failed to reload server: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Server configuration reloaded")
+}
+
+func setupSignalHandling(srv *server.Server, configPath, pidFile string) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	
 	go func() {
-		sig := <-sigChan
-		fmt.Printf("\nReceived %v, shutting down gracefully...\n", sig)
-		
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				// Reload client keys; new keys apply to new handshakes and
+				// clients whose keys were removed are disconnected
+				fmt.Println("Received SIGHUP, reloading configuration...")
+				err := srv.Reload(configPath)
+				if err != nil {
+					fmt.Printf("Failed to reload config, keeping current settings: %v\n", err)
+				}
+				continue
+			}
+			
+			fmt.Printf("\nReceived %v, shutting down gracefully...\n", sig)
+			shutdown(srv, pidFile)
+		}
+	}()
+}
+
+// shutdownOnce makes sure a signal arriving while a bounded run is stopping
+// the server doesn't stop it a second time
+var shutdownOnce sync.Once
+
+// shutdown stops the server, removes the PID file and exits
+func shutdown(srv *server.Server, pidFile string) {
+	shutdownOnce.Do(func() {
 		err := srv.Stop()
 		if err != nil {
 			fmt.Printf("Error during shutdown: %v\n", err)
 		}
 		
+		if pidFile != "" {
+			removePIDFile(pidFile)
+		}
+		
 		fmt.Println("Server stopped")
 		os.Exit(0)
-	}()
+	})
 }
 
 func showVersion() {
@@ -214,21 +685,50 @@ func showUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  fvps <command> [flags]")
 	fmt.Println()
+	fmt.Println("Every command takes --config <file>, before or after it, to use a")
+	fmt.Println("configuration file other than server.yaml in the current directory.")
+	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("  setup         Create initial server configuration")
 	fmt.Println("  up            Start the VPN server")
 	fmt.Println("  status        Show server status")
+	fmt.Println("  info          Show effective configuration and limits")
+	fmt.Println("  verify-config Check a config file's keys, client IDs, subnet and ports")
+	fmt.Println("  bench         Measure tunnel throughput on loopback (no root needed)")
 	fmt.Println("  add-client    Add a new client")
 	fmt.Println("  list-clients  List all configured clients")
 	fmt.Println("  remove-client Remove a client")
+	fmt.Println("  disconnect    Drop a live client session")
+	fmt.Println("  reload        Reload client keys on the running server")
+	fmt.Println("  timeout       Show or change the running server's client timeout")
+	fmt.Println("  stats reset   Zero the running server's traffic counters")
 	fmt.Println("  version       Show version information")
 	fmt.Println("  help          Show this help message")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  fvps setup --port 1194 --timeout 30")
+	fmt.Println("  fvps --config /etc/fvp/server.yaml up")
 	fmt.Println("  fvps up")
+	fmt.Println("  fvps up --pidfile /run/fvps.pid")
+	fmt.Println("  fvps up --state-file /var/lib/fvp/fvps.state")
+	fmt.Println("  fvps up --lease-file /var/lib/fvp/fvps.leases")
+	fmt.Println("  fvps up --dry-run")
+	fmt.Println("  fvps up --max-duration 30s --max-packets 1000")
+	fmt.Println("  fvps up --verbose")
+	fmt.Println("  fvps up --listen 203.0.113.5")
+	fmt.Println("  fvps up --tun-fd 3")
 	fmt.Println("  fvps status")
+	fmt.Println("  fvps info")
+	fmt.Println("  fvps verify-config server.yaml")
+	fmt.Println("  fvps bench --size 1400 --count 10000")
 	fmt.Println("  fvps add-client")
+	fmt.Println("  fvps add-client --export client2.yaml --host vpn.example.com")
 	fmt.Println("  fvps list-clients")
+	fmt.Println("  fvps list-clients --watch")
 	fmt.Println("  fvps remove-client --id 1")
+	fmt.Println("  fvps remove-client --id 1 --pidfile /run/fvps.pid")
+	fmt.Println("  fvps disconnect --id 3")
+	fmt.Println("  fvps reload")
+	fmt.Println("  fvps timeout 2h")
+	fmt.Println("  fvps stats reset")
 }
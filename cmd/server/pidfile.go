@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile records the current process ID at path. A PID file left
+// behind by a crashed server is replaced with a warning; one belonging to a
+// running process is an error.
+func writePIDFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		pid, parseErr := strconv.Atoi(strings.TrimSpace(string(data)))
+		if parseErr == nil && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("server already running with PID %d (%s)", pid, path)
+		}
+		fmt.Printf("Warning: removing stale PID file %s\n", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read PID file: %w", err)
+	}
+
+	err = os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write PID file: %w", err)
+	}
+
+	return nil
+}
+
+// removePIDFile deletes the PID file if it still belongs to this process
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+
+	os.Remove(path)
+}
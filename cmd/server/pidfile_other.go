@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// signalReload can't signal a server on this platform; a running server is
+// reloaded through its admin socket instead
+func signalReload(path string) error {
+	return fmt.Errorf("signaling the server is not supported on %s; reload it through its admin socket", runtime.GOOS)
+}
+
+// processExists reports whether a process with the PID can be found. Unlike
+// on Unix, finding a process here fails once it has exited.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signalReload sends SIGHUP to the server whose PID is recorded at path, so it
+// reloads server.yaml and disconnects clients whose keys were removed
+func signalReload(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read PID file: %w", err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid PID file %s: %w", path, err)
+	}
+
+	err = syscall.Kill(pid, syscall.SIGHUP)
+	if err != nil {
+		return fmt.Errorf("failed to signal server with PID %d: %w", pid, err)
+	}
+
+	return nil
+}
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
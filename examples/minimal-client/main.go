@@ -0,0 +1,53 @@
+// Command minimal-client is a VPN client built only on the public pkg/fvp
+// API. It connects to a server, prints the tunnel address it was given and
+// stays connected until interrupted.
+//
+//	sudo go run ./examples/minimal-client 192.168.1.100:1194
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pepalonsocosta/fvp/pkg/fvp"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("Usage: minimal-client <server-ip>:<port>")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c := fvp.NewClient(os.Args[1])
+	err := c.ConnectContext(ctx)
+	if errors.Is(err, fvp.ErrAuthTimeout) {
+		fmt.Println("No answer from the server, is it running?")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Failed to connect: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Connected as client %d with address %s using %s\n",
+		c.GetClientID(), c.GetAssignedIP(), c.GetCipher().Name())
+
+	select {
+	case <-ctx.Done():
+	case <-c.ServerClosed():
+		fmt.Println("Server ended the session")
+	}
+
+	err = c.Disconnect()
+	if err != nil {
+		fmt.Printf("Error during disconnect: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,10 +1,21 @@
 package client
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/crypto"
@@ -12,88 +23,437 @@ import (
 	"github.com/pepalonsocosta/fvp/internal/protocol"
 )
 
+// DefaultKeepAliveInterval is how often an idle client pings the server. It
+// must stay well below the server timeout and any NAT mapping timeout on the
+// path.
+const DefaultKeepAliveInterval = 30 * time.Second
+
+// DefaultAuthTimeout is how long the client waits for each auth response,
+// and DefaultAuthRetries how many times it resends the request before
+// giving up
+const (
+	DefaultAuthTimeout = 3 * time.Second
+	DefaultAuthRetries = 2
+)
+
+// DefaultInterfaceName is the TUN interface the client creates by default
+const DefaultInterfaceName = "fvp-client0"
+
+// MinClampMTU is the smallest MTU every IPv4 host must support, below which
+// SetClampMSS refuses to clamp
+const MinClampMTU = 576
+
+// DialFunc opens the connection a client talks to the server at address over
+type DialFunc func(ctx context.Context, address string) (net.Conn, error)
+
 // Client represents a VPN client
 type Client struct {
-	serverAddr     string
+	serverAddr     string   // Server currently in use
+	servers        []string // Servers to try, in order
+	serverIndex    int      // Index of serverAddr in servers
 	clientID       uint8
 	key            []byte
+	presharedID    uint8  // Client ID the pre-shared key is registered under
+	presharedKey   []byte // Pre-shared key, nil when the server assigns one
 	assignedIP     string
 	tunInterface   network.TUNInterface
-	udpConn        *net.UDPConn
+	tunQueue       *network.WriteQueue // Writes received packets to tunInterface
+	interfaceName  string              // Name of the TUN interface to create
+	conn           net.Conn            // Connection to the server, a UDP socket unless SetDialer says otherwise
+	dataConn       net.Conn            // Connection to the server's data socket, which data packets go over; nil sends them over conn
+	dataPort       uint16              // Port of the server's data socket, zero if it has none
+	dial           DialFunc            // Opens conn; nil dials UDP
+	localAddr      *net.UDPAddr        // Address to send from; nil picks a random port on every connect
+	killSwitch     bool                // Block traffic outside the tunnel from connecting until Disconnect
+	firewall       *network.KillSwitch // Installed kill switch, kept across reconnects
+	pinned         map[string]string   // Resolved address of each server, dialed while the kill switch blocks DNS
+	networkKey     []byte              // Key for the network MAC on every datagram; nil disables it
+	serverIdentity ed25519.PublicKey   // Identity key the server must sign its auth response with; nil accepts any server
 	sequence       uint32
-	connected      bool
+	sendMutex      sync.Mutex          // Held while a sequence is used, so concurrent senders never share one, and while session state is swapped
+	version        uint8               // Protocol version negotiated with the server
+	cipher         crypto.Cipher       // Cipher suite selected by the server
+	keys           *crypto.KeyRing     // Per-direction data keys for this session, replaced by rekeys
+	sessionNonce   []byte              // Nonce sent in the auth request
+	authOptions    []byte              // Encoded options of the auth request, which the server's identity signature covers
+	rekey          bool                // Rekeys accepted by the server for this session
+	rekeyInterval  time.Duration       // How often to replace the session keys; zero leaves it to the server
+	rekeyBytes     uint64              // Payload bytes after which to replace the session keys; zero leaves it to the server
+	keepAlive      time.Duration       // Interval between keepalive pings
+	authTimeout    time.Duration       // How long to wait for each auth response
+	authRetries    int                 // Times the auth request is resent before giving up
+	wantCompress   bool                // Request payload compression at handshake
+	requestedIP    net.IP              // Preferred tunnel address, nil to take any
+	insecure       bool                // Encryption disabled; only a server that also disabled it is accepted
+	compress       bool                // Compression accepted by the server
+	maxMSS         uint16              // TCP MSS clamp for tunneled SYNs, zero to leave them alone
+	mtu            int                 // Largest tunneled IP packet, zero for network.DefaultMTU
+	maxUDPPayload  int                 // Largest datagram to send, zero for no limit
+	dscp           int                 // DSCP marked on datagrams to the server, zero for none
+	oversized      atomic.Uint64       // Packets dropped for not fitting in maxUDPPayload
+	routes         []*net.IPNet        // Networks the server advertises as reachable through the tunnel
+	rtt            *rttTracker         // Round-trip time measured with pings
+	trace          bool                // Log every packet sent and received, see SetPacketTrace
+	receiveHandler func([]byte)        // Takes decrypted payloads in place of the TUN interface, see Receive
+	connected      atomic.Bool   // Set while a session is up; Send reads it from other goroutines
+	serverClosed   chan struct{} // Closed when the server ends this session
 	stopChan       chan struct{}
 	wg             sync.WaitGroup
 }
 
-// NewClient creates a new VPN client
+// NewClient creates a new VPN client. serverAddr may list several
+// comma-separated fallback servers, which are tried in order.
 func NewClient(serverAddr string) *Client {
+	servers := parseServerList(serverAddr)
 	return &Client{
-		serverAddr:   serverAddr,
-		clientID:     0, // Will be assigned by server
-		key:          nil, // Will be assigned by server
-		assignedIP:   "", // Will be assigned by server
-		tunInterface: network.NewTunManager(),
-		sequence:     1,
-		connected:    false,
-		stopChan:     make(chan struct{}),
+		serverAddr:    servers[0],
+		servers:       servers,
+		clientID:      0, // Will be assigned by server
+		key:           nil, // Will be assigned by server
+		assignedIP:    "", // Will be assigned by server
+		tunInterface:  network.NewTunManager(),
+		interfaceName: DefaultInterfaceName,
+		sequence:      1,
+		cipher:        crypto.DefaultCipher(),
+		keepAlive:     DefaultKeepAliveInterval,
+		authTimeout:   DefaultAuthTimeout,
+		authRetries:   DefaultAuthRetries,
+		rtt:           newRTTTracker(time.Now),
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// NewClientWithTUN creates a new VPN client backed by the given TUN interface
+func NewClientWithTUN(serverAddr string, tunInterface network.TUNInterface) *Client {
+	c := NewClient(serverAddr)
+	c.tunInterface = tunInterface
+	return c
+}
+
+// parseServerList splits a comma-separated server list, dropping blanks
+func parseServerList(serverAddr string) []string {
+	var servers []string
+	for _, addr := range strings.Split(serverAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			servers = append(servers, addr)
+		}
 	}
+	if len(servers) == 0 {
+		servers = []string{serverAddr}
+	}
+	return servers
 }
 
+// Connect connects to the server, waiting for the handshake as set by
+// SetAuthTimeout, about 9 seconds by default
 func (c *Client) Connect() error {
-	log.Printf("Connecting to VPN server at %s", c.serverAddr)
+	return c.ConnectContext(context.Background())
+}
 
-	serverAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve server address: %w", err)
+// ConnectContext connects to the first server that completes the handshake,
+// starting from the current one and moving down the list on failure, giving
+// up when ctx is cancelled or its deadline passes. Anything set up before a
+// failure is torn down.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	var lastErr error
+	for attempt := 0; attempt < len(c.servers); attempt++ {
+		if attempt > 0 {
+			c.rotateServer()
+		}
+
+		lastErr = c.connectToServer(ctx)
+		if lastErr == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return lastErr
+		}
+
+		log.Printf("Failed to connect to %s: %v", c.serverAddr, lastErr)
+	}
+
+	if len(c.servers) == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("all %d servers failed, last error: %w", len(c.servers), lastErr)
+}
+
+// Reconnect tears down the current connection and connects again, starting
+// with the server after the one in use. The kill switch, if on, stays up
+// throughout.
+func (c *Client) Reconnect(ctx context.Context) error {
+	if c.connected.Load() {
+		c.disconnect()
 	}
 
-	c.udpConn, err = net.DialUDP("udp", nil, serverAddr)
+	// Start a fresh session; the next server assigns its own ID and key
+	c.stopChan = make(chan struct{})
+	c.sendMutex.Lock()
+	c.clientID = 0
+	c.sequence = 1
+	c.sendMutex.Unlock()
+
+	c.rotateServer()
+	return c.ConnectContext(ctx)
+}
+
+// rotateServer makes the next server in the list the current one
+func (c *Client) rotateServer() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	c.serverIndex = (c.serverIndex + 1) % len(c.servers)
+	c.serverAddr = c.servers[c.serverIndex]
+}
+
+func (c *Client) connectToServer(ctx context.Context) error {
+	log.Printf("Connecting to VPN server at %s", c.serverAddr)
+
+	dial := c.dial
+	if dial == nil {
+		dial = c.dialUDP
+	}
+	conn, err := dial(ctx, c.dialAddress(c.serverAddr))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("%w: %s, choose another local port or stop whatever is using it", ErrLocalAddrInUse, c.localAddr)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %w", err)
 	}
+	c.sendMutex.Lock()
+	c.conn = conn
+	c.sendMutex.Unlock()
 
-	err = c.sendAuthRequest()
+	err = c.authenticate(ctx)
 	if err != nil {
-		c.udpConn.Close()
-		return fmt.Errorf("failed to send auth request: %w", err)
+		c.conn.Close()
+		return err
 	}
 
-	err = c.waitForAuthResponse()
-	if err != nil {
-		c.udpConn.Close()
-		return fmt.Errorf("authentication failed: %w", err)
+	if err := ctx.Err(); err != nil {
+		c.conn.Close()
+		return err
 	}
 
-	err = c.tunInterface.Create("fvp-client0")
+	if setter, ok := c.tunInterface.(network.MTUSetter); ok && !c.tunInterface.IsCreated() {
+		setter.SetMTU(c.mtu)
+	}
+	err = c.tunInterface.Create(c.interfaceName)
 	if err != nil {
-		c.udpConn.Close()
+		c.conn.Close()
 		return fmt.Errorf("failed to create TUN interface: %w", err)
 	}
 
 	// Step 5: Configure TUN interface with assigned IP
 	err = c.tunInterface.ConfigureClientInterface(c.assignedIP)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		c.tunInterface.Close()
-		c.udpConn.Close()
+		c.conn.Close()
 		return fmt.Errorf("failed to configure TUN interface: %w", err)
 	}
 	
 	log.Printf("TUN interface configured with IP %s", c.assignedIP)
 
+	// Packets sent before the kernel has the interface up would be dropped
+	if checker, ok := c.tunInterface.(network.ReadinessChecker); ok {
+		ready := func() (bool, error) { return checker.InterfaceReady(c.assignedIP) }
+		err = waitForInterface(ctx, ready, interfaceReadyTimeout, interfaceReadyPoll)
+		if ctx.Err() != nil {
+			c.tunInterface.Close()
+			c.conn.Close()
+			return fmt.Errorf("failed to configure TUN interface: %w", ctx.Err())
+		}
+		if err != nil {
+			log.Printf("Warning: %v; the first packets may be dropped", err)
+		}
+	}
+
+	// Rules left from before a reconnect stay in place
+	if c.killSwitch && c.firewall == nil {
+		err = c.enableKillSwitch()
+		if err != nil {
+			c.tunInterface.Close()
+			c.conn.Close()
+			return err
+		}
+	}
+
+	// Data packets go to the server's data socket, if it has one
+	var dataConn net.Conn
+	if c.dataPort != 0 {
+		dataConn = c.dialDataSocket(ctx)
+	}
+	c.sendMutex.Lock()
+	c.dataConn = dataConn
+	c.sendMutex.Unlock()
+
 	// Step 6: Start packet processing
-	c.connected = true
+	c.connected.Store(true)
+	c.serverClosed = make(chan struct{})
+	c.tunQueue = network.NewWriteQueue(c.tunInterface, network.DefaultWriteQueueSize)
 	c.startPacketProcessing()
 
 	log.Printf("Successfully connected to VPN server. Client ID: %d, IP: %s", c.clientID, c.assignedIP)
 	return nil
 }
 
-// Disconnect closes the VPN connection
+// interfaceReadyTimeout is how long Connect waits for the TUN interface to
+// come up with its address, polling every interfaceReadyPoll
+const (
+	interfaceReadyTimeout = 2 * time.Second
+	interfaceReadyPoll    = 20 * time.Millisecond
+)
+
+// waitForInterface polls ready every interval until it reports true, and
+// fails if that takes longer than timeout or ctx is done first
+func waitForInterface(ctx context.Context, ready func() (bool, error), timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		ok, err := ready()
+		if ok {
+			return nil
+		}
+		lastErr = err
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("TUN interface not ready after %s: %w", timeout, lastErr)
+			}
+			return fmt.Errorf("TUN interface not up with its address after %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// dialUDP opens a UDP socket to address, from the local port if one is set
+func (c *Client) dialUDP(ctx context.Context, address string) (net.Conn, error) {
+	return c.dialUDPFrom(ctx, address, c.localAddr)
+}
+
+// dialDataSocket connects to the data socket the server offered, on the same
+// host as the server. It returns nil if that fails, leaving data packets to
+// go over conn with the rest.
+func (c *Client) dialDataSocket(ctx context.Context) net.Conn {
+	host, _, err := net.SplitHostPort(c.dialAddress(c.serverAddr))
+	if err != nil {
+		log.Printf("Warning: failed to find the server's data socket: %v; sending data packets with control packets", err)
+		return nil
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(c.dataPort)))
+
+	// The local port, if one is set, is already taken by conn
+	var conn net.Conn
+	if c.dial != nil {
+		conn, err = c.dial(ctx, address)
+	} else {
+		conn, err = c.dialUDPFrom(ctx, address, nil)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to connect to the server's data socket at %s: %v; sending data packets with control packets", address, err)
+		return nil
+	}
+
+	log.Printf("Sending data packets to the server's data socket at %s", address)
+	return conn
+}
+
+// dialUDPFrom opens a UDP socket to address from localAddr, or from a random
+// port if it is nil
+func (c *Client) dialUDPFrom(ctx context.Context, address string, localAddr *net.UDPAddr) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let the kernel fragment datagrams over the path MTU rather than drop
+	// them
+	if sc, ok := conn.(syscall.Conn); ok {
+		err = network.AllowFragmentation(sc)
+		if err != nil {
+			log.Printf("Warning: %v; datagrams over the path MTU may be dropped", err)
+		}
+	}
+	if c.dscp != 0 {
+		err = network.SetDSCP(conn, c.dscp)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// dialAddress returns the address to dial for server: the one it resolved to
+// when the kill switch went up, if it is up, since DNS is blocked
+func (c *Client) dialAddress(server string) string {
+	if pinned, ok := c.pinned[server]; ok {
+		return pinned
+	}
+	return server
+}
+
+// enableKillSwitch blocks traffic outside the tunnel, letting UDP to every
+// server in the list through. Server names are resolved once here.
+func (c *Client) enableKillSwitch() error {
+	pinned := make(map[string]string)
+	var ips []net.IP
+	for _, server := range c.servers {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			log.Printf("Warning: failed to resolve %s, it is unreachable while the kill switch is on: %v", server, err)
+			continue
+		}
+		pinned[server] = addr.String()
+		ips = append(ips, addr.IP)
+	}
+
+	killSwitch := network.NewKillSwitch(c.tunInterface.GetName(), ips)
+	err := killSwitch.Enable()
+	if err != nil {
+		return err
+	}
+
+	c.firewall = killSwitch
+	c.pinned = pinned
+	return nil
+}
+
+// Disconnect closes the VPN connection and removes the kill switch, if on
 func (c *Client) Disconnect() error {
+	c.disconnect()
+
+	if c.firewall != nil {
+		err := c.firewall.Disable()
+		c.firewall = nil
+		c.pinned = nil
+		if err != nil {
+			return fmt.Errorf("failed to remove kill switch: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// disconnect closes the VPN connection, leaving the kill switch in place
+func (c *Client) disconnect() {
 	log.Printf("Disconnecting from VPN server")
 
-	c.connected = false
+	c.connected.Store(false)
 
 	// Signal all goroutines to stop
 	close(c.stopChan)
@@ -101,20 +461,37 @@ func (c *Client) Disconnect() error {
 	// Wait for all goroutines to finish
 	c.wg.Wait()
 
-	// Close connections
-	if c.udpConn != nil {
-		c.udpConn.Close()
+	// Flush packets still waiting for the TUN interface
+	if c.tunQueue != nil {
+		c.tunQueue.Close()
+	}
+
+	// Close connections, once a Send in progress has finished with them
+	c.sendMutex.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.dataConn != nil {
+		c.dataConn.Close()
+		c.dataConn = nil
 	}
+	c.sendMutex.Unlock()
 	if c.tunInterface != nil {
 		c.tunInterface.Close()
 	}
 
 	log.Printf("Disconnected from VPN server")
-	return nil
+}
+
+// ServerClosed returns a channel that is closed when the server ends the
+// current session, e.g. because it is shutting down. The connection is left
+// open; callers should Reconnect, which moves on to the next server.
+func (c *Client) ServerClosed() <-chan struct{} {
+	return c.serverClosed
 }
 
 func (c *Client) IsConnected() bool {
-	return c.connected
+	return c.connected.Load()
 }
 
 func (c *Client) GetClientID() uint8 {
@@ -125,57 +502,600 @@ func (c *Client) GetAssignedIP() string {
 	return c.assignedIP
 }
 
-func (c *Client) sendAuthRequest() error {
-	authPacket := protocol.CreateAuthPacket(c.clientID, c.sequence, []byte{})
-	
-	packetData, err := protocol.EncodePacket(authPacket)
+// GetRoutes returns the networks the server advertised at the handshake as
+// reachable through the tunnel. The client doesn't install them itself.
+func (c *Client) GetRoutes() []*net.IPNet {
+	return c.routes
+}
+
+// DroppedPackets returns how many packets from the server were dropped this
+// session because the TUN interface couldn't keep up
+func (c *Client) DroppedPackets() uint64 {
+	if c.tunQueue == nil {
+		return 0
+	}
+	return c.tunQueue.Dropped()
+}
+
+// OversizedPackets returns how many packets from the TUN interface were
+// dropped because their datagram wouldn't fit in the SetMaxUDPPayload limit
+func (c *Client) OversizedPackets() uint64 {
+	return c.oversized.Load()
+}
+
+// SetKeepAliveInterval sets how often the client pings the server. Call it
+// before Connect; non-positive intervals are ignored.
+func (c *Client) SetKeepAliveInterval(interval time.Duration) {
+	if interval > 0 {
+		c.keepAlive = interval
+	}
+}
+
+// GetKeepAliveInterval returns the interval between keepalive pings
+func (c *Client) GetKeepAliveInterval() time.Duration {
+	return c.keepAlive
+}
+
+// SetPreSharedKey authenticates as a client configured on the server instead
+// of asking to be assigned an ID and key. It must be called before Connect.
+func (c *Client) SetPreSharedKey(clientID uint8, key []byte) {
+	c.presharedID = clientID
+	c.presharedKey = append([]byte(nil), key...)
+}
+
+// SetInterfaceName sets the name of the TUN interface created on connect, so
+// several clients can run on one host. Call it before Connect; an empty name
+// is ignored.
+func (c *Client) SetInterfaceName(name string) {
+	if name != "" {
+		c.interfaceName = name
+	}
+}
+
+// GetInterfaceName returns the name of the client's TUN interface
+func (c *Client) GetInterfaceName() string {
+	return c.interfaceName
+}
+
+// SetCompression asks the server to compress data payloads in both
+// directions, which helps on slow links. Call it before Connect; servers
+// that don't support compression leave it off.
+func (c *Client) SetCompression(enabled bool) {
+	c.wantCompress = enabled
+}
+
+// SetRequestedIP asks the server for a specific tunnel address. The server
+// gives it if it is free and within its subnet, and otherwise assigns another
+// one, which GetAssignedIP reports. Call it before Connect.
+func (c *Client) SetRequestedIP(ip string) error {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return fmt.Errorf("invalid requested IP %q: must be an IPv4 address", ip)
+	}
+	c.requestedIP = parsed
+	return nil
+}
+
+// SetLocalPort makes the client send from a fixed UDP port, so firewall
+// rules can name it and NAT mappings survive reconnects. Zero, the default,
+// lets the OS pick a fresh random port on every connect and reconnect. Call
+// it before Connect.
+func (c *Client) SetLocalPort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid local port %d: must be between 0 and 65535", port)
+	}
+	if port == 0 {
+		c.localAddr = nil
+		return nil
+	}
+	c.localAddr = &net.UDPAddr{Port: port}
+	return nil
+}
+
+// GetLocalAddr returns the address the client sends from, or nil if it has
+// never connected
+func (c *Client) GetLocalAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// SetClampMSS lowers the MSS of TCP connections through the tunnel to fit
+// mtu, the largest IP packet the tunnel carries, so large transfers don't
+// stall when path MTU discovery is blocked. Zero disables clamping. Call it
+// before Connect.
+func (c *Client) SetClampMSS(mtu int) error {
+	if mtu != 0 && (mtu < MinClampMTU || mtu > 65535) {
+		return fmt.Errorf("invalid MSS clamp MTU %d: must be between %d and 65535", mtu, MinClampMTU)
+	}
+	c.maxMSS = network.MSSForMTU(mtu)
+	return nil
+}
+
+// SetMTU sets the largest IP packet the tunnel carries, e.g. 9000 on links
+// with jumbo frames, giving the TUN interface that MTU and sizing reads from
+// the server to match. It should equal the server's mtu. Zero selects
+// network.DefaultMTU. Call it before Connect.
+func (c *Client) SetMTU(mtu int) error {
+	maximum := protocol.MaxInnerPacketSize(65507, protocol.ProtocolVersionMajor, crypto.CipherOverhead, true)
+	if mtu != 0 && (mtu < MinClampMTU || mtu > maximum) {
+		return fmt.Errorf("invalid MTU %d: must be between %d and %d", mtu, MinClampMTU, maximum)
+	}
+	c.mtu = mtu
+	return nil
+}
+
+// maxDatagramSize is the largest datagram the server sends: an MTU-sized IP
+// packet plus the packet header, authentication tag and network MAC
+func (c *Client) maxDatagramSize() int {
+	mtu := c.mtu
+	if mtu == 0 {
+		mtu = network.DefaultMTU
+	}
+	return protocol.DatagramOverhead(protocol.ProtocolVersionMajor, crypto.CipherOverhead, true) + mtu
+}
+
+// SetMaxUDPPayload caps the datagrams sent to the server at size bytes,
+// dropping packets that wouldn't fit instead of leaving them to be
+// fragmented or lost on the path. Zero removes the limit. Call it before
+// Connect.
+func (c *Client) SetMaxUDPPayload(size int) error {
+	if size == 0 {
+		c.maxUDPPayload = 0
+		return nil
+	}
+	minimum := protocol.DatagramOverhead(protocol.ProtocolVersionMajor, crypto.CipherOverhead, true) + MinClampMTU
+	if size < minimum || size > 65507 {
+		return fmt.Errorf("invalid max UDP payload %d: must be between %d and 65507", size, minimum)
+	}
+	c.maxUDPPayload = size
+	return nil
+}
+
+// SetDSCP marks the datagrams sent to the server with dscp, e.g. 46 for
+// Expedited Forwarding, so the network can prioritize them. Zero leaves them
+// unmarked. It has no effect with a custom dialer. Call it before Connect.
+func (c *Client) SetDSCP(dscp int) error {
+	err := network.ValidateDSCP(dscp)
 	if err != nil {
-		return fmt.Errorf("failed to encode auth packet: %w", err)
+		return err
 	}
+	c.dscp = dscp
+	return nil
+}
 
-	_, err = c.udpConn.Write(packetData)
+// SetAuthTimeout sets how long the client waits for the server to answer
+// its auth request, and how many times it resends the request when the
+// answer doesn't come, e.g. because a datagram was lost. Call it before
+// Connect.
+func (c *Client) SetAuthTimeout(timeout time.Duration, retries int) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid auth timeout %s: must be positive", timeout)
+	}
+	if retries < 0 {
+		return fmt.Errorf("invalid auth retries %d: must not be negative", retries)
+	}
+	c.authTimeout = timeout
+	c.authRetries = retries
+	return nil
+}
+
+// SetNetworkKey makes the client add a MAC made with the 32-byte network key
+// to every datagram and drop datagrams without one, for servers with
+// network_key set. A nil key disables it. Call it before Connect.
+func (c *Client) SetNetworkKey(key []byte) error {
+	if key != nil && len(key) != 32 {
+		return fmt.Errorf("invalid network key: must be exactly 32 bytes, got %d bytes", len(key))
+	}
+	c.networkKey = append([]byte(nil), key...)
+	return nil
+}
+
+// SetServerIdentity pins the server's 32-byte identity public key, so the
+// client only accepts an auth response the server signed with the matching
+// identity_key, and refuses to connect to an impostor at the server's
+// address. A nil key accepts any server. Call it before Connect.
+func (c *Client) SetServerIdentity(publicKey []byte) error {
+	if publicKey != nil && len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid server identity: must be exactly %d bytes, got %d bytes", ed25519.PublicKeySize, len(publicKey))
+	}
+	c.serverIdentity = nil
+	if publicKey != nil {
+		c.serverIdentity = append(ed25519.PublicKey(nil), publicKey...)
+	}
+	return nil
+}
+
+// SetDialer replaces the UDP socket the client opens to each server with
+// whatever dial returns, e.g. an endpoint on a network.MemoryNetwork so a
+// client and server can be tested together in one process. Each Read and
+// Write on the connection must carry one datagram. SetLocalPort has no
+// effect with a custom dialer. Call it before Connect; nil restores UDP.
+func (c *Client) SetDialer(dial DialFunc) {
+	c.dial = dial
+}
+
+// SetKillSwitch makes the client block all traffic that would leave outside
+// the tunnel, other than to the VPN servers, from when it first connects
+// until Disconnect, reconnects included, so nothing leaks over the default
+// route while the tunnel is down. It needs root and iptables, so Linux only.
+// Server names are resolved once when it goes up. Call it before Connect.
+func (c *Client) SetKillSwitch(enabled bool) error {
+	if enabled && runtime.GOOS != "linux" {
+		return fmt.Errorf("kill switch is not supported on %s, only on linux", runtime.GOOS)
+	}
+	c.killSwitch = enabled
+	return nil
+}
+
+// SetRekey makes the client replace the session keys once they are interval
+// old or have carried bytes of payload, whichever comes first, zero disabling
+// either. The server may rekey on its own schedule too. It only takes effect
+// with servers that derive session keys and accept rekeys. Call it before
+// Connect.
+func (c *Client) SetRekey(interval time.Duration, bytes uint64) error {
+	if interval < 0 {
+		return fmt.Errorf("invalid rekey interval %s: must not be negative", interval)
+	}
+	c.rekeyInterval = interval
+	c.rekeyBytes = bytes
+	return nil
+}
+
+// SetInsecureNoEncryption disables encryption so packet captures are
+// readable while debugging. It fails unless crypto.InsecureEnvVar is set to
+// "1", and the handshake then fails unless the server has disabled
+// encryption too.
+func (c *Client) SetInsecureNoEncryption(enabled bool) error {
+	if enabled {
+		_, err := crypto.InsecureCipher()
+		if err != nil {
+			return err
+		}
+		log.Printf("WARNING: encryption is disabled, tunnel traffic is sent in plaintext; never use this in production")
+	}
+	c.insecure = enabled
+	return nil
+}
+
+// GetCompression reports whether compression is in use for this session
+func (c *Client) GetCompression() bool {
+	return c.compress
+}
+
+// GetRTT returns the smoothed round-trip time to the server measured with
+// keepalive pings, or zero before the first pong arrives
+func (c *Client) GetRTT() time.Duration {
+	return c.rtt.RTT()
+}
+
+// GetServerAddr returns the server currently in use
+func (c *Client) GetServerAddr() string {
+	return c.serverAddr
+}
+
+// GetNegotiatedVersion returns the protocol version agreed with the server
+func (c *Client) GetNegotiatedVersion() uint8 {
+	return c.version
+}
+
+// GetCipher returns the cipher suite used for data packets
+func (c *Client) GetCipher() crypto.Cipher {
+	return c.cipher
+}
+
+// authenticate sends the auth request and waits for the response, resending
+// the request up to authRetries times if none arrives within authTimeout.
+// Retries are identical to the first request, so a server that did get an
+// earlier copy answers with the session it already set up instead of
+// starting another one.
+func (c *Client) authenticate(ctx context.Context) error {
+	authPacket, packetData, err := c.authRequest()
 	if err != nil {
-		return fmt.Errorf("failed to send auth packet: %w", err)
+		return fmt.Errorf("failed to send auth request: %w", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = c.writePacket(packetData)
+		if err != nil {
+			return fmt.Errorf("failed to send auth request: %w", err)
+		}
+		c.tracePacket("send", authPacket, "", nil)
+		log.Printf("Sent authentication request to server")
+
+		err = c.waitForAuthResponse(ctx)
+		if !errors.Is(err, ErrAuthTimeout) || attempt == c.authRetries {
+			break
+		}
+		log.Printf("No auth response from %s within %s, resending the request (retry %d of %d)", c.serverAddr, c.authTimeout, attempt+1, c.authRetries)
+	}
+	if err != nil {
+		return fmt.Errorf("authentication failed: %w", err)
 	}
 
-	log.Printf("Sent authentication request to server")
 	return nil
 }
 
-func (c *Client) waitForAuthResponse() error {
-	c.udpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+// authRequest builds the auth request for a new session, returning it both
+// as a packet and encoded
+func (c *Client) authRequest() (*protocol.Packet, []byte, error) {
+	// Offer every supported cipher; the server picks one
+	supported := crypto.SupportedCiphers()
+	cipherIDs := make([]byte, len(supported))
+	for i, cipher := range supported {
+		cipherIDs[i] = cipher.ID()
+	}
+	if c.insecure {
+		cipherIDs = []byte{crypto.CipherNone}
+	}
+
+	sessionNonce, err := crypto.GenerateSessionNonce()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate session nonce: %w", err)
+	}
+	c.sessionNonce = sessionNonce
+
+	requestOptions := protocol.AuthOptions{
+		protocol.AuthOptionCiphers:     cipherIDs,
+		protocol.AuthOptionClientNonce: c.sessionNonce,
+		protocol.AuthOptionRekey:       {},
+	}
+	if c.wantCompress {
+		requestOptions[protocol.AuthOptionCompression] = []byte{protocol.CompressionFlate}
+	}
+	if c.requestedIP != nil {
+		requestOptions[protocol.AuthOptionRequestedIP] = c.requestedIP
+	}
+
+	// Configured clients always identify with their configured ID; the one the
+	// server assigned last session isn't registered with a key
+	clientID := c.clientID
+	if c.presharedKey != nil {
+		clientID = c.presharedID
+	}
+
+	options, err := protocol.EncodeAuthOptions(requestOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode auth options: %w", err)
+	}
+
+	// Proving the key lets the server hand this client a session that is
+	// still live, say from before a restart
+	if c.presharedKey != nil {
+		requestOptions[protocol.AuthOptionProof] = protocol.SignAuthProof(c.presharedKey, clientID, time.Now(), options)
+		options, err = protocol.EncodeAuthOptions(requestOptions)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode auth options: %w", err)
+		}
+	}
+	c.authOptions = options
+
+	authPacket := protocol.CreateAuthPacket(clientID, c.sequence, options)
+	
+	packetData, err := protocol.EncodePacket(authPacket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode auth packet: %w", err)
+	}
+
+	return authPacket, packetData, nil
+}
+
+// writePacket sends an encoded packet to the server with the network MAC
+// added, if one is configured
+func (c *Client) writePacket(packetData []byte) error {
+	_, err := c.conn.Write(protocol.SealNetworkMAC(packetData, c.networkKey))
+	return err
+}
+
+// writeDataPacket is writePacket for data packets, which go to the server's
+// data socket if it has one
+func (c *Client) writeDataPacket(packetData []byte) error {
+	if c.dataConn == nil {
+		return c.writePacket(packetData)
+	}
+	_, err := c.dataConn.Write(protocol.SealNetworkMAC(packetData, c.networkKey))
+	return err
+}
+
+func (c *Client) waitForAuthResponse(ctx context.Context) error {
+	deadline := time.Now().Add(c.authTimeout)
+	ctxDeadline, hasDeadline := ctx.Deadline()
+	if hasDeadline && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	// Unblock the read as soon as the context is cancelled. The callback may
+	// still run after stop, once the next attempt has replaced c.conn, so
+	// it holds on to this attempt's socket.
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
 
 	buffer := make([]byte, 1500)
-	n, err := c.udpConn.Read(buffer)
+	n, err := c.conn.Read(buffer)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The socket deadline can fire just before the context notices
+		if hasDeadline && !time.Now().Before(ctxDeadline) {
+			return context.DeadlineExceeded
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf("%w: none within %s", ErrAuthTimeout, c.authTimeout)
+		}
 		return fmt.Errorf("failed to read auth response: %w", err)
 	}
 
-	packet, err := protocol.DecodePacket(buffer[:n])
+	data, err := protocol.OpenNetworkMAC(buffer[:n], c.networkKey)
+	if err != nil {
+		return fmt.Errorf("failed to check auth response: %w; is the network key the server's?", err)
+	}
+
+	packet, err := protocol.DecodePacket(data)
 	if err != nil {
 		return fmt.Errorf("failed to decode auth response: %w", err)
 	}
+	c.tracePacket("recv", packet, "", nil)
+
+	return c.handleAuthResponse(packet)
+}
+
+// verifyServerIdentity checks that an auth response was signed with the
+// pinned server identity, over the request it answers
+func (c *Client) verifyServerIdentity(key []byte, assignedIP string, options protocol.AuthOptions) error {
+	identity, ok := options[protocol.AuthOptionIdentity]
+	if !ok {
+		return fmt.Errorf("%w: the server sent none; does it have identity_key set?", ErrServerIdentity)
+	}
+
+	unsigned := maps.Clone(options)
+	delete(unsigned, protocol.AuthOptionIdentity)
+	response, err := protocol.EncodeAuthResponse(key, assignedIP, unsigned)
+	if err != nil {
+		return fmt.Errorf("failed to encode auth response: %w", err)
+	}
+
+	err = protocol.VerifyIdentity(c.serverIdentity, identity, c.authOptions, response)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrServerIdentity, err)
+	}
+	return nil
+}
+
+func (c *Client) handleAuthResponse(packet *protocol.Packet) error {
+	if packet.Type == protocol.PacketTypeError {
+		code, message, err := protocol.DecodeError(packet.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to decode error response: %w", err)
+		}
+		return &ServerError{Code: code, Message: message}
+	}
 
 	if packet.Type != protocol.PacketTypeAuth {
 		return fmt.Errorf("expected auth response, got packet type %d", packet.Type)
 	}
 
-	if len(packet.Payload) < 32 {
-		return fmt.Errorf("invalid auth response payload length")
+	key, assignedIP, options, err := protocol.DecodeAuthResponse(packet.Payload)
+	if err != nil {
+		return err
+	}
+
+	// Checked first, so nothing from an impostor is acted on
+	if c.serverIdentity != nil {
+		err = c.verifyServerIdentity(key, assignedIP, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Servers never send a pre-shared key back, only proof that they know
+	// it; a server that can't prove it doesn't know ours
+	if c.presharedKey != nil {
+		if !hmac.Equal(key, protocol.AuthResponseProof(c.presharedKey, c.authOptions)) {
+			return fmt.Errorf("server does not accept the pre-shared key for client %d", c.presharedID)
+		}
+		key = c.presharedKey
+	}
+
+	selected := options[protocol.AuthOptionCipher]
+	if len(selected) != 1 {
+		return fmt.Errorf("invalid cipher selection in auth response")
+	}
+	var cipher crypto.Cipher = crypto.NoopCipher{}
+	if selected[0] != crypto.CipherNone || !c.insecure {
+		cipher, err = crypto.CipherByID(selected[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	// A server that ignored the offer would otherwise get plaintext it
+	// takes for ciphertext
+	if c.insecure && cipher.ID() != crypto.CipherNone {
+		return fmt.Errorf("server selected %s, but encryption is disabled on this client", cipher.Name())
+	}
+
+	// Servers that send no nonce would use the same keys every session, and
+	// both sides restarting their sequences would then reuse AEAD nonces
+	serverNonce, ok := options[protocol.AuthOptionServerNonce]
+	if !ok {
+		return fmt.Errorf("server sent no session nonce; it predates session keys, which are required")
+	}
+	key = append([]byte(nil), key...)
+	session, err := crypto.DeriveSessionKeys(key, c.sessionNonce, serverNonce)
+	if err != nil {
+		return fmt.Errorf("failed to derive session keys: %w", err)
+	}
+
+	// The server echoes the algorithm back only if it accepted compression
+	compress := false
+	if algorithm, ok := options[protocol.AuthOptionCompression]; ok {
+		if len(algorithm) != 1 || algorithm[0] != protocol.CompressionFlate || !c.wantCompress {
+			return fmt.Errorf("invalid compression selection in auth response")
+		}
+		compress = true
+	}
+
+	// The server accepts rekeys by echoing the option
+	_, rekey := options[protocol.AuthOptionRekey]
+
+	// Servers with a data socket say which port it is on
+	var dataPort uint16
+	if encoded, ok := options[protocol.AuthOptionDataPort]; ok {
+		if len(encoded) != 2 || binary.BigEndian.Uint16(encoded) == 0 {
+			return fmt.Errorf("invalid data port in auth response")
+		}
+		dataPort = binary.BigEndian.Uint16(encoded)
+	}
+
+	var routes []*net.IPNet
+	if encoded, ok := options[protocol.AuthOptionRoutes]; ok {
+		routes, err = protocol.DecodeRoutes(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid routes in auth response: %w", err)
+		}
 	}
 
+	// Swapped while no Send is using the last session's state
+	c.sendMutex.Lock()
 	c.clientID = packet.ClientID
-	c.key = make([]byte, 32)
-	copy(c.key, packet.Payload[:32])
-	c.assignedIP = string(packet.Payload[32:])
+	c.key = key
+	c.assignedIP = assignedIP
+	c.cipher = cipher
+	c.keys = crypto.NewKeyRing(session, true)
+	c.rekey = rekey
+	c.compress = compress
+	c.routes = routes
+	c.dataPort = dataPort
+	c.sendMutex.Unlock()
+
+	// The server advertises its full version byte in the response header
+	c.version = protocol.NegotiateVersion(protocol.ProtocolVersionByte, packet.Version)
+
+	if c.requestedIP != nil && !c.requestedIP.Equal(net.ParseIP(assignedIP)) {
+		log.Printf("Requested IP %s is unavailable, server assigned %s", c.requestedIP, assignedIP)
+	}
+	if len(routes) > 0 {
+		log.Printf("Server advertises routes: %v", routes)
+	}
 
-	log.Printf("Received authentication response: Client ID %d, IP %s", c.clientID, c.assignedIP)
+	log.Printf("Received authentication response: Client ID %d, IP %s, protocol version %s, cipher %s, compression %t", c.clientID, c.assignedIP, protocol.FormatVersion(c.version), c.cipher.Name(), c.compress)
 	return nil
 }
 
 func (c *Client) startPacketProcessing() {
 	c.wg.Add(1)
-	go c.handleServerPackets()
+	go c.handleServerPackets(c.conn)
+
+	if c.dataConn != nil {
+		c.wg.Add(1)
+		go c.handleServerPackets(c.dataConn)
+	}
 
 	c.wg.Add(1)
 	go c.handleTUNPackets()
@@ -183,22 +1103,28 @@ func (c *Client) startPacketProcessing() {
 	c.wg.Add(1)
 	go c.sendKeepAlive()
 
+	if c.rekey && (c.rekeyInterval > 0 || c.rekeyBytes > 0) {
+		c.wg.Add(1)
+		go c.rekeySession()
+	}
+
 	log.Printf("Started packet processing goroutines")
 }
 
-func (c *Client) handleServerPackets() {
+// handleServerPackets reads packets from the server over conn
+func (c *Client) handleServerPackets(conn net.Conn) {
 	defer c.wg.Done()
 
-	buffer := make([]byte, 1500)
+	buffer := make([]byte, c.maxDatagramSize())
 	for {
 		select {
 		case <-c.stopChan:
 			log.Printf("Server packet handler stopped")
 			return
 		default:
-			c.udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
 			
-			n, err := c.udpConn.Read(buffer)
+			n, err := conn.Read(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -207,7 +1133,13 @@ func (c *Client) handleServerPackets() {
 				continue
 			}
 
-			c.processServerPacket(buffer[:n])
+			// Datagrams from outside the network are dropped unlogged
+			data, err := protocol.OpenNetworkMAC(buffer[:n], c.networkKey)
+			if err != nil {
+				continue
+			}
+
+			c.processServerPacket(data)
 		}
 	}
 }
@@ -226,6 +1158,9 @@ func (c *Client) handleTUNPackets() {
 				time.Sleep(10 * time.Millisecond)
 				continue
 			}
+			if len(packetData) == 0 {
+				continue
+			}
 
 			c.processTUNPacket(packetData)
 		}
@@ -238,63 +1173,231 @@ func (c *Client) processServerPacket(data []byte) {
 		log.Printf("Failed to decode server packet: %v", err)
 		return
 	}
+	if packet.Type != protocol.PacketTypeData {
+		c.tracePacket("recv", packet, "", nil)
+	}
 
 	switch packet.Type {
 	case protocol.PacketTypeData:
 		c.handleDataPacket(packet)
+	case protocol.PacketTypePing:
+		c.handlePingPacket(packet)
 	case protocol.PacketTypePong:
 		c.handlePongPacket(packet)
+	case protocol.PacketTypeError:
+		code, message, _ := protocol.DecodeError(packet.Payload)
+		log.Printf("Server reported an error: %v", &ServerError{Code: code, Message: message})
+	case protocol.PacketTypeDisconnect:
+		c.handleDisconnectPacket(packet)
+	case protocol.PacketTypeRekey:
+		c.handleRekeyPacket(packet)
 	default:
 		log.Printf("Unknown packet type %d from server", packet.Type)
 	}
 }
 
-func (c *Client) processTUNPacket(data []byte) {
-	encryptedData, err := crypto.EncryptPayload(data, c.key, c.sequence)
+// handleDisconnectPacket signals ServerClosed when the server ends this
+// client's session. Disconnects are sealed like data, so forged ones are
+// dropped rather than failing the client over.
+func (c *Client) handleDisconnectPacket(packet *protocol.Packet) {
+	if packet.ClientID != c.clientID {
+		return
+	}
+
+	reason, err := c.keys.Open(c.cipher, packet.Payload, packet.Sequence)
 	if err != nil {
-		log.Printf("Failed to encrypt packet: %v", err)
+		log.Printf("Dropping disconnect from server that failed to decrypt: %v", err)
 		return
 	}
 
+	select {
+	case <-c.serverClosed:
+		// Already signalled
+	default:
+		log.Printf("Server ended the session: %q", reason)
+		close(c.serverClosed)
+	}
+}
+
+func (c *Client) processTUNPacket(data []byte) {
+	if c.maxMSS > 0 {
+		network.ClampMSS(data, c.maxMSS)
+	}
+
+	err := c.sendData(data)
+	if err != nil {
+		log.Printf("Failed to send packet from TUN interface: %v", err)
+	}
+}
+
+// Send encrypts payload and sends it to the server as a data packet, as if
+// it had been read from the TUN interface. The server treats it as an IP
+// packet from the client's tunnel address and drops it if it isn't one, so
+// app-level protocols must still be framed as IP packets. It fails with
+// ErrNotConnected outside a session.
+func (c *Client) Send(payload []byte) error {
+	if !c.connected.Load() {
+		return ErrNotConnected
+	}
+	return c.sendData(payload)
+}
+
+// Receive makes the client hand each decrypted data payload to handler
+// instead of writing it to the TUN interface, so embedders can consume
+// tunnel traffic directly. handler runs on the receiving goroutine and
+// should return quickly; the slice is its own. A nil handler restores
+// writing to the TUN interface. Call it before Connect.
+func (c *Client) Receive(handler func(payload []byte)) {
+	c.receiveHandler = handler
+}
+
+// sendData encrypts data, compressing it first if negotiated, and sends it
+// as a data packet. Packets over the max UDP payload are dropped and
+// counted, without an error. It fails with ErrNotConnected if the session
+// ended, since its state may be mid-swap for the next one.
+func (c *Client) sendData(data []byte) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if !c.connected.Load() {
+		return ErrNotConnected
+	}
+
+	payload := data
+	compressed := false
+	if c.compress {
+		payload, compressed = protocol.CompressPayload(data)
+	}
+
+	if c.maxUDPPayload > 0 {
+		limit := protocol.MaxInnerPacketSize(c.maxUDPPayload, protocol.ProtocolVersionMajor, crypto.CipherOverhead, c.networkKey != nil)
+		if len(payload) > limit {
+			// Log the first drop and every 100th after, a sender ignoring
+			// the MTU would otherwise flood the log
+			dropped := c.oversized.Add(1)
+			if dropped%100 == 1 {
+				log.Printf("Dropped %d-byte packet, over the %d bytes the max UDP payload leaves (%d dropped so far); lower the MTU or set --clamp-mss", len(payload), limit, dropped)
+			}
+			return nil
+		}
+	}
+
+	encryptedData, err := c.keys.Seal(c.cipher, payload, c.sequence)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt packet: %w", err)
+	}
+
 	dataPacket := protocol.CreateDataPacket(c.clientID, c.sequence, encryptedData)
+	if compressed {
+		dataPacket.Flags |= protocol.PacketFlagCompressed
+	}
 	
 	packetData, err := protocol.EncodePacket(dataPacket)
 	if err != nil {
-		log.Printf("Failed to encode data packet: %v", err)
-		return
+		return fmt.Errorf("failed to encode data packet: %w", err)
 	}
 
-	_, err = c.udpConn.Write(packetData)
+	err = c.writeDataPacket(packetData)
 	if err != nil {
-		log.Printf("Failed to send data packet to server: %v", err)
-		return
+		return fmt.Errorf("failed to send data packet to server: %w", err)
 	}
+	c.tracePacket("send", dataPacket, "encrypted", data)
 
 	c.sequence++
+	return nil
 }
 
 func (c *Client) handleDataPacket(packet *protocol.Packet) {
-	decryptedData, err := crypto.DecryptPayload(packet.Payload, c.key, packet.Sequence)
+	decryptedData, err := c.openData(packet)
 	if err != nil {
-		log.Printf("Failed to decrypt data packet: %v", err)
+		log.Printf("Dropping data packet from server: %v", err)
+		return
+	}
+
+	if c.receiveHandler != nil {
+		c.receiveHandler(decryptedData)
 		return
 	}
 
-	err = c.tunInterface.WritePacket(decryptedData)
+	if c.maxMSS > 0 {
+		network.ClampMSS(decryptedData, c.maxMSS)
+	}
+
+	// Writing here would let a slow TUN interface stall reception and
+	// keepalives, so hand the packet to the TUN writer, which drops it if
+	// it is falling behind
+	c.tunQueue.Enqueue(decryptedData)
+}
+
+// openData returns the payload of a data packet, decrypted and, if it was
+// compressed, decompressed
+func (c *Client) openData(packet *protocol.Packet) ([]byte, error) {
+	decryptedData, err := c.keys.Open(c.cipher, packet.Payload, packet.Sequence)
 	if err != nil {
-		log.Printf("Failed to write packet to TUN interface: %v", err)
+		c.tracePacket("recv", packet, "decrypt failed", nil)
+		return nil, fmt.Errorf("failed to decrypt data packet: %w", err)
+	}
+
+	if packet.Flags&protocol.PacketFlagCompressed != 0 {
+		if !c.compress {
+			return nil, fmt.Errorf("packet is compressed, but compression was not negotiated")
+		}
+		decryptedData, err = protocol.DecompressPayload(decryptedData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data packet: %w", err)
+		}
+	}
+	c.tracePacket("recv", packet, "decrypted", decryptedData)
+
+	return decryptedData, nil
+}
+
+// handlePingPacket answers a server liveness probe. The pong carries the
+// client's own next sequence and an empty payload sealed like data, so the
+// server accepts it as fresh activity.
+func (c *Client) handlePingPacket(packet *protocol.Packet) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	sealed, err := c.keys.Seal(c.cipher, []byte{}, c.sequence)
+	if err != nil {
+		log.Printf("Failed to encrypt pong packet: %v", err)
+		return
+	}
+
+	pongPacket := protocol.CreatePongPacket(c.clientID, c.sequence)
+	pongPacket.Payload = sealed
+	pongPacket.Length = uint16(len(sealed))
+	packetData, err := protocol.EncodePacket(pongPacket)
+	if err != nil {
+		log.Printf("Failed to encode pong packet: %v", err)
+		return
+	}
+
+	err = c.writePacket(packetData)
+	if err != nil {
+		log.Printf("Failed to send pong packet: %v", err)
 		return
 	}
+	c.tracePacket("send", pongPacket, "", nil)
+
+	c.sequence++
 }
 
 func (c *Client) handlePongPacket(packet *protocol.Packet) {
-	log.Printf("Received pong from server (sequence %d)", packet.Sequence)
+	sample, ok := c.rtt.Received(packet.Sequence)
+	if !ok {
+		log.Printf("Ignoring pong from server for unknown ping (sequence %d)", packet.Sequence)
+		return
+	}
+
+	log.Printf("Received pong from server (sequence %d, RTT %s, smoothed %s)", packet.Sequence, sample, c.rtt.RTT())
 }
 
 func (c *Client) sendKeepAlive() {
 	defer c.wg.Done()
 
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(c.keepAlive)
 	defer ticker.Stop()
 
 	for {
@@ -308,7 +1411,20 @@ func (c *Client) sendKeepAlive() {
 }
 
 func (c *Client) sendPing() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	// Report the smoothed RTT so the server can show it too. The payload is
+	// sealed like data, so the server can tell the ping is really ours.
+	sealed, err := c.keys.Seal(c.cipher, protocol.EncodePingRTT(c.rtt.RTT()), c.sequence)
+	if err != nil {
+		log.Printf("Failed to encrypt ping packet: %v", err)
+		return
+	}
+
 	pingPacket := protocol.CreatePingPacket(c.clientID, c.sequence)
+	pingPacket.Payload = sealed
+	pingPacket.Length = uint16(len(sealed))
 	
 	packetData, err := protocol.EncodePacket(pingPacket)
 	if err != nil {
@@ -316,11 +1432,14 @@ func (c *Client) sendPing() {
 		return
 	}
 
-	_, err = c.udpConn.Write(packetData)
+	c.rtt.Sent(c.sequence)
+
+	err = c.writePacket(packetData)
 	if err != nil {
 		log.Printf("Failed to send ping packet: %v", err)
 		return
 	}
+	c.tracePacket("send", pingPacket, "", nil)
 
 	c.sequence++
 }
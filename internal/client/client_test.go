@@ -1,7 +1,18 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+	"golang.org/x/net/ipv4"
 )
 
 func TestNewClient(t *testing.T) {
@@ -15,7 +26,7 @@ func TestNewClient(t *testing.T) {
 		t.Errorf("Expected client ID 0, got %d", client.clientID)
 	}
 	
-	if client.connected {
+	if client.connected.Load() {
 		t.Error("Expected client to be disconnected initially")
 	}
 	
@@ -40,3 +51,894 @@ func TestClientMethods(t *testing.T) {
 		t.Errorf("Expected empty assigned IP, got %s", client.GetAssignedIP())
 	}
 }
+
+func TestHandleAuthResponse_NegotiatesOlderServerVersion(t *testing.T) {
+	// This client speaks 1.2.0 while the server only speaks 1.0.0
+	if err := protocol.InitProtocolVersion("1.2.0"); err != nil {
+		t.Fatalf("Failed to init protocol version: %v", err)
+	}
+	defer protocol.InitProtocolVersion("1.0.0")
+
+	client := NewClient("127.0.0.1:1194")
+	client.sessionNonce = make([]byte, crypto.SessionNonceSize)
+
+	payload, _ := protocol.EncodeAuthResponse(make([]byte, 32), "10.0.0.2", protocol.AuthOptions{
+		protocol.AuthOptionCipher:      {crypto.CipherChaCha20Poly1305},
+		protocol.AuthOptionServerNonce: make([]byte, crypto.SessionNonceSize),
+	})
+	response := protocol.CreateAuthPacket(1, 0, payload)
+	response.Version = protocol.EncodeVersion(1, 0, 0)
+
+	err := client.handleAuthResponse(response)
+	if err != nil {
+		t.Fatalf("handleAuthResponse failed: %v", err)
+	}
+
+	if client.GetNegotiatedVersion() != protocol.EncodeVersion(1, 0, 0) {
+		t.Errorf("Expected negotiated version 1.0.0, got %s", protocol.FormatVersion(client.GetNegotiatedVersion()))
+	}
+
+	if protocol.VersionAtLeast(client.GetNegotiatedVersion(), 1, 2, 0) {
+		t.Error("Client should not use 1.2 features with a 1.0.0 server")
+	}
+}
+
+func TestHandleAuthResponse_SelectsCipher(t *testing.T) {
+	key := make([]byte, 32)
+	serverNonce := make([]byte, crypto.SessionNonceSize)
+
+	// Every server that derives session keys also selects a cipher
+	client := NewClient("127.0.0.1:1194")
+	client.sessionNonce = make([]byte, crypto.SessionNonceSize)
+	payload, _ := protocol.EncodeAuthResponse(key, "10.0.0.2", protocol.AuthOptions{
+		protocol.AuthOptionServerNonce: serverNonce,
+	})
+	err := client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+	if err == nil {
+		t.Error("Expected error for a missing cipher selection")
+	}
+
+	client = NewClient("127.0.0.1:1194")
+	client.sessionNonce = make([]byte, crypto.SessionNonceSize)
+	payload, _ = protocol.EncodeAuthResponse(key, "10.0.0.3", protocol.AuthOptions{
+		protocol.AuthOptionCipher:      {crypto.CipherAES256GCM},
+		protocol.AuthOptionServerNonce: serverNonce,
+	})
+	err = client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+	if err != nil {
+		t.Fatalf("handleAuthResponse failed: %v", err)
+	}
+	if client.GetCipher().ID() != crypto.CipherAES256GCM {
+		t.Errorf("Expected aes-256-gcm, got %s", client.GetCipher().Name())
+	}
+	if client.GetAssignedIP() != "10.0.0.3" {
+		t.Errorf("Expected IP 10.0.0.3, got %s", client.GetAssignedIP())
+	}
+
+	// Unknown cipher selections are rejected
+	client = NewClient("127.0.0.1:1194")
+	client.sessionNonce = make([]byte, crypto.SessionNonceSize)
+	payload, _ = protocol.EncodeAuthResponse(key, "10.0.0.4", protocol.AuthOptions{
+		protocol.AuthOptionCipher:      {99},
+		protocol.AuthOptionServerNonce: serverNonce,
+	})
+	err = client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+	if err == nil {
+		t.Error("Expected error for unknown cipher")
+	}
+}
+
+func TestHandleAuthResponse_RequiresServerNonce(t *testing.T) {
+	// Servers that predate session keys would reuse nonces across sessions
+	client := NewClient("127.0.0.1:1194")
+	client.sessionNonce = make([]byte, crypto.SessionNonceSize)
+	payload, _ := protocol.EncodeAuthResponse(make([]byte, 32), "10.0.0.2", protocol.AuthOptions{
+		protocol.AuthOptionCipher: {crypto.CipherChaCha20Poly1305},
+	})
+	err := client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+	if err == nil {
+		t.Error("Expected a server without a session nonce to be refused")
+	}
+}
+
+func TestHandleAuthResponse_InsecureNoEncryption(t *testing.T) {
+	key := make([]byte, 32)
+
+	t.Setenv(crypto.InsecureEnvVar, "")
+	client := NewClient("127.0.0.1:1194")
+	if client.SetInsecureNoEncryption(true) == nil {
+		t.Fatalf("Expected disabling encryption to require %s", crypto.InsecureEnvVar)
+	}
+
+	t.Setenv(crypto.InsecureEnvVar, "1")
+	responses := map[string]protocol.AuthOptions{
+		"legacy server":     nil,
+		"encrypting server": {protocol.AuthOptionCipher: {crypto.CipherChaCha20Poly1305}},
+	}
+	for name, options := range responses {
+		client := NewClient("127.0.0.1:1194")
+		err := client.SetInsecureNoEncryption(true)
+		if err != nil {
+			t.Fatalf("SetInsecureNoEncryption failed: %v", err)
+		}
+
+		payload, _ := protocol.EncodeAuthResponse(key, "10.0.0.2", options)
+		err = client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+		if err == nil {
+			t.Errorf("Expected an insecure client to refuse a %s", name)
+		}
+	}
+
+	// A secure client never accepts plaintext
+	client = NewClient("127.0.0.1:1194")
+	payload, _ := protocol.EncodeAuthResponse(key, "10.0.0.2", protocol.AuthOptions{
+		protocol.AuthOptionCipher: {crypto.CipherNone},
+	})
+	err := client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+	if err == nil {
+		t.Error("Expected a secure client to refuse a server without encryption")
+	}
+}
+
+func TestHandleAuthResponse_DerivesSessionKeys(t *testing.T) {
+	key := make([]byte, 32)
+	serverNonce := make([]byte, crypto.SessionNonceSize)
+
+	client := NewClient("127.0.0.1:1194")
+	client.sessionNonce = make([]byte, crypto.SessionNonceSize)
+
+	payload, _ := protocol.EncodeAuthResponse(key, "10.0.0.2", protocol.AuthOptions{
+		protocol.AuthOptionCipher:      {crypto.CipherChaCha20Poly1305},
+		protocol.AuthOptionServerNonce: serverNonce,
+	})
+	err := client.handleAuthResponse(protocol.CreateAuthPacket(1, 0, payload))
+	if err != nil {
+		t.Fatalf("handleAuthResponse failed: %v", err)
+	}
+
+	expected, err := crypto.DeriveSessionKeys(key, client.sessionNonce, serverNonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+
+	if string(client.keys.Keys().ClientToServer) != string(expected.ClientToServer) {
+		t.Error("Client→server key doesn't match the derived key")
+	}
+	if string(client.keys.Keys().ServerToClient) != string(expected.ServerToClient) {
+		t.Error("Server→client key doesn't match the derived key")
+	}
+}
+
+// TestHandleAuthResponse_ServerError tests that each error code the server
+// can send turns into a clear error instead of an auth timeout
+func TestHandleAuthResponse_ServerError(t *testing.T) {
+	tests := []struct {
+		code     uint8
+		message  string
+		expected string
+	}{
+		{protocol.ErrorCodeUnknownClient, "client ID 9 is not configured", "server refused connection: client ID is not configured on the server, check the ID and key (client ID 9 is not configured)"},
+		{protocol.ErrorCodeServerFull, "no tunnel addresses available", "server refused connection: server at capacity, no room for more clients (no tunnel addresses available)"},
+		{protocol.ErrorCodeAlreadyConnected, "", "server refused connection: a client with this key is already connected"},
+		{protocol.ErrorCodeAuthFailed, "", "server refused connection: authentication failed"},
+		{200, "", "server refused connection: unknown error code 200"},
+	}
+
+	for _, tt := range tests {
+		client := NewClient("127.0.0.1:1194")
+		err := client.handleAuthResponse(protocol.CreateErrorPacket(0, tt.code, tt.message))
+
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) {
+			t.Errorf("Expected a ServerError for code %d, got %v", tt.code, err)
+			continue
+		}
+		if serverErr.Code != tt.code {
+			t.Errorf("Expected code %d, got %d", tt.code, serverErr.Code)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, err.Error())
+		}
+		if full := errors.Is(err, ErrServerFull); full != (tt.code == protocol.ErrorCodeServerFull) {
+			t.Errorf("Expected errors.Is(err, ErrServerFull) to be %t for code %d", !full, tt.code)
+		}
+	}
+}
+
+func TestConnectContext_Cancelled(t *testing.T) {
+	// A server that never answers the handshake
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer silent.Close()
+
+	tun := network.NewMockTunManager()
+	client := NewClientWithTUN(silent.LocalAddr().String(), tun)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err = client.ConnectContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected cancellation to return promptly, took %v", elapsed)
+	}
+
+	if tun.IsCreated() {
+		t.Error("TUN interface should not be created after a failed handshake")
+	}
+	if client.IsConnected() {
+		t.Error("Client should not be connected")
+	}
+}
+
+func TestConnectContext_Deadline(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer silent.Close()
+
+	client := NewClientWithTUN(silent.LocalAddr().String(), network.NewMockTunManager())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = client.ConnectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestNewClient_ServerList(t *testing.T) {
+	client := NewClient("10.0.0.1:1194, 10.0.0.2:1194,")
+
+	if len(client.servers) != 2 {
+		t.Fatalf("Expected 2 servers, got %v", client.servers)
+	}
+	if client.GetServerAddr() != "10.0.0.1:1194" {
+		t.Errorf("Expected first server to be active, got %s", client.GetServerAddr())
+	}
+}
+
+func TestConnect_FallsBackToNextServer(t *testing.T) {
+	refusing := startFakeServer(t, false)
+	accepting := startFakeServer(t, true)
+
+	client := NewClientWithTUN(refusing+","+accepting, network.NewMockTunManager())
+
+	err := client.Connect()
+	if err != nil {
+		t.Fatalf("Expected connect to fall back to second server, got %v", err)
+	}
+	defer client.Disconnect()
+
+	if client.GetServerAddr() != accepting {
+		t.Errorf("Expected active server %s, got %s", accepting, client.GetServerAddr())
+	}
+	if client.GetAssignedIP() != "10.0.0.2" {
+		t.Errorf("Expected IP 10.0.0.2, got %s", client.GetAssignedIP())
+	}
+}
+
+func TestReconnect_RotatesToNextServer(t *testing.T) {
+	first := startFakeServer(t, true)
+	second := startFakeServer(t, true)
+
+	client := NewClientWithTUN(first+","+second, network.NewMockTunManager())
+
+	err := client.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if client.GetServerAddr() != first {
+		t.Fatalf("Expected active server %s, got %s", first, client.GetServerAddr())
+	}
+
+	err = client.Reconnect(context.Background())
+	if err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	if client.GetServerAddr() != second {
+		t.Errorf("Expected reconnect to move to %s, got %s", second, client.GetServerAddr())
+	}
+}
+
+// TestSend_DuringReconnect tests that Send can be called from another
+// goroutine while the client reconnects, failing with ErrNotConnected rather
+// than racing on the session being swapped. Run it with -race.
+func TestSend_DuringReconnect(t *testing.T) {
+	client := NewClientWithTUN(startFakeServer(t, true)+","+startFakeServer(t, true), network.NewMockTunManager())
+
+	err := client.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := client.Send([]byte("packet"))
+			if err != nil && !errors.Is(err, ErrNotConnected) {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		err = client.Reconnect(context.Background())
+		if err != nil {
+			t.Fatalf("Reconnect failed: %v", err)
+		}
+	}
+	close(stop)
+
+	if err := <-errs; err != nil {
+		t.Errorf("Expected Send to succeed or fail with ErrNotConnected, got %v", err)
+	}
+}
+
+func TestConnect_AllServersFail(t *testing.T) {
+	client := NewClientWithTUN(startFakeServer(t, false)+","+startFakeServer(t, false), network.NewMockTunManager())
+
+	err := client.Connect()
+	if err == nil {
+		client.Disconnect()
+		t.Fatal("Expected error when every server refuses the handshake")
+	}
+}
+
+// startFakeServer answers each auth request with a minimal auth response, or
+// with a ping if accept is false so the handshake fails straight away
+func startFakeServer(t *testing.T, accept bool) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			packet, err := protocol.DecodePacket(buffer[:n])
+			if err != nil || packet.Type != protocol.PacketTypeAuth {
+				continue
+			}
+
+			response := protocol.CreatePingPacket(0, packet.Sequence)
+			if accept {
+				payload, _ := protocol.EncodeAuthResponse(make([]byte, 32), "10.0.0.2", protocol.AuthOptions{
+					protocol.AuthOptionCipher:      {crypto.CipherChaCha20Poly1305},
+					protocol.AuthOptionServerNonce: make([]byte, crypto.SessionNonceSize),
+				})
+				response = protocol.CreateAuthPacket(1, 0, payload)
+			}
+
+			data, _ := protocol.EncodePacket(response)
+			conn.WriteToUDP(data, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSendKeepAlive_UsesConfiguredInterval(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer server.Close()
+
+	client := NewClient(server.LocalAddr().String())
+	if client.GetKeepAliveInterval() != DefaultKeepAliveInterval {
+		t.Errorf("Expected default interval %v, got %v", DefaultKeepAliveInterval, client.GetKeepAliveInterval())
+	}
+
+	nonce := make([]byte, crypto.SessionNonceSize)
+	session, err := crypto.DeriveSessionKeys(make([]byte, 32), nonce, nonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	client.cipher = crypto.DefaultCipher()
+	client.keys = crypto.NewKeyRing(session, true)
+
+	client.SetKeepAliveInterval(50 * time.Millisecond)
+	client.conn, err = net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer client.conn.Close()
+
+	client.wg.Add(1)
+	go client.sendKeepAlive()
+	defer func() {
+		close(client.stopChan)
+		client.wg.Wait()
+	}()
+
+	// With the default 30s interval no ping would arrive in time
+	buffer := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := server.Read(buffer)
+		if err != nil {
+			t.Fatalf("Expected ping %d within a second: %v", i+1, err)
+		}
+
+		packet, err := protocol.DecodePacket(buffer[:n])
+		if err != nil || packet.Type != protocol.PacketTypePing {
+			t.Fatalf("Expected ping packet, got %v (%v)", packet, err)
+		}
+	}
+}
+
+func TestConnect_UsesInterfaceName(t *testing.T) {
+	tun := network.NewMockTunManager()
+	client := NewClientWithTUN(startFakeServer(t, true), tun)
+
+	if client.GetInterfaceName() != DefaultInterfaceName {
+		t.Errorf("Expected default interface %s, got %s", DefaultInterfaceName, client.GetInterfaceName())
+	}
+
+	client.SetInterfaceName("fvp-office")
+	err := client.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	if tun.GetName() != "fvp-office" {
+		t.Errorf("Expected TUN interface fvp-office, got %s", tun.GetName())
+	}
+}
+
+func TestHandlePingPacket_AnswersWithPong(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer server.Close()
+
+	nonce := make([]byte, crypto.SessionNonceSize)
+	session, err := crypto.DeriveSessionKeys(make([]byte, 32), nonce, nonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	client := NewClient(server.LocalAddr().String())
+	client.clientID = 7
+	client.sequence = 5
+	client.cipher = crypto.DefaultCipher()
+	client.keys = crypto.NewKeyRing(session, true)
+	client.conn, err = net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer client.conn.Close()
+
+	client.handlePingPacket(protocol.CreatePingPacket(7, 42))
+
+	buffer := make([]byte, 1500)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := server.Read(buffer)
+	if err != nil {
+		t.Fatalf("Expected pong within a second: %v", err)
+	}
+
+	packet, err := protocol.DecodePacket(buffer[:n])
+	if err != nil || packet.Type != protocol.PacketTypePong {
+		t.Fatalf("Expected pong packet, got %v (%v)", packet, err)
+	}
+	if packet.ClientID != 7 || packet.Sequence != 5 {
+		t.Errorf("Expected pong for client 7 sequence 5, got client %d sequence %d", packet.ClientID, packet.Sequence)
+	}
+	_, err = crypto.NewKeyRing(session, false).Open(crypto.DefaultCipher(), packet.Payload, packet.Sequence)
+	if err != nil {
+		t.Errorf("Expected pong sealed with the session keys, got %v", err)
+	}
+	if client.sequence != 6 {
+		t.Errorf("Expected sequence to advance to 6, got %d", client.sequence)
+	}
+}
+
+func TestHandleDisconnectPacket_SignalsServerClosed(t *testing.T) {
+	nonce := make([]byte, crypto.SessionNonceSize)
+	session, err := crypto.DeriveSessionKeys(make([]byte, 32), nonce, nonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	client := NewClient("127.0.0.1:1194")
+	client.clientID = 7
+	client.cipher = crypto.DefaultCipher()
+	client.keys = crypto.NewKeyRing(session, true)
+	client.serverClosed = make(chan struct{})
+
+	serverKeys := crypto.NewKeyRing(session, false)
+	sequence := uint32(0)
+	disconnect := func(clientID uint8) []byte {
+		sequence++
+		sealed, err := serverKeys.Seal(crypto.DefaultCipher(), protocol.EncodeDisconnect("server shutting down"), sequence)
+		if err != nil {
+			t.Fatalf("Failed to seal disconnect: %v", err)
+		}
+		data, err := protocol.EncodePacket(protocol.CreateDisconnectPacket(clientID, sequence, sealed))
+		if err != nil {
+			t.Fatalf("Failed to encode disconnect: %v", err)
+		}
+		return data
+	}
+
+	// Disconnects meant for another client are ignored
+	client.processServerPacket(disconnect(8))
+	select {
+	case <-client.ServerClosed():
+		t.Fatal("Expected a disconnect for another client to be ignored")
+	default:
+	}
+
+	// So are forged ones, which don't open with the session keys
+	forged, _ := protocol.EncodePacket(protocol.CreateDisconnectPacket(7, 1, []byte("server shutting down")))
+	client.processServerPacket(forged)
+	select {
+	case <-client.ServerClosed():
+		t.Fatal("Expected a forged disconnect to be ignored")
+	default:
+	}
+
+	// Repeated disconnects don't close the channel twice
+	client.processServerPacket(disconnect(7))
+	client.processServerPacket(disconnect(7))
+	select {
+	case <-client.ServerClosed():
+	default:
+		t.Fatal("Expected ServerClosed to be signalled")
+	}
+}
+
+func TestHandleDataPacket_SlowTUNDoesNotBlockReader(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	tun := network.NewCallbackTun(func([]byte) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	if err := tun.Create("slow0"); err != nil {
+		t.Fatalf("Failed to create TUN: %v", err)
+	}
+
+	nonce := make([]byte, crypto.SessionNonceSize)
+	session, err := crypto.DeriveSessionKeys(make([]byte, 32), nonce, nonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	client := NewClientWithTUN("127.0.0.1:1", tun)
+	client.clientID = 3
+	client.keys = crypto.NewKeyRing(session, true)
+	client.tunQueue = network.NewWriteQueue(tun, 2)
+
+	packets := make([][]byte, 20)
+	for i := range packets {
+		encrypted, err := crypto.EncryptPayload([]byte("payload"), session.ServerToClient, uint32(i+1))
+		if err != nil {
+			t.Fatalf("Failed to encrypt payload: %v", err)
+		}
+		packets[i], _ = protocol.EncodePacket(protocol.CreateDataPacket(3, uint32(i+1), encrypted))
+	}
+
+	// Once the TUN interface is stuck on the first packet, the reader only
+	// gets through the rest if it drops what the queue can't hold
+	client.processServerPacket(packets[0])
+	<-entered
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, packet := range packets[1:] {
+			client.processServerPacket(packet)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reader blocked on a slow TUN interface")
+	}
+
+	if dropped := client.DroppedPackets(); dropped != 17 {
+		t.Errorf("Expected 17 dropped packets, got %d", dropped)
+	}
+
+	close(release)
+	client.tunQueue.Close()
+}
+
+func TestSetClampMSS(t *testing.T) {
+	client := NewClient("127.0.0.1:1194")
+
+	if err := client.SetClampMSS(100); err == nil {
+		t.Error("Expected error for an MTU below the IPv4 minimum")
+	}
+	if err := client.SetClampMSS(1400); err != nil || client.maxMSS != 1360 {
+		t.Errorf("Expected MSS 1360 for MTU 1400, got %d (%v)", client.maxMSS, err)
+	}
+	if err := client.SetClampMSS(0); err != nil || client.maxMSS != 0 {
+		t.Errorf("Expected clamping disabled, got MSS %d (%v)", client.maxMSS, err)
+	}
+}
+
+// TestWaitForInterface tests polling a readiness source until the interface
+// is up, and giving up after the timeout or when the context is cancelled
+func TestWaitForInterface(t *testing.T) {
+	// fakeReadiness becomes ready on the given poll, failing before that
+	fakeReadiness := func(readyOn int, err error) (func() (bool, error), *int) {
+		polls := 0
+		return func() (bool, error) {
+			polls++
+			return polls >= readyOn, err
+		}, &polls
+	}
+
+	t.Run("ready after polling", func(t *testing.T) {
+		ready, polls := fakeReadiness(3, nil)
+		err := waitForInterface(context.Background(), ready, time.Second, time.Millisecond)
+		if err != nil {
+			t.Fatalf("Expected the interface ready, got %v", err)
+		}
+		if *polls != 3 {
+			t.Errorf("Expected 3 polls, got %d", *polls)
+		}
+	})
+
+	t.Run("never ready", func(t *testing.T) {
+		ready, polls := fakeReadiness(1000000, errors.New("ip failed"))
+		start := time.Now()
+		err := waitForInterface(context.Background(), ready, 50*time.Millisecond, 5*time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), "ip failed") {
+			t.Errorf("Expected a timeout carrying the last error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+			t.Errorf("Expected to give up after about 50ms, took %s", elapsed)
+		}
+		if *polls < 2 {
+			t.Errorf("Expected several polls, got %d", *polls)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		ready, _ := fakeReadiness(1000000, nil)
+		err := waitForInterface(ctx, ready, time.Second, time.Millisecond)
+		if err == nil {
+			t.Error("Expected an error for a cancelled context")
+		}
+	})
+}
+
+// TestSetDSCP tests that the client marks the sockets it dials with the DSCP
+func TestSetDSCP(t *testing.T) {
+	client := NewClient("127.0.0.1:1194")
+
+	if err := client.SetDSCP(64); err == nil {
+		t.Error("Expected error for a DSCP over 63")
+	}
+	err := client.SetDSCP(46)
+	if err != nil {
+		t.Fatalf("SetDSCP failed: %v", err)
+	}
+
+	conn, err := client.dialUDP(context.Background(), "127.0.0.1:1194")
+	if err != nil {
+		t.Fatalf("dialUDP failed: %v", err)
+	}
+	defer conn.Close()
+
+	tos, err := ipv4.NewConn(conn).TOS()
+	if err != nil {
+		t.Fatalf("Failed to read the ToS: %v", err)
+	}
+	if tos != 46<<2 {
+		t.Errorf("Expected ToS %d for DSCP 46, got %d", 46<<2, tos)
+	}
+}
+
+// TestDialAddress tests that servers are dialed by the address they resolved
+// to while the kill switch is up, and by name otherwise
+func TestDialAddress(t *testing.T) {
+	client := NewClient("vpn.example.com:1194,127.0.0.1:1195")
+	if got := client.dialAddress("vpn.example.com:1194"); got != "vpn.example.com:1194" {
+		t.Errorf("Expected the server name without a kill switch, got %s", got)
+	}
+
+	client.pinned = map[string]string{"vpn.example.com:1194": "203.0.113.5:1194"}
+	if got := client.dialAddress("vpn.example.com:1194"); got != "203.0.113.5:1194" {
+		t.Errorf("Expected the pinned address, got %s", got)
+	}
+	if got := client.dialAddress("127.0.0.1:1195"); got != "127.0.0.1:1195" {
+		t.Errorf("Expected an unpinned server to be dialed as given, got %s", got)
+	}
+}
+
+func TestSetMaxUDPPayload(t *testing.T) {
+	client := NewClient("127.0.0.1:1194")
+
+	if err := client.SetMaxUDPPayload(500); err == nil {
+		t.Error("Expected error for a payload with no room for a minimum MTU packet")
+	}
+	if err := client.SetMaxUDPPayload(70000); err == nil {
+		t.Error("Expected error for a payload over the UDP maximum")
+	}
+	if err := client.SetMaxUDPPayload(1472); err != nil || client.maxUDPPayload != 1472 {
+		t.Errorf("Expected max UDP payload 1472, got %d (%v)", client.maxUDPPayload, err)
+	}
+	if err := client.SetMaxUDPPayload(0); err != nil || client.maxUDPPayload != 0 {
+		t.Errorf("Expected no limit, got %d (%v)", client.maxUDPPayload, err)
+	}
+}
+
+func TestSetMTU(t *testing.T) {
+	client := NewClient("127.0.0.1:1194")
+
+	if err := client.SetMTU(100); err == nil {
+		t.Error("Expected error for an MTU under the IPv4 minimum")
+	}
+	if err := client.SetMTU(65500); err == nil {
+		t.Error("Expected error for an MTU whose datagram exceeds the UDP maximum")
+	}
+	if err := client.SetMTU(9000); err != nil || client.mtu != 9000 {
+		t.Errorf("Expected MTU 9000, got %d (%v)", client.mtu, err)
+	}
+	if client.maxDatagramSize() <= 9000 {
+		t.Errorf("Expected reads sized for a 9000-byte packet and its overhead, got %d", client.maxDatagramSize())
+	}
+}
+
+// TestSetLocalPort tests that the client sends from the configured port on
+// every connect attempt, and rejects ports out of range
+func TestSetLocalPort(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer silent.Close()
+
+	// Find a free port, then release it for the client
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	client := NewClientWithTUN(silent.LocalAddr().String(), network.NewMockTunManager())
+	err = client.SetLocalPort(port)
+	if err != nil {
+		t.Fatalf("SetLocalPort failed: %v", err)
+	}
+
+	// The same port is reused when connecting again
+	buffer := make([]byte, 1500)
+	for attempt := 1; attempt <= 2; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		client.ConnectContext(ctx)
+		cancel()
+
+		silent.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := silent.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("Expected auth request on attempt %d: %v", attempt, err)
+		}
+		if from.Port != port {
+			t.Errorf("Expected attempt %d from port %d, got %d", attempt, port, from.Port)
+		}
+	}
+
+	for _, invalid := range []int{-1, 65536} {
+		if err := client.SetLocalPort(invalid); err == nil {
+			t.Errorf("Expected error for local port %d", invalid)
+		}
+	}
+}
+
+func TestSetLocalPort_InUse(t *testing.T) {
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer taken.Close()
+
+	client := NewClientWithTUN("127.0.0.1:1194", network.NewMockTunManager())
+	err = client.SetLocalPort(taken.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatalf("SetLocalPort failed: %v", err)
+	}
+
+	err = client.Connect()
+	if !errors.Is(err, ErrLocalAddrInUse) {
+		t.Errorf("Expected ErrLocalAddrInUse, got %v", err)
+	}
+}
+
+func TestSetNetworkKey(t *testing.T) {
+	client := NewClient("127.0.0.1:1194")
+
+	if err := client.SetNetworkKey(make([]byte, 16)); err == nil {
+		t.Error("Expected error for a 16-byte network key")
+	}
+	if err := client.SetNetworkKey(make([]byte, 32)); err != nil || len(client.networkKey) != 32 {
+		t.Errorf("Expected a 32-byte network key to be set, got %d bytes (%v)", len(client.networkKey), err)
+	}
+	if err := client.SetNetworkKey(nil); err != nil || client.networkKey != nil {
+		t.Errorf("Expected nil to disable the network key, got %x (%v)", client.networkKey, err)
+	}
+}
+
+// TestAuthRetries tests that a client resends the same auth request until
+// its retries run out, then reports ErrAuthTimeout
+func TestAuthRetries(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer silent.Close()
+
+	client := NewClientWithTUN(silent.LocalAddr().String(), network.NewMockTunManager())
+	if err := client.SetAuthTimeout(0, 1); err == nil {
+		t.Error("Expected error for a zero auth timeout")
+	}
+	if err := client.SetAuthTimeout(time.Second, -1); err == nil {
+		t.Error("Expected error for negative auth retries")
+	}
+	err = client.SetAuthTimeout(50*time.Millisecond, 2)
+	if err != nil {
+		t.Fatalf("SetAuthTimeout failed: %v", err)
+	}
+
+	err = client.Connect()
+	if !errors.Is(err, ErrAuthTimeout) {
+		t.Fatalf("Expected ErrAuthTimeout, got %v", err)
+	}
+
+	var requests [][]byte
+	buffer := make([]byte, 1500)
+	for {
+		silent.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := silent.Read(buffer)
+		if err != nil {
+			break
+		}
+		requests = append(requests, append([]byte(nil), buffer[:n]...))
+	}
+	if len(requests) != 3 {
+		t.Fatalf("Expected the request and 2 retries, got %d requests", len(requests))
+	}
+	for i, request := range requests[1:] {
+		if !bytes.Equal(request, requests[0]) {
+			t.Errorf("Expected retry %d to repeat the request, got %x", i+1, request)
+		}
+	}
+}
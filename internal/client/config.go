@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KeyEnvVar is the environment variable a pre-shared key can be passed in,
+// so ephemeral clients never have to write it to disk
+const KeyEnvVar = "FVPC_KEY"
+
+// NetworkKeyEnvVar is the environment variable the network key can be passed
+// in, taking precedence over the config file's network_key
+const NetworkKeyEnvVar = "FVPC_NETWORK_KEY"
+
+// Config is the client config file layout
+type Config struct {
+	Server           string        `yaml:"server,omitempty"`            // Server address, or comma-separated fallbacks, used when --server isn't given
+	ClientID         uint8         `yaml:"client_id"`                   // ID the key is registered under on the server
+	Key              string        `yaml:"key"`                         // Pre-shared 32-byte key, hex-encoded
+	NetworkKey       string        `yaml:"network_key,omitempty"`       // The server's 32-byte network key, hex-encoded
+	ServerIdentity   string        `yaml:"server_identity,omitempty"`   // The server's 32-byte identity public key, hex-encoded, to accept only that server
+	AuthTimeout      time.Duration `yaml:"auth_timeout,omitempty"`      // How long to wait for each auth response
+	AuthRetries      *int          `yaml:"auth_retries,omitempty"`      // Times to resend an unanswered auth request, nil for the default
+	DSCP             int           `yaml:"dscp,omitempty"`              // DSCP to mark datagrams to the server with, zero for none
+	KeepAliveSeconds int           `yaml:"keepalive_seconds,omitempty"` // Seconds between keepalive pings, zero for the default
+}
+
+// LoadConfig reads a client config file
+func LoadConfig(configPath string) (*Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return &config, nil
+}
+
+// WriteConfig writes a client config file readable only by its owner, since
+// it holds the pre-shared key
+func WriteConfig(configPath string, config *Config) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	err = os.WriteFile(configPath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// KeySources are the places a pre-shared key can come from
+type KeySources struct {
+	Stdin     io.Reader // Read when FromStdin is set
+	FromStdin bool      // Set by --key-stdin
+	Env       string    // Value of KeyEnvVar
+	File      string    // Key from the config file
+}
+
+// ResolveKey returns the pre-shared key from the first source that has one:
+// stdin if requested, then the environment, then the config file. It returns
+// nil if none does.
+func ResolveKey(sources KeySources) ([]byte, error) {
+	if sources.FromStdin {
+		line, err := bufio.NewReader(sources.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read key from stdin: %w", err)
+		}
+		return ParseKey(line)
+	}
+
+	if sources.Env != "" {
+		return ParseKey(sources.Env)
+	}
+
+	if sources.File != "" {
+		return ParseKey(sources.File)
+	}
+
+	return nil, nil
+}
+
+// KeepAliveSources are the places the keepalive interval can come from
+type KeepAliveSources struct {
+	Flag    int  // Seconds given by --keepalive
+	FlagSet bool // Set when --keepalive was given
+	File    int  // keepalive_seconds from the config file, zero if unset
+}
+
+// ResolveKeepAlive returns the keepalive interval from the first source that
+// sets one: the --keepalive flag, then the config file. It returns
+// DefaultKeepAliveInterval if neither does.
+func ResolveKeepAlive(sources KeepAliveSources) (time.Duration, error) {
+	if sources.FlagSet {
+		if sources.Flag <= 0 {
+			return 0, fmt.Errorf("invalid --keepalive %d: must be positive", sources.Flag)
+		}
+		return time.Duration(sources.Flag) * time.Second, nil
+	}
+
+	if sources.File < 0 {
+		return 0, fmt.Errorf("invalid keepalive_seconds %d: must be positive", sources.File)
+	}
+	if sources.File > 0 {
+		return time.Duration(sources.File) * time.Second, nil
+	}
+
+	return DefaultKeepAliveInterval, nil
+}
+
+// ParseKey decodes a hex-encoded 32-byte key, ignoring surrounding whitespace
+func ParseKey(hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex key: %w", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key: must be exactly 32 bytes (64 hex chars), got %d bytes", len(key))
+	}
+
+	return key, nil
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	stdinKey = "1111111111111111111111111111111111111111111111111111111111111111"
+	envKey   = "2222222222222222222222222222222222222222222222222222222222222222"
+	fileKey  = "3333333333333333333333333333333333333333333333333333333333333333"
+)
+
+func TestResolveKey_Precedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  KeySources
+		expected string
+	}{
+		{
+			name:     "stdin over env and file",
+			sources:  KeySources{Stdin: strings.NewReader(stdinKey + "\n"), FromStdin: true, Env: envKey, File: fileKey},
+			expected: stdinKey,
+		},
+		{
+			name:     "env over file",
+			sources:  KeySources{Stdin: strings.NewReader(stdinKey), Env: envKey, File: fileKey},
+			expected: envKey,
+		},
+		{
+			name:     "file alone",
+			sources:  KeySources{File: fileKey},
+			expected: fileKey,
+		},
+		{
+			name:     "no key",
+			sources:  KeySources{},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ResolveKey(tt.sources)
+			if err != nil {
+				t.Fatalf("ResolveKey failed: %v", err)
+			}
+
+			expected, _ := ParseKey(tt.expected)
+			if tt.expected == "" {
+				expected = nil
+			}
+			if !bytes.Equal(key, expected) {
+				t.Errorf("Expected key %x, got %x", expected, key)
+			}
+		})
+	}
+}
+
+func TestResolveKey_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources KeySources
+	}{
+		{"empty stdin", KeySources{Stdin: strings.NewReader(""), FromStdin: true, Env: envKey}},
+		{"short env key", KeySources{Env: "abcd"}},
+		{"non-hex file key", KeySources{File: strings.Repeat("zz", 32)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResolveKey(tt.sources)
+			if err == nil || !strings.Contains(err.Error(), "invalid") {
+				t.Errorf("Expected an invalid key error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "fvpc.yaml")
+	err := os.WriteFile(configPath, []byte("client_id: 7\nkey: \""+fileKey+"\"\nkeepalive_seconds: 15\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if config.ClientID != 7 {
+		t.Errorf("Expected client ID 7, got %d", config.ClientID)
+	}
+	if config.Key != fileKey {
+		t.Errorf("Expected key %s, got %s", fileKey, config.Key)
+	}
+	if config.KeepAliveSeconds != 15 {
+		t.Errorf("Expected keepalive_seconds 15, got %d", config.KeepAliveSeconds)
+	}
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Error("Expected error for a missing config file")
+	}
+}
+
+func TestResolveKeepAlive(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  KeepAliveSources
+		expected time.Duration
+	}{
+		{"flag over file", KeepAliveSources{Flag: 10, FlagSet: true, File: 15}, 10 * time.Second},
+		{"file when flag not given", KeepAliveSources{Flag: 30, File: 15}, 15 * time.Second},
+		{"default flag value given", KeepAliveSources{Flag: 30, FlagSet: true, File: 15}, 30 * time.Second},
+		{"neither", KeepAliveSources{Flag: 30}, DefaultKeepAliveInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interval, err := ResolveKeepAlive(tt.sources)
+			if err != nil {
+				t.Fatalf("ResolveKeepAlive failed: %v", err)
+			}
+			if interval != tt.expected {
+				t.Errorf("Expected interval %v, got %v", tt.expected, interval)
+			}
+		})
+	}
+
+	for _, sources := range []KeepAliveSources{
+		{Flag: 0, FlagSet: true},
+		{Flag: -5, FlagSet: true, File: 15},
+		{Flag: 30, File: -1},
+	} {
+		_, err := ResolveKeepAlive(sources)
+		if err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("Expected an invalid keepalive error for %+v, got %v", sources, err)
+		}
+	}
+}
+
+// TestWriteConfig tests that a written config loads back unchanged and is
+// kept private
+func TestWriteConfig(t *testing.T) {
+	retries := 4
+	written := &Config{
+		Server:      "vpn.example.com:1194",
+		ClientID:    9,
+		Key:         fileKey,
+		NetworkKey:  envKey,
+		AuthRetries: &retries,
+	}
+
+	configPath := filepath.Join(t.TempDir(), "fvpc.yaml")
+	err := WriteConfig(configPath, written)
+	if err != nil {
+		t.Fatalf("WriteConfig failed: %v", err)
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatalf("Failed to stat config: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %o", info.Mode().Perm())
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Server != written.Server || config.ClientID != written.ClientID || config.Key != written.Key || config.NetworkKey != written.NetworkKey {
+		t.Errorf("Expected %+v, got %+v", written, config)
+	}
+	if config.AuthRetries == nil || *config.AuthRetries != retries {
+		t.Errorf("Expected %d auth retries, got %v", retries, config.AuthRetries)
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// ErrServerFull matches a ServerError from a server that has no client IDs
+// or tunnel addresses left, so callers can tell it apart with errors.Is
+var ErrServerFull = errors.New("server at capacity")
+
+// ErrAuthTimeout is returned by Connect when the server doesn't answer the
+// auth request, even after it was resent as often as SetAuthTimeout allows
+var ErrAuthTimeout = errors.New("no auth response from server")
+
+// ErrLocalAddrInUse is returned by Connect when the local port set with
+// SetLocalPort is taken by another socket
+var ErrLocalAddrInUse = errors.New("local address already in use")
+
+// ErrServerIdentity is returned by Connect when a server identity is pinned
+// with SetServerIdentity and the server doesn't prove it has it
+var ErrServerIdentity = errors.New("server identity does not match the pinned key")
+
+// ErrNotConnected is returned by Send when the client has no session with a
+// server
+var ErrNotConnected = errors.New("not connected to a server")
+
+// ServerError is returned when the server answers a handshake with an error
+// packet instead of an auth response
+type ServerError struct {
+	Code    uint8
+	Message string // Detail from the server, may be empty
+}
+
+func (e *ServerError) Error() string {
+	reason := describeErrorCode(e.Code)
+	if e.Message == "" {
+		return "server refused connection: " + reason
+	}
+	return fmt.Sprintf("server refused connection: %s (%s)", reason, e.Message)
+}
+
+// Is reports whether target is the sentinel for this error's code
+func (e *ServerError) Is(target error) bool {
+	return target == ErrServerFull && e.Code == protocol.ErrorCodeServerFull
+}
+
+// describeErrorCode explains an error code in terms of what the user can do
+// about it
+func describeErrorCode(code uint8) string {
+	switch code {
+	case protocol.ErrorCodeUnknownClient:
+		return "client ID is not configured on the server, check the ID and key"
+	case protocol.ErrorCodeServerFull:
+		return "server at capacity, no room for more clients"
+	case protocol.ErrorCodeAlreadyConnected:
+		return "a client with this key is already connected"
+	case protocol.ErrorCodeAuthFailed:
+		return "authentication failed"
+	case protocol.ErrorCodeEncryptionMismatch:
+		return "encryption is disabled on only one side, both must use insecure_no_encryption or neither"
+	default:
+		return fmt.Sprintf("unknown error code %d", code)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// rekeyCheckInterval is how often the session is checked for a due rekey.
+// Overridable for tests.
+var rekeyCheckInterval = time.Second
+
+// rekeySession starts a rekey once the session keys are rekeyInterval old or
+// have carried rekeyBytes
+func (c *Client) rekeySession() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+			if !c.keys.Due(c.rekeyInterval, c.rekeyBytes) {
+				continue
+			}
+
+			nonce, err := c.keys.StartRekey()
+			if err == nil {
+				err = c.sendRekey(protocol.Rekey{Phase: protocol.RekeyRequest, Nonce: nonce})
+			}
+			if err != nil {
+				log.Printf("Failed to start rekey: %v", err)
+			}
+		}
+	}
+}
+
+// handleRekeyPacket takes the client's part in a rekey, whichever side
+// started it. Rekey packets are sealed like data, so forged ones are dropped.
+func (c *Client) handleRekeyPacket(packet *protocol.Packet) {
+	if !c.rekey || packet.ClientID != c.clientID {
+		log.Printf("Dropping unexpected rekey from server")
+		return
+	}
+
+	payload, err := c.keys.Open(c.cipher, packet.Payload, packet.Sequence)
+	if err != nil {
+		log.Printf("Failed to decrypt rekey from server: %v", err)
+		return
+	}
+
+	rekey, err := protocol.DecodeRekey(payload)
+	if err != nil {
+		log.Printf("Dropping rekey from server: %v", err)
+		return
+	}
+
+	switch rekey.Phase {
+	case protocol.RekeyRequest:
+		nonce, err := c.keys.AcceptRekey(c.key, rekey.Nonce)
+		if errors.Is(err, crypto.ErrRekeyInProgress) {
+			log.Printf("Ignoring rekey from server, the client's own is in progress")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept rekey from server: %v", err)
+			return
+		}
+		err = c.sendRekey(protocol.Rekey{Phase: protocol.RekeyResponse, Nonce: nonce, PeerNonce: rekey.Nonce})
+		if err != nil {
+			log.Printf("Failed to answer rekey from server: %v", err)
+		}
+	case protocol.RekeyResponse:
+		err := c.keys.FinishRekey(c.key, rekey.Nonce, rekey.PeerNonce)
+		if errors.Is(err, crypto.ErrNoRekeyPending) {
+			log.Printf("Ignoring stale rekey response from server")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to finish rekey: %v", err)
+			return
+		}
+		log.Printf("Rekeyed session with server")
+
+		err = c.sendRekey(protocol.Rekey{Phase: protocol.RekeyConfirm})
+		if err != nil {
+			log.Printf("Failed to confirm rekey: %v", err)
+		}
+	case protocol.RekeyConfirm:
+		// Opening it with the pending keys already switched to them
+		log.Printf("Rekeyed session with server")
+	}
+}
+
+// sendRekey seals a rekey payload with the current keys and sends it,
+// taking a sequence as a data packet would
+func (c *Client) sendRekey(rekey protocol.Rekey) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	sealed, err := c.keys.Seal(c.cipher, protocol.EncodeRekey(rekey), c.sequence)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt rekey: %w", err)
+	}
+
+	rekeyPacket := protocol.CreateRekeyPacket(c.clientID, c.sequence, sealed)
+	packetData, err := protocol.EncodePacket(rekeyPacket)
+	if err != nil {
+		return fmt.Errorf("failed to encode rekey: %w", err)
+	}
+
+	err = c.writePacket(packetData)
+	if err != nil {
+		return err
+	}
+	c.tracePacket("send", rekeyPacket, "", nil)
+
+	c.sequence++
+	return nil
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// rttSmoothing is the weight of a new sample in the smoothed RTT, the
+	// same 1/8 TCP uses
+	rttSmoothing = 0.125
+
+	// maxPendingPings bounds how many unanswered pings are remembered; the
+	// oldest is forgotten first, so lost pongs can't grow the map
+	maxPendingPings = 8
+)
+
+// rttTracker matches pongs to the pings they answer and keeps a smoothed
+// round-trip time. Pongs are matched by sequence, so they may arrive in any
+// order.
+type rttTracker struct {
+	mutex   sync.Mutex
+	pending map[uint32]time.Time // Send time by ping sequence
+	smooth  time.Duration        // Smoothed RTT, zero until the first sample
+	now     func() time.Time
+}
+
+func newRTTTracker(now func() time.Time) *rttTracker {
+	return &rttTracker{
+		pending: make(map[uint32]time.Time),
+		now:     now,
+	}
+}
+
+// Sent records that the ping with this sequence was sent
+func (t *rttTracker) Sent(sequence uint32) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.pending) >= maxPendingPings {
+		t.forgetOldest()
+	}
+	t.pending[sequence] = t.now()
+}
+
+// Received records the pong for a ping and returns its RTT. It returns false
+// for pongs that answer no remembered ping, such as duplicates or answers to
+// pings already forgotten.
+func (t *rttTracker) Received(sequence uint32) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	sentAt, ok := t.pending[sequence]
+	if !ok {
+		return 0, false
+	}
+	delete(t.pending, sequence)
+
+	sample := t.now().Sub(sentAt)
+	if t.smooth == 0 {
+		t.smooth = sample
+	} else {
+		t.smooth += time.Duration(rttSmoothing * float64(sample-t.smooth))
+	}
+
+	return sample, true
+}
+
+// RTT returns the smoothed round-trip time, or zero before the first pong
+func (t *rttTracker) RTT() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.smooth
+}
+
+// forgetOldest drops the ping that has waited longest for its pong. It must
+// be called with the mutex held.
+func (t *rttTracker) forgetOldest() {
+	var oldest uint32
+	var oldestAt time.Time
+	for sequence, sentAt := range t.pending {
+		if oldestAt.IsZero() || sentAt.Before(oldestAt) {
+			oldest, oldestAt = sequence, sentAt
+		}
+	}
+	delete(t.pending, oldest)
+}
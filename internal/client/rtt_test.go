@@ -0,0 +1,98 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests advance by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRTTTracker_Smoothing(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	tracker := newRTTTracker(clock.Now)
+
+	if tracker.RTT() != 0 {
+		t.Errorf("Expected no RTT before the first pong, got %s", tracker.RTT())
+	}
+
+	// The first sample is taken as-is
+	tracker.Sent(1)
+	clock.Advance(80 * time.Millisecond)
+	sample, ok := tracker.Received(1)
+	if !ok || sample != 80*time.Millisecond {
+		t.Fatalf("Expected an 80ms sample, got %s (ok=%t)", sample, ok)
+	}
+	if tracker.RTT() != 80*time.Millisecond {
+		t.Errorf("Expected smoothed RTT 80ms, got %s", tracker.RTT())
+	}
+
+	// Later samples move it an eighth of the way
+	tracker.Sent(2)
+	clock.Advance(160 * time.Millisecond)
+	tracker.Received(2)
+	if tracker.RTT() != 90*time.Millisecond {
+		t.Errorf("Expected smoothed RTT 90ms, got %s", tracker.RTT())
+	}
+}
+
+func TestRTTTracker_OutOfOrderPongs(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	tracker := newRTTTracker(clock.Now)
+
+	tracker.Sent(1)
+	clock.Advance(10 * time.Millisecond)
+	tracker.Sent(2)
+	clock.Advance(10 * time.Millisecond)
+
+	// The second ping's pong overtakes the first's
+	sample, ok := tracker.Received(2)
+	if !ok || sample != 10*time.Millisecond {
+		t.Errorf("Expected a 10ms sample for ping 2, got %s (ok=%t)", sample, ok)
+	}
+	sample, ok = tracker.Received(1)
+	if !ok || sample != 20*time.Millisecond {
+		t.Errorf("Expected a 20ms sample for ping 1, got %s (ok=%t)", sample, ok)
+	}
+
+	// Duplicates and pongs for pings never sent are ignored
+	if _, ok := tracker.Received(1); ok {
+		t.Error("Expected a duplicate pong to be ignored")
+	}
+	if _, ok := tracker.Received(99); ok {
+		t.Error("Expected a pong for an unknown ping to be ignored")
+	}
+}
+
+func TestRTTTracker_ForgetsLostPings(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	tracker := newRTTTracker(clock.Now)
+
+	// Far more pings than are remembered, none of them answered
+	for sequence := uint32(1); sequence <= 100; sequence++ {
+		tracker.Sent(sequence)
+		clock.Advance(time.Second)
+	}
+
+	if len(tracker.pending) != maxPendingPings {
+		t.Errorf("Expected %d pending pings, got %d", maxPendingPings, len(tracker.pending))
+	}
+
+	// The oldest were forgotten, the newest can still be matched
+	if _, ok := tracker.Received(1); ok {
+		t.Error("Expected the oldest ping to be forgotten")
+	}
+	if _, ok := tracker.Received(100); !ok {
+		t.Error("Expected the newest ping to be remembered")
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// statusTimeout bounds how long one status request may take
+const statusTimeout = 5 * time.Second
+
+// Status is a snapshot of the client's connection, as served on its status
+// socket
+type Status struct {
+	Connected  bool          `json:"connected"`
+	Server     string        `json:"server"`
+	ClientID   uint8         `json:"client_id"`
+	AssignedIP string        `json:"assigned_ip"`
+	Interface  string        `json:"interface"`
+	RTT        time.Duration `json:"rtt"` // Smoothed round-trip time to the server, zero before the first pong
+}
+
+// DefaultStatusSocket is the status socket fvpc connect listens on for the
+// TUN interface called interfaceName, so several clients on one host each
+// have their own
+func DefaultStatusSocket(interfaceName string) string {
+	return filepath.Join(os.TempDir(), "fvpc-"+interfaceName+".sock")
+}
+
+// Status returns a snapshot of the connection. It is safe to call from any
+// goroutine, also while the client reconnects.
+func (c *Client) Status() Status {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	return Status{
+		Connected:  c.connected.Load(),
+		Server:     c.serverAddr,
+		ClientID:   c.clientID,
+		AssignedIP: c.assignedIP,
+		Interface:  c.interfaceName,
+		RTT:        c.rtt.RTT(),
+	}
+}
+
+// ServeStatus answers every connection to a Unix socket at path with the
+// client's Status as JSON, until the returned listener is closed. The socket
+// is only accessible to its owner.
+func (c *Client) ServeStatus(path string) (net.Listener, error) {
+	// A socket left behind by a crashed client would block the listen, but
+	// one that still answers belongs to a running client
+	if _, err := os.Stat(path); err == nil {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("status socket %s is in use by another client", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := network.ListenUnixPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on status socket: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Status socket error: %v", err)
+				}
+				return
+			}
+
+			conn.SetDeadline(time.Now().Add(statusTimeout))
+			json.NewEncoder(conn).Encode(c.Status())
+			conn.Close()
+		}
+	}()
+
+	return listener, nil
+}
+
+// QueryStatus returns the Status served by the client listening on the
+// status socket at path
+func QueryStatus(path string) (*Status, error) {
+	conn, err := net.DialTimeout("unix", path, statusTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to status socket: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(statusTimeout))
+
+	var status Status
+	err = json.NewDecoder(conn).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// TestServeStatus tests that the status socket serves the connection,
+// including the smoothed RTT, and refuses to take over a running client's
+// socket
+func TestServeStatus(t *testing.T) {
+	server := startFakeServer(t, true)
+	client := NewClientWithTUN(server, network.NewMockTunManager())
+
+	err := client.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Disconnect()
+
+	client.rtt.Sent(1)
+	time.Sleep(10 * time.Millisecond)
+	client.rtt.Received(1)
+
+	path := filepath.Join(t.TempDir(), "fvpc.sock")
+	listener, err := client.ServeStatus(path)
+	if err != nil {
+		t.Fatalf("ServeStatus failed: %v", err)
+	}
+	defer listener.Close()
+
+	status, err := QueryStatus(path)
+	if err != nil {
+		t.Fatalf("QueryStatus failed: %v", err)
+	}
+	if !status.Connected || status.Server != server || status.ClientID != 1 || status.AssignedIP != "10.0.0.2" {
+		t.Errorf("Expected connected to %s as client 1 with 10.0.0.2, got %+v", server, status)
+	}
+	if status.Interface != DefaultInterfaceName {
+		t.Errorf("Expected interface %s, got %s", DefaultInterfaceName, status.Interface)
+	}
+	if status.RTT < 10*time.Millisecond {
+		t.Errorf("Expected an RTT of at least 10ms, got %v", status.RTT)
+	}
+
+	_, err = client.ServeStatus(path)
+	if err == nil {
+		t.Error("Expected a second client on the same status socket to fail")
+	}
+
+	listener.Close()
+	_, err = QueryStatus(path)
+	if err == nil {
+		t.Error("Expected no status once the socket is closed")
+	}
+}
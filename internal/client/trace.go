@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// SetPacketTrace makes the client log a line for every packet it sends or
+// receives: its type, client ID, sequence and length, whether a data packet
+// decrypted, and the addresses and ports of the IP packet inside. Payload
+// contents are never logged. Call it before Connect.
+func (c *Client) SetPacketTrace(enabled bool) {
+	c.trace = enabled
+}
+
+// tracePacket logs a packet for the packet trace if it is enabled. result
+// says what became of a data packet, and ipData is the IP packet it carries,
+// nil if unknown.
+func (c *Client) tracePacket(direction string, packet *protocol.Packet, result string, ipData []byte) {
+	if !c.trace {
+		return
+	}
+
+	line := fmt.Sprintf("TRACE %s %s: %s", direction, c.serverAddr, packet)
+	if result != "" {
+		line += ", " + result
+	}
+	if ipData != nil {
+		line += ", " + network.DescribeFlow(ipData)
+	}
+	log.Print(line)
+}
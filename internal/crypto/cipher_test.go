@@ -0,0 +1,90 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	payload := []byte("Hello, World!")
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	for _, c := range SupportedCiphers() {
+		t.Run(c.Name(), func(t *testing.T) {
+			encrypted, err := c.EncryptPayload(payload, key, 42)
+			if err != nil {
+				t.Fatalf("EncryptPayload failed: %v", err)
+			}
+
+			// Both suites append a 16-byte authentication tag
+			if len(encrypted) != len(payload)+16 {
+				t.Errorf("Expected %d encrypted bytes, got %d", len(payload)+16, len(encrypted))
+			}
+
+			decrypted, err := c.DecryptPayload(encrypted, key, 42)
+			if err != nil {
+				t.Fatalf("DecryptPayload failed: %v", err)
+			}
+
+			if !bytes.Equal(decrypted, payload) {
+				t.Errorf("Decrypted data doesn't match original: got %s, want %s", decrypted, payload)
+			}
+
+			// Wrong sequence must fail authentication
+			_, err = c.DecryptPayload(encrypted, key, 43)
+			if err != ErrDecryptionFailed {
+				t.Errorf("Expected ErrDecryptionFailed, got %v", err)
+			}
+
+			// Invalid key length must be rejected
+			_, err = c.EncryptPayload(payload, []byte("short"), 42)
+			if err == nil {
+				t.Error("Expected error for invalid key length")
+			}
+		})
+	}
+}
+
+func TestCiphersAreNotInterchangeable(t *testing.T) {
+	key := make([]byte, 32)
+
+	encrypted, err := AES256GCMCipher{}.EncryptPayload([]byte("payload"), key, 1)
+	if err != nil {
+		t.Fatalf("EncryptPayload failed: %v", err)
+	}
+
+	_, err = ChaCha20Poly1305Cipher{}.DecryptPayload(encrypted, key, 1)
+	if err != ErrDecryptionFailed {
+		t.Errorf("Expected ErrDecryptionFailed, got %v", err)
+	}
+}
+
+func TestCipherLookup(t *testing.T) {
+	c, err := CipherByName("")
+	if err != nil || c.ID() != CipherChaCha20Poly1305 {
+		t.Errorf("Expected empty name to select the default cipher, got %v, %v", c, err)
+	}
+
+	c, err = CipherByName("aes-256-gcm")
+	if err != nil || c.ID() != CipherAES256GCM {
+		t.Errorf("Expected aes-256-gcm, got %v, %v", c, err)
+	}
+
+	_, err = CipherByName("rot13")
+	if err == nil {
+		t.Error("Expected error for unsupported cipher name")
+	}
+
+	c, err = CipherByID(CipherChaCha20Poly1305)
+	if err != nil || c.Name() != "chacha20-poly1305" {
+		t.Errorf("Expected chacha20-poly1305, got %v, %v", c, err)
+	}
+
+	_, err = CipherByID(99)
+	if err == nil {
+		t.Error("Expected error for unsupported cipher id")
+	}
+}
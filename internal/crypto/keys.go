@@ -1,29 +1,109 @@
 package crypto
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type ClientConfig struct {
-	ID  uint8  `yaml:"id"`
-	Key string `yaml:"key"`
+	ID         uint8    `yaml:"id"`
+	Key        string   `yaml:"key"`
+	AllowedIPs []string `yaml:"allowed_ips,omitempty"` // Extra source networks, in CIDR notation
+	IP         string   `yaml:"ip,omitempty"`          // Tunnel IP reserved for this client
 }
 
 type Config struct {
 	Clients []ClientConfig `yaml:"clients"`
 }
 
+// ClientsDir is the directory next to a config file whose *.yaml files list
+// more clients, in the config file's clients format, so each client can be
+// managed as a file of its own
+const ClientsDir = "clients.d"
+
+// ClientsDirFiles returns the *.yaml files in the clients.d directory next
+// to the config file at configPath, sorted by name. A missing directory has
+// none.
+func ClientsDirFiles(configPath string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(configPath), ClientsDir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", ClientsDir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// MergeClientsDir returns clients, those of the config file at configPath,
+// followed by the clients listed in its clients.d files. It fails if two
+// entries share an ID, naming the files both came from.
+func MergeClientsDir(configPath string, clients []ClientConfig) ([]ClientConfig, error) {
+	files, err := ClientsDirFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[uint8]string)
+	merged := make([]ClientConfig, 0, len(clients))
+	add := func(source string, clients []ClientConfig) error {
+		for _, client := range clients {
+			if first, exists := sources[client.ID]; exists {
+				return fmt.Errorf("invalid client list: duplicate client ID %d in %s and %s", client.ID, first, source)
+			}
+			sources[client.ID] = source
+			merged = append(merged, client)
+		}
+		return nil
+	}
+
+	err = add(configPath, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client file: %w", err)
+		}
+
+		var config Config
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client file %s: %w", file, err)
+		}
+
+		err = add(file, config.Clients)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return merged, nil
+}
+
 type KeyManager struct {
-	keys map[uint8][]byte
+	keys      map[uint8][]byte
+	secondary map[uint8]secondaryKey // Previous keys still accepted after a rotation
+}
+
+// secondaryKey is a client's previous key, accepted until expires so
+// sessions using it survive a rotation
+type secondaryKey struct {
+	key     []byte
+	expires time.Time
 }
 
 func NewKeyManager() *KeyManager {
 	return &KeyManager{
-		keys: make(map[uint8][]byte),
+		keys:      make(map[uint8][]byte),
+		secondary: make(map[uint8]secondaryKey),
 	}
 }
 
@@ -38,21 +118,53 @@ func (km *KeyManager) LoadKeysFromConfig(configPath string) error {
 		return fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	km.keys = make(map[uint8][]byte)
+	clients, err := MergeClientsDir(configPath, config.Clients)
+	if err != nil {
+		return err
+	}
+
+	keys, err := DecodeClientKeys(clients)
+	if err != nil {
+		return err
+	}
+
+	km.keys = keys
+	return nil
+}
+
+// DecodeClientKeys decodes and validates the hex keys of configured clients
+func DecodeClientKeys(clients []ClientConfig) (map[uint8][]byte, error) {
+	keys := make(map[uint8][]byte)
+
+	for _, client := range clients {
+		if _, exists := keys[client.ID]; exists {
+			return nil, fmt.Errorf("invalid client list: duplicate client ID %d", client.ID)
+		}
 
-	for _, client := range config.Clients {
 		key, err := hex.DecodeString(client.Key)
 		if err != nil {
-			return fmt.Errorf("invalid hex key for client %d: %w", client.ID, err)
+			return nil, fmt.Errorf("invalid hex key for client %d: %w", client.ID, err)
 		}
 
 		if len(key) != 32 {
-			return fmt.Errorf("key for client %d must be exactly 32 bytes (64 hex chars), got %d bytes", client.ID, len(key))
+			return nil, fmt.Errorf("invalid key for client %d: must be exactly 32 bytes (64 hex chars), got %d bytes", client.ID, len(key))
 		}
 
-		km.keys[client.ID] = key
+		keys[client.ID] = key
+	}
+
+	return keys, nil
+}
+
+// AddClientKey registers a pre-shared key for a client without reading a config file
+func (km *KeyManager) AddClientKey(clientID uint8, key []byte) error {
+	if len(key) != 32 {
+		return ErrInvalidKeyLength
 	}
 
+	keyCopy := make([]byte, len(key))
+	copy(keyCopy, key)
+	km.keys[clientID] = keyCopy
 	return nil
 }
 
@@ -64,6 +176,71 @@ func (km *KeyManager) GetClientKey(clientID uint8) ([]byte, error) {
 	return key, nil
 }
 
+// SetSecondaryKey makes key, a client's previous key, acceptable alongside
+// its primary key until expires
+func (km *KeyManager) SetSecondaryKey(clientID uint8, key []byte, expires time.Time) error {
+	if len(key) != 32 {
+		return ErrInvalidKeyLength
+	}
+
+	if km.secondary == nil {
+		km.secondary = make(map[uint8]secondaryKey)
+	}
+	km.secondary[clientID] = secondaryKey{key: bytes.Clone(key), expires: expires}
+	return nil
+}
+
+// GetSecondaryKey returns a client's previous key and when it stops being
+// accepted, or ErrKeyNotFound if it has none or it has expired
+func (km *KeyManager) GetSecondaryKey(clientID uint8) ([]byte, time.Time, error) {
+	secondary, exists := km.secondary[clientID]
+	if !exists || !time.Now().Before(secondary.expires) {
+		return nil, time.Time{}, ErrKeyNotFound
+	}
+	return secondary.key, secondary.expires, nil
+}
+
+// AcceptsKey reports whether key is a client's primary key or its unexpired
+// secondary key
+func (km *KeyManager) AcceptsKey(clientID uint8, key []byte) bool {
+	primary, exists := km.keys[clientID]
+	if exists && bytes.Equal(primary, key) {
+		return true
+	}
+
+	secondary, _, err := km.GetSecondaryKey(clientID)
+	return err == nil && bytes.Equal(secondary, key)
+}
+
+// KeepRotatedKeys carries keys over from previous, the key manager being
+// replaced: a client whose key changed keeps its old key as a secondary key
+// until expires, and unexpired secondary keys of clients whose key didn't
+// change are kept as they are. Clients that were removed get nothing. It
+// returns the IDs of the clients whose key changed.
+func (km *KeyManager) KeepRotatedKeys(previous *KeyManager, expires time.Time) []uint8 {
+	var rotated []uint8
+	for clientID, key := range km.keys {
+		old, exists := previous.keys[clientID]
+		if !exists {
+			continue
+		}
+
+		if !bytes.Equal(old, key) {
+			km.SetSecondaryKey(clientID, old, expires)
+			rotated = append(rotated, clientID)
+			continue
+		}
+
+		secondary, secondaryExpires, err := previous.GetSecondaryKey(clientID)
+		if err == nil {
+			km.SetSecondaryKey(clientID, secondary, secondaryExpires)
+		}
+	}
+
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i] < rotated[j] })
+	return rotated
+}
+
 func (km *KeyManager) HasClient(clientID uint8) bool {
 	_, exists := km.keys[clientID]
 	return exists
@@ -1,8 +1,14 @@
 package crypto
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestKeyManager(t *testing.T) {
@@ -148,3 +154,254 @@ func TestKeyManagerWrongKeyLength(t *testing.T) {
 		t.Error("Expected error for wrong key length")
 	}
 }
+
+func TestDecodeClientKeys(t *testing.T) {
+	clients := []ClientConfig{
+		{ID: 1, Key: "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456"},
+		{ID: 2, Key: "fedcba0987654321fedcba0987654321fedcba0987654321fedcba0987654321"},
+	}
+
+	keys, err := DecodeClientKeys(clients)
+	if err != nil {
+		t.Fatalf("DecodeClientKeys failed: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 keys, got %d", len(keys))
+	}
+	if len(keys[1]) != 32 {
+		t.Errorf("Key length should be 32, got %d", len(keys[1]))
+	}
+
+	// Test invalid hex
+	_, err = DecodeClientKeys([]ClientConfig{{ID: 1, Key: "not-hex"}})
+	if err == nil {
+		t.Error("Expected error for invalid hex key")
+	}
+
+	// Test wrong length
+	_, err = DecodeClientKeys([]ClientConfig{{ID: 1, Key: "a1b2c3d4"}})
+	if err == nil {
+		t.Error("Expected error for short key")
+	}
+}
+
+func TestAddClientKey(t *testing.T) {
+	km := NewKeyManager()
+
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	err := km.AddClientKey(7, key)
+	if err != nil {
+		t.Fatalf("AddClientKey failed: %v", err)
+	}
+
+	// Modifying the original must not affect the stored key
+	key[0] = 0xFF
+
+	stored, err := km.GetClientKey(7)
+	if err != nil {
+		t.Fatalf("GetClientKey(7) failed: %v", err)
+	}
+	if stored[0] != 0 {
+		t.Error("Stored key should be a copy of the provided key")
+	}
+
+	// Test wrong length
+	err = km.AddClientKey(8, make([]byte, 16))
+	if err != ErrInvalidKeyLength {
+		t.Errorf("Expected ErrInvalidKeyLength, got %v", err)
+	}
+}
+
+func TestDecodeClientKeys_DuplicateID(t *testing.T) {
+	key := "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456"
+
+	_, err := DecodeClientKeys([]ClientConfig{{ID: 1, Key: key}, {ID: 1, Key: key}})
+	if err == nil {
+		t.Error("Expected error for duplicate client ID")
+	}
+}
+
+func TestSecondaryKey(t *testing.T) {
+	primary := bytes.Repeat([]byte{0x11}, 32)
+	secondary := bytes.Repeat([]byte{0x22}, 32)
+
+	km := NewKeyManager()
+	km.AddClientKey(1, primary)
+	err := km.SetSecondaryKey(1, secondary, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("SetSecondaryKey failed: %v", err)
+	}
+
+	key, _, err := km.GetSecondaryKey(1)
+	if err != nil || !bytes.Equal(key, secondary) {
+		t.Errorf("Expected the secondary key, got %x, %v", key, err)
+	}
+	if !km.AcceptsKey(1, primary) || !km.AcceptsKey(1, secondary) {
+		t.Error("Expected both keys accepted during the grace period")
+	}
+	if km.AcceptsKey(1, bytes.Repeat([]byte{0x33}, 32)) {
+		t.Error("Expected an unknown key to be refused")
+	}
+
+	km.SetSecondaryKey(1, secondary, time.Now().Add(-time.Second))
+	if _, _, err := km.GetSecondaryKey(1); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for an expired key, got %v", err)
+	}
+	if km.AcceptsKey(1, secondary) {
+		t.Error("Expected the secondary key refused once expired")
+	}
+
+	if err := km.SetSecondaryKey(1, make([]byte, 16), time.Now()); err != ErrInvalidKeyLength {
+		t.Errorf("Expected ErrInvalidKeyLength, got %v", err)
+	}
+}
+
+func TestKeepRotatedKeys(t *testing.T) {
+	keyA := bytes.Repeat([]byte{0xAA}, 32)
+	keyB := bytes.Repeat([]byte{0xBB}, 32)
+	keyC := bytes.Repeat([]byte{0xCC}, 32)
+	expires := time.Now().Add(time.Hour)
+
+	previous := NewKeyManager()
+	previous.AddClientKey(1, keyA) // Rotated
+	previous.AddClientKey(2, keyB) // Unchanged, still in an earlier grace period
+	previous.SetSecondaryKey(2, keyC, expires)
+	previous.AddClientKey(3, keyC) // Removed
+
+	reloaded := NewKeyManager()
+	reloaded.AddClientKey(1, keyB)
+	reloaded.AddClientKey(2, keyB)
+	rotated := reloaded.KeepRotatedKeys(previous, time.Now().Add(time.Minute))
+	if len(rotated) != 1 || rotated[0] != 1 {
+		t.Errorf("Expected only client 1 rotated, got %v", rotated)
+	}
+
+	if !reloaded.AcceptsKey(1, keyA) || !reloaded.AcceptsKey(1, keyB) {
+		t.Error("Expected a rotated client to have both keys accepted")
+	}
+	if key, until, err := reloaded.GetSecondaryKey(2); err != nil || !bytes.Equal(key, keyC) || !until.Equal(expires) {
+		t.Errorf("Expected the earlier secondary key kept with its expiry, got %x until %s, %v", key, until, err)
+	}
+	if reloaded.AcceptsKey(3, keyC) {
+		t.Error("Expected a removed client to have no keys")
+	}
+}
+
+// writeClientsDir writes a config file listing base in dir, and a clients.d
+// file for each of files
+func writeClientsDir(t *testing.T, base string, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "server.yaml")
+	err := os.WriteFile(configPath, []byte(base), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	err = os.Mkdir(filepath.Join(dir, ClientsDir), 0700)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", ClientsDir, err)
+	}
+	for name, content := range files {
+		err = os.WriteFile(filepath.Join(dir, ClientsDir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return configPath
+}
+
+func TestLoadKeysFromConfig_ClientsDir(t *testing.T) {
+	configPath := writeClientsDir(t, `clients:
+  - id: 1
+    key: "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456"
+`, map[string]string{
+		"client-2.yaml": `clients:
+  - id: 2
+    key: "fedcba0987654321fedcba0987654321fedcba0987654321fedcba0987654321"
+`,
+		"team.yaml": `clients:
+  - id: 3
+    key: "1111111111111111111111111111111111111111111111111111111111111111"
+  - id: 4
+    key: "2222222222222222222222222222222222222222222222222222222222222222"
+`,
+		"notes.txt": "not a client file",
+	})
+
+	km := NewKeyManager()
+	err := km.LoadKeysFromConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadKeysFromConfig failed: %v", err)
+	}
+
+	for _, clientID := range []uint8{1, 2, 3, 4} {
+		if !km.HasClient(clientID) {
+			t.Errorf("Expected client %d to be loaded", clientID)
+		}
+	}
+	key, _ := km.GetClientKey(3)
+	if !bytes.Equal(key, bytes.Repeat([]byte{0x11}, 32)) {
+		t.Errorf("Expected client 3's key from team.yaml, got %x", key)
+	}
+}
+
+func TestMergeClientsDir_Duplicates(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		files map[string]string
+		want  string // Both files named in the error
+	}{
+		{
+			name: "config file and clients.d",
+			base: "clients:\n  - id: 1\n    key: \"aa\"\n",
+			files: map[string]string{
+				"client-1.yaml": "clients:\n  - id: 1\n    key: \"bb\"\n",
+			},
+			want: "server.yaml and",
+		},
+		{
+			name: "two clients.d files",
+			base: "clients: []\n",
+			files: map[string]string{
+				"a.yaml": "clients:\n  - id: 7\n    key: \"aa\"\n",
+				"b.yaml": "clients:\n  - id: 7\n    key: \"bb\"\n",
+			},
+			want: "a.yaml and",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := writeClientsDir(t, tt.base, tt.files)
+
+			var config Config
+			data, _ := os.ReadFile(configPath)
+			yaml.Unmarshal(data, &config)
+
+			_, err := MergeClientsDir(configPath, config.Clients)
+			if err == nil || !strings.Contains(err.Error(), "duplicate client ID") || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected a duplicate ID error naming both files, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeClientsDir_NoDirectory(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	clients := []ClientConfig{{ID: 1, Key: "aa"}}
+
+	merged, err := MergeClientsDir(configPath, clients)
+	if err != nil {
+		t.Fatalf("MergeClientsDir failed: %v", err)
+	}
+	if len(merged) != 1 || merged[0].ID != 1 {
+		t.Errorf("Expected the config file's clients alone, got %v", merged)
+	}
+}
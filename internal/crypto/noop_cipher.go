@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"fmt"
+	"os"
+)
+
+// CipherNone identifies the NoopCipher in the handshake. It is never offered
+// or accepted unless both peers have encryption explicitly disabled.
+const CipherNone uint8 = 255
+
+// InsecureEnvVar must be set to "1" for InsecureCipher to hand out the
+// NoopCipher, so a stray config flag alone can't disable encryption
+const InsecureEnvVar = "FVP_INSECURE_NO_ENCRYPTION"
+
+// NoopCipher passes payloads through unencrypted and unauthenticated, so
+// packet captures are readable while debugging the protocol. It must never be
+// used in production.
+type NoopCipher struct{}
+
+func (NoopCipher) ID() uint8 {
+	return CipherNone
+}
+
+func (NoopCipher) Name() string {
+	return "none"
+}
+
+func (NoopCipher) EncryptPayload(payload []byte, key []byte, sequence uint32) ([]byte, error) {
+	return append([]byte(nil), payload...), nil
+}
+
+func (NoopCipher) DecryptPayload(encryptedPayload []byte, key []byte, sequence uint32) ([]byte, error) {
+	return append([]byte(nil), encryptedPayload...), nil
+}
+
+// InsecureCipher returns the NoopCipher if InsecureEnvVar is set to "1"
+func InsecureCipher() (Cipher, error) {
+	if os.Getenv(InsecureEnvVar) != "1" {
+		return nil, fmt.Errorf("disabling encryption also requires %s=1 in the environment", InsecureEnvVar)
+	}
+	return NoopCipher{}, nil
+}
+
+var _ Cipher = NoopCipher{}
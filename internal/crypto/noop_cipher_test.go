@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNoopCipher_RoundTrip(t *testing.T) {
+	cipher := NoopCipher{}
+	payload := []byte("readable in a packet capture")
+
+	encrypted, err := cipher.EncryptPayload(payload, nil, 1)
+	if err != nil {
+		t.Fatalf("EncryptPayload failed: %v", err)
+	}
+	if !bytes.Equal(encrypted, payload) {
+		t.Errorf("Expected payload to pass through unchanged, got %x", encrypted)
+	}
+
+	decrypted, err := cipher.DecryptPayload(encrypted, nil, 1)
+	if err != nil {
+		t.Fatalf("DecryptPayload failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, payload) {
+		t.Errorf("Expected %x, got %x", payload, decrypted)
+	}
+}
+
+func TestNoopCipher_NeverNegotiable(t *testing.T) {
+	for _, cipher := range SupportedCiphers() {
+		if cipher.ID() == CipherNone {
+			t.Error("Expected the noop cipher not to be offered")
+		}
+	}
+	if _, err := CipherByID(CipherNone); err == nil {
+		t.Error("Expected CipherByID not to find the noop cipher")
+	}
+	if _, err := CipherByName("none"); err == nil {
+		t.Error("Expected CipherByName not to find the noop cipher")
+	}
+}
+
+func TestInsecureCipher_RequiresEnv(t *testing.T) {
+	t.Setenv(InsecureEnvVar, "")
+	if _, err := InsecureCipher(); err == nil {
+		t.Errorf("Expected InsecureCipher to fail without %s", InsecureEnvVar)
+	}
+
+	t.Setenv(InsecureEnvVar, "1")
+	cipher, err := InsecureCipher()
+	if err != nil {
+		t.Fatalf("InsecureCipher failed: %v", err)
+	}
+	if cipher.ID() != CipherNone {
+		t.Errorf("Expected the noop cipher, got %s", cipher.Name())
+	}
+}
@@ -0,0 +1,273 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// RekeyOverlap is how long the keys a rekey replaced still open packets,
+	// so those the peer sent before it switched aren't lost
+	RekeyOverlap = 5 * time.Second
+
+	// RekeyTimeout is how long a rekey waits for the peer before another
+	// may start
+	RekeyTimeout = 10 * time.Second
+)
+
+var (
+	ErrRekeyInProgress = errors.New("a rekey started by this side is in progress")
+	ErrNoRekeyPending  = errors.New("no matching rekey in progress")
+	ErrNoSessionKeys   = errors.New("no session keys established")
+)
+
+// KeyRing holds one side's data keys for a session across rekeys: the
+// current keys, keys a rekey derived that the peer hasn't switched to yet,
+// and for RekeyOverlap after a switch the keys it replaced. It is safe for
+// concurrent use.
+//
+// A rekey takes three packets. The side starting it sends a fresh nonce
+// (StartRekey); the peer answers with its own and keeps the keys derived
+// from both pending (AcceptRekey); the starting side derives the same keys,
+// switches to them and confirms (FinishRekey). The peer switches as soon as
+// a packet opens with the pending keys, the confirm or any after it.
+type KeyRing struct {
+	mutex          sync.Mutex
+	client         bool // Held by the client, which sends with ClientToServer
+	current        *SessionKeys
+	pending        *SessionKeys // Derived by a rekey the peer hasn't switched to yet
+	previous       *SessionKeys // Replaced by the last switch
+	previousExpiry time.Time    // When previous stops opening packets
+	nonce          []byte       // Nonce of the rekey this side started, until answered
+	started        time.Time    // When the rekey in progress started
+	switched       time.Time    // When current took over
+	bytes          uint64       // Payload bytes sealed and opened with current
+	rekeys         int          // Switches since the session started
+
+	// Overridable for tests
+	now func() time.Time
+}
+
+// NewKeyRing returns a key ring starting with keys, for the client side of
+// the session if client is set and the server side otherwise. With nil keys
+// nothing seals or opens, for sessions whose handshake hasn't derived keys
+// yet.
+func NewKeyRing(keys *SessionKeys, client bool) *KeyRing {
+	return &KeyRing{
+		client:   client,
+		current:  keys,
+		switched: time.Now(),
+		now:      time.Now,
+	}
+}
+
+// Keys returns the current keys
+func (r *KeyRing) Keys() *SessionKeys {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// Rekeys returns how many rekeys have completed on this side
+func (r *KeyRing) Rekeys() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rekeys
+}
+
+// Seal encrypts a payload for the peer with the current keys
+func (r *KeyRing) Seal(cipher Cipher, payload []byte, sequence uint32) ([]byte, error) {
+	r.mutex.Lock()
+	keys := r.current
+	r.mutex.Unlock()
+	if keys == nil {
+		return nil, ErrNoSessionKeys
+	}
+
+	sealed, err := cipher.EncryptPayload(payload, r.sendKey(keys), sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	r.count(keys, len(payload))
+	return sealed, nil
+}
+
+// Open decrypts a payload from the peer with the current keys, or failing
+// that the pending keys, which means the peer switched and so does this
+// side, or the keys the last switch replaced while they overlap. The error
+// is the one the current keys gave.
+func (r *KeyRing) Open(cipher Cipher, sealed []byte, sequence uint32) ([]byte, error) {
+	r.mutex.Lock()
+	current, pending, previous := r.current, r.pending, r.previous
+	if previous != nil && !r.now().Before(r.previousExpiry) {
+		r.previous = nil
+		previous = nil
+	}
+	r.mutex.Unlock()
+	if current == nil {
+		return nil, ErrNoSessionKeys
+	}
+
+	payload, err := cipher.DecryptPayload(sealed, r.receiveKey(current), sequence)
+	if err == nil {
+		r.count(current, len(payload))
+		return payload, nil
+	}
+
+	if pending != nil {
+		if payload, pendingErr := cipher.DecryptPayload(sealed, r.receiveKey(pending), sequence); pendingErr == nil {
+			r.mutex.Lock()
+			if r.pending == pending {
+				r.switchLocked()
+			}
+			r.mutex.Unlock()
+			r.count(pending, len(payload))
+			return payload, nil
+		}
+	}
+
+	if previous != nil {
+		if payload, previousErr := cipher.DecryptPayload(sealed, r.receiveKey(previous), sequence); previousErr == nil {
+			return payload, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Due reports whether this side should start a rekey: when interval has
+// passed or bytes payload bytes went through since the last one, zero
+// disabling either. A rekey in progress holds the next one off until it
+// completes or RekeyTimeout passes.
+func (r *KeyRing) Due(interval time.Duration, bytes uint64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	if r.nonce != nil || r.pending != nil {
+		if now.Sub(r.started) < RekeyTimeout {
+			return false
+		}
+		// The peer never answered, or never switched
+		r.nonce = nil
+		r.pending = nil
+	}
+
+	return (interval > 0 && now.Sub(r.switched) >= interval) || (bytes > 0 && r.bytes >= bytes)
+}
+
+// StartRekey begins a rekey, returning the nonce to send the peer in a
+// request
+func (r *KeyRing) StartRekey() ([]byte, error) {
+	nonce, err := GenerateSessionNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nonce = nonce
+	r.started = r.now()
+	return nonce, nil
+}
+
+// AcceptRekey answers a rekey the peer started with peerNonce, deriving the
+// new keys from psk and both nonces and keeping them pending until the peer
+// switches. It returns the nonce to send back. If both sides start a rekey
+// at once, the client's goes ahead: the server drops its own and the client
+// refuses the server's with ErrRekeyInProgress.
+func (r *KeyRing) AcceptRekey(psk, peerNonce []byte) ([]byte, error) {
+	nonce, err := GenerateSessionNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.client && r.nonce != nil {
+		return nil, ErrRekeyInProgress
+	}
+
+	keys, err := r.derive(psk, nonce, peerNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	r.nonce = nil
+	r.pending = keys
+	r.started = r.now()
+	return nonce, nil
+}
+
+// FinishRekey completes the rekey this side started once the peer answers
+// with peerNonce, echoing the request's nonce, and switches to the new keys.
+// It fails with ErrNoRekeyPending for an answer to a request that has since
+// been replaced or finished.
+func (r *KeyRing) FinishRekey(psk, peerNonce, echoed []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.nonce == nil || !bytes.Equal(echoed, r.nonce) {
+		return ErrNoRekeyPending
+	}
+
+	keys, err := r.derive(psk, r.nonce, peerNonce)
+	if err != nil {
+		return err
+	}
+
+	r.pending = keys
+	r.switchLocked()
+	return nil
+}
+
+// derive returns the keys for a rekey from psk and each side's nonce, which
+// keep their handshake roles whichever side started it
+func (r *KeyRing) derive(psk, nonce, peerNonce []byte) (*SessionKeys, error) {
+	if r.client {
+		return DeriveSessionKeys(psk, nonce, peerNonce)
+	}
+	return DeriveSessionKeys(psk, peerNonce, nonce)
+}
+
+// switchLocked makes the pending keys current, keeping the replaced ones for
+// RekeyOverlap. The caller must hold the mutex.
+func (r *KeyRing) switchLocked() {
+	now := r.now()
+	r.previous = r.current
+	r.previousExpiry = now.Add(RekeyOverlap)
+	r.current = r.pending
+	r.pending = nil
+	r.nonce = nil
+	r.switched = now
+	r.bytes = 0
+	r.rekeys++
+}
+
+// count adds n payload bytes to the traffic under keys, if they are still
+// current
+func (r *KeyRing) count(keys *SessionKeys, n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.current == keys {
+		r.bytes += uint64(n)
+	}
+}
+
+func (r *KeyRing) sendKey(keys *SessionKeys) []byte {
+	if r.client {
+		return keys.ClientToServer
+	}
+	return keys.ServerToClient
+}
+
+func (r *KeyRing) receiveKey(keys *SessionKeys) []byte {
+	if r.client {
+		return keys.ServerToClient
+	}
+	return keys.ClientToServer
+}
@@ -0,0 +1,216 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newKeyRings returns the client and server key rings of a session with a
+// fake clock, and the pre-shared key it was derived from
+func newKeyRings(t *testing.T, now *time.Time) (*KeyRing, *KeyRing, []byte) {
+	t.Helper()
+
+	psk := bytes.Repeat([]byte{0x42}, 32)
+	clientNonce, _ := GenerateSessionNonce()
+	serverNonce, _ := GenerateSessionNonce()
+	keys, err := DeriveSessionKeys(psk, clientNonce, serverNonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+
+	client := NewKeyRing(keys, true)
+	server := NewKeyRing(keys, false)
+	for _, ring := range []*KeyRing{client, server} {
+		ring.now = func() time.Time { return *now }
+		ring.switched = *now
+	}
+	return client, server, psk
+}
+
+// rekey runs a rekey started by from, up to the point the responder has
+// the new keys pending
+func rekey(t *testing.T, from, to *KeyRing, psk []byte) {
+	t.Helper()
+
+	nonce, err := from.StartRekey()
+	if err != nil {
+		t.Fatalf("StartRekey failed: %v", err)
+	}
+	peerNonce, err := to.AcceptRekey(psk, nonce)
+	if err != nil {
+		t.Fatalf("AcceptRekey failed: %v", err)
+	}
+	err = from.FinishRekey(psk, peerNonce, nonce)
+	if err != nil {
+		t.Fatalf("FinishRekey failed: %v", err)
+	}
+}
+
+// TestKeyRing_NoSessionKeys tests that a ring without keys refuses to seal
+// or open instead of using an empty key
+func TestKeyRing_NoSessionKeys(t *testing.T) {
+	ring := NewKeyRing(nil, false)
+
+	if _, err := ring.Seal(DefaultCipher(), []byte("payload"), 1); !errors.Is(err, ErrNoSessionKeys) {
+		t.Errorf("Expected ErrNoSessionKeys from Seal, got %v", err)
+	}
+	if _, err := ring.Open(DefaultCipher(), []byte("sealed payload"), 1); !errors.Is(err, ErrNoSessionKeys) {
+		t.Errorf("Expected ErrNoSessionKeys from Open, got %v", err)
+	}
+}
+
+func TestKeyRing_Rekey(t *testing.T) {
+	now := time.Now()
+	client, server, psk := newKeyRings(t, &now)
+	cipher := DefaultCipher()
+	old := server.Keys()
+
+	rekey(t, server, client, psk)
+	if server.Rekeys() != 1 || client.Rekeys() != 0 {
+		t.Fatalf("Expected only the server to have switched, got %d and %d rekeys", server.Rekeys(), client.Rekeys())
+	}
+
+	// The first packet under the new keys switches the client too
+	sealed, err := server.Seal(cipher, []byte("confirm"), 1)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	payload, err := client.Open(cipher, sealed, 1)
+	if err != nil || string(payload) != "confirm" {
+		t.Fatalf("Expected the client to open the packet, got %q, %v", payload, err)
+	}
+	if client.Rekeys() != 1 {
+		t.Errorf("Expected the client to switch, got %d rekeys", client.Rekeys())
+	}
+
+	if !bytes.Equal(client.Keys().ClientToServer, server.Keys().ClientToServer) || !bytes.Equal(client.Keys().ServerToClient, server.Keys().ServerToClient) {
+		t.Error("Expected both sides to derive the same keys")
+	}
+	if bytes.Equal(server.Keys().ClientToServer, old.ClientToServer) || bytes.Equal(server.Keys().ServerToClient, old.ServerToClient) {
+		t.Error("Expected the rekey to replace both keys")
+	}
+
+	sealed, err = client.Seal(cipher, []byte("data"), 2)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	_, err = server.Open(cipher, sealed, 2)
+	if err != nil {
+		t.Errorf("Expected the server to open a packet under the new keys, got %v", err)
+	}
+}
+
+// TestKeyRing_Overlap tests that packets sealed before the peer switched
+// still open for RekeyOverlap, and not after
+func TestKeyRing_Overlap(t *testing.T) {
+	now := time.Now()
+	client, server, psk := newKeyRings(t, &now)
+	cipher := DefaultCipher()
+
+	// In flight when the client switches
+	inFlight, err := server.Seal(cipher, []byte("in flight"), 1)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	late, err := server.Seal(cipher, []byte("late"), 2)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+
+	rekey(t, client, server, psk)
+
+	now = now.Add(RekeyOverlap - time.Millisecond)
+	payload, err := client.Open(cipher, inFlight, 1)
+	if err != nil || string(payload) != "in flight" {
+		t.Errorf("Expected the old keys to open a packet within the overlap, got %q, %v", payload, err)
+	}
+
+	now = now.Add(time.Millisecond)
+	_, err = client.Open(cipher, late, 2)
+	if err == nil {
+		t.Error("Expected the old keys to be dropped after the overlap")
+	}
+}
+
+// TestKeyRing_StaleResponse tests that an answer to a replaced request is
+// refused rather than deriving keys the peer doesn't have
+func TestKeyRing_StaleResponse(t *testing.T) {
+	now := time.Now()
+	client, server, psk := newKeyRings(t, &now)
+
+	first, _ := server.StartRekey()
+	peerNonce, err := client.AcceptRekey(psk, first)
+	if err != nil {
+		t.Fatalf("AcceptRekey failed: %v", err)
+	}
+
+	server.StartRekey()
+	err = server.FinishRekey(psk, peerNonce, first)
+	if !errors.Is(err, ErrNoRekeyPending) {
+		t.Errorf("Expected ErrNoRekeyPending, got %v", err)
+	}
+	if server.Rekeys() != 0 {
+		t.Errorf("Expected no switch, got %d rekeys", server.Rekeys())
+	}
+}
+
+// TestKeyRing_Collision tests that the client's rekey goes ahead when both
+// sides start one at once
+func TestKeyRing_Collision(t *testing.T) {
+	now := time.Now()
+	client, server, psk := newKeyRings(t, &now)
+
+	clientNonce, _ := client.StartRekey()
+	serverNonce, _ := server.StartRekey()
+
+	_, err := client.AcceptRekey(psk, serverNonce)
+	if !errors.Is(err, ErrRekeyInProgress) {
+		t.Errorf("Expected the client to refuse the server's rekey, got %v", err)
+	}
+
+	answer, err := server.AcceptRekey(psk, clientNonce)
+	if err != nil {
+		t.Fatalf("Expected the server to accept the client's rekey, got %v", err)
+	}
+	err = client.FinishRekey(psk, answer, clientNonce)
+	if err != nil {
+		t.Errorf("FinishRekey failed: %v", err)
+	}
+}
+
+func TestKeyRing_Due(t *testing.T) {
+	now := time.Now()
+	client, server, psk := newKeyRings(t, &now)
+
+	if server.Due(time.Minute, 0) {
+		t.Error("Expected no rekey before the interval")
+	}
+	now = now.Add(time.Minute)
+	if !server.Due(time.Minute, 0) {
+		t.Error("Expected a rekey after the interval")
+	}
+
+	// Held off while a rekey is in progress, until it times out
+	server.StartRekey()
+	if server.Due(time.Minute, 0) {
+		t.Error("Expected no rekey while one is in progress")
+	}
+	now = now.Add(RekeyTimeout)
+	if !server.Due(time.Minute, 0) {
+		t.Error("Expected a rekey once the one in progress timed out")
+	}
+
+	rekey(t, server, client, psk)
+	if server.Due(time.Minute, 100) {
+		t.Error("Expected no rekey right after one")
+	}
+	server.Seal(DefaultCipher(), make([]byte, 100), 1)
+	if !server.Due(time.Minute, 100) {
+		t.Error("Expected a rekey after the byte count")
+	}
+	if server.Due(0, 0) {
+		t.Error("Expected no rekey with both triggers disabled")
+	}
+}
@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SessionNonceSize is the size of the random nonce each side contributes
+const SessionNonceSize = 32
+
+// HKDF info labels, one per derived key
+var (
+	clientToServerLabel = []byte("fvp client to server")
+	serverToClientLabel = []byte("fvp server to client")
+)
+
+var ErrInvalidSessionNonce = errors.New("session nonce must be exactly 32 bytes")
+
+// SessionKeys holds the per-direction data keys for one session
+type SessionKeys struct {
+	ClientToServer []byte
+	ServerToClient []byte
+}
+
+// GenerateSessionNonce returns a fresh random nonce for the handshake
+func GenerateSessionNonce() ([]byte, error) {
+	nonce := make([]byte, SessionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// DeriveSessionKeys derives the client→server and server→client keys from the
+// pre-shared key and both handshake nonces using HKDF-SHA256. The nonces form
+// the salt, so every session gets keys that are independent of past sessions
+// and sequence numbers can restart without reusing an AEAD nonce.
+func DeriveSessionKeys(psk, clientNonce, serverNonce []byte) (*SessionKeys, error) {
+	if len(psk) != 32 {
+		return nil, ErrInvalidKeyLength
+	}
+	if len(clientNonce) != SessionNonceSize || len(serverNonce) != SessionNonceSize {
+		return nil, ErrInvalidSessionNonce
+	}
+
+	salt := make([]byte, 0, 2*SessionNonceSize)
+	salt = append(salt, clientNonce...)
+	salt = append(salt, serverNonce...)
+	prk := hkdf.Extract(sha256.New, psk, salt)
+
+	clientToServer, err := expandKey(prk, clientToServerLabel)
+	if err != nil {
+		return nil, &CryptoError{Operation: "key derivation", Err: err}
+	}
+
+	serverToClient, err := expandKey(prk, serverToClientLabel)
+	if err != nil {
+		return nil, &CryptoError{Operation: "key derivation", Err: err}
+	}
+
+	return &SessionKeys{
+		ClientToServer: clientToServer,
+		ServerToClient: serverToClient,
+	}, nil
+}
+
+func expandKey(prk, info []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveSessionKeys_Vectors(t *testing.T) {
+	psk := make([]byte, 32)
+	clientNonce := make([]byte, 32)
+	serverNonce := make([]byte, 32)
+	for i := range psk {
+		psk[i] = byte(i)
+		clientNonce[i] = byte(0x40 + i)
+		serverNonce[i] = byte(0x80 + i)
+	}
+
+	keys, err := DeriveSessionKeys(psk, clientNonce, serverNonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+
+	// HKDF-SHA256 with salt = clientNonce || serverNonce and ikm = psk
+	expectedClientToServer := "33cd7c8dbb259fa878a67bd6a6be19c5ee860de1664239679aac313c00c60cd2"
+	expectedServerToClient := "d429d97bebbed3697f3996af97dee03721a736fec963e732cfeb5df97bcad1de"
+
+	if got := hex.EncodeToString(keys.ClientToServer); got != expectedClientToServer {
+		t.Errorf("Expected client→server key %s, got %s", expectedClientToServer, got)
+	}
+	if got := hex.EncodeToString(keys.ServerToClient); got != expectedServerToClient {
+		t.Errorf("Expected server→client key %s, got %s", expectedServerToClient, got)
+	}
+}
+
+func TestDeriveSessionKeys_FreshPerSession(t *testing.T) {
+	psk := make([]byte, 32)
+
+	clientNonce, err := GenerateSessionNonce()
+	if err != nil {
+		t.Fatalf("GenerateSessionNonce failed: %v", err)
+	}
+	serverNonce1, _ := GenerateSessionNonce()
+	serverNonce2, _ := GenerateSessionNonce()
+
+	keys1, err := DeriveSessionKeys(psk, clientNonce, serverNonce1)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	keys2, err := DeriveSessionKeys(psk, clientNonce, serverNonce2)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+
+	if bytes.Equal(keys1.ClientToServer, keys1.ServerToClient) {
+		t.Error("Directional keys should differ")
+	}
+	if bytes.Equal(keys1.ClientToServer, keys2.ClientToServer) {
+		t.Error("Keys should differ between sessions")
+	}
+	if bytes.Equal(keys1.ClientToServer, psk) {
+		t.Error("Session key should not equal the pre-shared key")
+	}
+}
+
+func TestDeriveSessionKeys_InvalidInput(t *testing.T) {
+	nonce := make([]byte, SessionNonceSize)
+
+	_, err := DeriveSessionKeys([]byte("short"), nonce, nonce)
+	if err != ErrInvalidKeyLength {
+		t.Errorf("Expected ErrInvalidKeyLength, got %v", err)
+	}
+
+	_, err = DeriveSessionKeys(make([]byte, 32), nonce[:16], nonce)
+	if err != ErrInvalidSessionNonce {
+		t.Errorf("Expected ErrInvalidSessionNonce, got %v", err)
+	}
+}
+
+// TestDeriveSessionKeys_DirectionsDiffer tests that the two directions of a
+// session, both counting sequences from 1, never seal under the same key and
+// nonce
+func TestDeriveSessionKeys_DirectionsDiffer(t *testing.T) {
+	nonce := make([]byte, SessionNonceSize)
+	keys, err := DeriveSessionKeys(make([]byte, 32), nonce, nonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+
+	client := NewKeyRing(keys, true)
+	server := NewKeyRing(keys, false)
+	cipher := DefaultCipher()
+	payload := []byte("same payload")
+
+	fromClient, err := client.Seal(cipher, payload, 1)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	fromServer, err := server.Seal(cipher, payload, 1)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if bytes.Equal(fromClient, fromServer) {
+		t.Error("Expected the same payload and sequence to seal differently per direction")
+	}
+
+	if _, err := server.Open(cipher, fromClient, 1); err != nil {
+		t.Errorf("Expected the server to open the client's payload, got %v", err)
+	}
+	if _, err := client.Open(cipher, fromClient, 1); err == nil {
+		t.Error("Expected a payload reflected back to the client not to open")
+	}
+}
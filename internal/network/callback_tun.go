@@ -0,0 +1,157 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// callbackReadTimeout bounds how long ReadPacket waits, so a reader polling
+// for a stop signal isn't blocked forever on an idle interface
+const callbackReadTimeout = 100 * time.Millisecond
+
+// callbackQueueSize is how many injected packets may wait to be read
+const callbackQueueSize = 64
+
+// CallbackTun is a TUN interface with no kernel device behind it, for tests
+// and for embedders whose own code handles the data plane. Packets written to
+// it, i.e. decrypted tunnel traffic, are passed to a callback; packets given
+// to Inject are read from it as if they had arrived on the interface.
+type CallbackTun struct {
+	onPacket func([]byte)
+	packets  chan []byte
+	closed   chan struct{}
+	name     string
+	created  bool
+	mu       sync.Mutex
+}
+
+// NewCallbackTun creates a TUN interface that hands each written packet to
+// onPacket. onPacket runs on the writer's goroutine, so it should not block
+// for long; the slice it gets is its own copy.
+func NewCallbackTun(onPacket func([]byte)) *CallbackTun {
+	return &CallbackTun{
+		onPacket: onPacket,
+		packets:  make(chan []byte, callbackQueueSize),
+	}
+}
+
+// Create marks the interface as up. No device is created.
+func (ct *CallbackTun) Create(name string) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.created {
+		return errors.New("interface already created")
+	}
+
+	ct.name = name
+	ct.created = true
+	ct.closed = make(chan struct{})
+	return nil
+}
+
+// ReadPacket returns the next injected packet, waiting briefly for one if
+// none is queued
+func (ct *CallbackTun) ReadPacket() ([]byte, error) {
+	closed, err := ct.closedChan()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case packet := <-ct.packets:
+		return packet, nil
+	case <-closed:
+		return nil, os.ErrClosed
+	case <-time.After(callbackReadTimeout):
+		return nil, ErrNoPacket
+	}
+}
+
+// WritePacket passes a copy of the packet to the callback
+func (ct *CallbackTun) WritePacket(data []byte) error {
+	if !ct.IsCreated() {
+		return errors.New("interface not created")
+	}
+
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	ct.onPacket(packet)
+	return nil
+}
+
+// Inject queues a packet to be read from the interface, waiting for room if
+// the queue is full
+func (ct *CallbackTun) Inject(data []byte) error {
+	closed, err := ct.closedChan()
+	if err != nil {
+		return err
+	}
+
+	packet := make([]byte, len(data))
+	copy(packet, data)
+
+	select {
+	case ct.packets <- packet:
+		return nil
+	case <-closed:
+		return errors.New("interface closed")
+	}
+}
+
+// Close marks the interface as down and discards queued packets
+func (ct *CallbackTun) Close() error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if !ct.created {
+		return nil
+	}
+
+	ct.created = false
+	ct.name = ""
+	close(ct.closed)
+
+	for {
+		select {
+		case <-ct.packets:
+		default:
+			return nil
+		}
+	}
+}
+
+// GetName returns the interface name
+func (ct *CallbackTun) GetName() string {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.name
+}
+
+// IsCreated returns true if the interface is created
+func (ct *CallbackTun) IsCreated() bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.created
+}
+
+// ConfigureClientInterface does nothing, as there is no device to configure
+func (ct *CallbackTun) ConfigureClientInterface(clientIP string) error {
+	if !ct.IsCreated() {
+		return errors.New("interface not created")
+	}
+	return nil
+}
+
+// closedChan returns the channel closed when the interface goes down
+func (ct *CallbackTun) closedChan() (chan struct{}, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if !ct.created {
+		return nil, errors.New("interface not created")
+	}
+	return ct.closed, nil
+}
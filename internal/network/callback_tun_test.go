@@ -0,0 +1,109 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCallbackTun_WritePacket(t *testing.T) {
+	var received [][]byte
+	tun := NewCallbackTun(func(packet []byte) {
+		received = append(received, packet)
+	})
+
+	err := tun.WritePacket([]byte("early"))
+	if err == nil {
+		t.Error("Expected error when writing to an interface that isn't created")
+	}
+
+	err = tun.Create("sink0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if tun.GetName() != "sink0" {
+		t.Errorf("Expected name sink0, got %s", tun.GetName())
+	}
+
+	data := []byte("decrypted packet")
+	err = tun.WritePacket(data)
+	if err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	// The callback gets its own copy
+	data[0] = 'X'
+	if len(received) != 1 || string(received[0]) != "decrypted packet" {
+		t.Errorf("Expected callback to receive the packet, got %q", received)
+	}
+}
+
+func TestCallbackTun_Inject(t *testing.T) {
+	tun := NewCallbackTun(func([]byte) {})
+
+	err := tun.Inject([]byte("early"))
+	if err == nil {
+		t.Error("Expected error when injecting into an interface that isn't created")
+	}
+
+	err = tun.Create("sink0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	for _, packet := range []string{"first", "second"} {
+		err = tun.Inject([]byte(packet))
+		if err != nil {
+			t.Fatalf("Inject failed: %v", err)
+		}
+	}
+
+	for _, expected := range []string{"first", "second"} {
+		packet, err := tun.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if !bytes.Equal(packet, []byte(expected)) {
+			t.Errorf("Expected %s, got %s", expected, packet)
+		}
+	}
+
+	// An idle interface returns rather than blocking the reader forever
+	start := time.Now()
+	_, err = tun.ReadPacket()
+	if err == nil {
+		t.Error("Expected error reading from an empty interface")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected ReadPacket to give up quickly, took %v", elapsed)
+	}
+}
+
+func TestCallbackTun_Close(t *testing.T) {
+	tun := NewCallbackTun(func([]byte) {})
+	err := tun.Create("sink0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	tun.Inject([]byte("discarded"))
+	tun.Close()
+
+	if tun.IsCreated() {
+		t.Error("Expected interface to be down after Close")
+	}
+	_, err = tun.ReadPacket()
+	if err == nil {
+		t.Error("Expected error reading from a closed interface")
+	}
+
+	// The interface can be brought up again without stale packets
+	err = tun.Create("sink0")
+	if err != nil {
+		t.Fatalf("Create after Close failed: %v", err)
+	}
+	_, err = tun.ReadPacket()
+	if err == nil {
+		t.Error("Expected queued packets to be discarded by Close")
+	}
+}
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MaxDSCP is the largest DSCP value, which has 6 bits
+const MaxDSCP = 63
+
+// ValidateDSCP checks that dscp fits in the DSCP field
+func ValidateDSCP(dscp int) error {
+	if dscp < 0 || dscp > MaxDSCP {
+		return fmt.Errorf("invalid dscp %d: must be between 0 and %d", dscp, MaxDSCP)
+	}
+	return nil
+}
+
+// SetDSCP marks the datagrams sent from conn with dscp, e.g. 46 for
+// Expedited Forwarding, so the network can prioritize tunnel traffic. It
+// sets the upper 6 bits of the IPv4 ToS byte and of the IPv6 traffic class,
+// whichever the socket supports; dual-stack sockets take both.
+func SetDSCP(conn net.Conn, dscp int) error {
+	err := ValidateDSCP(dscp)
+	if err != nil {
+		return err
+	}
+
+	tos := dscp << 2
+	v4Err := ipv4.NewConn(conn).SetTOS(tos)
+	v6Err := ipv6.NewConn(conn).SetTrafficClass(tos)
+	if v4Err != nil && v6Err != nil {
+		return fmt.Errorf("failed to set DSCP %d: %w", dscp, v4Err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestValidateDSCP(t *testing.T) {
+	for _, dscp := range []int{0, 46, MaxDSCP} {
+		if err := ValidateDSCP(dscp); err != nil {
+			t.Errorf("Expected DSCP %d to be valid, got %v", dscp, err)
+		}
+	}
+	for _, dscp := range []int{-1, 64, 184} {
+		err := ValidateDSCP(dscp)
+		if err == nil || !strings.Contains(err.Error(), "invalid dscp") {
+			t.Errorf("Expected DSCP %d to be invalid, got %v", dscp, err)
+		}
+	}
+}
+
+func TestSetDSCP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(address, func(t *testing.T) {
+			addr, _ := net.ResolveUDPAddr("udp", address)
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				t.Skipf("Failed to listen on %s: %v", address, err)
+			}
+			defer conn.Close()
+
+			err = SetDSCP(conn, 46)
+			if err != nil {
+				t.Fatalf("SetDSCP failed: %v", err)
+			}
+
+			// EF in the upper 6 bits of the ToS byte or traffic class
+			var tos int
+			if addr.IP.To4() != nil {
+				tos, err = ipv4.NewConn(conn).TOS()
+			} else {
+				tos, err = ipv6.NewConn(conn).TrafficClass()
+			}
+			if err != nil {
+				t.Fatalf("Failed to read the ToS: %v", err)
+			}
+			if tos != 46<<2 {
+				t.Errorf("Expected ToS %d, got %d", 46<<2, tos)
+			}
+
+			if err := SetDSCP(conn, 64); err == nil {
+				t.Error("Expected an error for DSCP 64")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	protocolICMP   = 1
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// DescribeFlow summarizes an IP packet by its protocol and addresses, with
+// ports for TCP and UDP, e.g. "TCP 10.0.0.2:51000 -> 93.184.216.34:443". Only
+// the IP and transport headers are read, so it is safe to log.
+func DescribeFlow(packet []byte) string {
+	if len(packet) == 0 {
+		return "empty packet"
+	}
+
+	var protocol byte
+	var src, dst net.IP
+	var transport []byte
+
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0F) * 4
+		if len(packet) < 20 || headerLen < 20 || headerLen > len(packet) {
+			return fmt.Sprintf("malformed IPv4 packet (%d bytes)", len(packet))
+		}
+		protocol = packet[9]
+		src, dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(packet[6:8])&0x1FFF == 0 {
+			transport = packet[headerLen:]
+		}
+	case 6:
+		if len(packet) < 40 {
+			return fmt.Sprintf("malformed IPv6 packet (%d bytes)", len(packet))
+		}
+		// Extension headers aren't followed, so their payload isn't
+		// recognised as TCP or UDP
+		protocol = packet[6]
+		src, dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+		transport = packet[40:]
+	default:
+		return fmt.Sprintf("non-IP packet (%d bytes)", len(packet))
+	}
+
+	name := protocolName(protocol)
+	if (protocol == protocolTCP || protocol == protocolUDP) && len(transport) >= 4 {
+		srcPort := binary.BigEndian.Uint16(transport[0:2])
+		dstPort := binary.BigEndian.Uint16(transport[2:4])
+		return fmt.Sprintf("%s %s -> %s", name,
+			net.JoinHostPort(src.String(), strconv.Itoa(int(srcPort))),
+			net.JoinHostPort(dst.String(), strconv.Itoa(int(dstPort))))
+	}
+
+	return fmt.Sprintf("%s %s -> %s", name, src, dst)
+}
+
+func protocolName(protocol byte) string {
+	switch protocol {
+	case protocolICMP:
+		return "ICMP"
+	case protocolTCP:
+		return "TCP"
+	case protocolUDP:
+		return "UDP"
+	case protocolICMPv6:
+		return "ICMPv6"
+	default:
+		return fmt.Sprintf("protocol %d", protocol)
+	}
+}
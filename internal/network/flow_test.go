@@ -0,0 +1,47 @@
+package network
+
+import "testing"
+
+func TestDescribeFlow(t *testing.T) {
+	udp := make([]byte, 28)
+	udp[0] = 0x45
+	udp[9] = protocolUDP
+	copy(udp[12:16], []byte{10, 0, 0, 2})
+	copy(udp[16:20], []byte{8, 8, 8, 8})
+	copy(udp[20:24], []byte{0xC3, 0x50, 0x00, 0x35})
+
+	icmp := append([]byte(nil), udp...)
+	icmp[9] = protocolICMP
+
+	fragment := append([]byte(nil), udp...)
+	fragment[7] = 0x10 // Offset 16, so no UDP header
+
+	tcp6 := make([]byte, 44)
+	tcp6[0] = 0x60
+	tcp6[6] = protocolTCP
+	tcp6[23] = 1
+	tcp6[39] = 2
+	copy(tcp6[40:44], []byte{0x01, 0xBB, 0xD4, 0x31})
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		expected string
+	}{
+		{"UDP", udp, "UDP 10.0.0.2:50000 -> 8.8.8.8:53"},
+		{"ICMP", icmp, "ICMP 10.0.0.2 -> 8.8.8.8"},
+		{"later fragment", fragment, "UDP 10.0.0.2 -> 8.8.8.8"},
+		{"IPv6 TCP", tcp6, "TCP [::1]:443 -> [::2]:54321"},
+		{"truncated IPv4", udp[:12], "malformed IPv4 packet (12 bytes)"},
+		{"not IP", []byte{0x00, 0x01}, "non-IP packet (2 bytes)"},
+		{"empty", nil, "empty packet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DescribeFlow(tt.packet); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
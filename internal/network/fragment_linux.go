@@ -0,0 +1,44 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// AllowFragmentation stops Linux setting the don't-fragment bit on
+// datagrams sent from conn. Tunnel datagrams are larger than the packets
+// they carry, and with the bit set a hop with a smaller MTU drops them
+// wherever the ICMP reply that would report it is filtered; without it the
+// hop fragments them instead.
+func AllowFragmentation(conn syscall.Conn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to allow fragmentation: %w", err)
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DONT)
+		if sockErr != nil {
+			return
+		}
+
+		// Dual-stack sockets also send IPv6; IPv4 sockets don't have the
+		// option at all
+		v6Err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DONT)
+		if v6Err != nil && !errors.Is(v6Err, unix.ENOPROTOOPT) && !errors.Is(v6Err, unix.EINVAL) {
+			sockErr = v6Err
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to allow fragmentation: %w", err)
+	}
+
+	return nil
+}
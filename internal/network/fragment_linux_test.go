@@ -0,0 +1,39 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAllowFragmentation(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(address, func(t *testing.T) {
+			addr, _ := net.ResolveUDPAddr("udp", address)
+			conn, err := net.ListenUDP("udp", addr)
+			if err != nil {
+				t.Skipf("Failed to listen on %s: %v", address, err)
+			}
+			defer conn.Close()
+
+			err = AllowFragmentation(conn)
+			if err != nil {
+				t.Fatalf("AllowFragmentation failed: %v", err)
+			}
+
+			rawConn, _ := conn.SyscallConn()
+			var mode int
+			var getErr error
+			rawConn.Control(func(fd uintptr) {
+				mode, getErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+			})
+			if getErr != nil {
+				t.Fatalf("Failed to read IP_MTU_DISCOVER: %v", getErr)
+			}
+			if mode != unix.IP_PMTUDISC_DONT {
+				t.Errorf("Expected IP_PMTUDISC_DONT, got %d", mode)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package network
+
+import (
+	"syscall"
+)
+
+// AllowFragmentation does nothing outside Linux, where UDP sockets don't set
+// the don't-fragment bit unless asked to
+func AllowFragmentation(conn syscall.Conn) error {
+	return nil
+}
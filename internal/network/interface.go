@@ -1,7 +1,16 @@
 package network
 
+import "errors"
+
+// ErrNoPacket is returned by ReadPacket of interfaces that poll rather than
+// block, such as MockTunManager and CallbackTun, when no packet arrived in
+// time. It is not a failure; callers read again.
+var ErrNoPacket = errors.New("no packets available")
+
 type TUNInterface interface {
 	Create(name string) error
+	// ReadPacket returns the next IP packet, which may be empty if the read
+	// returned nothing; callers skip empty packets
 	ReadPacket() ([]byte, error)
 	WritePacket(data []byte) error
 	Close() error
@@ -10,6 +19,28 @@ type TUNInterface interface {
 	ConfigureClientInterface(clientIP string) error
 }
 
-// Ensure both implementations satisfy the interface
+// ReadinessChecker is implemented by TUN interfaces that can take a moment
+// after ConfigureClientInterface before the kernel routes packets through
+// them. Callers poll InterfaceReady until it reports true, so the first
+// packets sent aren't dropped.
+type ReadinessChecker interface {
+	// InterfaceReady reports whether the interface is up with clientIP
+	// assigned
+	InterfaceReady(clientIP string) (bool, error)
+}
+
+// MTUSetter is implemented by TUN interfaces whose MTU can be raised or
+// lowered from the default. SetMTU must be called before Create.
+type MTUSetter interface {
+	SetMTU(mtu int)
+}
+
+// Ensure all implementations satisfy the interface
 var _ TUNInterface = (*TunManager)(nil)
 var _ TUNInterface = (*MockTunManager)(nil)
+var _ TUNInterface = (*CallbackTun)(nil)
+
+// Ensure the interfaces that can report readiness do; the kernel TUN
+// interface only does on Linux, see tun_linux.go
+var _ ReadinessChecker = (*MockTunManager)(nil)
+var _ MTUSetter = (*TunManager)(nil)
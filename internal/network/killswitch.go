@@ -0,0 +1,150 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+var ErrKillSwitchRequiresRoot = errors.New("kill switch requires root privileges")
+
+// killSwitchChainPrefix starts the name of the iptables chain holding a kill
+// switch's rules, which ends with the tunnel interface name so clients on
+// different interfaces keep separate chains
+const killSwitchChainPrefix = "FVP-KILL-"
+
+// KillSwitch blocks outbound traffic that would leave outside the tunnel, so
+// nothing leaks over the default route while the tunnel is down. Only
+// loopback, the tunnel interface and UDP to the VPN servers are let through;
+// everything else is rejected, IPv6 included. The rules live in a chain of
+// their own, jumped to from OUTPUT, in both iptables and ip6tables.
+type KillSwitch struct {
+	tunInterface string
+	servers      []net.IP
+
+	enabled bool
+
+	// Overridable for tests
+	run     func(name string, args ...string) error
+	geteuid func() int
+}
+
+// NewKillSwitch creates a kill switch for the given tunnel interface that
+// lets traffic to the servers' addresses through
+func NewKillSwitch(tunInterface string, servers []net.IP) *KillSwitch {
+	return &KillSwitch{
+		tunInterface: tunInterface,
+		servers:      servers,
+		run:          runCommand,
+		geteuid:      os.Geteuid,
+	}
+}
+
+// Enable installs the rules. A chain left behind by an earlier run that died
+// without calling Disable is flushed and reused.
+func (ks *KillSwitch) Enable() error {
+	if ks.geteuid() != 0 {
+		return ErrKillSwitchRequiresRoot
+	}
+
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		err := ks.install(tool)
+		if err != nil {
+			ks.uninstall()
+			return fmt.Errorf("failed to enable kill switch: %w", err)
+		}
+	}
+
+	ks.enabled = true
+	log.Printf("Enabled kill switch: only %s and %v are reachable", ks.tunInterface, ks.servers)
+	return nil
+}
+
+// Disable removes the rules. It does nothing if Enable didn't succeed.
+func (ks *KillSwitch) Disable() error {
+	if !ks.enabled {
+		return nil
+	}
+	ks.enabled = false
+
+	err := ks.uninstall()
+	log.Printf("Disabled kill switch")
+	return err
+}
+
+// IsEnabled reports whether the rules are installed
+func (ks *KillSwitch) IsEnabled() bool {
+	return ks.enabled
+}
+
+// install sets up the chain for one of iptables and ip6tables and jumps to
+// it from OUTPUT
+func (ks *KillSwitch) install(tool string) error {
+	if ks.run(tool, "-N", ks.chain()) != nil {
+		err := ks.run(tool, "-F", ks.chain())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range ks.Rules(tool == "ip6tables") {
+		err := ks.run(tool, append([]string{"-A", ks.chain()}, rule...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ks.run(tool, ks.jumpArgs("-C")...) != nil {
+		return ks.run(tool, ks.jumpArgs("-I")...)
+	}
+	return nil
+}
+
+// uninstall removes the jump from OUTPUT and the chain from both tools,
+// carrying on past failures so as much as possible is removed
+func (ks *KillSwitch) uninstall() error {
+	var errs []error
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		for _, args := range [][]string{ks.jumpArgs("-D"), {"-F", ks.chain()}, {"-X", ks.chain()}} {
+			err := ks.run(tool, args...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Rules returns the rules of the kill switch chain, in order, for ip6tables
+// if ipv6 is set and iptables otherwise. Each is the arguments that follow
+// "-A <chain>".
+func (ks *KillSwitch) Rules(ipv6 bool) [][]string {
+	rules := [][]string{
+		{"-o", "lo", "-j", "RETURN"},
+		{"-o", ks.tunInterface, "-j", "RETURN"},
+	}
+
+	for _, server := range ks.servers {
+		if (server.To4() == nil) != ipv6 {
+			continue
+		}
+		prefix := "/32"
+		if ipv6 {
+			prefix = "/128"
+		}
+		rules = append(rules, []string{"-d", server.String() + prefix, "-p", "udp", "-j", "RETURN"})
+	}
+
+	return append(rules, []string{"-j", "REJECT"})
+}
+
+// chain is the name of the chain holding the rules
+func (ks *KillSwitch) chain() string {
+	return killSwitchChainPrefix + ks.tunInterface
+}
+
+func (ks *KillSwitch) jumpArgs(action string) []string {
+	return []string{action, "OUTPUT", "-j", ks.chain()}
+}
@@ -0,0 +1,205 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeFirewall records iptables and ip6tables invocations and tracks chains
+// and the rules in them
+type fakeFirewall struct {
+	chains   map[string][]string // By tool and chain name
+	commands []string
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{chains: map[string][]string{
+		"iptables OUTPUT":  nil,
+		"ip6tables OUTPUT": nil,
+	}}
+}
+
+func (f *fakeFirewall) run(name string, args ...string) error {
+	f.commands = append(f.commands, name+" "+strings.Join(args, " "))
+
+	chain := name + " " + args[1]
+	rules, exists := f.chains[chain]
+	rule := strings.Join(args[2:], " ")
+	switch args[0] {
+	case "-N":
+		if exists {
+			return errors.New("chain already exists")
+		}
+		f.chains[chain] = nil
+		return nil
+	}
+
+	if !exists {
+		return errors.New("no chain by that name")
+	}
+	switch args[0] {
+	case "-F":
+		f.chains[chain] = nil
+	case "-X":
+		delete(f.chains, chain)
+	case "-A", "-I":
+		f.chains[chain] = append(rules, rule)
+	case "-C", "-D":
+		for i, existing := range rules {
+			if existing == rule {
+				if args[0] == "-D" {
+					f.chains[chain] = append(rules[:i], rules[i+1:]...)
+				}
+				return nil
+			}
+		}
+		return errors.New("rule not found")
+	}
+	return nil
+}
+
+func newTestKillSwitch(servers ...string) (*KillSwitch, *fakeFirewall) {
+	var ips []net.IP
+	for _, server := range servers {
+		ips = append(ips, net.ParseIP(server))
+	}
+
+	fake := newFakeFirewall()
+	ks := NewKillSwitch("fvp-client0", ips)
+	ks.run = fake.run
+	ks.geteuid = func() int { return 0 }
+	return ks, fake
+}
+
+func TestKillSwitch_Rules(t *testing.T) {
+	ks, _ := newTestKillSwitch("203.0.113.5", "2001:db8::5", "198.51.100.7")
+
+	expected := []string{
+		"-o lo -j RETURN",
+		"-o fvp-client0 -j RETURN",
+		"-d 203.0.113.5/32 -p udp -j RETURN",
+		"-d 198.51.100.7/32 -p udp -j RETURN",
+		"-j REJECT",
+	}
+	var rules []string
+	for _, rule := range ks.Rules(false) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected IPv4 rules\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+
+	expected = []string{
+		"-o lo -j RETURN",
+		"-o fvp-client0 -j RETURN",
+		"-d 2001:db8::5/128 -p udp -j RETURN",
+		"-j REJECT",
+	}
+	rules = nil
+	for _, rule := range ks.Rules(true) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected IPv6 rules\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+}
+
+func TestKillSwitch_EnableDisable(t *testing.T) {
+	ks, fake := newTestKillSwitch("203.0.113.5")
+
+	err := ks.Enable()
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	if !ks.IsEnabled() {
+		t.Error("Expected the kill switch to be enabled")
+	}
+
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		output := fake.chains[tool+" OUTPUT"]
+		if len(output) != 1 || output[0] != "-j FVP-KILL-fvp-client0" {
+			t.Errorf("Expected OUTPUT to jump to the kill switch chain in %s, got %v", tool, output)
+		}
+		chain := fake.chains[tool+" FVP-KILL-fvp-client0"]
+		if len(chain) == 0 || chain[len(chain)-1] != "-j REJECT" {
+			t.Errorf("Expected the %s chain to end by rejecting, got %v", tool, chain)
+		}
+	}
+
+	err = ks.Disable()
+	if err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if len(fake.chains[tool+" OUTPUT"]) != 0 {
+			t.Errorf("Expected the jump to be removed from %s, got %v", tool, fake.chains[tool+" OUTPUT"])
+		}
+		if _, exists := fake.chains[tool+" FVP-KILL-fvp-client0"]; exists {
+			t.Errorf("Expected the %s chain to be deleted", tool)
+		}
+	}
+
+	// Disabling again is a no-op
+	fake.commands = nil
+	err = ks.Disable()
+	if err != nil || len(fake.commands) != 0 {
+		t.Errorf("Expected a second Disable to do nothing, got %v and %v", err, fake.commands)
+	}
+}
+
+// TestKillSwitch_ReusesLeftoverChain tests that rules left behind by a run
+// that died are replaced rather than added to
+func TestKillSwitch_ReusesLeftoverChain(t *testing.T) {
+	ks, fake := newTestKillSwitch("203.0.113.5")
+	fake.chains["iptables FVP-KILL-fvp-client0"] = []string{"-d 192.0.2.1/32 -p udp -j RETURN", "-j REJECT"}
+	fake.chains["iptables OUTPUT"] = []string{"-j FVP-KILL-fvp-client0"}
+
+	err := ks.Enable()
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	chain := fake.chains["iptables FVP-KILL-fvp-client0"]
+	if len(chain) != len(ks.Rules(false)) || strings.Contains(strings.Join(chain, " "), "192.0.2.1") {
+		t.Errorf("Expected the leftover rules to be replaced, got %v", chain)
+	}
+	if output := fake.chains["iptables OUTPUT"]; len(output) != 1 {
+		t.Errorf("Expected a single jump from OUTPUT, got %v", output)
+	}
+}
+
+func TestKillSwitch_RequiresRoot(t *testing.T) {
+	ks, fake := newTestKillSwitch("203.0.113.5")
+	ks.geteuid = func() int { return 1000 }
+
+	err := ks.Enable()
+	if !errors.Is(err, ErrKillSwitchRequiresRoot) {
+		t.Errorf("Expected ErrKillSwitchRequiresRoot, got %v", err)
+	}
+	if len(fake.commands) != 0 {
+		t.Errorf("Expected no firewall commands, got %v", fake.commands)
+	}
+}
+
+// TestKillSwitch_EnableFailure tests that a failed Enable removes whatever it
+// had installed
+func TestKillSwitch_EnableFailure(t *testing.T) {
+	ks, fake := newTestKillSwitch("203.0.113.5")
+	delete(fake.chains, "ip6tables OUTPUT")
+
+	err := ks.Enable()
+	if err == nil {
+		t.Fatal("Expected Enable to fail")
+	}
+	if ks.IsEnabled() {
+		t.Error("Expected the kill switch to stay disabled")
+	}
+	if _, exists := fake.chains["iptables FVP-KILL-fvp-client0"]; exists {
+		t.Error("Expected the iptables chain to be removed after the failure")
+	}
+	if len(fake.chains["iptables OUTPUT"]) != 0 {
+		t.Errorf("Expected no jump left in iptables OUTPUT, got %v", fake.chains["iptables OUTPUT"])
+	}
+}
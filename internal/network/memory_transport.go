@@ -0,0 +1,203 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// memoryQueueSize is how many datagrams a MemoryConn holds unread before
+// further ones are dropped, as a full socket buffer would
+const memoryQueueSize = 256
+
+// MemoryNetwork carries datagrams between MemoryConns in the same process,
+// so a server and its clients can be tested together without sockets or
+// privileges. Endpoints get addresses from 192.0.2.0/24, which is reserved
+// for documentation, so they can't be mistaken for real ones.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	endpoints map[string]*MemoryConn
+	nextPort  int
+}
+
+// NewMemoryNetwork creates an empty in-memory network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		endpoints: make(map[string]*MemoryConn),
+		nextPort:  1,
+	}
+}
+
+// Listen creates an endpoint that can send to and receive from any other
+// endpoint on the network, e.g. for a server
+func (n *MemoryNetwork) Listen() *MemoryConn {
+	return n.attach(nil)
+}
+
+// Dial creates an endpoint whose Write sends to remote, e.g. for a client.
+// Its signature matches what Client.SetDialer expects; ctx is unused, since
+// dialing never blocks.
+func (n *MemoryNetwork) Dial(ctx context.Context, remote string) (net.Conn, error) {
+	n.mu.Lock()
+	peer, ok := n.endpoints[remote]
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("failed to dial %s: no such endpoint", remote)
+	}
+
+	return n.attach(peer.local), nil
+}
+
+// attach adds an endpoint with the next free address
+func (n *MemoryNetwork) attach(remote *net.UDPAddr) *MemoryConn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	conn := &MemoryConn{
+		network:  n,
+		local:    &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: n.nextPort},
+		remote:   remote,
+		incoming: make(chan Datagram, memoryQueueSize),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}),
+	}
+	n.nextPort++
+	n.endpoints[conn.local.String()] = conn
+	return conn
+}
+
+// deliver queues data on the endpoint at addr. Like UDP, it drops datagrams
+// for unknown addresses and full queues without telling the sender.
+func (n *MemoryNetwork) deliver(data []byte, from, to net.Addr) {
+	n.mu.Lock()
+	peer, ok := n.endpoints[to.String()]
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case peer.incoming <- Datagram{Data: append([]byte(nil), data...), Addr: from}:
+	default:
+	}
+}
+
+// MemoryConn is an endpoint on a MemoryNetwork. It is both a Transport, for
+// a server, and a net.Conn, for a client.
+type MemoryConn struct {
+	network  *MemoryNetwork
+	local    *net.UDPAddr
+	remote   *net.UDPAddr // Destination of Write; nil for listening endpoints
+	incoming chan Datagram
+	closed   chan struct{}
+	close    sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	deadline     chan struct{} // Closed and replaced whenever readDeadline changes
+}
+
+// ReadFrom waits for the next datagram, until the read deadline passes or
+// the endpoint is closed
+func (c *MemoryConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		readDeadline, changed := c.readDeadline, c.deadline
+		c.mu.Unlock()
+
+		// Timers that are never stopped are collected once unreachable
+		var expired <-chan time.Time
+		if !readDeadline.IsZero() {
+			expired = time.After(time.Until(readDeadline))
+		}
+
+		select {
+		case datagram := <-c.incoming:
+			return copy(buffer, datagram.Data), datagram.Addr, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+		}
+	}
+}
+
+// WriteTo sends a datagram to the endpoint at addr
+func (c *MemoryConn) WriteTo(data []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.network.deliver(data, c.local, addr)
+	return len(data), nil
+}
+
+// Read waits for the next datagram from any endpoint
+func (c *MemoryConn) Read(buffer []byte) (int, error) {
+	n, _, err := c.ReadFrom(buffer)
+	return n, err
+}
+
+// Write sends a datagram to the endpoint the connection was dialed to
+func (c *MemoryConn) Write(data []byte) (int, error) {
+	if c.remote == nil {
+		return 0, fmt.Errorf("write on listening endpoint %s: no destination", c.local)
+	}
+	return c.WriteTo(data, c.remote)
+}
+
+// Close detaches the endpoint from the network and wakes blocked reads
+func (c *MemoryConn) Close() error {
+	c.close.Do(func() {
+		c.network.mu.Lock()
+		delete(c.network.endpoints, c.local.String())
+		c.network.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+// LocalAddr returns the endpoint's address
+func (c *MemoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address Write sends to, nil for listening endpoints
+func (c *MemoryConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return c.remote
+}
+
+// SetReadDeadline makes reads fail with os.ErrDeadlineExceeded once t
+// passes; the zero time waits forever
+func (c *MemoryConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	close(c.deadline)
+	c.deadline = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block
+func (c *MemoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// SetDeadline sets the read deadline
+func (c *MemoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// Ensure MemoryConn serves both sides
+var _ Transport = (*MemoryConn)(nil)
+var _ net.Conn = (*MemoryConn)(nil)
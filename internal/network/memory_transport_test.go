@@ -0,0 +1,97 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryNetwork_RoundTrip(t *testing.T) {
+	memory := NewMemoryNetwork()
+	listener := memory.Listen()
+	defer listener.Close()
+
+	conn, err := memory.Dial(context.Background(), listener.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 64)
+	n, addr, err := listener.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buffer[:n]) != "hello" {
+		t.Errorf("Expected 'hello', got '%s'", buffer[:n])
+	}
+	if addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected source %s, got %s", conn.LocalAddr(), addr)
+	}
+
+	_, err = listener.WriteTo([]byte("world"), addr)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "world" {
+		t.Errorf("Expected 'world', got '%s' (%v)", buffer[:n], err)
+	}
+}
+
+func TestMemoryNetwork_Dial_Unknown(t *testing.T) {
+	_, err := NewMemoryNetwork().Dial(context.Background(), "192.0.2.1:99")
+	if err == nil {
+		t.Error("Expected error dialing an address nobody listens on")
+	}
+}
+
+func TestMemoryConn_DeadlineAndClose(t *testing.T) {
+	memory := NewMemoryNetwork()
+	listener := memory.Listen()
+
+	// Datagrams to unknown endpoints vanish, as with UDP
+	_, err := listener.WriteTo([]byte("lost"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 99})
+	if err != nil {
+		t.Errorf("Expected WriteTo an unknown address to succeed, got %v", err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = listener.ReadFrom(make([]byte, 64))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected os.ErrDeadlineExceeded, got %v", err)
+	}
+
+	listener.SetReadDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := listener.ReadFrom(make([]byte, 64))
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	listener.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close to unblock ReadFrom")
+	}
+
+	_, err = listener.WriteTo([]byte("late"), listener.LocalAddr())
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed writing after Close, got %v", err)
+	}
+}
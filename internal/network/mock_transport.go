@@ -0,0 +1,103 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Datagram is a packet together with its peer address
+type Datagram struct {
+	Data []byte
+	Addr net.Addr
+}
+
+// MockTransport is a mock implementation for testing
+type MockTransport struct {
+	closed    bool
+	readQueue []Datagram
+	sent      []Datagram
+	mu        sync.Mutex
+}
+
+// NewMockTransport creates a new mock transport
+func NewMockTransport() *MockTransport {
+	return &MockTransport{
+		readQueue: make([]Datagram, 0),
+		sent:      make([]Datagram, 0),
+	}
+}
+
+// ReadFrom reads a queued datagram from the mock transport
+func (mt *MockTransport) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.closed {
+		return 0, nil, net.ErrClosed
+	}
+
+	if len(mt.readQueue) == 0 {
+		return 0, nil, errors.New("no datagrams available")
+	}
+
+	datagram := mt.readQueue[0]
+	mt.readQueue = mt.readQueue[1:]
+	return copy(buffer, datagram.Data), datagram.Addr, nil
+}
+
+// WriteTo records a datagram sent through the mock transport
+func (mt *MockTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if mt.closed {
+		return 0, net.ErrClosed
+	}
+
+	// Copy the data to avoid issues with slice references
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	mt.sent = append(mt.sent, Datagram{Data: packet, Addr: addr})
+	return len(data), nil
+}
+
+// Close closes the mock transport
+func (mt *MockTransport) Close() error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	mt.closed = true
+	mt.readQueue = nil
+	return nil
+}
+
+// QueueDatagram queues a datagram for reading (testing helper)
+func (mt *MockTransport) QueueDatagram(data []byte, addr net.Addr) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	mt.readQueue = append(mt.readQueue, Datagram{Data: packet, Addr: addr})
+}
+
+// GetSent returns the datagrams sent so far (testing helper)
+func (mt *MockTransport) GetSent() []Datagram {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	// Return a copy to avoid race conditions
+	result := make([]Datagram, len(mt.sent))
+	for i, datagram := range mt.sent {
+		result[i] = Datagram{Data: append([]byte(nil), datagram.Data...), Addr: datagram.Addr}
+	}
+	return result
+}
+
+// ClearSent clears the sent datagrams (testing helper)
+func (mt *MockTransport) ClearSent() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.sent = nil
+}
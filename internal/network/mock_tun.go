@@ -46,7 +46,7 @@ func (mtm *MockTunManager) ReadPacket() ([]byte, error) {
 	}
 
 	if len(mtm.readQueue) == 0 {
-		return nil, errors.New("no packets available")
+		return nil, ErrNoPacket
 	}
 
 	packet := mtm.readQueue[0]
@@ -110,6 +110,11 @@ func (mtm *MockTunManager) ConfigureClientInterface(clientIP string) error {
 	return nil
 }
 
+// InterfaceReady reports the mock interface ready as soon as it is created
+func (mtm *MockTunManager) InterfaceReady(clientIP string) (bool, error) {
+	return mtm.IsCreated(), nil
+}
+
 // QueueReadPacket queues a packet for reading (testing helper)
 func (mtm *MockTunManager) QueueReadPacket(data []byte) {
 	mtm.mu.Lock()
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// TCPIPHeaderSize is the size of IPv4 and TCP headers without options, which
+// an MSS leaves out of the MTU
+const TCPIPHeaderSize = 40
+
+const (
+	protocolTCP   = 6
+	tcpFlagSYN    = 0x02
+	tcpOptionEnd  = 0
+	tcpOptionNOP  = 1
+	tcpOptionMSS  = 2
+	tcpMSSOptSize = 4
+)
+
+// MSSForMTU returns the largest TCP MSS whose segments fit in mtu
+func MSSForMTU(mtu int) uint16 {
+	if mtu <= TCPIPHeaderSize {
+		return 0
+	}
+	if mtu-TCPIPHeaderSize > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(mtu - TCPIPHeaderSize)
+}
+
+// ClampMSS lowers the MSS option of an IPv4 TCP SYN packet to maxMSS if it
+// advertises more, fixing up the TCP checksum, and reports whether the packet
+// was changed. Both ends of a connection take the smaller of the two MSS
+// values, so clamping SYNs in either direction keeps segments within the
+// tunnel MTU even when path MTU discovery is broken. Anything else, including
+// fragments and malformed packets, is left alone.
+func ClampMSS(packet []byte, maxMSS uint16) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != protocolTCP {
+		return false
+	}
+
+	ipHeaderLen := int(packet[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	fragmentOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1FFF
+	if ipHeaderLen < 20 || totalLen > len(packet) || fragmentOffset != 0 {
+		return false
+	}
+
+	tcp := packet[ipHeaderLen:totalLen]
+	if len(tcp) < 20 || tcp[13]&tcpFlagSYN == 0 {
+		return false
+	}
+
+	tcpHeaderLen := int(tcp[12]>>4) * 4
+	if tcpHeaderLen < 20 || tcpHeaderLen > len(tcp) {
+		return false
+	}
+
+	for offset := 20; offset < tcpHeaderLen; {
+		options := tcp[offset:tcpHeaderLen]
+		switch options[0] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNOP:
+			offset++
+			continue
+		}
+
+		if len(options) < 2 || options[1] < 2 || int(options[1]) > len(options) {
+			return false
+		}
+		if options[0] == tcpOptionMSS && options[1] == tcpMSSOptSize {
+			mss := binary.BigEndian.Uint16(options[2:4])
+			if mss <= maxMSS {
+				return false
+			}
+
+			binary.BigEndian.PutUint16(options[2:4], maxMSS)
+
+			// A value at an odd offset straddles two checksum words, where
+			// its bytes count the other way round
+			oldWord, newWord := mss, maxMSS
+			if offset%2 != 0 {
+				oldWord, newWord = bits.ReverseBytes16(mss), bits.ReverseBytes16(maxMSS)
+			}
+			checksum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], updateChecksum(checksum, oldWord, newWord))
+			return true
+		}
+		offset += int(options[1])
+	}
+
+	return false
+}
+
+// updateChecksum adjusts an internet checksum for a 16-bit word changing from
+// old to new, as in RFC 1624
+func updateChecksum(checksum, old, new uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^old) + uint32(new)
+	sum = (sum & 0xFFFF) + (sum >> 16)
+	sum = (sum & 0xFFFF) + (sum >> 16)
+	return ^uint16(sum)
+}
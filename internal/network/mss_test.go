@@ -0,0 +1,149 @@
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// buildTCPPacket returns an IPv4 TCP packet with the given flags and options
+// and a valid TCP checksum
+func buildTCPPacket(flags byte, options []byte) []byte {
+	tcpLen := 20 + len(options)
+	packet := make([]byte, 20+tcpLen)
+
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = protocolTCP
+	copy(packet[12:16], []byte{10, 0, 0, 2})
+	copy(packet[16:20], []byte{93, 184, 216, 34})
+
+	tcp := packet[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	tcp[12] = byte(tcpLen/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[20:], options)
+
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(packet))
+	return packet
+}
+
+// tcpChecksum computes the TCP checksum of an IPv4 packet from scratch, with
+// the checksum field treated as zero
+func tcpChecksum(packet []byte) uint16 {
+	tcp := packet[20:]
+	var sum uint32
+	add := func(data []byte) {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		}
+		if len(data)%2 != 0 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+
+	add(packet[12:20])
+	sum += protocolTCP + uint32(len(tcp))
+	add(tcp[:16])
+	add(tcp[18:])
+
+	for sum > 0xFFFF {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func mssOption(mss uint16) []byte {
+	return []byte{tcpOptionMSS, tcpMSSOptSize, byte(mss >> 8), byte(mss)}
+}
+
+func TestClampMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   byte
+		options []byte
+		mss     int // Expected MSS after clamping to 1360, -1 if unchanged
+	}{
+		{name: "SYN", flags: tcpFlagSYN, options: mssOption(1460), mss: 1360},
+		{name: "SYN-ACK", flags: tcpFlagSYN | 0x10, options: mssOption(1460), mss: 1360},
+		{name: "odd offset", flags: tcpFlagSYN, options: append(append([]byte{tcpOptionNOP}, mssOption(8961)...), tcpOptionNOP, tcpOptionNOP, tcpOptionNOP), mss: 1360},
+		{name: "after other options", flags: tcpFlagSYN, options: append([]byte{4, 2, 3, 3, 7, tcpOptionNOP, tcpOptionNOP, tcpOptionNOP}, mssOption(1460)...), mss: 1360},
+		{name: "already small", flags: tcpFlagSYN, options: mssOption(1200), mss: -1},
+		{name: "not a SYN", flags: 0x10, options: mssOption(1460), mss: -1},
+		{name: "no MSS option", flags: tcpFlagSYN, options: []byte{tcpOptionNOP, tcpOptionNOP, 4, 2}, mss: -1},
+		{name: "end of options", flags: tcpFlagSYN, options: append([]byte{tcpOptionEnd, 0, 0, 0}, mssOption(1460)...), mss: -1},
+		{name: "bad option length", flags: tcpFlagSYN, options: []byte{8, 0, 0, 0}, mss: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := buildTCPPacket(tt.flags, tt.options)
+			original := append([]byte(nil), packet...)
+
+			changed := ClampMSS(packet, 1360)
+			if changed != (tt.mss >= 0) {
+				t.Fatalf("Expected changed %t, got %t", tt.mss >= 0, changed)
+			}
+			if !changed {
+				if string(packet) != string(original) {
+					t.Error("Expected packet to be left alone")
+				}
+				return
+			}
+
+			offset := 20 + 20
+			for packet[offset] != tcpOptionMSS {
+				if packet[offset] == tcpOptionNOP {
+					offset++
+				} else {
+					offset += int(packet[offset+1])
+				}
+			}
+			if mss := binary.BigEndian.Uint16(packet[offset+2:]); int(mss) != tt.mss {
+				t.Errorf("Expected MSS %d, got %d", tt.mss, mss)
+			}
+
+			want := tcpChecksum(packet)
+			if got := binary.BigEndian.Uint16(packet[36:38]); got != want {
+				t.Errorf("Expected checksum 0x%04x, got 0x%04x", want, got)
+			}
+		})
+	}
+}
+
+func TestClampMSS_IgnoresOtherPackets(t *testing.T) {
+	udp := buildTCPPacket(tcpFlagSYN, mssOption(1460))
+	udp[9] = 17
+
+	fragment := buildTCPPacket(tcpFlagSYN, mssOption(1460))
+	binary.BigEndian.PutUint16(fragment[6:8], 185)
+
+	ipv6 := buildTCPPacket(tcpFlagSYN, mssOption(1460))
+	ipv6[0] = 0x60
+
+	truncated := buildTCPPacket(tcpFlagSYN, mssOption(1460))[:42]
+
+	packets := map[string][]byte{
+		"UDP":       udp,
+		"fragment":  fragment,
+		"IPv6":      ipv6,
+		"truncated": truncated,
+		"empty":     {},
+	}
+	for name, packet := range packets {
+		if ClampMSS(packet, 1360) {
+			t.Errorf("%s: expected packet to be left alone", name)
+		}
+	}
+}
+
+func TestMSSForMTU(t *testing.T) {
+	if mss := MSSForMTU(1400); mss != 1360 {
+		t.Errorf("Expected MSS 1360 for MTU 1400, got %d", mss)
+	}
+	if mss := MSSForMTU(30); mss != 0 {
+		t.Errorf("Expected MSS 0 for MTU 30, got %d", mss)
+	}
+}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+var ErrNATRequiresRoot = errors.New("NAT setup requires root privileges")
+
+// NATManager masquerades tunnel traffic out of a WAN interface so clients
+// can reach the internet through the server
+type NATManager struct {
+	subnet       string
+	wanInterface string
+
+	enabled         bool
+	previousForward string
+	state           *StateFile // Records how to undo the changes; nil records nothing
+
+	// Overridable for tests
+	run         func(name string, args ...string) error
+	forwardPath string
+	geteuid     func() int
+}
+
+// NewNATManager creates a NAT manager for the given tunnel subnet (CIDR) and
+// WAN interface
+func NewNATManager(subnet, wanInterface string) *NATManager {
+	return &NATManager{
+		subnet:       subnet,
+		wanInterface: wanInterface,
+		run:          runCommand,
+		forwardPath:  ipForwardPath,
+		geteuid:      os.Geteuid,
+	}
+}
+
+// SetStateFile records the rule and ip_forward change in state, so they are
+// undone by the next run's Reconcile if this one dies without calling
+// Disable. Call it before Enable.
+func (nm *NATManager) SetStateFile(state *StateFile) {
+	nm.state = state
+}
+
+// Enable installs the masquerade rule and turns on IP forwarding. A rule left
+// behind by an earlier run is reused rather than added a second time.
+func (nm *NATManager) Enable() error {
+	if nm.geteuid() != 0 {
+		return ErrNATRequiresRoot
+	}
+
+	if nm.run("iptables", nm.ruleArgs("-C")...) != nil {
+		err := nm.run("iptables", nm.ruleArgs("-A")...)
+		if err != nil {
+			return fmt.Errorf("failed to add masquerade rule: %w", err)
+		}
+	} else {
+		log.Printf("Masquerade rule for %s via %s already present", nm.subnet, nm.wanInterface)
+	}
+
+	previous, err := os.ReadFile(nm.forwardPath)
+	if err != nil {
+		nm.run("iptables", nm.ruleArgs("-D")...)
+		return fmt.Errorf("failed to read ip_forward: %w", err)
+	}
+
+	err = os.WriteFile(nm.forwardPath, []byte("1\n"), 0644)
+	if err != nil {
+		nm.run("iptables", nm.ruleArgs("-D")...)
+		return fmt.Errorf("failed to enable ip_forward: %w", err)
+	}
+
+	nm.previousForward = strings.TrimSpace(string(previous))
+	nm.enabled = true
+
+	err = nm.state.Record(nm.undoRule()...)
+	if err == nil && nm.previousForward != "1" {
+		err = nm.state.Record(nm.undoForward()...)
+	}
+	if err != nil {
+		log.Printf("Failed to record NAT changes, they won't be cleaned up after a crash: %v", err)
+	}
+
+	log.Printf("Enabled NAT for %s via %s", nm.subnet, nm.wanInterface)
+	return nil
+}
+
+// Disable removes the masquerade rule and restores the previous ip_forward
+// setting. It does nothing if Enable didn't succeed.
+func (nm *NATManager) Disable() error {
+	if !nm.enabled {
+		return nil
+	}
+	nm.enabled = false
+
+	var errs []error
+	err := nm.run("iptables", nm.ruleArgs("-D")...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove masquerade rule: %w", err))
+	}
+
+	if nm.previousForward != "1" {
+		err = os.WriteFile(nm.forwardPath, []byte(nm.previousForward+"\n"), 0644)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore ip_forward: %w", err))
+		}
+	}
+
+	err = nm.state.Forget(nm.undoRule()...)
+	if err == nil {
+		err = nm.state.Forget(nm.undoForward()...)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	log.Printf("Disabled NAT for %s via %s", nm.subnet, nm.wanInterface)
+	return errors.Join(errs...)
+}
+
+// IsEnabled reports whether the masquerade rule is installed
+func (nm *NATManager) IsEnabled() bool {
+	return nm.enabled
+}
+
+// undoRule is the command that removes the masquerade rule
+func (nm *NATManager) undoRule() []string {
+	return append([]string{"iptables"}, nm.ruleArgs("-D")...)
+}
+
+// undoForward is the command that restores the previous ip_forward setting
+func (nm *NATManager) undoForward() []string {
+	return []string{"sysctl", "-w", "net.ipv4.ip_forward=" + nm.previousForward}
+}
+
+func (nm *NATManager) ruleArgs(action string) []string {
+	return []string{"-t", "nat", action, "POSTROUTING", "-s", nm.subnet, "-o", nm.wanInterface, "-j", "MASQUERADE"}
+}
+
+func runCommand(name string, args ...string) error {
+	_, err := commandOutput(name, args...)
+	return err
+}
+
+// commandOutput runs a command and returns what it printed
+func commandOutput(name string, args ...string) ([]byte, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
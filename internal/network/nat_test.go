@@ -0,0 +1,202 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeIptables records iptables invocations and tracks installed rules
+type fakeIptables struct {
+	rules    map[string]bool
+	commands []string
+}
+
+func (f *fakeIptables) run(name string, args ...string) error {
+	f.commands = append(f.commands, name+" "+strings.Join(args, " "))
+
+	// args: -t nat <action> POSTROUTING ...
+	action := args[2]
+	rule := strings.Join(args[3:], " ")
+	switch action {
+	case "-C":
+		if !f.rules[rule] {
+			return errors.New("rule not found")
+		}
+	case "-A":
+		f.rules[rule] = true
+	case "-D":
+		if !f.rules[rule] {
+			return errors.New("rule not found")
+		}
+		delete(f.rules, rule)
+	}
+	return nil
+}
+
+func newTestNATManager(t *testing.T, forward string) (*NATManager, *fakeIptables) {
+	forwardPath := filepath.Join(t.TempDir(), "ip_forward")
+	err := os.WriteFile(forwardPath, []byte(forward+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write ip_forward: %v", err)
+	}
+
+	fake := &fakeIptables{rules: make(map[string]bool)}
+	nm := NewNATManager("10.0.0.0/24", "eth0")
+	nm.run = fake.run
+	nm.forwardPath = forwardPath
+	nm.geteuid = func() int { return 0 }
+	return nm, fake
+}
+
+func TestNATManager_EnableDisable(t *testing.T) {
+	nm, fake := newTestNATManager(t, "0")
+
+	err := nm.Enable()
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	if len(fake.rules) != 1 {
+		t.Errorf("Expected 1 masquerade rule, got %d", len(fake.rules))
+	}
+	if !fake.rules["POSTROUTING -s 10.0.0.0/24 -o eth0 -j MASQUERADE"] {
+		t.Errorf("Unexpected rules: %v", fake.rules)
+	}
+
+	forward, _ := os.ReadFile(nm.forwardPath)
+	if strings.TrimSpace(string(forward)) != "1" {
+		t.Errorf("Expected ip_forward 1, got %q", forward)
+	}
+
+	err = nm.Disable()
+	if err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+
+	if len(fake.rules) != 0 {
+		t.Errorf("Expected masquerade rule to be removed, got %v", fake.rules)
+	}
+
+	// ip_forward goes back to what it was before
+	forward, _ = os.ReadFile(nm.forwardPath)
+	if strings.TrimSpace(string(forward)) != "0" {
+		t.Errorf("Expected ip_forward restored to 0, got %q", forward)
+	}
+
+	// Disabling again is a no-op
+	err = nm.Disable()
+	if err != nil {
+		t.Errorf("Second Disable failed: %v", err)
+	}
+}
+
+func TestNATManager_NoDuplicateRules(t *testing.T) {
+	nm, fake := newTestNATManager(t, "1")
+
+	// A rule left behind by a crashed run
+	fake.rules["POSTROUTING -s 10.0.0.0/24 -o eth0 -j MASQUERADE"] = true
+
+	err := nm.Enable()
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	for _, command := range fake.commands {
+		if strings.Contains(command, " -A ") {
+			t.Errorf("Expected existing rule to be reused, got %q", command)
+		}
+	}
+
+	nm.Disable()
+	if len(fake.rules) != 0 {
+		t.Errorf("Expected masquerade rule to be removed, got %v", fake.rules)
+	}
+
+	// ip_forward was already on, so it stays on
+	forward, _ := os.ReadFile(nm.forwardPath)
+	if strings.TrimSpace(string(forward)) != "1" {
+		t.Errorf("Expected ip_forward to stay 1, got %q", forward)
+	}
+}
+
+func TestNATManager_RequiresRoot(t *testing.T) {
+	nm, fake := newTestNATManager(t, "0")
+	nm.geteuid = func() int { return 1000 }
+
+	err := nm.Enable()
+	if err != ErrNATRequiresRoot {
+		t.Errorf("Expected ErrNATRequiresRoot, got %v", err)
+	}
+
+	if len(fake.commands) != 0 {
+		t.Errorf("Expected no iptables commands, got %v", fake.commands)
+	}
+	if nm.IsEnabled() {
+		t.Error("Expected NAT to stay disabled")
+	}
+}
+
+// TestNATManager_CleanupAfterCrash tests that the changes of a run that died
+// without calling Disable are undone by the next run's Reconcile
+func TestNATManager_CleanupAfterCrash(t *testing.T) {
+	nm, fake := newTestNATManager(t, "0")
+	statePath := filepath.Join(t.TempDir(), "fvps.state")
+	nm.SetStateFile(NewStateFile(statePath))
+
+	err := nm.Enable()
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	// The next run finds the state file and undoes what it records
+	var sysctl []string
+	state := NewStateFile(statePath)
+	state.run = func(name string, args ...string) error {
+		if name == "iptables" {
+			return fake.run(name, args...)
+		}
+		sysctl = append(sysctl, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	err = state.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	if len(fake.rules) != 0 {
+		t.Errorf("Expected masquerade rule to be removed, got %v", fake.rules)
+	}
+	if len(sysctl) != 1 || sysctl[0] != "sysctl -w net.ipv4.ip_forward=0" {
+		t.Errorf("Expected ip_forward to be restored to 0, got %v", sysctl)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("Expected state file to be removed, got %v", err)
+	}
+}
+
+// TestNATManager_DisableForgetsState tests that a clean shutdown leaves
+// nothing for the next run to undo
+func TestNATManager_DisableForgetsState(t *testing.T) {
+	nm, _ := newTestNATManager(t, "0")
+	statePath := filepath.Join(t.TempDir(), "fvps.state")
+	nm.SetStateFile(NewStateFile(statePath))
+
+	err := nm.Enable()
+	if err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Fatalf("Expected state file while NAT is enabled, got %v", err)
+	}
+
+	err = nm.Disable()
+	if err != nil {
+		t.Fatalf("Disable failed: %v", err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("Expected state file to be removed, got %v", err)
+	}
+}
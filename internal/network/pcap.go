@@ -0,0 +1,118 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagic        = 0xa1b2c3d4 // Microsecond timestamps, in the writer's byte order
+	pcapSnapLen      = 65535
+	pcapLinkTypeRaw  = 101 // Packets start with the IP header, no link layer
+	pcapHeaderSize   = 24
+	pcapRecordHeader = 16
+)
+
+// PcapWriter writes IP packets to a pcap file that tcpdump or Wireshark can
+// read, for debugging what goes through a tunnel. Once the file reaches its
+// size limit further packets are dropped, so a capture left running can't
+// fill the disk. It is safe for concurrent use. A nil *PcapWriter writes
+// nothing.
+type PcapWriter struct {
+	path    string
+	maxSize int64
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64 // Bytes written, including the file header
+	full  bool  // The size limit was reached
+
+	// Overridable for tests
+	now func() time.Time
+}
+
+// NewPcapWriter creates a pcap file at path, replacing any file there, that
+// grows to at most maxSize bytes
+func NewPcapWriter(path string, maxSize int64) (*PcapWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcap file: %w", err)
+	}
+
+	header := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+
+	_, err = file.Write(header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+
+	return &PcapWriter{
+		path:    path,
+		maxSize: maxSize,
+		file:    file,
+		size:    pcapHeaderSize,
+		now:     time.Now,
+	}, nil
+}
+
+// WritePacket appends an IP packet to the capture, unless the file is full
+// or closed
+func (pw *PcapWriter) WritePacket(packet []byte) {
+	if pw == nil {
+		return
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if pw.file == nil || pw.full {
+		return
+	}
+
+	captured := packet[:min(len(packet), pcapSnapLen)]
+	if pw.size+pcapRecordHeader+int64(len(captured)) > pw.maxSize {
+		pw.full = true
+		log.Printf("Warning: pcap file %s reached %d bytes, no longer capturing", pw.path, pw.size)
+		return
+	}
+
+	now := pw.now()
+	record := make([]byte, pcapRecordHeader, pcapRecordHeader+len(captured))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, captured...)
+
+	n, err := pw.file.Write(record)
+	pw.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write to pcap file %s, no longer capturing: %v", pw.path, err)
+		pw.full = true
+	}
+}
+
+// Close closes the pcap file
+func (pw *PcapWriter) Close() error {
+	if pw == nil {
+		return nil
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	if pw.file == nil {
+		return nil
+	}
+	err := pw.file.Close()
+	pw.file = nil
+	return err
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPcapWriter tests that the capture starts with a pcap header for raw IP
+// packets and holds a record with a timestamp for each packet
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug.pcap")
+	pcap, err := NewPcapWriter(path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	pcap.now = func() time.Time { return time.Unix(1700000000, 250000000) }
+
+	packets := [][]byte{bytes.Repeat([]byte{0x45}, 20), bytes.Repeat([]byte{0x46}, 60)}
+	for _, packet := range packets {
+		pcap.WritePacket(packet)
+	}
+	err = pcap.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read capture: %v", err)
+	}
+	if len(data) < pcapHeaderSize {
+		t.Fatalf("Expected a %d-byte header, got %d bytes", pcapHeaderSize, len(data))
+	}
+
+	header := data[:pcapHeaderSize]
+	if magic := binary.LittleEndian.Uint32(header[0:]); magic != 0xa1b2c3d4 {
+		t.Errorf("Expected magic a1b2c3d4, got %x", magic)
+	}
+	if major, minor := binary.LittleEndian.Uint16(header[4:]), binary.LittleEndian.Uint16(header[6:]); major != 2 || minor != 4 {
+		t.Errorf("Expected version 2.4, got %d.%d", major, minor)
+	}
+	if linkType := binary.LittleEndian.Uint32(header[20:]); linkType != 101 {
+		t.Errorf("Expected link type 101 (raw IP), got %d", linkType)
+	}
+
+	records := data[pcapHeaderSize:]
+	for i, packet := range packets {
+		if len(records) < pcapRecordHeader+len(packet) {
+			t.Fatalf("Expected record %d, got %d bytes left", i, len(records))
+		}
+		seconds := binary.LittleEndian.Uint32(records[0:])
+		micros := binary.LittleEndian.Uint32(records[4:])
+		if seconds != 1700000000 || micros != 250000 {
+			t.Errorf("Expected record %d at 1700000000.250000, got %d.%06d", i, seconds, micros)
+		}
+		captured := binary.LittleEndian.Uint32(records[8:])
+		length := binary.LittleEndian.Uint32(records[12:])
+		if captured != uint32(len(packet)) || length != uint32(len(packet)) {
+			t.Errorf("Expected record %d to hold %d bytes, got %d of %d", i, len(packet), captured, length)
+		}
+		if !bytes.Equal(records[pcapRecordHeader:pcapRecordHeader+len(packet)], packet) {
+			t.Errorf("Expected record %d to hold the packet", i)
+		}
+		records = records[pcapRecordHeader+len(packet):]
+	}
+	if len(records) != 0 {
+		t.Errorf("Expected no more records, got %d bytes", len(records))
+	}
+}
+
+// TestPcapWriter_StopsAtMaxSize tests that packets that would take the file
+// past its size limit are dropped, and so are all packets after them
+func TestPcapWriter_StopsAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug.pcap")
+	maxSize := int64(pcapHeaderSize + 2*(pcapRecordHeader+40))
+	pcap, err := NewPcapWriter(path, maxSize)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	defer pcap.Close()
+
+	for i := 0; i < 3; i++ {
+		pcap.WritePacket(make([]byte, 40))
+	}
+	pcap.WritePacket(make([]byte, 1))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat capture: %v", err)
+	}
+	if info.Size() != maxSize {
+		t.Errorf("Expected the capture to stop at %d bytes, got %d", maxSize, info.Size())
+	}
+}
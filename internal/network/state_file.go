@@ -0,0 +1,161 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// StateFile records how to undo the system changes a server makes outside
+// its own process, such as NAT rules, so the next run can clean up after one
+// that died without doing so itself. Each change is stored as the command
+// that undoes it. A nil *StateFile records nothing.
+type StateFile struct {
+	path  string
+	mutex sync.Mutex
+
+	// Overridable for tests
+	run func(name string, args ...string) error
+}
+
+// NewStateFile returns a state file stored at path, which is only created
+// while there are changes to undo
+func NewStateFile(path string) *StateFile {
+	return &StateFile{
+		path: path,
+		run:  runCommand,
+	}
+}
+
+// Reconcile undoes the changes left behind by an earlier run, newest first,
+// and empties the file. Undo commands that fail are logged and dropped, since
+// the change they undo is usually gone already, e.g. after a reboot.
+func (sf *StateFile) Reconcile() error {
+	if sf == nil {
+		return nil
+	}
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	undo, err := sf.read()
+	if err != nil {
+		return err
+	}
+
+	for i := len(undo) - 1; i >= 0; i-- {
+		command := undo[i]
+		log.Printf("Cleaning up after an earlier run: %s", strings.Join(command, " "))
+		err := sf.run(command[0], command[1:]...)
+		if err != nil {
+			log.Printf("Failed to clean up, ignoring: %v", err)
+		}
+	}
+
+	return sf.write(nil)
+}
+
+// Record adds the command that undoes a change just made. It is recorded
+// once however often it is added.
+func (sf *StateFile) Record(undo ...string) error {
+	if sf == nil || len(undo) == 0 {
+		return nil
+	}
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	commands, err := sf.read()
+	if err != nil {
+		return err
+	}
+	for _, command := range commands {
+		if slices.Equal(command, undo) {
+			return nil
+		}
+	}
+
+	return sf.write(append(commands, undo))
+}
+
+// Forget removes an undo command once its change has been undone
+func (sf *StateFile) Forget(undo ...string) error {
+	if sf == nil {
+		return nil
+	}
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	commands, err := sf.read()
+	if err != nil {
+		return err
+	}
+
+	return sf.write(slices.DeleteFunc(commands, func(command []string) bool {
+		return slices.Equal(command, undo)
+	}))
+}
+
+// read returns the recorded undo commands, treating a missing file as empty
+func (sf *StateFile) read() ([][]string, error) {
+	data, err := os.ReadFile(sf.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var commands [][]string
+	err = json.Unmarshal(data, &commands)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", sf.path, err)
+	}
+
+	return slices.DeleteFunc(commands, func(command []string) bool { return len(command) == 0 }), nil
+}
+
+// write replaces the file atomically, so a crash mid-write leaves the
+// previous commands in place, and removes it once nothing is left to undo
+func (sf *StateFile) write(commands [][]string) error {
+	if len(commands) == 0 {
+		err := os.Remove(sf.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove state file: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state file: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(sf.path), filepath.Base(sf.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), sf.path)
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
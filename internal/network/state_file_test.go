@@ -0,0 +1,79 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateFile_RecordForgetReconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fvps.state")
+	state := NewStateFile(path)
+
+	var ran []string
+	state.run = func(name string, args ...string) error {
+		ran = append(ran, name+" "+strings.Join(args, " "))
+		if name == "fail" {
+			return errors.New("already gone")
+		}
+		return nil
+	}
+
+	for _, undo := range [][]string{{"first", "a"}, {"fail"}, {"second", "b"}, {"first", "a"}, {"third"}} {
+		err := state.Record(undo...)
+		if err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+	err := state.Forget("third")
+	if err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+
+	// Undone newest first, carrying on past failures, and recorded once each
+	err = state.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	expected := []string{"second b", "fail ", "first a"}
+	if strings.Join(ran, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected undo commands %v, got %v", expected, ran)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected state file to be removed, got %v", err)
+	}
+
+	// Nothing is left for another Reconcile
+	ran = nil
+	err = state.Reconcile()
+	if err != nil || len(ran) != 0 {
+		t.Errorf("Expected nothing to undo, got %v (err %v)", ran, err)
+	}
+}
+
+func TestStateFile_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fvps.state")
+	os.WriteFile(path, []byte("not json"), 0600)
+
+	err := NewStateFile(path).Reconcile()
+	if err == nil {
+		t.Error("Expected error for a corrupt state file")
+	}
+}
+
+func TestStateFile_Nil(t *testing.T) {
+	var state *StateFile
+
+	if err := state.Record("iptables", "-D"); err != nil {
+		t.Errorf("Expected nil state file to ignore Record, got %v", err)
+	}
+	if err := state.Forget("iptables", "-D"); err != nil {
+		t.Errorf("Expected nil state file to ignore Forget, got %v", err)
+	}
+	if err := state.Reconcile(); err != nil {
+		t.Errorf("Expected nil state file to ignore Reconcile, got %v", err)
+	}
+}
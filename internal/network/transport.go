@@ -0,0 +1,39 @@
+package network
+
+import "net"
+
+// Transport carries encoded packets between the server and its clients
+type Transport interface {
+	ReadFrom(buffer []byte) (n int, addr net.Addr, err error)
+	WriteTo(data []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+// UDPTransport is a Transport backed by a UDP socket
+type UDPTransport struct {
+	conn *net.UDPConn
+}
+
+// NewUDPTransport wraps an open UDP socket
+func NewUDPTransport(conn *net.UDPConn) *UDPTransport {
+	return &UDPTransport{conn: conn}
+}
+
+// ReadFrom reads one datagram into buffer
+func (t *UDPTransport) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	return t.conn.ReadFrom(buffer)
+}
+
+// WriteTo sends one datagram to addr
+func (t *UDPTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	return t.conn.WriteTo(data, addr)
+}
+
+// Close closes the underlying socket
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Ensure both implementations satisfy the interface
+var _ Transport = (*UDPTransport)(nil)
+var _ Transport = (*MockTransport)(nil)
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTransport_RoundTrip(t *testing.T) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create sender: %v", err)
+	}
+
+	receiving := NewUDPTransport(listener)
+	defer receiving.Close()
+	sending := NewUDPTransport(sender)
+	defer sending.Close()
+
+	_, err = sending.WriteTo([]byte("hello"), listener.LocalAddr())
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 64)
+	n, addr, err := receiving.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buffer[:n]) != "hello" {
+		t.Errorf("Expected 'hello', got '%s'", buffer[:n])
+	}
+	if addr.String() != sender.LocalAddr().String() {
+		t.Errorf("Expected source %s, got %s", sender.LocalAddr(), addr)
+	}
+}
+
+func TestMockTransport(t *testing.T) {
+	mt := NewMockTransport()
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 100), Port: 12345}
+
+	// Test read with nothing queued
+	_, _, err := mt.ReadFrom(make([]byte, 64))
+	if err == nil {
+		t.Error("Expected error when no datagrams are queued")
+	}
+
+	mt.QueueDatagram([]byte("inbound"), addr)
+	buffer := make([]byte, 64)
+	n, from, err := mt.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buffer[:n]) != "inbound" || from != addr {
+		t.Errorf("Expected 'inbound' from %s, got '%s' from %s", addr, buffer[:n], from)
+	}
+
+	data := []byte("outbound")
+	_, err = mt.WriteTo(data, addr)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	data[0] = 'X'
+
+	sent := mt.GetSent()
+	if len(sent) != 1 || string(sent[0].Data) != "outbound" || sent[0].Addr != addr {
+		t.Errorf("Expected 'outbound' sent to %s, got %v", addr, sent)
+	}
+
+	mt.Close()
+	_, err = mt.WriteTo(data, addr)
+	if err == nil {
+		t.Error("Expected error when writing to a closed transport")
+	}
+}
@@ -1,107 +1,128 @@
 package network
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
+	"slices"
+	"strings"
 	"syscall"
-	"unsafe"
 )
 
-type TunManager struct {
-	device *os.File
-	name   string
-}
+// MaxInterfaceNameLength is the longest interface name the kernel accepts,
+// leaving room for the terminating NUL in the 16-byte ifr_name field
+const MaxInterfaceNameLength = 15
 
-func NewTunManager() *TunManager {
-	return &TunManager{}
-}
+// DefaultTunnelAddress is the server interface address used when none is set
+const DefaultTunnelAddress = "10.0.0.1/24"
 
-func (tm *TunManager) Create(name string) error {
-	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR, 0)
-	if err != nil {
-		return fmt.Errorf("failed to open TUN device: %w", err)
-	}
+// DefaultMTU is the MTU of an interface whose MTU isn't set, and so the
+// largest packet read from it
+const DefaultMTU = 1500
 
-	var ifr struct {
-		name  [16]byte
-		flags uint16
-		pad   [22]byte
+// ValidateInterfaceName checks that name can be used for a TUN interface
+func ValidateInterfaceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid interface name: must not be empty")
 	}
-
-	copy(ifr.name[:], name)
-	ifr.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
-
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
-	if errno != 0 {
-		syscall.Close(fd)
-		return fmt.Errorf("failed to create TUN interface: %v", errno)
+	if len(name) > MaxInterfaceNameLength {
+		return fmt.Errorf("invalid interface name %q: must be at most %d bytes", name, MaxInterfaceNameLength)
 	}
-
-	tm.device = os.NewFile(uintptr(fd), "/dev/net/tun")
-	tm.name = name
-
-	if err := tm.configureInterface(); err != nil {
-		tm.Close()
-		return fmt.Errorf("failed to configure interface: %w", err)
-	}
-
 	return nil
 }
 
-func (tm *TunManager) configureInterface() error {
-	cmd := exec.Command("ip", "link", "set", tm.name, "up")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to bring interface up: %w", err)
-	}
-
-	cmd = exec.Command("ip", "addr", "add", "10.0.0.1/24", "dev", tm.name)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set IP address: %w", err)
-	}
-
-	return nil
+// TunManager manages a kernel TUN device. Creating and configuring the
+// device is platform specific; see tun_linux.go, tun_darwin.go and
+// tun_windows.go.
+type TunManager struct {
+	device  io.ReadWriteCloser // Reads and writes bare IP packets, or utun frames on macOS
+	name    string
+	address string // Server address in CIDR notation, set up by Create
+	mtu     int    // Set on the interface by Create; zero leaves the default
+
+	adopted     io.ReadWriteCloser // Interface passed to NewTunManagerFromFD, until Create adopts it
+	adoptedName string
+
+	// Overridable for tests; open is only used on Linux, where nil opens
+	// /dev/net/tun
+	run    func(name string, args ...string) error
+	output func(name string, args ...string) ([]byte, error)
+	open   func(name string) (io.ReadWriteCloser, error)
 }
 
-func (tm *TunManager) ConfigureClientInterface(clientIP string) error {
-	cmd := exec.Command("ip", "link", "set", tm.name, "up")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to bring interface up: %w", err)
-	}
-
-	cmd = exec.Command("ip", "addr", "add", clientIP+"/24", "dev", tm.name)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set client IP address: %w", err)
+func NewTunManager() *TunManager {
+	return &TunManager{
+		address: DefaultTunnelAddress,
+		run:     runCommand,
+		output:  commandOutput,
 	}
-
-	return nil
 }
 
-func (tm *TunManager) ReadPacket() ([]byte, error) {
-	if tm.device == nil {
-		return nil, fmt.Errorf("TUN interface not created")
+// parseInterfaceReady reports whether output, as printed by "ip addr show",
+// shows the interface up with ip among its IPv4 addresses
+func parseInterfaceReady(output, ip string) bool {
+	up := false
+	assigned := false
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+
+		// The first line reads e.g. "5: fvp0: <POINTOPOINT,UP,LOWER_UP> mtu 1500 ..."
+		if len(fields) >= 3 && strings.HasPrefix(fields[2], "<") {
+			flags := strings.Split(strings.Trim(fields[2], "<>"), ",")
+			up = slices.Contains(flags, "UP")
+		}
+
+		if len(fields) >= 2 && fields[0] == "inet" {
+			address, _, _ := strings.Cut(fields[1], "/")
+			if address == ip {
+				assigned = true
+			}
+		}
 	}
+	return up && assigned
+}
 
-	buffer := make([]byte, 1500)
-	n, err := tm.device.Read(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read packet: %w", err)
-	}
+// SetAddress sets the address, in CIDR notation such as "10.8.0.1/16", that
+// Create assigns to a server interface. It has no effect once created.
+func (tm *TunManager) SetAddress(cidr string) {
+	tm.address = cidr
+}
 
-	return buffer[:n], nil
+// SetMTU sets the MTU Create gives the interface, e.g. 9000 for jumbo frames,
+// and sizes reads to match. Zero leaves the system default of DefaultMTU. It
+// has no effect once created.
+func (tm *TunManager) SetMTU(mtu int) {
+	tm.mtu = mtu
 }
 
-func (tm *TunManager) WritePacket(data []byte) error {
-	if tm.device == nil {
-		return fmt.Errorf("TUN interface not created")
+// readBufferSize is the largest packet the interface can hand over
+func (tm *TunManager) readBufferSize() int {
+	if tm.mtu == 0 {
+		return DefaultMTU
 	}
+	return tm.mtu
+}
 
-	_, err := tm.device.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write packet: %w", err)
+// transientReadRetries is how many times readDevice retries a read that was
+// interrupted or found nothing ready before passing the error on
+const transientReadRetries = 3
+
+// readDevice reads one packet from a TUN device into buffer. Reads
+// interrupted by a signal or that would block are retried a few times
+// rather than reported as failures. The packet may be empty; callers skip
+// those.
+func readDevice(device io.Reader, buffer []byte) (int, error) {
+	for retries := 0; ; retries++ {
+		n, err := device.Read(buffer)
+		if err == nil {
+			return n, nil
+		}
+
+		transient := errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+		if !transient || retries == transientReadRetries {
+			return 0, fmt.Errorf("failed to read packet: %w", err)
+		}
 	}
-
-	return nil
 }
 
 func (tm *TunManager) Close() error {
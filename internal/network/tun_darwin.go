@@ -0,0 +1,192 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	utunControlName = "com.apple.net.utun_control"
+	utunOptIfName   = 2 // UTUN_OPT_IFNAME
+	sysProtoControl = 2 // SYSPROTO_CONTROL
+
+	// utun prefixes every packet with the address family in network byte order
+	utunHeaderSize = 4
+)
+
+// Create opens a utun interface. macOS only allows names of the form utunN,
+// so any other name lets the kernel pick the next free unit; use GetName to
+// find out which interface was created. A TunManager from
+// NewTunManagerFromFD adopts its interface instead, whatever name is.
+func (tm *TunManager) Create(name string) error {
+	if tm.adopted != nil {
+		tm.adopt()
+		return nil
+	}
+
+	if err := ValidateInterfaceName(name); err != nil {
+		return err
+	}
+
+	unit := utunUnit(name)
+
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, sysProtoControl)
+	if err != nil {
+		return fmt.Errorf("failed to open utun control socket: %w", err)
+	}
+
+	info := &unix.CtlInfo{}
+	copy(info.Name[:], utunControlName)
+	err = unix.IoctlCtlInfo(fd, info)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to look up utun control: %w", err)
+	}
+
+	err = unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: unit})
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to create TUN interface: %w", err)
+	}
+
+	ifName, err := unix.GetsockoptString(fd, sysProtoControl, utunOptIfName)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to get utun interface name: %w", err)
+	}
+
+	if unit == 0 && name != ifName {
+		log.Printf("macOS requires utunN interface names, using %s instead of %s", ifName, name)
+	}
+
+	tm.device = os.NewFile(uintptr(fd), ifName)
+	tm.name = ifName
+
+	if err := tm.configureInterface(); err != nil {
+		tm.Close()
+		return fmt.Errorf("failed to configure interface: %w", err)
+	}
+
+	return nil
+}
+
+// utunUnit returns the control unit for a utunN name, which is N+1, or 0 to
+// let the kernel pick the next free unit for any other name
+func utunUnit(name string) uint32 {
+	number, ok := strings.CutPrefix(name, "utun")
+	if !ok {
+		return 0
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return uint32(n) + 1
+}
+
+func (tm *TunManager) configureInterface() error {
+	ip, subnet, err := net.ParseCIDR(tm.address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid interface address %q: must be an IPv4 CIDR", tm.address)
+	}
+	netmask := net.IP(subnet.Mask).String()
+
+	if tm.mtu != 0 {
+		cmd := exec.Command("ifconfig", tm.name, "mtu", strconv.Itoa(tm.mtu))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to set MTU: %w", err)
+		}
+	}
+
+	// utun is point-to-point, so it needs a destination address as well
+	cmd := exec.Command("ifconfig", tm.name, "inet", ip.String(), ip.String(), "netmask", netmask, "up")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to set IP address: %w", err)
+	}
+
+	cmd = exec.Command("route", "-q", "-n", "add", "-net", subnet.String(), "-interface", tm.name)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to add subnet route: %w", err)
+	}
+
+	return nil
+}
+
+func (tm *TunManager) ConfigureClientInterface(clientIP string) error {
+	ip := net.ParseIP(clientIP).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid client IP address: %s", clientIP)
+	}
+
+	// The server is the first host of the client's /24
+	subnet := &net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	serverIP := make(net.IP, 4)
+	copy(serverIP, subnet.IP)
+	serverIP[3] = 1
+
+	cmd := exec.Command("ifconfig", tm.name, "inet", clientIP, serverIP.String(), "netmask", "255.255.255.0", "up")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to set client IP address: %w", err)
+	}
+
+	cmd = exec.Command("route", "-q", "-n", "add", "-net", subnet.String(), "-interface", tm.name)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to add subnet route: %w", err)
+	}
+
+	return nil
+}
+
+func (tm *TunManager) ReadPacket() ([]byte, error) {
+	if tm.device == nil {
+		return nil, fmt.Errorf("TUN interface not created")
+	}
+
+	buffer := make([]byte, utunHeaderSize+tm.readBufferSize())
+	n, err := readDevice(tm.device, buffer)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n < utunHeaderSize {
+		return nil, fmt.Errorf("failed to read packet: short utun frame")
+	}
+
+	return buffer[utunHeaderSize:n], nil
+}
+
+func (tm *TunManager) WritePacket(data []byte) error {
+	if tm.device == nil {
+		return fmt.Errorf("TUN interface not created")
+	}
+
+	frame := make([]byte, utunHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, utunFamily(data))
+	copy(frame[utunHeaderSize:], data)
+
+	_, err := tm.device.Write(frame)
+	if err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+
+	return nil
+}
+
+// utunFamily returns the address family utun expects in front of an IP packet
+func utunFamily(data []byte) uint32 {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
@@ -0,0 +1,22 @@
+package network
+
+import "testing"
+
+func TestUtunUnit(t *testing.T) {
+	tests := []struct {
+		name string
+		unit uint32
+	}{
+		{"utun0", 1},
+		{"utun7", 8},
+		{"utun", 0},
+		{"utunx", 0},
+		{"fvp-client0", 0},
+	}
+
+	for _, tt := range tests {
+		if unit := utunUnit(tt.name); unit != tt.unit {
+			t.Errorf("%s: expected unit %d, got %d", tt.name, tt.unit, unit)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Create creates a TUN interface called name. An interface of that name left
+// behind by an earlier run, e.g. one that crashed, is reused if it is a TUN
+// interface nobody holds, and deleted and recreated if it is anything else.
+// One still held by another process is an error. A TunManager from
+// NewTunManagerFromFD adopts its interface instead, whatever name is.
+func (tm *TunManager) Create(name string) error {
+	if tm.adopted != nil {
+		tm.adopt()
+		return nil
+	}
+
+	if err := ValidateInterfaceName(name); err != nil {
+		return err
+	}
+
+	open := tm.open
+	if open == nil {
+		open = openTUN
+	}
+
+	device, err := open(name)
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EEXIST) {
+		log.Printf("Removing stale interface %s left behind by an earlier run", name)
+		deleteErr := tm.run("ip", "link", "delete", name)
+		if deleteErr != nil {
+			return fmt.Errorf("failed to remove stale interface %s: %w", name, deleteErr)
+		}
+		device, err = open(name)
+	}
+	if errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("failed to create TUN interface: %s is in use by another process", name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create TUN interface: %w", err)
+	}
+
+	tm.device = device
+	tm.name = name
+
+	if err := tm.configureInterface(); err != nil {
+		tm.Close()
+		return fmt.Errorf("failed to configure interface: %w", err)
+	}
+
+	return nil
+}
+
+// openTUN attaches to the TUN interface called name, creating it if it
+// doesn't exist. The kernel's errno is returned as is, so callers can tell
+// why an existing interface couldn't be used.
+func openTUN(name string) (io.ReadWriteCloser, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TUN device: %w", err)
+	}
+
+	var ifr struct {
+		name  [16]byte
+		flags uint16
+		pad   [22]byte
+	}
+
+	copy(ifr.name[:], name)
+	ifr.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+func (tm *TunManager) configureInterface() error {
+	if tm.mtu != 0 {
+		err := tm.run("ip", "link", "set", tm.name, "mtu", strconv.Itoa(tm.mtu))
+		if err != nil {
+			return fmt.Errorf("failed to set MTU: %w", err)
+		}
+	}
+
+	return tm.setAddress(tm.address)
+}
+
+func (tm *TunManager) ConfigureClientInterface(clientIP string) error {
+	err := tm.setAddress(clientIP + "/24")
+	if err != nil {
+		return fmt.Errorf("failed to set client IP address: %w", err)
+	}
+
+	return nil
+}
+
+var _ ReadinessChecker = (*TunManager)(nil)
+
+// InterfaceReady reports whether the kernel shows the interface up with
+// clientIP assigned
+func (tm *TunManager) InterfaceReady(clientIP string) (bool, error) {
+	output, err := tm.output("ip", "addr", "show", "dev", tm.name)
+	if err != nil {
+		return false, fmt.Errorf("failed to read interface state: %w", err)
+	}
+	return parseInterfaceReady(string(output), clientIP), nil
+}
+
+// setAddress brings the interface up with cidr as its only address. An
+// interface reused from an earlier run may still hold that run's address,
+// which would make adding it again fail, so existing addresses are flushed
+// first.
+func (tm *TunManager) setAddress(cidr string) error {
+	err := tm.run("ip", "link", "set", tm.name, "up")
+	if err != nil {
+		return fmt.Errorf("failed to bring interface up: %w", err)
+	}
+
+	err = tm.run("ip", "addr", "flush", "dev", tm.name)
+	if err != nil {
+		return fmt.Errorf("failed to clear stale addresses: %w", err)
+	}
+
+	err = tm.run("ip", "addr", "add", cidr, "dev", tm.name)
+	if err != nil {
+		return fmt.Errorf("failed to set IP address: %w", err)
+	}
+
+	return nil
+}
+
+func (tm *TunManager) ReadPacket() ([]byte, error) {
+	if tm.device == nil {
+		return nil, fmt.Errorf("TUN interface not created")
+	}
+
+	buffer := make([]byte, tm.readBufferSize())
+	n, err := readDevice(tm.device, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer[:n], nil
+}
+
+func (tm *TunManager) WritePacket(data []byte) error {
+	if tm.device == nil {
+		return fmt.Errorf("TUN interface not created")
+	}
+
+	_, err := tm.device.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeTUNDevice stands in for an open /dev/net/tun
+type fakeTUNDevice struct {
+	io.ReadWriter
+}
+
+func (d *fakeTUNDevice) Close() error {
+	return nil
+}
+
+// newTestTunManager returns a TunManager whose open fails with each of
+// openErrors in turn before succeeding, and which records ip commands
+func newTestTunManager(openErrors ...error) (*TunManager, *[]string) {
+	var commands []string
+	tm := NewTunManager()
+	tm.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	tm.open = func(name string) (io.ReadWriteCloser, error) {
+		if len(openErrors) > 0 {
+			err := openErrors[0]
+			openErrors = openErrors[1:]
+			return nil, err
+		}
+		return &fakeTUNDevice{}, nil
+	}
+	return tm, &commands
+}
+
+func TestTunManager_RecreatesStaleInterface(t *testing.T) {
+	// The name is taken by an interface that isn't a usable TUN interface
+	tm, commands := newTestTunManager(syscall.EINVAL)
+
+	err := tm.Create("fvp0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if !tm.IsCreated() || tm.GetName() != "fvp0" {
+		t.Errorf("Expected created interface fvp0, got %q (created %t)", tm.GetName(), tm.IsCreated())
+	}
+
+	expected := []string{
+		"ip link delete fvp0",
+		"ip link set fvp0 up",
+		"ip addr flush dev fvp0",
+		"ip addr add 10.0.0.1/24 dev fvp0",
+	}
+	if strings.Join(*commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected commands %v, got %v", expected, *commands)
+	}
+}
+
+// TestTunManager_MTU tests that a set MTU is given to the interface and that
+// reads take packets that large
+func TestTunManager_MTU(t *testing.T) {
+	tm, commands := newTestTunManager()
+	tm.SetMTU(9000)
+
+	jumbo := bytes.Repeat([]byte{0x45}, 9000)
+	tm.open = func(name string) (io.ReadWriteCloser, error) {
+		return &fakeTUNDevice{bytes.NewBuffer(jumbo)}, nil
+	}
+
+	err := tm.Create("fvp0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(*commands) == 0 || (*commands)[0] != "ip link set fvp0 mtu 9000" {
+		t.Errorf("Expected the MTU to be set first, got %v", *commands)
+	}
+
+	packet, err := tm.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if !bytes.Equal(packet, jumbo) {
+		t.Errorf("Expected the 9000-byte packet intact, got %d bytes", len(packet))
+	}
+}
+
+func TestTunManager_ReusesStaleTUN(t *testing.T) {
+	// A persistent TUN interface attaches without error; only its stale
+	// address needs clearing
+	tm, commands := newTestTunManager()
+
+	err := tm.Create("fvp0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	for _, command := range *commands {
+		if strings.Contains(command, "delete") {
+			t.Errorf("Expected the interface to be reused, got %q", command)
+		}
+	}
+}
+
+func TestTunManager_InterfaceInUse(t *testing.T) {
+	tm, commands := newTestTunManager(syscall.EBUSY)
+
+	err := tm.Create("fvp0")
+	if err == nil || !strings.Contains(err.Error(), "in use by another process") {
+		t.Errorf("Expected in-use error, got %v", err)
+	}
+	if len(*commands) != 0 {
+		t.Errorf("Expected a busy interface to be left alone, got %v", *commands)
+	}
+	if tm.IsCreated() {
+		t.Error("Expected no interface to be created")
+	}
+}
+
+func TestTunManager_InterfaceReady(t *testing.T) {
+	tm, _ := newTestTunManager()
+	err := tm.Create("fvp0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	var command string
+	tm.output = func(name string, args ...string) ([]byte, error) {
+		command = name + " " + strings.Join(args, " ")
+		return []byte("5: fvp0: <POINTOPOINT,UP,LOWER_UP> mtu 1500\n    inet 10.0.0.2/24 scope global fvp0\n"), nil
+	}
+
+	ready, err := tm.InterfaceReady("10.0.0.2")
+	if err != nil || !ready {
+		t.Errorf("Expected the interface ready, got %t, %v", ready, err)
+	}
+	if command != "ip addr show dev fvp0" {
+		t.Errorf("Expected ip addr show dev fvp0, got %q", command)
+	}
+}
+
+// TestNewTunManagerFromFD tests that an interface passed as a file
+// descriptor, here a pipe, is adopted without opening or configuring
+// anything and carries packets
+func TestNewTunManagerFromFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// The TunManager closes the descriptor it gets, so give it its own
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to duplicate descriptor: %v", err)
+	}
+
+	tm, err := NewTunManagerFromFD(fd, "fvp-passed0")
+	if err != nil {
+		t.Fatalf("NewTunManagerFromFD failed: %v", err)
+	}
+	var commands []string
+	tm.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	tm.open = func(name string) (io.ReadWriteCloser, error) {
+		t.Errorf("Expected no device to be opened, got one for %s", name)
+		return &fakeTUNDevice{}, nil
+	}
+
+	err = tm.Create("fvp0")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer tm.Close()
+	if !tm.IsCreated() || tm.GetName() != "fvp-passed0" {
+		t.Errorf("Expected adopted interface fvp-passed0, got %q (created %t)", tm.GetName(), tm.IsCreated())
+	}
+	if len(commands) != 0 {
+		t.Errorf("Expected an adopted interface to be left as configured, got %v", commands)
+	}
+
+	packet := []byte{0x45, 0x00, 0x00, 0x14}
+	_, err = w.Write(packet)
+	if err != nil {
+		t.Fatalf("Failed to write to pipe: %v", err)
+	}
+	read, err := tm.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if !bytes.Equal(read, packet) {
+		t.Errorf("Expected %x, got %x", packet, read)
+	}
+}
+
+func TestNewTunManagerFromFD_Invalid(t *testing.T) {
+	_, err := NewTunManagerFromFD(-1, "fvp0")
+	if err == nil {
+		t.Error("Expected an invalid descriptor to be rejected")
+	}
+
+	_, err = NewTunManagerFromFD(0, "an-interface-name-too-long")
+	if err == nil {
+		t.Error("Expected an invalid name to be rejected")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin && !windows
+
+package network
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func NewTunManagerFromFD(fd int, name string) (*TunManager, error) {
+	return nil, fmt.Errorf("TUN interfaces are not supported on %s", runtime.GOOS)
+}
+
+func (tm *TunManager) Create(name string) error {
+	return fmt.Errorf("TUN interfaces are not supported on %s", runtime.GOOS)
+}
+
+func (tm *TunManager) ConfigureClientInterface(clientIP string) error {
+	return fmt.Errorf("TUN interfaces are not supported on %s", runtime.GOOS)
+}
+
+func (tm *TunManager) ReadPacket() ([]byte, error) {
+	return nil, fmt.Errorf("TUN interface not created")
+}
+
+func (tm *TunManager) WritePacket(data []byte) error {
+	return fmt.Errorf("TUN interface not created")
+}
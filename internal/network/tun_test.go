@@ -1,6 +1,8 @@
 package network
 
 import (
+	"errors"
+	"syscall"
 	"testing"
 )
 
@@ -230,3 +232,124 @@ func TestMockTUNManager_ConcurrentAccess(t *testing.T) {
 		t.Errorf("Expected 10 packets in queue, got %d", len(queue))
 	}
 }
+
+func TestValidateInterfaceName(t *testing.T) {
+	valid := []string{"fvp0", "fvp-client0", "abcdefghijklmno"}
+	for _, name := range valid {
+		if err := ValidateInterfaceName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "abcdefghijklmnop"}
+	for _, name := range invalid {
+		if err := ValidateInterfaceName(name); err == nil {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestTunManager_CreateRejectsLongName(t *testing.T) {
+	tm := NewTunManager()
+
+	err := tm.Create("abcdefghijklmnop")
+	if err == nil {
+		tm.Close()
+		t.Fatal("Expected error for interface name over 15 bytes")
+	}
+	if tm.IsCreated() {
+		t.Error("Expected no interface to be created")
+	}
+}
+
+func TestTunManager_SetAddress(t *testing.T) {
+	tm := NewTunManager()
+	if tm.address != DefaultTunnelAddress {
+		t.Errorf("Expected default address %s, got %s", DefaultTunnelAddress, tm.address)
+	}
+
+	tm.SetAddress("10.8.0.1/16")
+	if tm.address != "10.8.0.1/16" {
+		t.Errorf("Expected address 10.8.0.1/16, got %s", tm.address)
+	}
+}
+
+// scriptedReader returns each of errs in turn, then reads data
+type scriptedReader struct {
+	errs []error
+	data []byte
+}
+
+func (r *scriptedReader) Read(buffer []byte) (int, error) {
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return 0, err
+	}
+	return copy(buffer, r.data), nil
+}
+
+func TestReadDevice(t *testing.T) {
+	tests := []struct {
+		name     string
+		errs     []error
+		data     []byte
+		expected int
+		err      error
+	}{
+		{"packet", nil, []byte{0x45, 0x00}, 2, nil},
+		{"empty read", nil, nil, 0, nil},
+		{"interrupted", []error{syscall.EINTR, syscall.EAGAIN}, []byte{0x45}, 1, nil},
+		{"interrupted too often", []error{syscall.EINTR, syscall.EINTR, syscall.EINTR, syscall.EINTR}, []byte{0x45}, 0, syscall.EINTR},
+		{"device error", []error{syscall.EBADF}, []byte{0x45}, 0, syscall.EBADF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := readDevice(&scriptedReader{errs: tt.errs, data: tt.data}, make([]byte, 1500))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if n != tt.expected {
+				t.Errorf("Expected %d bytes, got %d", tt.expected, n)
+			}
+		})
+	}
+}
+
+func TestParseInterfaceReady(t *testing.T) {
+	const up = `7: fvp-client0: <POINTOPOINT,MULTICAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc fq_codel state UNKNOWN group default qlen 500
+    link/none 
+    inet 10.0.0.2/24 scope global fvp-client0
+       valid_lft forever preferred_lft forever
+`
+	const down = `7: fvp-client0: <POINTOPOINT,MULTICAST,NOARP> mtu 1500 qdisc noop state DOWN group default qlen 500
+    link/none 
+    inet 10.0.0.2/24 scope global fvp-client0
+       valid_lft forever preferred_lft forever
+`
+	const noAddress = `7: fvp-client0: <POINTOPOINT,MULTICAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc fq_codel state UNKNOWN group default qlen 500
+    link/none 
+`
+
+	tests := []struct {
+		name     string
+		output   string
+		ip       string
+		expected bool
+	}{
+		{"up with the address", up, "10.0.0.2", true},
+		{"up with another address", up, "10.0.0.20", false},
+		{"down", down, "10.0.0.2", false},
+		{"no address yet", noAddress, "10.0.0.2", false},
+		{"no output", "", "10.0.0.2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ready := parseInterfaceReady(tt.output, tt.ip); ready != tt.expected {
+				t.Errorf("Expected ready %t, got %t", tt.expected, ready)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin
+
+package network
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// NewTunManagerFromFD returns a TunManager for the TUN interface called name
+// that another process, such as an init process or container runtime,
+// created and passed down open as file descriptor fd. Create adopts it as
+// is: nothing is opened and its address, MTU and link state are left alone,
+// so no CAP_NET_ADMIN is needed. On macOS fd must be a utun control socket.
+func NewTunManagerFromFD(fd int, name string) (*TunManager, error) {
+	if err := ValidateInterfaceName(name); err != nil {
+		return nil, err
+	}
+
+	var stat syscall.Stat_t
+	err := syscall.Fstat(fd, &stat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUN file descriptor %d: %w", fd, err)
+	}
+
+	tm := NewTunManager()
+	tm.adopted = os.NewFile(uintptr(fd), name)
+	tm.adoptedName = name
+	return tm, nil
+}
+
+// adopt makes the interface passed to NewTunManagerFromFD the device, without
+// configuring it. It can only be adopted once; once closed, Create makes a
+// new interface.
+func (tm *TunManager) adopt() {
+	log.Printf("Using TUN interface %s passed as a file descriptor, as already configured", tm.adoptedName)
+
+	tm.device = tm.adopted
+	tm.name = tm.adoptedName
+	tm.adopted = nil
+}
@@ -0,0 +1,303 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// wintunTunnelType groups the adapters created by FVP in Wintun
+	wintunTunnelType = "FVP"
+
+	// wintunRingCapacity is the size of each session ring; Wintun requires a
+	// power of two between 128 KiB and 64 MiB
+	wintunRingCapacity = 0x400000
+)
+
+var (
+	wintunOnce  sync.Once
+	wintunError error
+
+	procCreateAdapter        uintptr
+	procCloseAdapter         uintptr
+	procStartSession         uintptr
+	procEndSession           uintptr
+	procGetReadWaitEvent     uintptr
+	procReceivePacket        uintptr
+	procReleaseReceivePacket uintptr
+	procAllocateSendPacket   uintptr
+	procSendPacket           uintptr
+)
+
+// loadWintun loads wintun.dll and resolves the functions used. The DLL is
+// only looked for next to the executable and in System32, never in the
+// current directory.
+func loadWintun() error {
+	wintunOnce.Do(func() {
+		dll, err := windows.LoadLibraryEx("wintun.dll", 0, windows.LOAD_LIBRARY_SEARCH_APPLICATION_DIR|windows.LOAD_LIBRARY_SEARCH_SYSTEM32)
+		if err != nil {
+			wintunError = fmt.Errorf("failed to load wintun.dll, get it from https://www.wintun.net and put it next to the executable: %w", err)
+			return
+		}
+
+		procs := []struct {
+			name string
+			addr *uintptr
+		}{
+			{"WintunCreateAdapter", &procCreateAdapter},
+			{"WintunCloseAdapter", &procCloseAdapter},
+			{"WintunStartSession", &procStartSession},
+			{"WintunEndSession", &procEndSession},
+			{"WintunGetReadWaitEvent", &procGetReadWaitEvent},
+			{"WintunReceivePacket", &procReceivePacket},
+			{"WintunReleaseReceivePacket", &procReleaseReceivePacket},
+			{"WintunAllocateSendPacket", &procAllocateSendPacket},
+			{"WintunSendPacket", &procSendPacket},
+		}
+		for _, proc := range procs {
+			*proc.addr, err = windows.GetProcAddress(dll, proc.name)
+			if err != nil {
+				wintunError = fmt.Errorf("failed to find %s in wintun.dll: %w", proc.name, err)
+				return
+			}
+		}
+	})
+	return wintunError
+}
+
+// wintunDevice reads and writes packets through a Wintun session. Wintun
+// hands over bare IP packets with no header in front, like IFF_NO_PI on
+// Linux, so no framing is needed.
+type wintunDevice struct {
+	adapter    uintptr
+	session    uintptr
+	readEvent  windows.Handle // Signalled by Wintun when packets arrive
+	closeEvent windows.Handle // Signalled by Close to wake a blocked Read
+	mutex      sync.RWMutex   // Held for reading while the session is in use, so Close can't end it mid-call
+	closed     bool
+}
+
+// openWintun creates a Wintun adapter called name and starts a session on it
+func openWintun(name string) (*wintunDevice, error) {
+	err := loadWintun()
+	if err != nil {
+		return nil, err
+	}
+
+	adapterName, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface name %q: %w", name, err)
+	}
+	tunnelType, _ := windows.UTF16PtrFromString(wintunTunnelType)
+
+	adapter, _, errno := syscall.SyscallN(procCreateAdapter, uintptr(unsafe.Pointer(adapterName)), uintptr(unsafe.Pointer(tunnelType)), 0)
+	if adapter == 0 {
+		return nil, fmt.Errorf("failed to create Wintun adapter: %w", errno)
+	}
+
+	session, _, errno := syscall.SyscallN(procStartSession, adapter, wintunRingCapacity)
+	if session == 0 {
+		syscall.SyscallN(procCloseAdapter, adapter)
+		return nil, fmt.Errorf("failed to start Wintun session: %w", errno)
+	}
+
+	closeEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		syscall.SyscallN(procEndSession, session)
+		syscall.SyscallN(procCloseAdapter, adapter)
+		return nil, fmt.Errorf("failed to create close event: %w", err)
+	}
+
+	readEvent, _, _ := syscall.SyscallN(procGetReadWaitEvent, session)
+
+	return &wintunDevice{
+		adapter:    adapter,
+		session:    session,
+		readEvent:  windows.Handle(readEvent),
+		closeEvent: closeEvent,
+	}, nil
+}
+
+// Read copies the next packet into buffer, waiting until one arrives
+func (d *wintunDevice) Read(buffer []byte) (int, error) {
+	for {
+		d.mutex.RLock()
+		if d.closed {
+			d.mutex.RUnlock()
+			return 0, os.ErrClosed
+		}
+
+		var size uint32
+		packet, _, errno := syscall.SyscallN(procReceivePacket, d.session, uintptr(unsafe.Pointer(&size)))
+		if packet != 0 {
+			n := copy(buffer, unsafe.Slice(bytePointer(packet), size))
+			syscall.SyscallN(procReleaseReceivePacket, d.session, packet)
+			d.mutex.RUnlock()
+			return n, nil
+		}
+		d.mutex.RUnlock()
+
+		switch errno {
+		case windows.ERROR_NO_MORE_ITEMS:
+			_, err := windows.WaitForMultipleObjects([]windows.Handle{d.readEvent, d.closeEvent}, false, windows.INFINITE)
+			if err != nil {
+				return 0, fmt.Errorf("failed to wait for packets: %w", err)
+			}
+		case windows.ERROR_HANDLE_EOF:
+			return 0, os.ErrClosed
+		default:
+			return 0, errno
+		}
+	}
+}
+
+// Write sends one packet. It fails rather than waits if the ring is full,
+// which drops the packet the way a congested link would.
+func (d *wintunDevice) Write(packet []byte) (int, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return 0, os.ErrClosed
+	}
+
+	buffer, _, errno := syscall.SyscallN(procAllocateSendPacket, d.session, uintptr(len(packet)))
+	if buffer == 0 {
+		return 0, errno
+	}
+	copy(unsafe.Slice(bytePointer(buffer), len(packet)), packet)
+	syscall.SyscallN(procSendPacket, d.session, buffer)
+
+	return len(packet), nil
+}
+
+// Close ends the session and removes the adapter. The close event is left
+// open, so a Read racing Close never waits on a recycled handle.
+func (d *wintunDevice) Close() error {
+	windows.SetEvent(d.closeEvent)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	syscall.SyscallN(procEndSession, d.session)
+	syscall.SyscallN(procCloseAdapter, d.adapter)
+	return nil
+}
+
+// bytePointer turns an address in a Wintun ring into a pointer. The ring
+// isn't Go memory and never moves; going through a variable keeps vet from
+// mistaking this for a stale uintptr.
+func bytePointer(addr uintptr) *byte {
+	return *(**byte)(unsafe.Pointer(&addr))
+}
+
+// NewTunManagerFromFD is not supported on Windows, whose TUN interfaces are
+// Wintun adapters rather than file descriptors
+func NewTunManagerFromFD(fd int, name string) (*TunManager, error) {
+	return nil, fmt.Errorf("adopting a TUN file descriptor is not supported on windows")
+}
+
+// Create creates a Wintun adapter. It needs wintun.dll next to the
+// executable and an elevated prompt.
+func (tm *TunManager) Create(name string) error {
+	if err := ValidateInterfaceName(name); err != nil {
+		return err
+	}
+
+	device, err := openWintun(name)
+	if err != nil {
+		return fmt.Errorf("failed to create TUN interface: %w", err)
+	}
+
+	tm.device = device
+	tm.name = name
+
+	if err := tm.configureInterface(); err != nil {
+		tm.Close()
+		return fmt.Errorf("failed to configure interface: %w", err)
+	}
+
+	return nil
+}
+
+func (tm *TunManager) configureInterface() error {
+	ip, subnet, err := net.ParseCIDR(tm.address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid interface address %q: must be an IPv4 CIDR", tm.address)
+	}
+
+	if tm.mtu != 0 {
+		cmd := exec.Command("netsh", "interface", "ipv4", "set", "subinterface", tm.name, "mtu="+strconv.Itoa(tm.mtu), "store=active")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to set MTU: %w: %s", err, output)
+		}
+	}
+
+	return tm.setAddress(ip.String(), net.IP(subnet.Mask).String())
+}
+
+func (tm *TunManager) ConfigureClientInterface(clientIP string) error {
+	if net.ParseIP(clientIP).To4() == nil {
+		return fmt.Errorf("invalid client IP address: %s", clientIP)
+	}
+
+	err := tm.setAddress(clientIP, "255.255.255.0")
+	if err != nil {
+		return fmt.Errorf("failed to set client IP address: %w", err)
+	}
+
+	return nil
+}
+
+// setAddress assigns a static address with netsh, which also adds the route
+// for its subnet
+func (tm *TunManager) setAddress(ip, mask string) error {
+	cmd := exec.Command("netsh", "interface", "ipv4", "set", "address", "name="+tm.name, "source=static", "address="+ip, "mask="+mask)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set IP address: %w: %s", err, output)
+	}
+
+	return nil
+}
+
+func (tm *TunManager) ReadPacket() ([]byte, error) {
+	if tm.device == nil {
+		return nil, fmt.Errorf("TUN interface not created")
+	}
+
+	buffer := make([]byte, tm.readBufferSize())
+	n, err := readDevice(tm.device, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer[:n], nil
+}
+
+func (tm *TunManager) WritePacket(data []byte) error {
+	if tm.device == nil {
+		return fmt.Errorf("TUN interface not created")
+	}
+
+	_, err := tm.device.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const udpHeaderSize = 8
+
+// UDPPacket is the addressing and payload of an IPv4 UDP packet
+type UDPPacket struct {
+	Src     net.IP
+	Dst     net.IP
+	SrcPort uint16
+	DstPort uint16
+	Payload []byte
+}
+
+// ParseUDP reads an IPv4 UDP packet, reporting false for anything else,
+// including fragments and packets whose lengths don't add up. The payload
+// shares packet's memory.
+func ParseUDP(packet []byte) (UDPPacket, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != protocolUDP {
+		return UDPPacket{}, false
+	}
+
+	headerLen := int(packet[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	fragment := binary.BigEndian.Uint16(packet[6:8]) & 0x3FFF // Offset and more fragments flag
+	if headerLen < 20 || totalLen > len(packet) || totalLen < headerLen+udpHeaderSize || fragment != 0 {
+		return UDPPacket{}, false
+	}
+
+	udp := packet[headerLen:totalLen]
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < udpHeaderSize || udpLen > len(udp) {
+		return UDPPacket{}, false
+	}
+
+	return UDPPacket{
+		Src:     net.IP(packet[12:16]),
+		Dst:     net.IP(packet[16:20]),
+		SrcPort: binary.BigEndian.Uint16(udp[0:2]),
+		DstPort: binary.BigEndian.Uint16(udp[2:4]),
+		Payload: udp[udpHeaderSize:udpLen],
+	}, true
+}
+
+// BuildUDP builds an IPv4 UDP packet with valid IP and UDP checksums. Src and
+// Dst must be IPv4 addresses, and the payload must fit in a single packet.
+func BuildUDP(p UDPPacket) []byte {
+	totalLen := 20 + udpHeaderSize + len(p.Payload)
+	packet := make([]byte, totalLen)
+
+	packet[0] = 0x45 // Version 4, 20-byte header
+	binary.BigEndian.PutUint16(packet[2:4], uint16(totalLen))
+	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Don't fragment
+	packet[8] = 64                                  // TTL
+	packet[9] = protocolUDP
+	copy(packet[12:16], p.Src.To4())
+	copy(packet[16:20], p.Dst.To4())
+	binary.BigEndian.PutUint16(packet[10:12], ^foldChecksum(sumWords(0, packet[:20])))
+
+	udp := packet[20:]
+	binary.BigEndian.PutUint16(udp[0:2], p.SrcPort)
+	binary.BigEndian.PutUint16(udp[2:4], p.DstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[udpHeaderSize:], p.Payload)
+
+	// The UDP checksum also covers a pseudo-header of the addresses,
+	// protocol and UDP length
+	sum := sumWords(0, packet[12:20])
+	sum += protocolUDP + uint32(len(udp))
+	sum = sumWords(sum, udp)
+	checksum := ^foldChecksum(sum)
+	if checksum == 0 {
+		// Zero means no checksum, so a computed zero is sent as all ones
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(udp[6:8], checksum)
+
+	return packet
+}
+
+// sumWords adds data to sum as big-endian 16-bit words, padding an odd byte
+// with zero
+func sumWords(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// foldChecksum folds the carries of a one's complement sum back into 16 bits
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return uint16(sum)
+}
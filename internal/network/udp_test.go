@@ -0,0 +1,77 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestBuildUDP_RoundTrip(t *testing.T) {
+	packet := BuildUDP(UDPPacket{
+		Src:     net.ParseIP("10.0.0.1"),
+		Dst:     net.ParseIP("10.0.0.2"),
+		SrcPort: 53,
+		DstPort: 40000,
+		Payload: []byte("answer"),
+	})
+
+	if sum := foldChecksum(sumWords(0, packet[:20])); sum != 0xFFFF {
+		t.Errorf("Expected a valid IP header checksum, got sum %#x", sum)
+	}
+	pseudo := sumWords(0, packet[12:20]) + protocolUDP + uint32(len(packet)-20)
+	if sum := foldChecksum(sumWords(pseudo, packet[20:])); sum != 0xFFFF {
+		t.Errorf("Expected a valid UDP checksum, got sum %#x", sum)
+	}
+
+	udp, ok := ParseUDP(packet)
+	if !ok {
+		t.Fatal("Expected the built packet to parse")
+	}
+	if !udp.Src.Equal(net.ParseIP("10.0.0.1")) || !udp.Dst.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Expected 10.0.0.1 -> 10.0.0.2, got %s -> %s", udp.Src, udp.Dst)
+	}
+	if udp.SrcPort != 53 || udp.DstPort != 40000 {
+		t.Errorf("Expected ports 53 -> 40000, got %d -> %d", udp.SrcPort, udp.DstPort)
+	}
+	if !bytes.Equal(udp.Payload, []byte("answer")) {
+		t.Errorf("Expected payload %q, got %q", "answer", udp.Payload)
+	}
+}
+
+func TestParseUDP_Rejects(t *testing.T) {
+	valid := BuildUDP(UDPPacket{
+		Src:     net.ParseIP("10.0.0.2"),
+		Dst:     net.ParseIP("10.0.0.1"),
+		SrcPort: 40000,
+		DstPort: 53,
+		Payload: []byte("query"),
+	})
+
+	tcp := bytes.Clone(valid)
+	tcp[9] = protocolTCP
+
+	fragment := bytes.Clone(valid)
+	binary.BigEndian.PutUint16(fragment[6:8], 0x2000) // More fragments
+
+	truncated := valid[:len(valid)-1]
+
+	longUDP := bytes.Clone(valid)
+	binary.BigEndian.PutUint16(longUDP[24:26], 100)
+
+	tests := map[string][]byte{
+		"empty":          nil,
+		"TCP":            tcp,
+		"fragment":       fragment,
+		"truncated":      truncated,
+		"UDP length":     longUDP,
+		"IPv6":           append([]byte{0x60}, make([]byte, 47)...),
+		"header too big": append([]byte{0x4f}, valid[1:]...),
+	}
+
+	for name, packet := range tests {
+		if _, ok := ParseUDP(packet); ok {
+			t.Errorf("Expected %s packet to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenUnixPrivate listens on a Unix socket at path that only its owner may
+// connect to. There is no umask here, so the mode is set after the listen.
+func ListenUnixPrivate(path string) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package network
+
+import (
+	"net"
+	"syscall"
+)
+
+// ListenUnixPrivate listens on a Unix socket at path that only its owner may
+// connect to. The socket is created mode 0600 under a restrictive umask, so
+// unlike a chmod after the listen it is never briefly open to other users.
+// The umask is process-wide, so files other goroutines create meanwhile are
+// private too.
+func ListenUnixPrivate(path string) (net.Listener, error) {
+	previous := syscall.Umask(0177)
+	defer syscall.Umask(previous)
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin
+
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestListenUnixPrivate tests that the socket is created owner-only even
+// under a permissive umask, which is restored afterwards
+func TestListenUnixPrivate(t *testing.T) {
+	previous := syscall.Umask(0)
+	defer syscall.Umask(previous)
+
+	path := filepath.Join(t.TempDir(), "test.sock")
+	listener, err := ListenUnixPrivate(path)
+	if err != nil {
+		t.Fatalf("ListenUnixPrivate failed: %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected the socket to exist: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected socket mode 0600, got %o", perm)
+	}
+
+	if umask := syscall.Umask(0); umask != 0 {
+		t.Errorf("Expected the umask restored to 0, got %o", umask)
+	}
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultWriteQueueSize is how many packets may wait for a slow TUN interface
+// before further packets are dropped
+const DefaultWriteQueueSize = 256
+
+// WriteQueue writes packets to a TUN interface from a goroutine of its own,
+// so a slow interface can't stall the socket reader handing it packets.
+// Packets that arrive while the queue is full are dropped and counted, the
+// way a congested link would drop them.
+type WriteQueue struct {
+	tun     TUNInterface
+	queue   chan []byte
+	queued  atomic.Uint64
+	dropped atomic.Uint64
+	mutex   sync.Mutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewWriteQueue starts a writer for tun that holds up to size packets
+func NewWriteQueue(tun TUNInterface, size int) *WriteQueue {
+	if size <= 0 {
+		size = DefaultWriteQueueSize
+	}
+
+	q := &WriteQueue{
+		tun:   tun,
+		queue: make(chan []byte, size),
+	}
+
+	q.wg.Add(1)
+	go q.run()
+
+	return q
+}
+
+func (q *WriteQueue) run() {
+	defer q.wg.Done()
+
+	// A TUN device takes one packet per write, so there is nothing to gain
+	// from handing it several at once
+	for packet := range q.queue {
+		if err := q.tun.WritePacket(packet); err != nil {
+			log.Printf("Failed to write packet to TUN interface: %v", err)
+		}
+	}
+}
+
+// Enqueue queues a packet to be written without waiting, returning false if
+// the queue was full or closed and the packet was dropped. The queue keeps
+// the slice, so the caller must not reuse it.
+func (q *WriteQueue) Enqueue(packet []byte) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.closed {
+		select {
+		case q.queue <- packet:
+			q.queued.Add(1)
+			return true
+		default:
+		}
+	}
+
+	q.dropped.Add(1)
+	return false
+}
+
+// Dropped returns how many packets Enqueue has dropped
+func (q *WriteQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+// Queued returns how many packets Enqueue has accepted
+func (q *WriteQueue) Queued() uint64 {
+	return q.queued.Load()
+}
+
+// Depth returns how many packets are waiting to be written. A queue that
+// stays near its size means the TUN interface is the bottleneck.
+func (q *WriteQueue) Depth() int {
+	return len(q.queue)
+}
+
+// ResetCounters sets the queued and dropped packet counts back to zero
+func (q *WriteQueue) ResetCounters() {
+	q.queued.Store(0)
+	q.dropped.Store(0)
+}
+
+// Close stops accepting packets and waits for queued ones to be written
+func (q *WriteQueue) Close() {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mutex.Unlock()
+
+	q.wg.Wait()
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newSlowTun returns a created CallbackTun whose writes signal entered, then
+// block until release is closed, reporting each packet on written
+func newSlowTun(t *testing.T) (tun *CallbackTun, entered chan struct{}, written chan []byte, release chan struct{}) {
+	entered = make(chan struct{}, 16)
+	written = make(chan []byte, 16)
+	release = make(chan struct{})
+	tun = NewCallbackTun(func(packet []byte) {
+		entered <- struct{}{}
+		<-release
+		written <- packet
+	})
+	if err := tun.Create("slow0"); err != nil {
+		t.Fatalf("Failed to create TUN: %v", err)
+	}
+	return tun, entered, written, release
+}
+
+func TestWriteQueue_WritesPackets(t *testing.T) {
+	tun, _, written, release := newSlowTun(t)
+	close(release)
+
+	q := NewWriteQueue(tun, 4)
+	defer q.Close()
+
+	if !q.Enqueue([]byte("hello")) {
+		t.Fatal("Expected packet to be queued")
+	}
+
+	select {
+	case packet := <-written:
+		if string(packet) != "hello" {
+			t.Errorf("Expected hello, got %q", packet)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for packet to be written")
+	}
+}
+
+func TestWriteQueue_DropsWhenFull(t *testing.T) {
+	tun, entered, _, release := newSlowTun(t)
+	q := NewWriteQueue(tun, 2)
+
+	// One packet blocks in the writer and two fill the queue; the rest must
+	// be dropped without blocking
+	q.Enqueue([]byte{0})
+	<-entered
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 10; i++ {
+			q.Enqueue([]byte{byte(i)})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue blocked on a slow TUN interface")
+	}
+
+	if dropped := q.Dropped(); dropped != 7 {
+		t.Errorf("Expected 7 dropped packets, got %d", dropped)
+	}
+	if queued, depth := q.Queued(), q.Depth(); queued != 3 || depth != 2 {
+		t.Errorf("Expected 3 packets queued and 2 waiting, got %d and %d", queued, depth)
+	}
+
+	q.ResetCounters()
+	if q.Dropped() != 0 || q.Queued() != 0 {
+		t.Errorf("Expected counters to be reset, got %d dropped and %d queued", q.Dropped(), q.Queued())
+	}
+
+	close(release)
+	q.Close()
+}
+
+func TestWriteQueue_CloseWritesQueuedPackets(t *testing.T) {
+	tun, _, written, release := newSlowTun(t)
+	q := NewWriteQueue(tun, 4)
+
+	for i := 0; i < 3; i++ {
+		if !q.Enqueue([]byte{byte(i)}) {
+			t.Fatalf("Expected packet %d to be queued", i)
+		}
+	}
+
+	close(release)
+	q.Close()
+
+	if len(written) != 3 {
+		t.Errorf("Expected 3 packets written before Close returned, got %d", len(written))
+	}
+
+	if q.Enqueue([]byte{3}) {
+		t.Error("Expected Enqueue to fail after Close")
+	}
+	if q.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", q.Dropped())
+	}
+}
+
+// rejectingTun fails to write packets starting with 0xff
+type rejectingTun struct {
+	*MockTunManager
+}
+
+func (rt rejectingTun) WritePacket(packet []byte) error {
+	if packet[0] == 0xff {
+		return errors.New("rejected")
+	}
+	return rt.MockTunManager.WritePacket(packet)
+}
+
+func TestWriteQueue_SkipsRejectedPacket(t *testing.T) {
+	tun := rejectingTun{NewMockTunManager()}
+	tun.Create("test0")
+
+	q := NewWriteQueue(tun, 4)
+	q.Enqueue([]byte{1})
+	q.Enqueue([]byte{0xff})
+	q.Enqueue([]byte{2})
+	q.Close()
+
+	written := tun.GetWriteQueue()
+	if len(written) != 2 || written[0][0] != 1 || written[1][0] != 2 {
+		t.Errorf("Expected packets 1 and 2 written around the rejected one, got %v", written)
+	}
+	if q.Dropped() != 0 {
+		t.Errorf("Expected rejected writes not to count as dropped, got %d", q.Dropped())
+	}
+}
@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Auth option types carried in auth packet payloads. Options are encoded as
+// [type][length][value] triples; peers skip options they don't understand so
+// the handshake can grow without breaking older builds.
+const (
+	AuthOptionCiphers     = 1  // Client: supported cipher IDs in order of preference
+	AuthOptionCipher      = 2  // Server: cipher ID selected for the session
+	AuthOptionClientNonce = 3  // Client: random nonce for session key derivation
+	AuthOptionServerNonce = 4  // Server: random nonce for session key derivation
+	AuthOptionCompression = 5  // Client: requested compression; server: accepted compression
+	AuthOptionRequestedIP = 6  // Client: preferred tunnel IPv4 address, 4 bytes
+	AuthOptionRoutes      = 7  // Server: networks to route through the tunnel, see EncodeRoutes
+	AuthOptionRekey       = 8  // Client: rekeys supported; server: rekeys accepted for the session
+	AuthOptionDataPort    = 9  // Server: UDP port to send data packets to, 2 bytes big-endian
+	AuthOptionIdentity    = 10 // Server: its identity public key and a signature over the handshake, see SignIdentity
+	AuthOptionProof       = 11 // Client: proof that it holds its pre-shared key, see SignAuthProof
+)
+
+// RouteSize is the encoded size of one route: an IPv4 network address and a
+// prefix length
+const RouteSize = 5
+
+// MaxRoutes is the most routes that fit in one auth option
+const MaxRoutes = 255 / RouteSize
+
+// AuthKeySize is the size of the key at the start of an auth response
+const AuthKeySize = 32
+
+// AuthOptions maps auth option types to their raw values
+type AuthOptions map[uint8][]byte
+
+// EncodeAuthOptions serializes options in ascending type order
+func EncodeAuthOptions(options AuthOptions) ([]byte, error) {
+	types := make([]int, 0, len(options))
+	for optionType := range options {
+		types = append(types, int(optionType))
+	}
+	sort.Ints(types)
+
+	var buf bytes.Buffer
+	for _, optionType := range types {
+		value := options[uint8(optionType)]
+		if len(value) > 255 {
+			return nil, errors.New("auth option value too long")
+		}
+		buf.WriteByte(uint8(optionType))
+		buf.WriteByte(uint8(len(value)))
+		buf.Write(value)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeAuthOptions parses options encoded by EncodeAuthOptions
+func DecodeAuthOptions(data []byte) (AuthOptions, error) {
+	options := make(AuthOptions)
+
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("truncated auth option header")
+		}
+
+		optionType := data[0]
+		length := int(data[1])
+		if len(data) < 2+length {
+			return nil, errors.New("truncated auth option value")
+		}
+
+		options[optionType] = data[2 : 2+length]
+		data = data[2+length:]
+	}
+
+	return options, nil
+}
+
+// EncodeAuthResponse builds an auth response payload: [32-byte key][IP string],
+// followed by a zero byte and the encoded options when there are any. Options
+// must only be sent to clients that sent options themselves, since older
+// clients treat everything after the key as the IP.
+func EncodeAuthResponse(key []byte, ip string, options AuthOptions) ([]byte, error) {
+	payload := make([]byte, AuthKeySize+len(ip))
+	copy(payload[:AuthKeySize], key)
+	copy(payload[AuthKeySize:], []byte(ip))
+
+	if len(options) > 0 {
+		encoded, err := EncodeAuthOptions(options)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, 0)
+		payload = append(payload, encoded...)
+	}
+
+	return payload, nil
+}
+
+// DecodeAuthResponse splits an auth response payload into key, IP and options
+func DecodeAuthResponse(payload []byte) ([]byte, string, AuthOptions, error) {
+	if len(payload) < AuthKeySize {
+		return nil, "", nil, errors.New("invalid auth response payload length")
+	}
+
+	key := payload[:AuthKeySize]
+	rest := payload[AuthKeySize:]
+
+	separator := bytes.IndexByte(rest, 0)
+	if separator < 0 {
+		return key, string(rest), AuthOptions{}, nil
+	}
+
+	options, err := DecodeAuthOptions(rest[separator+1:])
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return key, string(rest[:separator]), options, nil
+}
+
+// EncodeRoutes serializes IPv4 networks for AuthOptionRoutes
+func EncodeRoutes(routes []*net.IPNet) ([]byte, error) {
+	if len(routes) > MaxRoutes {
+		return nil, fmt.Errorf("too many routes: %d, limit is %d", len(routes), MaxRoutes)
+	}
+
+	data := make([]byte, 0, len(routes)*RouteSize)
+	for _, route := range routes {
+		ip := route.IP.To4()
+		ones, bits := route.Mask.Size()
+		if ip == nil || bits != 32 {
+			return nil, fmt.Errorf("route %s is not an IPv4 network", route)
+		}
+		data = append(data, ip...)
+		data = append(data, uint8(ones))
+	}
+
+	return data, nil
+}
+
+// DecodeRoutes parses routes encoded by EncodeRoutes
+func DecodeRoutes(data []byte) ([]*net.IPNet, error) {
+	if len(data)%RouteSize != 0 {
+		return nil, errors.New("invalid routes length")
+	}
+
+	routes := make([]*net.IPNet, 0, len(data)/RouteSize)
+	for ; len(data) > 0; data = data[RouteSize:] {
+		ones := int(data[4])
+		if ones > 32 {
+			return nil, fmt.Errorf("invalid route prefix length %d", ones)
+		}
+
+		mask := net.CIDRMask(ones, 32)
+		ip := net.IP(append([]byte(nil), data[:4]...)).Mask(mask)
+		routes = append(routes, &net.IPNet{IP: ip, Mask: mask})
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AuthProofSize is the length of an AuthOptionProof value: an 8-byte
+// timestamp followed by an HMAC-SHA256
+const AuthProofSize = 8 + sha256.Size
+
+// authProofContext and authResponseContext separate auth proofs and auth
+// response proofs from each other and any other use of the client key
+const (
+	authProofContext    = "fvp auth proof v1\x00"
+	authResponseContext = "fvp auth response v1\x00"
+)
+
+// SignAuthProof returns the AuthOptionProof value for an auth request from
+// clientID: the time it was made, in nanoseconds since the Unix epoch, and an
+// HMAC keyed with the client's pre-shared key over the time and the request's
+// other options as encoded without the proof. It shows the request comes from
+// a holder of the key, and the time lets the server tell a new request from a
+// replayed one.
+func SignAuthProof(key []byte, clientID uint8, at time.Time, options []byte) []byte {
+	timestamp := binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))
+	return append(timestamp, authProofMAC(key, clientID, timestamp, options)...)
+}
+
+// VerifyAuthProof checks an AuthOptionProof value made by SignAuthProof
+// against the client's key, returning the time it was made
+func VerifyAuthProof(key []byte, clientID uint8, proof, options []byte) (time.Time, error) {
+	if len(proof) != AuthProofSize {
+		return time.Time{}, fmt.Errorf("invalid auth proof length %d", len(proof))
+	}
+
+	timestamp := proof[:8]
+	if !hmac.Equal(proof[8:], authProofMAC(key, clientID, timestamp, options)) {
+		return time.Time{}, errors.New("invalid auth proof")
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(timestamp))), nil
+}
+
+// AuthResponseProof is what an auth response carries in place of the key for
+// a client that already holds it: an HMAC keyed with the key over the auth
+// options of the request it answers. It shows the server knows the key
+// without revealing it, and the request's nonce keeps it from being replayed
+// to another handshake. Its AuthKeySize bytes take the place of the key.
+func AuthResponseProof(key, request []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(authResponseContext))
+	mac.Write(request)
+	return mac.Sum(nil)
+}
+
+// authProofMAC is the HMAC of an auth proof. The client ID is included so a
+// proof can't be moved to a request for another configured client.
+func authProofMAC(key []byte, clientID uint8, timestamp, options []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(authProofContext))
+	mac.Write([]byte{clientID})
+	mac.Write(timestamp)
+	mac.Write(options)
+	return mac.Sum(nil)
+}
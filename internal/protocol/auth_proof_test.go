@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAuthProof(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	options := []byte("request options")
+	at := time.Unix(1700000000, 123456789)
+
+	proof := SignAuthProof(key, 3, at, options)
+	if len(proof) != AuthProofSize {
+		t.Fatalf("Expected a %d-byte proof, got %d", AuthProofSize, len(proof))
+	}
+
+	got, err := VerifyAuthProof(key, 3, proof, options)
+	if err != nil {
+		t.Fatalf("Expected the proof to verify, got %v", err)
+	}
+	if !got.Equal(at) {
+		t.Errorf("Expected time %v, got %v", at, got)
+	}
+
+	if _, err := VerifyAuthProof(bytes.Repeat([]byte{0x24}, 32), 3, proof, options); err == nil {
+		t.Error("Expected a proof checked with another key to be rejected")
+	}
+	if _, err := VerifyAuthProof(key, 4, proof, options); err == nil {
+		t.Error("Expected a proof for another client ID to be rejected")
+	}
+	if _, err := VerifyAuthProof(key, 3, proof, []byte("other options")); err == nil {
+		t.Error("Expected a proof over other options to be rejected")
+	}
+
+	// The time is covered by the MAC, so a replay can't be made to look newer
+	tampered := append([]byte(nil), proof...)
+	tampered[7]++
+	if _, err := VerifyAuthProof(key, 3, tampered, options); err == nil {
+		t.Error("Expected a proof with a tampered time to be rejected")
+	}
+	if _, err := VerifyAuthProof(key, 3, proof[:len(proof)-1], options); err == nil {
+		t.Error("Expected a truncated proof to be rejected")
+	}
+}
+
+func TestAuthResponseProof(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	request := []byte("request options")
+
+	proof := AuthResponseProof(key, request)
+	if len(proof) != AuthKeySize {
+		t.Fatalf("Expected a %d-byte proof, got %d", AuthKeySize, len(proof))
+	}
+	if bytes.Equal(proof, key) {
+		t.Error("Expected the proof not to be the key")
+	}
+	if bytes.Equal(proof, AuthResponseProof(key, []byte("another request"))) {
+		t.Error("Expected proofs for different requests to differ")
+	}
+	if bytes.Equal(proof, AuthResponseProof(bytes.Repeat([]byte{0x24}, 32), request)) {
+		t.Error("Expected proofs with different keys to differ")
+	}
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestAuthOptionsRoundTrip(t *testing.T) {
+	options := AuthOptions{
+		AuthOptionCipher:  {2},
+		AuthOptionCiphers: {1, 2},
+	}
+
+	encoded, err := EncodeAuthOptions(options)
+	if err != nil {
+		t.Fatalf("EncodeAuthOptions failed: %v", err)
+	}
+
+	// Options are written in ascending type order
+	expected := []byte{AuthOptionCiphers, 2, 1, 2, AuthOptionCipher, 1, 2}
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected %v, got %v", expected, encoded)
+	}
+
+	decoded, err := DecodeAuthOptions(encoded)
+	if err != nil {
+		t.Fatalf("DecodeAuthOptions failed: %v", err)
+	}
+
+	if !bytes.Equal(decoded[AuthOptionCiphers], []byte{1, 2}) {
+		t.Errorf("Expected ciphers [1 2], got %v", decoded[AuthOptionCiphers])
+	}
+	if !bytes.Equal(decoded[AuthOptionCipher], []byte{2}) {
+		t.Errorf("Expected cipher [2], got %v", decoded[AuthOptionCipher])
+	}
+}
+
+func TestDecodeAuthOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", []byte{1}},
+		{"truncated value", []byte{1, 4, 0xAA}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeAuthOptions(tt.data)
+			if err == nil {
+				t.Error("Expected error for malformed options")
+			}
+		})
+	}
+
+	// Unknown option types are kept so callers can ignore them
+	options, err := DecodeAuthOptions([]byte{200, 1, 7})
+	if err != nil {
+		t.Fatalf("DecodeAuthOptions failed: %v", err)
+	}
+	if !bytes.Equal(options[200], []byte{7}) {
+		t.Errorf("Expected unknown option to be preserved, got %v", options[200])
+	}
+}
+
+func TestAuthResponseRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i + 1)
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		payload, err := EncodeAuthResponse(key, "10.0.0.2", nil)
+		if err != nil {
+			t.Fatalf("EncodeAuthResponse failed: %v", err)
+		}
+
+		// Without options the payload keeps the original [key][IP] layout
+		if string(payload[32:]) != "10.0.0.2" {
+			t.Errorf("Expected legacy layout, got %q", payload[32:])
+		}
+
+		gotKey, ip, options, err := DecodeAuthResponse(payload)
+		if err != nil {
+			t.Fatalf("DecodeAuthResponse failed: %v", err)
+		}
+		if !bytes.Equal(gotKey, key) || ip != "10.0.0.2" || len(options) != 0 {
+			t.Errorf("Unexpected decode result: key %x, ip %s, options %v", gotKey, ip, options)
+		}
+	})
+
+	t.Run("with options", func(t *testing.T) {
+		payload, err := EncodeAuthResponse(key, "10.0.0.2", AuthOptions{AuthOptionCipher: {2}})
+		if err != nil {
+			t.Fatalf("EncodeAuthResponse failed: %v", err)
+		}
+
+		gotKey, ip, options, err := DecodeAuthResponse(payload)
+		if err != nil {
+			t.Fatalf("DecodeAuthResponse failed: %v", err)
+		}
+		if !bytes.Equal(gotKey, key) || ip != "10.0.0.2" {
+			t.Errorf("Unexpected decode result: key %x, ip %s", gotKey, ip)
+		}
+		if !bytes.Equal(options[AuthOptionCipher], []byte{2}) {
+			t.Errorf("Expected cipher option [2], got %v", options[AuthOptionCipher])
+		}
+	})
+
+	t.Run("short payload", func(t *testing.T) {
+		_, _, _, err := DecodeAuthResponse(make([]byte, 10))
+		if err == nil {
+			t.Error("Expected error for short payload")
+		}
+	})
+}
+
+func TestRoutesRoundTrip(t *testing.T) {
+	var routes []*net.IPNet
+	for _, cidr := range []string{"10.10.0.0/16", "192.168.1.0/24", "0.0.0.0/0", "172.16.5.4/32"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		routes = append(routes, network)
+	}
+
+	data, err := EncodeRoutes(routes)
+	if err != nil {
+		t.Fatalf("EncodeRoutes failed: %v", err)
+	}
+	if len(data) != len(routes)*RouteSize {
+		t.Errorf("Expected %d bytes, got %d", len(routes)*RouteSize, len(data))
+	}
+
+	decoded, err := DecodeRoutes(data)
+	if err != nil {
+		t.Fatalf("DecodeRoutes failed: %v", err)
+	}
+	if len(decoded) != len(routes) {
+		t.Fatalf("Expected %d routes, got %d", len(routes), len(decoded))
+	}
+	for i := range routes {
+		if decoded[i].String() != routes[i].String() {
+			t.Errorf("Expected route %s, got %s", routes[i], decoded[i])
+		}
+	}
+}
+
+func TestEncodeRoutes_Invalid(t *testing.T) {
+	_, ipv6, _ := net.ParseCIDR("fd00::/64")
+	if _, err := EncodeRoutes([]*net.IPNet{ipv6}); err == nil {
+		t.Error("Expected error for an IPv6 route")
+	}
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	tooMany := make([]*net.IPNet, MaxRoutes+1)
+	for i := range tooMany {
+		tooMany[i] = network
+	}
+	if _, err := EncodeRoutes(tooMany); err == nil {
+		t.Errorf("Expected error for %d routes", len(tooMany))
+	}
+}
+
+func TestDecodeRoutes_Invalid(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated":       {10, 0, 0, 0},
+		"prefix too long": {10, 0, 0, 0, 33},
+	}
+
+	for name, data := range tests {
+		if _, err := DecodeRoutes(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -35,3 +35,70 @@ func CreatePingPacket(clientID uint8, sequence uint32) *Packet {
 		Payload:  []byte{},
 	}
 }
+
+func CreatePongPacket(clientID uint8, sequence uint32) *Packet {
+	return &Packet{
+		Magic:    [3]byte{'F', 'V', 'P'},
+		Type:     PacketTypePong,
+		ClientID: clientID,
+		Sequence: sequence,
+		Length:   0,
+		Version:  ProtocolVersionByte,
+		Payload:  []byte{},
+	}
+}
+
+// CreateErrorPacket builds a packet telling a client why the server refused
+// it. Error packets use sequence 0, like auth responses.
+func CreateErrorPacket(clientID uint8, code uint8, message string) *Packet {
+	payload := EncodeError(code, message)
+	return &Packet{
+		Magic:    [3]byte{'F', 'V', 'P'},
+		Type:     PacketTypeError,
+		ClientID: clientID,
+		Sequence: 0,
+		Length:   uint16(len(payload)),
+		Version:  ProtocolVersionByte,
+		Payload:  payload,
+	}
+}
+
+// EncodeDisconnect returns the payload of a disconnect packet giving reason,
+// to be sealed like a data payload. Reasons longer than MaxErrorMessageLength
+// are truncated.
+func EncodeDisconnect(reason string) []byte {
+	if len(reason) > MaxErrorMessageLength {
+		reason = reason[:MaxErrorMessageLength]
+	}
+	return []byte(reason)
+}
+
+// CreateDisconnectPacket builds a packet telling a client the server is ending
+// its session, e.g. because it is shutting down, around a sealed
+// EncodeDisconnect payload. It takes a sequence from the sender's own, like a
+// data packet.
+func CreateDisconnectPacket(clientID uint8, sequence uint32, payload []byte) *Packet {
+	return &Packet{
+		Magic:    [3]byte{'F', 'V', 'P'},
+		Type:     PacketTypeDisconnect,
+		ClientID: clientID,
+		Sequence: sequence,
+		Length:   uint16(len(payload)),
+		Version:  ProtocolVersionByte,
+		Payload:  payload,
+	}
+}
+
+// CreateRekeyPacket builds a rekey packet around a sealed rekey payload, see
+// EncodeRekey. It takes a sequence from the sender's own, like a data packet.
+func CreateRekeyPacket(clientID uint8, sequence uint32, payload []byte) *Packet {
+	return &Packet{
+		Magic:    [3]byte{'F', 'V', 'P'},
+		Type:     PacketTypeRekey,
+		ClientID: clientID,
+		Sequence: sequence,
+		Length:   uint16(len(payload)),
+		Version:  ProtocolVersionByte,
+		Payload:  payload,
+	}
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// CompressionFlate is the compression algorithm ID negotiated in auth
+	CompressionFlate = 1
+
+	// CompressionMinSize is the smallest payload worth compressing; below it
+	// the flate framing usually costs more than it saves
+	CompressionMinSize = 128
+
+	// maxDecompressedSize bounds decompression, since no IP packet is larger
+	maxDecompressedSize = 65535
+)
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return writer
+	},
+}
+
+// CompressPayload compresses a payload with flate. It returns the payload
+// unchanged and false if it is too small or doesn't shrink, so incompressible
+// traffic such as already-encrypted streams is sent as-is.
+func CompressPayload(payload []byte) ([]byte, bool) {
+	if len(payload) < CompressionMinSize {
+		return payload, false
+	}
+
+	var buf bytes.Buffer
+	writer := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(writer)
+	writer.Reset(&buf)
+
+	_, err := writer.Write(payload)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil || buf.Len() >= len(payload) {
+		return payload, false
+	}
+
+	return buf.Bytes(), true
+}
+
+// DecompressPayload reverses CompressPayload
+func DecompressPayload(compressed []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxDecompressedSize {
+		return nil, errors.New("decompressed payload too large")
+	}
+
+	return payload, nil
+}
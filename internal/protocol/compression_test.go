@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressPayload_RoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 20)
+
+	compressed, ok := CompressPayload(payload)
+	if !ok {
+		t.Fatal("Expected compressible payload to be compressed")
+	}
+	if len(compressed) >= len(payload)/4 {
+		t.Errorf("Expected at least 4x size reduction, got %d bytes from %d", len(compressed), len(payload))
+	}
+
+	decompressed, err := DecompressPayload(compressed)
+	if err != nil {
+		t.Fatalf("DecompressPayload failed: %v", err)
+	}
+	if !bytes.Equal(decompressed, payload) {
+		t.Error("Decompressed payload doesn't match original")
+	}
+}
+
+func TestCompressPayload_SkipsSmallPayloads(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), CompressionMinSize-1)
+
+	result, ok := CompressPayload(payload)
+	if ok {
+		t.Error("Expected small payload not to be compressed")
+	}
+	if !bytes.Equal(result, payload) {
+		t.Error("Expected small payload to be returned unchanged")
+	}
+}
+
+func TestCompressPayload_SkipsIncompressible(t *testing.T) {
+	payload := make([]byte, 1400)
+	rand.Read(payload)
+
+	result, ok := CompressPayload(payload)
+	if ok {
+		t.Error("Expected random payload not to be compressed")
+	}
+	if !bytes.Equal(result, payload) {
+		t.Error("Expected random payload to be returned unchanged")
+	}
+}
+
+func TestDecompressPayload_Invalid(t *testing.T) {
+	_, err := DecompressPayload([]byte{0xff, 0xff, 0xff, 0xff})
+	if err == nil {
+		t.Error("Expected error for invalid compressed data")
+	}
+}
+
+func TestDecompressPayload_TooLarge(t *testing.T) {
+	compressed, ok := CompressPayload(make([]byte, maxDecompressedSize+1))
+	if !ok {
+		t.Fatal("Expected zeros to compress")
+	}
+
+	_, err := DecompressPayload(compressed)
+	if err == nil {
+		t.Error("Expected error for oversized payload")
+	}
+}
+
+func TestPacketFlags_RoundTrip(t *testing.T) {
+	packet := CreateDataPacket(1, 1, []byte("payload"))
+	packet.Flags = PacketFlagCompressed
+
+	data, err := EncodePacket(packet)
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+	if data[3] != PacketTypeData|PacketFlagCompressed {
+		t.Errorf("Expected type byte 0x%02x, got 0x%02x", PacketTypeData|PacketFlagCompressed, data[3])
+	}
+
+	decoded, err := DecodePacket(data)
+	if err != nil {
+		t.Fatalf("DecodePacket failed: %v", err)
+	}
+	if decoded.Type != PacketTypeData {
+		t.Errorf("Expected type %d, got %d", PacketTypeData, decoded.Type)
+	}
+	if decoded.Flags != PacketFlagCompressed {
+		t.Errorf("Expected flags 0x%02x, got 0x%02x", PacketFlagCompressed, decoded.Flags)
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	unknown := CreateDataPacket(1, 1, []byte("payload"))
+	unknown.Flags = 0x40
+	if ValidateFlags(unknown) == nil {
+		t.Error("Expected error for unknown flag")
+	}
+
+	ping := CreatePingPacket(1, 1)
+	ping.Flags = PacketFlagCompressed
+	if ValidateFlags(ping) == nil {
+		t.Error("Expected error for compressed flag on ping packet")
+	}
+}
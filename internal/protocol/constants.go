@@ -8,16 +8,47 @@ import (
 
 const (
 	MagicBytes = "FVP"
+
+	// HeaderSize is the length of the major 1 header. Use HeaderLen for a
+	// packet of any other major.
 	HeaderSize = 12
 
-	PacketTypeData = 1
-	PacketTypeAuth = 2
-	PacketTypePing = 3
-	PacketTypePong = 4
+	// ExtendedHeaderSize is the length of the header from major 2 on, which
+	// widens the client ID to 16 bits
+	ExtendedHeaderSize = 13
+
+	// MaxHeaderSize is the longest header of any major version
+	MaxHeaderSize = ExtendedHeaderSize
+
+	PacketTypeData       = 1
+	PacketTypeAuth       = 2
+	PacketTypePing       = 3
+	PacketTypePong       = 4
+	PacketTypeError      = 5 // Server: why a request was refused
+	PacketTypeDisconnect = 6 // Server: the session is ending, reconnect elsewhere
+	PacketTypeRekey      = 7 // Either side: replace the session keys, see EncodeRekey
+
+	// The type byte carries the packet type in its low bits and flags in its
+	// high bits
+	PacketTypeMask = 0x0F
+
+	// PacketFlagCompressed marks a data packet whose payload was compressed
+	// before encryption
+	PacketFlagCompressed = 0x80
+
+	// The version byte only holds minor and patch, so bits 4-5 of the type
+	// byte carry the major version minus one. Major 1 leaves them clear, as
+	// packets did before the major was carried at all.
+	PacketMajorMask  = 0x30
+	PacketMajorShift = 4
+
+	// MaxProtocolMajor is the highest major version the type byte can carry
+	MaxProtocolMajor = PacketMajorMask>>PacketMajorShift + 1
 )
 
 var (
-	// Note: Packet encoding only supports major=1, so this will always be 1
+	// ProtocolVersionMajor is set at runtime from injected app version
+	// (1-MaxProtocolMajor); peers with a different major are rejected
 	ProtocolVersionMajor = 1
 	// ProtocolVersionMinor is set at runtime from injected app version (0-31)
 	ProtocolVersionMinor = 0
@@ -27,7 +58,7 @@ var (
 	ProtocolVersionByte uint8 = 0
 )
 
-// Packet encoding limitation: major must be 1, minor 0-31, patch 0-7
+// Packet encoding limitation: major 1-MaxProtocolMajor, minor 0-31, patch 0-7
 func InitProtocolVersion(version string) error {
 	if version == "" {
 		// Default to 1.0.0 if no version provided
@@ -58,9 +89,9 @@ func InitProtocolVersion(version string) error {
 		return fmt.Errorf("invalid patch version: %w", err)
 	}
 
-	// Packet encoding only supports major=1
-	if major != 1 {
-		return fmt.Errorf("protocol version major must be 1 (got %d), protocol encoding limitation", major)
+	// Packet encoding limits: major 1-MaxProtocolMajor
+	if major < 1 || major > MaxProtocolMajor {
+		return fmt.Errorf("protocol version major must be 1-%d (got %d), protocol encoding limitation", MaxProtocolMajor, major)
 	}
 
 	// Packet encoding limits: minor 0-31, patch 0-7
@@ -81,9 +112,37 @@ func InitProtocolVersion(version string) error {
 }
 
 func encodeVersion(major, minor, patch int) uint8 {
-	// major is always 1, not encoded in the byte
+	// major is carried in the type byte, not encoded here
 	// minor: 5 bits (0-31), shifted left by 3
 	// patch: 3 bits (0-7), in lower 3 bits
 	return uint8((minor << 3) | patch)
 }
 
+
+// EncodeVersion returns the version byte carried in packet headers
+func EncodeVersion(major, minor, patch int) uint8 {
+	return encodeVersion(major, minor, patch)
+}
+
+// NegotiateVersion returns the version both peers can speak, which is the
+// lower of the two advertised version bytes. Peers with different majors are
+// rejected before negotiating, so the bytes order the same way as
+// minor.patch.
+func NegotiateVersion(local, remote uint8) uint8 {
+	if remote < local {
+		return remote
+	}
+	return local
+}
+
+// VersionAtLeast reports whether a version byte is at least major.minor.patch,
+// which is how optional features are gated on the negotiated version
+func VersionAtLeast(version uint8, major, minor, patch int) bool {
+	return version >= encodeVersion(major, minor, patch)
+}
+
+// FormatVersion renders a version byte as major.minor.patch
+func FormatVersion(version uint8) string {
+	major, minor, patch := parseVersion(version)
+	return fmt.Sprintf("%d.%d.%d", major, minor, patch)
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		local    uint8
+		remote   uint8
+		expected uint8
+	}{
+		{
+			name:     "same version",
+			local:    EncodeVersion(1, 1, 0),
+			remote:   EncodeVersion(1, 1, 0),
+			expected: EncodeVersion(1, 1, 0),
+		},
+		{
+			name:     "older remote",
+			local:    EncodeVersion(1, 2, 0),
+			remote:   EncodeVersion(1, 0, 0),
+			expected: EncodeVersion(1, 0, 0),
+		},
+		{
+			name:     "newer remote",
+			local:    EncodeVersion(1, 0, 0),
+			remote:   EncodeVersion(1, 2, 0),
+			expected: EncodeVersion(1, 0, 0),
+		},
+		{
+			name:     "patch difference",
+			local:    EncodeVersion(1, 1, 3),
+			remote:   EncodeVersion(1, 1, 1),
+			expected: EncodeVersion(1, 1, 1),
+		},
+		{
+			name:     "minor outranks patch",
+			local:    EncodeVersion(1, 0, 7),
+			remote:   EncodeVersion(1, 1, 0),
+			expected: EncodeVersion(1, 0, 7),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NegotiateVersion(tt.local, tt.remote)
+			if got != tt.expected {
+				t.Errorf("NegotiateVersion(%s, %s) = %s, want %s",
+					FormatVersion(tt.local), FormatVersion(tt.remote), FormatVersion(got), FormatVersion(tt.expected))
+			}
+		})
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	v120 := EncodeVersion(1, 2, 0)
+
+	if !VersionAtLeast(v120, 1, 2, 0) {
+		t.Error("Expected 1.2.0 to be at least 1.2.0")
+	}
+	if !VersionAtLeast(v120, 1, 0, 0) {
+		t.Error("Expected 1.2.0 to be at least 1.0.0")
+	}
+	if VersionAtLeast(EncodeVersion(1, 1, 7), 1, 2, 0) {
+		t.Error("Expected 1.1.7 to be older than 1.2.0")
+	}
+	if VersionAtLeast(EncodeVersion(1, 0, 0), 1, 2, 0) {
+		t.Error("Expected 1.0.0 to be older than 1.2.0")
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	if got := FormatVersion(EncodeVersion(1, 2, 3)); got != "1.2.3" {
+		t.Errorf("Expected 1.2.3, got %s", got)
+	}
+	if got := FormatVersion(0); got != "1.0.0" {
+		t.Errorf("Expected 1.0.0, got %s", got)
+	}
+}
+
+func TestInitProtocolVersion_Major(t *testing.T) {
+	defer InitProtocolVersion("1.0.0")
+
+	err := InitProtocolVersion("2.1.0")
+	if err != nil {
+		t.Fatalf("InitProtocolVersion failed: %v", err)
+	}
+	if ProtocolVersionMajor != 2 {
+		t.Errorf("Expected major 2, got %d", ProtocolVersionMajor)
+	}
+
+	// A major 2 build rejects major 1 peers
+	data, err := EncodePacket(&Packet{Magic: [3]byte{'F', 'V', 'P'}, Type: PacketTypePing, Major: 1, Payload: []byte{}})
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+	_, err = DecodePacket(data)
+	if err == nil {
+		t.Error("Expected a major 1 packet to be rejected by a major 2 build")
+	}
+
+	for _, version := range []string{"0.1.0", "5.0.0"} {
+		err = InitProtocolVersion(version)
+		if err == nil {
+			t.Errorf("Expected version %s to be rejected", version)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import "errors"
+
+// Error codes carried in error packets, telling a client why the server
+// refused it
+const (
+	ErrorCodeUnknownClient      = 1 // Auth named a client ID the server has no key for
+	ErrorCodeServerFull         = 2 // No client IDs or tunnel addresses left
+	ErrorCodeAlreadyConnected   = 3 // A client with the same key is already connected
+	ErrorCodeAuthFailed         = 4 // The handshake could not be completed
+	ErrorCodeEncryptionMismatch = 5 // Only one side has encryption disabled
+)
+
+// MaxErrorMessageLength caps the message in an error packet, which keeps
+// replies to unauthenticated requests small
+const MaxErrorMessageLength = 128
+
+// EncodeError builds an error packet payload: [code][message]. Messages
+// longer than MaxErrorMessageLength are truncated.
+func EncodeError(code uint8, message string) []byte {
+	if len(message) > MaxErrorMessageLength {
+		message = message[:MaxErrorMessageLength]
+	}
+
+	payload := make([]byte, 1+len(message))
+	payload[0] = code
+	copy(payload[1:], message)
+	return payload
+}
+
+// DecodeError splits an error packet payload into its code and message
+func DecodeError(payload []byte) (uint8, string, error) {
+	if len(payload) < 1 {
+		return 0, "", errors.New("invalid error payload length")
+	}
+
+	return payload[0], string(payload[1:]), nil
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorPacketRoundTrip(t *testing.T) {
+	packet := CreateErrorPacket(7, ErrorCodeUnknownClient, "client ID 7 is not configured")
+
+	data, err := EncodePacket(packet)
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+
+	decoded, err := DecodePacket(data)
+	if err != nil {
+		t.Fatalf("DecodePacket failed: %v", err)
+	}
+	if decoded.Type != PacketTypeError {
+		t.Errorf("Expected type %d, got %d", PacketTypeError, decoded.Type)
+	}
+	if decoded.ClientID != 7 {
+		t.Errorf("Expected client ID 7, got %d", decoded.ClientID)
+	}
+
+	code, message, err := DecodeError(decoded.Payload)
+	if err != nil {
+		t.Fatalf("DecodeError failed: %v", err)
+	}
+	if code != ErrorCodeUnknownClient {
+		t.Errorf("Expected code %d, got %d", ErrorCodeUnknownClient, code)
+	}
+	if message != "client ID 7 is not configured" {
+		t.Errorf("Expected message 'client ID 7 is not configured', got '%s'", message)
+	}
+}
+
+func TestEncodeError_TruncatesMessage(t *testing.T) {
+	payload := EncodeError(ErrorCodeAuthFailed, strings.Repeat("x", MaxErrorMessageLength+50))
+
+	_, message, err := DecodeError(payload)
+	if err != nil {
+		t.Fatalf("DecodeError failed: %v", err)
+	}
+	if len(message) != MaxErrorMessageLength {
+		t.Errorf("Expected message truncated to %d bytes, got %d", MaxErrorMessageLength, len(message))
+	}
+}
+
+func TestDecodeError_Empty(t *testing.T) {
+	_, _, err := DecodeError(nil)
+	if err == nil {
+		t.Error("Expected error for empty payload")
+	}
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// IdentityKeySize is the size of both halves of a server identity: the
+// Ed25519 seed the server keeps as its private key, and the public key
+// clients pin
+const IdentityKeySize = 32
+
+// identityContext separates identity signatures from any other use of the
+// key
+const identityContext = "fvp server identity v1\x00"
+
+// SignIdentity returns the AuthOptionIdentity value for an auth response:
+// the server's public key followed by its signature over the client's auth
+// request options and the response payload, as encoded without the option.
+// The request carries the client's nonce, so a signature can't be replayed
+// to another handshake.
+func SignIdentity(identityKey ed25519.PrivateKey, request, response []byte) []byte {
+	signature := ed25519.Sign(identityKey, identityMessage(request, response))
+
+	value := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize)
+	value = append(value, identityKey.Public().(ed25519.PublicKey)...)
+	return append(value, signature...)
+}
+
+// VerifyIdentity checks an AuthOptionIdentity value made by SignIdentity
+// against the server public key the client pinned
+func VerifyIdentity(pinned ed25519.PublicKey, identity, request, response []byte) error {
+	if len(identity) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return fmt.Errorf("invalid identity option length %d", len(identity))
+	}
+
+	publicKey := identity[:ed25519.PublicKeySize]
+	if !bytes.Equal(publicKey, pinned) {
+		return fmt.Errorf("server presented key %x", publicKey)
+	}
+
+	if !ed25519.Verify(pinned, identityMessage(request, response), identity[ed25519.PublicKeySize:]) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// identityMessage is what an identity signature covers. The request's
+// length is included so the two parts can't be shifted into each other.
+func identityMessage(request, response []byte) []byte {
+	message := make([]byte, 0, len(identityContext)+2+len(request)+len(response))
+	message = append(message, identityContext...)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(request)))
+	message = append(message, request...)
+	return append(message, response...)
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	identityKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x42}, IdentityKeySize))
+	publicKey := identityKey.Public().(ed25519.PublicKey)
+	request := []byte("request options")
+	response := []byte("response payload")
+
+	identity := SignIdentity(identityKey, request, response)
+	err := VerifyIdentity(publicKey, identity, request, response)
+	if err != nil {
+		t.Fatalf("Expected the identity to verify, got %v", err)
+	}
+
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x24}, IdentityKeySize))
+	if err := VerifyIdentity(other.Public().(ed25519.PublicKey), identity, request, response); err == nil {
+		t.Error("Expected a different pinned key to be rejected")
+	}
+
+	// An impostor can present the pinned key, but can't sign with it
+	forged := SignIdentity(other, request, response)
+	copy(forged, publicKey)
+	if err := VerifyIdentity(publicKey, forged, request, response); err == nil {
+		t.Error("Expected a signature by another key to be rejected")
+	}
+
+	// A signature is bound to the request it answers and the response
+	if err := VerifyIdentity(publicKey, identity, []byte("another request"), response); err == nil {
+		t.Error("Expected a signature over another request to be rejected")
+	}
+	if err := VerifyIdentity(publicKey, identity, request, []byte("tampered payload")); err == nil {
+		t.Error("Expected a signature over another response to be rejected")
+	}
+	if err := VerifyIdentity(publicKey, identity[:len(identity)-1], request, response); err == nil {
+		t.Error("Expected a truncated identity to be rejected")
+	}
+}
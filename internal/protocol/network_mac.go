@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// NetworkMACSize is the length of the tag appended to every datagram when a
+// network key is configured
+const NetworkMACSize = 8
+
+// ErrBadNetworkMAC is returned by OpenNetworkMAC for a datagram whose tag is
+// missing or wasn't made with the network key
+var ErrBadNetworkMAC = errors.New("invalid network MAC")
+
+// SealNetworkMAC appends a keyed hash of the packet header to an encoded
+// packet, so peers sharing networkKey can throw out packets from other
+// networks before looking up a client or decrypting anything. The payload
+// isn't covered; it is authenticated by the session cipher. A nil key
+// returns data unchanged.
+func SealNetworkMAC(data, networkKey []byte) []byte {
+	if networkKey == nil {
+		return data
+	}
+
+	return append(data, networkMAC(data, networkKey)...)
+}
+
+// OpenNetworkMAC checks and strips the tag added by SealNetworkMAC,
+// returning ErrBadNetworkMAC if it doesn't match. A nil key returns data
+// unchanged.
+func OpenNetworkMAC(data, networkKey []byte) ([]byte, error) {
+	if networkKey == nil {
+		return data, nil
+	}
+
+	if len(data) < typeByteLen+NetworkMACSize {
+		return nil, fmt.Errorf("%w: %d bytes is too short to carry one", ErrBadNetworkMAC, len(data))
+	}
+
+	packet := data[:len(data)-NetworkMACSize]
+	if !hmac.Equal(data[len(packet):], networkMAC(packet, networkKey)) {
+		return nil, ErrBadNetworkMAC
+	}
+
+	return packet, nil
+}
+
+// networkMAC returns the truncated HMAC-SHA256 of the header of an encoded
+// packet, or of all of it if it is shorter than a header
+func networkMAC(packet, networkKey []byte) []byte {
+	header := packet
+	if len(packet) >= typeByteLen {
+		major := (packet[3]&PacketMajorMask)>>PacketMajorShift + 1
+		if headerLen := HeaderLen(int(major)); len(packet) > headerLen {
+			header = packet[:headerLen]
+		}
+	}
+
+	mac := hmac.New(sha256.New, networkKey)
+	mac.Write(header)
+	return mac.Sum(nil)[:NetworkMACSize]
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestNetworkMAC(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 32)
+	data, err := EncodePacket(CreateDataPacket(3, 42, []byte("payload")))
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+
+	sealed := SealNetworkMAC(append([]byte(nil), data...), key)
+	if len(sealed) != len(data)+NetworkMACSize {
+		t.Fatalf("Expected %d bytes after sealing, got %d", len(data)+NetworkMACSize, len(sealed))
+	}
+
+	opened, err := OpenNetworkMAC(sealed, key)
+	if err != nil {
+		t.Fatalf("OpenNetworkMAC failed: %v", err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Errorf("Expected the original packet back, got %x", opened)
+	}
+
+	tampered := func(i int) []byte {
+		b := append([]byte(nil), sealed...)
+		b[i] ^= 0x01
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{"wrong key", sealed, bytes.Repeat([]byte{0x22}, 32)},
+		{"no tag", data, key},
+		{"tampered client ID", tampered(4), key},
+		{"tampered sequence", tampered(5), key},
+		{"tampered tag", tampered(len(sealed) - 1), key},
+		{"too short", []byte("FVP"), key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := OpenNetworkMAC(tt.data, tt.key)
+			if !errors.Is(err, ErrBadNetworkMAC) {
+				t.Errorf("Expected ErrBadNetworkMAC, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNetworkMAC_NoKey(t *testing.T) {
+	data := []byte("FVP anything")
+
+	if sealed := SealNetworkMAC(data, nil); !bytes.Equal(sealed, data) {
+		t.Errorf("Expected data unchanged without a key, got %q", sealed)
+	}
+
+	opened, err := OpenNetworkMAC(data, nil)
+	if err != nil || !bytes.Equal(opened, data) {
+		t.Errorf("Expected data unchanged without a key, got %q, %v", opened, err)
+	}
+}
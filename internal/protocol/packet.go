@@ -3,9 +3,11 @@ package protocol
 type Packet struct {
 	Magic [3]byte // "FVP"
 	Type  uint8   // 1-4
+	Flags uint8   // PacketFlag bits, sharing the type byte on the wire
 	ClientID uint8 // 0-255
 	Sequence uint32 // Sequence number
 	Length uint16 // Payload length
-	Version uint8 // Protocol version
+	Version uint8 // Protocol minor and patch version
+	Major uint8 // Protocol major version, carried in the type byte; 0 means ProtocolVersionMajor
 	Payload []byte
 }
@@ -3,30 +3,134 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 )
 
+// MaxPayloadSize is the largest payload the 16-bit length field can describe
+const MaxPayloadSize = 65535
+
+// Errors returned, wrapped with details, when a packet fails to parse or
+// validate. Match them with errors.Is.
+var (
+	// ErrPayloadTooLarge is returned when a packet carries more payload than
+	// the decoder allows
+	ErrPayloadTooLarge    = errors.New("payload too large")
+	ErrPacketTooShort     = errors.New("packet too short")
+	ErrBadMagic           = errors.New("invalid magic")
+	ErrBadType            = errors.New("invalid packet type")
+	ErrBadFlags           = errors.New("invalid packet flags")
+	ErrLengthMismatch     = errors.New("length mismatch")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrBadClientID        = errors.New("invalid client ID")
+)
+
+// typeByteLen is how much of the header has to be read to learn its length:
+// the magic and the type byte, which carries the major version
+const typeByteLen = 4
+
+// HeaderLen returns the header length of a packet with the given major
+// version. Major 1 uses the original 12-byte header; later majors widen the
+// client ID to 16 bits, moving every field after it along by one byte.
+func HeaderLen(major int) int {
+	if major <= 1 {
+		return HeaderSize
+	}
+	return ExtendedHeaderSize
+}
+
+// ParsePacket splits a packet into its fields, laying out the header
+// according to the major version in the type byte, so packets of old and new
+// formats can be told apart during a migration. The payload is exactly the
+// number of bytes the length field gives; a datagram that is shorter, or has
+// bytes left over after it, fails with ErrLengthMismatch.
 func ParsePacket(data []byte) (*Packet, error) {
-	if len(data) < HeaderSize {
-		return nil, errors.New("packet too short")
+	packet, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := trimPayload(packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// parseHeader splits a packet into its fields, leaving everything after the
+// header in Payload whatever the length field says
+func parseHeader(data []byte) (*Packet, error) {
+	if len(data) < typeByteLen {
+		return nil, fmt.Errorf("%w: %d bytes, header is %d", ErrPacketTooShort, len(data), HeaderSize)
+	}
+
+	major := (data[3]&PacketMajorMask)>>PacketMajorShift + 1
+	headerLen := HeaderLen(int(major))
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("%w: %d bytes, header is %d", ErrPacketTooShort, len(data), headerLen)
+	}
+
+	// Fields after the client ID are shifted by the width it gained
+	clientID := uint16(data[4])
+	shift := headerLen - HeaderSize
+	if shift > 0 {
+		clientID = binary.LittleEndian.Uint16(data[4:6])
+	}
+	if clientID > 0xFF {
+		// Packet.ClientID is still 8 bits wide, as are the server's IDs
+		return nil, fmt.Errorf("%w: %d is out of range", ErrBadClientID, clientID)
 	}
 
 	return &Packet{
 		Magic:    [3]byte{data[0], data[1], data[2]},
-		Type:     data[3],
-		ClientID: data[4],
-		Sequence: binary.LittleEndian.Uint32(data[5:9]),
-		Length:   binary.LittleEndian.Uint16(data[9:11]),
-		Version:  data[11],
-		Payload:  data[HeaderSize:],
+		Type:     data[3] & PacketTypeMask,
+		Flags:    data[3] &^ (PacketTypeMask | PacketMajorMask),
+		Major:    major,
+		ClientID: uint8(clientID),
+		Sequence: binary.LittleEndian.Uint32(data[5+shift : 9+shift]),
+		Length:   binary.LittleEndian.Uint16(data[9+shift : 11+shift]),
+		Version:  data[11+shift],
+		Payload:  data[headerLen:],
 	}, nil
 }
 
+// trimPayload cuts a packet's payload down to the length field, failing if
+// the datagram is shorter than that or carries trailing bytes
+func trimPayload(packet *Packet) error {
+	length := int(packet.Length)
+	if len(packet.Payload) < length {
+		return fmt.Errorf("%w: header says %d bytes of payload, datagram has %d",
+			ErrLengthMismatch, length, len(packet.Payload))
+	}
+	if len(packet.Payload) > length {
+		return fmt.Errorf("%w: %d trailing bytes after the %d-byte payload",
+			ErrLengthMismatch, len(packet.Payload)-length, length)
+	}
+	packet.Payload = packet.Payload[:length]
+	return nil
+}
+
+// DecodePacket parses and validates a packet whose payload may be up to
+// MaxPayloadSize bytes
 func DecodePacket(data []byte) (*Packet, error) {
-	packet, err := ParsePacket(data)
+	return DecodePacketLimit(data, MaxPayloadSize)
+}
+
+// DecodePacketLimit parses and validates a packet, rejecting it with
+// ErrPayloadTooLarge if its payload exceeds maxPayload bytes. The check runs
+// before the length field is trusted, so a crafted length can't hide extra
+// bytes.
+func DecodePacketLimit(data []byte, maxPayload int) (*Packet, error) {
+	packet, err := parseHeader(data)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(packet.Payload) > maxPayload {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrPayloadTooLarge, len(packet.Payload), maxPayload)
+	}
+
+	if err := trimPayload(packet); err != nil {
+		return nil, err
+	}
+
 	if err := ValidatePacket(packet); err != nil {
 		return nil, err
 	}
@@ -35,15 +139,26 @@ func DecodePacket(data []byte) (*Packet, error) {
 }
 
 func EncodePacket(packet *Packet) ([]byte, error) {
-	data := make([]byte, HeaderSize+len(packet.Payload))
+	major := packetMajor(packet)
+	if major < 1 || major > MaxProtocolMajor {
+		return nil, fmt.Errorf("invalid major version %d: must be 1-%d", major, MaxProtocolMajor)
+	}
+
+	headerLen := HeaderLen(major)
+	shift := headerLen - HeaderSize
+	data := make([]byte, headerLen+len(packet.Payload))
 
 	copy(data[0:3], packet.Magic[:])
-	data[3] = packet.Type
-	data[4] = packet.ClientID
-	binary.LittleEndian.PutUint32(data[5:9], packet.Sequence)
-	binary.LittleEndian.PutUint16(data[9:11], packet.Length)
-	data[11] = packet.Version
-	copy(data[HeaderSize:], packet.Payload)
+	data[3] = packet.Type | packet.Flags | uint8(major-1)<<PacketMajorShift
+	if shift > 0 {
+		binary.LittleEndian.PutUint16(data[4:6], uint16(packet.ClientID))
+	} else {
+		data[4] = packet.ClientID
+	}
+	binary.LittleEndian.PutUint32(data[5+shift:9+shift], packet.Sequence)
+	binary.LittleEndian.PutUint16(data[9+shift:11+shift], packet.Length)
+	data[11+shift] = packet.Version
+	copy(data[headerLen:], packet.Payload)
 
 	return data, nil
 }
@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -9,6 +11,7 @@ func TestParsePacket(t *testing.T) {
 		name        string
 		data        []byte
 		expectError bool
+		wantErr     error
 		expected    *Packet
 	}{
 		{
@@ -57,18 +60,21 @@ func TestParsePacket(t *testing.T) {
 			name:        "packet too short",
 			data:        []byte{'F', 'V', 'P', PacketTypeData},
 			expectError: true,
+			wantErr:     ErrPacketTooShort,
 			expected:    nil,
 		},
 		{
 			name:        "empty data",
 			data:        []byte{},
 			expectError: true,
+			wantErr:     ErrPacketTooShort,
 			expected:    nil,
 		},
 		{
 			name:        "nil data",
 			data:        nil,
 			expectError: true,
+			wantErr:     ErrPacketTooShort,
 			expected:    nil,
 		},
 	}
@@ -80,6 +86,8 @@ func TestParsePacket(t *testing.T) {
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 				return
 			}
@@ -131,6 +139,7 @@ func TestDecodePacket(t *testing.T) {
 		name        string
 		data        []byte
 		expectError bool
+		wantErr     error
 	}{
 		{
 			name:        "valid packet",
@@ -141,21 +150,25 @@ func TestDecodePacket(t *testing.T) {
 			name:        "invalid magic",
 			data:        []byte{'X', 'Y', 'Z', PacketTypeData, 1, 0, 0, 0, 0, 5, 0, 1, 'h', 'e', 'l', 'l', 'o'},
 			expectError: true,
+			wantErr:     ErrBadMagic,
 		},
 		{
 			name:        "invalid packet type",
-			data:        []byte{'F', 'V', 'P', 99, 1, 0, 0, 0, 0, 5, 0, 1, 'h', 'e', 'l', 'l', 'o'},
+			data:        []byte{'F', 'V', 'P', PacketTypeRekey + 1, 1, 0, 0, 0, 0, 5, 0, 1, 'h', 'e', 'l', 'l', 'o'},
 			expectError: true,
+			wantErr:     ErrBadType,
 		},
 		{
 			name:        "length mismatch",
 			data:        []byte{'F', 'V', 'P', PacketTypeData, 1, 0, 0, 0, 0, 10, 0, 1, 'h', 'e', 'l', 'l', 'o'},
 			expectError: true,
+			wantErr:     ErrLengthMismatch,
 		},
 		{
 			name:        "packet too short",
 			data:        []byte{'F', 'V', 'P'},
 			expectError: true,
+			wantErr:     ErrPacketTooShort,
 		},
 	}
 
@@ -166,6 +179,8 @@ func TestDecodePacket(t *testing.T) {
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 				return
 			}
@@ -348,4 +363,208 @@ func TestParsePacketEdgeCases(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+// TestDecodePacketLimit tests the payload limit at the boundary and just over it
+func TestDecodePacketLimit(t *testing.T) {
+	const limit = 1516
+
+	encode := func(size int) []byte {
+		packet := CreateDataPacket(1, 1, make([]byte, size))
+		data, _ := EncodePacket(packet)
+		return data
+	}
+
+	packet, err := DecodePacketLimit(encode(limit), limit)
+	if err != nil {
+		t.Fatalf("Expected %d-byte payload to decode, got %v", limit, err)
+	}
+	if len(packet.Payload) != limit {
+		t.Errorf("Expected %d-byte payload, got %d", limit, len(packet.Payload))
+	}
+
+	_, err = DecodePacketLimit(encode(limit+1), limit)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge for %d-byte payload, got %v", limit+1, err)
+	}
+}
+
+// TestParsePacket_LengthField tests that the payload is cut to the length
+// field and that datagrams that don't match it are rejected
+func TestParsePacket_LengthField(t *testing.T) {
+	header := []byte{'F', 'V', 'P', PacketTypeData, 1, 0, 0, 0, 0, 5, 0, 1}
+
+	packet, err := ParsePacket(append(header, 'h', 'e', 'l', 'l', 'o'))
+	if err != nil {
+		t.Fatalf("ParsePacket failed: %v", err)
+	}
+	if string(packet.Payload) != "hello" {
+		t.Errorf("Expected payload %q, got %q", "hello", packet.Payload)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"trailing garbage", []byte{'h', 'e', 'l', 'l', 'o', 0xde, 0xad}},
+		{"short datagram", []byte{'h', 'e', 'l'}},
+		{"no payload", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append(append([]byte{}, header...), tt.payload...)
+			_, err := ParsePacket(data)
+			if !errors.Is(err, ErrLengthMismatch) {
+				t.Errorf("Expected ErrLengthMismatch, got %v", err)
+			}
+
+			_, err = DecodePacket(data)
+			if !errors.Is(err, ErrLengthMismatch) {
+				t.Errorf("Expected ErrLengthMismatch from DecodePacket, got %v", err)
+			}
+		})
+	}
+}
+
+// TestDecodePacket_LengthWraparound tests that a payload too long for the
+// length field is rejected rather than matched against a wrapped length
+func TestDecodePacket_LengthWraparound(t *testing.T) {
+	packet := CreateDataPacket(1, 1, make([]byte, MaxPayloadSize+5))
+	packet.Length = 4 // (MaxPayloadSize + 5) truncated to 16 bits
+	data, _ := EncodePacket(packet)
+
+	_, err := DecodePacket(data)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestHeaderLen(t *testing.T) {
+	tests := []struct {
+		major    int
+		expected int
+	}{
+		{1, HeaderSize},
+		{2, ExtendedHeaderSize},
+		{MaxProtocolMajor, ExtendedHeaderSize},
+	}
+
+	for _, tt := range tests {
+		if got := HeaderLen(tt.major); got != tt.expected {
+			t.Errorf("Expected header length %d for major %d, got %d", tt.expected, tt.major, got)
+		}
+	}
+}
+
+// TestParsePacket_HeaderFormats tests that the header layout follows the
+// major version in the type byte, so legacy and new packets decode side by
+// side
+func TestParsePacket_HeaderFormats(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		major uint8
+	}{
+		{
+			name:  "legacy 12-byte header",
+			data:  []byte{'F', 'V', 'P', PacketTypeData, 7, 0x12, 0x34, 0x56, 0x78, 2, 0, 0x09, 'h', 'i'},
+			major: 1,
+		},
+		{
+			name:  "extended 13-byte header",
+			data:  []byte{'F', 'V', 'P', PacketTypeData | 1<<PacketMajorShift, 7, 0, 0x12, 0x34, 0x56, 0x78, 2, 0, 0x09, 'h', 'i'},
+			major: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, err := ParsePacket(tt.data)
+			if err != nil {
+				t.Fatalf("ParsePacket failed: %v", err)
+			}
+
+			if packet.Major != tt.major {
+				t.Errorf("Expected major %d, got %d", tt.major, packet.Major)
+			}
+			if packet.ClientID != 7 || packet.Sequence != 0x78563412 || packet.Length != 2 || packet.Version != 0x09 {
+				t.Errorf("Expected client 7, sequence 0x78563412, length 2, version 0x09, got %d, 0x%x, %d, 0x%02x",
+					packet.ClientID, packet.Sequence, packet.Length, packet.Version)
+			}
+			if string(packet.Payload) != "hi" {
+				t.Errorf("Expected payload %q, got %q", "hi", packet.Payload)
+			}
+
+			encoded, err := EncodePacket(packet)
+			if err != nil {
+				t.Fatalf("EncodePacket failed: %v", err)
+			}
+			if string(encoded) != string(tt.data) {
+				t.Errorf("Expected re-encoding to give % x, got % x", tt.data, encoded)
+			}
+		})
+	}
+
+	// A major 2 header cut short by the byte it gained
+	_, err := ParsePacket(tests[1].data[:HeaderSize])
+	if !errors.Is(err, ErrPacketTooShort) {
+		t.Errorf("Expected ErrPacketTooShort for a truncated extended header, got %v", err)
+	}
+
+	// Client IDs above 255 don't fit in Packet yet
+	wide := append([]byte(nil), tests[1].data...)
+	wide[5] = 1
+	_, err = ParsePacket(wide)
+	if !errors.Is(err, ErrBadClientID) {
+		t.Errorf("Expected ErrBadClientID for client ID 263, got %v", err)
+	}
+}
+
+// FuzzDecodePacket feeds arbitrary datagrams to the decoder, which must never
+// panic, and checks that every packet it accepts encodes back to the same
+// bytes and decodes again to the same packet
+func FuzzDecodePacket(f *testing.F) {
+	seeds := []*Packet{
+		CreateDataPacket(1, 7, []byte("hello")),
+		CreateAuthPacket(0, 1, nil),
+		CreatePingPacket(3, 9),
+		CreateRekeyPacket(4, 2, []byte{1, 2, 3}),
+		{Magic: [3]byte{'F', 'V', 'P'}, Type: PacketTypeData, Major: 2, ClientID: 5, Version: ProtocolVersionByte},
+	}
+	for _, packet := range seeds {
+		packet.Length = uint16(len(packet.Payload))
+		data, err := EncodePacket(packet)
+		if err != nil {
+			f.Fatalf("Failed to encode seed: %v", err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{'F', 'V', 'P'})
+	f.Add([]byte{'F', 'V', 'P', PacketTypeData, 1, 0, 0, 0, 0, 5, 0, 1, 'h', 'i'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := DecodePacket(data)
+		if err != nil {
+			return
+		}
+
+		encoded, err := EncodePacket(packet)
+		if err != nil {
+			t.Fatalf("Failed to encode a decoded packet: %v", err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("Expected the decoded packet to encode to\n%x\ngot\n%x", data, encoded)
+		}
+
+		again, err := DecodePacket(encoded)
+		if err != nil {
+			t.Fatalf("Failed to decode a re-encoded packet: %v", err)
+		}
+		if again.Type != packet.Type || again.Flags != packet.Flags || again.Major != packet.Major ||
+			again.ClientID != packet.ClientID || again.Sequence != packet.Sequence ||
+			again.Version != packet.Version || !bytes.Equal(again.Payload, packet.Payload) {
+			t.Fatalf("Expected %+v after a round trip, got %+v", packet, again)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// PingRTTSize is the size of the RTT a client reports in a ping payload
+const PingRTTSize = 4
+
+// EncodePingRTT builds a ping payload reporting the client's smoothed RTT in
+// microseconds. An unknown RTT is sent as an empty payload, which is also
+// what clients that don't measure RTT send.
+func EncodePingRTT(rtt time.Duration) []byte {
+	if rtt <= 0 {
+		return []byte{}
+	}
+
+	micros := rtt.Microseconds()
+	if micros > math.MaxUint32 {
+		micros = math.MaxUint32
+	}
+
+	payload := make([]byte, PingRTTSize)
+	binary.BigEndian.PutUint32(payload, uint32(micros))
+	return payload
+}
+
+// DecodePingRTT returns the RTT reported in a ping payload, or false if the
+// ping doesn't carry one
+func DecodePingRTT(payload []byte) (time.Duration, bool) {
+	if len(payload) < PingRTTSize {
+		return 0, false
+	}
+
+	micros := binary.BigEndian.Uint32(payload)
+	return time.Duration(micros) * time.Microsecond, true
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingRTTRoundTrip(t *testing.T) {
+	payload := EncodePingRTT(42500 * time.Microsecond)
+	if len(payload) != PingRTTSize {
+		t.Fatalf("Expected %d-byte payload, got %d", PingRTTSize, len(payload))
+	}
+
+	rtt, ok := DecodePingRTT(payload)
+	if !ok || rtt != 42500*time.Microsecond {
+		t.Errorf("Expected 42.5ms, got %s (ok=%t)", rtt, ok)
+	}
+}
+
+func TestPingRTT_Unknown(t *testing.T) {
+	// Clients without a measurement, and older clients, send no payload
+	payload := EncodePingRTT(0)
+	if len(payload) != 0 {
+		t.Errorf("Expected empty payload for unknown RTT, got %d bytes", len(payload))
+	}
+
+	if _, ok := DecodePingRTT(payload); ok {
+		t.Error("Expected no RTT from an empty payload")
+	}
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import "fmt"
+
+// Rekey phases, the first byte of a decrypted rekey payload
+const (
+	RekeyRequest  = 1 // Starts a rekey with the sender's fresh nonce
+	RekeyResponse = 2 // Answers with the responder's nonce and echoes the request's
+	RekeyConfirm  = 3 // The requester switched to the new keys; sealed with them
+)
+
+// RekeyNonceSize is the size of the nonce each side contributes to a rekey
+const RekeyNonceSize = 32
+
+// Rekey is the payload of a rekey packet, which is sealed with the sender's
+// current session key like a data payload
+type Rekey struct {
+	Phase     uint8
+	Nonce     []byte // Sender's fresh nonce; empty in a confirm
+	PeerNonce []byte // The request's nonce, echoed in a response so a stale one is recognized
+}
+
+// EncodeRekey builds a rekey payload: [phase][nonce][peer nonce], with only
+// the nonces the phase carries
+func EncodeRekey(rekey Rekey) []byte {
+	payload := make([]byte, 0, 1+2*RekeyNonceSize)
+	payload = append(payload, rekey.Phase)
+	payload = append(payload, rekey.Nonce...)
+	payload = append(payload, rekey.PeerNonce...)
+	return payload
+}
+
+// DecodeRekey parses a rekey payload, checking it is the length its phase
+// calls for
+func DecodeRekey(payload []byte) (Rekey, error) {
+	if len(payload) < 1 {
+		return Rekey{}, fmt.Errorf("invalid rekey payload: empty")
+	}
+
+	rekey := Rekey{Phase: payload[0]}
+	var nonces int
+	switch rekey.Phase {
+	case RekeyRequest:
+		nonces = 1
+	case RekeyResponse:
+		nonces = 2
+	case RekeyConfirm:
+		nonces = 0
+	default:
+		return Rekey{}, fmt.Errorf("invalid rekey phase %d", rekey.Phase)
+	}
+
+	if len(payload) != 1+nonces*RekeyNonceSize {
+		return Rekey{}, fmt.Errorf("invalid rekey payload length %d for phase %d", len(payload), rekey.Phase)
+	}
+	if nonces > 0 {
+		rekey.Nonce = payload[1 : 1+RekeyNonceSize]
+	}
+	if nonces > 1 {
+		rekey.PeerNonce = payload[1+RekeyNonceSize:]
+	}
+
+	return rekey, nil
+}
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRekeyRoundTrip(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0x11}, RekeyNonceSize)
+	peerNonce := bytes.Repeat([]byte{0x22}, RekeyNonceSize)
+
+	tests := []struct {
+		name  string
+		rekey Rekey
+	}{
+		{"request", Rekey{Phase: RekeyRequest, Nonce: nonce}},
+		{"response", Rekey{Phase: RekeyResponse, Nonce: nonce, PeerNonce: peerNonce}},
+		{"confirm", Rekey{Phase: RekeyConfirm}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := DecodeRekey(EncodeRekey(tt.rekey))
+			if err != nil {
+				t.Fatalf("DecodeRekey failed: %v", err)
+			}
+			if decoded.Phase != tt.rekey.Phase {
+				t.Errorf("Expected phase %d, got %d", tt.rekey.Phase, decoded.Phase)
+			}
+			if !bytes.Equal(decoded.Nonce, tt.rekey.Nonce) {
+				t.Errorf("Expected nonce %x, got %x", tt.rekey.Nonce, decoded.Nonce)
+			}
+			if !bytes.Equal(decoded.PeerNonce, tt.rekey.PeerNonce) {
+				t.Errorf("Expected peer nonce %x, got %x", tt.rekey.PeerNonce, decoded.PeerNonce)
+			}
+		})
+	}
+}
+
+func TestDecodeRekey_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"unknown phase", []byte{9}},
+		{"request without nonce", []byte{RekeyRequest}},
+		{"response with one nonce", append([]byte{RekeyResponse}, make([]byte, RekeyNonceSize)...)},
+		{"confirm with trailing bytes", []byte{RekeyConfirm, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeRekey(tt.payload)
+			if err == nil {
+				t.Error("Expected error for invalid rekey payload")
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package protocol
+
+// DatagramOverhead is how many bytes the tunnel adds to an IP packet on the
+// wire for a protocol major: the packet header, the cipher's tagSize-byte
+// authentication tag and, with a network key, the network MAC. The outer
+// UDP and IP headers aren't included.
+func DatagramOverhead(major, tagSize int, networkMAC bool) int {
+	overhead := HeaderLen(major) + tagSize
+	if networkMAC {
+		overhead += NetworkMACSize
+	}
+	return overhead
+}
+
+// MaxInnerPacketSize returns the largest payload, before encryption, whose
+// datagram fits in maxUDPPayload bytes, or 0 if not even an empty one fits
+func MaxInnerPacketSize(maxUDPPayload, major, tagSize int, networkMAC bool) int {
+	size := maxUDPPayload - DatagramOverhead(major, tagSize, networkMAC)
+	if size < 0 {
+		return 0
+	}
+	return size
+}
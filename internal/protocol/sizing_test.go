@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestDatagramOverhead(t *testing.T) {
+	tests := []struct {
+		name       string
+		major      int
+		networkMAC bool
+		expected   int
+	}{
+		{"major 1", 1, false, 12 + 16},
+		{"major 1 with network MAC", 1, true, 12 + 16 + 8},
+		{"major 2", 2, false, 13 + 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overhead := DatagramOverhead(tt.major, 16, tt.networkMAC)
+			if overhead != tt.expected {
+				t.Errorf("Expected overhead %d, got %d", tt.expected, overhead)
+			}
+		})
+	}
+}
+
+func TestMaxInnerPacketSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxUDPPayload int
+		networkMAC    bool
+		expected      int
+	}{
+		{"ethernet path", 1472, false, 1444},
+		{"ethernet path with network MAC", 1472, true, 1436},
+		{"room for nothing but overhead", 28, false, 0},
+		{"too small for the overhead", 20, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := MaxInnerPacketSize(tt.maxUDPPayload, 1, 16, tt.networkMAC)
+			if size != tt.expected {
+				t.Errorf("Expected %d bytes, got %d", tt.expected, size)
+			}
+		})
+	}
+}
+
+// TestMaxInnerPacketSize_Boundary tests that a payload of exactly the
+// returned size encodes to a datagram of exactly the limit
+func TestMaxInnerPacketSize_Boundary(t *testing.T) {
+	const maxUDPPayload = 1400
+	size := MaxInnerPacketSize(maxUDPPayload, 1, 16, false)
+
+	// The encrypted payload is the plaintext plus the 16-byte tag
+	data, err := EncodePacket(CreateDataPacket(1, 1, make([]byte, size+16)))
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+	if len(data) != maxUDPPayload {
+		t.Errorf("Expected a %d-byte datagram, got %d", maxUDPPayload, len(data))
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import "fmt"
+
+// TypeName returns the name of a packet type, for logs
+func TypeName(packetType uint8) string {
+	switch packetType {
+	case PacketTypeData:
+		return "data"
+	case PacketTypeAuth:
+		return "auth"
+	case PacketTypePing:
+		return "ping"
+	case PacketTypePong:
+		return "pong"
+	case PacketTypeError:
+		return "error"
+	case PacketTypeDisconnect:
+		return "disconnect"
+	case PacketTypeRekey:
+		return "rekey"
+	default:
+		return fmt.Sprintf("type %d", packetType)
+	}
+}
+
+// DescribeHeader summarizes a packet's header for packet traces. The payload
+// is only described by its length, never its contents.
+func DescribeHeader(packet *Packet) string {
+	description := fmt.Sprintf("%s client %d seq %d len %d", TypeName(packet.Type), packet.ClientID, packet.Sequence, len(packet.Payload))
+	if packet.Flags&PacketFlagCompressed != 0 {
+		description += " compressed"
+	}
+	return description
+}
+
+// String describes the packet for debug logs like DescribeHeader, adding the
+// protocol version it was sent with, e.g. "ping client 3 seq 1 len 0 v1.2.0"
+func (p *Packet) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+
+	description := fmt.Sprintf("%s client %d seq %d len %d v%d.%d.%d", TypeName(p.Type), p.ClientID, p.Sequence, len(p.Payload), packetMajor(p), p.Version>>3, p.Version&0x07)
+	if p.Flags&PacketFlagCompressed != 0 {
+		description += " compressed"
+	}
+	return description
+}
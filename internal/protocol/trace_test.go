@@ -0,0 +1,54 @@
+package protocol
+
+import "testing"
+
+func TestDescribeHeader(t *testing.T) {
+	packet := CreateDataPacket(3, 42, []byte("secret"))
+	if got := DescribeHeader(packet); got != "data client 3 seq 42 len 6" {
+		t.Errorf("Expected %q, got %q", "data client 3 seq 42 len 6", got)
+	}
+
+	packet.Flags |= PacketFlagCompressed
+	if got := DescribeHeader(packet); got != "data client 3 seq 42 len 6 compressed" {
+		t.Errorf("Expected compressed flag in description, got %q", got)
+	}
+
+	if got := TypeName(9); got != "type 9" {
+		t.Errorf("Expected %q for an unknown type, got %q", "type 9", got)
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	compressed := CreateDataPacket(3, 43, []byte("secret"))
+	compressed.Flags |= PacketFlagCompressed
+
+	tests := []struct {
+		packet   *Packet
+		expected string
+	}{
+		{CreateDataPacket(3, 42, []byte("secret")), "data client 3 seq 42 len 6 v1.2.3"},
+		{compressed, "data client 3 seq 43 len 6 v1.2.3 compressed"},
+		{CreateAuthPacket(0, 1, make([]byte, 40)), "auth client 0 seq 1 len 40 v1.2.3"},
+		{CreatePingPacket(3, 7), "ping client 3 seq 7 len 0 v1.2.3"},
+		{CreatePongPacket(3, 7), "pong client 3 seq 7 len 0 v1.2.3"},
+		{CreateErrorPacket(3, ErrorCodeAuthFailed, "no"), "error client 3 seq 0 len 3 v1.2.3"},
+		{CreateDisconnectPacket(3, 8, make([]byte, 19)), "disconnect client 3 seq 8 len 19 v1.2.3"},
+		{CreateRekeyPacket(3, 9, make([]byte, 8)), "rekey client 3 seq 9 len 8 v1.2.3"},
+		{&Packet{Type: 9, ClientID: 1, Version: EncodeVersion(2, 31, 7), Major: 2}, "type 9 client 1 seq 0 len 0 v2.31.7"},
+	}
+
+	for _, test := range tests {
+		if test.packet.Major == 0 {
+			test.packet.Major = 1
+			test.packet.Version = EncodeVersion(1, 2, 3)
+		}
+		if got := test.packet.String(); got != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, got)
+		}
+	}
+
+	var packet *Packet
+	if got := packet.String(); got != "<nil>" {
+		t.Errorf("Expected %q for a nil packet, got %q", "<nil>", got)
+	}
+}
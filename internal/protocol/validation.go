@@ -4,29 +4,51 @@ import "fmt"
 
 func ValidateMagic(packet *Packet) error {
 	if string(packet.Magic[:]) != MagicBytes {
-		return fmt.Errorf("invalid magic: got %s, want %s", string(packet.Magic[:]), MagicBytes)
+		return fmt.Errorf("%w: got %s, want %s", ErrBadMagic, string(packet.Magic[:]), MagicBytes)
 	}
 	return nil
 }
 
+// ValidateVersion rejects packets from a peer with a different major version,
+// which the type byte carries. Minor and patch differences are negotiated
+// instead.
 func ValidateVersion(packet *Packet) error {
-	major, _, _ := parseVersion(packet.Version)
+	major := packetMajor(packet)
 	if major != ProtocolVersionMajor {
-		return fmt.Errorf("unsupported version: got %d, want %d", major, ProtocolVersionMajor)
+		return fmt.Errorf("%w: got major %d, want %d", ErrUnsupportedVersion, major, ProtocolVersionMajor)
 	}
 	return nil
 }
 
+// packetMajor returns the major version a packet was or will be sent with
+func packetMajor(packet *Packet) int {
+	if packet.Major == 0 {
+		return ProtocolVersionMajor
+	}
+	return int(packet.Major)
+}
+
 func ValidateType(packet *Packet) error {
-	if packet.Type < PacketTypeData || packet.Type > PacketTypePong {
-		return fmt.Errorf("invalid packet type: %d", packet.Type)
+	if packet.Type < PacketTypeData || packet.Type > PacketTypeRekey {
+		return fmt.Errorf("%w: %d", ErrBadType, packet.Type)
+	}
+	return nil
+}
+
+// ValidateFlags rejects unknown flag bits and flags on non-data packets
+func ValidateFlags(packet *Packet) error {
+	if packet.Flags&^PacketFlagCompressed != 0 {
+		return fmt.Errorf("%w: 0x%02x", ErrBadFlags, packet.Flags)
+	}
+	if packet.Flags != 0 && packet.Type != PacketTypeData {
+		return fmt.Errorf("%w: 0x%02x not allowed on packet type %d", ErrBadFlags, packet.Flags, packet.Type)
 	}
 	return nil
 }
 
 func ValidateLength(packet *Packet) error {
 	if packet.Length != uint16(len(packet.Payload)) {
-		return fmt.Errorf("length mismatch: header says %d, payload is %d", packet.Length, len(packet.Payload))
+		return fmt.Errorf("%w: header says %d, payload is %d", ErrLengthMismatch, packet.Length, len(packet.Payload))
 	}
 	return nil
 }
@@ -36,6 +58,7 @@ func ValidatePacket(packet *Packet) error {
 		ValidateMagic,
 		ValidateVersion,
 		ValidateType,
+		ValidateFlags,
 		ValidateLength,
 	}
 
@@ -47,9 +70,11 @@ func ValidatePacket(packet *Packet) error {
 	return nil
 }
 
+// parseVersion splits a version byte. The byte doesn't carry the major
+// version, which is reported as ours: ValidateVersion has already rejected
+// packets with any other.
 func parseVersion(version byte) (major int, minor int, patch int) {
-
-	major = 1
+	major = ProtocolVersionMajor
 	minor = int(version >> 3)
 	patch = int(version & 0x07)
 
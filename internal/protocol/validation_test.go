@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -9,6 +10,7 @@ func TestValidateMagic(t *testing.T) {
 		name        string
 		packet      *Packet
 		expectError bool
+		wantErr     error
 	}{
 		{
 			name: "valid magic",
@@ -23,6 +25,7 @@ func TestValidateMagic(t *testing.T) {
 				Magic: [3]byte{'X', 'V', 'P'},
 			},
 			expectError: true,
+			wantErr:     ErrBadMagic,
 		},
 		{
 			name: "invalid magic - wrong second byte",
@@ -30,6 +33,7 @@ func TestValidateMagic(t *testing.T) {
 				Magic: [3]byte{'F', 'X', 'P'},
 			},
 			expectError: true,
+			wantErr:     ErrBadMagic,
 		},
 		{
 			name: "invalid magic - wrong third byte",
@@ -37,6 +41,7 @@ func TestValidateMagic(t *testing.T) {
 				Magic: [3]byte{'F', 'V', 'X'},
 			},
 			expectError: true,
+			wantErr:     ErrBadMagic,
 		},
 		{
 			name: "invalid magic - all wrong",
@@ -44,6 +49,7 @@ func TestValidateMagic(t *testing.T) {
 				Magic: [3]byte{'X', 'Y', 'Z'},
 			},
 			expectError: true,
+			wantErr:     ErrBadMagic,
 		},
 	}
 
@@ -54,6 +60,8 @@ func TestValidateMagic(t *testing.T) {
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 			} else {
 				if err != nil {
@@ -69,6 +77,7 @@ func TestValidateVersion(t *testing.T) {
 		name        string
 		packet      *Packet
 		expectError bool
+		wantErr     error
 	}{
 		{
 			name: "valid version - major 1, minor 0, patch 0",
@@ -112,6 +121,32 @@ func TestValidateVersion(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "valid version - major 1 explicit",
+			packet: &Packet{
+				Major:   1,
+				Version: 0x08,
+			},
+			expectError: false,
+		},
+		{
+			name: "invalid version - major 2",
+			packet: &Packet{
+				Major:   2,
+				Version: 0x00,
+			},
+			expectError: true,
+			wantErr:     ErrUnsupportedVersion,
+		},
+		{
+			name: "invalid version - major 4",
+			packet: &Packet{
+				Major:   4,
+				Version: 0xFF,
+			},
+			expectError: true,
+			wantErr:     ErrUnsupportedVersion,
+		},
 	}
 
 	for _, tt := range tests {
@@ -119,8 +154,10 @@ func TestValidateVersion(t *testing.T) {
 			err := ValidateVersion(tt.packet)
 
 			if tt.expectError {
-				if err != nil {
+				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 			} else {
 				if err != nil {
@@ -136,6 +173,7 @@ func TestValidateType(t *testing.T) {
 		name        string
 		packet      *Packet
 		expectError bool
+		wantErr     error
 	}{
 		{
 			name: "valid type - Data",
@@ -165,19 +203,35 @@ func TestValidateType(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "valid type - Error",
+			packet: &Packet{
+				Type: PacketTypeError,
+			},
+			expectError: false,
+		},
+		{
+			name: "valid type - Disconnect",
+			packet: &Packet{
+				Type: PacketTypeDisconnect,
+			},
+			expectError: false,
+		},
 		{
 			name: "invalid type - too low",
 			packet: &Packet{
 				Type: 0,
 			},
 			expectError: true,
+			wantErr:     ErrBadType,
 		},
 		{
 			name: "invalid type - too high",
 			packet: &Packet{
-				Type: 5,
+				Type: 8,
 			},
 			expectError: true,
+			wantErr:     ErrBadType,
 		},
 		{
 			name: "invalid type - very high",
@@ -185,6 +239,7 @@ func TestValidateType(t *testing.T) {
 				Type: 255,
 			},
 			expectError: true,
+			wantErr:     ErrBadType,
 		},
 	}
 
@@ -195,6 +250,8 @@ func TestValidateType(t *testing.T) {
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 			} else {
 				if err != nil {
@@ -210,6 +267,7 @@ func TestValidateLength(t *testing.T) {
 		name        string
 		packet      *Packet
 		expectError bool
+		wantErr     error
 	}{
 		{
 			name: "valid length - empty payload",
@@ -242,6 +300,7 @@ func TestValidateLength(t *testing.T) {
 				Payload: []byte{'a', 'b', 'c'},
 			},
 			expectError: true,
+			wantErr:     ErrLengthMismatch,
 		},
 		{
 			name: "invalid length - too long",
@@ -250,6 +309,7 @@ func TestValidateLength(t *testing.T) {
 				Payload: []byte{'a', 'b', 'c', 'd', 'e'},
 			},
 			expectError: true,
+			wantErr:     ErrLengthMismatch,
 		},
 		{
 			name: "invalid length - zero length with payload",
@@ -258,6 +318,7 @@ func TestValidateLength(t *testing.T) {
 				Payload: []byte{'a'},
 			},
 			expectError: true,
+			wantErr:     ErrLengthMismatch,
 		},
 	}
 
@@ -268,6 +329,8 @@ func TestValidateLength(t *testing.T) {
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 			} else {
 				if err != nil {
@@ -283,6 +346,7 @@ func TestValidatePacket(t *testing.T) {
 		name        string
 		packet      *Packet
 		expectError bool
+		wantErr     error
 	}{
 		{
 			name: "valid packet",
@@ -309,6 +373,7 @@ func TestValidatePacket(t *testing.T) {
 				Payload:  []byte{'h', 'e', 'l', 'l', 'o'},
 			},
 			expectError: true,
+			wantErr:     ErrBadMagic,
 		},
 		{
 			name: "invalid packet - wrong type",
@@ -322,6 +387,7 @@ func TestValidatePacket(t *testing.T) {
 				Payload:  []byte{'h', 'e', 'l', 'l', 'o'},
 			},
 			expectError: true,
+			wantErr:     ErrBadType,
 		},
 		{
 			name: "invalid packet - length mismatch",
@@ -335,6 +401,7 @@ func TestValidatePacket(t *testing.T) {
 				Payload:  []byte{'h', 'e', 'l', 'l', 'o'},
 			},
 			expectError: true,
+			wantErr:     ErrLengthMismatch,
 		},
 	}
 
@@ -345,6 +412,8 @@ func TestValidatePacket(t *testing.T) {
 			if tt.expectError {
 				if err == nil {
 					t.Errorf("expected error but got none")
+				} else if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
 				}
 			} else {
 				if err != nil {
@@ -486,4 +555,53 @@ func TestValidatePacketEdgeCases(t *testing.T) {
 			}
 		})
 	}
-} 
\ No newline at end of file
+} 
+// TestMajorVersionOnWire tests that the major version survives encoding and
+// that a packet from a peer with another major is rejected on decode
+func TestMajorVersionOnWire(t *testing.T) {
+	packet := CreatePingPacket(1, 1)
+	data, err := EncodePacket(packet)
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+	if data[3]&PacketMajorMask != 0 {
+		t.Errorf("Expected major 1 to leave the major bits clear, got type byte 0x%02x", data[3])
+	}
+
+	decoded, err := DecodePacket(data)
+	if err != nil {
+		t.Fatalf("DecodePacket failed: %v", err)
+	}
+	if decoded.Major != 1 {
+		t.Errorf("Expected major 1, got %d", decoded.Major)
+	}
+
+	// A major 2 peer's packet is otherwise well formed
+	packet.Major = 2
+	data, err = EncodePacket(packet)
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+	if data[3]&PacketTypeMask != PacketTypePing {
+		t.Errorf("Expected major bits to leave the type intact, got type byte 0x%02x", data[3])
+	}
+
+	parsed, err := ParsePacket(data)
+	if err != nil {
+		t.Fatalf("ParsePacket failed: %v", err)
+	}
+	if parsed.Major != 2 || parsed.Flags != 0 {
+		t.Errorf("Expected major 2 without flags, got major %d flags 0x%02x", parsed.Major, parsed.Flags)
+	}
+
+	_, err = DecodePacket(data)
+	if err == nil {
+		t.Error("Expected a packet with major 2 to be rejected")
+	}
+
+	packet.Major = MaxProtocolMajor + 1
+	_, err = EncodePacket(packet)
+	if err == nil {
+		t.Errorf("Expected major %d to be unencodable", MaxProtocolMajor+1)
+	}
+}
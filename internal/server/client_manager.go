@@ -1,9 +1,14 @@
 package server
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -11,53 +16,124 @@ import (
 )
 
 type Client struct {
-	ID       uint8
-	IP       string
-	Key      []byte
-	Address  string
-	Connected bool
-	LastSeen  time.Time
-	LastSeq   uint32
+	ID             uint8
+	IP             string
+	Key            []byte
+	Address        string
+	UDPAddr        *net.UDPAddr // Resolved Address, cached for sends
+	DataAddr       *net.UDPAddr // Source of the client's packets on the data socket; nil until one arrives
+	Connected      bool
+	LastSeen       time.Time
+	ConnectedSince time.Time       // When the session was set up; roaming keeps it, reconnecting starts a new one
+	RxSeq          uint32          // Highest sequence received from the client
+	ControlRxSeq   uint32          // Highest control packet sequence received, when DataPlane
+	TxSeq          uint32          // Last sequence sent to the client
+	Version        uint8           // Protocol version negotiated during auth
+	Cipher         crypto.Cipher   // Cipher suite negotiated during auth
+	Keys           *crypto.KeyRing // Per-direction data keys derived during auth, replaced by rekeys
+	Rekey          bool            // Rekeys negotiated during auth
+	DataPlane      bool            // Offered the data socket during auth, so its data and control packets travel apart
+	Compress       bool            // Payload compression negotiated during auth
+	AllowedIPs     []*net.IPNet    // Networks besides IP the client may send from
+	BytesRx        uint64          // Tunneled bytes received from the client, as decrypted IP packets
+	BytesTx        uint64          // Tunneled bytes sent to the client, as IP packets before encryption
+	WireBytesRx    uint64          // UDP payload bytes of the client's data packets, tunnel overhead included
+	WireBytesTx    uint64          // UDP payload bytes of the data packets sent to the client
+	PacketsRx      uint64          // Data packets received from the client
+	PacketsTx      uint64          // Data packets sent to the client
+	RTT            time.Duration   // Smoothed RTT the client last reported
+	loggedRTT      time.Duration   // RTT when a change was last logged
+	Probes         int             // Liveness probes sent since the client last spoke
+	ConfigID       uint8           // Configured client whose pre-shared key it used; 0 if assigned
+	authRequest    []byte          // Auth request the session was set up for, to recognize retries
+	authResponse   []byte          // Auth response sent for it, resent to retries
+	authProof      time.Time       // When the auth request proved the client holds its key; zero if it didn't
 }
 
 type ClientManager struct {
-	clients     map[uint8]*Client
-	ipToClient  map[string]uint8
-	keyToClient map[string]uint8
-	mutex       sync.RWMutex
-	timeout     time.Duration
-	keyManager  *crypto.KeyManager
+	clients        map[uint8]*Client
+	ipToClient     map[string]uint8
+	keyToClient    map[string]uint8
+	sourceToClient map[string]uint8 // UDP source address of each client
+	dataToClient   map[string]uint8 // UDP source address of each client on the data socket
+	lastIPs        map[uint8]string // Tunnel IP each configured client ID last had, to give it again
+	mutex          sync.RWMutex
+	timeout        time.Duration
+	allocator      IPAllocator // Hands out client tunnel addresses
+	tunnelIP       string      // Server's tunnel address, which clients use as their gateway
+	keyManager     *crypto.KeyManager
+	events         *eventDispatcher
+	stopChan       chan struct{}
+	stopOnce       sync.Once
+	wg             sync.WaitGroup
 }
 
+// rttTrendThreshold is how far a client's RTT must move from the last logged
+// value, as a fraction of it, before the change is logged again
+const rttTrendThreshold = 0.5
+
+// MaxClients is the most clients a server can hold. Client IDs are a single
+// byte and ID 0 is reserved for clients asking to be assigned one, leaving
+// IDs 1-255.
+const MaxClients = 255
+
 var (
 	ErrClientNotFound      = errors.New("client not found")
 	ErrClientAlreadyExists = errors.New("client already exists")
-	ErrMaxClientsReached   = errors.New("maximum clients reached (256)")
+	ErrMaxClientsReached   = fmt.Errorf("maximum clients reached (%d)", MaxClients)
 	ErrInvalidKey          = errors.New("invalid client key")
 	ErrClientTimeout       = errors.New("client timeout")
 	ErrInvalidSequence     = errors.New("invalid sequence number")
 	ErrClientDisconnected  = errors.New("client disconnected")
+	ErrIPPoolExhausted     = errors.New("no IP addresses left in the tunnel subnet")
 )
 
-func NewClientManager(keyManager *crypto.KeyManager) *ClientManager {
+// NewClientManager creates a client manager that takes tunnel addresses from
+// allocator. A nil allocator hands out addresses from DefaultSubnet in order.
+func NewClientManager(keyManager *crypto.KeyManager, allocator IPAllocator) *ClientManager {
+	_, subnet, _ := net.ParseCIDR(DefaultSubnet)
+	if allocator == nil {
+		allocator = NewSequentialAllocator(subnet, "")
+	}
+
 	cm := &ClientManager{
-		clients:     make(map[uint8]*Client),
-		ipToClient:  make(map[string]uint8),
-		keyToClient: make(map[string]uint8),
-		timeout:     30 * time.Minute,
-		keyManager:  keyManager,
+		clients:        make(map[uint8]*Client),
+		ipToClient:     make(map[string]uint8),
+		keyToClient:    make(map[string]uint8),
+		sourceToClient: make(map[string]uint8),
+		dataToClient:   make(map[string]uint8),
+		lastIPs:        make(map[uint8]string),
+		timeout:        30 * time.Minute,
+		allocator:      allocator,
+		tunnelIP:       hostIP(subnet, 1),
+		keyManager:     keyManager,
+		stopChan:       make(chan struct{}),
 	}
 	
+	cm.wg.Add(1)
 	go cm.startTimeoutChecker()
 	
 	return cm
 }
 
 func (cm *ClientManager) AddClient(key []byte, address string) (*Client, error) {
+	return cm.AddClientWithIP(key, address, "")
+}
+
+// AddClientWithIP adds a client like AddClient, giving it preferredIP if the
+// allocator can claim it and the next free address otherwise. The caller
+// checks whether the client may have a reserved IP.
+func (cm *ClientManager) AddClientWithIP(key []byte, address string, preferredIP string) (*Client, error) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	
-	if len(cm.clients) >= 256 {
+
+	return cm.addClient(key, address, preferredIP)
+}
+
+// addClient adds a client for AddClientWithIP. It must be called with the
+// mutex held.
+func (cm *ClientManager) addClient(key []byte, address string, preferredIP string) (*Client, error) {
+	if len(cm.clients) >= MaxClients {
 		return nil, ErrMaxClientsReached
 	}
 	
@@ -65,35 +141,98 @@ func (cm *ClientManager) AddClient(key []byte, address string) (*Client, error)
 	if _, exists := cm.keyToClient[keyHash]; exists {
 		return nil, ErrClientAlreadyExists
 	}
-	
+
 	clientID := cm.findNextClientID()
 	if clientID == 0 {
 		return nil, ErrMaxClientsReached
 	}
 	
-	ip := cm.assignNextIP()
-	if ip == "" {
-		return nil, fmt.Errorf("no IP addresses available")
+	ip, err := cm.allocateIP(preferredIP)
+	if err != nil {
+		return nil, err
 	}
 	
+	// Addresses come from ReadFromUDP so resolving never touches DNS
+	udpAddr, _ := net.ResolveUDPAddr("udp", address)
+
 	client := &Client{
-		ID:        clientID,
-		IP:        ip,
-		Key:       key,
-		Address:   address,
-		Connected: true,
-		LastSeen:  time.Now(),
-		LastSeq:   0,
+		ID:             clientID,
+		IP:             ip,
+		Key:            key,
+		Address:        address,
+		UDPAddr:        udpAddr,
+		Connected:      true,
+		LastSeen:       time.Now(),
+		ConnectedSince: time.Now(),
+		RxSeq:          0,
+		TxSeq:          0,
+		Cipher:         crypto.DefaultCipher(),
+		Keys:           crypto.NewKeyRing(nil, false), // Set by SetClientSession once the handshake derives them
 	}
 	
 	cm.clients[clientID] = client
 	cm.ipToClient[ip] = clientID
 	cm.keyToClient[keyHash] = clientID
+	cm.sourceToClient[address] = clientID
 	
 	log.Printf("Added client %d with IP %s from %s", clientID, ip, address)
 	return client, nil
 }
 
+// AddOrUpdateClient adds a client like AddClientWithIP, unless a client with
+// the same key already has a session. That client is reconnecting: it keeps
+// its ID and IP, but gets a fresh session from address, as if it were new.
+// Anyone can send an auth request, so the session is only replaced if proof,
+// when the request proved the client holds the key, is later than the proof
+// of the request that set it up; otherwise it fails with
+// ErrClientAlreadyExists. A zero proof never replaces a session.
+func (cm *ClientManager) AddOrUpdateClient(key []byte, address string, preferredIP string, proof time.Time) (*Client, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	existingID, exists := cm.keyToClient[fmt.Sprintf("%x", key)]
+	if !exists {
+		client, err := cm.addClient(key, address, preferredIP)
+		if err != nil {
+			return nil, err
+		}
+		client.authProof = proof
+		return client, nil
+	}
+
+	existing := cm.clients[existingID]
+	if !proof.After(existing.authProof) {
+		return nil, ErrClientAlreadyExists
+	}
+
+	cm.forgetSource(existing)
+	cm.forgetDataSource(existing)
+
+	// Addresses come from ReadFromUDP so resolving never touches DNS
+	udpAddr, _ := net.ResolveUDPAddr("udp", address)
+
+	client := &Client{
+		ID:             existing.ID,
+		IP:             existing.IP,
+		Key:            existing.Key,
+		Address:        address,
+		UDPAddr:        udpAddr,
+		Connected:      true,
+		LastSeen:       time.Now(),
+		ConnectedSince: time.Now(),
+		Cipher:         crypto.DefaultCipher(),
+		Keys:           crypto.NewKeyRing(nil, false), // Set by SetClientSession once the handshake derives them
+		authProof:      proof,
+	}
+
+	cm.clients[client.ID] = client
+	cm.sourceToClient[address] = client.ID
+
+	log.Printf("Client %d reconnected from %s, keeping IP %s", client.ID, address, client.IP)
+	cm.events.disconnected(client.ID, DisconnectReasonReconnected)
+	return client, nil
+}
+
 func (cm *ClientManager) RemoveClient(clientID uint8) error {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
@@ -103,12 +242,10 @@ func (cm *ClientManager) RemoveClient(clientID uint8) error {
 		return ErrClientNotFound
 	}
 	
-	delete(cm.clients, clientID)
-	delete(cm.ipToClient, client.IP)
-	keyHash := fmt.Sprintf("%x", client.Key)
-	delete(cm.keyToClient, keyHash)
+	cm.deleteClient(client)
 	
 	log.Printf("Removed client %d with IP %s", clientID, client.IP)
+	cm.events.disconnected(clientID, DisconnectReasonRemoved)
 	return nil
 }
 
@@ -141,6 +278,46 @@ func (cm *ClientManager) GetClientByIP(ip string) (*Client, error) {
 	return client, nil
 }
 
+// GetClientByAddress returns the client whose packets arrive from the given
+// UDP source address
+func (cm *ClientManager) GetClientByAddress(addr string) (*Client, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clientID, exists := cm.sourceToClient[addr]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+
+	return client, nil
+}
+
+// GetClientByDataAddress returns the client whose packets arrive on the data
+// socket from the given UDP source address
+func (cm *ClientManager) GetClientByDataAddress(addr string) (*Client, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clientID, exists := cm.dataToClient[addr]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+
+	return client, nil
+}
+
+// ListClients returns every client, ordered by ID. The clients are live and
+// their fields change under the lock; use Snapshot to read them.
 func (cm *ClientManager) ListClients() []*Client {
 	cm.mutex.RLock()
 	defer cm.mutex.RUnlock()
@@ -149,10 +326,28 @@ func (cm *ClientManager) ListClients() []*Client {
 	for _, client := range cm.clients {
 		clients = append(clients, client)
 	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
 	
 	return clients
 }
 
+// Snapshot returns a copy of every client, ordered by ID, taken under the lock
+// so its fields can be read while the clients keep changing. Slices and
+// pointers in the copies are shared, but they are replaced rather than
+// modified in place.
+func (cm *ClientManager) Snapshot() []Client {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clients := make([]Client, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		clients = append(clients, *client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	return clients
+}
+
 func (cm *ClientManager) UpdateClientActivity(clientID uint8, sequence uint32) error {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
@@ -162,23 +357,480 @@ func (cm *ClientManager) UpdateClientActivity(clientID uint8, sequence uint32) e
 		return ErrClientNotFound
 	}
 	
-	if sequence <= client.LastSeq {
+	if sequence <= client.RxSeq {
 		return ErrInvalidSequence
 	}
 	
 	client.LastSeen = time.Now()
-	client.LastSeq = sequence
+	client.RxSeq = sequence
+	client.Probes = 0
 	
 	return nil
 }
 
+// UpdateControlActivity is UpdateClientActivity for control packets: pings,
+// pongs and rekeys. A DataPlane client numbers its data and control packets
+// from one sequence but sends them over different sockets, which don't keep
+// them in order, so its control packets are checked against the last control
+// sequence instead.
+func (cm *ClientManager) UpdateControlActivity(clientID uint8, sequence uint32) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	last := &client.RxSeq
+	if client.DataPlane {
+		last = &client.ControlRxSeq
+	}
+	if sequence <= *last {
+		return ErrInvalidSequence
+	}
+
+	client.LastSeen = time.Now()
+	*last = sequence
+	client.Probes = 0
+
+	return nil
+}
+
+// NextTxSequence returns the sequence for the next data packet sent to the
+// client. It is counted apart from the sequences the client sends, so the
+// two directions never advance or reuse each other's.
+func (cm *ClientManager) NextTxSequence(clientID uint8) (uint32, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return 0, ErrClientNotFound
+	}
+
+	client.TxSeq++
+	return client.TxSeq, nil
+}
+
+// SetClientAllowedIPs records the networks, besides its tunnel IP, that a
+// client may send packets from and receive packets for
+func (cm *ClientManager) SetClientAllowedIPs(clientID uint8, allowed []*net.IPNet) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.AllowedIPs = allowed
+	return nil
+}
+
+// allowsSource reports whether an IPv4 packet from the client carries its
+// tunnel IP, or an address in one of its allowed networks, as the source
+func (c *Client) allowsSource(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return false
+	}
+
+	source := net.IP(packet[12:16])
+	if source.String() == c.IP {
+		return true
+	}
+	for _, allowed := range c.AllowedIPs {
+		if allowed.Contains(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetClientConfigID records which configured client's pre-shared key a client
+// authenticated with, so it can be disconnected if that key is removed
+func (cm *ClientManager) SetClientConfigID(clientID uint8, configID uint8) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.ConfigID = configID
+	cm.lastIPs[configID] = client.IP
+	return nil
+}
+
+// RememberedIP returns the tunnel IP the client configured as configID last
+// had, or an empty string if it hasn't connected
+func (cm *ClientManager) RememberedIP(configID uint8) string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return cm.lastIPs[configID]
+}
+
+// RememberedIPs returns the tunnel IP each configured client last had, by
+// configured client ID
+func (cm *ClientManager) RememberedIPs() map[uint8]string {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return maps.Clone(cm.lastIPs)
+}
+
+// RememberIPs records the tunnel IPs configured clients had before, e.g. in
+// an earlier run, so they are offered the same ones again
+func (cm *ClientManager) RememberIPs(ips map[uint8]string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	maps.Copy(cm.lastIPs, ips)
+}
+
+// SetClientCompression records whether data payloads to and from the client
+// may be compressed
+func (cm *ClientManager) SetClientCompression(clientID uint8, enabled bool) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.Compress = enabled
+	return nil
+}
+
+// SetClientAuth records the auth request a client's session was set up for
+// and the response it was sent, so AuthReplay can recognize retries
+func (cm *ClientManager) SetClientAuth(clientID uint8, request, response []byte) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.authRequest = request
+	client.authResponse = response
+	return nil
+}
+
+// AuthReplay returns the auth response already sent for request if the
+// client at address was set up by an identical one, or nil otherwise. A
+// client that heard nothing back resends its request unchanged, and must get
+// the same answer rather than a second session.
+func (cm *ClientManager) AuthReplay(address string, request []byte) []byte {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	clientID, exists := cm.sourceToClient[address]
+	if !exists {
+		return nil
+	}
+
+	client := cm.clients[clientID]
+	if client == nil || client.authResponse == nil || !bytes.Equal(client.authRequest, request) {
+		return nil
+	}
+	return client.authResponse
+}
+
+// RecordReceived counts a data packet from a client, carrying an IP packet of
+// appBytes in a datagram of wireBytes
+func (cm *ClientManager) RecordReceived(clientID uint8, appBytes, wireBytes int) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.BytesRx += uint64(appBytes)
+	client.WireBytesRx += uint64(wireBytes)
+	client.PacketsRx++
+	return nil
+}
+
+// RecordSent counts a data packet sent to a client, carrying an IP packet of
+// appBytes in a datagram of wireBytes
+func (cm *ClientManager) RecordSent(clientID uint8, appBytes, wireBytes int) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.BytesTx += uint64(appBytes)
+	client.WireBytesTx += uint64(wireBytes)
+	client.PacketsTx++
+	return nil
+}
+
+// ResetCounters sets every client's traffic counters back to zero, leaving
+// their sessions alone
+func (cm *ClientManager) ResetCounters() {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	for _, client := range cm.clients {
+		client.BytesRx = 0
+		client.BytesTx = 0
+		client.WireBytesRx = 0
+		client.WireBytesTx = 0
+		client.PacketsRx = 0
+		client.PacketsTx = 0
+	}
+}
+
+// RecordRTT stores the RTT a client reported. It also returns the last
+// logged RTT and whether the new one has moved far enough from it to be worth
+// logging, so trends show up in the log without an entry per ping.
+func (cm *ClientManager) RecordRTT(clientID uint8, rtt time.Duration) (time.Duration, bool, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return 0, false, ErrClientNotFound
+	}
+
+	client.RTT = rtt
+	previous := client.loggedRTT
+	change := float64(rtt - previous)
+	if change < 0 {
+		change = -change
+	}
+	if previous != 0 && change < rttTrendThreshold*float64(previous) {
+		return previous, false, nil
+	}
+
+	client.loggedRTT = rtt
+	return previous, true, nil
+}
+
+// ClientStatuses returns a snapshot of every client's state, ordered by ID.
+// It is taken under the lock so counters aren't read while the packet
+// processor updates them.
+func (cm *ClientManager) ClientStatuses() []ClientStatus {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	status := make([]ClientStatus, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		status = append(status, client.status())
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+
+	return status
+}
+
+// GetClientStatus returns a snapshot of one client's state
+func (cm *ClientManager) GetClientStatus(clientID uint8) (ClientStatus, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ClientStatus{}, ErrClientNotFound
+	}
+
+	return client.status(), nil
+}
+
+// status must be called with the client manager lock held
+func (c *Client) status() ClientStatus {
+	return ClientStatus{
+		ID:             c.ID,
+		IP:             c.IP,
+		Connected:      c.Connected,
+		LastSeen:       c.LastSeen,
+		ConnectedSince: c.ConnectedSince,
+		Uptime:         time.Since(c.ConnectedSince),
+		BytesRx:        c.BytesRx,
+		BytesTx:        c.BytesTx,
+		WireBytesRx:    c.WireBytesRx,
+		WireBytesTx:    c.WireBytesTx,
+		PacketsRx:      c.PacketsRx,
+		PacketsTx:      c.PacketsTx,
+		RTT:            c.RTT,
+	}
+}
+
+// UpdateClientAddress records a new source address for a roaming client. It
+// must only be called for authenticated packets. Returns true if the address
+// changed.
+func (cm *ClientManager) UpdateClientAddress(clientID uint8, addr *net.UDPAddr) (bool, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return false, ErrClientNotFound
+	}
+
+	address := addr.String()
+	if client.Address == address {
+		return false, nil
+	}
+
+	log.Printf("Client %d roamed from %s to %s", clientID, client.Address, address)
+	cm.forgetSource(client)
+	client.Address = address
+	client.UDPAddr = addr
+	cm.sourceToClient[address] = clientID
+	return true, nil
+}
+
+// UpdateClientDataAddress records the source address of a client's packets
+// on the data socket. It must only be called for authenticated packets.
+func (cm *ClientManager) UpdateClientDataAddress(clientID uint8, addr *net.UDPAddr) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	if client.DataAddr != nil && client.DataAddr.String() == addr.String() {
+		return nil
+	}
+
+	cm.forgetDataSource(client)
+	client.DataAddr = addr
+	cm.dataToClient[addr.String()] = clientID
+	return nil
+}
+
+// GetClientDataAddr returns the address data packets to the client should be
+// sent to from the data socket, or nil if it hasn't sent from one
+func (cm *ClientManager) GetClientDataAddr(clientID uint8) *net.UDPAddr {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return nil
+	}
+	return client.DataAddr
+}
+
+// GetClientAddr returns the address replies to the client should be sent to
+func (cm *ClientManager) GetClientAddr(clientID uint8) (*net.UDPAddr, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+
+	if client.UDPAddr != nil {
+		return client.UDPAddr, nil
+	}
+	return net.ResolveUDPAddr("udp", client.Address)
+}
+
+func (cm *ClientManager) SetClientVersion(clientID uint8, version uint8) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.Version = version
+	return nil
+}
+
+func (cm *ClientManager) SetClientCipher(clientID uint8, cipher crypto.Cipher) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.Cipher = cipher
+	return nil
+}
+
+func (cm *ClientManager) SetClientSession(clientID uint8, session *crypto.SessionKeys) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.Keys = crypto.NewKeyRing(session, false)
+	return nil
+}
+
+// SetClientRekey records whether the client agreed to rekey its session
+func (cm *ClientManager) SetClientRekey(clientID uint8, enabled bool) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.Rekey = enabled
+	return nil
+}
+
+// SetClientDataPlane records whether the client was offered the data socket
+func (cm *ClientManager) SetClientDataPlane(clientID uint8, enabled bool) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	client, exists := cm.clients[clientID]
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	client.DataPlane = enabled
+	return nil
+}
+
+// SetTimeout changes how long clients may be idle before they are removed.
+// It applies from the next timeout check, to clients already connected too.
+func (cm *ClientManager) SetTimeout(timeout time.Duration) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	cm.timeout = timeout
+}
+
+// GetTimeout returns how long clients may be idle before they are removed
+func (cm *ClientManager) GetTimeout() time.Duration {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return cm.timeout
+}
+
 func (cm *ClientManager) CheckTimeouts() {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	
+
 	now := time.Now()
 	var toRemove []uint8
-	
+
 	for clientID, client := range cm.clients {
 		if now.Sub(client.LastSeen) > cm.timeout {
 			toRemove = append(toRemove, clientID)
@@ -187,40 +839,152 @@ func (cm *ClientManager) CheckTimeouts() {
 	
 	for _, clientID := range toRemove {
 		client := cm.clients[clientID]
-		delete(cm.clients, clientID)
-		delete(cm.ipToClient, client.IP)
-		keyHash := fmt.Sprintf("%x", client.Key)
-		delete(cm.keyToClient, keyHash)
+		cm.deleteClient(client)
 		log.Printf("Removed timed-out client %d with IP %s", clientID, client.IP)
+		cm.events.disconnected(clientID, DisconnectReasonTimeout)
 	}
 }
 
+// CheckIdle finds clients silent for at least half the timeout. Those that
+// have already been sent maxProbes probes are removed; the rest have their
+// probe count bumped and are returned so the caller can probe them.
+func (cm *ClientManager) CheckIdle(maxProbes int) []uint8 {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	now := time.Now()
+	var toProbe []uint8
+
+	for clientID, client := range cm.clients {
+		if now.Sub(client.LastSeen) < cm.timeout/2 {
+			continue
+		}
+
+		if client.Probes >= maxProbes {
+			cm.deleteClient(client)
+			log.Printf("Removed unresponsive client %d with IP %s after %d probes", clientID, client.IP, client.Probes)
+			cm.events.disconnected(clientID, DisconnectReasonUnresponsive)
+			continue
+		}
+
+		client.Probes++
+		toProbe = append(toProbe, clientID)
+	}
+
+	sort.Slice(toProbe, func(i, j int) bool { return toProbe[i] < toProbe[j] })
+	return toProbe
+}
+
+// deleteClient drops a client from every index. It must be called with the
+// mutex held.
+func (cm *ClientManager) deleteClient(client *Client) {
+	delete(cm.clients, client.ID)
+	delete(cm.ipToClient, client.IP)
+	cm.allocator.Release(net.ParseIP(client.IP))
+	keyHash := fmt.Sprintf("%x", client.Key)
+	delete(cm.keyToClient, keyHash)
+	cm.forgetSource(client)
+	cm.forgetDataSource(client)
+}
+
+// forgetSource drops a client's source address from the index, unless another
+// client has since taken it over. It must be called with the mutex held.
+func (cm *ClientManager) forgetSource(client *Client) {
+	if cm.sourceToClient[client.Address] == client.ID {
+		delete(cm.sourceToClient, client.Address)
+	}
+}
+
+// forgetDataSource drops a client's data socket address from the index,
+// unless another client has since taken it over. It must be called with the
+// mutex held.
+func (cm *ClientManager) forgetDataSource(client *Client) {
+	if client.DataAddr != nil && cm.dataToClient[client.DataAddr.String()] == client.ID {
+		delete(cm.dataToClient, client.DataAddr.String())
+	}
+}
+
+// Close stops the timeout checker and waits for it to exit. It is safe to
+// call more than once.
+func (cm *ClientManager) Close() {
+	if cm.stopChan == nil {
+		return
+	}
+
+	cm.stopOnce.Do(func() {
+		close(cm.stopChan)
+	})
+	cm.wg.Wait()
+}
+
 func (cm *ClientManager) startTimeoutChecker() {
+	defer cm.wg.Done()
+
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	
-	for range ticker.C {
-		cm.CheckTimeouts()
+	for {
+		select {
+		case <-cm.stopChan:
+			return
+		case <-ticker.C:
+			cm.CheckTimeouts()
+		}
 	}
 }
 
+// findNextClientID returns the lowest free client ID, so IDs freed by
+// removed clients are reused first, or 0 if all MaxClients IDs are taken
 func (cm *ClientManager) findNextClientID() uint8 {
-	for i := uint8(1); i != 0; i++ {
-		if _, exists := cm.clients[i]; !exists {
-			return i
+	for id := 1; id <= MaxClients; id++ {
+		if _, exists := cm.clients[uint8(id)]; !exists {
+			return uint8(id)
 		}
 	}
 	return 0
 }
 
-func (cm *ClientManager) assignNextIP() string {
-	for i := 2; i <= 255; i++ {
-		ip := fmt.Sprintf("10.0.0.%d", i)
-		if _, exists := cm.ipToClient[ip]; !exists {
-			return ip
+// allocateIP claims preferredIP if it is set and the allocator can hand it
+// out, and otherwise takes the next free address. It must be called with the
+// mutex held.
+func (cm *ClientManager) allocateIP(preferredIP string) (string, error) {
+	if claimer, ok := cm.allocator.(IPClaimer); ok && preferredIP != "" {
+		ip := net.ParseIP(preferredIP)
+		if ip != nil && claimer.Claim(ip) == nil {
+			return ip.String(), nil
 		}
 	}
-	return ""
+
+	ip, err := cm.allocator.Allocate()
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// SetReservedIPs holds back tunnel IPs for configured clients, so they aren't
+// given to anyone who doesn't ask for them. It only has an effect if the
+// allocator supports reservations, as ReservationAllocator does.
+func (cm *ClientManager) SetReservedIPs(ips map[uint8]string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if reserver, ok := cm.allocator.(interface{ SetReserved(map[uint8]string) }); ok {
+		reserver.SetReserved(ips)
+	}
+}
+
+// serverIP returns the server's tunnel address
+func (cm *ClientManager) serverIP() string {
+	return cm.tunnelIP
+}
+
+// hostIP returns the address at the given offset within the subnet
+func hostIP(subnet *net.IPNet, offset int) string {
+	base := binary.BigEndian.Uint32(subnet.IP.To4())
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base+uint32(offset))
+	return ip.String()
 }
 
 func (cm *ClientManager) determineClient(packetData []byte) (uint8, error) {
@@ -231,7 +995,7 @@ func (cm *ClientManager) determineClient(packetData []byte) (uint8, error) {
 	sourceIP := fmt.Sprintf("%d.%d.%d.%d", packetData[12], packetData[13], packetData[14], packetData[15])
 	destinationIP := fmt.Sprintf("%d.%d.%d.%d", packetData[16], packetData[17], packetData[18], packetData[19])
 
-	if destinationIP == "10.0.0.1" {
+	if destinationIP == cm.serverIP() {
 		client, err := cm.GetClientByIP(sourceIP)
 		if err != nil {
 			return 0, fmt.Errorf("no client found for IP %s: %w", sourceIP, err)
@@ -240,8 +1004,29 @@ func (cm *ClientManager) determineClient(packetData []byte) (uint8, error) {
 	}
 
 	client, err := cm.GetClientByIP(destinationIP)
-	if err != nil {
+	if err == nil {
+		return client.ID, nil
+	}
+
+	// Site-to-site clients also route the networks behind them
+	clientID, ok := cm.findClientByAllowedIP(net.IP(packetData[16:20]))
+	if !ok {
 		return 0, fmt.Errorf("no client found for IP %s: %w", destinationIP, err)
 	}
-	return client.ID, nil
+	return clientID, nil
+}
+
+// findClientByAllowedIP returns the client whose allowed networks contain ip
+func (cm *ClientManager) findClientByAllowedIP(ip net.IP) (uint8, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	for _, client := range cm.clients {
+		for _, allowed := range client.AllowedIPs {
+			if allowed.Contains(ip) {
+				return client.ID, true
+			}
+		}
+	}
+	return 0, false
 }
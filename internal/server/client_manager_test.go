@@ -1,15 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/crypto"
 )
 
 func TestClientManager_AddClient(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Test adding first client
 	key1 := make([]byte, 32)
@@ -60,9 +67,112 @@ func TestClientManager_AddClient(t *testing.T) {
 	}
 }
 
+// TestClientManager_AddOrUpdateClient tests that adding a client whose key
+// already has a session starts a new session with the same ID and IP, once it
+// proves the key
+func TestClientManager_AddOrUpdateClient(t *testing.T) {
+	keyManager := crypto.NewKeyManager()
+	cm := NewClientManager(keyManager, nil)
+	defer cm.Close()
+
+	key := make([]byte, 32)
+	connectedAt := time.Now()
+	client, err := cm.AddOrUpdateClient(key, "192.168.1.100:12345", "", connectedAt)
+	if err != nil {
+		t.Fatalf("AddOrUpdateClient failed: %v", err)
+	}
+	err = cm.UpdateClientActivity(client.ID, 42)
+	if err != nil {
+		t.Fatalf("UpdateClientActivity failed: %v", err)
+	}
+
+	// Requests that don't prove the key later than the session's can't take
+	// it over
+	_, err = cm.AddOrUpdateClient(key, "192.168.1.100:23456", "", time.Time{})
+	if !errors.Is(err, ErrClientAlreadyExists) {
+		t.Errorf("Expected an unproven reconnect to fail with ErrClientAlreadyExists, got %v", err)
+	}
+	_, err = cm.AddOrUpdateClient(key, "192.168.1.100:23456", "", connectedAt)
+	if !errors.Is(err, ErrClientAlreadyExists) {
+		t.Errorf("Expected a replayed reconnect to fail with ErrClientAlreadyExists, got %v", err)
+	}
+	if found, err := cm.GetClientByAddress("192.168.1.100:12345"); err != nil || found.ID != client.ID || found.RxSeq != 42 {
+		t.Errorf("Expected the session at the old address to be kept, got %+v (%v)", found, err)
+	}
+
+	reconnected, err := cm.AddOrUpdateClient(key, "192.168.1.100:23456", "", connectedAt.Add(time.Second))
+	if err != nil {
+		t.Fatalf("Expected reconnect to succeed, got %v", err)
+	}
+
+	if reconnected.ID != client.ID || reconnected.IP != client.IP {
+		t.Errorf("Expected client %d with IP %s, got client %d with IP %s", client.ID, client.IP, reconnected.ID, reconnected.IP)
+	}
+	if reconnected.RxSeq != 0 {
+		t.Errorf("Expected a fresh session, got RxSeq %d", reconnected.RxSeq)
+	}
+	if _, err := cm.GetClientByAddress("192.168.1.100:12345"); err == nil {
+		t.Error("Expected the old address to be forgotten")
+	}
+	if found, err := cm.GetClientByAddress("192.168.1.100:23456"); err != nil || found.ID != client.ID {
+		t.Errorf("Expected the new address to find client %d, got %v", client.ID, err)
+	}
+	if clients := cm.ListClients(); len(clients) != 1 {
+		t.Errorf("Expected 1 client, got %d", len(clients))
+	}
+
+	// Another key still gets a client of its own
+	other, err := cm.AddOrUpdateClient(bytes.Repeat([]byte{1}, 32), "192.168.1.101:12345", "", time.Time{})
+	if err != nil {
+		t.Fatalf("AddOrUpdateClient failed: %v", err)
+	}
+	if other.ID == client.ID || other.IP == client.IP {
+		t.Errorf("Expected a new ID and IP, got client %d with IP %s", other.ID, other.IP)
+	}
+}
+
+// TestClientManager_SetTimeout tests that lowering the timeout removes idle
+// clients at the next check that the old timeout would have kept
+func TestClientManager_SetTimeout(t *testing.T) {
+	keyManager := crypto.NewKeyManager()
+	cm := NewClientManager(keyManager, nil)
+	defer cm.Close()
+
+	idle, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	active, err := cm.AddClient(bytes.Repeat([]byte{1}, 32), "192.168.1.101:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	cm.mutex.Lock()
+	idle.LastSeen = time.Now().Add(-10 * time.Minute)
+	cm.mutex.Unlock()
+
+	cm.CheckTimeouts()
+	if _, err := cm.GetClient(idle.ID); err != nil {
+		t.Fatalf("Expected the idle client to outlast the default timeout, got %v", err)
+	}
+
+	cm.SetTimeout(5 * time.Minute)
+	if timeout := cm.GetTimeout(); timeout != 5*time.Minute {
+		t.Errorf("Expected timeout 5m0s, got %s", timeout)
+	}
+
+	cm.CheckTimeouts()
+	if _, err := cm.GetClient(idle.ID); err != ErrClientNotFound {
+		t.Errorf("Expected the idle client to be removed, got %v", err)
+	}
+	if _, err := cm.GetClient(active.ID); err != nil {
+		t.Errorf("Expected the active client to stay, got %v", err)
+	}
+}
+
 func TestClientManager_RemoveClient(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Add a client
 	key := make([]byte, 32)
@@ -92,7 +202,7 @@ func TestClientManager_RemoveClient(t *testing.T) {
 
 func TestClientManager_GetClient(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Add a client
 	key := make([]byte, 32)
@@ -120,7 +230,7 @@ func TestClientManager_GetClient(t *testing.T) {
 
 func TestClientManager_GetClientByIP(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Add a client
 	key := make([]byte, 32)
@@ -148,7 +258,7 @@ func TestClientManager_GetClientByIP(t *testing.T) {
 
 func TestClientManager_UpdateClientActivity(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Add a client
 	key := make([]byte, 32)
@@ -184,7 +294,7 @@ func TestClientManager_UpdateClientActivity(t *testing.T) {
 
 func TestClientManager_ListClients(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Initially no clients
 	clients := cm.ListClients()
@@ -219,7 +329,7 @@ func TestClientManager_ListClients(t *testing.T) {
 
 func TestClientManager_IPAssignment(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Add multiple clients and check IP assignment
 	expectedIPs := []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}
@@ -243,7 +353,7 @@ func TestClientManager_IPAssignment(t *testing.T) {
 
 func TestClientManager_ConcurrentAccess(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
-	cm := NewClientManager(keyManager)
+	cm := NewClientManager(keyManager, nil)
 
 	// Test concurrent client additions
 	done := make(chan bool, 10)
@@ -274,3 +384,657 @@ func TestClientManager_ConcurrentAccess(t *testing.T) {
 		t.Errorf("Expected 10 clients, got %d", len(clients))
 	}
 }
+
+func TestClientManager_CustomSubnet(t *testing.T) {
+	keyManager := crypto.NewKeyManager()
+	_, subnet, err := net.ParseCIDR("172.16.5.0/24")
+	if err != nil {
+		t.Fatalf("Failed to parse subnet: %v", err)
+	}
+	cm := NewClientManager(keyManager, NewSequentialAllocator(subnet, ""))
+	cm.tunnelIP = "172.16.5.1"
+
+	key := make([]byte, 32)
+	client, err := cm.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	if client.IP != "172.16.5.2" {
+		t.Errorf("Expected IP 172.16.5.2, got %s", client.IP)
+	}
+
+	// Traffic to the server address is attributed to the sending client
+	clientID, err := cm.determineClient(createMockIPPacketWithAddrs("172.16.5.2", "172.16.5.1"))
+	if err != nil {
+		t.Fatalf("determineClient failed: %v", err)
+	}
+	if clientID != client.ID {
+		t.Errorf("Expected client %d, got %d", client.ID, clientID)
+	}
+}
+
+// TestClientManager_ServerIPOverride tests that an explicit server address is
+// skipped when assigning clients and treated as the gateway when routing
+func TestClientManager_ServerIPOverride(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.8.0.0/16")
+	cm := NewClientManager(crypto.NewKeyManager(), NewSequentialAllocator(subnet, "10.8.0.2"))
+	defer cm.Close()
+	cm.tunnelIP = "10.8.0.2"
+
+	first, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	second, err := cm.AddClient([]byte("another-32-byte-key-for-testing!"), "192.168.1.101:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	if first.IP != "10.8.0.1" || second.IP != "10.8.0.3" {
+		t.Errorf("Expected IPs 10.8.0.1 and 10.8.0.3, got %s and %s", first.IP, second.IP)
+	}
+
+	// Gateway-bound traffic is attributed to the sending client
+	clientID, err := cm.determineClient(createMockIPPacketWithAddrs("10.8.0.3", "10.8.0.2"))
+	if err != nil {
+		t.Fatalf("determineClient failed: %v", err)
+	}
+	if clientID != second.ID {
+		t.Errorf("Expected client %d, got %d", second.ID, clientID)
+	}
+
+	// The first host is an ordinary client now, not the gateway
+	clientID, err = cm.determineClient(createMockIPPacketWithAddrs("8.8.8.8", "10.8.0.1"))
+	if err != nil {
+		t.Fatalf("determineClient failed: %v", err)
+	}
+	if clientID != first.ID {
+		t.Errorf("Expected client %d, got %d", first.ID, clientID)
+	}
+}
+
+func TestClientManager_CloseStopsTimeoutChecker(t *testing.T) {
+	// Checkers from earlier tests may not be visible yet; let them settle
+	before := settledGoroutineCount("startTimeoutChecker")
+
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	if !waitForGoroutines("startTimeoutChecker", before+1) {
+		t.Fatalf("Expected %d timeout checkers, got %d", before+1, countGoroutines("startTimeoutChecker"))
+	}
+
+	cm.Close()
+	if !waitForGoroutines("startTimeoutChecker", before) {
+		t.Errorf("Expected timeout checker to exit, %d still running (was %d)", countGoroutines("startTimeoutChecker"), before)
+	}
+
+	// Closing twice must not panic
+	cm.Close()
+
+	// Managers built without the constructor have nothing to stop
+	(&ClientManager{}).Close()
+}
+
+// waitForGoroutines waits briefly for the goroutine count to settle at want
+func waitForGoroutines(function string, want int) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if countGoroutines(function) == want {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// settledGoroutineCount returns the goroutine count once it stops changing
+func settledGoroutineCount(function string) int {
+	count := countGoroutines(function)
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		next := countGoroutines(function)
+		if next == count {
+			break
+		}
+		count = next
+	}
+	return count
+}
+
+// countGoroutines counts running goroutines whose stack mentions the given function
+func countGoroutines(function string) int {
+	// Grow the buffer until every stack fits, or goroutines go uncounted
+	buf := make([]byte, 1<<20)
+	n := runtime.Stack(buf, true)
+	for n == len(buf) {
+		buf = make([]byte, 2*len(buf))
+		n = runtime.Stack(buf, true)
+	}
+	stacks := string(buf[:n])
+
+	count := 0
+	for _, stack := range strings.Split(stacks, "\n\n") {
+		if strings.Contains(stack, "."+function+"(") {
+			count++
+		}
+	}
+	return count
+}
+
+// createMockIPPacketWithAddrs creates a minimal IPv4 header with the given addresses
+func createMockIPPacketWithAddrs(srcIP, dstIP string) []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	copy(packet[12:16], net.ParseIP(srcIP).To4())
+	copy(packet[16:20], net.ParseIP(dstIP).To4())
+	return packet
+}
+
+func TestClientManager_IPPoolExhausted(t *testing.T) {
+	// A /29 leaves offsets 2-6 for clients
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/29")
+	cm := NewClientManager(crypto.NewKeyManager(), NewSequentialAllocator(subnet, ""))
+	defer cm.Close()
+
+	for i := 0; i < 5; i++ {
+		key := make([]byte, 32)
+		key[0] = byte(i + 1)
+		_, err := cm.AddClient(key, fmt.Sprintf("192.168.1.%d:12345", i+1))
+		if err != nil {
+			t.Fatalf("AddClient %d failed: %v", i+1, err)
+		}
+	}
+
+	key := make([]byte, 32)
+	key[0] = 99
+	_, err := cm.AddClient(key, "192.168.1.99:12345")
+	if !errors.Is(err, ErrIPPoolExhausted) {
+		t.Errorf("Expected ErrIPPoolExhausted, got %v", err)
+	}
+}
+
+// TestClientManager_ReusesLowestFreeID tests that a full manager rejects new
+// clients and that a freed ID is handed out again before any other
+func TestClientManager_ReusesLowestFreeID(t *testing.T) {
+	// Large enough that IPs never run out before IDs do
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/16")
+	cm := NewClientManager(crypto.NewKeyManager(), NewSequentialAllocator(subnet, ""))
+	defer cm.Close()
+
+	newKey := func(n int) []byte {
+		key := make([]byte, 32)
+		key[0] = byte(n)
+		key[1] = byte(n >> 8)
+		return key
+	}
+
+	for i := 1; i <= MaxClients; i++ {
+		client, err := cm.AddClient(newKey(i), fmt.Sprintf("192.168.1.1:%d", 10000+i))
+		if err != nil {
+			t.Fatalf("AddClient %d failed: %v", i, err)
+		}
+		if int(client.ID) != i {
+			t.Fatalf("Expected client ID %d, got %d", i, client.ID)
+		}
+	}
+
+	_, err := cm.AddClient(newKey(MaxClients+1), "192.168.1.1:20000")
+	if !errors.Is(err, ErrMaxClientsReached) {
+		t.Errorf("Expected ErrMaxClientsReached, got %v", err)
+	}
+
+	err = cm.RemoveClient(128)
+	if err != nil {
+		t.Fatalf("RemoveClient failed: %v", err)
+	}
+
+	client, err := cm.AddClient(newKey(MaxClients+2), "192.168.1.1:20001")
+	if err != nil {
+		t.Fatalf("AddClient after removal failed: %v", err)
+	}
+	if client.ID != 128 {
+		t.Errorf("Expected freed client ID 128 to be reused, got %d", client.ID)
+	}
+}
+
+// TestClientManager_RoutesAllowedIPs tests that traffic for a network behind
+// a site-to-site client is routed to that client
+func TestClientManager_RoutesAllowedIPs(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	_, site, _ := net.ParseCIDR("192.168.50.0/24")
+	err = cm.SetClientAllowedIPs(client.ID, []*net.IPNet{site})
+	if err != nil {
+		t.Fatalf("SetClientAllowedIPs failed: %v", err)
+	}
+
+	clientID, err := cm.determineClient(createMockIPPacketWithAddrs("8.8.8.8", "192.168.50.7"))
+	if err != nil {
+		t.Fatalf("determineClient failed: %v", err)
+	}
+	if clientID != client.ID {
+		t.Errorf("Expected client %d, got %d", client.ID, clientID)
+	}
+
+	_, err = cm.determineClient(createMockIPPacketWithAddrs("8.8.8.8", "192.168.51.7"))
+	if err == nil {
+		t.Error("Expected no client for an address outside every allowed network")
+	}
+}
+
+func TestClientManager_RecordRTT(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	// Each report is stored, but only marked changes are worth logging
+	reports := []struct {
+		rtt      time.Duration
+		logged   bool
+		previous time.Duration
+	}{
+		{40 * time.Millisecond, true, 0},
+		{50 * time.Millisecond, false, 40 * time.Millisecond},
+		{59 * time.Millisecond, false, 40 * time.Millisecond},
+		{60 * time.Millisecond, true, 40 * time.Millisecond},
+		{25 * time.Millisecond, true, 60 * time.Millisecond},
+	}
+
+	for _, report := range reports {
+		previous, logged, err := cm.RecordRTT(client.ID, report.rtt)
+		if err != nil {
+			t.Fatalf("RecordRTT failed: %v", err)
+		}
+		if logged != report.logged || previous != report.previous {
+			t.Errorf("Reporting %s: expected logged=%t previous=%s, got logged=%t previous=%s", report.rtt, report.logged, report.previous, logged, previous)
+		}
+
+		status, _ := cm.GetClientStatus(client.ID)
+		if status.RTT != report.rtt {
+			t.Errorf("Expected status RTT %s, got %s", report.rtt, status.RTT)
+		}
+	}
+
+	_, _, err = cm.RecordRTT(99, time.Millisecond)
+	if !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected ErrClientNotFound, got %v", err)
+	}
+}
+
+func TestClientManager_ListClientsSortedByID(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	// Insert out of order, as clients connecting and leaving would leave them
+	for _, id := range []uint8{9, 3, 200, 1, 42} {
+		cm.clients[id] = &Client{ID: id, IP: fmt.Sprintf("10.0.0.%d", id)}
+	}
+
+	expected := []uint8{1, 3, 9, 42, 200}
+
+	clients := cm.ListClients()
+	if len(clients) != len(expected) {
+		t.Fatalf("Expected %d clients, got %d", len(expected), len(clients))
+	}
+	for i, client := range clients {
+		if client.ID != expected[i] {
+			t.Errorf("Expected client %d at position %d, got %d", expected[i], i, client.ID)
+		}
+	}
+
+	status := cm.ClientStatuses()
+	for i, client := range status {
+		if client.ID != expected[i] {
+			t.Errorf("Expected status for client %d at position %d, got %d", expected[i], i, client.ID)
+		}
+	}
+}
+
+// TestClientManager_SnapshotDuringUpdates reads snapshots while another
+// goroutine updates client activity; run with -race to catch shared reads
+func TestClientManager_SnapshotDuringUpdates(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sequence := uint32(1); sequence <= 1000; sequence++ {
+			cm.UpdateClientActivity(client.ID, sequence)
+			cm.RecordReceived(client.ID, 100, 130)
+		}
+	}()
+
+	var lastSeq uint32
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		clients := cm.Snapshot()
+		if len(clients) != 1 {
+			t.Fatalf("Expected 1 client, got %d", len(clients))
+		}
+		if clients[0].RxSeq < lastSeq {
+			t.Fatalf("Expected sequence to only grow, got %d after %d", clients[0].RxSeq, lastSeq)
+		}
+		lastSeq = clients[0].RxSeq
+	}
+
+	// Copies don't follow later updates
+	clients := cm.Snapshot()
+	cm.UpdateClientActivity(client.ID, 1001)
+	if clients[0].RxSeq != 1000 {
+		t.Errorf("Expected snapshot to keep sequence 1000, got %d", clients[0].RxSeq)
+	}
+}
+
+// TestClientManager_SequencesPerDirection tests that receiving from and
+// sending to a client at the same time advance separate counters, and that
+// every send gets a sequence of its own
+func TestClientManager_SequencesPerDirection(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+
+	const count = 500
+	sent := make(chan uint32, count)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count/4; j++ {
+				sequence, err := cm.NextTxSequence(client.ID)
+				if err != nil {
+					t.Errorf("NextTxSequence failed: %v", err)
+					return
+				}
+				sent <- sequence
+			}
+		}()
+	}
+	for sequence := uint32(1); sequence <= count; sequence++ {
+		err := cm.UpdateClientActivity(client.ID, sequence)
+		if err != nil {
+			t.Fatalf("Expected sequence %d from the client to be accepted, got %v", sequence, err)
+		}
+	}
+	wg.Wait()
+	close(sent)
+
+	seen := make(map[uint32]bool)
+	for sequence := range sent {
+		if seen[sequence] || sequence < 1 || sequence > count {
+			t.Fatalf("Expected unique send sequences 1-%d, got %d twice or out of range", count, sequence)
+		}
+		seen[sequence] = true
+	}
+
+	clients := cm.Snapshot()
+	if clients[0].RxSeq != count || clients[0].TxSeq != count {
+		t.Errorf("Expected RxSeq and TxSeq %d, got %d and %d", count, clients[0].RxSeq, clients[0].TxSeq)
+	}
+
+	_, err = cm.NextTxSequence(99)
+	if !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected ErrClientNotFound, got %v", err)
+	}
+}
+
+// TestClientManager_AddClientWithIP tests that a preferred address is honored
+// only when it is a free host address within the subnet
+func TestClientManager_AddClientWithIP(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	key := make([]byte, 32)
+
+	honored, err := cm.AddClientWithIP(key, "192.168.1.100:12345", "10.0.0.50")
+	if err != nil {
+		t.Fatalf("AddClientWithIP failed: %v", err)
+	}
+	if honored.IP != "10.0.0.50" {
+		t.Errorf("Expected requested IP 10.0.0.50, got %s", honored.IP)
+	}
+
+	tests := []struct {
+		name      string
+		preferred string
+	}{
+		{"taken", "10.0.0.50"},
+		{"outside subnet", "192.168.7.9"},
+		{"server address", "10.0.0.1"},
+		{"network address", "10.0.0.0"},
+		{"not an address", "bogus"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := bytes.Repeat([]byte{byte(i + 1)}, 32)
+			client, err := cm.AddClientWithIP(key, fmt.Sprintf("192.168.1.%d:12345", 101+i), tt.preferred)
+			if err != nil {
+				t.Fatalf("AddClientWithIP failed: %v", err)
+			}
+
+			// Falls back to the next free address
+			expected := fmt.Sprintf("10.0.0.%d", 2+i)
+			if client.IP != expected {
+				t.Errorf("Expected fallback IP %s, got %s", expected, client.IP)
+			}
+		})
+	}
+}
+
+// TestClientManager_SkipsReservedIPs tests that automatic assignment never
+// hands out an address reserved for a configured client
+func TestClientManager_SkipsReservedIPs(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR(DefaultSubnet)
+	cm := NewClientManager(crypto.NewKeyManager(), NewReservationAllocator(subnet, "", nil))
+	defer cm.Close()
+	cm.SetReservedIPs(map[uint8]string{3: "10.0.0.2", 4: "10.0.0.3"})
+	key := make([]byte, 32)
+
+	client, err := cm.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	if client.IP != "10.0.0.4" {
+		t.Errorf("Expected IP 10.0.0.4, got %s", client.IP)
+	}
+
+	// The owner of a reservation still gets it
+	owner, err := cm.AddClientWithIP(bytes.Repeat([]byte{1}, 32), "192.168.1.101:12345", "10.0.0.3")
+	if err != nil {
+		t.Fatalf("AddClientWithIP failed: %v", err)
+	}
+	if owner.IP != "10.0.0.3" {
+		t.Errorf("Expected reserved IP 10.0.0.3, got %s", owner.IP)
+	}
+}
+
+func TestClientManager_GetClientByAddress(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	found, err := cm.GetClientByAddress("192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("GetClientByAddress failed: %v", err)
+	}
+	if found.ID != client.ID {
+		t.Errorf("Expected client %d, got %d", client.ID, found.ID)
+	}
+
+	_, err = cm.GetClientByAddress("192.168.1.100:54321")
+	if !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected ErrClientNotFound for an unknown address, got %v", err)
+	}
+
+	// Roaming moves the lookup to the new address
+	roamed, _ := net.ResolveUDPAddr("udp", "203.0.113.9:40000")
+	_, err = cm.UpdateClientAddress(client.ID, roamed)
+	if err != nil {
+		t.Fatalf("UpdateClientAddress failed: %v", err)
+	}
+	if _, err := cm.GetClientByAddress("192.168.1.100:12345"); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected old address to be forgotten after roaming, got %v", err)
+	}
+	if found, err := cm.GetClientByAddress("203.0.113.9:40000"); err != nil || found.ID != client.ID {
+		t.Errorf("Expected new address to map to client %d, got %v (%v)", client.ID, found, err)
+	}
+
+	err = cm.RemoveClient(client.ID)
+	if err != nil {
+		t.Fatalf("RemoveClient failed: %v", err)
+	}
+	if _, err := cm.GetClientByAddress("203.0.113.9:40000"); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected address to be forgotten after removal, got %v", err)
+	}
+}
+
+// TestClientManager_UpdateControlActivity tests that control packets from a
+// client on the data plane are checked against their own sequence, and
+// against the data sequence otherwise
+func TestClientManager_UpdateControlActivity(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	err = cm.UpdateClientActivity(client.ID, 10)
+	if err != nil {
+		t.Fatalf("UpdateClientActivity failed: %v", err)
+	}
+	err = cm.UpdateControlActivity(client.ID, 5)
+	if !errors.Is(err, ErrInvalidSequence) {
+		t.Errorf("Expected ErrInvalidSequence for a ping behind the data, got %v", err)
+	}
+
+	err = cm.SetClientDataPlane(client.ID, true)
+	if err != nil {
+		t.Fatalf("SetClientDataPlane failed: %v", err)
+	}
+	err = cm.UpdateControlActivity(client.ID, 5)
+	if err != nil {
+		t.Errorf("Expected a ping overtaken by data on the data socket to be accepted, got %v", err)
+	}
+	err = cm.UpdateControlActivity(client.ID, 5)
+	if !errors.Is(err, ErrInvalidSequence) {
+		t.Errorf("Expected ErrInvalidSequence for a replayed ping, got %v", err)
+	}
+}
+
+// TestClientManager_DataAddress tests tracking where a client's data packets
+// arrive from, apart from its control address
+func TestClientManager_DataAddress(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	client, err := cm.AddClient(make([]byte, 32), "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	if addr := cm.GetClientDataAddr(client.ID); addr != nil {
+		t.Errorf("Expected no data address before any data, got %s", addr)
+	}
+
+	dataAddr, _ := net.ResolveUDPAddr("udp", "192.168.1.100:23456")
+	err = cm.UpdateClientDataAddress(client.ID, dataAddr)
+	if err != nil {
+		t.Fatalf("UpdateClientDataAddress failed: %v", err)
+	}
+	if addr := cm.GetClientDataAddr(client.ID); addr == nil || addr.String() != dataAddr.String() {
+		t.Errorf("Expected data address %s, got %v", dataAddr, addr)
+	}
+	if found, err := cm.GetClientByDataAddress(dataAddr.String()); err != nil || found.ID != client.ID {
+		t.Errorf("Expected data address to map to client %d, got %v (%v)", client.ID, found, err)
+	}
+	if addr, _ := cm.GetClientAddr(client.ID); addr.String() != "192.168.1.100:12345" {
+		t.Errorf("Expected the control address to stay put, got %s", addr)
+	}
+
+	err = cm.RemoveClient(client.ID)
+	if err != nil {
+		t.Fatalf("RemoveClient failed: %v", err)
+	}
+	if _, err := cm.GetClientByDataAddress(dataAddr.String()); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected data address to be forgotten after removal, got %v", err)
+	}
+}
+
+// TestClientManager_Uptime tests that a session's uptime grows, survives the
+// client roaming and starts over when the client reconnects
+func TestClientManager_Uptime(t *testing.T) {
+	cm := NewClientManager(crypto.NewKeyManager(), nil)
+	defer cm.Close()
+
+	key := make([]byte, 32)
+	client, err := cm.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	connectedSince := client.ConnectedSince
+
+	time.Sleep(20 * time.Millisecond)
+	status, _ := cm.GetClientStatus(client.ID)
+	if status.Uptime < 20*time.Millisecond {
+		t.Errorf("Expected uptime of at least 20ms, got %v", status.Uptime)
+	}
+	if !status.ConnectedSince.Equal(connectedSince) {
+		t.Errorf("Expected connected since %v, got %v", connectedSince, status.ConnectedSince)
+	}
+
+	roamed, _ := net.ResolveUDPAddr("udp", "203.0.113.9:40000")
+	_, err = cm.UpdateClientAddress(client.ID, roamed)
+	if err != nil {
+		t.Fatalf("UpdateClientAddress failed: %v", err)
+	}
+	status, _ = cm.GetClientStatus(client.ID)
+	if !status.ConnectedSince.Equal(connectedSince) {
+		t.Errorf("Expected roaming to keep the session start, got %v instead of %v", status.ConnectedSince, connectedSince)
+	}
+
+	// Reconnecting sets up a new session
+	err = cm.RemoveClient(client.ID)
+	if err != nil {
+		t.Fatalf("RemoveClient failed: %v", err)
+	}
+	client, err = cm.AddClient(key, "203.0.113.9:40001")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	status, _ = cm.GetClientStatus(client.ID)
+	if !status.ConnectedSince.After(connectedSince) {
+		t.Errorf("Expected reconnecting to start a new session, got connected since %v", status.ConnectedSince)
+	}
+	if status.Uptime >= 20*time.Millisecond {
+		t.Errorf("Expected uptime to start over after reconnecting, got %v", status.Uptime)
+	}
+}
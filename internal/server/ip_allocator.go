@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrIPUnavailable is returned by Claim for an address outside the pool or
+// already in use
+var ErrIPUnavailable = errors.New("IP address unavailable")
+
+// IPAllocator hands out tunnel addresses to clients. ClientManager calls it
+// with its mutex held, so implementations don't need locking of their own
+// unless they share state with something else, such as an external IPAM.
+type IPAllocator interface {
+	// Allocate takes a free address out of the pool, returning
+	// ErrIPPoolExhausted if none is left
+	Allocate() (net.IP, error)
+
+	// Release returns an address handed out by Allocate or Claim to the pool
+	Release(ip net.IP)
+}
+
+// IPClaimer is implemented by allocators that can hand out a particular
+// address, so clients that ask for one can be given it. With allocators that
+// don't implement it, requested addresses are ignored.
+type IPClaimer interface {
+	// Claim takes ip out of the pool, returning ErrIPUnavailable if it isn't
+	// part of the pool or is already in use
+	Claim(ip net.IP) error
+}
+
+// SequentialAllocator hands out the lowest free host address of a subnet,
+// skipping the network and broadcast addresses and the server's own address
+type SequentialAllocator struct {
+	subnet   *net.IPNet
+	serverIP string
+	used     map[string]bool
+}
+
+// NewSequentialAllocator creates an allocator for subnet. An empty serverIP
+// selects the subnet's first host as the server's address.
+func NewSequentialAllocator(subnet *net.IPNet, serverIP string) *SequentialAllocator {
+	if serverIP == "" {
+		serverIP = hostIP(subnet, 1)
+	}
+
+	return &SequentialAllocator{
+		subnet:   subnet,
+		serverIP: serverIP,
+		used:     make(map[string]bool),
+	}
+}
+
+func (a *SequentialAllocator) Allocate() (net.IP, error) {
+	return a.allocate(nil)
+}
+
+// allocate takes the lowest free address that skip doesn't reject
+func (a *SequentialAllocator) allocate(skip func(ip string) bool) (net.IP, error) {
+	ones, bits := a.subnet.Mask.Size()
+	size := 1 << (bits - ones)
+
+	// Offset 0 is the network address and the last the broadcast address
+	for i := 1; i < size-1; i++ {
+		ip := hostIP(a.subnet, i)
+		if ip == a.serverIP || a.used[ip] || (skip != nil && skip(ip)) {
+			continue
+		}
+
+		a.used[ip] = true
+		return net.ParseIP(ip), nil
+	}
+
+	return nil, ErrIPPoolExhausted
+}
+
+func (a *SequentialAllocator) Claim(ip net.IP) error {
+	if !isHostAddress(a.subnet, ip) {
+		return fmt.Errorf("%w: %s is not a host address in %s", ErrIPUnavailable, ip, a.subnet)
+	}
+
+	key := ip.To4().String()
+	if key == a.serverIP || a.used[key] {
+		return fmt.Errorf("%w: %s is in use", ErrIPUnavailable, key)
+	}
+
+	a.used[key] = true
+	return nil
+}
+
+func (a *SequentialAllocator) Release(ip net.IP) {
+	delete(a.used, ip.String())
+}
+
+// isHostAddress reports whether ip is an IPv4 address within subnet other
+// than its network and broadcast addresses, which can't be given to a client
+func isHostAddress(subnet *net.IPNet, ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil || !subnet.Contains(ip) {
+		return false
+	}
+
+	ones, bits := subnet.Mask.Size()
+	offset := binary.BigEndian.Uint32(ip) - binary.BigEndian.Uint32(subnet.IP.To4())
+	return offset != 0 && offset != 1<<(bits-ones)-1
+}
+
+// ReservationAllocator is a SequentialAllocator that holds back the static
+// addresses of configured clients, so Allocate never gives them to anyone
+// else. They can still be claimed; the caller checks that the client asking
+// for one is the one it is reserved for.
+type ReservationAllocator struct {
+	*SequentialAllocator
+	reserved map[string]bool
+}
+
+// NewReservationAllocator creates an allocator for subnet that holds back
+// reserved, the static address of each configured client ID
+func NewReservationAllocator(subnet *net.IPNet, serverIP string, reserved map[uint8]string) *ReservationAllocator {
+	a := &ReservationAllocator{SequentialAllocator: NewSequentialAllocator(subnet, serverIP)}
+	a.SetReserved(reserved)
+	return a
+}
+
+func (a *ReservationAllocator) Allocate() (net.IP, error) {
+	return a.allocate(func(ip string) bool { return a.reserved[ip] })
+}
+
+// SetReserved replaces the reserved addresses, e.g. after a reload. Addresses
+// already handed out stay with their clients.
+func (a *ReservationAllocator) SetReserved(reserved map[uint8]string) {
+	a.reserved = make(map[string]bool, len(reserved))
+	for _, ip := range reserved {
+		a.reserved[ip] = true
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+)
+
+func mustAllocate(t *testing.T, allocator IPAllocator) string {
+	t.Helper()
+
+	ip, err := allocator.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	return ip.String()
+}
+
+func TestSequentialAllocator_AllocateReleaseReuse(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/29")
+	allocator := NewSequentialAllocator(subnet, "")
+
+	// Offset 1 is the server and 7 the broadcast address, leaving offsets 2-6
+	expected := []string{"10.9.0.2", "10.9.0.3", "10.9.0.4", "10.9.0.5", "10.9.0.6"}
+	for _, want := range expected {
+		if got := mustAllocate(t, allocator); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+
+	_, err := allocator.Allocate()
+	if !errors.Is(err, ErrIPPoolExhausted) {
+		t.Errorf("Expected ErrIPPoolExhausted, got %v", err)
+	}
+
+	// Released addresses are handed out again, lowest first
+	allocator.Release(net.ParseIP("10.9.0.5"))
+	allocator.Release(net.ParseIP("10.9.0.3"))
+	if got := mustAllocate(t, allocator); got != "10.9.0.3" {
+		t.Errorf("Expected released 10.9.0.3 to be reused, got %s", got)
+	}
+	if got := mustAllocate(t, allocator); got != "10.9.0.5" {
+		t.Errorf("Expected released 10.9.0.5 to be reused, got %s", got)
+	}
+}
+
+func TestSequentialAllocator_SkipsServerIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.8.0.0/24")
+	allocator := NewSequentialAllocator(subnet, "10.8.0.2")
+
+	for _, want := range []string{"10.8.0.1", "10.8.0.3"} {
+		if got := mustAllocate(t, allocator); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+// TestSequentialAllocator_Slash30 tests that a /30 has a single client
+// address, the broadcast address being neither allocated nor claimable
+func TestSequentialAllocator_Slash30(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/30")
+	allocator := NewSequentialAllocator(subnet, "")
+
+	if got := mustAllocate(t, allocator); got != "10.9.0.2" {
+		t.Errorf("Expected 10.9.0.2, got %s", got)
+	}
+	_, err := allocator.Allocate()
+	if !errors.Is(err, ErrIPPoolExhausted) {
+		t.Errorf("Expected ErrIPPoolExhausted after the only client address, got %v", err)
+	}
+
+	err = allocator.Claim(net.ParseIP("10.9.0.3"))
+	if !errors.Is(err, ErrIPUnavailable) {
+		t.Errorf("Expected the broadcast address to be unavailable, got %v", err)
+	}
+
+	if _, usable := SubnetCapacity(subnet); usable != 1 {
+		t.Errorf("Expected 1 usable address, got %d", usable)
+	}
+}
+
+func TestSequentialAllocator_Claim(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/24")
+	allocator := NewSequentialAllocator(subnet, "")
+
+	err := allocator.Claim(net.ParseIP("10.9.0.2"))
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"already claimed", "10.9.0.2"},
+		{"server address", "10.9.0.1"},
+		{"network address", "10.9.0.0"},
+		{"broadcast address", "10.9.0.255"},
+		{"outside subnet", "10.10.0.2"},
+		{"IPv6", "fd00::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := allocator.Claim(net.ParseIP(tt.ip))
+			if !errors.Is(err, ErrIPUnavailable) {
+				t.Errorf("Expected ErrIPUnavailable for %s, got %v", tt.ip, err)
+			}
+		})
+	}
+
+	// Allocate steps over the claimed address
+	if got := mustAllocate(t, allocator); got != "10.9.0.3" {
+		t.Errorf("Expected 10.9.0.3, got %s", got)
+	}
+
+	allocator.Release(net.ParseIP("10.9.0.2"))
+	err = allocator.Claim(net.ParseIP("10.9.0.2"))
+	if err != nil {
+		t.Errorf("Expected released address to be claimable, got %v", err)
+	}
+}
+
+func TestReservationAllocator(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.9.0.0/24")
+	allocator := NewReservationAllocator(subnet, "", map[uint8]string{3: "10.9.0.2", 4: "10.9.0.4"})
+
+	for _, want := range []string{"10.9.0.3", "10.9.0.5"} {
+		if got := mustAllocate(t, allocator); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+
+	// Reserved addresses can still be claimed by their owners
+	err := allocator.Claim(net.ParseIP("10.9.0.4"))
+	if err != nil {
+		t.Errorf("Expected reserved address to be claimable, got %v", err)
+	}
+
+	// Dropping a reservation frees it for anyone
+	allocator.SetReserved(map[uint8]string{4: "10.9.0.4"})
+	if got := mustAllocate(t, allocator); got != "10.9.0.2" {
+		t.Errorf("Expected unreserved 10.9.0.2, got %s", got)
+	}
+}
+
+// staticAllocator hands out a fixed list of addresses, standing in for an
+// external IPAM
+type staticAllocator struct {
+	free     []string
+	released []string
+}
+
+func (a *staticAllocator) Allocate() (net.IP, error) {
+	if len(a.free) == 0 {
+		return nil, ErrIPPoolExhausted
+	}
+	ip := a.free[0]
+	a.free = a.free[1:]
+	return net.ParseIP(ip), nil
+}
+
+func (a *staticAllocator) Release(ip net.IP) {
+	a.released = append(a.released, ip.String())
+	a.free = append(a.free, ip.String())
+}
+
+// TestClientManager_CustomAllocator tests that the client manager takes
+// addresses from an injected allocator and gives them back on removal
+func TestClientManager_CustomAllocator(t *testing.T) {
+	allocator := &staticAllocator{free: []string{"192.0.2.10", "192.0.2.20"}}
+	cm := NewClientManager(crypto.NewKeyManager(), allocator)
+	defer cm.Close()
+
+	first, err := cm.AddClient(bytes.Repeat([]byte{1}, 32), "198.51.100.1:1194")
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+	if first.IP != "192.0.2.10" {
+		t.Errorf("Expected IP 192.0.2.10, got %s", first.IP)
+	}
+
+	// Allocators that can't claim addresses ignore requested ones
+	second, err := cm.AddClientWithIP(bytes.Repeat([]byte{2}, 32), "198.51.100.2:1194", "192.0.2.99")
+	if err != nil {
+		t.Fatalf("AddClientWithIP failed: %v", err)
+	}
+	if second.IP != "192.0.2.20" {
+		t.Errorf("Expected IP 192.0.2.20, got %s", second.IP)
+	}
+
+	_, err = cm.AddClient(bytes.Repeat([]byte{3}, 32), "198.51.100.3:1194")
+	if !errors.Is(err, ErrIPPoolExhausted) {
+		t.Errorf("Expected ErrIPPoolExhausted, got %v", err)
+	}
+
+	err = cm.RemoveClient(first.ID)
+	if err != nil {
+		t.Fatalf("RemoveClient failed: %v", err)
+	}
+	if len(allocator.released) != 1 || allocator.released[0] != "192.0.2.10" {
+		t.Errorf("Expected 192.0.2.10 to be released, got %v", allocator.released)
+	}
+
+	third, err := cm.AddClient(bytes.Repeat([]byte{3}, 32), "198.51.100.3:1194")
+	if err != nil {
+		t.Fatalf("AddClient after removal failed: %v", err)
+	}
+	if third.IP != "192.0.2.10" {
+		t.Errorf("Expected released IP 192.0.2.10 to be reused, got %s", third.IP)
+	}
+}
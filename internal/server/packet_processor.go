@@ -1,59 +1,217 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/crypto"
 	"github.com/pepalonsocosta/fvp/internal/network"
 	"github.com/pepalonsocosta/fvp/internal/protocol"
 )
 
+// ErrDecryptFailed is returned by ProcessPacket for a packet that doesn't
+// decrypt with its client's keys
+var ErrDecryptFailed = errors.New("failed to decrypt payload")
+
 type PacketProcessor struct {
 	tunInterface  network.TUNInterface
 	keyManager    *crypto.KeyManager
 	clientManager *ClientManager
-	udpConn       *net.UDPConn
+	transport     network.Transport
+	dataTransport network.Transport   // Sends data packets from the data socket; nil sends them through transport
+	tunQueue      *network.WriteQueue // Writes to tunInterface in the background; nil writes inline
+	maxMSS        uint16              // TCP MSS clamp for tunneled SYNs, zero to leave them alone
+	maxPayload    int                 // Largest payload to encrypt, so datagrams fit max_udp_payload; zero for no limit
+	wireOverhead  int                 // Bytes the transport adds to each datagram, i.e. the network MAC
+	trace         bool                // Log every data packet, see Server.SetPacketTrace
+	tooLarge      atomic.Uint64       // Packets dropped for exceeding maxPayload
+	tooLargeLog   atomic.Int64        // When the last too-large warning was logged, in Unix nanoseconds
+	sendFailed    atomic.Uint64       // Packets for clients the socket failed to send, e.g. for full buffers
+	capture       *network.PcapWriter // Records decrypted packets in both directions for debugging; nil records nothing
+	dnsRelay      *dnsRelay           // Answers DNS queries to the server's tunnel IP; nil leaves them to the host
 }
 
-func NewPacketProcessor(tunInterface network.TUNInterface, keyManager *crypto.KeyManager, clientManager *ClientManager, udpConn *net.UDPConn) *PacketProcessor {
+// tooLargeLogInterval rate-limits the too-large packet warning, since a
+// sender that ignores the MTU keeps sending packets that won't fit
+const tooLargeLogInterval = 10 * time.Second
+
+func NewPacketProcessor(tunInterface network.TUNInterface, keyManager *crypto.KeyManager, clientManager *ClientManager, transport network.Transport) *PacketProcessor {
 	return &PacketProcessor{
 		tunInterface:  tunInterface,
 		keyManager:    keyManager,
 		clientManager: clientManager,
-		udpConn:       udpConn,
+		transport:     transport,
 	}
 }
 
-func (pp *PacketProcessor) ProcessPacket(packetData []byte) error {
-	
+// EnableWriteQueue makes ProcessPacket hand decrypted packets to a TUN writer
+// goroutine holding up to size packets, so a slow TUN interface drops
+// packets instead of stalling the socket reader. Call it before processing
+// packets and Close when done.
+func (pp *PacketProcessor) EnableWriteQueue(size int) {
+	pp.tunQueue = network.NewWriteQueue(pp.tunInterface, size)
+}
+
+// Close waits for queued packets to be written to the TUN interface
+func (pp *PacketProcessor) Close() {
+	if pp.tunQueue != nil {
+		pp.tunQueue.Close()
+	}
+	pp.dnsRelay.Close()
+}
+
+// DroppedPackets returns how many client packets were dropped because the
+// TUN interface couldn't keep up
+func (pp *PacketProcessor) DroppedPackets() uint64 {
+	if pp.tunQueue == nil {
+		return 0
+	}
+	return pp.tunQueue.Dropped()
+}
+
+// QueuedPackets returns how many client packets were queued for the TUN
+// interface, and how many of them are still waiting to be written
+func (pp *PacketProcessor) QueuedPackets() (queued uint64, waiting int) {
+	if pp.tunQueue == nil {
+		return 0, 0
+	}
+	return pp.tunQueue.Queued(), pp.tunQueue.Depth()
+}
+
+// FailedSends returns how many packets for clients were dropped because the
+// socket failed to send them
+func (pp *PacketProcessor) FailedSends() uint64 {
+	return pp.sendFailed.Load()
+}
+
+// TooLargePackets returns how many packets for clients were dropped because
+// their datagram wouldn't fit in max_udp_payload
+func (pp *PacketProcessor) TooLargePackets() uint64 {
+	return pp.tooLarge.Load()
+}
+
+// ResetCounters sets the queued and dropped packet counts back to zero
+func (pp *PacketProcessor) ResetCounters() {
+	if pp.tunQueue != nil {
+		pp.tunQueue.ResetCounters()
+	}
+	pp.tooLarge.Store(0)
+	pp.sendFailed.Store(0)
+}
+
+// ProcessPacket decrypts a data packet and writes it to the TUN interface.
+// If clientAddr is set and differs from the client's recorded address, the
+// client is treated as having roamed once the packet authenticates.
+func (pp *PacketProcessor) ProcessPacket(packetData []byte, clientAddr *net.UDPAddr) error {
+	return pp.processPacket(packetData, clientAddr, false)
+}
+
+// ProcessDataPlanePacket is ProcessPacket for a packet from the data socket.
+// clientAddr becomes the client's data address, which data packets to it are
+// sent to, leaving the address control packets go to alone.
+func (pp *PacketProcessor) ProcessDataPlanePacket(packetData []byte, clientAddr *net.UDPAddr) error {
+	return pp.processPacket(packetData, clientAddr, true)
+}
+
+func (pp *PacketProcessor) processPacket(packetData []byte, clientAddr *net.UDPAddr, dataPlane bool) error {
 	packet, err := protocol.DecodePacket(packetData)
 	if err != nil {
 		return fmt.Errorf("failed to decode packet: %w", err)
 	}
 	
+	// A source address already tied to another client can't be a roam, so
+	// the claimed client ID is forged
+	if clientAddr != nil {
+		lookup := pp.clientManager.GetClientByAddress
+		if dataPlane {
+			lookup = pp.clientManager.GetClientByDataAddress
+		}
+		owner, err := lookup(clientAddr.String())
+		if err == nil && owner.ID != packet.ClientID {
+			return fmt.Errorf("dropping packet claiming client %d from %s, which belongs to client %d", packet.ClientID, clientAddr, owner.ID)
+		}
+	}
+
 	client, err := pp.clientManager.GetClient(packet.ClientID)
 	if err != nil {
 		return fmt.Errorf("failed to get client %d: %w", packet.ClientID, err)
 	}
 
+	decryptedPayload, err := client.Keys.Open(client.Cipher, packet.Payload, packet.Sequence)
+	if err != nil {
+		if pp.trace {
+			tracePacket("recv", clientAddr, packet, "decrypt failed", nil)
+		}
+		return fmt.Errorf("%w for client %d: %w", ErrDecryptFailed, packet.ClientID, err)
+	}
+
+	if packet.Flags&protocol.PacketFlagCompressed != 0 {
+		if !client.Compress {
+			return fmt.Errorf("compressed packet from client %d without negotiated compression", packet.ClientID)
+		}
+		decryptedPayload, err = protocol.DecompressPayload(decryptedPayload)
+		if err != nil {
+			return fmt.Errorf("failed to decompress payload for client %d: %w", packet.ClientID, err)
+		}
+	}
+
+	if pp.trace {
+		tracePacket("recv", clientAddr, packet, "decrypted", decryptedPayload)
+	}
+
+	// Clients may only send from their own tunnel IP or allowed networks,
+	// otherwise one client could impersonate another
+	if !client.allowsSource(decryptedPayload) {
+		return fmt.Errorf("dropping packet from client %d: source address not allowed", packet.ClientID)
+	}
+
+	if pp.maxMSS > 0 {
+		network.ClampMSS(decryptedPayload, pp.maxMSS)
+	}
+
+	// Session state only changes for packets that authenticate, so forged
+	// packets can neither advance the sequence nor redirect replies
 	err = pp.clientManager.UpdateClientActivity(packet.ClientID, packet.Sequence)
 	if err != nil {
 		return fmt.Errorf("failed to update client activity: %w", err)
 	}
-	
-	decryptedPayload, err := crypto.DecryptPayload(packet.Payload, client.Key, packet.Sequence)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt payload for client %d: %w", packet.ClientID, err)
+
+	if clientAddr != nil && dataPlane {
+		err = pp.clientManager.UpdateClientDataAddress(packet.ClientID, clientAddr)
+		if err != nil {
+			return fmt.Errorf("failed to update data address for client %d: %w", packet.ClientID, err)
+		}
+	} else if clientAddr != nil {
+		_, err = pp.clientManager.UpdateClientAddress(packet.ClientID, clientAddr)
+		if err != nil {
+			return fmt.Errorf("failed to update address for client %d: %w", packet.ClientID, err)
+		}
 	}
 
+	pp.capture.WritePacket(decryptedPayload)
+
+	if pp.dnsRelay.Relay(decryptedPayload) {
+		// Answered through the tunnel rather than by the host
+	} else if pp.tunQueue != nil {
+		// Dropped packets are counted by the queue and not as received
+		if !pp.tunQueue.Enqueue(decryptedPayload) {
+			return nil
+		}
+	} else {
+		err = pp.tunInterface.WritePacket(decryptedPayload)
+		if err != nil {
+			return fmt.Errorf("failed to write packet for client %d: %w", packet.ClientID, err)
+		}
+	}
 
-	err = pp.tunInterface.WritePacket(decryptedPayload)
+	err = pp.clientManager.RecordReceived(packet.ClientID, len(decryptedPayload), len(packetData)+pp.wireOverhead)
 	if err != nil {
-		return fmt.Errorf("failed to write packet for client %d: %w", packet.ClientID, err)
+		return fmt.Errorf("failed to record traffic for client %d: %w", packet.ClientID, err)
 	}
-	
 
 	return nil
 }
@@ -63,7 +221,16 @@ func (pp *PacketProcessor) ProcessOutgoingPacket() error {
 	if err != nil {
 		return fmt.Errorf("failed to read from TUN: %w", err)
 	}
+	if len(packetData) == 0 {
+		return nil
+	}
 
+	return pp.RoutePacket(packetData)
+}
+
+// RoutePacket encrypts an IP packet read from the TUN interface and sends it
+// to the client owning its address
+func (pp *PacketProcessor) RoutePacket(packetData []byte) error {
 	clientID, err := pp.clientManager.determineClient(packetData)
 	if err != nil {
 		return err
@@ -85,41 +252,89 @@ func (pp *PacketProcessor) ProcessOutgoingPacket() error {
 }
 
 func (pp *PacketProcessor) createAndSendPacket(client *Client, ipData []byte) error {
-	packet := &protocol.Packet{
-		Magic:    [3]byte{'F', 'V', 'P'},
-		Type:     protocol.PacketTypeData,
-		ClientID: client.ID,
-		Sequence: client.LastSeq + 1,
-		Length:   uint16(len(ipData)),
-		Version:  protocol.ProtocolVersionByte,
-		Payload:  ipData,
+	if pp.maxMSS > 0 {
+		network.ClampMSS(ipData, pp.maxMSS)
 	}
-	
+
+	payload := ipData
+	compressed := false
+	if client.Compress {
+		payload, compressed = protocol.CompressPayload(ipData)
+	}
+
+	// A datagram over the path MTU would be fragmented or lost on the way,
+	// so drop it here where it can be counted
+	if pp.maxPayload > 0 && len(payload) > pp.maxPayload {
+		dropped := pp.tooLarge.Add(1)
+		last := pp.tooLargeLog.Load()
+		if time.Since(time.Unix(0, last)) >= tooLargeLogInterval && pp.tooLargeLog.CompareAndSwap(last, time.Now().UnixNano()) {
+			log.Printf("Dropped %d-byte packet for client %d, over the %d bytes max_udp_payload leaves (%d dropped so far); lower the mtu or set clamp_mss", len(payload), client.ID, pp.maxPayload, dropped)
+		}
+		return nil
+	}
+
+	sequence, err := pp.clientManager.NextTxSequence(client.ID)
+	if err != nil {
+		return err
+	}
+
+	// Only the IP payload is encrypted; the header travels in the clear so the
+	// client can decode it before decrypting, mirroring the inbound framing.
+	encrypted, err := client.Keys.Seal(client.Cipher, payload, sequence)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt packet: %w", err)
+	}
+
+	packet := protocol.CreateDataPacket(client.ID, sequence, encrypted)
+	if compressed {
+		packet.Flags |= protocol.PacketFlagCompressed
+	}
+
 	packetData, err := protocol.EncodePacket(packet)
 	if err != nil {
 		return fmt.Errorf("failed to encode packet: %w", err)
 	}
-	
-	encrypted, err := crypto.EncryptPayload(packetData, client.Key, packet.Sequence)
+
+	addr, err := pp.sendToClient(client, packetData)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt packet: %w", err)
+		return err
 	}
-	
-	return pp.sendToClient(client, encrypted)
+
+	if pp.trace {
+		tracePacket("send", addr, packet, "encrypted", ipData)
+	}
+	pp.capture.WritePacket(ipData)
+
+	return pp.clientManager.RecordSent(client.ID, len(ipData), len(packetData)+pp.wireOverhead)
 }
 
-func (pp *PacketProcessor) sendToClient(client *Client, data []byte) error {
-	// Parse client address
-	addr, err := net.ResolveUDPAddr("udp", client.Address)
-	if err != nil {
-		return fmt.Errorf("failed to resolve client address: %w", err)
+// sendToClient sends data to the client's current address, which it returns:
+// from the data socket to its data address once the client has sent from
+// one, and otherwise from the listener
+func (pp *PacketProcessor) sendToClient(client *Client, data []byte) (*net.UDPAddr, error) {
+	transport := pp.transport
+	var addr *net.UDPAddr
+	if pp.dataTransport != nil {
+		addr = pp.clientManager.GetClientDataAddr(client.ID)
+		if addr != nil {
+			transport = pp.dataTransport
+		}
+	}
+
+	// Look up the current address; it changes when the client roams
+	if addr == nil {
+		var err error
+		addr, err = pp.clientManager.GetClientAddr(client.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve client address: %w", err)
+		}
 	}
 	
-	// Send data to client via UDP
-	_, err = pp.udpConn.WriteToUDP(data, addr)
+	_, err := transport.WriteTo(data, addr)
 	if err != nil {
-		return fmt.Errorf("failed to send data to client %d: %w", client.ID, err)
+		pp.sendFailed.Add(1)
+		return nil, fmt.Errorf("failed to send data to client %d: %w", client.ID, err)
 	}
 	
-	return nil
+	return addr, nil
 }
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/crypto"
 	"github.com/pepalonsocosta/fvp/internal/network"
@@ -23,21 +27,13 @@ func TestPacketProcessor_ProcessPacket(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
 	
 	// Create client manager
-	clientManager := NewClientManager(keyManager)
+	clientManager := NewClientManager(keyManager, nil)
 	
-	// Create mock UDP connection
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		t.Fatalf("Failed to resolve UDP address: %v", err)
-	}
-	mockUDPConn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		t.Fatalf("Failed to create UDP connection: %v", err)
-	}
-	defer mockUDPConn.Close()
+	// Create mock transport
+	mockTransport := network.NewMockTransport()
 	
 	// Create packet processor
-	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockUDPConn)
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockTransport)
 	
 	// Add a client
 	key := make([]byte, 32)
@@ -49,12 +45,13 @@ func TestPacketProcessor_ProcessPacket(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to add client: %v", err)
 	}
+	setTestSession(t, clientManager, client)
 	
 	// Create a test packet with encrypted payload
-	testPayload := []byte("Hello, World!")
+	testPayload := createMockIPPacket(client.IP, "8.8.8.8", []byte("Hello, World!"))
 	
 	// Encrypt only the payload
-	encryptedPayload, err := crypto.EncryptPayload(testPayload, client.Key, 1)
+	encryptedPayload, err := encryptFromClient(testPayload, client.Key, 1)
 	if err != nil {
 		t.Fatalf("Failed to encrypt payload: %v", err)
 	}
@@ -77,7 +74,7 @@ func TestPacketProcessor_ProcessPacket(t *testing.T) {
 	}
 	
 	// Process the packet
-	err = processor.ProcessPacket(finalPacketData)
+	err = processor.ProcessPacket(finalPacketData, nil)
 	if err != nil {
 		t.Fatalf("ProcessPacket failed: %v", err)
 	}
@@ -102,24 +99,16 @@ func TestPacketProcessor_ProcessPacket_InvalidPacket(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
 	
 	// Create client manager
-	clientManager := NewClientManager(keyManager)
+	clientManager := NewClientManager(keyManager, nil)
 	
-	// Create mock UDP connection
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		t.Fatalf("Failed to resolve UDP address: %v", err)
-	}
-	mockUDPConn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		t.Fatalf("Failed to create UDP connection: %v", err)
-	}
-	defer mockUDPConn.Close()
+	// Create mock transport
+	mockTransport := network.NewMockTransport()
 	
 	// Create packet processor
-	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockUDPConn)
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockTransport)
 	
 	// Test with invalid packet
-	err = processor.ProcessPacket([]byte("invalid packet"))
+	err := processor.ProcessPacket([]byte("invalid packet"), nil)
 	if err == nil {
 		t.Error("Expected error for invalid packet")
 	}
@@ -133,21 +122,13 @@ func TestPacketProcessor_ProcessPacket_UnknownClient(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
 	
 	// Create client manager
-	clientManager := NewClientManager(keyManager)
+	clientManager := NewClientManager(keyManager, nil)
 	
-	// Create mock UDP connection
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		t.Fatalf("Failed to resolve UDP address: %v", err)
-	}
-	mockUDPConn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		t.Fatalf("Failed to create UDP connection: %v", err)
-	}
-	defer mockUDPConn.Close()
+	// Create mock transport
+	mockTransport := network.NewMockTransport()
 	
 	// Create packet processor
-	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockUDPConn)
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockTransport)
 	
 	// Create a test packet with unknown client ID
 	testPayload := []byte("Hello, World!")
@@ -168,7 +149,7 @@ func TestPacketProcessor_ProcessPacket_UnknownClient(t *testing.T) {
 	}
 	
 	// Process the packet
-	err = processor.ProcessPacket(packetData)
+	err = processor.ProcessPacket(packetData, nil)
 	if err == nil {
 		t.Error("Expected error for unknown client")
 	}
@@ -188,21 +169,13 @@ func TestPacketProcessor_ProcessOutgoingPacket(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
 	
 	// Create client manager
-	clientManager := NewClientManager(keyManager)
+	clientManager := NewClientManager(keyManager, nil)
 	
-	// Create mock UDP connection
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		t.Fatalf("Failed to resolve UDP address: %v", err)
-	}
-	mockUDPConn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		t.Fatalf("Failed to create UDP connection: %v", err)
-	}
-	defer mockUDPConn.Close()
+	// Create mock transport
+	mockTransport := network.NewMockTransport()
 	
 	// Create packet processor
-	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockUDPConn)
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockTransport)
 	
 	// Add a client
 	key := make([]byte, 32)
@@ -210,13 +183,14 @@ func TestPacketProcessor_ProcessOutgoingPacket(t *testing.T) {
 		key[i] = byte(i)
 	}
 	
-	_, err = clientManager.AddClient(key, "192.168.1.100:12345")
+	client, err := clientManager.AddClient(key, "192.168.1.100:12345")
 	if err != nil {
 		t.Fatalf("Failed to add client: %v", err)
 	}
+	setTestSession(t, clientManager, client)
 	
 	// Create a mock IP packet (destination IP = client's IP)
-	ipPacket := createMockIPPacket("10.0.0.2", "8.8.8.8", []byte("test data"))
+	ipPacket := createMockIPPacket("8.8.8.8", "10.0.0.2", []byte("test data"))
 	
 	// Queue the packet in TUN
 	mockTUN.QueueReadPacket(ipPacket)
@@ -226,6 +200,27 @@ func TestPacketProcessor_ProcessOutgoingPacket(t *testing.T) {
 	if err != nil {
 		t.Fatalf("ProcessOutgoingPacket failed: %v", err)
 	}
+	
+	// The packet should have gone to the client's address, encrypted
+	sent := mockTransport.GetSent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 datagram sent, got %d", len(sent))
+	}
+	if sent[0].Addr.String() != "192.168.1.100:12345" {
+		t.Errorf("Expected datagram sent to 192.168.1.100:12345, got %s", sent[0].Addr)
+	}
+	
+	packet, err := protocol.DecodePacket(sent[0].Data)
+	if err != nil {
+		t.Fatalf("Failed to decode sent packet: %v", err)
+	}
+	decrypted, err := decryptAtClient(packet.Payload, key, packet.Sequence)
+	if err != nil {
+		t.Fatalf("Failed to decrypt sent packet: %v", err)
+	}
+	if !bytes.Equal(decrypted, ipPacket) {
+		t.Error("Sent payload does not match the routed IP packet")
+	}
 }
 
 func TestPacketProcessor_ProcessOutgoingPacket_NoPackets(t *testing.T) {
@@ -242,21 +237,13 @@ func TestPacketProcessor_ProcessOutgoingPacket_NoPackets(t *testing.T) {
 	keyManager := crypto.NewKeyManager()
 	
 	// Create client manager
-	clientManager := NewClientManager(keyManager)
+	clientManager := NewClientManager(keyManager, nil)
 	
-	// Create mock UDP connection
-	addr, err := net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		t.Fatalf("Failed to resolve UDP address: %v", err)
-	}
-	mockUDPConn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		t.Fatalf("Failed to create UDP connection: %v", err)
-	}
-	defer mockUDPConn.Close()
+	// Create mock transport
+	mockTransport := network.NewMockTransport()
 	
 	// Create packet processor
-	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockUDPConn)
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockTransport)
 	
 	// Process outgoing packet with no packets in TUN
 	err = processor.ProcessOutgoingPacket()
@@ -265,6 +252,43 @@ func TestPacketProcessor_ProcessOutgoingPacket_NoPackets(t *testing.T) {
 	}
 }
 
+// testNonce is both nonces of the sessions setTestSession sets up
+var testNonce = make([]byte, crypto.SessionNonceSize)
+
+// setTestSession gives a client added without a handshake the session keys
+// encryptFromClient and decryptAtClient use
+func setTestSession(t *testing.T, cm *ClientManager, client *Client) {
+	t.Helper()
+	session, err := crypto.DeriveSessionKeys(client.Key, testNonce, testNonce)
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	err = cm.SetClientSession(client.ID, session)
+	if err != nil {
+		t.Fatalf("SetClientSession failed: %v", err)
+	}
+}
+
+// encryptFromClient encrypts payload as a client with key would in a session
+// set up by setTestSession, with its client→server key
+func encryptFromClient(payload, key []byte, sequence uint32) ([]byte, error) {
+	session, err := crypto.DeriveSessionKeys(key, testNonce, testNonce)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.EncryptPayload(payload, session.ClientToServer, sequence)
+}
+
+// decryptAtClient decrypts a payload the server sent to a client with key in
+// a session set up by setTestSession, with its server→client key
+func decryptAtClient(sealed, key []byte, sequence uint32) ([]byte, error) {
+	session, err := crypto.DeriveSessionKeys(key, testNonce, testNonce)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.DecryptPayload(sealed, session.ServerToClient, sequence)
+}
+
 // createMockIPPacket creates a mock IP packet for testing
 func createMockIPPacket(srcIP, dstIP string, payload []byte) []byte {
 	// Simple IP header (20 bytes) + payload
@@ -281,20 +305,527 @@ func createMockIPPacket(srcIP, dstIP string, payload []byte) []byte {
 	// Protocol (UDP = 17)
 	packet[9] = 17
 	
-	// Source IP (simplified - just use last octet)
-	packet[12] = 192
-	packet[13] = 168
-	packet[14] = 1
-	packet[15] = 100
-	
-	// Destination IP (simplified - just use last octet)
-	packet[16] = 10
-	packet[17] = 0
-	packet[18] = 0
-	packet[19] = 2
+	copy(packet[12:16], net.ParseIP(srcIP).To4())
+	copy(packet[16:20], net.ParseIP(dstIP).To4())
 	
 	// Copy payload
 	copy(packet[20:], payload)
 	
 	return packet
 }
+
+func TestPacketProcessor_ProcessPacket_UpdatesActivity(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, nil)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	// Pretend the client has been idle for a while
+	idleSince := time.Now().Add(-10 * time.Minute)
+	client.LastSeen = idleSince
+
+	// A packet that fails to decrypt is not activity
+	forged, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, []byte("not encrypted")))
+	processor.ProcessPacket(forged, nil)
+	if !client.LastSeen.Equal(idleSince) {
+		t.Error("Expected a forged data packet not to refresh LastSeen")
+	}
+
+	// An authenticated data packet counts as activity, like a ping
+	encrypted, err := encryptFromClient(createMockIPPacket(client.IP, "8.8.8.8", []byte("payload")), key, 1)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
+	packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, encrypted))
+
+	err = processor.ProcessPacket(packetData, nil)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+	if !client.LastSeen.After(idleSince) {
+		t.Error("Expected a data packet to refresh LastSeen")
+	}
+}
+
+// TestPacketProcessor_SequencesPerDirection tests that packets to a client
+// are numbered from their own counter, unaffected by the sequences the
+// client sends, and don't make later packets from the client look replayed
+func TestPacketProcessor_SequencesPerDirection(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	mockTransport := network.NewMockTransport()
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, mockTransport)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	receive := func(sequence uint32) {
+		t.Helper()
+		encrypted, err := encryptFromClient(createMockIPPacket(client.IP, "8.8.8.8", []byte("payload")), key, sequence)
+		if err != nil {
+			t.Fatalf("Failed to encrypt payload: %v", err)
+		}
+		packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, sequence, encrypted))
+		err = processor.ProcessPacket(packetData, nil)
+		if err != nil {
+			t.Fatalf("Expected packet with sequence %d to be accepted, got %v", sequence, err)
+		}
+	}
+	send := func() uint32 {
+		t.Helper()
+		err := processor.RoutePacket(createMockIPPacket("8.8.8.8", client.IP, []byte("reply")))
+		if err != nil {
+			t.Fatalf("RoutePacket failed: %v", err)
+		}
+		sent := mockTransport.GetSent()
+		packet, err := protocol.DecodePacket(sent[len(sent)-1].Data)
+		if err != nil {
+			t.Fatalf("Failed to decode sent packet: %v", err)
+		}
+		return packet.Sequence
+	}
+
+	receive(100)
+	if sequence := send(); sequence != 1 {
+		t.Errorf("Expected the first packet to the client to have sequence 1, got %d", sequence)
+	}
+	receive(101)
+	if sequence := send(); sequence != 2 {
+		t.Errorf("Expected the second packet to the client to have sequence 2, got %d", sequence)
+	}
+	receive(102)
+
+	updated, _ := clientManager.GetClient(client.ID)
+	if updated.RxSeq != 102 || updated.TxSeq != 2 {
+		t.Errorf("Expected RxSeq 102 and TxSeq 2, got %d and %d", updated.RxSeq, updated.TxSeq)
+	}
+}
+
+func TestPacketProcessor_CountsTraffic(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	transport := network.NewMockTransport()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, transport)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	// Inbound: a forged packet is not counted, an authenticated one is
+	forged, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, []byte("not encrypted")))
+	processor.ProcessPacket(forged, nil)
+
+	payload := createMockIPPacket(client.IP, "8.8.8.8", []byte("payload"))
+	encrypted, err := encryptFromClient(payload, key, 1)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
+	packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, encrypted))
+	err = processor.ProcessPacket(packetData, nil)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+
+	// Outbound
+	ipPacket := createMockIPPacket("8.8.8.8", "10.0.0.2", []byte("test data"))
+	err = processor.RoutePacket(ipPacket)
+	if err != nil {
+		t.Fatalf("RoutePacket failed: %v", err)
+	}
+
+	status := clientManager.ClientStatuses()
+	if len(status) != 1 {
+		t.Fatalf("Expected 1 client, got %d", len(status))
+	}
+	if status[0].PacketsRx != 1 || status[0].BytesRx != uint64(len(payload)) {
+		t.Errorf("Expected 1 packet and %d bytes received, got %d and %d", len(payload), status[0].PacketsRx, status[0].BytesRx)
+	}
+	if status[0].PacketsTx != 1 || status[0].BytesTx != uint64(len(ipPacket)) {
+		t.Errorf("Expected 1 packet and %d bytes sent, got %d and %d", len(ipPacket), status[0].PacketsTx, status[0].BytesTx)
+	}
+}
+
+// TestPacketProcessor_CountsWireBytes tests that the wire byte counts include
+// the packet header, the authentication tag and the network MAC on top of
+// the tunneled bytes
+func TestPacketProcessor_CountsWireBytes(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, network.NewMockTransport())
+	processor.wireOverhead = protocol.NetworkMACSize
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	payload := createMockIPPacket(client.IP, "8.8.8.8", []byte("payload"))
+	encrypted, err := encryptFromClient(payload, key, 1)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
+	packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, encrypted))
+	err = processor.ProcessPacket(packetData, nil)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+
+	err = processor.RoutePacket(createMockIPPacket("8.8.8.8", client.IP, []byte("test data")))
+	if err != nil {
+		t.Fatalf("RoutePacket failed: %v", err)
+	}
+
+	overhead := uint64(protocol.HeaderSize + crypto.CipherOverhead + protocol.NetworkMACSize)
+	status := clientManager.ClientStatuses()[0]
+	if status.WireBytesRx-status.BytesRx != overhead {
+		t.Errorf("Expected %d wire bytes received on top of %d tunneled, got %d", overhead, status.BytesRx, status.WireBytesRx)
+	}
+	if status.WireBytesTx-status.BytesTx != overhead {
+		t.Errorf("Expected %d wire bytes sent on top of %d tunneled, got %d", overhead, status.BytesTx, status.WireBytesTx)
+	}
+
+	clientManager.ResetCounters()
+	status = clientManager.ClientStatuses()[0]
+	if status.WireBytesRx != 0 || status.WireBytesTx != 0 {
+		t.Errorf("Expected reset wire byte counts, got %d and %d", status.WireBytesRx, status.WireBytesTx)
+	}
+}
+
+// TestPacketProcessor_Capture tests that the debug capture records the
+// decrypted packets from and to clients
+func TestPacketProcessor_Capture(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, network.NewMockTransport())
+
+	path := filepath.Join(t.TempDir(), "debug.pcap")
+	capture, err := network.NewPcapWriter(path, 1<<20)
+	if err != nil {
+		t.Fatalf("NewPcapWriter failed: %v", err)
+	}
+	processor.capture = capture
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	inbound := createMockIPPacket(client.IP, "8.8.8.8", []byte("request"))
+	encrypted, err := encryptFromClient(inbound, key, 1)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
+	packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, encrypted))
+	err = processor.ProcessPacket(packetData, nil)
+	if err != nil {
+		t.Fatalf("ProcessPacket failed: %v", err)
+	}
+
+	outbound := createMockIPPacket("8.8.8.8", client.IP, []byte("response"))
+	err = processor.RoutePacket(outbound)
+	if err != nil {
+		t.Fatalf("RoutePacket failed: %v", err)
+	}
+	capture.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read capture: %v", err)
+	}
+	// A 24-byte file header, then a 16-byte header before each packet
+	expected := 24 + 16 + len(inbound) + 16 + len(outbound)
+	if len(data) != expected {
+		t.Fatalf("Expected a %d-byte capture, got %d bytes", expected, len(data))
+	}
+	if !bytes.Equal(data[24+16:24+16+len(inbound)], inbound) {
+		t.Error("Expected the inbound packet to be captured decrypted")
+	}
+	if !bytes.Equal(data[len(data)-len(outbound):], outbound) {
+		t.Error("Expected the outbound packet to be captured before encryption")
+	}
+}
+
+func TestPacketProcessor_RejectsSpoofedSource(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, nil)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	other, err := clientManager.AddClient(otherKey, "192.168.1.101:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, other)
+
+	_, site, _ := net.ParseCIDR("192.168.50.0/24")
+	clientManager.SetClientAllowedIPs(client.ID, []*net.IPNet{site})
+
+	sequence := uint32(0)
+	send := func(ipPacket []byte) error {
+		sequence++
+		encrypted, err := encryptFromClient(ipPacket, key, sequence)
+		if err != nil {
+			t.Fatalf("Failed to encrypt payload: %v", err)
+		}
+		packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, sequence, encrypted))
+		return processor.ProcessPacket(packetData, nil)
+	}
+
+	// Impersonating another client, or sending from outside any allowed
+	// network, is dropped
+	spoofed := [][]byte{
+		createMockIPPacket(other.IP, "8.8.8.8", []byte("spoofed")),
+		createMockIPPacket("192.168.51.7", "8.8.8.8", []byte("spoofed")),
+		[]byte("not an IP packet"),
+	}
+	for _, ipPacket := range spoofed {
+		if send(ipPacket) == nil {
+			t.Errorf("Expected packet from %v to be rejected", net.IP(ipPacket[12:16]))
+		}
+	}
+	if len(mockTUN.GetWriteQueue()) != 0 {
+		t.Fatalf("Expected no spoofed packets on TUN, got %d", len(mockTUN.GetWriteQueue()))
+	}
+
+	// The client's own IP and its allowed network are accepted
+	allowed := [][]byte{
+		createMockIPPacket(client.IP, "8.8.8.8", []byte("own address")),
+		createMockIPPacket("192.168.50.7", "8.8.8.8", []byte("site address")),
+	}
+	for _, ipPacket := range allowed {
+		err := send(ipPacket)
+		if err != nil {
+			t.Errorf("Expected packet from %v to be accepted, got %v", net.IP(ipPacket[12:16]), err)
+		}
+	}
+	if len(mockTUN.GetWriteQueue()) != 2 {
+		t.Errorf("Expected 2 packets on TUN, got %d", len(mockTUN.GetWriteQueue()))
+	}
+}
+
+func TestPacketProcessor_RejectsSpoofedClientID(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, nil)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	other, err := clientManager.AddClient(otherKey, "192.168.1.101:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, other)
+
+	encrypted, err := encryptFromClient(createMockIPPacket(client.IP, "8.8.8.8", []byte("payload")), key, 1)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
+	packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, encrypted))
+
+	// Claiming the client's ID from the other client's address is dropped,
+	// even though the packet itself would authenticate
+	otherAddr, _ := net.ResolveUDPAddr("udp", other.Address)
+	err = processor.ProcessPacket(packetData, otherAddr)
+	if err == nil {
+		t.Error("Expected a packet claiming another client's ID to be rejected")
+	}
+	if len(mockTUN.GetWriteQueue()) != 0 {
+		t.Fatalf("Expected no spoofed packets on TUN, got %d", len(mockTUN.GetWriteQueue()))
+	}
+	if client.Address != "192.168.1.100:12345" {
+		t.Errorf("Expected spoofed packet not to move the client, got %s", client.Address)
+	}
+
+	// An unknown source is a roam and is accepted once it authenticates
+	roamedAddr, _ := net.ResolveUDPAddr("udp", "192.168.1.200:40000")
+	err = processor.ProcessPacket(packetData, roamedAddr)
+	if err != nil {
+		t.Fatalf("Expected roamed packet to be accepted, got %v", err)
+	}
+
+	found, err := clientManager.GetClientByAddress("192.168.1.200:40000")
+	if err != nil || found.ID != client.ID {
+		t.Errorf("Expected new address to map to client %d, got %v (%v)", client.ID, found, err)
+	}
+}
+
+// TestPacketProcessor_CountsFailedSends tests that packets for clients the
+// socket fails to send are counted as dropped
+func TestPacketProcessor_CountsFailedSends(t *testing.T) {
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	transport := network.NewMockTransport()
+	transport.Close()
+
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, transport)
+
+	client, err := clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	for i := 0; i < 3; i++ {
+		err = processor.RoutePacket(createMockIPPacket("8.8.8.8", client.IP, []byte("reply")))
+		if err == nil {
+			t.Fatal("Expected RoutePacket to fail on a closed socket")
+		}
+	}
+
+	if failed := processor.FailedSends(); failed != 3 {
+		t.Errorf("Expected 3 failed sends, got %d", failed)
+	}
+
+	processor.ResetCounters()
+	if failed := processor.FailedSends(); failed != 0 {
+		t.Errorf("Expected failed sends to be reset, got %d", failed)
+	}
+}
+
+func TestPacketProcessor_SlowTUNDropsInsteadOfBlocking(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	tun := network.NewCallbackTun(func([]byte) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	tun.Create("slow0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	processor := NewPacketProcessor(tun, keyManager, clientManager, nil)
+	processor.EnableWriteQueue(2)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "192.168.1.100:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	packets := make([][]byte, 20)
+	for i := range packets {
+		sequence := uint32(i + 1)
+		encrypted, err := encryptFromClient(createMockIPPacket(client.IP, "8.8.8.8", []byte("payload")), key, sequence)
+		if err != nil {
+			t.Fatalf("Failed to encrypt payload: %v", err)
+		}
+		packets[i], _ = protocol.EncodePacket(protocol.CreateDataPacket(client.ID, sequence, encrypted))
+	}
+
+	// Once the TUN interface is stuck on the first packet, the reader only
+	// gets through the rest if it drops what the queue can't hold
+	processor.ProcessPacket(packets[0], nil)
+	<-entered
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, packet := range packets[1:] {
+			if err := processor.ProcessPacket(packet, nil); err != nil {
+				t.Errorf("Expected packet to be accepted, got %v", err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ProcessPacket blocked on a slow TUN interface")
+	}
+
+	dropped := processor.DroppedPackets()
+	if dropped != 17 {
+		t.Errorf("Expected 17 dropped packets, got %d", dropped)
+	}
+	if queued, waiting := processor.QueuedPackets(); queued != 3 || waiting != 2 {
+		t.Errorf("Expected 3 packets queued and 2 waiting, got %d and %d", queued, waiting)
+	}
+
+	// Only packets that made it into the queue count as received
+	stats := clientManager.ClientStatuses()
+	if len(stats) != 1 || stats[0].PacketsRx != 20-dropped {
+		t.Errorf("Expected %d packets received, got %+v", 20-dropped, stats)
+	}
+
+	close(release)
+	processor.Close()
+}
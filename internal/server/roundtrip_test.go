@@ -0,0 +1,1853 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// TestDataRoundTrip tests that IP packets survive both directions of the tunnel
+// with a mock TUN interface on the server and on the client
+func TestDataRoundTrip(t *testing.T) {
+	server := NewServer()
+
+	// Set up server with a mock TUN interface
+	serverTUN := network.NewMockTunManager()
+	err := serverTUN.Create("test0")
+	if err != nil {
+		t.Fatalf("Failed to create server mock TUN: %v", err)
+	}
+
+	server.tunInterface = serverTUN
+	server.keyManager = crypto.NewKeyManager()
+	server.clientManager = NewClientManager(server.keyManager, nil)
+
+	err = server.CreateUDPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create UDP server: %v", err)
+	}
+
+	err = server.CreatePacketProcessor()
+	if err != nil {
+		t.Fatalf("Failed to create packet processor: %v", err)
+	}
+
+	// Only handle client packets; outgoing packets are driven manually below
+	server.wg.Add(1)
+	go server.handleClients()
+	defer server.Stop()
+
+	// Connect a client with its own mock TUN interface
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.udpConn.LocalAddr().String(), clientTUN)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Client → server: packet read from the client TUN emerges on the server TUN
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("client to server"))
+	clientTUN.QueueReadPacket(outbound)
+
+	received := waitForTUNPacket(t, serverTUN)
+	if !bytes.Equal(received, outbound) {
+		t.Errorf("Server TUN got %x, expected %x", received, outbound)
+	}
+
+	// Server → client: packet read from the server TUN emerges on the client TUN
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), []byte("server to client"))
+	serverTUN.QueueReadPacket(inbound)
+
+	err = server.packetProcessor.ProcessOutgoingPacket()
+	if err != nil {
+		t.Fatalf("ProcessOutgoingPacket failed: %v", err)
+	}
+
+	received = waitForTUNPacket(t, clientTUN)
+	if !bytes.Equal(received, inbound) {
+		t.Errorf("Client TUN got %x, expected %x", received, inbound)
+	}
+}
+
+// waitForTUNPacket waits for a packet to be written to the mock TUN interface
+func waitForTUNPacket(t *testing.T, tun *network.MockTunManager) []byte {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		writeQueue := tun.GetWriteQueue()
+		if len(writeQueue) > 0 {
+			tun.ClearWriteQueue()
+			return writeQueue[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Timed out waiting for packet on TUN interface")
+	return nil
+}
+
+// TestDataRoundTrip_AES256GCM tests the tunnel with AES-256-GCM negotiated
+func TestDataRoundTrip_AES256GCM(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:   "127.0.0.1:0",
+		Cipher: "aes-256-gcm",
+		TUN:    serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	if vpnClient.GetCipher().ID() != crypto.CipherAES256GCM {
+		t.Fatalf("Expected aes-256-gcm to be negotiated, got %s", vpnClient.GetCipher().Name())
+	}
+
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("client to server"))
+	clientTUN.QueueReadPacket(outbound)
+
+	received := waitForTUNPacket(t, serverTUN)
+	if !bytes.Equal(received, outbound) {
+		t.Errorf("Server TUN got %x, expected %x", received, outbound)
+	}
+
+	// The server routing loop picks this up from the TUN interface
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), []byte("server to client"))
+	serverTUN.QueueReadPacket(inbound)
+
+	received = waitForTUNPacket(t, clientTUN)
+	if !bytes.Equal(received, inbound) {
+		t.Errorf("Client TUN got %x, expected %x", received, inbound)
+	}
+}
+
+// TestClientSendReceive tests that payloads given to Client.Send reach the
+// server like packets from the TUN interface, and that a Receive handler
+// takes the server's packets in place of the TUN interface
+func TestClientSendReceive(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+
+	err = vpnClient.Send([]byte("too early"))
+	if !errors.Is(err, client.ErrNotConnected) {
+		t.Errorf("Expected ErrNotConnected before Connect, got %v", err)
+	}
+
+	received := make(chan []byte, 1)
+	vpnClient.Receive(func(payload []byte) {
+		received <- payload
+	})
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("sent by the app"))
+	err = vpnClient.Send(outbound)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	packet := waitForTUNPacket(t, serverTUN)
+	if !bytes.Equal(packet, outbound) {
+		t.Errorf("Server TUN got %x, expected %x", packet, outbound)
+	}
+
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), []byte("for the app"))
+	serverTUN.QueueReadPacket(inbound)
+
+	select {
+	case payload := <-received:
+		if !bytes.Equal(payload, inbound) {
+			t.Errorf("Receive handler got %x, expected %x", payload, inbound)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the Receive handler")
+	}
+	if len(clientTUN.GetWriteQueue()) != 0 {
+		t.Error("Expected nothing written to the client TUN with a Receive handler")
+	}
+}
+
+// TestDataRoundTrip_JumboMTU tests that 9000-byte packets cross the tunnel
+// intact in both directions when both ends use a jumbo MTU
+func TestDataRoundTrip_JumboMTU(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		MTU:  9000,
+		TUN:  serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	err = vpnClient.SetMTU(9000)
+	if err != nil {
+		t.Fatalf("SetMTU failed: %v", err)
+	}
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Incompressible, so a corrupted or truncated byte anywhere shows
+	payload := make([]byte, 9000-20)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", payload)
+	clientTUN.QueueReadPacket(outbound)
+
+	received := waitForTUNPacket(t, serverTUN)
+	if !bytes.Equal(received, outbound) {
+		t.Errorf("Server TUN got %d bytes, expected the %d-byte packet intact", len(received), len(outbound))
+	}
+
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), payload)
+	serverTUN.QueueReadPacket(inbound)
+
+	received = waitForTUNPacket(t, clientTUN)
+	if !bytes.Equal(received, inbound) {
+		t.Errorf("Client TUN got %d bytes, expected the %d-byte packet intact", len(received), len(inbound))
+	}
+}
+
+// TestDataRoundTrip_Compressed tests the tunnel with compression negotiated,
+// for payloads large enough to compress and ones sent as-is
+func TestDataRoundTrip_Compressed(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	vpnClient.SetCompression(true)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	if !vpnClient.GetCompression() {
+		t.Fatal("Expected compression to be negotiated")
+	}
+
+	payloads := [][]byte{
+		bytes.Repeat([]byte("compressible "), 64),
+		[]byte("short"),
+	}
+
+	for _, payload := range payloads {
+		outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", payload)
+		clientTUN.QueueReadPacket(outbound)
+
+		received := waitForTUNPacket(t, serverTUN)
+		if !bytes.Equal(received, outbound) {
+			t.Errorf("Server TUN got %x, expected %x", received, outbound)
+		}
+
+		inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), payload)
+		serverTUN.QueueReadPacket(inbound)
+
+		received = waitForTUNPacket(t, clientTUN)
+		if !bytes.Equal(received, inbound) {
+			t.Errorf("Client TUN got %x, expected %x", received, inbound)
+		}
+	}
+}
+
+// TestDataRoundTrip_CallbackTun tests a server whose data plane is a callback
+// rather than a kernel device
+func TestDataRoundTrip_CallbackTun(t *testing.T) {
+	delivered := make(chan []byte, 1)
+	serverTUN := network.NewCallbackTun(func(packet []byte) {
+		delivered <- packet
+	})
+
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Client → server: the decrypted packet goes to the callback
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("to the callback"))
+	clientTUN.QueueReadPacket(outbound)
+
+	select {
+	case received := <-delivered:
+		if !bytes.Equal(received, outbound) {
+			t.Errorf("Callback got %x, expected %x", received, outbound)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the callback")
+	}
+
+	// Server → client: an injected packet is routed to the client
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), []byte("from the callback side"))
+	err = serverTUN.Inject(inbound)
+	if err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+
+	received := waitForTUNPacket(t, clientTUN)
+	if !bytes.Equal(received, inbound) {
+		t.Errorf("Client TUN got %x, expected %x", received, inbound)
+	}
+}
+
+// TestInsecureNoEncryption tests that encryption is only disabled when both
+// peers disable it, and that mixed peers refuse to connect
+func TestInsecureNoEncryption(t *testing.T) {
+	t.Setenv(crypto.InsecureEnvVar, "1")
+
+	startServer := func(t *testing.T, insecure bool) (*Server, *network.MockTunManager) {
+		serverTUN := network.NewMockTunManager()
+		server, err := NewServerWithOptions(ServerOptions{
+			Port:                 "127.0.0.1:0",
+			InsecureNoEncryption: insecure,
+			TUN:                  serverTUN,
+		})
+		if err != nil {
+			t.Fatalf("NewServerWithOptions failed: %v", err)
+		}
+
+		err = server.Serve()
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+		t.Cleanup(func() { server.Stop() })
+		return server, serverTUN
+	}
+
+	newClient := func(t *testing.T, server *Server, insecure bool) (*client.Client, *network.MockTunManager) {
+		clientTUN := network.NewMockTunManager()
+		vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+		err := vpnClient.SetInsecureNoEncryption(insecure)
+		if err != nil {
+			t.Fatalf("SetInsecureNoEncryption failed: %v", err)
+		}
+		return vpnClient, clientTUN
+	}
+
+	t.Run("both insecure", func(t *testing.T) {
+		server, serverTUN := startServer(t, true)
+		vpnClient, clientTUN := newClient(t, server, true)
+
+		err := vpnClient.Connect()
+		if err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		defer vpnClient.Disconnect()
+
+		if vpnClient.GetCipher().ID() != crypto.CipherNone {
+			t.Errorf("Expected no encryption, got %s", vpnClient.GetCipher().Name())
+		}
+
+		outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("plaintext"))
+		clientTUN.QueueReadPacket(outbound)
+
+		received := waitForTUNPacket(t, serverTUN)
+		if !bytes.Equal(received, outbound) {
+			t.Errorf("Server TUN got %x, expected %x", received, outbound)
+		}
+	})
+
+	mixed := []struct {
+		name           string
+		serverInsecure bool
+		clientInsecure bool
+	}{
+		{"insecure server, secure client", true, false},
+		{"secure server, insecure client", false, true},
+	}
+
+	for _, tt := range mixed {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := startServer(t, tt.serverInsecure)
+			vpnClient, _ := newClient(t, server, tt.clientInsecure)
+
+			err := vpnClient.Connect()
+			if err == nil {
+				vpnClient.Disconnect()
+				t.Fatal("Expected a secure and an insecure peer to refuse to connect")
+			}
+
+			var serverErr *client.ServerError
+			if !errors.As(err, &serverErr) || serverErr.Code != protocol.ErrorCodeEncryptionMismatch {
+				t.Errorf("Expected an encryption mismatch error, got %v", err)
+			}
+			if len(server.clientManager.ListClients()) != 0 {
+				t.Errorf("Expected the refused client to be removed, got %d clients", len(server.clientManager.ListClients()))
+			}
+		})
+	}
+}
+
+// TestPreSharedKeyAuth tests that a client configured with a pre-shared key
+// authenticates under its configured ID, and refuses a server that answers
+// with a different key
+func TestPreSharedKeyAuth(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	startServer := func(t *testing.T) (*Server, *network.MockTunManager) {
+		serverTUN := network.NewMockTunManager()
+		server, err := NewServerWithOptions(ServerOptions{
+			Port:       "127.0.0.1:0",
+			ClientKeys: map[uint8][]byte{5: key},
+			TUN:        serverTUN,
+		})
+		if err != nil {
+			t.Fatalf("NewServerWithOptions failed: %v", err)
+		}
+
+		err = server.Serve()
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+		t.Cleanup(func() { server.Stop() })
+		return server, serverTUN
+	}
+
+	t.Run("matching key", func(t *testing.T) {
+		server, serverTUN := startServer(t)
+
+		clientTUN := network.NewMockTunManager()
+		vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+		vpnClient.SetPreSharedKey(5, key)
+
+		err := vpnClient.Connect()
+		if err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		defer vpnClient.Disconnect()
+
+		outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("pre-shared"))
+		clientTUN.QueueReadPacket(outbound)
+
+		received := waitForTUNPacket(t, serverTUN)
+		if !bytes.Equal(received, outbound) {
+			t.Errorf("Server TUN got %x, expected %x", received, outbound)
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		server, _ := startServer(t)
+
+		vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+		vpnClient.SetPreSharedKey(5, bytes.Repeat([]byte{0x24}, 32))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		err := vpnClient.ConnectContext(ctx)
+		if err == nil {
+			vpnClient.Disconnect()
+			t.Fatal("Expected connecting with the wrong key to fail")
+		}
+	})
+}
+
+// TestRequestedIP tests that clients get the tunnel address they ask for or
+// have reserved, and that nobody else can claim a reservation
+func TestRequestedIP(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:        "127.0.0.1:0",
+		ClientKeys:  map[uint8][]byte{5: key},
+		ReservedIPs: map[uint8]string{5: "10.0.0.77"},
+		TUN:         network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	connect := func(t *testing.T, requested string, configure func(*client.Client)) string {
+		vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+		if requested != "" {
+			err := vpnClient.SetRequestedIP(requested)
+			if err != nil {
+				t.Fatalf("SetRequestedIP failed: %v", err)
+			}
+		}
+		if configure != nil {
+			configure(vpnClient)
+		}
+
+		err := vpnClient.Connect()
+		if err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		t.Cleanup(func() { vpnClient.Disconnect() })
+		return vpnClient.GetAssignedIP()
+	}
+
+	if ip := connect(t, "10.0.0.40", nil); ip != "10.0.0.40" {
+		t.Errorf("Expected requested IP 10.0.0.40, got %s", ip)
+	}
+	if ip := connect(t, "10.0.0.40", nil); ip != "10.0.0.2" {
+		t.Errorf("Expected taken request to fall back to 10.0.0.2, got %s", ip)
+	}
+	if ip := connect(t, "10.0.0.77", nil); ip != "10.0.0.3" {
+		t.Errorf("Expected reserved request to fall back to 10.0.0.3, got %s", ip)
+	}
+
+	ip := connect(t, "", func(c *client.Client) { c.SetPreSharedKey(5, key) })
+	if ip != "10.0.0.77" {
+		t.Errorf("Expected reserved IP 10.0.0.77, got %s", ip)
+	}
+}
+
+// TestLeaseFile tests that a configured client gets the IP it had before a
+// restart back, and the next free one if another client has taken it
+func TestLeaseFile(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	leaseFile := filepath.Join(t.TempDir(), "fvps.leases")
+
+	start := func(t *testing.T) *Server {
+		server, err := NewServerWithOptions(ServerOptions{
+			Port:       "127.0.0.1:0",
+			ClientKeys: map[uint8][]byte{5: key},
+			TUN:        network.NewMockTunManager(),
+		})
+		if err != nil {
+			t.Fatalf("NewServerWithOptions failed: %v", err)
+		}
+		server.SetLeaseFile(leaseFile)
+
+		err = server.Serve()
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+		return server
+	}
+	connect := func(t *testing.T, server *Server, requested string, clientID uint8) *client.Client {
+		vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+		if requested != "" {
+			vpnClient.SetRequestedIP(requested)
+		}
+		if clientID != 0 {
+			vpnClient.SetPreSharedKey(clientID, key)
+		}
+
+		err := vpnClient.Connect()
+		if err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		return vpnClient
+	}
+
+	// Another client arrives first, so client 5 gets the second address
+	server := start(t)
+	other := connect(t, server, "", 0)
+	configured := connect(t, server, "", 5)
+	if ip := configured.GetAssignedIP(); ip != "10.0.0.3" {
+		t.Fatalf("Expected client 5 to get 10.0.0.3, got %s", ip)
+	}
+	configured.Disconnect()
+	other.Disconnect()
+	server.Stop()
+
+	// After a restart it arrives first and still gets its old address
+	server = start(t)
+	configured = connect(t, server, "", 5)
+	if ip := configured.GetAssignedIP(); ip != "10.0.0.3" {
+		t.Errorf("Expected client 5 to get 10.0.0.3 back, got %s", ip)
+	}
+	configured.Disconnect()
+	server.Stop()
+
+	// Unless someone else took it in the meantime
+	server = start(t)
+	defer server.Stop()
+	other = connect(t, server, "10.0.0.3", 0)
+	defer other.Disconnect()
+	configured = connect(t, server, "", 5)
+	defer configured.Disconnect()
+	if ip := configured.GetAssignedIP(); ip != "10.0.0.2" {
+		t.Errorf("Expected client 5 to fall back to 10.0.0.2, got %s", ip)
+	}
+	if ip := server.clientManager.RememberedIP(5); ip != "10.0.0.2" {
+		t.Errorf("Expected the lease to move to 10.0.0.2, got %s", ip)
+	}
+}
+
+// TestAuthErrorResponse tests that a refused client learns why right away
+// rather than waiting out the handshake timeout
+func TestAuthErrorResponse(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:       "127.0.0.1:0",
+		ClientKeys: map[uint8][]byte{5: key},
+		TUN:        network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name     string
+		clientID uint8
+		code     uint8
+	}{
+		{"unknown client", 9, protocol.ErrorCodeUnknownClient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+			vpnClient.SetPreSharedKey(tt.clientID, key)
+
+			start := time.Now()
+			err := vpnClient.Connect()
+			if err == nil {
+				vpnClient.Disconnect()
+				t.Fatal("Expected connect to be refused")
+			}
+
+			var serverErr *client.ServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("Expected a ServerError, got %v", err)
+			}
+			if serverErr.Code != tt.code {
+				t.Errorf("Expected code %d, got %d", tt.code, serverErr.Code)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Expected an immediate error, took %s", elapsed)
+			}
+		})
+	}
+}
+
+// TestReconnectKeepsSession tests that a client connecting again with the key
+// of a client that still has a session, as after a restart, takes over that
+// session's ID and IP instead of being refused
+func TestReconnectKeepsSession(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:       "127.0.0.1:0",
+		ClientKeys: map[uint8][]byte{5: key},
+		TUN:        network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	first := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	first.SetPreSharedKey(5, key)
+	err = first.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer first.Disconnect()
+
+	second := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	second.SetPreSharedKey(5, key)
+	err = second.Connect()
+	if err != nil {
+		t.Fatalf("Expected the reconnect to succeed, got %v", err)
+	}
+	defer second.Disconnect()
+
+	if second.GetAssignedIP() != first.GetAssignedIP() {
+		t.Errorf("Expected IP %s after reconnecting, got %s", first.GetAssignedIP(), second.GetAssignedIP())
+	}
+	if second.GetClientID() != first.GetClientID() {
+		t.Errorf("Expected client ID %d after reconnecting, got %d", first.GetClientID(), second.GetClientID())
+	}
+	if clients := server.clientManager.ListClients(); len(clients) != 1 {
+		t.Errorf("Expected 1 client after reconnecting, got %d", len(clients))
+	}
+}
+
+// TestNetworkKey tests that a server with a network key drops datagrams
+// without its MAC before looking up the client, while clients with the key
+// connect as usual
+func TestNetworkKey(t *testing.T) {
+	networkKey := bytes.Repeat([]byte{0x5a}, 32)
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:       "127.0.0.1:0",
+		NetworkKey: networkKey,
+		TUN:        network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	conn, err := net.DialUDP("udp", nil, server.GetAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	// An unknown client ID would get an error packet if it were looked up
+	authPacket, _ := protocol.EncodePacket(protocol.CreateAuthPacket(9, 1, nil))
+	untagged := [][]byte{
+		authPacket,
+		protocol.SealNetworkMAC(authPacket, bytes.Repeat([]byte{0xa5}, 32)),
+	}
+	for _, data := range untagged {
+		conn.Write(data)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 1500)); err == nil {
+		t.Fatalf("Expected no response to packets without the network MAC, got %d bytes", n)
+	}
+	if dropped := server.GetServerStatus().DroppedNetworkMAC; dropped != uint64(len(untagged)) {
+		t.Errorf("Expected %d datagrams dropped for the network MAC, got %d", len(untagged), dropped)
+	}
+
+	// A client without the key times out, as if nobody were listening
+	outsider := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err = outsider.ConnectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		outsider.Disconnect()
+		t.Fatalf("Expected a client without the network key to time out, got %v", err)
+	}
+	if clients := server.GetClientStatus(); len(clients) != 0 {
+		t.Errorf("Expected no clients to be added, got %d", len(clients))
+	}
+
+	member := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	err = member.SetNetworkKey(networkKey)
+	if err != nil {
+		t.Fatalf("SetNetworkKey failed: %v", err)
+	}
+	err = member.Connect()
+	if err != nil {
+		t.Fatalf("Expected a client with the network key to connect, got %v", err)
+	}
+	defer member.Disconnect()
+
+	if clients := server.GetClientStatus(); len(clients) != 1 {
+		t.Errorf("Expected 1 client, got %d", len(clients))
+	}
+}
+
+// TestServerIdentity tests that a client with the server's identity pinned
+// connects, while one pinning another key, or connecting to a server
+// without an identity, is refused
+func TestServerIdentity(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, protocol.IdentityKeySize)
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x24}, protocol.IdentityKeySize)).Public().(ed25519.PublicKey)
+
+	serve := func(identityKey []byte) *Server {
+		t.Helper()
+		server, err := NewServerWithOptions(ServerOptions{
+			Port:        "127.0.0.1:0",
+			IdentityKey: identityKey,
+			TUN:         network.NewMockTunManager(),
+		})
+		if err != nil {
+			t.Fatalf("NewServerWithOptions failed: %v", err)
+		}
+		err = server.Serve()
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+		t.Cleanup(func() { server.Stop() })
+		return server
+	}
+	connect := func(server *Server, pinned []byte) error {
+		t.Helper()
+		c := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+		err := c.SetServerIdentity(pinned)
+		if err != nil {
+			t.Fatalf("SetServerIdentity failed: %v", err)
+		}
+		err = c.Connect()
+		if err == nil {
+			c.Disconnect()
+		}
+		return err
+	}
+
+	server := serve(seed)
+	if err := connect(server, publicKey); err != nil {
+		t.Errorf("Expected a client pinning the server's identity to connect, got %v", err)
+	}
+	if err := connect(server, nil); err != nil {
+		t.Errorf("Expected a client without a pin to connect, got %v", err)
+	}
+	if err := connect(server, otherKey); !errors.Is(err, client.ErrServerIdentity) {
+		t.Errorf("Expected a client pinning another key to be refused, got %v", err)
+	}
+
+	impostor := serve(nil)
+	if err := connect(impostor, publicKey); !errors.Is(err, client.ErrServerIdentity) {
+		t.Errorf("Expected a server without the identity to be refused, got %v", err)
+	}
+}
+
+// lossyTransport loses the first auth response the server sends
+type lossyTransport struct {
+	*network.MemoryConn
+	dropped atomic.Bool
+}
+
+func (t *lossyTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	packet, err := protocol.ParsePacket(data)
+	if err == nil && packet.Type == protocol.PacketTypeAuth && t.dropped.CompareAndSwap(false, true) {
+		return len(data), nil
+	}
+	return t.MemoryConn.WriteTo(data, addr)
+}
+
+// TestAuthRetry tests that a client whose auth response is lost resends its
+// request and connects, and that the server answers the retry with the
+// session it already set up rather than a second one
+func TestAuthRetry(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	tests := []struct {
+		name      string
+		configure func(*client.Client)
+	}{
+		{"assigned ID", func(*client.Client) {}},
+		{"pre-shared key", func(c *client.Client) { c.SetPreSharedKey(5, key) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := network.NewMemoryNetwork()
+			transport := &lossyTransport{MemoryConn: memory.Listen()}
+			serverTUN := network.NewMockTunManager()
+			server, err := NewServerWithOptions(ServerOptions{
+				ClientKeys: map[uint8][]byte{5: key},
+				Transport:  transport,
+				TUN:        serverTUN,
+			})
+			if err != nil {
+				t.Fatalf("NewServerWithOptions failed: %v", err)
+			}
+
+			err = server.Serve()
+			if err != nil {
+				t.Fatalf("Serve failed: %v", err)
+			}
+			defer server.Stop()
+
+			clientTUN := network.NewMockTunManager()
+			vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+			vpnClient.SetDialer(memory.Dial)
+			tt.configure(vpnClient)
+			err = vpnClient.SetAuthTimeout(200*time.Millisecond, 2)
+			if err != nil {
+				t.Fatalf("SetAuthTimeout failed: %v", err)
+			}
+
+			err = vpnClient.Connect()
+			if err != nil {
+				t.Fatalf("Expected the retry to connect, got %v", err)
+			}
+			defer vpnClient.Disconnect()
+
+			if !transport.dropped.Load() {
+				t.Fatal("Expected the first auth response to be dropped")
+			}
+			if clients := server.GetClientStatus(); len(clients) != 1 {
+				t.Fatalf("Expected one session for the retried request, got %d", len(clients))
+			}
+
+			// Both sides ended up with the same keys
+			outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("after retry"))
+			clientTUN.QueueReadPacket(outbound)
+			if received := waitForTUNPacket(t, serverTUN); !bytes.Equal(received, outbound) {
+				t.Errorf("Server TUN got %x, expected %x", received, outbound)
+			}
+		})
+	}
+}
+
+// countingTransport counts the data packets the server sends and receives
+type countingTransport struct {
+	*network.MemoryConn
+	sent     atomic.Int32
+	received atomic.Int32
+}
+
+func (t *countingTransport) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	n, addr, err := t.MemoryConn.ReadFrom(buffer)
+	if packet, parseErr := protocol.ParsePacket(buffer[:n]); err == nil && parseErr == nil && packet.Type == protocol.PacketTypeData {
+		t.received.Add(1)
+	}
+	return n, addr, err
+}
+
+func (t *countingTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	if packet, err := protocol.ParsePacket(data); err == nil && packet.Type == protocol.PacketTypeData {
+		t.sent.Add(1)
+	}
+	return t.MemoryConn.WriteTo(data, addr)
+}
+
+// TestEmptyTUNReads tests that empty reads from either TUN interface are
+// skipped rather than sent through the tunnel as empty packets
+func TestEmptyTUNReads(t *testing.T) {
+	memory := network.NewMemoryNetwork()
+	transport := &countingTransport{MemoryConn: memory.Listen()}
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Transport: transport,
+		TUN:       serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	vpnClient.SetDialer(memory.Dial)
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Each empty read is followed by a real packet, which must be the first
+	// thing out of the other end
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("after empty read"))
+	clientTUN.QueueReadPacket([]byte{})
+	clientTUN.QueueReadPacket(outbound)
+	if received := waitForTUNPacket(t, serverTUN); !bytes.Equal(received, outbound) {
+		t.Errorf("Server TUN got %x, expected %x", received, outbound)
+	}
+
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), []byte("after empty read"))
+	serverTUN.QueueReadPacket([]byte{})
+	serverTUN.QueueReadPacket(inbound)
+	if received := waitForTUNPacket(t, clientTUN); !bytes.Equal(received, inbound) {
+		t.Errorf("Client TUN got %x, expected %x", received, inbound)
+	}
+
+	if sent, received := transport.sent.Load(), transport.received.Load(); sent != 1 || received != 1 {
+		t.Errorf("Expected one data packet each way, got %d sent and %d received", sent, received)
+	}
+}
+
+// TestMaxUDPPayload tests that a packet whose datagram is exactly
+// max_udp_payload bytes goes through the tunnel both ways, and one a byte
+// larger is dropped and counted
+func TestMaxUDPPayload(t *testing.T) {
+	const maxUDPPayload = 1000
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:          "127.0.0.1:0",
+		TUN:           serverTUN,
+		MaxUDPPayload: maxUDPPayload,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	err = vpnClient.SetMaxUDPPayload(maxUDPPayload)
+	if err != nil {
+		t.Fatalf("SetMaxUDPPayload failed: %v", err)
+	}
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Take away the 20-byte IP header from the largest packet that fits
+	fits := protocol.MaxInnerPacketSize(maxUDPPayload, protocol.ProtocolVersionMajor, crypto.CipherOverhead, false) - 20
+
+	// The oversized packet goes first, so the fitting one arriving first
+	// shows it was dropped
+	tooLarge := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", make([]byte, fits+1))
+	outbound := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", make([]byte, fits))
+	clientTUN.QueueReadPacket(tooLarge)
+	clientTUN.QueueReadPacket(outbound)
+	if received := waitForTUNPacket(t, serverTUN); !bytes.Equal(received, outbound) {
+		t.Errorf("Expected the %d-byte packet on the server TUN, got %d bytes", len(outbound), len(received))
+	}
+	if dropped := vpnClient.OversizedPackets(); dropped != 1 {
+		t.Errorf("Expected 1 oversized packet on the client, got %d", dropped)
+	}
+
+	tooLarge = createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), make([]byte, fits+1))
+	inbound := createMockIPPacket("8.8.8.8", vpnClient.GetAssignedIP(), make([]byte, fits))
+	serverTUN.QueueReadPacket(tooLarge)
+	serverTUN.QueueReadPacket(inbound)
+	if received := waitForTUNPacket(t, clientTUN); !bytes.Equal(received, inbound) {
+		t.Errorf("Expected the %d-byte packet on the client TUN, got %d bytes", len(inbound), len(received))
+	}
+	if dropped := server.GetServerStatus().DroppedTooLarge; dropped != 1 {
+		t.Errorf("Expected 1 packet dropped as too large on the server, got %d", dropped)
+	}
+}
+
+// TestServerFull tests that a client connecting to a server with no
+// addresses left is told so at once, without being registered, and moves on
+// to its fallback server
+func TestServerFull(t *testing.T) {
+	newServer := func() *Server {
+		server, err := NewServerWithOptions(ServerOptions{
+			Port:   "127.0.0.1:0",
+			Subnet: "10.9.0.0/30",
+			TUN:    network.NewMockTunManager(),
+		})
+		if err != nil {
+			t.Fatalf("NewServerWithOptions failed: %v", err)
+		}
+		err = server.Serve()
+		if err != nil {
+			t.Fatalf("Serve failed: %v", err)
+		}
+		t.Cleanup(func() { server.Stop() })
+		return server
+	}
+
+	full := newServer()
+	fallback := newServer()
+
+	_, capacity := SubnetCapacity(full.subnet)
+	for i := 0; i < capacity; i++ {
+		vpnClient := client.NewClientWithTUN(full.GetAddr().String(), network.NewMockTunManager())
+		err := vpnClient.Connect()
+		if err != nil {
+			t.Fatalf("Failed to connect client %d of %d: %v", i+1, capacity, err)
+		}
+		defer vpnClient.Disconnect()
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		vpnClient := client.NewClientWithTUN(full.GetAddr().String(), network.NewMockTunManager())
+
+		start := time.Now()
+		err := vpnClient.Connect()
+		if err == nil {
+			vpnClient.Disconnect()
+			t.Fatal("Expected connect to a full server to be refused")
+		}
+		if !errors.Is(err, client.ErrServerFull) {
+			t.Errorf("Expected ErrServerFull, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected an immediate error, took %s", elapsed)
+		}
+		if total := full.GetServerStatus().TotalClients; total != capacity {
+			t.Errorf("Expected the refused client not to be registered, got %d clients for capacity %d", total, capacity)
+		}
+	})
+
+	t.Run("falls back", func(t *testing.T) {
+		servers := full.GetAddr().String() + "," + fallback.GetAddr().String()
+		vpnClient := client.NewClientWithTUN(servers, network.NewMockTunManager())
+
+		err := vpnClient.Connect()
+		if err != nil {
+			t.Fatalf("Expected to connect to the fallback server, got %v", err)
+		}
+		defer vpnClient.Disconnect()
+
+		if vpnClient.GetServerAddr() != fallback.GetAddr().String() {
+			t.Errorf("Expected to connect to %s, got %s", fallback.GetAddr(), vpnClient.GetServerAddr())
+		}
+	})
+}
+
+// TestClientRoaming tests that replies follow a client whose source address
+// changes mid-session once it sends an authenticated packet from the new one
+func TestClientRoaming(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{Port: "127.0.0.1:0", TUN: serverTUN})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	// Two sockets stand in for the same client before and after a NAT rebind
+	oldConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer oldConn.Close()
+
+	newConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP socket: %v", err)
+	}
+	defer newConn.Close()
+
+	key := make([]byte, 32)
+	client, err := server.clientManager.AddClient(key, oldConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, server.clientManager, client)
+
+	sendData := func(conn *net.UDPConn, sequence uint32, payload []byte) {
+		encrypted, err := encryptFromClient(payload, key, sequence)
+		if err != nil {
+			t.Fatalf("Failed to encrypt payload: %v", err)
+		}
+		packetData, err := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, sequence, encrypted))
+		if err != nil {
+			t.Fatalf("Failed to encode packet: %v", err)
+		}
+		_, err = conn.WriteToUDP(packetData, server.GetAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("Failed to send packet: %v", err)
+		}
+	}
+
+	// A forged packet from the new address must not move the client
+	forged, err := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, 1, []byte("not encrypted")))
+	if err != nil {
+		t.Fatalf("Failed to encode packet: %v", err)
+	}
+	_, err = newConn.WriteToUDP(forged, server.GetAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to send packet: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	addr, err := server.clientManager.GetClientAddr(client.ID)
+	if err != nil || addr.String() != oldConn.LocalAddr().String() {
+		t.Fatalf("Expected address %s after forged packet, got %v (%v)", oldConn.LocalAddr(), addr, err)
+	}
+
+	// An authenticated packet from the new address moves the client
+	sendData(newConn, 1, createMockIPPacket(client.IP, "8.8.8.8", []byte("after roaming")))
+	waitForTUNPacket(t, serverTUN)
+
+	addr, err = server.clientManager.GetClientAddr(client.ID)
+	if err != nil || addr.String() != newConn.LocalAddr().String() {
+		t.Fatalf("Expected address %s after roaming, got %v (%v)", newConn.LocalAddr(), addr, err)
+	}
+
+	// Return traffic goes to the new address
+	serverTUN.QueueReadPacket(createMockIPPacket("8.8.8.8", client.IP, []byte("reply")))
+
+	newConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, err := newConn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Expected reply on new address: %v", err)
+	}
+
+	reply, err := protocol.DecodePacket(buffer[:n])
+	if err != nil {
+		t.Fatalf("Failed to decode reply: %v", err)
+	}
+	if reply.Type != protocol.PacketTypeData || reply.ClientID != client.ID {
+		t.Errorf("Expected data packet for client %d, got type %d for client %d", client.ID, reply.Type, reply.ClientID)
+	}
+}
+
+// TestRekey tests that traffic keeps flowing in both directions while the
+// server replaces a client's session keys several times
+func TestRekey(t *testing.T) {
+	defer func(interval time.Duration) { rekeyCheckInterval = interval }(rekeyCheckInterval)
+	rekeyCheckInterval = 10 * time.Millisecond
+
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:          "127.0.0.1:0",
+		TUN:           serverTUN,
+		RekeyInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	session, err := server.clientManager.GetClient(vpnClient.GetClientID())
+	if err != nil {
+		t.Fatalf("GetClient failed: %v", err)
+	}
+	if !session.Rekey {
+		t.Fatal("Expected rekeys to be negotiated")
+	}
+	initial := session.Keys.Keys()
+
+	exchangeTraffic(t, serverTUN, clientTUN, vpnClient.GetAssignedIP(), func() bool {
+		return session.Keys.Rekeys() >= 3
+	})
+
+	if bytes.Equal(session.Keys.Keys().ServerToClient, initial.ServerToClient) {
+		t.Error("Expected the session keys to be replaced")
+	}
+}
+
+// TestRekey_ClientStarted tests a rekey the client starts after a byte count
+func TestRekey_ClientStarted(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{Port: "127.0.0.1:0", TUN: serverTUN})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	err = vpnClient.SetRekey(0, 1000)
+	if err != nil {
+		t.Fatalf("SetRekey failed: %v", err)
+	}
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	session, err := server.clientManager.GetClient(vpnClient.GetClientID())
+	if err != nil {
+		t.Fatalf("GetClient failed: %v", err)
+	}
+
+	exchangeTraffic(t, serverTUN, clientTUN, vpnClient.GetAssignedIP(), func() bool {
+		return session.Keys.Rekeys() >= 1
+	})
+}
+
+// exchangeTraffic sends packets through the tunnel in both directions,
+// checking each one arrives, until done reports true
+func exchangeTraffic(t *testing.T, serverTUN, clientTUN *network.MockTunManager, clientIP string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; !done(); i++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for rekeys after %d round trips", i)
+		}
+
+		outbound := createMockIPPacket(clientIP, "8.8.8.8", []byte(fmt.Sprintf("client to server %d", i)))
+		clientTUN.QueueReadPacket(outbound)
+		if received := waitForTUNPacket(t, serverTUN); !bytes.Equal(received, outbound) {
+			t.Fatalf("Server TUN got %x, expected %x", received, outbound)
+		}
+
+		inbound := createMockIPPacket("8.8.8.8", clientIP, []byte(fmt.Sprintf("server to client %d", i)))
+		serverTUN.QueueReadPacket(inbound)
+		if received := waitForTUNPacket(t, clientTUN); !bytes.Equal(received, inbound) {
+			t.Fatalf("Client TUN got %x, expected %x", received, inbound)
+		}
+	}
+}
+
+// TestDataPort tests that a client offered a data socket sends its data
+// packets there and gets the server's back from it, while pings still go
+// through the listener
+func TestDataPort(t *testing.T) {
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:     "127.0.0.1:0",
+		DataPort: "127.0.0.1:0",
+		TUN:      serverTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.GetDataAddr() == nil {
+		t.Fatal("Expected a data socket")
+	}
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	vpnClient.SetKeepAliveInterval(20 * time.Millisecond)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Pings interleave with data packets numbered from the same sequence
+	exchangeTraffic(t, serverTUN, clientTUN, vpnClient.GetAssignedIP(), func() bool {
+		return vpnClient.GetRTT() > 0
+	})
+
+	session := server.clientManager.Snapshot()[0]
+	if !session.DataPlane {
+		t.Error("Expected the client to be offered the data socket")
+	}
+	if session.DataAddr == nil || session.DataAddr.String() == session.Address {
+		t.Errorf("Expected data packets from a separate address, got %v and control from %s", session.DataAddr, session.Address)
+	}
+}
+
+// TestDataPort_ControlUnderLoad tests that pings on the listener are still
+// answered while the data socket is flooded, and that the data socket
+// ignores control packets
+func TestDataPort_ControlUnderLoad(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:     "127.0.0.1:0",
+		DataPort: "127.0.0.1:0",
+		TUN:      network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	controlAddr := server.GetAddr().(*net.UDPAddr)
+	dataAddr := server.GetDataAddr().(*net.UDPAddr)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open client socket: %v", err)
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, 1500)
+	receive := func(timeout time.Duration) (*protocol.Packet, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.DecodePacket(buffer[:n])
+	}
+
+	clientNonce := make([]byte, crypto.SessionNonceSize)
+	options, _ := protocol.EncodeAuthOptions(protocol.AuthOptions{protocol.AuthOptionClientNonce: clientNonce})
+	authPacket, _ := protocol.EncodePacket(protocol.CreateAuthPacket(0, 1, options))
+	conn.WriteToUDP(authPacket, controlAddr)
+	response, err := receive(time.Second)
+	if err != nil || response.Type != protocol.PacketTypeAuth {
+		t.Fatalf("Expected an auth response, got %v, %v", response, err)
+	}
+	clientID := response.ClientID
+
+	// Pings are sealed like data with the keys the handshake derived
+	key, _, responseOptions, err := protocol.DecodeAuthResponse(response.Payload)
+	if err != nil {
+		t.Fatalf("DecodeAuthResponse failed: %v", err)
+	}
+	session, err := crypto.DeriveSessionKeys(key, clientNonce, responseOptions[protocol.AuthOptionServerNonce])
+	if err != nil {
+		t.Fatalf("DeriveSessionKeys failed: %v", err)
+	}
+	keys := crypto.NewKeyRing(session, true)
+	newPing := func(sequence uint32) []byte {
+		sealed, err := keys.Seal(crypto.DefaultCipher(), []byte{}, sequence)
+		if err != nil {
+			t.Fatalf("Failed to seal ping: %v", err)
+		}
+		ping := protocol.CreatePingPacket(clientID, sequence)
+		ping.Payload = sealed
+		ping.Length = uint16(len(sealed))
+		data, _ := protocol.EncodePacket(ping)
+		return data
+	}
+
+	ping := newPing(2)
+	conn.WriteToUDP(ping, dataAddr)
+	if packet, err := receive(200 * time.Millisecond); err == nil {
+		t.Errorf("Expected no answer to a ping on the data socket, got %v", packet)
+	}
+
+	// Datagrams over the MTU are dropped as soon as they are read, so the
+	// flood costs the server little besides a full data socket
+	stop := make(chan struct{})
+	var flooders sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		flooders.Add(1)
+		go func() {
+			defer flooders.Done()
+			flood, err := net.DialUDP("udp", nil, dataAddr)
+			if err != nil {
+				return
+			}
+			defer flood.Close()
+
+			junk := make([]byte, 2000)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					flood.Write(junk)
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		flooders.Wait()
+	}()
+
+	for sequence := uint32(3); sequence < 13; sequence++ {
+		conn.WriteToUDP(newPing(sequence), controlAddr)
+
+		pong, err := receive(time.Second)
+		if err != nil {
+			t.Fatalf("Expected a pong to ping %d under data load, got %v", sequence, err)
+		}
+		if pong.Type != protocol.PacketTypePong {
+			t.Fatalf("Expected a pong, got packet type %d", pong.Type)
+		}
+	}
+
+	if server.oversized.Load() == 0 {
+		t.Error("Expected the flood to reach the data socket")
+	}
+}
+
+// TestReloadDisconnectsRemovedClient tests that reloading a configuration
+// without a client's key drops its live session, so its next data packet is
+// rejected instead of reaching the TUN interface
+func TestReloadDisconnectsRemovedClient(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	writeConfig := func(clients string) {
+		config := "server:\n  port: \"127.0.0.1:0\"\nclients:\n" + clients
+		err := os.WriteFile(configPath, []byte(config), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	writeConfig(fmt.Sprintf("  - id: 5\n    key: \"%x\"\n  - id: 6\n    key: \"%x\"\n", key, bytes.Repeat([]byte{0x24}, 32)))
+
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{TUN: serverTUN})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	err = server.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	vpnClient.SetPreSharedKey(5, key)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	before := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("before removal"))
+	clientTUN.QueueReadPacket(before)
+	waitForTUNPacket(t, serverTUN)
+
+	// Removing an unrelated key leaves the session alone
+	writeConfig(fmt.Sprintf("  - id: 5\n    key: \"%x\"\n", key))
+	err = server.Reload(configPath)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if count := len(server.clientManager.ListClients()); count != 1 {
+		t.Fatalf("Expected client kept after unrelated removal, got %d clients", count)
+	}
+
+	writeConfig("  []\n")
+	err = server.Reload(configPath)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if count := len(server.clientManager.ListClients()); count != 0 {
+		t.Fatalf("Expected removed client disconnected, got %d clients", count)
+	}
+
+	after := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("after removal"))
+	clientTUN.QueueReadPacket(after)
+
+	time.Sleep(300 * time.Millisecond)
+	if writeQueue := serverTUN.GetWriteQueue(); len(writeQueue) != 0 {
+		t.Errorf("Expected packet from removed client to be rejected, got %d packets on TUN", len(writeQueue))
+	}
+}
+
+// TestReloadKeyGracePeriod tests that a session using a client's old key
+// keeps decrypting after a reload rotates the key, until the grace period
+// ends and the session is dropped
+func TestReloadKeyGracePeriod(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{0x42}, 32)
+	newKey := bytes.Repeat([]byte{0x43}, 32)
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	writeConfig := func(key []byte) {
+		config := fmt.Sprintf("server:\n  port: \"127.0.0.1:0\"\n  key_grace_period: 500ms\nclients:\n  - id: 5\n    key: \"%x\"\n", key)
+		err := os.WriteFile(configPath, []byte(config), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	writeConfig(oldKey)
+
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{TUN: serverTUN})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	err = server.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	vpnClient.SetPreSharedKey(5, oldKey)
+
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	writeConfig(newKey)
+	err = server.Reload(configPath)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	during := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("during grace period"))
+	clientTUN.QueueReadPacket(during)
+	if received := waitForTUNPacket(t, serverTUN); !bytes.Equal(received, during) {
+		t.Errorf("Server TUN got %x, expected %x", received, during)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.clientManager.ListClients()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := len(server.clientManager.ListClients()); count != 0 {
+		t.Fatalf("Expected the old key's session dropped after the grace period, got %d clients", count)
+	}
+
+	after := createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("after grace period"))
+	clientTUN.QueueReadPacket(after)
+
+	time.Sleep(300 * time.Millisecond)
+	if writeQueue := serverTUN.GetWriteQueue(); len(writeQueue) != 0 {
+		t.Errorf("Expected packet with the old key to be rejected, got %d packets on TUN", len(writeQueue))
+	}
+}
+
+// createTCPSYNPacket builds an IPv4 TCP SYN advertising the given MSS
+func createTCPSYNPacket(srcIP, dstIP string, mss uint16) []byte {
+	options := []byte{2, 4, byte(mss >> 8), byte(mss)}
+	packet := createMockIPPacket(srcIP, dstIP, make([]byte, 20+len(options)))
+	packet[9] = 6
+
+	tcp := packet[20:]
+	tcp[12] = byte((20+len(options))/4) << 4
+	tcp[13] = 0x02
+	copy(tcp[20:], options)
+	return packet
+}
+
+// TestClampMSS tests that TCP SYNs are clamped to the tunnel MTU in both
+// directions by whichever side has clamping enabled
+func TestClampMSS(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverMTU int
+		clientMTU int
+		wantMSS   uint16
+	}{
+		{name: "server", serverMTU: 1400, wantMSS: 1360},
+		{name: "client", clientMTU: 1300, wantMSS: 1260},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverTUN := network.NewMockTunManager()
+			opts := ServerOptions{Port: "127.0.0.1:0", TUN: serverTUN}
+			if tt.serverMTU != 0 {
+				opts.MTU = tt.serverMTU
+				opts.ClampMSS = true
+			}
+			server, err := NewServerWithOptions(opts)
+			if err != nil {
+				t.Fatalf("NewServerWithOptions failed: %v", err)
+			}
+			err = server.Serve()
+			if err != nil {
+				t.Fatalf("Serve failed: %v", err)
+			}
+			defer server.Stop()
+
+			clientTUN := network.NewMockTunManager()
+			vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+			err = vpnClient.SetClampMSS(tt.clientMTU)
+			if err != nil {
+				t.Fatalf("SetClampMSS failed: %v", err)
+			}
+			err = vpnClient.Connect()
+			if err != nil {
+				t.Fatalf("Failed to connect client: %v", err)
+			}
+			defer vpnClient.Disconnect()
+
+			mssOf := func(packet []byte) uint16 {
+				return uint16(packet[42])<<8 | uint16(packet[43])
+			}
+
+			clientTUN.QueueReadPacket(createTCPSYNPacket(vpnClient.GetAssignedIP(), "93.184.216.34", 1460))
+			if mss := mssOf(waitForTUNPacket(t, serverTUN)); mss != tt.wantMSS {
+				t.Errorf("Expected outbound SYN with MSS %d, got %d", tt.wantMSS, mss)
+			}
+
+			serverTUN.QueueReadPacket(createTCPSYNPacket("93.184.216.34", vpnClient.GetAssignedIP(), 1460))
+			if mss := mssOf(waitForTUNPacket(t, clientTUN)); mss != tt.wantMSS {
+				t.Errorf("Expected inbound SYN with MSS %d, got %d", tt.wantMSS, mss)
+			}
+		})
+	}
+}
+
+// lockedBuffer collects log output written from several goroutines
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// TestPacketTrace tests that packet tracing logs headers and flows for both
+// sides of the tunnel without ever logging payload contents
+func TestPacketTrace(t *testing.T) {
+	output := &lockedBuffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	serverTUN := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{Port: "127.0.0.1:0", TUN: serverTUN})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	server.SetPacketTrace(true)
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	vpnClient.SetPacketTrace(true)
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// A UDP datagram from port 50000 to 53 carrying a secret
+	payload := append([]byte{0xC3, 0x50, 0x00, 0x35, 0, 14, 0, 0}, "top-secret"...)
+	clientTUN.QueueReadPacket(createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", payload))
+	waitForTUNPacket(t, serverTUN)
+
+	flow := fmt.Sprintf("UDP %s:50000 -> 8.8.8.8:53", vpnClient.GetAssignedIP())
+	wants := []string{
+		"TRACE send " + server.GetAddr().String() + ": auth client 0",
+		"TRACE recv " + vpnClient.GetLocalAddr().String() + ": auth client 0",
+		"encrypted, " + flow,
+		"decrypted, " + flow,
+	}
+
+	// The client may log its send after the server has handled the packet
+	var logged string
+	deadline := time.Now().Add(2 * time.Second)
+	for _, want := range wants {
+		for {
+			logged = output.String()
+			if strings.Contains(logged, want) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !strings.Contains(logged, want) {
+			t.Errorf("Expected trace to contain %q, got:\n%s", want, logged)
+		}
+	}
+	if strings.Contains(logged, "top-secret") {
+		t.Errorf("Expected payload contents to stay out of the trace, got:\n%s", logged)
+	}
+}
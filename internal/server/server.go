@@ -1,10 +1,16 @@
 package server
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/crypto"
@@ -13,21 +19,41 @@ import (
 
 // ServerStatus represents the current server status
 type ServerStatus struct {
-	Uptime           time.Duration `json:"uptime"`
-	TotalClients     int           `json:"total_clients"`
-	ConnectedClients int           `json:"connected_clients"`
-	ServerIP         string        `json:"server_ip"`
-	TUNInterface     string        `json:"tun_interface"`
-	Port             string        `json:"port"`
-	Status           string        `json:"status"` // "running", "stopped", "error"
+	Uptime            time.Duration `json:"uptime"`
+	TotalClients      int           `json:"total_clients"`
+	ConnectedClients  int           `json:"connected_clients"`
+	ServerIP          string        `json:"server_ip"`
+	TUNInterface      string        `json:"tun_interface"`
+	Port              string        `json:"port"`
+	Status            string        `json:"status"`           // "running", "stopped", "error"
+	PacketsReceived   uint64        `json:"packets_received"` // Datagrams read from the socket, including dropped ones
+	DroppedOversized  uint64        `json:"dropped_oversized"`
+	DroppedNetworkMAC uint64        `json:"dropped_network_mac"` // Datagrams without a valid network MAC, see ServerOptions.NetworkKey
+	DroppedTUNQueue   uint64        `json:"dropped_tun_queue"`   // Client packets dropped because the TUN interface fell behind
+	DroppedTooLarge   uint64        `json:"dropped_too_large"`   // Packets for clients dropped for not fitting in max_udp_payload
+	DroppedBanned     uint64        `json:"dropped_banned"`      // Datagrams from sources banned for failing to decrypt
+	DroppedMalformed  uint64        `json:"dropped_malformed"`   // Datagrams that didn't decode as packets
+	ReadErrors        uint64        `json:"read_errors"`         // Socket reads that failed other than by timing out
+	DroppedUDPSend    uint64        `json:"dropped_udp_send"`    // Packets for clients the socket failed to send
+	TUNQueued         uint64        `json:"tun_queued"`          // Client packets queued for the TUN interface
+	TUNQueueDepth     int           `json:"tun_queue_depth"`     // Client packets still waiting for the TUN interface
 }
 
 // ClientStatus represents real-time client information
 type ClientStatus struct {
-	ID        uint8     `json:"id"`
-	IP        string    `json:"ip"`
-	Connected bool      `json:"connected"`
-	LastSeen  time.Time `json:"last_seen"`
+	ID             uint8         `json:"id"`
+	IP             string        `json:"ip"`
+	Connected      bool          `json:"connected"`
+	LastSeen       time.Time     `json:"last_seen"`
+	ConnectedSince time.Time     `json:"connected_since"` // When the current session was set up
+	Uptime         time.Duration `json:"uptime"`          // How long the current session has lasted
+	BytesRx        uint64        `json:"bytes_rx"`      // IP packet bytes, what applications sent
+	BytesTx        uint64        `json:"bytes_tx"`
+	WireBytesRx    uint64        `json:"wire_bytes_rx"` // UDP payload bytes, including headers, tags and the network MAC
+	WireBytesTx    uint64        `json:"wire_bytes_tx"`
+	PacketsRx      uint64        `json:"packets_rx"`
+	PacketsTx      uint64        `json:"packets_tx"`
+	RTT            time.Duration `json:"rtt"` // Reported by the client; zero if unknown
 }
 
 // Server represents the VPN server
@@ -37,42 +63,233 @@ type Server struct {
 	clientManager  *ClientManager
 	packetProcessor *PacketProcessor
 	udpConn        *net.UDPConn
+	transport      network.Transport
+	customTransport network.Transport // Used instead of udpConn when set, see ServerOptions.Transport
+	dataPort       string            // Listen address of dataConn; empty carries data packets on udpConn
+	dataConn       *net.UDPConn      // Socket for data packets, so they can't hold up control packets
+	dataTransport  network.Transport // Sends through dataConn; nil without one
 	stopChan       chan struct{}
+	stopMutex      sync.Mutex      // Serializes Stop, which a cancelled context calls too
+	ctx            context.Context // Stops the server when done, see StartContext
 	wg             sync.WaitGroup
 	timeout        time.Duration
 	startTime      time.Time
 	serverIP       string
 	port           string
+	subnet         *net.IPNet
+	cipher         crypto.Cipher
+	natEnabled     bool
+	wanInterface   string
+	nat            *network.NATManager
+	stateFile      *network.StateFile // Records NAT changes for cleanup after a crash; nil disables
+	leaseFile      string             // Keeps configured clients' tunnel IPs across restarts, see SetLeaseFile
+	healthAddr     string
+	healthServer   *http.Server
+	healthListener net.Listener
+	adminSocket    string // Unix socket path for admin commands; empty disables it
+	adminListener  net.Listener
+	configPath     string // File the server was configured from, for reloads
+	interfaceName  string
+	mtu            int
+	clampMSS       bool // Clamp the MSS of tunneled TCP connections to fit mtu
+	allowedIPs     map[uint8][]*net.IPNet // Extra networks per configured client ID
+	reservedIPs    map[uint8]string       // Tunnel IP per configured client ID
+	pushRoutes     []PushRoute            // Networks advertised to clients at handshake
+	ipAllocator    IPAllocator            // Custom client address allocator, nil for the default
+	received       atomic.Uint64          // Datagrams read from the socket
+	oversized      atomic.Uint64          // Datagrams dropped for exceeding maxDatagramSize
+	oversizedLog   atomic.Int64           // When the last oversized warning was logged, in Unix nanoseconds
+	networkKey     []byte                 // Key for the network MAC on every datagram; nil disables it
+	identityKey    ed25519.PrivateKey     // Signs auth responses so clients can pin the server; nil sends no identity
+	badNetworkMAC  atomic.Uint64          // Datagrams dropped for a missing or wrong network MAC
+	malformed      atomic.Uint64          // Datagrams dropped because they didn't decode
+	malformedLog   rateLimitedLog         // Rate-limits the log line for each of them
+	readErrors     atomic.Uint64          // Socket reads that failed other than by timing out
+	readErrorLog   rateLimitedLog         // Rate-limits the log line for each of them
+	dataErrorLog   rateLimitedLog         // Rate-limits the log line for data packets that failed to process, e.g. to decrypt
+	tunReadLog     rateLimitedLog         // Rate-limits the log line for failed TUN reads
+	bans           *sourceBans            // Sources banned for decrypt failures; nil disables banning
+	banned         atomic.Uint64          // Datagrams dropped from banned sources
+	packetTrace    bool                   // Log every packet sent and received, see SetPacketTrace
+	eventHandler   EventHandler
+	events         *eventDispatcher
+	probeInterval  time.Duration // How often idle clients are probed
+	statsInterval  time.Duration // How often traffic stats are logged; zero disables
+	keyGracePeriod time.Duration // How long Reload keeps sessions with a changed key
+	maxUDPPayload  int           // Largest datagram sent to clients; zero for no limit
+	dscp           int           // DSCP marked on datagrams to clients; zero leaves them unmarked
+	rekeyInterval  time.Duration // How often client session keys are replaced; zero disables
+	rekeyBytes     uint64        // Payload bytes after which client session keys are replaced; zero disables
+	drainTimeout   time.Duration // How long Stop serves after notifying clients
+	tunFD          int           // Descriptor of a TUN interface created elsewhere, see SetTUNFD; -1 creates one
+	random         io.Reader     // Source of the keys generated for new clients. Overridable for tests
+	logPath        string        // File the log is written to while running; empty leaves it on stderr
+	logMaxSize     int64         // Size in bytes at which the log file is rotated
+	logMaxBackups  int           // Rotated log files kept
+	logFile        *rotatingLog  // Open log file while running; nil without one
+	pcapPath       string        // File decrypted packets are captured to for debugging; empty disables
+	pcapMaxSize    int64         // Size in bytes at which the capture stops
+	pcap           *network.PcapWriter // Open capture while running; nil without one
+	dnsUpstream    string        // Resolver DNS queries to serverIP are relayed to; empty disables the relay
+	keysMutex      sync.RWMutex  // Guards keyManager, allowedIPs and reservedIPs, which Reload swaps
 }
 
 // NewServer creates a new VPN server
 func NewServer() *Server {
 	return &Server{
 		stopChan: make(chan struct{}),
-		timeout:  30 * time.Minute, // Default timeout
+		ctx:      context.Background(),
+		timeout:  DefaultTimeout,
+		mtu:           DefaultMTU,
+		cipher:        crypto.DefaultCipher(),
+		probeInterval: DefaultProbeInterval,
+		drainTimeout:  DefaultDrainTimeout,
+		tunFD:         -1,
+		random:        rand.Reader,
 	}
 }
 
-// Start starts the VPN server
+// SetEventHandler registers a handler to be told when clients connect and
+// disconnect. It must be called before the server is started.
+func (s *Server) SetEventHandler(handler EventHandler) {
+	s.eventHandler = handler
+}
+
+// SetTimeout changes how long clients may be idle before they are removed,
+// taking effect on a running server from its next timeout check. The config
+// file is left alone, so the next start goes back to timeout_minutes.
+func (s *Server) SetTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s: must be positive", timeout)
+	}
+
+	s.timeout = timeout
+	if s.clientManager != nil {
+		s.clientManager.SetTimeout(timeout)
+	}
+	log.Printf("Client timeout set to %s", timeout)
+	return nil
+}
+
+// GetTimeout returns how long clients may be idle before they are removed
+func (s *Server) GetTimeout() time.Duration {
+	if s.clientManager != nil {
+		return s.clientManager.GetTimeout()
+	}
+	return s.timeout
+}
+
+// SetTUNFD makes the server adopt the TUN interface open as file descriptor
+// fd, which another process created and configured, instead of creating
+// one. Its address, MTU and link state are left alone, so the server needs
+// no CAP_NET_ADMIN for it; the interface name configured must still be its
+// name. It must be called before the server is started.
+func (s *Server) SetTUNFD(fd int) {
+	s.tunFD = fd
+}
+
+// SetStateFile makes the server record the NAT rules it installs in a file
+// at path, and undo any left there by an earlier run that crashed before
+// starting. An empty path disables this. It must be called before the
+// server is started.
+func (s *Server) SetStateFile(path string) {
+	if path == "" {
+		s.stateFile = nil
+		return
+	}
+	s.stateFile = network.NewStateFile(path)
+}
+
+// Start loads the configuration file and starts the VPN server
 func (s *Server) Start(configPath, port string) error {
+	return s.StartContext(context.Background(), configPath, port)
+}
+
+// StartContext is Start for a server that stops when ctx is done, as if Stop
+// were called. Its packet loops return as soon as ctx is done, so clients
+// are told the server is stopping but their traffic isn't forwarded while
+// Stop drains them. Stop may still be called, before or after.
+func (s *Server) StartContext(ctx context.Context, configPath, port string) error {
 	log.Printf("Starting VPN server...")
 	
+	err := s.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	
+	s.ctx = ctx
+	return s.start(port)
+}
+
+// Serve starts the VPN server with the options it was created with, without
+// reading any configuration files
+func (s *Server) Serve() error {
+	return s.ServeContext(context.Background())
+}
+
+// ServeContext is Serve for a server that stops when ctx is done, like
+// StartContext
+func (s *Server) ServeContext(ctx context.Context) error {
+	log.Printf("Starting VPN server...")
+	
+	if s.keyManager == nil {
+		return fmt.Errorf("server options not set, use NewServerWithOptions")
+	}
+	
+	port := s.port
+	if port == "" {
+		port = DefaultPort
+	}
+	
+	s.ctx = ctx
+	return s.start(port)
+}
+
+func (s *Server) start(port string) error {
+	// A failed start tears down with Stop, which closes stopChan; open it
+	// again so the server can be started once whatever failed is fixed
+	select {
+	case <-s.stopChan:
+		s.stopChan = make(chan struct{})
+	default:
+	}
+
 	// Set server status tracking
 	s.startTime = time.Now()
 	s.port = port
 	
-	// Step 1: Load configuration
-	err := s.LoadConfig(configPath)
+	err := s.openLog()
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return err
+	}
+
+	// Undo whatever an earlier run that crashed left behind
+	err = s.stateFile.Reconcile()
+	if err != nil {
+		log.Printf("Failed to clean up after an earlier run: %v", err)
 	}
+
+	// If a step fails, tear down what the earlier ones set up, so a failed
+	// start doesn't leave the TUN interface, socket or NAT rule behind
+	started := false
+	defer func() {
+		if !started {
+			s.Stop()
+		}
+	}()
 	
-	// Step 2: Create TUN interface
+	// Step 1: Create TUN interface
 	err = s.CreateTUNInterface()
 	if err != nil {
 		return fmt.Errorf("failed to create TUN interface: %w", err)
 	}
 	
+	// Step 2: Set up NAT for client traffic, if enabled
+	err = s.SetupNAT()
+	if err != nil {
+		return fmt.Errorf("failed to set up NAT: %w", err)
+	}
+	
 	// Step 3: Create client manager
 	err = s.CreateClientManager()
 	if err != nil {
@@ -94,24 +311,77 @@ func (s *Server) Start(configPath, port string) error {
 	// Step 6: Start packet processing goroutines
 	s.startPacketProcessing()
 	
+	// Step 7: Start health check endpoint, if configured
+	err = s.startHealthServer()
+	if err != nil {
+		return fmt.Errorf("failed to start health endpoint: %w", err)
+	}
+	
+	// Step 8: Start admin socket, if configured
+	err = s.startAdminServer()
+	if err != nil {
+		return fmt.Errorf("failed to start admin socket: %w", err)
+	}
+	
+	started = true
 	log.Printf("VPN server started on port %s", s.port)
+
+	if s.ctx.Done() != nil {
+		go s.stopOnCancel()
+	}
 	return nil
 }
 
+// stopOnCancel stops the server once its context is done. It isn't counted
+// in wg, since Stop waits for wg.
+func (s *Server) stopOnCancel() {
+	select {
+	case <-s.ctx.Done():
+		log.Printf("Context done: %v", context.Cause(s.ctx))
+		s.Stop()
+	case <-s.stopChan:
+	}
+}
+
 // startPacketProcessing starts the packet processing goroutines
 func (s *Server) startPacketProcessing() {
 	// Start client packet handling goroutine
 	s.wg.Add(1)
 	go s.handleClients()
 	
+	// Start data packet handling goroutine, if data has its own socket
+	if s.dataConn != nil {
+		s.wg.Add(1)
+		go s.handleDataClients()
+	}
+	
 	// Start TUN packet routing goroutine
 	s.wg.Add(1)
 	go s.routePackets()
 	
+	// Start idle client prober goroutine
+	s.wg.Add(1)
+	go s.probeIdleClients()
+	
+	// Start periodic stats logging, if configured
+	if s.statsInterval > 0 {
+		s.wg.Add(1)
+		go s.logStats()
+	}
+	
+	// Start replacing client session keys, if configured
+	if s.rekeyInterval > 0 || s.rekeyBytes > 0 {
+		s.wg.Add(1)
+		go s.rekeyClients()
+	}
+	
 }
 
 // Stop stops the VPN server
 func (s *Server) Stop() error {
+	s.stopMutex.Lock()
+	defer s.stopMutex.Unlock()
+
 	log.Printf("Stopping VPN server...")
 	
 	// Only close stopChan if it's not already closed
@@ -119,23 +389,59 @@ func (s *Server) Stop() error {
 	case <-s.stopChan:
 		// Already closed, do nothing
 	default:
+		// Let clients fail over while the socket is still open
+		s.drainClients()
 		close(s.stopChan)
 	}
 	
 	// Wait for all goroutines to finish
 	s.wg.Wait()
 	
+	// Stop the health check endpoint and admin socket
+	s.stopHealthServer()
+	s.stopAdminServer()
+	
+	// Flush client packets still waiting for the TUN interface
+	if s.packetProcessor != nil {
+		s.packetProcessor.Close()
+	}
+	s.pcap.Close()
+	s.pcap = nil
+	
+	// Stop the client timeout checker
+	if s.clientManager != nil {
+		s.clientManager.Close()
+	}
+	
+	// Deliver any events still queued for the event handler
+	s.events.close()
+	
 	// Close UDP connection
 	if s.udpConn != nil {
 		s.udpConn.Close()
 	}
+	if s.dataConn != nil {
+		s.dataConn.Close()
+	}
+	if s.customTransport != nil {
+		s.customTransport.Close()
+	}
 	
 	// Close TUN interface
 	if s.tunInterface != nil {
 		s.tunInterface.Close()
 	}
 	
+	// Remove NAT rules
+	if s.nat != nil {
+		err := s.nat.Disable()
+		if err != nil {
+			log.Printf("Failed to remove NAT rules: %v", err)
+		}
+	}
+	
 	log.Printf("VPN server stopped")
+	s.closeLog()
 	return nil
 }
 
@@ -162,7 +468,7 @@ func (s *Server) GetServerStatus() ServerStatus {
 	}
 	
 	if s.clientManager != nil {
-		clients := s.clientManager.ListClients()
+		clients := s.clientManager.Snapshot()
 		status.TotalClients = len(clients)
 		
 		connectedCount := 0
@@ -176,7 +482,22 @@ func (s *Server) GetServerStatus() ServerStatus {
 	
 	status.ServerIP = s.serverIP
 	status.Port = s.port
-	status.TUNInterface = "fvp0"
+	status.PacketsReceived = s.received.Load()
+	status.DroppedOversized = s.oversized.Load()
+	status.DroppedNetworkMAC = s.badNetworkMAC.Load()
+	status.DroppedBanned = s.banned.Load()
+	status.DroppedMalformed = s.malformed.Load()
+	status.ReadErrors = s.readErrors.Load()
+	if s.packetProcessor != nil {
+		status.DroppedTUNQueue = s.packetProcessor.DroppedPackets()
+		status.DroppedTooLarge = s.packetProcessor.TooLargePackets()
+		status.DroppedUDPSend = s.packetProcessor.FailedSends()
+		status.TUNQueued, status.TUNQueueDepth = s.packetProcessor.QueuedPackets()
+	}
+	status.TUNInterface = s.getInterfaceName()
+	if s.tunInterface != nil && s.tunInterface.IsCreated() {
+		status.TUNInterface = s.tunInterface.GetName()
+	}
 	
 	return status
 }
@@ -186,21 +507,38 @@ func (s *Server) GetClientStatus() []ClientStatus {
 		return []ClientStatus{}
 	}
 	
-	clients := s.clientManager.ListClients()
-	status := make([]ClientStatus, len(clients))
-	
-	for i, client := range clients {
-		status[i] = ClientStatus{
-			ID:        client.ID,
-			IP:        client.IP,
-			Connected: client.Connected,
-			LastSeen:  client.LastSeen,
-		}
+	return s.clientManager.ClientStatuses()
+}
+
+// getInterfaceName returns the configured TUN interface name
+func (s *Server) getInterfaceName() string {
+	if s.interfaceName == "" {
+		return DefaultInterfaceName
 	}
-	
-	return status
+	return s.interfaceName
 }
 
 func (s *Server) GetPort() string {
 	return s.port
+}
+
+// GetAddr returns the address the UDP listener is bound to, or that of a
+// custom transport that reports one
+func (s *Server) GetAddr() net.Addr {
+	if local, ok := s.customTransport.(interface{ LocalAddr() net.Addr }); ok {
+		return local.LocalAddr()
+	}
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
+
+// GetDataAddr returns the address the data socket is bound to, or nil if data
+// packets share the listener
+func (s *Server) GetDataAddr() net.Addr {
+	if s.dataConn == nil {
+		return nil
+	}
+	return s.dataConn.LocalAddr()
 }
\ No newline at end of file
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+const (
+	// DefaultAdminSocket is the admin socket fvps setup configures, relative
+	// to the directory holding server.yaml
+	DefaultAdminSocket = "fvps.sock"
+
+	// adminTimeout bounds how long one admin request may take
+	adminTimeout = 5 * time.Second
+)
+
+// AdminResponse is the JSON answer to an admin command
+type AdminResponse struct {
+	OK      bool           `json:"ok"`
+	Error   string         `json:"error,omitempty"`
+	Status  *ServerStatus  `json:"status,omitempty"`
+	Clients []ClientStatus `json:"clients,omitempty"`
+	Timeout time.Duration  `json:"timeout,omitempty"` // Client timeout, for the timeout command
+}
+
+// AdminSocketPath resolves the admin_socket setting of the config file at
+// configPath, a relative socket path being relative to the directory holding
+// the file
+func AdminSocketPath(configPath, socket string) string {
+	return configRelativePath(configPath, socket)
+}
+
+// configRelativePath resolves a path set in the config file at configPath,
+// relative to the directory holding the file
+func configRelativePath(configPath, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+// AdminRequest sends one command to a running server's admin socket and
+// returns its response. Commands are "status", "list-clients",
+// "disconnect <id>", "reload", "timeout [duration]" and "stats reset". A command the server refuses is returned
+// as an error.
+func AdminRequest(socketPath, command string) (*AdminResponse, error) {
+	conn, err := net.DialTimeout("unix", socketPath, adminTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to admin socket: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	_, err = fmt.Fprintf(conn, "%s\n", command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send admin command: %w", err)
+	}
+
+	var response AdminResponse
+	err = json.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin response: %w", err)
+	}
+
+	if !response.OK {
+		return &response, errors.New(response.Error)
+	}
+	return &response, nil
+}
+
+// startAdminServer listens for admin commands on the configured Unix socket.
+// The socket is only accessible to its owner. It does nothing if no socket is
+// configured.
+func (s *Server) startAdminServer() error {
+	if s.adminSocket == "" {
+		return nil
+	}
+
+	// A socket left behind by a crashed server would block the listen, but
+	// one that still answers belongs to a running server
+	if _, err := os.Stat(s.adminSocket); err == nil {
+		conn, err := net.Dial("unix", s.adminSocket)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("admin socket %s is in use by another server", s.adminSocket)
+		}
+		os.Remove(s.adminSocket)
+	}
+
+	listener, err := network.ListenUnixPrivate(s.adminSocket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin socket: %w", err)
+	}
+
+	s.adminListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Admin socket error: %v", err)
+				}
+				return
+			}
+			go s.handleAdminConn(conn)
+		}
+	}()
+
+	log.Printf("Admin socket listening on %s", s.adminSocket)
+	return nil
+}
+
+// stopAdminServer closes the admin socket, if listening, and removes it
+func (s *Server) stopAdminServer() {
+	if s.adminListener == nil {
+		return
+	}
+
+	// Closing a Unix listener also unlinks its socket file
+	s.adminListener.Close()
+	s.adminListener = nil
+}
+
+// handleAdminConn answers a single command on an admin connection
+func (s *Server) handleAdminConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	response := s.adminCommand(strings.TrimSpace(line))
+	json.NewEncoder(conn).Encode(response)
+}
+
+// adminCommand runs one admin command
+func (s *Server) adminCommand(line string) AdminResponse {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return AdminResponse{Error: "empty command"}
+	}
+
+	switch fields[0] {
+	case "status":
+		status := s.GetServerStatus()
+		return AdminResponse{OK: true, Status: &status}
+
+	case "list-clients":
+		return AdminResponse{OK: true, Clients: s.GetClientStatus()}
+
+	case "disconnect":
+		if len(fields) != 2 {
+			return AdminResponse{Error: "usage: disconnect <id>"}
+		}
+		clientID, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return AdminResponse{Error: fmt.Sprintf("invalid client ID %q", fields[1])}
+		}
+		if s.clientManager == nil {
+			return AdminResponse{Error: "server is not running"}
+		}
+		err = s.clientManager.RemoveClient(uint8(clientID))
+		if err != nil {
+			return AdminResponse{Error: fmt.Sprintf("failed to disconnect client %d: %v", clientID, err)}
+		}
+		return AdminResponse{OK: true}
+
+	case "reload":
+		if s.configPath == "" {
+			return AdminResponse{Error: "server was not started from a configuration file"}
+		}
+		err := s.Reload(s.configPath)
+		if err != nil {
+			return AdminResponse{Error: err.Error()}
+		}
+		return AdminResponse{OK: true}
+
+	case "timeout":
+		if len(fields) > 2 {
+			return AdminResponse{Error: "usage: timeout [duration]"}
+		}
+		if len(fields) == 2 {
+			timeout, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return AdminResponse{Error: fmt.Sprintf("invalid timeout %q", fields[1])}
+			}
+			err = s.SetTimeout(timeout)
+			if err != nil {
+				return AdminResponse{Error: err.Error()}
+			}
+		}
+		return AdminResponse{OK: true, Timeout: s.GetTimeout()}
+
+	case "stats":
+		if len(fields) != 2 || fields[1] != "reset" {
+			return AdminResponse{Error: "usage: stats reset"}
+		}
+		s.ResetStats()
+		return AdminResponse{OK: true}
+
+	default:
+		return AdminResponse{Error: fmt.Sprintf("unknown command %q", fields[0])}
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// startAdminTestServer starts a server with an admin socket in a temporary
+// directory and returns the socket path
+func startAdminTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "fvps.sock")
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:        "127.0.0.1:0",
+		AdminSocket: socketPath,
+		TUN:         network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	return server, socketPath
+}
+
+func TestAdminSocket_Commands(t *testing.T) {
+	server, socketPath := startAdminTestServer(t)
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Expected admin socket to exist: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected admin socket mode 0600, got %o", perm)
+	}
+
+	response, err := AdminRequest(socketPath, "status")
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if response.Status == nil || response.Status.Status != "running" {
+		t.Errorf("Expected running status, got %+v", response.Status)
+	}
+
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	response, err = AdminRequest(socketPath, "list-clients")
+	if err != nil {
+		t.Fatalf("list-clients failed: %v", err)
+	}
+	if len(response.Clients) != 1 || response.Clients[0].IP != vpnClient.GetAssignedIP() {
+		t.Fatalf("Expected the connected client, got %+v", response.Clients)
+	}
+
+	_, err = AdminRequest(socketPath, fmt.Sprintf("disconnect %d", response.Clients[0].ID))
+	if err != nil {
+		t.Fatalf("disconnect failed: %v", err)
+	}
+	if count := len(server.GetClientStatus()); count != 0 {
+		t.Errorf("Expected client disconnected, got %d clients", count)
+	}
+}
+
+func TestAdminSocket_Timeout(t *testing.T) {
+	server, socketPath := startAdminTestServer(t)
+
+	response, err := AdminRequest(socketPath, "timeout")
+	if err != nil {
+		t.Fatalf("timeout failed: %v", err)
+	}
+	if response.Timeout != DefaultTimeout {
+		t.Errorf("Expected timeout %s, got %s", DefaultTimeout, response.Timeout)
+	}
+
+	response, err = AdminRequest(socketPath, "timeout 2h")
+	if err != nil {
+		t.Fatalf("timeout 2h failed: %v", err)
+	}
+	if response.Timeout != 2*time.Hour {
+		t.Errorf("Expected timeout 2h0m0s in the response, got %s", response.Timeout)
+	}
+	if timeout := server.clientManager.GetTimeout(); timeout != 2*time.Hour {
+		t.Errorf("Expected the client manager's timeout to be 2h0m0s, got %s", timeout)
+	}
+}
+
+func TestAdminSocket_Errors(t *testing.T) {
+	_, socketPath := startAdminTestServer(t)
+
+	commands := []string{
+		"",
+		"shutdown",
+		"disconnect",
+		"disconnect abc",
+		"disconnect 42",
+		"reload", // Not started from a configuration file
+		"stats",
+		"stats show",
+		"timeout soon",
+		"timeout -1m",
+		"timeout 1m 2m",
+	}
+
+	for _, command := range commands {
+		response, err := AdminRequest(socketPath, command)
+		if err == nil {
+			t.Errorf("Expected %q to fail", command)
+			continue
+		}
+		if response == nil || response.OK || response.Error == "" {
+			t.Errorf("Expected an error response for %q, got %+v", command, response)
+		}
+	}
+}
+
+// TestAdminSocket_Lifecycle tests that a stale socket file is replaced, a
+// live one is refused and the socket is removed on stop
+func TestAdminSocket_Lifecycle(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "fvps.sock")
+	err := os.WriteFile(socketPath, nil, 0600)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket file: %v", err)
+	}
+
+	newServer := func() *Server {
+		server, err := NewServerWithOptions(ServerOptions{
+			Port:        "127.0.0.1:0",
+			AdminSocket: socketPath,
+			TUN:         network.NewMockTunManager(),
+		})
+		if err != nil {
+			t.Fatalf("NewServerWithOptions failed: %v", err)
+		}
+		return server
+	}
+
+	first := newServer()
+	err = first.Serve()
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+
+	second := newServer()
+	err = second.Serve()
+	if err == nil {
+		second.Stop()
+		t.Error("Expected a second server on the same admin socket to fail")
+	}
+
+	first.Stop()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Expected admin socket removed on stop, got %v", err)
+	}
+}
+
+// TestAdminSocket_StatsReset tests that resetting stats zeroes the traffic
+// counters while leaving client sessions working
+func TestAdminSocket_StatsReset(t *testing.T) {
+	server, socketPath := startAdminTestServer(t)
+
+	clientTUN := network.NewMockTunManager()
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), clientTUN)
+	err := vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	// Packets are counted just after they reach the TUN interface, so wait
+	// for the count itself
+	send := func(payload string) {
+		t.Helper()
+		clientTUN.QueueReadPacket(createMockIPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte(payload)))
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if status := server.GetClientStatus(); len(status) == 1 && status[0].PacketsRx == 1 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for %q to be counted", payload)
+	}
+
+	send("before reset")
+	before := server.GetClientStatus()
+	if len(before) != 1 || before[0].PacketsRx != 1 || before[0].BytesRx == 0 {
+		t.Fatalf("Expected one packet counted before the reset, got %+v", before)
+	}
+
+	_, err = AdminRequest(socketPath, "stats reset")
+	if err != nil {
+		t.Fatalf("stats reset failed: %v", err)
+	}
+
+	after := server.GetClientStatus()
+	if len(after) != 1 || after[0].ID != before[0].ID || after[0].IP != before[0].IP {
+		t.Fatalf("Expected the client session to survive the reset, got %+v", after)
+	}
+	if after[0].PacketsRx != 0 || after[0].BytesRx != 0 || after[0].PacketsTx != 0 || after[0].BytesTx != 0 {
+		t.Errorf("Expected client counters zeroed, got %+v", after[0])
+	}
+	if received := server.GetServerStatus().PacketsReceived; received != 0 {
+		t.Errorf("Expected packets received zeroed, got %d", received)
+	}
+
+	// The session still carries traffic, counted afresh
+	send("after reset")
+	if status := server.GetClientStatus(); status[0].PacketsRx != 1 {
+		t.Errorf("Expected one packet counted after the reset, got %d", status[0].PacketsRx)
+	}
+}
+
+// TestStatsLogging tests that traffic stats are logged every stats interval
+// and that logging stops with the server
+func TestStatsLogging(t *testing.T) {
+	output := &lockedBuffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:          "127.0.0.1:0",
+		StatsInterval: 50 * time.Millisecond,
+		TUN:           network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	server.Stop()
+
+	logged := strings.Count(output.String(), "Stats: 0 clients")
+	if logged == 0 {
+		t.Fatalf("Expected stats lines, got:\n%s", output.String())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if after := strings.Count(output.String(), "Stats: 0 clients"); after != logged {
+		t.Errorf("Expected stats logging to stop with the server, got %d more lines", after-logged)
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDecryptBanDuration is how long a source that reached the decrypt
+// failure limit is banned when no duration is configured
+const DefaultDecryptBanDuration = 5 * time.Minute
+
+// maxTrackedSources caps how many source addresses failures are counted for,
+// so a flood from spoofed addresses can't grow the table without bound. When
+// it fills up the counts start over.
+const maxTrackedSources = 4096
+
+// sourceBans counts consecutive decrypt failures by source address and bans
+// a source for a while once it reaches the limit, so its datagrams are
+// dropped before anything is decrypted. A packet that decrypts resets its
+// source's count.
+type sourceBans struct {
+	limit    int
+	duration time.Duration
+
+	mutex    sync.Mutex
+	failures map[string]int       // Consecutive decrypt failures by source address
+	banned   map[string]time.Time // When each ban expires, by source address
+
+	now func() time.Time // Overridable for tests
+}
+
+func newSourceBans(limit int, duration time.Duration) *sourceBans {
+	return &sourceBans{
+		limit:    limit,
+		duration: duration,
+		failures: make(map[string]int),
+		banned:   make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Banned reports whether a source is banned, lifting its ban if it expired
+func (b *sourceBans) Banned(addr string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	expiry, exists := b.banned[addr]
+	if !exists {
+		return false
+	}
+	if b.now().Before(expiry) {
+		return true
+	}
+	delete(b.banned, addr)
+	return false
+}
+
+// Failed records a decrypt failure from a source and reports whether it
+// brought the source to the limit, banning it
+func (b *sourceBans) Failed(addr string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, exists := b.failures[addr]; !exists && len(b.failures) >= maxTrackedSources {
+		clear(b.failures)
+	}
+
+	b.failures[addr]++
+	if b.failures[addr] < b.limit {
+		return false
+	}
+
+	delete(b.failures, addr)
+	now := b.now()
+	for source, expiry := range b.banned {
+		if !now.Before(expiry) {
+			delete(b.banned, source)
+		}
+	}
+	b.banned[addr] = now.Add(b.duration)
+	return true
+}
+
+// Succeeded records a packet from a source that decrypted, resetting its
+// failure count
+func (b *sourceBans) Succeeded(addr string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.failures, addr)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// TestDecryptFailureBan tests that a source sending packets that don't
+// decrypt is banned once it reaches the limit, has its datagrams dropped
+// while banned and is let back in when the ban expires
+func TestDecryptFailureBan(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:                "127.0.0.1:0",
+		DecryptFailureLimit: 3,
+		DecryptBanDuration:  time.Minute,
+		TUN:                 network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	now := time.Now()
+	server.bans.now = func() time.Time { return now }
+
+	attacker := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	client, err := server.clientManager.AddClient(bytes.Repeat([]byte{0x11}, 32), attacker.String())
+	if err != nil {
+		t.Fatalf("AddClient failed: %v", err)
+	}
+
+	forged := func(sequence uint32) []byte {
+		data, err := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, sequence, bytes.Repeat([]byte{0xee}, 64)))
+		if err != nil {
+			t.Fatalf("Failed to encode packet: %v", err)
+		}
+		return data
+	}
+
+	for sequence := uint32(1); sequence <= 3; sequence++ {
+		server.receivePacket(forged(sequence), attacker)
+	}
+	if !server.bans.Banned(attacker.String()) {
+		t.Fatal("Expected the source to be banned after 3 decrypt failures")
+	}
+
+	server.receivePacket(forged(4), attacker)
+	server.receivePacket(forged(5), attacker)
+	if dropped := server.GetServerStatus().DroppedBanned; dropped != 2 {
+		t.Errorf("Expected 2 datagrams dropped from the banned source, got %d", dropped)
+	}
+
+	// Other sources are unaffected
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}
+	server.receivePacket(forged(6), other)
+	if server.bans.Banned(other.String()) {
+		t.Error("Expected another source not to be banned")
+	}
+
+	now = now.Add(time.Minute)
+	server.receivePacket(forged(7), attacker)
+	if dropped := server.GetServerStatus().DroppedBanned; dropped != 2 {
+		t.Errorf("Expected the expired ban to stop dropping datagrams, got %d dropped", dropped)
+	}
+	if server.bans.Banned(attacker.String()) {
+		t.Error("Expected a single failure after the ban to not ban the source again")
+	}
+}
+
+func TestSourceBans_SuccessResetsCount(t *testing.T) {
+	bans := newSourceBans(3, time.Minute)
+
+	bans.Failed("192.0.2.1:1")
+	bans.Failed("192.0.2.1:1")
+	bans.Succeeded("192.0.2.1:1")
+	if bans.Failed("192.0.2.1:1") {
+		t.Error("Expected a decrypted packet to reset the failure count")
+	}
+	bans.Failed("192.0.2.1:1")
+	if !bans.Failed("192.0.2.1:1") {
+		t.Error("Expected 3 consecutive failures to ban the source")
+	}
+}
+
+func TestDecryptFailureLimitValidation(t *testing.T) {
+	_, err := NewServerWithOptions(ServerOptions{DecryptFailureLimit: -1})
+	if err == nil {
+		t.Error("Expected a negative decrypt_failure_limit to be rejected")
+	}
+
+	_, err = NewServerWithOptions(ServerOptions{DecryptFailureLimit: 5, DecryptBanDuration: -time.Second})
+	if err == nil {
+		t.Error("Expected a negative decrypt_ban_duration to be rejected")
+	}
+}
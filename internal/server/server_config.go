@@ -1,75 +1,801 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pepalonsocosta/fvp/internal/crypto"
 	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
 	"gopkg.in/yaml.v3"
 )
 
 type ServerConfig struct {
 	Server struct {
-		Port           string `yaml:"port"`
-		TimeoutMinutes int    `yaml:"timeout_minutes"`
+		Port                 string        `yaml:"port"`
+		ListenAddress        string        `yaml:"listen_address,omitempty"`
+		TimeoutMinutes       int           `yaml:"timeout_minutes"`
+		Subnet               string        `yaml:"subnet,omitempty"`
+		ServerIP             string        `yaml:"server_ip,omitempty"`
+		Cipher               string        `yaml:"cipher,omitempty"`
+		InsecureNoEncryption bool          `yaml:"insecure_no_encryption,omitempty"`
+		NAT                  bool          `yaml:"nat,omitempty"`
+		WANInterface         string        `yaml:"wan_interface,omitempty"`
+		HealthAddr           string        `yaml:"health_addr,omitempty"`
+		AdminSocket          string        `yaml:"admin_socket,omitempty"`
+		InterfaceName        string        `yaml:"interface_name,omitempty"`
+		MTU                  int           `yaml:"mtu,omitempty"`
+		ClampMSS             bool          `yaml:"clamp_mss,omitempty"`
+		PushRoutes           []string      `yaml:"push_routes,omitempty"`
+		StatsInterval        time.Duration `yaml:"stats_interval,omitempty"`
+		NetworkKey           string        `yaml:"network_key,omitempty"`
+		IdentityKey          string        `yaml:"identity_key,omitempty"`
+		KeyGracePeriod       time.Duration `yaml:"key_grace_period,omitempty"`
+		MaxUDPPayload        int           `yaml:"max_udp_payload,omitempty"`
+		DSCP                 int           `yaml:"dscp,omitempty"`
+		RekeyInterval        time.Duration `yaml:"rekey_interval,omitempty"`
+		RekeyBytes           uint64        `yaml:"rekey_bytes,omitempty"`
+		DataPort             string        `yaml:"data_port,omitempty"`
+		DecryptFailureLimit  int           `yaml:"decrypt_failure_limit,omitempty"`
+		DecryptBanDuration   time.Duration `yaml:"decrypt_ban_duration,omitempty"`
+		LogFile              string        `yaml:"log_file,omitempty"`
+		LogMaxSizeMB         int           `yaml:"log_max_size_mb,omitempty"`
+		LogMaxBackups        int           `yaml:"log_max_backups,omitempty"`
+		DebugPcap            string        `yaml:"debug_pcap,omitempty"`
+		DebugPcapMaxSizeMB   int           `yaml:"debug_pcap_max_size_mb,omitempty"`
+		DNSRelay             bool          `yaml:"dns_relay,omitempty"`
+		DNSUpstream          string        `yaml:"dns_upstream,omitempty"`
 	} `yaml:"server"`
 	Clients []crypto.ClientConfig `yaml:"clients"`
 }
 
+const (
+	// DefaultSubnet is the tunnel subnet used when none is configured
+	DefaultSubnet = "10.0.0.0/24"
+	// DefaultPort is the UDP listen address used when none is configured
+	DefaultPort = ":1194"
+	// DefaultTimeout is how long a client may be idle before it is removed
+	DefaultTimeout = 30 * time.Minute
+	// DefaultInterfaceName is the TUN interface created when none is configured
+	DefaultInterfaceName = "fvp0"
+	// DefaultMTU is the largest IP packet carried through the tunnel
+	DefaultMTU = 1500
+	// MinMTU is the smallest MTU every IPv4 host must support
+	MinMTU = 576
+	// MaxMTU keeps an encrypted packet within the 16-bit payload length field
+	MaxMTU = 65535 - crypto.CipherOverhead
+	// MaxUDPPayload is the largest payload of an IPv4 UDP datagram
+	MaxUDPPayload = 65507
+	// DefaultDebugPcapMaxSizeMB is how large the debug_pcap file grows, in
+	// megabytes, before capturing stops when no size is configured
+	DefaultDebugPcapMaxSizeMB = 100
+)
+
+// SubnetCapacity returns the server's tunnel address within subnet and how
+// many clients can be assigned an address. Client IDs are a single byte, so
+// no more than MaxClients clients are supported whatever the subnet size.
+func SubnetCapacity(subnet *net.IPNet) (string, int) {
+	ones, bits := subnet.Mask.Size()
+	usable := (1 << (bits - ones)) - 3 // Network and broadcast addresses and server
+	if usable < 0 {
+		usable = 0
+	}
+	if usable > MaxClients {
+		usable = MaxClients
+	}
+	return hostIP(subnet, 1), usable
+}
+
+// ResolveServerIP returns the server's tunnel address: serverIP if set, which
+// must be a host address within subnet, or else the subnet's first host
+func ResolveServerIP(subnet *net.IPNet, serverIP string) (string, error) {
+	if serverIP == "" {
+		return hostIP(subnet, 1), nil
+	}
+
+	ip := net.ParseIP(serverIP).To4()
+	if ip == nil || !subnet.Contains(ip) {
+		return "", fmt.Errorf("invalid server_ip %q: must be an IPv4 address within %s", serverIP, subnet)
+	}
+
+	ones, bits := subnet.Mask.Size()
+	offset := binary.BigEndian.Uint32(ip) - binary.BigEndian.Uint32(subnet.IP.To4())
+	if offset == 0 || (bits-ones > 1 && offset == 1<<(bits-ones)-1) {
+		return "", fmt.Errorf("invalid server_ip %q: must not be the network or broadcast address of %s", serverIP, subnet)
+	}
+
+	return ip.String(), nil
+}
+
+// ServerOptions configures a server programmatically, without any files.
+//
+// A custom Transport, such as a network.MemoryConn for tests, must identify
+// peers by *net.UDPAddr and implement SetReadDeadline, as net.PacketConn
+// does, so the receive loop notices the server stopping. The server closes
+// it on Stop.
+type ServerOptions struct {
+	Port                 string                 // UDP listen address, e.g. ":1194"
+	ListenAddress        string                 // IP to bind Port to, for multi-homed hosts; empty binds all interfaces
+	Timeout              time.Duration          // Client inactivity timeout; zero keeps DefaultTimeout
+	Subnet               string                 // Tunnel subnet in CIDR notation
+	ServerIP             string                 // Server's tunnel address; empty selects the subnet's first host
+	ClientKeys           map[uint8][]byte       // Pre-shared 32-byte keys by client ID
+	Cipher               string                 // Preferred cipher suite; empty selects the default
+	InsecureNoEncryption bool                   // Send payloads in plaintext, for debugging only; needs crypto.InsecureEnvVar=1
+	NAT                  bool                   // Masquerade client traffic out of WANInterface
+	WANInterface         string                 // Interface that NATed traffic leaves through
+	HealthAddr           string                 // TCP address for the /healthz endpoint; empty disables it
+	AdminSocket          string                 // Unix socket for admin commands; empty disables it
+	InterfaceName        string                 // TUN interface name; empty selects DefaultInterfaceName
+	MTU                  int                    // Largest tunneled IP packet; zero selects DefaultMTU
+	ClampMSS             bool                   // Lower the MSS of tunneled TCP connections to fit MTU
+	AllowedIPs           map[uint8][]*net.IPNet // Extra networks routed to each client, by client ID
+	ReservedIPs          map[uint8]string       // Tunnel IP reserved for each client, by client ID
+	PushRoutes           []PushRoute            // Networks advertised to clients as reachable through the tunnel
+	IPAllocator          IPAllocator            // Hands out client tunnel addresses; nil allocates from Subnet, honoring ReservedIPs
+	StatsInterval        time.Duration          // How often to log a traffic summary; zero disables
+	NetworkKey           []byte                 // 32-byte key every datagram must carry a MAC from; nil disables
+	IdentityKey          []byte                 // 32-byte Ed25519 seed to sign auth responses with, so clients can pin the server; nil disables
+	KeyGracePeriod       time.Duration          // How long a reload keeps accepting a client's changed key; zero disconnects at once
+	MaxUDPPayload        int                    // Largest datagram to send clients; packets that don't fit are dropped. Zero for no limit
+	DSCP                 int                    // DSCP to mark datagrams to clients with, for QoS; zero leaves them unmarked
+	RekeyInterval        time.Duration          // How often to replace each client's session keys; zero disables
+	RekeyBytes           uint64                 // Payload bytes after which to replace a client's session keys; zero disables
+	DataPort             string                 // Second UDP listen address for data packets, keeping control packets on Port; empty carries both on Port
+	DecryptFailureLimit  int                    // Consecutive decrypt failures after which a source address is banned; zero disables
+	DecryptBanDuration   time.Duration          // How long such a ban lasts; zero selects DefaultDecryptBanDuration
+	LogFile              string                 // File to log to while running, rotated by size; empty logs to stderr
+	LogMaxSizeMB         int                    // Size in megabytes at which LogFile is rotated; zero selects DefaultLogMaxSizeMB
+	LogMaxBackups        int                    // Rotated log files to keep; zero selects DefaultLogMaxBackups
+	DebugPcap            string                 // File to capture decrypted tunnel packets to, for debugging only; empty disables
+	DebugPcapMaxSizeMB   int                    // Size in megabytes at which DebugPcap stops growing; zero selects DefaultDebugPcapMaxSizeMB
+	DNSRelay             bool                   // Forward DNS queries clients send to the server's tunnel IP to DNSUpstream
+	DNSUpstream          string                 // Resolver address the DNS relay forwards to, as host[:port]; port 53 if omitted
+	TUN                  network.TUNInterface   // TUN interface to use; nil creates a kernel device
+	Transport            network.Transport      // Carries datagrams instead of a UDP socket on Port, see below; nil opens the socket
+}
+
+// NewServerWithOptions creates a VPN server from in-memory options so it can
+// be embedded in another program or tested without root
+func NewServerWithOptions(opts ServerOptions) (*Server, error) {
+	s := NewServer()
+
+	err := s.applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LoadServerOptions reads server options from a YAML configuration file.
+// Clients come from the file and from any clients.d files next to it.
+func LoadServerOptions(configPath string) (ServerOptions, error) {
+	var opts ServerOptions
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return opts, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config ServerConfig
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return opts, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	clients, err := crypto.MergeClientsDir(configPath, config.Clients)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.ClientKeys, err = crypto.DecodeClientKeys(clients)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.AllowedIPs, err = decodeAllowedIPs(clients)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.ReservedIPs = make(map[uint8]string)
+	for _, client := range clients {
+		if client.IP != "" {
+			opts.ReservedIPs[client.ID] = client.IP
+		}
+	}
+
+	opts.PushRoutes, err = ParsePushRoutes(config.Server.PushRoutes)
+	if err != nil {
+		return opts, err
+	}
+
+	if config.Server.NetworkKey != "" {
+		opts.NetworkKey, err = hex.DecodeString(config.Server.NetworkKey)
+		if err != nil {
+			return opts, fmt.Errorf("invalid hex network_key: %w", err)
+		}
+	}
+
+	if config.Server.IdentityKey != "" {
+		opts.IdentityKey, err = hex.DecodeString(config.Server.IdentityKey)
+		if err != nil {
+			return opts, fmt.Errorf("invalid hex identity_key: %w", err)
+		}
+	}
+
+	// Zero means unset and keeps the default timeout
+	if config.Server.TimeoutMinutes < 0 {
+		return opts, fmt.Errorf("invalid timeout_minutes %d: must not be negative; 0 or unset keeps the default of %v", config.Server.TimeoutMinutes, DefaultTimeout)
+	}
+
+	opts.Port = config.Server.Port
+	opts.ListenAddress = config.Server.ListenAddress
+	opts.Subnet = config.Server.Subnet
+	opts.ServerIP = config.Server.ServerIP
+	opts.Cipher = config.Server.Cipher
+	opts.InsecureNoEncryption = config.Server.InsecureNoEncryption
+	opts.NAT = config.Server.NAT
+	opts.WANInterface = config.Server.WANInterface
+	opts.HealthAddr = config.Server.HealthAddr
+	opts.AdminSocket = AdminSocketPath(configPath, config.Server.AdminSocket)
+	opts.InterfaceName = config.Server.InterfaceName
+	opts.MTU = config.Server.MTU
+	opts.ClampMSS = config.Server.ClampMSS
+	opts.StatsInterval = config.Server.StatsInterval
+	opts.KeyGracePeriod = config.Server.KeyGracePeriod
+	opts.MaxUDPPayload = config.Server.MaxUDPPayload
+	opts.DSCP = config.Server.DSCP
+	opts.RekeyInterval = config.Server.RekeyInterval
+	opts.RekeyBytes = config.Server.RekeyBytes
+	opts.DataPort = config.Server.DataPort
+	opts.DecryptFailureLimit = config.Server.DecryptFailureLimit
+	opts.DecryptBanDuration = config.Server.DecryptBanDuration
+	opts.LogFile = configRelativePath(configPath, config.Server.LogFile)
+	opts.LogMaxSizeMB = config.Server.LogMaxSizeMB
+	opts.LogMaxBackups = config.Server.LogMaxBackups
+	opts.DebugPcap = configRelativePath(configPath, config.Server.DebugPcap)
+	opts.DebugPcapMaxSizeMB = config.Server.DebugPcapMaxSizeMB
+	opts.DNSRelay = config.Server.DNSRelay
+	opts.DNSUpstream = config.Server.DNSUpstream
+	if config.Server.TimeoutMinutes > 0 {
+		opts.Timeout = time.Duration(config.Server.TimeoutMinutes) * time.Minute
+	}
+
+	return opts, nil
+}
+
 func (s *Server) LoadConfig(configPath string) error {
-	s.keyManager = crypto.NewKeyManager()
-	
-	err := s.keyManager.LoadKeysFromConfig(configPath)
+	opts, err := LoadServerOptions(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
-	
-	err = s.loadServerSettings(configPath)
+
+	err = s.applyOptions(opts)
 	if err != nil {
 		return fmt.Errorf("failed to load server settings: %w", err)
 	}
-	
+	s.configPath = configPath
+
 	log.Printf("Configuration loaded successfully")
 	return nil
 }
 
-func (s *Server) loadServerSettings(configPath string) error {
-	data, err := os.ReadFile(configPath)
+// Reload re-reads client keys, allowed IPs and reserved IPs from a configuration file while
+// the server runs, then disconnects live clients whose pre-shared key was
+// removed or changed. With key_grace_period set in the reloaded file,
+// clients whose key changed keep their sessions until the grace period
+// ends, so they can pick up the new key in their own time. Other settings
+// take effect on the next start. On error the current settings are kept.
+// The log file is reopened either way, for logrotate.
+func (s *Server) Reload(configPath string) error {
+	s.reopenLog()
+
+	opts, err := LoadServerOptions(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Validate everything, as a restart would, before swapping anything in
+	reloaded := NewServer()
+	err = reloaded.applyOptions(opts)
+	if err != nil {
+		return fmt.Errorf("failed to load server settings: %w", err)
+	}
+
+	grace := reloaded.keyGracePeriod
+	s.keysMutex.Lock()
+	if grace > 0 && s.keyManager != nil {
+		expires := time.Now().Add(grace)
+		for _, clientID := range reloaded.keyManager.KeepRotatedKeys(s.keyManager, expires) {
+			log.Printf("Key for configured client %d changed, sessions with the previous key last until %s", clientID, expires.Format(time.RFC3339))
+		}
+	}
+	s.keyManager = reloaded.keyManager
+	s.allowedIPs = reloaded.allowedIPs
+	s.reservedIPs = reloaded.reservedIPs
+	s.keysMutex.Unlock()
+
+	if s.clientManager != nil {
+		s.clientManager.SetReservedIPs(reloaded.reservedIPs)
+	}
+
+	s.disconnectRevokedClients()
+	if grace > 0 {
+		time.AfterFunc(grace, s.disconnectRevokedClients)
+	}
+
+	log.Printf("Configuration reloaded successfully")
+	return nil
+}
+
+// clientKeys returns the configured client keys, allowed IPs and reserved
+// IPs, which Reload may swap while the server runs
+func (s *Server) clientKeys() (*crypto.KeyManager, map[uint8][]*net.IPNet, map[uint8]string) {
+	s.keysMutex.RLock()
+	defer s.keysMutex.RUnlock()
+	return s.keyManager, s.allowedIPs, s.reservedIPs
+}
+
+// disconnectRevokedClients removes live clients whose pre-shared key is no
+// longer configured, or is a secondary key whose grace period is over, so a
+// reload after removing a client cuts its tunnel instead of leaving it up
+// until the timeout
+func (s *Server) disconnectRevokedClients() {
+	if s.clientManager == nil {
+		return
+	}
+
+	// A grace period may end after the server stopped
+	select {
+	case <-s.stopChan:
+		return
+	default:
+	}
+
+	keyManager, _, _ := s.clientKeys()
+	for _, client := range s.clientManager.Snapshot() {
+		if client.ConfigID == 0 {
+			continue
+		}
+
+		if keyManager.AcceptsKey(client.ConfigID, client.Key) {
+			continue
+		}
+
+		err := s.clientManager.RemoveClient(client.ID)
+		if err != nil {
+			continue
+		}
+		log.Printf("Disconnected client %d: key for configured client %d was removed or changed", client.ID, client.ConfigID)
+	}
+}
+
+// decodeAllowedIPs parses the allowed_ips networks of each client
+func decodeAllowedIPs(clients []crypto.ClientConfig) (map[uint8][]*net.IPNet, error) {
+	allowedIPs := make(map[uint8][]*net.IPNet)
+
+	for _, client := range clients {
+		for _, cidr := range client.AllowedIPs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil || network.IP.To4() == nil {
+				return nil, fmt.Errorf("invalid allowed_ips for client %d: %q is not an IPv4 CIDR", client.ID, cidr)
+			}
+			allowedIPs[client.ID] = append(allowedIPs[client.ID], network)
+		}
+	}
+
+	return allowedIPs, nil
+}
+
+// validateReservedIPs checks that each reserved IP is a distinct host address
+// within subnet other than the server's, returning them normalized
+func validateReservedIPs(subnet *net.IPNet, serverIP string, ips map[uint8]string) (map[uint8]string, error) {
+	reserved := make(map[uint8]string, len(ips))
+	owners := make(map[string]uint8, len(ips))
+
+	for clientID, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if !isHostAddress(subnet, parsed) {
+			return nil, fmt.Errorf("invalid ip for client %d: %q is not a host address within %s", clientID, ip, subnet)
+		}
+
+		normalized := parsed.To4().String()
+		if normalized == serverIP {
+			return nil, fmt.Errorf("invalid ip for client %d: %s is the server's address", clientID, normalized)
+		}
+		if owner, exists := owners[normalized]; exists {
+			return nil, fmt.Errorf("invalid ip for client %d: %s is already reserved for client %d", clientID, normalized, owner)
+		}
+
+		owners[normalized] = clientID
+		reserved[clientID] = normalized
+	}
+
+	return reserved, nil
+}
+
+func (s *Server) applyOptions(opts ServerOptions) error {
+	port, err := normalizePort(opts.Port)
 	if err != nil {
 		return err
 	}
 
-	var config ServerConfig
-	err = yaml.Unmarshal(data, &config)
+	if opts.ListenAddress != "" {
+		port, err = ListenAddress(opts.ListenAddress, port)
+		if err != nil {
+			return err
+		}
+	}
+
+	dataPort, err := normalizePort(opts.DataPort)
+	if err != nil {
+		return fmt.Errorf("invalid data_port: %w", err)
+	}
+	if dataPort != "" {
+		if opts.Transport != nil {
+			return fmt.Errorf("invalid data_port %q: needs a UDP socket, not a custom transport", opts.DataPort)
+		}
+		if opts.ListenAddress != "" {
+			dataPort, err = ListenAddress(opts.ListenAddress, dataPort)
+			if err != nil {
+				return err
+			}
+		}
+		controlPort := port
+		if controlPort == "" {
+			controlPort = DefaultPort
+		}
+		if _, number, _ := net.SplitHostPort(dataPort); number != "0" && dataPort == controlPort {
+			return fmt.Errorf("invalid data_port %q: must differ from port", opts.DataPort)
+		}
+	}
+
+	if opts.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v: must not be negative; 0 keeps the default of %v", opts.Timeout, DefaultTimeout)
+	}
+
+	subnet := opts.Subnet
+	if subnet == "" {
+		subnet = DefaultSubnet
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return fmt.Errorf("invalid subnet %q: must be an IPv4 CIDR", subnet)
+	}
+
+	serverIP, err := ResolveServerIP(ipNet, opts.ServerIP)
 	if err != nil {
 		return err
 	}
 
-	if config.Server.TimeoutMinutes > 0 {
-		s.timeout = time.Duration(config.Server.TimeoutMinutes) * time.Minute
+	reservedIPs, err := validateReservedIPs(ipNet, serverIP, opts.ReservedIPs)
+	if err != nil {
+		return err
 	}
-	
-	if config.Server.Port != "" {
-		s.port = config.Server.Port
+
+	cipher, err := crypto.CipherByName(opts.Cipher)
+	if err != nil {
+		return err
+	}
+	if opts.InsecureNoEncryption {
+		cipher, err = crypto.InsecureCipher()
+		if err != nil {
+			return fmt.Errorf("invalid insecure_no_encryption: %w", err)
+		}
+		log.Printf("WARNING: encryption is disabled, tunnel traffic is sent in plaintext; never use insecure_no_encryption in production")
+	}
+
+	err = validatePushRoutes(opts.PushRoutes)
+	if err != nil {
+		return err
+	}
+
+	if opts.StatsInterval < 0 {
+		return fmt.Errorf("invalid stats_interval %s: must not be negative", opts.StatsInterval)
+	}
+
+	if opts.KeyGracePeriod < 0 {
+		return fmt.Errorf("invalid key_grace_period %s: must not be negative", opts.KeyGracePeriod)
+	}
+
+	if opts.RekeyInterval < 0 {
+		return fmt.Errorf("invalid rekey_interval %s: must not be negative", opts.RekeyInterval)
+	}
+
+	if opts.DecryptFailureLimit < 0 {
+		return fmt.Errorf("invalid decrypt_failure_limit %d: must not be negative", opts.DecryptFailureLimit)
+	}
+
+	if opts.DecryptBanDuration < 0 {
+		return fmt.Errorf("invalid decrypt_ban_duration %s: must not be negative", opts.DecryptBanDuration)
+	}
+
+	if opts.LogMaxSizeMB < 0 {
+		return fmt.Errorf("invalid log_max_size_mb %d: must not be negative", opts.LogMaxSizeMB)
+	}
+
+	if opts.LogMaxBackups < 0 {
+		return fmt.Errorf("invalid log_max_backups %d: must not be negative", opts.LogMaxBackups)
+	}
+
+	if opts.DebugPcapMaxSizeMB < 0 {
+		return fmt.Errorf("invalid debug_pcap_max_size_mb %d: must not be negative", opts.DebugPcapMaxSizeMB)
+	}
+
+	if opts.NetworkKey != nil && len(opts.NetworkKey) != 32 {
+		return fmt.Errorf("invalid network_key: must be exactly 32 bytes (64 hex chars), got %d bytes", len(opts.NetworkKey))
+	}
+
+	if opts.IdentityKey != nil && len(opts.IdentityKey) != protocol.IdentityKeySize {
+		return fmt.Errorf("invalid identity_key: must be exactly %d bytes (%d hex chars), got %d bytes", protocol.IdentityKeySize, 2*protocol.IdentityKeySize, len(opts.IdentityKey))
+	}
+
+	if _, ok := opts.Transport.(readDeadliner); opts.Transport != nil && !ok {
+		return fmt.Errorf("invalid transport %T: must implement SetReadDeadline", opts.Transport)
+	}
+
+	if opts.NAT && opts.WANInterface == "" {
+		return fmt.Errorf("nat requires wan_interface to be set")
+	}
+
+	var dnsUpstream string
+	if opts.DNSRelay {
+		dnsUpstream, err = dnsUpstreamAddress(opts.DNSUpstream)
+		if err != nil {
+			return err
+		}
+	}
+
+	mtu := opts.MTU
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	// The largest packet must still fit in a single UDP datagram once the
+	// header, tag and network MAC are added
+	maxMTU := min(MaxMTU, protocol.MaxInnerPacketSize(MaxUDPPayload, protocol.ProtocolVersionMajor, crypto.CipherOverhead, opts.NetworkKey != nil))
+	if mtu < MinMTU || mtu > maxMTU {
+		return fmt.Errorf("invalid mtu %d: must be between %d and %d", mtu, MinMTU, maxMTU)
+	}
+
+	if opts.MaxUDPPayload != 0 {
+		// Leave room for the smallest packet every IPv4 host must handle
+		minimum := protocol.DatagramOverhead(protocol.ProtocolVersionMajor, crypto.CipherOverhead, opts.NetworkKey != nil) + MinMTU
+		if opts.MaxUDPPayload < minimum || opts.MaxUDPPayload > MaxUDPPayload {
+			return fmt.Errorf("invalid max_udp_payload %d: must be between %d and %d", opts.MaxUDPPayload, minimum, MaxUDPPayload)
+		}
+
+		fits := protocol.MaxInnerPacketSize(opts.MaxUDPPayload, protocol.ProtocolVersionMajor, crypto.CipherOverhead, opts.NetworkKey != nil)
+		if mtu > fits {
+			log.Printf("WARNING: max_udp_payload %d leaves room for %d-byte packets, less than the %d-byte mtu; larger packets to clients will be dropped, set mtu: %d or clamp_mss", opts.MaxUDPPayload, fits, mtu, fits)
+		}
+	}
+
+	err = network.ValidateDSCP(opts.DSCP)
+	if err != nil {
+		return err
+	}
+
+	interfaceName := opts.InterfaceName
+	if interfaceName == "" {
+		interfaceName = DefaultInterfaceName
+	}
+	err = network.ValidateInterfaceName(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	keyManager := crypto.NewKeyManager()
+	for clientID, key := range opts.ClientKeys {
+		err := keyManager.AddClientKey(clientID, key)
+		if err != nil {
+			return fmt.Errorf("invalid key for client %d: %w", clientID, err)
+		}
+	}
+
+	s.keyManager = keyManager
+	s.subnet = ipNet
+	s.serverIP = serverIP
+	s.cipher = cipher
+	s.natEnabled = opts.NAT
+	s.wanInterface = opts.WANInterface
+	s.healthAddr = opts.HealthAddr
+	s.adminSocket = opts.AdminSocket
+	s.interfaceName = interfaceName
+	s.mtu = mtu
+	s.clampMSS = opts.ClampMSS
+	s.allowedIPs = opts.AllowedIPs
+	s.reservedIPs = reservedIPs
+	s.pushRoutes = opts.PushRoutes
+	s.ipAllocator = opts.IPAllocator
+	s.statsInterval = opts.StatsInterval
+	s.networkKey = opts.NetworkKey
+	if opts.IdentityKey != nil {
+		s.identityKey = ed25519.NewKeyFromSeed(opts.IdentityKey)
+	}
+	s.keyGracePeriod = opts.KeyGracePeriod
+	s.maxUDPPayload = opts.MaxUDPPayload
+	s.dscp = opts.DSCP
+	s.rekeyInterval = opts.RekeyInterval
+	s.rekeyBytes = opts.RekeyBytes
+	s.dataPort = dataPort
+	s.logPath = opts.LogFile
+
+	s.logMaxSize = int64(DefaultLogMaxSizeMB) << 20
+	if opts.LogMaxSizeMB > 0 {
+		s.logMaxSize = int64(opts.LogMaxSizeMB) << 20
+	}
+	s.logMaxBackups = DefaultLogMaxBackups
+	if opts.LogMaxBackups > 0 {
+		s.logMaxBackups = opts.LogMaxBackups
+	}
+
+	s.dnsUpstream = dnsUpstream
+	s.pcapPath = opts.DebugPcap
+	s.pcapMaxSize = int64(DefaultDebugPcapMaxSizeMB) << 20
+	if opts.DebugPcapMaxSizeMB > 0 {
+		s.pcapMaxSize = int64(opts.DebugPcapMaxSizeMB) << 20
+	}
+
+	if opts.DecryptFailureLimit > 0 {
+		banDuration := opts.DecryptBanDuration
+		if banDuration == 0 {
+			banDuration = DefaultDecryptBanDuration
+		}
+		s.bans = newSourceBans(opts.DecryptFailureLimit, banDuration)
+	}
+
+	if opts.Timeout > 0 {
+		s.timeout = opts.Timeout
+	}
+
+	if port != "" {
+		s.port = port
+	}
+
+	if opts.TUN != nil {
+		s.tunInterface = opts.TUN
+	}
+
+	if opts.Transport != nil {
+		s.customTransport = opts.Transport
 	}
 
 	return nil
 }
 
+// ListenAddress binds the listen address port, as accepted in the port
+// setting, to the IP address ip. An empty port takes DefaultPort's. It fails
+// if ip isn't an IP address, or port already names a different one.
+func ListenAddress(ip, port string) (string, error) {
+	listenIP := net.ParseIP(strings.Trim(ip, "[]"))
+	if listenIP == nil {
+		return "", fmt.Errorf("invalid listen_address %q: must be an IP address", ip)
+	}
+
+	address, err := normalizePort(port)
+	if err != nil {
+		return "", err
+	}
+	if address == "" {
+		address = DefaultPort
+	}
+
+	host, portNumber, _ := net.SplitHostPort(address)
+	if host != "" && !net.ParseIP(host).Equal(listenIP) {
+		return "", fmt.Errorf("invalid listen_address %q: port %q already binds %s", ip, port, host)
+	}
+
+	return net.JoinHostPort(listenIP.String(), portNumber), nil
+}
+
+// normalizePort validates a listen address and turns a bare port number like
+// "1194" into ":1194". An empty port is left empty so the default applies.
+func normalizePort(port string) (string, error) {
+	if port == "" {
+		return "", nil
+	}
+
+	address := port
+	if _, err := strconv.Atoi(port); err == nil {
+		address = ":" + port
+	}
+
+	_, portNumber, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q: %w", port, err)
+	}
+
+	number, err := strconv.Atoi(portNumber)
+	if err != nil || number < 0 || number > 65535 {
+		return "", fmt.Errorf("invalid port %q: must be a number between 0 and 65535", port)
+	}
+
+	return address, nil
+}
+
 func (s *Server) CreateTUNInterface() error {
-	tunManager := network.NewTunManager()
-	
-	err := tunManager.Create("fvp0")
+	tunInterface := s.tunInterface
+	if tunInterface == nil && s.tunFD >= 0 {
+		tunManager, err := network.NewTunManagerFromFD(s.tunFD, s.getInterfaceName())
+		if err != nil {
+			return fmt.Errorf("failed to adopt TUN interface: %w", err)
+		}
+		// Reads must still fit the largest packet clients may send
+		tunManager.SetMTU(s.mtu)
+		tunInterface = tunManager
+	} else if tunInterface == nil {
+		tunManager := network.NewTunManager()
+		tunManager.SetAddress(s.tunnelAddress())
+		tunManager.SetMTU(s.mtu)
+		tunInterface = tunManager
+	}
+
+	if !tunInterface.IsCreated() {
+		err := tunInterface.Create(s.getInterfaceName())
+		if err != nil {
+			return fmt.Errorf("failed to create TUN interface: %w", err)
+		}
+	}
+
+	s.tunInterface = tunInterface
+	log.Printf("Created TUN interface: %s", tunInterface.GetName())
+	return nil
+}
+
+// tunnelAddress returns the server's tunnel address with the subnet's prefix
+// length, e.g. "10.0.0.1/24", for configuring the TUN interface
+func (s *Server) tunnelAddress() string {
+	subnet, serverIP := s.tunnelNetwork()
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", serverIP, ones)
+}
+
+// tunnelNetwork returns the tunnel subnet and the server's address within
+// it, filling in defaults for a server configured without them
+func (s *Server) tunnelNetwork() (*net.IPNet, string) {
+	subnet := s.subnet
+	if subnet == nil {
+		_, subnet, _ = net.ParseCIDR(DefaultSubnet)
+	}
+
+	serverIP := s.serverIP
+	if serverIP == "" {
+		serverIP = hostIP(subnet, 1)
+	}
+
+	return subnet, serverIP
+}
+
+// SetupNAT installs the masquerade rule for the tunnel subnet if NAT is enabled
+func (s *Server) SetupNAT() error {
+	if !s.natEnabled {
+		return nil
+	}
+
+	subnet := s.subnet
+	if subnet == nil {
+		_, subnet, _ = net.ParseCIDR(DefaultSubnet)
+	}
+
+	nat := network.NewNATManager(subnet.String(), s.wanInterface)
+	nat.SetStateFile(s.stateFile)
+	err := nat.Enable()
 	if err != nil {
-		return fmt.Errorf("failed to create TUN interface: %w", err)
+		return err
 	}
-	
-	s.tunInterface = tunManager
-	log.Printf("Created TUN interface: %s", tunManager.GetName())
+
+	s.nat = nat
 	return nil
 }
 
@@ -77,31 +803,126 @@ func (s *Server) CreateClientManager() error {
 	if s.keyManager == nil {
 		return fmt.Errorf("key manager not initialized")
 	}
-	s.clientManager = NewClientManager(s.keyManager)
+	subnet, serverIP := s.tunnelNetwork()
+	allocator := s.ipAllocator
+	if allocator == nil {
+		allocator = NewReservationAllocator(subnet, serverIP, s.reservedIPs)
+	}
+	s.clientManager = NewClientManager(s.keyManager, allocator)
+	s.clientManager.timeout = s.timeout
+	s.clientManager.tunnelIP = serverIP
+	s.loadLeases()
+	if s.eventHandler != nil {
+		s.events = newEventDispatcher(s.eventHandler)
+		s.clientManager.events = s.events
+	}
 	log.Printf("Created client manager")
 	return nil
 }
 
 func (s *Server) CreatePacketProcessor() error {
-	if s.tunInterface == nil || s.keyManager == nil || s.clientManager == nil || s.udpConn == nil {
+	if s.tunInterface == nil || s.keyManager == nil || s.clientManager == nil || s.transport == nil {
 		return fmt.Errorf("required components not initialized")
 	}
-	s.packetProcessor = NewPacketProcessor(s.tunInterface, s.keyManager, s.clientManager, s.udpConn)
+	s.packetProcessor = NewPacketProcessor(s.tunInterface, s.keyManager, s.clientManager, s.transport)
+	s.packetProcessor.dataTransport = s.dataTransport
+	s.packetProcessor.EnableWriteQueue(network.DefaultWriteQueueSize)
+	if s.clampMSS {
+		s.packetProcessor.maxMSS = network.MSSForMTU(s.mtu)
+	}
+	s.packetProcessor.trace = s.packetTrace
+	if s.pcapPath != "" {
+		pcap, err := network.NewPcapWriter(s.pcapPath, s.pcapMaxSize)
+		if err != nil {
+			return err
+		}
+		log.Printf("Warning: writing decrypted tunnel traffic to %s for debugging; remove debug_pcap from the config when done", s.pcapPath)
+		s.pcap = pcap
+		s.packetProcessor.capture = pcap
+	}
+	if s.networkKey != nil {
+		// The MAC is checked and stripped before the processor sees a datagram
+		s.packetProcessor.wireOverhead = protocol.NetworkMACSize
+	}
+	if s.dnsUpstream != "" {
+		s.packetProcessor.dnsRelay = newDNSRelay(net.ParseIP(s.serverIP), s.dnsUpstream, s.packetProcessor.RoutePacket)
+		log.Printf("Relaying DNS queries to %s to %s", s.serverIP, s.dnsUpstream)
+	}
+	if s.maxUDPPayload > 0 {
+		s.packetProcessor.maxPayload = protocol.MaxInnerPacketSize(s.maxUDPPayload, protocol.ProtocolVersionMajor, crypto.CipherOverhead, s.networkKey != nil)
+	}
 	log.Printf("Created packet processor")
 	return nil
 }
 
+// CreateUDPServer opens the UDP socket on port, or takes the custom
+// transport if one was configured
 func (s *Server) CreateUDPServer(port string) error {
+	if s.customTransport != nil {
+		s.setTransport(s.customTransport)
+		log.Printf("Serving on a custom %T transport", s.customTransport)
+		return nil
+	}
+
+	var err error
+	s.udpConn, err = s.listenUDP(port)
+	if err != nil {
+		return err
+	}
+	s.setTransport(network.NewUDPTransport(s.udpConn))
+	log.Printf("UDP server listening on %s", port)
+
+	if s.dataPort != "" {
+		s.dataConn, err = s.listenUDP(s.dataPort)
+		if err != nil {
+			return fmt.Errorf("failed to open data socket: %w", err)
+		}
+		s.dataTransport = s.wrapTransport(network.NewUDPTransport(s.dataConn))
+		log.Printf("UDP data socket listening on %s", s.dataConn.LocalAddr())
+	}
+
+	return nil
+}
+
+// listenUDP opens a UDP socket on port, set up for datagrams to clients
+func (s *Server) listenUDP(port string) (*net.UDPConn, error) {
 	addr, err := net.ResolveUDPAddr("udp", port)
 	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
+		return nil, fmt.Errorf("failed to resolve UDP address: %w", err)
 	}
 	
-	s.udpConn, err = net.ListenUDP("udp", addr)
+	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		return fmt.Errorf("failed to create UDP server: %w", err)
+		return nil, fmt.Errorf("failed to create UDP server: %w", err)
 	}
-	
-	log.Printf("UDP server listening on %s", port)
-	return nil
+	err = network.AllowFragmentation(conn)
+	if err != nil {
+		log.Printf("Warning: %v; datagrams over the path MTU may be dropped", err)
+	}
+	if s.dscp != 0 {
+		err = network.SetDSCP(conn, s.dscp)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// setTransport sends through transport, adding the network MAC and packet
+// trace if configured
+func (s *Server) setTransport(transport network.Transport) {
+	s.transport = s.wrapTransport(transport)
+}
+
+// wrapTransport adds the network MAC and packet trace to transport, if
+// configured
+func (s *Server) wrapTransport(transport network.Transport) network.Transport {
+	if s.networkKey != nil {
+		transport = &networkKeyTransport{Transport: transport, key: s.networkKey}
+	}
+	if s.packetTrace {
+		transport = &tracingTransport{Transport: transport}
+	}
+	return transport
 }
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+const (
+	dnsPort = 53
+	// dnsRelayTimeout is how long the relay waits for the upstream
+	// resolver to answer a query
+	dnsRelayTimeout = 5 * time.Second
+	// maxDNSRelayQueries caps the queries waiting on the upstream resolver,
+	// so a client flooding the relay can't pile up goroutines and sockets.
+	// Queries past it are dropped and the client retries.
+	maxDNSRelayQueries = 256
+	// maxDNSMessageSize is the largest DNS message over UDP
+	maxDNSMessageSize = 65535
+)
+
+// dnsRelay answers DNS queries clients send to the server's tunnel IP by
+// forwarding them to an upstream resolver and tunneling its answers back, so
+// clients can use the server as their resolver without one listening on the
+// host. Each query gets its own upstream socket, so answers can't be mixed
+// up between clients. Nothing is cached. A nil *dnsRelay relays nothing.
+type dnsRelay struct {
+	serverIP net.IP
+	upstream string                    // Resolver address, as host:port
+	reply    func(packet []byte) error // Sends an answer to the client it is addressed to
+	timeout  time.Duration             // How long to wait for an answer. Overridable for tests
+	queries  chan struct{}             // Holds a token per query in flight
+	wg       sync.WaitGroup
+}
+
+// dnsUpstreamAddress validates the dns_upstream setting, adding port 53 if
+// none is given
+func dnsUpstreamAddress(upstream string) (string, error) {
+	if upstream == "" {
+		return "", fmt.Errorf("dns_relay requires dns_upstream to be set")
+	}
+
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host, port = strings.Trim(upstream, "[]"), strconv.Itoa(dnsPort)
+	}
+
+	number, err := strconv.Atoi(port)
+	if host == "" || err != nil || number < 1 || number > 65535 {
+		return "", fmt.Errorf("invalid dns_upstream %q: must be a host or host:port", upstream)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+func newDNSRelay(serverIP net.IP, upstream string, reply func(packet []byte) error) *dnsRelay {
+	return &dnsRelay{
+		serverIP: serverIP,
+		upstream: upstream,
+		reply:    reply,
+		timeout:  dnsRelayTimeout,
+		queries:  make(chan struct{}, maxDNSRelayQueries),
+	}
+}
+
+// Relay forwards packet upstream if it is a DNS query to the server's tunnel
+// IP, and reports whether it was taken. The answer is sent in the background.
+func (r *dnsRelay) Relay(packet []byte) bool {
+	if r == nil {
+		return false
+	}
+
+	query, ok := network.ParseUDP(packet)
+	if !ok || query.DstPort != dnsPort || !query.Dst.Equal(r.serverIP) {
+		return false
+	}
+
+	select {
+	case r.queries <- struct{}{}:
+	default:
+		return true
+	}
+
+	// The packet buffer isn't ours to keep
+	query.Src = bytes.Clone(query.Src)
+	query.Payload = bytes.Clone(query.Payload)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() { <-r.queries }()
+		r.forward(query)
+	}()
+	return true
+}
+
+// forward sends a query to the upstream resolver and relays its answer
+func (r *dnsRelay) forward(query network.UDPPacket) {
+	conn, err := net.Dial("udp", r.upstream)
+	if err != nil {
+		log.Printf("Failed to relay DNS query from %s: %v", query.Src, err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	_, err = conn.Write(query.Payload)
+	if err != nil {
+		log.Printf("Failed to relay DNS query from %s: %v", query.Src, err)
+		return
+	}
+
+	answer := make([]byte, maxDNSMessageSize)
+	n, err := conn.Read(answer)
+	if err != nil {
+		log.Printf("Failed to relay DNS answer to %s: %v", query.Src, err)
+		return
+	}
+
+	err = r.reply(network.BuildUDP(network.UDPPacket{
+		Src:     r.serverIP,
+		Dst:     query.Src,
+		SrcPort: dnsPort,
+		DstPort: query.SrcPort,
+		Payload: answer[:n],
+	}))
+	if err != nil {
+		log.Printf("Failed to relay DNS answer to %s: %v", query.Src, err)
+	}
+}
+
+// Close waits for queries in flight to be answered or time out
+func (r *dnsRelay) Close() {
+	if r == nil {
+		return
+	}
+	r.wg.Wait()
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// TestDNSRelay tests that a DNS query to the server's tunnel IP is forwarded
+// to the upstream resolver instead of the TUN interface, and its answer is
+// tunneled back to the client from the server's port 53
+func TestDNSRelay(t *testing.T) {
+	// The mock upstream answers each query with the query and a marker
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			upstream.WriteToUDP(append(buffer[:n:n], []byte(" answered")...), addr)
+		}
+	}()
+
+	mockTUN := network.NewMockTunManager()
+	mockTUN.Create("test0")
+
+	keyManager := crypto.NewKeyManager()
+	clientManager := NewClientManager(keyManager, nil)
+	defer clientManager.Close()
+
+	transport := network.NewMockTransport()
+	processor := NewPacketProcessor(mockTUN, keyManager, clientManager, transport)
+	processor.dnsRelay = newDNSRelay(net.ParseIP("10.0.0.1"), upstream.LocalAddr().String(), processor.RoutePacket)
+
+	key := make([]byte, 32)
+	client, err := clientManager.AddClient(key, "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, clientManager, client)
+
+	send := func(sequence uint32, dst string, dstPort uint16, payload string) {
+		t.Helper()
+		query := network.BuildUDP(network.UDPPacket{
+			Src:     net.ParseIP(client.IP),
+			Dst:     net.ParseIP(dst),
+			SrcPort: 40000,
+			DstPort: dstPort,
+			Payload: []byte(payload),
+		})
+		encrypted, err := encryptFromClient(query, key, sequence)
+		if err != nil {
+			t.Fatalf("Failed to encrypt payload: %v", err)
+		}
+		packetData, _ := protocol.EncodePacket(protocol.CreateDataPacket(client.ID, sequence, encrypted))
+		err = processor.ProcessPacket(packetData, nil)
+		if err != nil {
+			t.Fatalf("ProcessPacket failed: %v", err)
+		}
+	}
+
+	send(1, "10.0.0.1", 53, "query")
+	// Other traffic, including DNS to other resolvers, goes to the host
+	send(2, "10.0.0.1", 80, "web")
+	send(3, "8.8.8.8", 53, "other resolver")
+
+	processor.dnsRelay.Close()
+
+	if written := mockTUN.GetWriteQueue(); len(written) != 2 {
+		t.Errorf("Expected 2 packets written to the TUN interface, got %d", len(written))
+	}
+
+	sent := transport.GetSent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 answer sent to the client, got %d", len(sent))
+	}
+	packet, err := protocol.DecodePacket(sent[0].Data)
+	if err != nil {
+		t.Fatalf("Failed to decode sent packet: %v", err)
+	}
+	decrypted, err := decryptAtClient(packet.Payload, key, packet.Sequence)
+	if err != nil {
+		t.Fatalf("Failed to decrypt sent packet: %v", err)
+	}
+
+	answer, ok := network.ParseUDP(decrypted)
+	if !ok {
+		t.Fatal("Expected the answer to be a UDP packet")
+	}
+	if !answer.Src.Equal(net.ParseIP("10.0.0.1")) || answer.SrcPort != 53 {
+		t.Errorf("Expected the answer from 10.0.0.1:53, got %s:%d", answer.Src, answer.SrcPort)
+	}
+	if !answer.Dst.Equal(net.ParseIP(client.IP)) || answer.DstPort != 40000 {
+		t.Errorf("Expected the answer to %s:40000, got %s:%d", client.IP, answer.Dst, answer.DstPort)
+	}
+	if !bytes.Equal(answer.Payload, []byte("query answered")) {
+		t.Errorf("Expected the upstream answer, got %q", answer.Payload)
+	}
+}
+
+// TestDNSRelay_UpstreamTimeout tests that a query the upstream resolver never
+// answers is given up on
+func TestDNSRelay_UpstreamTimeout(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer upstream.Close()
+
+	replies := 0
+	relay := newDNSRelay(net.ParseIP("10.0.0.1"), upstream.LocalAddr().String(), func([]byte) error {
+		replies++
+		return nil
+	})
+	relay.timeout = 50 * time.Millisecond
+
+	query := network.BuildUDP(network.UDPPacket{
+		Src:     net.ParseIP("10.0.0.2"),
+		Dst:     net.ParseIP("10.0.0.1"),
+		SrcPort: 40000,
+		DstPort: 53,
+		Payload: []byte("query"),
+	})
+	if !relay.Relay(query) {
+		t.Fatal("Expected the query to be relayed")
+	}
+
+	relay.Close()
+	if replies != 0 {
+		t.Errorf("Expected no answer, got %d", replies)
+	}
+}
+
+func TestDNSUpstreamAddress(t *testing.T) {
+	tests := map[string]string{
+		"1.1.1.1":           "1.1.1.1:53",
+		"1.1.1.1:5353":      "1.1.1.1:5353",
+		"dns.example.com":   "dns.example.com:53",
+		"2606:4700::1111":   "[2606:4700::1111]:53",
+		"[2606:4700::1111]": "[2606:4700::1111]:53",
+		"[::1]:5353":        "[::1]:5353",
+	}
+	for upstream, expected := range tests {
+		address, err := dnsUpstreamAddress(upstream)
+		if err != nil || address != expected {
+			t.Errorf("Expected %q to give %s, got %q (%v)", upstream, expected, address, err)
+		}
+	}
+
+	for _, upstream := range []string{"", ":53", "1.1.1.1:0", "1.1.1.1:dns"} {
+		_, err := dnsUpstreamAddress(upstream)
+		if err == nil {
+			t.Errorf("Expected dns_upstream %q to be rejected", upstream)
+		}
+	}
+
+	_, err := NewServerWithOptions(ServerOptions{DNSRelay: true})
+	if err == nil {
+		t.Error("Expected dns_relay without dns_upstream to be rejected")
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// DefaultDrainTimeout is how long Stop keeps forwarding traffic after telling
+// clients the server is going away
+const DefaultDrainTimeout = 500 * time.Millisecond
+
+// drainClients tells every connected client that the server is shutting down,
+// so it can reconnect to a failover at once instead of waiting for a timeout,
+// then keeps serving for the drain timeout so packets in flight still arrive
+func (s *Server) drainClients() {
+	if s.clientManager == nil || s.transport == nil {
+		return
+	}
+
+	notified := 0
+	for _, client := range s.clientManager.Snapshot() {
+		if !client.Connected {
+			continue
+		}
+
+		err := s.sendDisconnect(client.ID, "server shutting down")
+		if err != nil {
+			log.Printf("Failed to notify client %d of shutdown: %v", client.ID, err)
+			continue
+		}
+		notified++
+	}
+
+	if notified == 0 {
+		return
+	}
+
+	log.Printf("Notified %d clients of shutdown, draining for %v", notified, s.drainTimeout)
+	time.Sleep(s.drainTimeout)
+}
+
+// sendDisconnect tells a client its session is ending. The reason is sealed
+// with the session keys, so the client can tell it from a forged one.
+func (s *Server) sendDisconnect(clientID uint8, reason string) error {
+	client, err := s.clientManager.GetClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	sequence, err := s.clientManager.NextTxSequence(clientID)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := client.Keys.Seal(client.Cipher, protocol.EncodeDisconnect(reason), sequence)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt disconnect: %w", err)
+	}
+
+	packetData, err := protocol.EncodePacket(protocol.CreateDisconnectPacket(clientID, sequence, sealed))
+	if err != nil {
+		return fmt.Errorf("failed to encode disconnect: %w", err)
+	}
+
+	clientAddr, err := s.clientManager.GetClientAddr(clientID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.transport.WriteTo(packetData, clientAddr)
+	if err != nil {
+		return fmt.Errorf("failed to send disconnect: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+func TestStop_NotifiesConnectedClients(t *testing.T) {
+	clientManager := NewClientManager(crypto.NewKeyManager(), nil)
+	transport := network.NewMockTransport()
+	server := &Server{
+		clientManager: clientManager,
+		transport:     transport,
+		stopChan:      make(chan struct{}),
+		drainTimeout:  10 * time.Millisecond,
+	}
+
+	addresses := map[uint8]string{}
+	for i, address := range []string{"127.0.0.1:12345", "127.0.0.1:12346"} {
+		key := make([]byte, 32)
+		key[0] = byte(i + 1)
+		added, err := clientManager.AddClient(key, address)
+		if err != nil {
+			t.Fatalf("Failed to add client: %v", err)
+		}
+		setTestSession(t, clientManager, added)
+		addresses[added.ID] = address
+	}
+
+	server.Stop()
+
+	sent := transport.GetSent()
+	if len(sent) != len(addresses) {
+		t.Fatalf("Expected %d disconnects, got %d", len(addresses), len(sent))
+	}
+	for _, datagram := range sent {
+		packet, err := protocol.DecodePacket(datagram.Data)
+		if err != nil {
+			t.Fatalf("Failed to decode disconnect: %v", err)
+		}
+		if packet.Type != protocol.PacketTypeDisconnect {
+			t.Errorf("Expected disconnect packet, got type %d", packet.Type)
+		}
+		client, _ := clientManager.GetClient(packet.ClientID)
+		session, _ := crypto.DeriveSessionKeys(client.Key, testNonce, testNonce)
+		clientKeys := crypto.NewKeyRing(session, true)
+		reason, err := clientKeys.Open(client.Cipher, packet.Payload, packet.Sequence)
+		if err != nil || string(reason) != "server shutting down" {
+			t.Errorf("Expected the reason sealed with the session keys, got %q (%v)", reason, err)
+		}
+		if datagram.Addr.String() != addresses[packet.ClientID] {
+			t.Errorf("Expected disconnect for client %d sent to %s, got %s", packet.ClientID, addresses[packet.ClientID], datagram.Addr)
+		}
+	}
+
+	// Stopping again must not notify anyone twice
+	server.Stop()
+	if len(transport.GetSent()) != len(addresses) {
+		t.Errorf("Expected no further disconnects, got %d in total", len(transport.GetSent()))
+	}
+}
+
+// TestStop_ClientSeesServerClosed tests that a connected client learns of a
+// shutdown right away rather than by timing out
+func TestStop_ClientSeesServerClosed(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	server.Stop()
+
+	select {
+	case <-vpnClient.ServerClosed():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the client to be told the server closed")
+	}
+}
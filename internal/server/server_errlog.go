@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// errorLogInterval is the least time between two lines from a
+// rateLimitedLog, so a packet storm costs a line a second rather than one per
+// packet
+const errorLogInterval = time.Second
+
+// rateLimitedLog logs an error from a hot path at most once per
+// errorLogInterval. Errors in between are only counted, and the next line
+// logged says how many there were. Its zero value is ready to use, and it is
+// safe for concurrent use.
+type rateLimitedLog struct {
+	last       atomic.Int64  // When a line was last logged, in Unix nanoseconds
+	suppressed atomic.Uint64 // Errors not logged since then
+}
+
+// Printf logs like log.Printf, unless a line was logged less than
+// errorLogInterval ago
+func (l *rateLimitedLog) Printf(format string, args ...any) {
+	now := time.Now().UnixNano()
+	last := l.last.Load()
+	if now-last < int64(errorLogInterval) || !l.last.CompareAndSwap(last, now) {
+		l.suppressed.Add(1)
+		return
+	}
+
+	line := fmt.Sprintf(format, args...)
+	if suppressed := l.suppressed.Swap(0); suppressed > 0 {
+		line += fmt.Sprintf(" (%d similar errors not logged)", suppressed)
+	}
+	log.Print(line)
+}
+
+// logError logs an error from a hot path through limiter, or every time
+// while the packet trace is on, since that is when every detail is wanted
+func (s *Server) logError(limiter *rateLimitedLog, format string, args ...any) {
+	if s.packetTrace {
+		log.Printf(format, args...)
+		return
+	}
+	limiter.Printf(format, args...)
+}
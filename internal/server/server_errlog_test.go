@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// TestMalformedPacketLogging tests that a flood of datagrams that don't
+// decode is counted in full but logged at most once a second, with the
+// number left out reported on the next line
+func TestMalformedPacketLogging(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{TUN: network.NewMockTunManager()})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	source := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	for i := 0; i < 1000; i++ {
+		server.receivePacket([]byte("not a packet"), source)
+	}
+
+	if lines := strings.Count(output.String(), "\n"); lines != 1 {
+		t.Errorf("Expected 1 line logged for 1000 malformed packets, got %d:\n%s", lines, output.String())
+	}
+	if dropped := server.malformed.Load(); dropped != 1000 {
+		t.Errorf("Expected 1000 malformed packets counted, got %d", dropped)
+	}
+
+	// Once the interval has passed, the next line reports what was left out
+	output.Reset()
+	server.malformedLog.last.Store(0)
+	server.receivePacket([]byte("not a packet"), source)
+	if !strings.Contains(output.String(), "(999 similar errors not logged)") {
+		t.Errorf("Expected the next line to count the 999 errors not logged, got %q", output.String())
+	}
+
+	// The packet trace logs every one
+	output.Reset()
+	server.SetPacketTrace(true)
+	for i := 0; i < 10; i++ {
+		server.receivePacket([]byte("not a packet"), source)
+	}
+	if lines := strings.Count(output.String(), "\n"); lines != 10 {
+		t.Errorf("Expected every malformed packet logged while tracing, got %d lines", lines)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"log"
+	"sync"
+)
+
+// Reasons passed to EventHandler.OnClientDisconnected
+const (
+	DisconnectReasonTimeout      = "timeout"      // No packets within the client timeout
+	DisconnectReasonUnresponsive = "unresponsive" // Idle and didn't answer liveness probes
+	DisconnectReasonRemoved      = "removed"      // Removed by the server, e.g. a failed handshake
+	DisconnectReasonReconnected  = "reconnected"  // Replaced by a new session from the same client
+)
+
+// eventQueueSize is how many events can wait for a slow handler before
+// further events are dropped
+const eventQueueSize = 256
+
+// EventHandler is notified when clients connect and disconnect. Methods are
+// called one at a time, in order, from a goroutine of their own, so a slow
+// handler delays later events but never packet processing.
+type EventHandler interface {
+	OnClientConnected(status ClientStatus)
+	OnClientDisconnected(id uint8, reason string)
+}
+
+// eventDispatcher queues events and delivers them to an EventHandler. A nil
+// dispatcher discards events.
+type eventDispatcher struct {
+	handler EventHandler
+	queue   chan func()
+	mutex   sync.Mutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newEventDispatcher(handler EventHandler) *eventDispatcher {
+	d := &eventDispatcher{
+		handler: handler,
+		queue:   make(chan func(), eventQueueSize),
+	}
+
+	d.wg.Add(1)
+	go d.run()
+
+	return d
+}
+
+func (d *eventDispatcher) run() {
+	defer d.wg.Done()
+
+	for event := range d.queue {
+		event()
+	}
+}
+
+func (d *eventDispatcher) connected(status ClientStatus) {
+	d.dispatch(func() { d.handler.OnClientConnected(status) })
+}
+
+func (d *eventDispatcher) disconnected(id uint8, reason string) {
+	d.dispatch(func() { d.handler.OnClientDisconnected(id, reason) })
+}
+
+func (d *eventDispatcher) dispatch(event func()) {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	select {
+	case d.queue <- event:
+	default:
+		log.Printf("Event handler is falling behind, dropping client event")
+	}
+}
+
+// close stops accepting events and waits for queued ones to be delivered
+func (d *eventDispatcher) close() {
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mutex.Unlock()
+
+	d.wg.Wait()
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// recordingHandler forwards events to channels so tests can wait for them
+type recordingHandler struct {
+	connected    chan ClientStatus
+	disconnected chan disconnectEvent
+}
+
+type disconnectEvent struct {
+	id     uint8
+	reason string
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{
+		connected:    make(chan ClientStatus, 8),
+		disconnected: make(chan disconnectEvent, 8),
+	}
+}
+
+func (h *recordingHandler) OnClientConnected(status ClientStatus) {
+	h.connected <- status
+}
+
+func (h *recordingHandler) OnClientDisconnected(id uint8, reason string) {
+	h.disconnected <- disconnectEvent{id: id, reason: reason}
+}
+
+func (h *recordingHandler) waitDisconnected(t *testing.T) disconnectEvent {
+	t.Helper()
+
+	select {
+	case event := <-h.disconnected:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for disconnect event")
+		return disconnectEvent{}
+	}
+}
+
+func TestEvents_ClientConnected(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	handler := newRecordingHandler()
+	server.SetEventHandler(handler)
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	select {
+	case status := <-handler.connected:
+		if status.ID != vpnClient.GetClientID() {
+			t.Errorf("Expected client ID %d, got %d", vpnClient.GetClientID(), status.ID)
+		}
+		if status.IP != vpnClient.GetAssignedIP() {
+			t.Errorf("Expected IP %s, got %s", vpnClient.GetAssignedIP(), status.IP)
+		}
+		if !status.Connected {
+			t.Error("Expected client to be reported as connected")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for connect event")
+	}
+}
+
+func TestEvents_ClientRemoved(t *testing.T) {
+	handler := newRecordingHandler()
+	clientManager := NewClientManager(crypto.NewKeyManager(), nil)
+	defer clientManager.Close()
+	clientManager.events = newEventDispatcher(handler)
+	defer clientManager.events.close()
+
+	client, err := clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+
+	err = clientManager.RemoveClient(client.ID)
+	if err != nil {
+		t.Fatalf("RemoveClient failed: %v", err)
+	}
+
+	event := handler.waitDisconnected(t)
+	if event.id != client.ID || event.reason != DisconnectReasonRemoved {
+		t.Errorf("Expected client %d %s, got client %d %s", client.ID, DisconnectReasonRemoved, event.id, event.reason)
+	}
+}
+
+func TestEvents_ClientTimedOut(t *testing.T) {
+	handler := newRecordingHandler()
+	clientManager := NewClientManager(crypto.NewKeyManager(), nil)
+	defer clientManager.Close()
+	clientManager.events = newEventDispatcher(handler)
+	defer clientManager.events.close()
+	clientManager.timeout = time.Minute
+
+	idle, err := clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	active, err := clientManager.AddClient([]byte("another-32-byte-key-for-testing!"), "127.0.0.1:12346")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	idle.LastSeen = time.Now().Add(-2 * time.Minute)
+
+	clientManager.CheckTimeouts()
+
+	event := handler.waitDisconnected(t)
+	if event.id != idle.ID || event.reason != DisconnectReasonTimeout {
+		t.Errorf("Expected client %d %s, got client %d %s", idle.ID, DisconnectReasonTimeout, event.id, event.reason)
+	}
+
+	select {
+	case event := <-handler.disconnected:
+		t.Errorf("Expected no event for active client %d, got %+v", active.ID, event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// blockingHandler never returns from its callbacks until released
+type blockingHandler struct {
+	release chan struct{}
+}
+
+func (h *blockingHandler) OnClientConnected(status ClientStatus)        { <-h.release }
+func (h *blockingHandler) OnClientDisconnected(id uint8, reason string) { <-h.release }
+
+// TestEvents_SlowHandlerDoesNotBlock tests that events queue up or are
+// dropped rather than stalling the caller
+func TestEvents_SlowHandlerDoesNotBlock(t *testing.T) {
+	handler := &blockingHandler{release: make(chan struct{})}
+	dispatcher := newEventDispatcher(handler)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < eventQueueSize*2; i++ {
+			dispatcher.disconnected(1, DisconnectReasonRemoved)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dispatching events blocked on a slow handler")
+	}
+
+	close(handler.release)
+	dispatcher.close()
+}
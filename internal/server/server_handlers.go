@@ -1,47 +1,154 @@
 package server
 
 import (
-	"crypto/rand"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"time"
 
+	"github.com/pepalonsocosta/fvp/internal/crypto"
 	"github.com/pepalonsocosta/fvp/internal/protocol"
 )
 
+// oversizedLogInterval rate-limits the oversized datagram warning, since a
+// misconfigured client can send many
+const oversizedLogInterval = 10 * time.Second
+
 func (s *Server) handleClients() {
 	defer s.wg.Done()
 	
-	buffer := make([]byte, 1500) // Standard MTU size
+	// Packets in a batch are handled in arrival order, so per-client
+	// ordering is preserved. The spare byte in each buffer makes datagrams
+	// that were cut short by the buffer detectable.
+	var reader packetReader
+	var conn readDeadliner = s.udpConn
+	if s.customTransport != nil {
+		reader = newTransportReader(s.customTransport, s.maxDatagramSize()+1)
+		conn = s.customTransport.(readDeadliner)
+	} else {
+		reader = newPacketReader(s.udpConn, s.maxDatagramSize()+1)
+	}
 	
+	s.readLoop(reader, conn, s.receivePacket)
+}
+
+// handleDataClients reads the data socket, which only carries data packets
+func (s *Server) handleDataClients() {
+	defer s.wg.Done()
+
+	s.readLoop(newPacketReader(s.dataConn, s.maxDatagramSize()+1), s.dataConn, s.receiveDataPacket)
+}
+
+// readLoop hands every datagram reader reads to receive until the server
+// stops
+func (s *Server) readLoop(reader packetReader, conn readDeadliner, receive func(data []byte, clientAddr *net.UDPAddr)) {
 	for {
 		select {
 		case <-s.stopChan:
 			return
+		case <-s.ctx.Done():
+			return
 		default:
-			s.udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
 			
-			n, clientAddr, err := s.udpConn.ReadFromUDP(buffer)
+			err := reader.ReadPackets(receive)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
 				// Only log non-timeout errors
-				log.Printf("UDP read error: %v", err)
+				s.readErrors.Add(1)
+				s.logError(&s.readErrorLog, "UDP read error: %v", err)
 				continue
 			}
-			
-			s.processClientPacket(buffer[:n], clientAddr)
 		}
 	}
 }
 
+// maxDatagramSize is the largest datagram a client can legitimately send: an
+// MTU-sized IP packet plus the packet header, authentication tag and network
+// MAC, if any
+func (s *Server) maxDatagramSize() int {
+	size := protocol.HeaderLen(protocol.ProtocolVersionMajor) + s.maxPayloadSize()
+	if s.networkKey != nil {
+		size += protocol.NetworkMACSize
+	}
+	return size
+}
+
+// maxPayloadSize is the largest packet payload a client can legitimately
+// send: an MTU-sized IP packet plus the authentication tag
+func (s *Server) maxPayloadSize() int {
+	mtu := s.mtu
+	if mtu == 0 {
+		mtu = DefaultMTU
+	}
+	return mtu + crypto.CipherOverhead
+}
+
+// receivePacket processes a datagram from the listener, unless checkDatagram
+// drops it
+func (s *Server) receivePacket(data []byte, clientAddr *net.UDPAddr) {
+	data, ok := s.checkDatagram(data, clientAddr)
+	if ok {
+		s.processClientPacket(data, clientAddr)
+	}
+}
+
+// receiveDataPacket processes a datagram from the data socket, unless
+// checkDatagram drops it
+func (s *Server) receiveDataPacket(data []byte, clientAddr *net.UDPAddr) {
+	data, ok := s.checkDatagram(data, clientAddr)
+	if ok {
+		s.processDataPlanePacket(data, clientAddr)
+	}
+}
+
+// checkDatagram drops datagrams too large for the configured MTU, which
+// would otherwise reach the decoder truncated, and those without a valid
+// network MAC, returning the packet inside the rest
+func (s *Server) checkDatagram(data []byte, clientAddr *net.UDPAddr) ([]byte, bool) {
+	s.received.Add(1)
+	if len(data) > s.maxDatagramSize() {
+		dropped := s.oversized.Add(1)
+		last := s.oversizedLog.Load()
+		if time.Since(time.Unix(0, last)) >= oversizedLogInterval && s.oversizedLog.CompareAndSwap(last, time.Now().UnixNano()) {
+			log.Printf("Dropped oversized datagram from %s (over %d bytes, %d dropped so far); check the client MTU", clientAddr, s.maxDatagramSize(), dropped)
+		}
+		return nil, false
+	}
+
+	if s.bans != nil && s.bans.Banned(clientAddr.String()) {
+		s.banned.Add(1)
+		return nil, false
+	}
+
+	// Checked before anything else looks at the packet, so scanners and
+	// peers from other networks cost one hash and no log line
+	data, err := protocol.OpenNetworkMAC(data, s.networkKey)
+	if err != nil {
+		s.badNetworkMAC.Add(1)
+		return nil, false
+	}
+
+	return data, true
+}
+
 func (s *Server) processClientPacket(data []byte, clientAddr *net.UDPAddr) {
-	packet, err := protocol.DecodePacket(data)
+	packet, err := protocol.DecodePacketLimit(data, s.maxPayloadSize())
 	if err != nil {
-		log.Printf("Failed to decode packet from %s: %v", clientAddr, err)
+		s.malformed.Add(1)
+		s.logError(&s.malformedLog, "Failed to decode packet from %s: %v", clientAddr, err)
 		return
 	}
+	if s.packetTrace && packet.Type != protocol.PacketTypeData {
+		tracePacket("recv", clientAddr, packet, "", nil)
+	}
 	
 	switch packet.Type {
 	case protocol.PacketTypeAuth:
@@ -52,53 +159,342 @@ func (s *Server) processClientPacket(data []byte, clientAddr *net.UDPAddr) {
 		s.handlePingPacket(packet, clientAddr)
 	case protocol.PacketTypePong:
 		s.handlePongPacket(packet, clientAddr)
+	case protocol.PacketTypeRekey:
+		s.handleRekeyPacket(packet, clientAddr)
 	default:
 		// Silently drop unknown packet types (common for malformed packets)
 	}
 }
 
+// processDataPlanePacket handles a packet from the data socket. Only data
+// packets belong there; anything else is dropped, so control traffic keeps
+// to the listener whatever a peer sends.
+func (s *Server) processDataPlanePacket(data []byte, clientAddr *net.UDPAddr) {
+	packet, err := protocol.DecodePacketLimit(data, s.maxPayloadSize())
+	if err != nil {
+		s.malformed.Add(1)
+		s.logError(&s.malformedLog, "Failed to decode packet from %s: %v", clientAddr, err)
+		return
+	}
+	if packet.Type != protocol.PacketTypeData {
+		return
+	}
+
+	err = s.packetProcessor.ProcessDataPlanePacket(data, clientAddr)
+	if err != nil {
+		s.logError(&s.dataErrorLog, "Failed to process data packet from client %d: %v", packet.ClientID, err)
+	}
+	s.recordDecryptResult(err, clientAddr)
+}
+
 func (s *Server) handleAuthPacket(packet *protocol.Packet, clientAddr *net.UDPAddr) {
+	// A client that got no answer resends the same request; if an earlier
+	// copy did arrive, answer with the session it set up
+	request, err := protocol.EncodePacket(packet)
+	if err != nil {
+		log.Printf("Failed to encode auth packet from %s: %v", clientAddr, err)
+		return
+	}
+	if response := s.clientManager.AuthReplay(clientAddr.String(), request); response != nil {
+		log.Printf("Resending auth response to %s for a retried request", clientAddr)
+		_, err = s.transport.WriteTo(response, clientAddr)
+		if err != nil {
+			log.Printf("Failed to resend auth response to %s: %v", clientAddr, err)
+		}
+		return
+	}
+
+	// Every session derives its keys from a nonce the client sends, so
+	// requests without one, as from clients that predate session keys, can't
+	// be served
+	requestOptions, err := protocol.DecodeAuthOptions(packet.Payload)
+	if err == nil && len(requestOptions[protocol.AuthOptionClientNonce]) != crypto.SessionNonceSize {
+		err = crypto.ErrInvalidSessionNonce
+	}
+	if err != nil {
+		log.Printf("Authentication failed: invalid auth options from %s: %v", clientAddr, err)
+		s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeAuthFailed, "auth options with a session nonce are required", clientAddr)
+		return
+	}
+
 	var clientID uint8
 	var key []byte
-	var err error
+	var proof time.Time
+	keyManager, allowedIPs, reservedIPs := s.clientKeys()
 	
 	if packet.ClientID == 0 {
-		// Request assignment - server generates key and assigns ID
-		key = s.generateRandomKey()
-		clientID = s.clientManager.findNextClientID()
-		if clientID == 0 {
-			log.Printf("Authentication failed: no available client IDs from %s", clientAddr)
+		// Request assignment - server generates key and assigns ID. The
+		// client manager picks the ID when it adds the client, under its
+		// lock, so a full server is only detected there.
+		key, err = s.generateRandomKey()
+		if err != nil {
+			log.Printf("Failed to generate key for %s: %v", clientAddr, err)
+			s.sendErrorResponse(0, protocol.ErrorCodeAuthFailed, "failed to generate client key", clientAddr)
 			return
 		}
-		log.Printf("New client requesting assignment from %s, assigned ID %d", clientAddr, clientID)
+		log.Printf("New client requesting assignment from %s", clientAddr)
 	} else {
 		// Pre-shared key - use existing key
-		if !s.keyManager.HasClient(packet.ClientID) {
+		if !keyManager.HasClient(packet.ClientID) {
 			log.Printf("Authentication failed: unknown client ID %d from %s", packet.ClientID, clientAddr)
+			s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeUnknownClient, fmt.Sprintf("client ID %d is not configured", packet.ClientID), clientAddr)
 			return
 		}
 		
-		key, err = s.keyManager.GetClientKey(packet.ClientID)
+		key, err = keyManager.GetClientKey(packet.ClientID)
 		if err != nil {
 			log.Printf("Authentication failed: could not get key for client %d from %s: %v", packet.ClientID, clientAddr, err)
+			s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeAuthFailed, "client key unavailable", clientAddr)
 			return
 		}
 		clientID = packet.ClientID
 		log.Printf("Existing client %d authenticating from %s", clientID, clientAddr)
+
+		proof, err = authProof(requestOptions, packet.ClientID, key)
+		if err != nil {
+			log.Printf("Authentication failed: client %d from %s: %v", clientID, clientAddr, err)
+			s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeAuthFailed, "missing or invalid proof of the pre-shared key", clientAddr)
+			return
+		}
 	}
 	
-	client, err := s.clientManager.AddClient(key, clientAddr.String())
+	preferredIP := preferredClientIP(packet, reservedIPs, s.clientManager.RememberedIP(packet.ClientID))
+	client, err := s.clientManager.AddOrUpdateClient(key, clientAddr.String(), preferredIP, proof)
+	if errors.Is(err, ErrIPPoolExhausted) {
+		log.Printf("Authentication failed: IP pool exhausted, client %d from %s rejected; configure a larger subnet", clientID, clientAddr)
+		s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeServerFull, "no tunnel addresses available", clientAddr)
+		return
+	}
+	if errors.Is(err, ErrMaxClientsReached) {
+		log.Printf("Authentication failed: all %d client IDs in use, client %d from %s rejected", MaxClients, clientID, clientAddr)
+		s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeServerFull, "no client IDs available", clientAddr)
+		return
+	}
+	if errors.Is(err, ErrClientAlreadyExists) {
+		log.Printf("Authentication failed: client %d from %s did not prove its key with a newer request than its live session's, keeping that session", clientID, clientAddr)
+		s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeAlreadyConnected, "a session for this key is live", clientAddr)
+		return
+	}
 	if err != nil {
 		log.Printf("Authentication failed: could not add client %d from %s: %v", clientID, clientAddr, err)
+		s.sendErrorResponse(packet.ClientID, authErrorCode(err), err.Error(), clientAddr)
 		return
 	}
 	
-	log.Printf("Client %d connected from %s, assigned IP %s", client.ID, clientAddr, client.IP)
+	if packet.ClientID != 0 {
+		remembered := s.clientManager.RememberedIP(packet.ClientID)
+		err = s.clientManager.SetClientConfigID(client.ID, packet.ClientID)
+		if err != nil {
+			log.Printf("Failed to record configured ID for client %d: %v", client.ID, err)
+		}
+
+		if err == nil && client.IP != remembered {
+			err = s.saveLeases()
+			if err != nil {
+				log.Printf("Failed to save IP lease for client %d: %v", client.ID, err)
+			}
+		}
+	}
+
+	// Site-to-site clients may also send from the networks behind them
+	if allowed := allowedIPs[clientID]; len(allowed) > 0 {
+		err = s.clientManager.SetClientAllowedIPs(client.ID, allowed)
+		if err != nil {
+			log.Printf("Failed to record allowed IPs for client %d: %v", client.ID, err)
+		}
+	}
+
+	// The auth header carries the client's full version byte; both sides settle
+	// on the older of the two so neither uses features the other lacks
+	version := protocol.NegotiateVersion(protocol.ProtocolVersionByte, packet.Version)
+	err = s.clientManager.SetClientVersion(client.ID, version)
+	if err != nil {
+		log.Printf("Failed to record protocol version for client %d: %v", client.ID, err)
+	}
+
+	cipher, err := s.selectCipher(requestOptions[protocol.AuthOptionCiphers])
+	if err != nil {
+		log.Printf("Authentication failed: client %d from %s: %v", client.ID, clientAddr, err)
+		s.clientManager.RemoveClient(client.ID)
+		s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeEncryptionMismatch, err.Error(), clientAddr)
+		return
+	}
+	responseOptions := protocol.AuthOptions{protocol.AuthOptionCipher: {cipher.ID()}}
+
+	// Every session gets fresh per-direction keys
+	serverNonce, err := s.establishSession(client.ID, key, requestOptions[protocol.AuthOptionClientNonce])
+	if err != nil {
+		log.Printf("Authentication failed: could not derive session keys for client %d: %v", client.ID, err)
+		s.clientManager.RemoveClient(client.ID)
+		s.sendErrorResponse(packet.ClientID, protocol.ErrorCodeAuthFailed, "could not establish session keys", clientAddr)
+		return
+	}
+	responseOptions[protocol.AuthOptionServerNonce] = serverNonce
+
+	// Echoing the algorithm back confirms compression for the session
+	compress := false
+	if selectCompression(requestOptions[protocol.AuthOptionCompression]) {
+		compress = true
+		responseOptions[protocol.AuthOptionCompression] = []byte{protocol.CompressionFlate}
+	}
+
+	// Rekeys only make sense with encryption on
+	rekey := false
+	if _, ok := requestOptions[protocol.AuthOptionRekey]; ok && cipher.ID() != crypto.CipherNone {
+		rekey = true
+		responseOptions[protocol.AuthOptionRekey] = []byte{}
+	}
+
+	if len(s.pushRoutes) > 0 {
+		routes, err := encodePushRoutes(s.pushRoutes)
+		if err != nil {
+			log.Printf("Failed to encode push routes for client %d: %v", client.ID, err)
+		} else {
+			responseOptions[protocol.AuthOptionRoutes] = routes
+		}
+	}
+
+	// Clients send data packets to the data socket, so data volume can't
+	// hold up their control packets
+	dataPlane := false
+	if s.dataConn != nil {
+		dataPlane = true
+		port := uint16(s.dataConn.LocalAddr().(*net.UDPAddr).Port)
+		responseOptions[protocol.AuthOptionDataPort] = binary.BigEndian.AppendUint16(nil, port)
+	}
+
+	err = s.clientManager.SetClientCipher(client.ID, cipher)
+	if err != nil {
+		log.Printf("Failed to record cipher for client %d: %v", client.ID, err)
+	}
+	err = s.clientManager.SetClientCompression(client.ID, compress)
+	if err != nil {
+		log.Printf("Failed to record compression for client %d: %v", client.ID, err)
+	}
+	err = s.clientManager.SetClientRekey(client.ID, rekey)
+	if err != nil {
+		log.Printf("Failed to record rekeying for client %d: %v", client.ID, err)
+	}
+	err = s.clientManager.SetClientDataPlane(client.ID, dataPlane)
+	if err != nil {
+		log.Printf("Failed to record data socket for client %d: %v", client.ID, err)
+	}
+
+	// Clients with a pre-shared key get proof that the server knows it in
+	// place of the key, which only clients assigned an ID are sent
+	responseKey := key
+	if packet.ClientID != 0 {
+		responseKey = protocol.AuthResponseProof(key, packet.Payload)
+	}
+
+	if s.identityKey != nil {
+		err = s.signIdentity(packet.Payload, responseKey, client.IP, responseOptions)
+		if err != nil {
+			log.Printf("Failed to sign auth response for client %d: %v", client.ID, err)
+		}
+	}
+
+	log.Printf("Client %d connected from %s, assigned IP %s, protocol version %s, cipher %s, compression %t", client.ID, clientAddr, client.IP, protocol.FormatVersion(version), cipher.Name(), compress)
 	
-	err = s.sendAuthResponse(client.ID, client.IP, key, clientAddr)
+	response, err := s.sendAuthResponse(client.ID, client.IP, responseKey, responseOptions, clientAddr)
 	if err != nil {
 		log.Printf("Failed to send auth response to client %d: %v", client.ID, err)
 	}
+	if response != nil {
+		err = s.clientManager.SetClientAuth(client.ID, request, response)
+		if err != nil {
+			log.Printf("Failed to record auth response for client %d: %v", client.ID, err)
+		}
+	}
+
+	status, err := s.clientManager.GetClientStatus(client.ID)
+	if err == nil {
+		s.events.connected(status)
+	}
+}
+
+// authProof returns when the client proved it holds key in the options of its
+// auth request. Anyone can ask for a configured client ID, so a request
+// without a valid proof is an error.
+func authProof(options protocol.AuthOptions, clientID uint8, key []byte) (time.Time, error) {
+	proof, ok := options[protocol.AuthOptionProof]
+	if !ok {
+		return time.Time{}, errors.New("no proof of the pre-shared key")
+	}
+
+	unsigned := maps.Clone(options)
+	delete(unsigned, protocol.AuthOptionProof)
+	encoded, err := protocol.EncodeAuthOptions(unsigned)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return protocol.VerifyAuthProof(key, clientID, proof, encoded)
+}
+
+// authErrorCode maps a failure to add a client to the code reported to it
+func authErrorCode(err error) uint8 {
+	switch {
+	case errors.Is(err, ErrClientAlreadyExists):
+		return protocol.ErrorCodeAlreadyConnected
+	case errors.Is(err, ErrMaxClientsReached):
+		return protocol.ErrorCodeServerFull
+	default:
+		return protocol.ErrorCodeAuthFailed
+	}
+}
+
+// selectCipher returns the configured cipher if the client offered it,
+// otherwise the default cipher every client supports. Encryption is only ever
+// disabled if both sides disabled it.
+func (s *Server) selectCipher(offered []byte) (crypto.Cipher, error) {
+	insecureOffered := bytes.IndexByte(offered, crypto.CipherNone) >= 0
+	insecureServer := s.cipher.ID() == crypto.CipherNone
+
+	switch {
+	case insecureServer && !insecureOffered:
+		return nil, errors.New("server has encryption disabled")
+	case !insecureServer && insecureOffered:
+		return nil, errors.New("client has encryption disabled, which the server does not allow")
+	}
+
+	for _, id := range offered {
+		if id == s.cipher.ID() {
+			return s.cipher, nil
+		}
+	}
+	return crypto.DefaultCipher(), nil
+}
+
+// selectCompression reports whether the client asked for a compression
+// algorithm the server supports
+func selectCompression(requested []byte) bool {
+	for _, algorithm := range requested {
+		if algorithm == protocol.CompressionFlate {
+			return true
+		}
+	}
+	return false
+}
+
+// establishSession derives session keys for the client from its key and both
+// handshake nonces, returning the server nonce to send back
+func (s *Server) establishSession(clientID uint8, key, clientNonce []byte) ([]byte, error) {
+	serverNonce, err := crypto.GenerateSessionNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := crypto.DeriveSessionKeys(key, clientNonce, serverNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.clientManager.SetClientSession(clientID, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return serverNonce, nil
 }
 
 func (s *Server) handleDataPacket(packet *protocol.Packet, clientAddr *net.UDPAddr) {
@@ -108,20 +504,44 @@ func (s *Server) handleDataPacket(packet *protocol.Packet, clientAddr *net.UDPAd
 		return
 	}
 	
-	err = s.packetProcessor.ProcessPacket(packetData)
+	err = s.packetProcessor.ProcessPacket(packetData, clientAddr)
 	if err != nil {
-		log.Printf("Failed to process data packet from client %d: %v", packet.ClientID, err)
+		s.logError(&s.dataErrorLog, "Failed to process data packet from client %d: %v", packet.ClientID, err)
+	}
+	s.recordDecryptResult(err, clientAddr)
+}
+
+// recordDecryptResult counts a data packet that failed to decrypt against
+// its source, banning the source once it reaches the decrypt failure limit,
+// and clears the count when one decrypts
+func (s *Server) recordDecryptResult(err error, clientAddr *net.UDPAddr) {
+	if s.bans == nil || clientAddr == nil {
 		return
 	}
+
+	addr := clientAddr.String()
+	switch {
+	case err == nil:
+		s.bans.Succeeded(addr)
+	case errors.Is(err, ErrDecryptFailed):
+		if s.bans.Failed(addr) {
+			log.Printf("Warning: banning %s for %s after %d consecutive packets that failed to decrypt", addr, s.bans.duration, s.bans.limit)
+		}
+	}
 }
 
 func (s *Server) handlePingPacket(packet *protocol.Packet, clientAddr *net.UDPAddr) {
-	err := s.clientManager.UpdateClientActivity(packet.ClientID, packet.Sequence)
+	payload, err := s.openControlPacket(packet)
 	if err != nil {
-		log.Printf("Failed to update client activity for ping from client %d: %v", packet.ClientID, err)
+		log.Printf("Dropping ping from client %d: %v", packet.ClientID, err)
 		return
 	}
 	
+	// Clients that measure RTT report it in their pings
+	if rtt, ok := protocol.DecodePingRTT(payload); ok {
+		s.recordRTT(packet.ClientID, rtt)
+	}
+	
 	err = s.sendPongResponse(packet.ClientID, packet.Sequence)
 	if err != nil {
 		log.Printf("Failed to send pong response to client %d: %v", packet.ClientID, err)
@@ -130,19 +550,97 @@ func (s *Server) handlePingPacket(packet *protocol.Packet, clientAddr *net.UDPAd
 	log.Printf("Received ping from client %d", packet.ClientID)
 }
 
+// recordRTT stores a client's reported RTT, logging it when it first arrives
+// and whenever it moves markedly
+func (s *Server) recordRTT(clientID uint8, rtt time.Duration) {
+	previous, changed, err := s.clientManager.RecordRTT(clientID, rtt)
+	if err != nil || !changed {
+		return
+	}
+
+	if previous == 0 {
+		log.Printf("RTT to client %d is %s", clientID, rtt.Round(time.Microsecond))
+	} else {
+		log.Printf("RTT to client %d changed from %s to %s", clientID, previous.Round(time.Microsecond), rtt.Round(time.Microsecond))
+	}
+}
+
 func (s *Server) handlePongPacket(packet *protocol.Packet, clientAddr *net.UDPAddr) {
-	err := s.clientManager.UpdateClientActivity(packet.ClientID, packet.Sequence)
+	_, err := s.openControlPacket(packet)
 	if err != nil {
-		log.Printf("Failed to update client activity for pong from client %d: %v", packet.ClientID, err)
+		log.Printf("Dropping pong from client %d: %v", packet.ClientID, err)
 		return
 	}
 	
 	log.Printf("Received pong from client %d", packet.ClientID)
 }
 
+// openControlPacket opens the payload of a ping or pong from a client, which
+// is sealed like data, and only then counts the packet as activity. Forged
+// ones can then neither advance the sequence nor keep a dead client alive.
+func (s *Server) openControlPacket(packet *protocol.Packet) ([]byte, error) {
+	client, err := s.clientManager.GetClient(packet.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := client.Keys.Open(client.Cipher, packet.Payload, packet.Sequence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+
+	err = s.clientManager.UpdateControlActivity(client.ID, packet.Sequence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update client activity: %w", err)
+	}
+	return payload, nil
+}
+
 // generateRandomKey generates a random 32-byte key for new clients
-func (s *Server) generateRandomKey() []byte {
+func (s *Server) generateRandomKey() ([]byte, error) {
 	key := make([]byte, 32)
-	rand.Read(key)
-	return key
+	_, err := io.ReadFull(s.random, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// preferredClientIP returns the tunnel IP to offer an authenticating client:
+// the one reserved for its configured ID, or else the one it requested, or
+// else remembered, the one it last had, unless that is reserved for another
+// client. An empty result means any free IP.
+func preferredClientIP(packet *protocol.Packet, reservedIPs map[uint8]string, remembered string) string {
+	if ip, ok := reservedIPs[packet.ClientID]; ok && packet.ClientID != 0 {
+		return ip
+	}
+
+	ip := requestedClientIP(packet)
+	if ip == "" && packet.ClientID != 0 {
+		ip = remembered
+	}
+
+	for _, reserved := range reservedIPs {
+		if reserved == ip {
+			return ""
+		}
+	}
+	return ip
+}
+
+// requestedClientIP returns the tunnel IP a client asked for in its auth
+// options, or an empty string
+func requestedClientIP(packet *protocol.Packet) string {
+	if len(packet.Payload) == 0 {
+		return ""
+	}
+	options, err := protocol.DecodeAuthOptions(packet.Payload)
+	if err != nil {
+		return ""
+	}
+	requested := options[protocol.AuthOptionRequestedIP]
+	if len(requested) != net.IPv4len {
+		return ""
+	}
+	return net.IP(requested).String()
 }
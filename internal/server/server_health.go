@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startHealthServer serves /healthz on the configured health address. It
+// does nothing if no address is configured.
+func (s *Server) startHealthServer() error {
+	if s.healthAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.healthAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on health address: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+
+	s.healthListener = listener
+	s.healthServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		err := s.healthServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Health endpoint error: %v", err)
+		}
+	}()
+
+	log.Printf("Health endpoint listening on %s", listener.Addr())
+	return nil
+}
+
+// stopHealthServer shuts down the health endpoint, if running
+func (s *Server) stopHealthServer() {
+	if s.healthServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.healthServer.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Failed to stop health endpoint: %v", err)
+	}
+}
+
+// handleHealthz reports 200 while the transport and TUN interface are up
+// and 503 otherwise, with the server status as the body
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := s.GetServerStatus()
+
+	healthy := status.Status == "running" &&
+		s.transport != nil &&
+		s.tunInterface != nil && s.tunInterface.IsCreated()
+
+	w.Header().Set("Content-Type", "application/json")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// GetHealthAddr returns the address the health endpoint is listening on, or
+// nil if it isn't running
+func (s *Server) GetHealthAddr() net.Addr {
+	if s.healthListener == nil {
+		return nil
+	}
+	return s.healthListener.Addr()
+}
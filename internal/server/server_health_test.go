@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// TestHealthz tests the health endpoint of a running server
+func TestHealthz(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:       "127.0.0.1:0",
+		HealthAddr: "127.0.0.1:0",
+		TUN:        network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.GetHealthAddr() == nil {
+		t.Fatal("Expected health endpoint to be listening")
+	}
+
+	resp, err := http.Get("http://" + server.GetHealthAddr().String() + "/healthz")
+	if err != nil {
+		t.Fatalf("Health request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var status ServerStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		t.Fatalf("Failed to decode health body: %v", err)
+	}
+	if status.Status != "running" {
+		t.Errorf("Expected status running, got %s", status.Status)
+	}
+}
+
+// TestHealthz_Unavailable tests that a server that isn't up reports 503
+func TestHealthz_Unavailable(t *testing.T) {
+	server := NewServer()
+
+	recorder := httptest.NewRecorder()
+	server.handleHealthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", recorder.Code)
+	}
+}
+
+// TestHealthz_Disabled tests that no endpoint is started without an address
+func TestHealthz_Disabled(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.GetHealthAddr() != nil {
+		t.Errorf("Expected no health endpoint, got %v", server.GetHealthAddr())
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// IdentityPublicKey returns the public key, hex-encoded, that clients pin as
+// server_identity for the hex identity_key of a server config, or "" if it
+// is empty
+func IdentityPublicKey(identityKey string) (string, error) {
+	if identityKey == "" {
+		return "", nil
+	}
+
+	seed, err := hex.DecodeString(identityKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid hex identity_key: %w", err)
+	}
+	if len(seed) != protocol.IdentityKeySize {
+		return "", fmt.Errorf("invalid identity_key: must be exactly %d bytes (%d hex chars), got %d bytes", protocol.IdentityKeySize, 2*protocol.IdentityKeySize, len(seed))
+	}
+
+	publicKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	return hex.EncodeToString(publicKey), nil
+}
+
+// signIdentity adds the identity option to the options of an auth
+// response, signing the client's auth request options and the response
+// without it, so clients that pinned the server can tell it from an impostor
+func (s *Server) signIdentity(request, key []byte, ip string, options protocol.AuthOptions) error {
+	response, err := protocol.EncodeAuthResponse(key, ip, options)
+	if err != nil {
+		return err
+	}
+
+	options[protocol.AuthOptionIdentity] = protocol.SignIdentity(s.identityKey, request, response)
+	return nil
+}
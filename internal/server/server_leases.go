@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// SetLeaseFile makes the server keep the tunnel IP each configured client
+// last had in a file at path, so after a restart clients get the same IPs
+// back rather than ones in order of arrival, as long as they are free. An
+// empty path only remembers them while the server runs. It must be called
+// before the server is started.
+func (s *Server) SetLeaseFile(path string) {
+	s.leaseFile = path
+}
+
+// loadLeases offers configured clients the IPs recorded in the lease file
+func (s *Server) loadLeases() {
+	if s.leaseFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(s.leaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read lease file, assigning IPs afresh: %v", err)
+		return
+	}
+
+	var ips map[uint8]string
+	err = json.Unmarshal(data, &ips)
+	if err != nil {
+		log.Printf("Warning: failed to parse lease file %s, assigning IPs afresh: %v", s.leaseFile, err)
+		return
+	}
+
+	s.clientManager.RememberIPs(ips)
+}
+
+// saveLeases records the IP each configured client last had in the lease
+// file, replacing it atomically so a crash mid-write leaves the previous
+// leases in place
+func (s *Server) saveLeases() error {
+	if s.leaseFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.clientManager.RememberedIPs(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lease file: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.leaseFile), filepath.Base(s.leaseFile)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.leaseFile)
+	if err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	// DefaultLogMaxSizeMB is how large the log file grows, in megabytes,
+	// before it is rotated when no size is configured
+	DefaultLogMaxSizeMB = 100
+	// DefaultLogMaxBackups is how many rotated log files are kept when no
+	// count is configured
+	DefaultLogMaxBackups = 5
+)
+
+// rotatingLog is a log file that is rotated once it would grow past maxSize
+// bytes: the file becomes path.1, older backups move up one and those past
+// maxBackups are removed, then a new file is started at path.
+type rotatingLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64 // Bytes in file
+}
+
+// openRotatingLog opens the log file at path, appending to it if it exists
+func openRotatingLog(path string, maxSize int64, maxBackups int) (*rotatingLog, error) {
+	l := &rotatingLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write appends p to the log file, rotating it first if p would take it past
+// maxSize. A write larger than maxSize gets a file to itself. If rotating
+// fails, p is still written to the current file.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var rotateErr error
+	if l.file != nil && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		rotateErr = l.rotate()
+	}
+	if l.file == nil {
+		return 0, errors.Join(rotateErr, os.ErrClosed)
+	}
+
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rotateErr
+}
+
+// Reopen closes the log file and opens path again, so that once logrotate
+// or an operator has moved the file away, logging continues in a new one
+func (l *rotatingLog) Reopen() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	return l.open()
+}
+
+// Close closes the log file. Later writes fail.
+func (l *rotatingLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// open opens the file at path for appending. It must be called with the
+// mutex held.
+func (l *rotatingLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the log file to the first backup, shifting older backups up
+// and dropping the oldest, and starts a new file. It must be called with the
+// mutex held.
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	// Renaming over an existing file fails on Windows
+	os.Remove(l.backup(l.maxBackups))
+	for i := l.maxBackups - 1; i >= 1; i-- {
+		os.Rename(l.backup(i), l.backup(i+1))
+	}
+
+	err := os.Rename(l.path, l.backup(1))
+	if err != nil {
+		err = fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	return errors.Join(err, l.open())
+}
+
+// backup returns the path of the nth most recent rotated log file
+func (l *rotatingLog) backup(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// openLog sends the log to the configured log file, if any
+func (s *Server) openLog() error {
+	if s.logPath == "" || s.logFile != nil {
+		return nil
+	}
+
+	logFile, err := openRotatingLog(s.logPath, s.logMaxSize, s.logMaxBackups)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Logging to %s", s.logPath)
+	s.logFile = logFile
+	log.SetOutput(logFile)
+	return nil
+}
+
+// reopenLog reopens the log file, so that logrotate can move it away and
+// signal the server. If it can't be reopened, logs go to stderr.
+func (s *Server) reopenLog() {
+	if s.logFile == nil {
+		return
+	}
+
+	err := s.logFile.Reopen()
+	if err != nil {
+		log.SetOutput(os.Stderr)
+		log.Printf("Warning: logging to stderr: %v", err)
+		return
+	}
+	log.SetOutput(s.logFile)
+}
+
+// closeLog closes the log file, sending the log back to stderr
+func (s *Server) closeLog() {
+	if s.logFile == nil {
+		return
+	}
+
+	log.SetOutput(os.Stderr)
+	s.logFile.Close()
+	s.logFile = nil
+}
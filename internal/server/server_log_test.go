@@ -0,0 +1,130 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+// TestRotatingLog_RotatesAtMaxSize tests that the log file is rotated before
+// a write would take it past the maximum size, keeping only the configured
+// number of backups
+func TestRotatingLog_RotatesAtMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fvps.log")
+	logFile, err := openRotatingLog(path, 100, 2)
+	if err != nil {
+		t.Fatalf("openRotatingLog failed: %v", err)
+	}
+	defer logFile.Close()
+
+	for _, line := range []string{"a", "b", "c", "d"} {
+		_, err := logFile.Write([]byte(strings.Repeat(line, 59) + "\n"))
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        strings.Repeat("d", 59) + "\n",
+		path + ".1": strings.Repeat("c", 59) + "\n",
+		path + ".2": strings.Repeat("b", 59) + "\n",
+	}
+	for file, content := range expected {
+		if got := readLog(t, file); got != content {
+			t.Errorf("Expected %s to hold %q, got %q", file, content, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept, got %s: %v", path+".3", err)
+	}
+}
+
+// TestRotatingLog_AppendsUntilFull tests that writes fill an existing file up
+// to the maximum size before it is rotated
+func TestRotatingLog_AppendsUntilFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fvps.log")
+	err := os.WriteFile(path, []byte("earlier run\n"), 0640)
+	if err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	logFile, err := openRotatingLog(path, 24, 1)
+	if err != nil {
+		t.Fatalf("openRotatingLog failed: %v", err)
+	}
+	defer logFile.Close()
+
+	logFile.Write([]byte("first line\n"))
+	if got := readLog(t, path); got != "earlier run\nfirst line\n" {
+		t.Errorf("Expected the file to be appended to, got %q", got)
+	}
+
+	logFile.Write([]byte("second line\n"))
+	if got := readLog(t, path); got != "second line\n" {
+		t.Errorf("Expected a new file after rotating, got %q", got)
+	}
+	if got := readLog(t, path+".1"); got != "earlier run\nfirst line\n" {
+		t.Errorf("Expected the full file as the backup, got %q", got)
+	}
+}
+
+// TestServerReload_ReopensLog tests that a reload reopens the log file, so
+// logging continues in a new file once logrotate has moved the old one
+func TestServerReload_ReopensLog(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "server.yaml")
+	err := os.WriteFile(configPath, []byte("server:\n  log_file: fvps.log\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	opts, err := LoadServerOptions(configPath)
+	if err != nil {
+		t.Fatalf("LoadServerOptions failed: %v", err)
+	}
+	logPath := filepath.Join(dir, "fvps.log")
+	if opts.LogFile != logPath {
+		t.Fatalf("Expected log_file relative to the config, got %s", opts.LogFile)
+	}
+
+	server, err := NewServerWithOptions(opts)
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	err = server.openLog()
+	if err != nil {
+		t.Fatalf("openLog failed: %v", err)
+	}
+	defer server.closeLog()
+
+	log.Printf("before rotation")
+	err = os.Rename(logPath, logPath+".old")
+	if err != nil {
+		t.Fatalf("Failed to move log: %v", err)
+	}
+
+	err = server.Reload(configPath)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	log.Printf("after rotation")
+
+	if got := readLog(t, logPath+".old"); !strings.Contains(got, "before rotation") || strings.Contains(got, "after rotation") {
+		t.Errorf("Expected the moved file to end before the reload, got %q", got)
+	}
+	if got := readLog(t, logPath); !strings.Contains(got, "after rotation") {
+		t.Errorf("Expected logging to continue in a new file, got %q", got)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// networkKeyTransport appends the network MAC to every datagram the server
+// sends, so clients of the same network accept them. Received datagrams are
+// checked in receivePacket, which every read path goes through.
+type networkKeyTransport struct {
+	network.Transport
+	key []byte
+}
+
+func (t *networkKeyTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	// Capping the capacity makes the append copy rather than write into
+	// whatever follows data in the caller's buffer
+	sealed := protocol.SealNetworkMAC(data[:len(data):len(data)], t.key)
+	n, err := t.Transport.WriteTo(sealed, addr)
+	if n > len(data) {
+		n = len(data)
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// PreflightCheck is the outcome of one dry-run check
+type PreflightCheck struct {
+	Name string
+	Err  error
+}
+
+// Preflight checks that the server could start with the given configuration
+// without serving any traffic: the config must load, the UDP port and health
+// address must be free and, if checkTUN is set, a TUN interface must be
+// creatable. Every socket and interface it opens is closed again before it
+// returns. Checks after a failed config load are skipped.
+func (s *Server) Preflight(configPath string, checkTUN bool) []PreflightCheck {
+	err := s.LoadConfig(configPath)
+	checks := []PreflightCheck{{Name: "config", Err: err}}
+	if err != nil {
+		return checks
+	}
+
+	port := s.port
+	if port == "" {
+		port = DefaultPort
+	}
+
+	err = s.CreateUDPServer(port)
+	if s.udpConn != nil {
+		s.udpConn.Close()
+		s.udpConn = nil
+		s.transport = nil
+	}
+	if s.dataConn != nil {
+		s.dataConn.Close()
+		s.dataConn = nil
+		s.dataTransport = nil
+	}
+	name := "udp " + port
+	if s.dataPort != "" {
+		name += ", data " + s.dataPort
+	}
+	checks = append(checks, PreflightCheck{Name: name, Err: err})
+
+	if s.healthAddr != "" {
+		listener, err := net.Listen("tcp", s.healthAddr)
+		if err != nil {
+			err = fmt.Errorf("failed to listen on health address: %w", err)
+		} else {
+			listener.Close()
+		}
+		checks = append(checks, PreflightCheck{Name: "health " + s.healthAddr, Err: err})
+	}
+
+	if checkTUN {
+		err = s.CreateTUNInterface()
+		if err == nil {
+			s.tunInterface.Close()
+		}
+		checks = append(checks, PreflightCheck{Name: "tun " + s.getInterfaceName(), Err: err})
+	}
+
+	return checks
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// writePreflightConfig writes a server.yaml listening on port
+func writePreflightConfig(t *testing.T, port string) string {
+	t.Helper()
+
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(configPath, []byte("server:\n  port: \""+port+"\"\n  timeout_minutes: 30\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return configPath
+}
+
+func TestPreflight_Passes(t *testing.T) {
+	tun := network.NewMockTunManager()
+	server := NewServer()
+	server.tunInterface = tun
+
+	checks := server.Preflight(writePreflightConfig(t, "127.0.0.1:0"), true)
+
+	if len(checks) != 3 {
+		t.Fatalf("Expected 3 checks, got %d", len(checks))
+	}
+	for _, check := range checks {
+		if check.Err != nil {
+			t.Errorf("Expected %s to pass, got %v", check.Name, check.Err)
+		}
+	}
+
+	// Nothing may be left open
+	if server.udpConn != nil {
+		t.Error("Expected UDP socket to be closed")
+	}
+	if tun.IsCreated() {
+		t.Error("Expected TUN interface to be closed")
+	}
+}
+
+func TestPreflight_PortInUse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to occupy port: %v", err)
+	}
+	defer conn.Close()
+
+	checks := NewServer().Preflight(writePreflightConfig(t, conn.LocalAddr().String()), false)
+
+	if len(checks) != 2 {
+		t.Fatalf("Expected 2 checks, got %d", len(checks))
+	}
+	if checks[0].Err != nil {
+		t.Errorf("Expected config check to pass, got %v", checks[0].Err)
+	}
+	if checks[1].Err == nil {
+		t.Error("Expected UDP check to fail for a port in use")
+	}
+}
+
+func TestPreflight_InvalidConfig(t *testing.T) {
+	checks := NewServer().Preflight(writePreflightConfig(t, "70000"), true)
+
+	if len(checks) != 1 {
+		t.Fatalf("Expected later checks to be skipped, got %d checks", len(checks))
+	}
+	if checks[0].Err == nil {
+		t.Error("Expected config check to fail")
+	}
+}
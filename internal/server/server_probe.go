@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+const (
+	// DefaultProbeInterval is how often idle clients are probed
+	DefaultProbeInterval = 10 * time.Second
+
+	// probeAttempts is how many probes an idle client may leave unanswered
+	// before it is removed
+	probeAttempts = 3
+)
+
+// probeIdleClients pings clients that have been silent for half the timeout,
+// so dead ones are removed after a few unanswered probes instead of lingering
+// until the full timeout
+func (s *Server) probeIdleClients() {
+	defer s.wg.Done()
+
+	interval := s.probeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.probeClients()
+		}
+	}
+}
+
+// probeClients runs one probing round
+func (s *Server) probeClients() {
+	for _, clientID := range s.clientManager.CheckIdle(probeAttempts) {
+		err := s.sendProbe(clientID)
+		if err != nil {
+			log.Printf("Failed to probe client %d: %v", clientID, err)
+		}
+	}
+}
+
+// sendProbe pings a client, which answers with a pong
+func (s *Server) sendProbe(clientID uint8) error {
+	clientAddr, err := s.clientManager.GetClientAddr(clientID)
+	if err != nil {
+		return err
+	}
+
+	// The client answers with its own sequence, so this one carries nothing
+	packetData, err := protocol.EncodePacket(protocol.CreatePingPacket(clientID, 0))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.transport.WriteTo(packetData, clientAddr)
+	return err
+}
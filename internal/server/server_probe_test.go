@@ -0,0 +1,154 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// newProbeTestServer returns a server whose probes land in a mock transport
+func newProbeTestServer(t *testing.T) (*Server, *network.MockTransport) {
+	t.Helper()
+
+	clientManager := NewClientManager(crypto.NewKeyManager(), nil)
+	t.Cleanup(clientManager.Close)
+	clientManager.timeout = time.Minute
+
+	transport := network.NewMockTransport()
+	return &Server{clientManager: clientManager, transport: transport}, transport
+}
+
+func TestProbeClients_PingsIdleClients(t *testing.T) {
+	server, transport := newProbeTestServer(t)
+
+	idle, err := server.clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	_, err = server.clientManager.AddClient([]byte("another-32-byte-key-for-testing!"), "127.0.0.1:12346")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	idle.LastSeen = time.Now().Add(-40 * time.Second)
+
+	server.probeClients()
+
+	sent := transport.GetSent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 probe, got %d", len(sent))
+	}
+	if sent[0].Addr.String() != "127.0.0.1:12345" {
+		t.Errorf("Expected probe to 127.0.0.1:12345, got %s", sent[0].Addr)
+	}
+
+	packet, err := protocol.DecodePacket(sent[0].Data)
+	if err != nil {
+		t.Fatalf("Failed to decode probe: %v", err)
+	}
+	if packet.Type != protocol.PacketTypePing || packet.ClientID != idle.ID {
+		t.Errorf("Expected ping for client %d, got type %d for client %d", idle.ID, packet.Type, packet.ClientID)
+	}
+}
+
+func TestProbeClients_RemovesUnresponsiveClient(t *testing.T) {
+	server, transport := newProbeTestServer(t)
+	handler := newRecordingHandler()
+	server.clientManager.events = newEventDispatcher(handler)
+	defer server.clientManager.events.close()
+
+	client, err := server.clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	client.LastSeen = time.Now().Add(-40 * time.Second)
+
+	for i := 0; i < probeAttempts; i++ {
+		server.probeClients()
+	}
+	if count := len(server.clientManager.ListClients()); count != 1 {
+		t.Fatalf("Expected client kept while probes are outstanding, got %d clients", count)
+	}
+	if sent := len(transport.GetSent()); sent != probeAttempts {
+		t.Errorf("Expected %d probes, got %d", probeAttempts, sent)
+	}
+
+	server.probeClients()
+	if count := len(server.clientManager.ListClients()); count != 0 {
+		t.Errorf("Expected unresponsive client removed, got %d clients", count)
+	}
+
+	event := handler.waitDisconnected(t)
+	if event.id != client.ID || event.reason != DisconnectReasonUnresponsive {
+		t.Errorf("Expected client %d %s, got client %d %s", client.ID, DisconnectReasonUnresponsive, event.id, event.reason)
+	}
+}
+
+func TestProbeClients_PongResetsProbes(t *testing.T) {
+	server, transport := newProbeTestServer(t)
+
+	client, err := server.clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, server.clientManager, client)
+	client.LastSeen = time.Now().Add(-40 * time.Second)
+
+	server.probeClients()
+
+	// Pongs that don't open with the session keys are forged
+	server.handlePongPacket(protocol.CreatePongPacket(client.ID, 1), nil)
+	if client.Probes != 1 {
+		t.Errorf("Expected probes kept by a forged pong, got %d", client.Probes)
+	}
+
+	sealed, err := encryptFromClient([]byte{}, client.Key, 1)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
+	pong := protocol.CreatePongPacket(client.ID, 1)
+	pong.Payload = sealed
+	server.handlePongPacket(pong, nil)
+	if client.Probes != 0 {
+		t.Errorf("Expected probes reset by pong, got %d", client.Probes)
+	}
+
+	// The client is no longer idle, so it isn't probed again
+	transport.ClearSent()
+	server.probeClients()
+	if sent := len(transport.GetSent()); sent != 0 {
+		t.Errorf("Expected no probe after pong, got %d", sent)
+	}
+}
+
+// TestHandlePingPacket_ForgedPingChangesNothing tests that a ping that doesn't
+// open with the session keys neither keeps the client alive nor advances its
+// sequence past the data it sends
+func TestHandlePingPacket_ForgedPingChangesNothing(t *testing.T) {
+	server, transport := newProbeTestServer(t)
+
+	client, err := server.clientManager.AddClient(make([]byte, 32), "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to add client: %v", err)
+	}
+	setTestSession(t, server.clientManager, client)
+	lastSeen := time.Now().Add(-40 * time.Second)
+	client.LastSeen = lastSeen
+	client.Probes = 2
+
+	server.handlePingPacket(protocol.CreatePingPacket(client.ID, 0xFFFFFFFF), nil)
+	if client.RxSeq != 0 || client.Probes != 2 || !client.LastSeen.Equal(lastSeen) {
+		t.Errorf("Expected a forged ping to change nothing, got sequence %d, %d probes, last seen %s", client.RxSeq, client.Probes, client.LastSeen)
+	}
+	if sent := len(transport.GetSent()); sent != 0 {
+		t.Errorf("Expected no pong to a forged ping, got %d packets", sent)
+	}
+
+	// The client's own data is still accepted
+	err = server.clientManager.UpdateClientActivity(client.ID, 1)
+	if err != nil {
+		t.Errorf("Expected data after a forged ping to be accepted, got %v", err)
+	}
+}
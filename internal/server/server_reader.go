@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"golang.org/x/net/ipv4"
+)
+
+// readBatchSize is the most datagrams pulled from the socket per syscall
+const readBatchSize = 32
+
+// packetReader reads client datagrams from the UDP socket
+type packetReader interface {
+	// ReadPackets blocks until at least one datagram arrives, then calls
+	// handle for each one received, in arrival order. The data slice is only
+	// valid until handle returns. A datagram longer than the buffer is
+	// truncated to the buffer size.
+	ReadPackets(handle func(data []byte, addr *net.UDPAddr)) error
+}
+
+// newPacketReader returns a batching reader where recvmmsg is available and
+// a single-datagram reader elsewhere, reading into bufferSize-byte buffers
+func newPacketReader(conn *net.UDPConn, bufferSize int) packetReader {
+	if runtime.GOOS == "linux" {
+		return newBatchReader(conn, readBatchSize, bufferSize)
+	}
+	return newSingleReader(conn, bufferSize)
+}
+
+// readDeadliner is implemented by sockets and transports whose reads can
+// time out, which the receive loop relies on to notice the server stopping
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// transportReader reads one datagram per call from a custom transport,
+// dropping any from peers that aren't identified by a UDP address
+type transportReader struct {
+	transport network.Transport
+	buffer    []byte
+}
+
+func newTransportReader(transport network.Transport, bufferSize int) *transportReader {
+	return &transportReader{
+		transport: transport,
+		buffer:    make([]byte, bufferSize),
+	}
+}
+
+func (r *transportReader) ReadPackets(handle func(data []byte, addr *net.UDPAddr)) error {
+	n, addr, err := r.transport.ReadFrom(r.buffer)
+	if err != nil {
+		return err
+	}
+
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		handle(r.buffer[:n], udpAddr)
+	}
+	return nil
+}
+
+// singleReader reads one datagram per syscall
+type singleReader struct {
+	conn   *net.UDPConn
+	buffer []byte
+}
+
+func newSingleReader(conn *net.UDPConn, bufferSize int) *singleReader {
+	return &singleReader{
+		conn:   conn,
+		buffer: make([]byte, bufferSize),
+	}
+}
+
+func (r *singleReader) ReadPackets(handle func(data []byte, addr *net.UDPAddr)) error {
+	n, addr, err := r.conn.ReadFromUDP(r.buffer)
+	if err != nil {
+		return err
+	}
+
+	handle(r.buffer[:n], addr)
+	return nil
+}
+
+// batchReader reads up to a batch of datagrams per syscall with recvmmsg
+type batchReader struct {
+	conn     *ipv4.PacketConn
+	messages []ipv4.Message
+}
+
+func newBatchReader(conn *net.UDPConn, size, bufferSize int) *batchReader {
+	messages := make([]ipv4.Message, size)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, bufferSize)}
+	}
+
+	return &batchReader{
+		conn:     ipv4.NewPacketConn(conn),
+		messages: messages,
+	}
+}
+
+func (r *batchReader) ReadPackets(handle func(data []byte, addr *net.UDPAddr)) error {
+	count, err := r.conn.ReadBatch(r.messages, 0)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		message := &r.messages[i]
+		addr, ok := message.Addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		handle(message.Buffers[0][:message.N], addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// newLoopbackPair creates a listening socket and a sender connected to it
+func newLoopbackPair(tb testing.TB) (*net.UDPConn, *net.UDPConn) {
+	tb.Helper()
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatalf("Failed to create listener: %v", err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	sender, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatalf("Failed to create sender: %v", err)
+	}
+	tb.Cleanup(func() { sender.Close() })
+
+	return listener, sender
+}
+
+func TestPacketReaders_PreserveOrder(t *testing.T) {
+	readers := map[string]func(*net.UDPConn) packetReader{
+		"single": func(conn *net.UDPConn) packetReader { return newSingleReader(conn, 1500) },
+		"batch":  func(conn *net.UDPConn) packetReader { return newBatchReader(conn, 8, 1500) },
+	}
+
+	for name, newReader := range readers {
+		t.Run(name, func(t *testing.T) {
+			listener, sender := newLoopbackPair(t)
+			reader := newReader(listener)
+
+			// More packets than fit in one batch
+			const count = 20
+			for i := 0; i < count; i++ {
+				_, err := sender.Write([]byte(fmt.Sprintf("packet-%02d", i)))
+				if err != nil {
+					t.Fatalf("Failed to send packet: %v", err)
+				}
+			}
+
+			var received []string
+			listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for len(received) < count {
+				err := reader.ReadPackets(func(data []byte, addr *net.UDPAddr) {
+					if addr.String() != sender.LocalAddr().String() {
+						t.Errorf("Expected source %s, got %s", sender.LocalAddr(), addr)
+					}
+					received = append(received, string(data))
+				})
+				if err != nil {
+					t.Fatalf("ReadPackets failed after %d packets: %v", len(received), err)
+				}
+			}
+
+			for i, packet := range received {
+				expected := fmt.Sprintf("packet-%02d", i)
+				if packet != expected {
+					t.Errorf("Expected %s at position %d, got %s", expected, i, packet)
+				}
+			}
+		})
+	}
+}
+
+// TestOversizedDatagramsDropped tests that a datagram larger than the MTU
+// allows is counted and dropped rather than decoded truncated
+func TestOversizedDatagramsDropped(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		MTU:  1400,
+		TUN:  network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	sender, err := net.DialUDP("udp", nil, server.GetAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to create sender: %v", err)
+	}
+	defer sender.Close()
+
+	// Largest allowed size, then one byte over, then far over the buffer
+	sizes := []int{server.maxDatagramSize(), server.maxDatagramSize() + 1, 3000}
+	for _, size := range sizes {
+		_, err = sender.Write(make([]byte, size))
+		if err != nil {
+			t.Fatalf("Failed to send %d-byte datagram: %v", size, err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.GetServerStatus().DroppedOversized < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Give a wrongly counted third datagram a chance to show up
+	time.Sleep(50 * time.Millisecond)
+	if dropped := server.GetServerStatus().DroppedOversized; dropped != 2 {
+		t.Errorf("Expected 2 oversized datagrams dropped, got %d", dropped)
+	}
+	if received := server.GetServerStatus().PacketsReceived; received != 3 {
+		t.Errorf("Expected 3 datagrams received, got %d", received)
+	}
+}
+
+func benchmarkPacketReader(b *testing.B, newReader func(*net.UDPConn) packetReader) {
+	listener, sender := newLoopbackPair(b)
+	listener.SetReadBuffer(4 << 20)
+	reader := newReader(listener)
+
+	payload := make([]byte, 1400)
+	const burst = 64
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	received := 0
+	for received < b.N {
+		// Queue a burst, then drain it, so the socket buffer never overflows
+		b.StopTimer()
+		pending := burst
+		if b.N-received < pending {
+			pending = b.N - received
+		}
+		for i := 0; i < pending; i++ {
+			sender.Write(payload)
+		}
+		b.StartTimer()
+
+		for pending > 0 {
+			err := reader.ReadPackets(func(data []byte, addr *net.UDPAddr) {
+				pending--
+				received++
+			})
+			if err != nil {
+				b.Fatalf("ReadPackets failed: %v", err)
+			}
+		}
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// BenchmarkPacketReader_Single and BenchmarkPacketReader_Batch compare
+// packets per second for one recvfrom per datagram against recvmmsg
+func BenchmarkPacketReader_Single(b *testing.B) {
+	benchmarkPacketReader(b, func(conn *net.UDPConn) packetReader { return newSingleReader(conn, 1500) })
+}
+
+func BenchmarkPacketReader_Batch(b *testing.B) {
+	benchmarkPacketReader(b, func(conn *net.UDPConn) packetReader { return newBatchReader(conn, readBatchSize, 1500) })
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// rekeyCheckInterval is how often clients are checked for a due rekey.
+// Overridable for tests.
+var rekeyCheckInterval = time.Second
+
+// rekeyClients starts a rekey with each client that agreed to them once its
+// keys are rekeyInterval old or have carried rekeyBytes
+func (s *Server) rekeyClients() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(rekeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, client := range s.clientManager.Snapshot() {
+				if !client.Rekey || !client.Keys.Due(s.rekeyInterval, s.rekeyBytes) {
+					continue
+				}
+
+				err := s.startRekey(&client)
+				if err != nil {
+					log.Printf("Failed to start rekey with client %d: %v", client.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// startRekey sends a client a rekey request with a fresh nonce
+func (s *Server) startRekey(client *Client) error {
+	nonce, err := client.Keys.StartRekey()
+	if err != nil {
+		return err
+	}
+
+	return s.sendRekey(client, protocol.Rekey{Phase: protocol.RekeyRequest, Nonce: nonce})
+}
+
+// handleRekeyPacket takes a client's part in a rekey, whichever side started
+// it. Rekey packets are sealed like data, so forged ones are dropped.
+func (s *Server) handleRekeyPacket(packet *protocol.Packet, clientAddr *net.UDPAddr) {
+	client, err := s.clientManager.GetClient(packet.ClientID)
+	if err != nil {
+		log.Printf("Dropping rekey from %s: %v", clientAddr, err)
+		return
+	}
+	if !client.Rekey {
+		log.Printf("Dropping rekey from client %d, which did not negotiate rekeying", client.ID)
+		return
+	}
+
+	payload, err := client.Keys.Open(client.Cipher, packet.Payload, packet.Sequence)
+	if err != nil {
+		log.Printf("Failed to decrypt rekey from client %d: %v", client.ID, err)
+		return
+	}
+
+	// A replayed request would otherwise leave keys pending that the
+	// client never switches to
+	err = s.clientManager.UpdateControlActivity(client.ID, packet.Sequence)
+	if err != nil {
+		log.Printf("Dropping rekey from client %d: %v", client.ID, err)
+		return
+	}
+
+	rekey, err := protocol.DecodeRekey(payload)
+	if err != nil {
+		log.Printf("Dropping rekey from client %d: %v", client.ID, err)
+		return
+	}
+
+	switch rekey.Phase {
+	case protocol.RekeyRequest:
+		nonce, err := client.Keys.AcceptRekey(client.Key, rekey.Nonce)
+		if err != nil {
+			log.Printf("Failed to accept rekey from client %d: %v", client.ID, err)
+			return
+		}
+		err = s.sendRekey(client, protocol.Rekey{Phase: protocol.RekeyResponse, Nonce: nonce, PeerNonce: rekey.Nonce})
+		if err != nil {
+			log.Printf("Failed to answer rekey from client %d: %v", client.ID, err)
+		}
+	case protocol.RekeyResponse:
+		err := client.Keys.FinishRekey(client.Key, rekey.Nonce, rekey.PeerNonce)
+		if errors.Is(err, crypto.ErrNoRekeyPending) {
+			log.Printf("Ignoring stale rekey response from client %d", client.ID)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to finish rekey with client %d: %v", client.ID, err)
+			return
+		}
+		log.Printf("Rekeyed session with client %d", client.ID)
+
+		err = s.sendRekey(client, protocol.Rekey{Phase: protocol.RekeyConfirm})
+		if err != nil {
+			log.Printf("Failed to confirm rekey with client %d: %v", client.ID, err)
+		}
+	case protocol.RekeyConfirm:
+		// Opening it with the pending keys already switched to them
+		log.Printf("Rekeyed session with client %d", client.ID)
+	}
+}
+
+// sendRekey seals a rekey payload with the client's current keys and sends
+// it, taking a sequence as a data packet would
+func (s *Server) sendRekey(client *Client, rekey protocol.Rekey) error {
+	sequence, err := s.clientManager.NextTxSequence(client.ID)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := client.Keys.Seal(client.Cipher, protocol.EncodeRekey(rekey), sequence)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt rekey: %w", err)
+	}
+
+	packetData, err := protocol.EncodePacket(protocol.CreateRekeyPacket(client.ID, sequence, sealed))
+	if err != nil {
+		return fmt.Errorf("failed to encode rekey: %w", err)
+	}
+
+	clientAddr, err := s.clientManager.GetClientAddr(client.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.transport.WriteTo(packetData, clientAddr)
+	return err
+}
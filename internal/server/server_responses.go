@@ -8,12 +8,16 @@ import (
 	"github.com/pepalonsocosta/fvp/internal/protocol"
 )
 
-func (s *Server) sendAuthResponse(clientID uint8, clientIP string, key []byte, clientAddr *net.UDPAddr) error {
+// sendAuthResponse sends a client its key, or for a pre-shared key proof the
+// server knows it, its IP and handshake options, returning the encoded
+// response so it can be resent to retries
+func (s *Server) sendAuthResponse(clientID uint8, clientIP string, key []byte, options protocol.AuthOptions, clientAddr *net.UDPAddr) ([]byte, error) {
 	// Create response payload with key and IP
-	// Format: [32-byte key][IP string]
-	payload := make([]byte, 32+len(clientIP))
-	copy(payload[:32], key)
-	copy(payload[32:], []byte(clientIP))
+	// Format: [32-byte key or proof][IP string], plus [0][options] when options are set
+	payload, err := protocol.EncodeAuthResponse(key, clientIP, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode auth response: %w", err)
+	}
 	
 	packet := &protocol.Packet{
 		Magic:    [3]byte{'F', 'V', 'P'},
@@ -27,29 +31,24 @@ func (s *Server) sendAuthResponse(clientID uint8, clientIP string, key []byte, c
 	
 	packetData, err := protocol.EncodePacket(packet)
 	if err != nil {
-		return fmt.Errorf("failed to encode auth response: %w", err)
+		return nil, fmt.Errorf("failed to encode auth response: %w", err)
 	}
 	
-	_, err = s.udpConn.WriteToUDP(packetData, clientAddr)
+	_, err = s.transport.WriteTo(packetData, clientAddr)
 	if err != nil {
-		return fmt.Errorf("failed to send auth response: %w", err)
+		return packetData, fmt.Errorf("failed to send auth response: %w", err)
 	}
 	
 	log.Printf("Sent auth response to client %d with IP %s", clientID, clientIP)
-	return nil
+	return packetData, nil
 }
 
 func (s *Server) sendPongResponse(clientID uint8, sequence uint32) error {
-	client, err := s.clientManager.GetClient(clientID)
+	clientAddr, err := s.clientManager.GetClientAddr(clientID)
 	if err != nil {
 		return fmt.Errorf("client not found: %w", err)
 	}
 	
-	clientAddr, err := net.ResolveUDPAddr("udp", client.Address)
-	if err != nil {
-		return fmt.Errorf("invalid client address: %w", err)
-	}
-	
 	packet := &protocol.Packet{
 		Magic:    [3]byte{'F', 'V', 'P'},
 		Type:     protocol.PacketTypePong,
@@ -65,7 +64,7 @@ func (s *Server) sendPongResponse(clientID uint8, sequence uint32) error {
 		return fmt.Errorf("failed to encode pong response: %w", err)
 	}
 	
-	_, err = s.udpConn.WriteToUDP(packetData, clientAddr)
+	_, err = s.transport.WriteTo(packetData, clientAddr)
 	if err != nil {
 		return fmt.Errorf("failed to send pong response: %w", err)
 	}
@@ -73,3 +72,18 @@ func (s *Server) sendPongResponse(clientID uint8, sequence uint32) error {
 	log.Printf("Sent pong response to client %d", clientID)
 	return nil
 }
+
+// sendErrorResponse tells a client why its request was refused, so it can
+// fail fast instead of waiting for a response that never comes
+func (s *Server) sendErrorResponse(clientID uint8, code uint8, message string, clientAddr *net.UDPAddr) {
+	packetData, err := protocol.EncodePacket(protocol.CreateErrorPacket(clientID, code, message))
+	if err != nil {
+		log.Printf("Failed to encode error response: %v", err)
+		return
+	}
+
+	_, err = s.transport.WriteTo(packetData, clientAddr)
+	if err != nil {
+		log.Printf("Failed to send error response to %s: %v", clientAddr, err)
+	}
+}
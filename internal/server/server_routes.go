@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// Errors returned for a malformed push_routes list
+var (
+	ErrInvalidRoute   = errors.New("invalid push route")
+	ErrRouteHostBits  = errors.New("push route has host bits set")
+	ErrDuplicateRoute = errors.New("duplicate push route")
+	ErrTooManyRoutes  = errors.New("too many push routes")
+)
+
+// PushRoute is a network the server advertises to clients as reachable
+// through the tunnel
+type PushRoute struct {
+	Network *net.IPNet
+}
+
+func (r PushRoute) String() string {
+	return r.Network.String()
+}
+
+// ParsePushRoutes parses the push_routes entries of a configuration file.
+// Each must be an IPv4 network in CIDR notation with no host bits set, e.g.
+// "10.10.0.0/16".
+func ParsePushRoutes(cidrs []string) ([]PushRoute, error) {
+	routes := make([]PushRoute, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		ip, network, err := net.ParseCIDR(cidr)
+		if err != nil || network.IP.To4() == nil {
+			return nil, fmt.Errorf("%w %q: must be an IPv4 CIDR", ErrInvalidRoute, cidr)
+		}
+		if !ip.Equal(network.IP) {
+			return nil, fmt.Errorf("%w: %q, did you mean %s?", ErrRouteHostBits, cidr, network)
+		}
+		routes = append(routes, PushRoute{Network: network})
+	}
+
+	err := validatePushRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// validatePushRoutes checks routes given as options, which may not have come
+// through ParsePushRoutes
+func validatePushRoutes(routes []PushRoute) error {
+	if len(routes) > protocol.MaxRoutes {
+		return fmt.Errorf("%w: %d, limit is %d", ErrTooManyRoutes, len(routes), protocol.MaxRoutes)
+	}
+
+	seen := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		if route.Network == nil || route.Network.IP.To4() == nil {
+			return fmt.Errorf("%w %v: must be an IPv4 network", ErrInvalidRoute, route.Network)
+		}
+		if _, bits := route.Network.Mask.Size(); bits != 32 {
+			return fmt.Errorf("%w %s: must be an IPv4 network", ErrInvalidRoute, route)
+		}
+		if !route.Network.IP.Equal(route.Network.IP.Mask(route.Network.Mask)) {
+			return fmt.Errorf("%w: %s", ErrRouteHostBits, route)
+		}
+
+		if seen[route.String()] {
+			return fmt.Errorf("%w: %s", ErrDuplicateRoute, route)
+		}
+		seen[route.String()] = true
+	}
+
+	return nil
+}
+
+// encodePushRoutes returns the AuthOptionRoutes value for routes
+func encodePushRoutes(routes []PushRoute) ([]byte, error) {
+	networks := make([]*net.IPNet, len(routes))
+	for i, route := range routes {
+		networks[i] = route.Network
+	}
+	return protocol.EncodeRoutes(networks)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+func TestParsePushRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		want    []string
+		wantErr error
+	}{
+		{name: "none", cidrs: nil, want: []string{}},
+		{name: "valid", cidrs: []string{"10.10.0.0/16", "192.168.5.0/24", "0.0.0.0/0"}, want: []string{"10.10.0.0/16", "192.168.5.0/24", "0.0.0.0/0"}},
+		{name: "single host", cidrs: []string{"172.16.0.9/32"}, want: []string{"172.16.0.9/32"}},
+		{name: "not a CIDR", cidrs: []string{"10.10.0.0"}, wantErr: ErrInvalidRoute},
+		{name: "garbage", cidrs: []string{"ten.ten/16"}, wantErr: ErrInvalidRoute},
+		{name: "prefix too long", cidrs: []string{"10.10.0.0/33"}, wantErr: ErrInvalidRoute},
+		{name: "IPv6", cidrs: []string{"fd00::/64"}, wantErr: ErrInvalidRoute},
+		{name: "host bits set", cidrs: []string{"10.10.0.5/16"}, wantErr: ErrRouteHostBits},
+		{name: "duplicate", cidrs: []string{"10.10.0.0/16", "10.10.0.0/16"}, wantErr: ErrDuplicateRoute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := ParsePushRoutes(tt.cidrs)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePushRoutes failed: %v", err)
+			}
+
+			got := make([]string, len(routes))
+			for i, route := range routes {
+				got[i] = route.String()
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected routes %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidatePushRoutes_Options(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.10.0.0/16")
+
+	tooMany := make([]PushRoute, protocol.MaxRoutes+1)
+	for i := range tooMany {
+		tooMany[i] = PushRoute{Network: &net.IPNet{IP: net.IPv4(10, byte(i), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}}
+	}
+
+	tests := []struct {
+		name    string
+		routes  []PushRoute
+		wantErr error
+	}{
+		{name: "nil network", routes: []PushRoute{{}}, wantErr: ErrInvalidRoute},
+		{name: "host bits set", routes: []PushRoute{{Network: &net.IPNet{IP: net.IPv4(10, 10, 0, 5).To4(), Mask: network.Mask}}}, wantErr: ErrRouteHostBits},
+		{name: "duplicate", routes: []PushRoute{{Network: network}, {Network: network}}, wantErr: ErrDuplicateRoute},
+		{name: "too many", routes: tooMany, wantErr: ErrTooManyRoutes},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServerWithOptions(ServerOptions{PushRoutes: tt.routes})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadServerOptions_PushRoutes(t *testing.T) {
+	dir := t.TempDir()
+	load := func(routes string) (ServerOptions, error) {
+		configPath := filepath.Join(dir, "server.yaml")
+		config := "server:\n  push_routes: " + routes + "\nclients: []\n"
+		err := os.WriteFile(configPath, []byte(config), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		return LoadServerOptions(configPath)
+	}
+
+	opts, err := load("[10.10.0.0/16, 192.168.5.0/24]")
+	if err != nil {
+		t.Fatalf("LoadServerOptions failed: %v", err)
+	}
+	if len(opts.PushRoutes) != 2 || opts.PushRoutes[0].String() != "10.10.0.0/16" || opts.PushRoutes[1].String() != "192.168.5.0/24" {
+		t.Errorf("Expected routes 10.10.0.0/16 and 192.168.5.0/24, got %v", opts.PushRoutes)
+	}
+
+	_, err = load("[10.10.0.0/16, 10.10.0.300/16]")
+	if !errors.Is(err, ErrInvalidRoute) {
+		t.Errorf("Expected ErrInvalidRoute, got %v", err)
+	}
+}
+
+func TestPushRoutes_DeliveredToClient(t *testing.T) {
+	routes, err := ParsePushRoutes([]string{"10.10.0.0/16", "192.168.5.0/24"})
+	if err != nil {
+		t.Fatalf("ParsePushRoutes failed: %v", err)
+	}
+
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:       "127.0.0.1:0",
+		PushRoutes: routes,
+		TUN:        network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	got := vpnClient.GetRoutes()
+	if len(got) != 2 || got[0].String() != "10.10.0.0/16" || got[1].String() != "192.168.5.0/24" {
+		t.Errorf("Expected routes 10.10.0.0/16 and 192.168.5.0/24, got %v", got)
+	}
+}
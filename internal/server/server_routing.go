@@ -1,7 +1,13 @@
 package server
 
 import (
+	"errors"
 	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
 )
 
 func (s *Server) routePackets() {
@@ -11,20 +17,38 @@ func (s *Server) routePackets() {
 		select {
 		case <-s.stopChan:
 			return
+		case <-s.ctx.Done():
+			return
 		default:
-			_, err := s.tunInterface.ReadPacket()
+			packetData, err := s.tunInterface.ReadPacket()
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EBADF) {
+				// Expected while stopping; otherwise nothing more can be read
+				select {
+				case <-s.stopChan:
+				default:
+					log.Printf("TUN interface closed, no longer routing packets to clients: %v", err)
+				}
+				return
+			}
 			if err != nil {
-				log.Printf("TUN read error: %v", err)
+				if !errors.Is(err, network.ErrNoPacket) {
+					s.logError(&s.tunReadLog, "Failed to read from TUN interface: %v", err)
+				}
+				// Back off briefly so a TUN without pending packets doesn't spin
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if len(packetData) == 0 {
 				continue
 			}
 			
-			s.processOutgoingPacket()
+			s.processOutgoingPacket(packetData)
 		}
 	}
 }
 
-func (s *Server) processOutgoingPacket() {
-	err := s.packetProcessor.ProcessOutgoingPacket()
+func (s *Server) processOutgoingPacket(packetData []byte) {
+	err := s.packetProcessor.RoutePacket(packetData)
 	if err != nil {
 		log.Printf("Packet processing error: %v", err)
 	}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// trafficTotals sums the traffic counters of the clients connected at one
+// moment
+type trafficTotals struct {
+	clients   int
+	packetsRx uint64
+	packetsTx uint64
+	bytesRx   uint64
+	bytesTx   uint64
+}
+
+// ResetStats sets the server's packet counters and every client's traffic
+// counters back to zero, without disturbing any client session
+func (s *Server) ResetStats() {
+	s.received.Store(0)
+	s.oversized.Store(0)
+	s.badNetworkMAC.Store(0)
+	s.banned.Store(0)
+	s.malformed.Store(0)
+	s.readErrors.Store(0)
+	if s.packetProcessor != nil {
+		s.packetProcessor.ResetCounters()
+	}
+	if s.clientManager != nil {
+		s.clientManager.ResetCounters()
+	}
+	log.Printf("Traffic counters reset")
+}
+
+// trafficTotals adds up the traffic counters of the current clients
+func (s *Server) trafficTotals() trafficTotals {
+	var totals trafficTotals
+	if s.clientManager == nil {
+		return totals
+	}
+
+	for _, client := range s.clientManager.Snapshot() {
+		totals.clients++
+		totals.packetsRx += client.PacketsRx
+		totals.packetsTx += client.PacketsTx
+		totals.bytesRx += client.BytesRx
+		totals.bytesTx += client.BytesTx
+	}
+	return totals
+}
+
+// logStats logs a summary of the traffic every statsInterval until the
+// server stops
+func (s *Server) logStats() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.statsInterval)
+	defer ticker.Stop()
+
+	previous := s.trafficTotals()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			current := s.trafficTotals()
+			seconds := s.statsInterval.Seconds()
+			log.Printf("Stats: %d clients, in %.1f pps %d bytes, out %.1f pps %d bytes over the last %s",
+				current.clients,
+				float64(counterDelta(current.packetsRx, previous.packetsRx))/seconds,
+				counterDelta(current.bytesRx, previous.bytesRx),
+				float64(counterDelta(current.packetsTx, previous.packetsTx))/seconds,
+				counterDelta(current.bytesTx, previous.bytesTx),
+				s.statsInterval)
+			previous = current
+		}
+	}
+}
+
+// counterDelta returns how far a counter moved. A counter that went down was
+// reset, or lost a client's share when it left, so it counts from zero.
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
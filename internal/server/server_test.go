@@ -1,13 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pepalonsocosta/fvp/internal/client"
 	"github.com/pepalonsocosta/fvp/internal/crypto"
 	"github.com/pepalonsocosta/fvp/internal/network"
 	"github.com/pepalonsocosta/fvp/internal/protocol"
+	"golang.org/x/net/ipv4"
 )
 
 // TestNewServer tests server creation
@@ -85,7 +94,7 @@ func TestCreatePacketProcessor(t *testing.T) {
 	// Set up dependencies
 	server.tunInterface = network.NewMockTunManager()
 	server.keyManager = crypto.NewKeyManager()
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	
 	// Create UDP server first
 	err := server.CreateUDPServer(":0")
@@ -139,7 +148,7 @@ func TestSendAuthResponse(t *testing.T) {
 		t.Fatalf("Failed to resolve test address: %v", err)
 	}
 	
-	err = server.sendAuthResponse(1, "10.0.0.2", []byte("test-key-32-bytes-long-key-here"), clientAddr)
+	_, err = server.sendAuthResponse(1, "10.0.0.2", []byte("test-key-32-bytes-long-key-here"), nil, clientAddr)
 	if err != nil {
 		t.Errorf("Expected no error, got: %v", err)
 	}
@@ -151,7 +160,7 @@ func TestSendPongResponse(t *testing.T) {
 	
 	// Set up dependencies
 	server.keyManager = crypto.NewKeyManager()
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	
 	// Create UDP server
 	err := server.CreateUDPServer(":0")
@@ -186,9 +195,9 @@ func TestProcessClientPacket(t *testing.T) {
 	copy(key1, "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456")
 	server.keyManager.SetTestKey(1, key1)
 	
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	server.tunInterface = network.NewMockTunManager()
-	server.packetProcessor = NewPacketProcessor(server.tunInterface, server.keyManager, server.clientManager, server.udpConn)
+	server.packetProcessor = NewPacketProcessor(server.tunInterface, server.keyManager, server.clientManager, server.transport)
 	
 	// Create UDP server for sending responses
 	err := server.CreateUDPServer(":0")
@@ -198,15 +207,7 @@ func TestProcessClientPacket(t *testing.T) {
 	defer server.udpConn.Close()
 	
 	// Create test packet
-	packet := &protocol.Packet{
-		Magic:    [3]byte{'F', 'V', 'P'},
-		Type:     protocol.PacketTypeAuth,
-		ClientID: 1,
-		Sequence: 0,
-		Length:   0,
-		Version:  1,
-		Payload:  []byte{},
-	}
+	packet := protocol.CreateAuthPacket(1, 0, provenAuthOptions(t, key1, 1, time.Now()))
 	
 	// Encode packet
 	packetData, err := protocol.EncodePacket(packet)
@@ -246,7 +247,7 @@ func TestHandleAuthPacket(t *testing.T) {
 	copy(key1, "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456")
 	server.keyManager.SetTestKey(1, key1)
 	
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	
 	// Create UDP server
 	err := server.CreateUDPServer(":0")
@@ -261,9 +262,8 @@ func TestHandleAuthPacket(t *testing.T) {
 		Type:     protocol.PacketTypeAuth,
 		ClientID: 1,
 		Sequence: 0,
-		Length:   0,
 		Version:  1,
-		Payload:  []byte{},
+		Payload:  provenAuthOptions(t, key1, 1, time.Now()),
 	}
 	
 	// Create test address
@@ -286,15 +286,107 @@ func TestHandleAuthPacket(t *testing.T) {
 	}
 }
 
+// provenAuthOptions returns the auth options of a request from clientID with
+// a fresh nonce, proving key at the given time. A nil key sends no proof.
+func provenAuthOptions(t *testing.T, key []byte, clientID uint8, at time.Time) []byte {
+	t.Helper()
+	nonce, err := crypto.GenerateSessionNonce()
+	if err != nil {
+		t.Fatalf("GenerateSessionNonce failed: %v", err)
+	}
+	options := protocol.AuthOptions{protocol.AuthOptionClientNonce: nonce}
+	if key != nil {
+		unsigned, _ := protocol.EncodeAuthOptions(options)
+		options[protocol.AuthOptionProof] = protocol.SignAuthProof(key, clientID, at, unsigned)
+	}
+	encoded, err := protocol.EncodeAuthOptions(options)
+	if err != nil {
+		t.Fatalf("EncodeAuthOptions failed: %v", err)
+	}
+	return encoded
+}
+
+// TestHandleAuthPacket_UnprovenReauthKeepsSession tests that an auth request
+// for a configured client must prove the key, and only takes over a live
+// session with a newer proof, so spoofed or replayed requests can't redirect
+// it
+func TestHandleAuthPacket_UnprovenReauthKeepsSession(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 32)
+	server, err := NewServerWithOptions(ServerOptions{ClientKeys: map[uint8][]byte{1: key}})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	server.clientManager = NewClientManager(server.keyManager, nil)
+
+	err = server.CreateUDPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create UDP server: %v", err)
+	}
+	defer server.udpConn.Close()
+
+	authRequest := func(proofKey []byte, at time.Time) *protocol.Packet {
+		return protocol.CreateAuthPacket(1, 1, provenAuthOptions(t, proofKey, 1, at))
+	}
+
+	clientAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+	spoofedAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:23456")
+
+	// Without a proof, not even a client with no session is let in, or
+	// anyone could start one under its ID
+	server.handleAuthPacket(authRequest(nil, time.Time{}), spoofedAddr)
+	if _, err := server.clientManager.GetClient(1); err == nil {
+		t.Fatal("Expected an auth request without proof to be refused")
+	}
+
+	connectedAt := time.Now()
+	legitimate := authRequest(key, connectedAt)
+	server.handleAuthPacket(legitimate, clientAddr)
+	session, err := server.clientManager.GetClient(1)
+	if err != nil {
+		t.Fatalf("Expected client to be added, got error: %v", err)
+	}
+
+	attempts := []struct {
+		name   string
+		packet *protocol.Packet
+	}{
+		{"no proof", authRequest(nil, time.Time{})},
+		{"proof with another key", authRequest(bytes.Repeat([]byte{0x22}, 32), connectedAt.Add(time.Second))},
+		{"replayed request", legitimate},
+		{"older proof", authRequest(key, connectedAt.Add(-time.Second))},
+	}
+	for _, attempt := range attempts {
+		server.handleAuthPacket(attempt.packet, spoofedAddr)
+
+		client, err := server.clientManager.GetClient(1)
+		if err != nil || client != session {
+			t.Errorf("%s: Expected the existing session to be kept, got %+v (%v)", attempt.name, client, err)
+		}
+		if owner, err := server.clientManager.GetClientByAddress(clientAddr.String()); err != nil || owner.ID != 1 {
+			t.Errorf("%s: Expected %s to still belong to client 1, got %v", attempt.name, clientAddr, err)
+		}
+		if _, err := server.clientManager.GetClientByAddress(spoofedAddr.String()); err == nil {
+			t.Errorf("%s: Expected %s not to be tied to any client", attempt.name, spoofedAddr)
+		}
+	}
+
+	// The client itself, restarted, proves the key with a newer request
+	server.handleAuthPacket(authRequest(key, connectedAt.Add(time.Second)), spoofedAddr)
+	client, err := server.clientManager.GetClient(1)
+	if err != nil || client == session || client.Address != spoofedAddr.String() {
+		t.Errorf("Expected a new session from %s, got %+v (%v)", spoofedAddr, client, err)
+	}
+}
+
 // TestHandleDataPacket tests data packet handling
 func TestHandleDataPacket(t *testing.T) {
 	server := NewServer()
 	
 	// Set up dependencies
 	server.keyManager = crypto.NewKeyManager()
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	server.tunInterface = network.NewMockTunManager()
-	server.packetProcessor = NewPacketProcessor(server.tunInterface, server.keyManager, server.clientManager, server.udpConn)
+	server.packetProcessor = NewPacketProcessor(server.tunInterface, server.keyManager, server.clientManager, server.transport)
 	
 	// Create test packet
 	packet := &protocol.Packet{
@@ -326,7 +418,7 @@ func TestHandlePingPacket(t *testing.T) {
 	
 	// Set up dependencies
 	server.keyManager = crypto.NewKeyManager()
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	
 	// Create UDP server
 	err := server.CreateUDPServer(":0")
@@ -341,16 +433,21 @@ func TestHandlePingPacket(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to add test client: %v", err)
 	}
+	setTestSession(t, server.clientManager, client)
 	
-	// Create test packet
+	// Create test packet, sealed like data
+	sealed, err := encryptFromClient([]byte{}, key, 123)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
 	packet := &protocol.Packet{
 		Magic:    [3]byte{'F', 'V', 'P'},
 		Type:     protocol.PacketTypePing,
 		ClientID: client.ID,
 		Sequence: 123,
-		Length:   0,
+		Length:   uint16(len(sealed)),
 		Version:  1,
-		Payload:  []byte{},
+		Payload:  sealed,
 	}
 	
 	// Create test address
@@ -368,8 +465,8 @@ func TestHandlePingPacket(t *testing.T) {
 		t.Errorf("Expected client to exist, got error: %v", err)
 	}
 	
-	if updatedClient.LastSeq != 123 {
-		t.Errorf("Expected LastSeq to be 123, got %d", updatedClient.LastSeq)
+	if updatedClient.RxSeq != 123 {
+		t.Errorf("Expected RxSeq to be 123, got %d", updatedClient.RxSeq)
 	}
 }
 
@@ -379,7 +476,7 @@ func TestHandlePongPacket(t *testing.T) {
 	
 	// Set up dependencies
 	server.keyManager = crypto.NewKeyManager()
-	server.clientManager = NewClientManager(server.keyManager)
+	server.clientManager = NewClientManager(server.keyManager, nil)
 	
 	// Add a test client first
 	key := make([]byte, 32)
@@ -387,16 +484,21 @@ func TestHandlePongPacket(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to add test client: %v", err)
 	}
+	setTestSession(t, server.clientManager, client)
 	
-	// Create test packet
+	// Create test packet, sealed like data
+	sealed, err := encryptFromClient([]byte{}, key, 456)
+	if err != nil {
+		t.Fatalf("Failed to encrypt payload: %v", err)
+	}
 	packet := &protocol.Packet{
 		Magic:    [3]byte{'F', 'V', 'P'},
 		Type:     protocol.PacketTypePong,
 		ClientID: client.ID,
 		Sequence: 456,
-		Length:   0,
+		Length:   uint16(len(sealed)),
 		Version:  1,
-		Payload:  []byte{},
+		Payload:  sealed,
 	}
 	
 	// Create test address
@@ -414,8 +516,8 @@ func TestHandlePongPacket(t *testing.T) {
 		t.Errorf("Expected client to exist, got error: %v", err)
 	}
 	
-	if updatedClient.LastSeq != 456 {
-		t.Errorf("Expected LastSeq to be 456, got %d", updatedClient.LastSeq)
+	if updatedClient.RxSeq != 456 {
+		t.Errorf("Expected RxSeq to be 456, got %d", updatedClient.RxSeq)
 	}
 }
 
@@ -433,16 +535,74 @@ func TestProcessOutgoingPacket(t *testing.T) {
 	
 	server.tunInterface = mockTUN
 	server.keyManager = crypto.NewKeyManager()
-	server.clientManager = NewClientManager(server.keyManager)
-	server.packetProcessor = NewPacketProcessor(server.tunInterface, server.keyManager, server.clientManager, server.udpConn)
+	server.clientManager = NewClientManager(server.keyManager, nil)
+	server.packetProcessor = NewPacketProcessor(server.tunInterface, server.keyManager, server.clientManager, server.transport)
 	
-	// Test processing outgoing packet
-	server.processOutgoingPacket()
+	// Test processing outgoing packet for an unknown client
+	server.processOutgoingPacket(createMockIPPacket("8.8.8.8", "10.0.0.2", []byte("test data")))
 	
 	// Note: This test just verifies the function doesn't panic
 	// The actual packet processing is tested in packet_processor_test.go
 }
 
+// closedReadTun is a TUN interface whose reads all fail with err
+type closedReadTun struct {
+	*network.MockTunManager
+	err error
+}
+
+func (ct *closedReadTun) ReadPacket() ([]byte, error) {
+	return nil, ct.err
+}
+
+// TestRoutePackets_ReadErrors tests that the TUN read loop stops once the
+// interface is closed, and logs other read errors at most once a second
+// rather than spinning silently
+func TestRoutePackets_ReadErrors(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	server := NewServer()
+	server.tunInterface = &closedReadTun{
+		MockTunManager: network.NewMockTunManager(),
+		err:            &os.PathError{Op: "read", Path: "/dev/net/tun", Err: os.ErrClosed},
+	}
+
+	done := make(chan struct{})
+	server.wg.Add(1)
+	go func() {
+		server.routePackets()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the read loop to stop once the TUN interface is closed")
+	}
+	if !strings.Contains(output.String(), "TUN interface closed") {
+		t.Errorf("Expected the closed interface to be logged, got %q", output.String())
+	}
+
+	output.Reset()
+	server.tunInterface = &closedReadTun{
+		MockTunManager: network.NewMockTunManager(),
+		err:            errors.New("device broken"),
+	}
+	server.wg.Add(1)
+	go server.routePackets()
+	time.Sleep(200 * time.Millisecond)
+	close(server.stopChan)
+	server.wg.Wait()
+
+	if lines := strings.Count(output.String(), "\n"); lines != 1 {
+		t.Errorf("Expected 1 line logged for repeated read errors, got %d:\n%s", lines, output.String())
+	}
+	if !strings.Contains(output.String(), "device broken") {
+		t.Errorf("Expected the read error to be logged, got %q", output.String())
+	}
+}
+
 // TestStop tests server shutdown
 func TestStop(t *testing.T) {
 	// Test stopping server without connections
@@ -465,3 +625,843 @@ func TestStop(t *testing.T) {
 		t.Errorf("Expected no error, got: %v", err)
 	}
 }
+
+// TestServeContext_Cancel tests that cancelling the context a server was
+// started with stops its goroutines and closes its socket
+func TestServeContext_Cancel(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:          "127.0.0.1:0",
+		StatsInterval: time.Minute,
+		TUN:           network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = server.ServeContext(ctx)
+	if err != nil {
+		t.Fatalf("ServeContext failed: %v", err)
+	}
+	addr := server.GetAddr().String()
+
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server's goroutines to exit after cancelling the context")
+	}
+
+	// Stop finishes closing the socket after the goroutines exit
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.ListenPacket("udp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the socket on %s to be closed, got %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := server.GetServerStatus().Status; status != "stopped" {
+		t.Errorf("Expected status stopped, got %s", status)
+	}
+
+	// Stopping again must not hang or panic
+	err = server.Stop()
+	if err != nil {
+		t.Errorf("Expected no error stopping again, got %v", err)
+	}
+}
+
+// TestHandleAuthPacket_NegotiatesVersion tests that a newer client is downgraded to the server version
+func TestHandleAuthPacket_NegotiatesVersion(t *testing.T) {
+	// The server speaks 1.0.0 while the client advertises 1.2.0
+	err := protocol.InitProtocolVersion("1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to init protocol version: %v", err)
+	}
+
+	server := NewServer()
+	server.keyManager = crypto.NewKeyManager()
+	server.clientManager = NewClientManager(server.keyManager, nil)
+
+	err = server.CreateUDPServer(":0")
+	if err != nil {
+		t.Fatalf("Failed to create UDP server: %v", err)
+	}
+	defer server.udpConn.Close()
+
+	packet := protocol.CreateAuthPacket(0, 1, provenAuthOptions(t, nil, 0, time.Time{}))
+	packet.Version = protocol.EncodeVersion(1, 2, 0)
+
+	clientAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to resolve test address: %v", err)
+	}
+
+	server.handleAuthPacket(packet, clientAddr)
+
+	client, err := server.clientManager.GetClient(1)
+	if err != nil {
+		t.Fatalf("Expected client to be added, got error: %v", err)
+	}
+
+	if client.Version != protocol.EncodeVersion(1, 0, 0) {
+		t.Errorf("Expected negotiated version 1.0.0, got %s", protocol.FormatVersion(client.Version))
+	}
+
+	if protocol.VersionAtLeast(client.Version, 1, 2, 0) {
+		t.Error("Server should not use 1.2 features with a client negotiated down to 1.0.0")
+	}
+}
+
+// TestNewServerWithOptions tests creating a server from in-memory options
+func TestNewServerWithOptions(t *testing.T) {
+	key := make([]byte, 32)
+	mockTUN := network.NewMockTunManager()
+
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:       "127.0.0.1:0",
+		Timeout:    5 * time.Minute,
+		Subnet:     "10.8.0.0/24",
+		ClientKeys: map[uint8][]byte{1: key},
+		TUN:        mockTUN,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	if server.timeout != 5*time.Minute {
+		t.Errorf("Expected timeout 5 minutes, got %v", server.timeout)
+	}
+
+	if server.subnet.String() != "10.8.0.0/24" {
+		t.Errorf("Expected subnet 10.8.0.0/24, got %s", server.subnet)
+	}
+
+	if !server.keyManager.HasClient(1) {
+		t.Error("Expected client 1 key to be loaded")
+	}
+
+	if server.tunInterface != mockTUN {
+		t.Error("Expected injected TUN interface to be used")
+	}
+
+	// Test invalid options
+	_, err = NewServerWithOptions(ServerOptions{Subnet: "not-a-subnet"})
+	if err == nil {
+		t.Error("Expected error for invalid subnet")
+	}
+
+	_, err = NewServerWithOptions(ServerOptions{ClientKeys: map[uint8][]byte{1: make([]byte, 16)}})
+	if err == nil {
+		t.Error("Expected error for short client key")
+	}
+
+	_, err = NewServerWithOptions(ServerOptions{Transport: network.NewMockTransport()})
+	if err == nil {
+		t.Error("Expected error for a transport without read deadlines")
+	}
+}
+
+// TestLoadServerOptions tests reading options from a config file
+func TestLoadServerOptions(t *testing.T) {
+	opts, err := LoadServerOptions("../../server.example.yaml")
+	if err != nil {
+		t.Fatalf("LoadServerOptions failed: %v", err)
+	}
+
+	if len(opts.ClientKeys) != 3 {
+		t.Errorf("Expected 3 client keys, got %d", len(opts.ClientKeys))
+	}
+
+	_, err = LoadServerOptions("nonexistent.yaml")
+	if err == nil {
+		t.Error("Expected error for non-existent config file")
+	}
+}
+
+// TestLoadServerOptions_AllowedIPs tests parsing per-client allowed networks
+func TestLoadServerOptions_AllowedIPs(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	config := "clients:\n  - id: 2\n    key: \"a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456\"\n    allowed_ips: [\"192.168.50.0/24\", \"10.20.0.0/16\"]\n"
+	err := os.WriteFile(configPath, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	opts, err := LoadServerOptions(configPath)
+	if err != nil {
+		t.Fatalf("LoadServerOptions failed: %v", err)
+	}
+
+	allowed := opts.AllowedIPs[2]
+	if len(allowed) != 2 || allowed[0].String() != "192.168.50.0/24" || allowed[1].String() != "10.20.0.0/16" {
+		t.Errorf("Expected allowed networks 192.168.50.0/24 and 10.20.0.0/16, got %v", allowed)
+	}
+}
+
+// TestLoadServerOptions_ReservedIPs tests parsing per-client tunnel addresses
+func TestLoadServerOptions_ReservedIPs(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	config := "clients:\n  - id: 2\n    key: \"a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456\"\n    ip: 10.0.0.20\n  - id: 3\n    key: \"a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456\"\n"
+	err := os.WriteFile(configPath, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	opts, err := LoadServerOptions(configPath)
+	if err != nil {
+		t.Fatalf("LoadServerOptions failed: %v", err)
+	}
+
+	if len(opts.ReservedIPs) != 1 || opts.ReservedIPs[2] != "10.0.0.20" {
+		t.Errorf("Expected client 2 reserved at 10.0.0.20, got %v", opts.ReservedIPs)
+	}
+}
+
+// TestLoadServerOptions_ClientsDir tests that clients listed in clients.d
+// files are merged with the config file's, settings and all
+func TestLoadServerOptions_ClientsDir(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "server.yaml")
+	config := "clients:\n  - id: 2\n    key: \"a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456\"\n"
+	err := os.WriteFile(configPath, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	err = os.Mkdir(filepath.Join(dir, "clients.d"), 0700)
+	if err != nil {
+		t.Fatalf("Failed to create clients.d: %v", err)
+	}
+	clientFile := "clients:\n  - id: 3\n    key: \"a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456\"\n    ip: 10.0.0.30\n"
+	err = os.WriteFile(filepath.Join(dir, "clients.d", "client-3.yaml"), []byte(clientFile), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write client file: %v", err)
+	}
+
+	opts, err := LoadServerOptions(configPath)
+	if err != nil {
+		t.Fatalf("LoadServerOptions failed: %v", err)
+	}
+	if len(opts.ClientKeys) != 2 || opts.ClientKeys[3] == nil {
+		t.Errorf("Expected clients 2 and 3, got %d keys", len(opts.ClientKeys))
+	}
+	if opts.ReservedIPs[3] != "10.0.0.30" {
+		t.Errorf("Expected client 3 reserved at 10.0.0.30, got %v", opts.ReservedIPs)
+	}
+
+	// The same ID in both is an error, as it would be within one file
+	err = os.WriteFile(filepath.Join(dir, "clients.d", "client-2.yaml"), []byte(config), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write client file: %v", err)
+	}
+	_, err = LoadServerOptions(configPath)
+	if err == nil || !strings.Contains(err.Error(), "duplicate client ID 2") {
+		t.Errorf("Expected a duplicate client ID error, got %v", err)
+	}
+}
+
+// TestServeWithOptions tests running an embedded server without files or root
+func TestServeWithOptions(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:   "127.0.0.1:0",
+		Subnet: "10.8.0.0/24",
+		TUN:    network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	if server.GetServerStatus().Status != "running" {
+		t.Errorf("Expected server to be running")
+	}
+
+	// A client assigned by the server gets an address from the configured subnet
+	vpnClient := client.NewClientWithTUN(server.GetAddr().String(), network.NewMockTunManager())
+	err = vpnClient.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer vpnClient.Disconnect()
+
+	if vpnClient.GetAssignedIP() != "10.8.0.2" {
+		t.Errorf("Expected IP 10.8.0.2, got %s", vpnClient.GetAssignedIP())
+	}
+}
+
+// TestHandleAuthPacket_SelectsCipher tests cipher selection against the client's offer
+func TestHandleAuthPacket_SelectsCipher(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		expected uint8
+	}{
+		{"offered", []byte{protocol.AuthOptionCiphers, 2, crypto.CipherChaCha20Poly1305, crypto.CipherAES256GCM}, crypto.CipherAES256GCM},
+		{"not offered", []byte{protocol.AuthOptionCiphers, 1, crypto.CipherChaCha20Poly1305}, crypto.CipherChaCha20Poly1305},
+		{"no offer", []byte{}, crypto.CipherChaCha20Poly1305},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewServerWithOptions(ServerOptions{Cipher: "aes-256-gcm"})
+			if err != nil {
+				t.Fatalf("NewServerWithOptions failed: %v", err)
+			}
+			server.clientManager = NewClientManager(server.keyManager, nil)
+
+			err = server.CreateUDPServer("127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create UDP server: %v", err)
+			}
+			defer server.udpConn.Close()
+
+			payload := append(tt.payload, provenAuthOptions(t, nil, 0, time.Time{})...)
+			packet := protocol.CreateAuthPacket(0, 1, payload)
+			clientAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+			if err != nil {
+				t.Fatalf("Failed to resolve test address: %v", err)
+			}
+
+			server.handleAuthPacket(packet, clientAddr)
+
+			client, err := server.clientManager.GetClient(1)
+			if err != nil {
+				t.Fatalf("Expected client to be added, got error: %v", err)
+			}
+
+			if client.Cipher.ID() != tt.expected {
+				t.Errorf("Expected cipher %d, got %s", tt.expected, client.Cipher.Name())
+			}
+		})
+	}
+
+	_, err := NewServerWithOptions(ServerOptions{Cipher: "rot13"})
+	if err == nil {
+		t.Error("Expected error for unsupported cipher")
+	}
+}
+
+// TestHandleAuthPacket_DerivesSessionKeys tests that a client nonce yields fresh session keys
+func TestHandleAuthPacket_DerivesSessionKeys(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	server.clientManager = NewClientManager(server.keyManager, nil)
+
+	err = server.CreateUDPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create UDP server: %v", err)
+	}
+	defer server.udpConn.Close()
+
+	clientNonce := make([]byte, crypto.SessionNonceSize)
+	options, err := protocol.EncodeAuthOptions(protocol.AuthOptions{protocol.AuthOptionClientNonce: clientNonce})
+	if err != nil {
+		t.Fatalf("EncodeAuthOptions failed: %v", err)
+	}
+
+	clientAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to resolve test address: %v", err)
+	}
+
+	server.handleAuthPacket(protocol.CreateAuthPacket(0, 1, options), clientAddr)
+
+	client, err := server.clientManager.GetClient(1)
+	if err != nil {
+		t.Fatalf("Expected client to be added, got error: %v", err)
+	}
+
+	session := client.Keys.Keys()
+	if bytes.Equal(session.ClientToServer, client.Key) || bytes.Equal(session.ServerToClient, client.Key) {
+		t.Error("Expected derived session keys, got the raw client key")
+	}
+	if bytes.Equal(session.ClientToServer, session.ServerToClient) {
+		t.Error("Expected distinct keys per direction")
+	}
+
+	// A malformed nonce rejects the client instead of falling back
+	badOptions, _ := protocol.EncodeAuthOptions(protocol.AuthOptions{protocol.AuthOptionClientNonce: {1, 2, 3}})
+	otherAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:12346")
+	server.handleAuthPacket(protocol.CreateAuthPacket(0, 1, badOptions), otherAddr)
+
+	if len(server.clientManager.ListClients()) != 1 {
+		t.Errorf("Expected 1 client after bad nonce, got %d", len(server.clientManager.ListClients()))
+	}
+}
+
+// TestHandleAuthPacket_PreSharedKeyNotSent tests that a client with a
+// pre-shared key is sent proof that the server knows it, not the key itself
+func TestHandleAuthPacket_PreSharedKeyNotSent(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 32)
+	server, err := NewServerWithOptions(ServerOptions{ClientKeys: map[uint8][]byte{1: key}})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	server.clientManager = NewClientManager(server.keyManager, nil)
+	transport := network.NewMockTransport()
+	server.transport = transport
+
+	request := provenAuthOptions(t, key, 1, time.Now())
+	clientAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+	server.handleAuthPacket(protocol.CreateAuthPacket(1, 1, request), clientAddr)
+
+	sent := transport.GetSent()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 auth response, got %d", len(sent))
+	}
+	packet, err := protocol.DecodePacket(sent[0].Data)
+	if err != nil || packet.Type != protocol.PacketTypeAuth {
+		t.Fatalf("Expected an auth response, got %+v (%v)", packet, err)
+	}
+	if bytes.Contains(packet.Payload, key) {
+		t.Error("Expected the response not to contain the pre-shared key")
+	}
+	sentKey, _, _, err := protocol.DecodeAuthResponse(packet.Payload)
+	if err != nil {
+		t.Fatalf("DecodeAuthResponse failed: %v", err)
+	}
+	if !bytes.Equal(sentKey, protocol.AuthResponseProof(key, request)) {
+		t.Errorf("Expected the key field to prove the key over the request, got %x", sentKey)
+	}
+}
+
+// TestHandleAuthPacket_GeneratedKey tests that a client asking for an ID is
+// given a key read from the server's random source
+func TestHandleAuthPacket_GeneratedKey(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	server.clientManager = NewClientManager(server.keyManager, nil)
+
+	seed := make([]byte, 64)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	server.random = bytes.NewReader(seed)
+
+	err = server.CreateUDPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create UDP server: %v", err)
+	}
+	defer server.udpConn.Close()
+
+	clientAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:12345")
+	if err != nil {
+		t.Fatalf("Failed to resolve test address: %v", err)
+	}
+
+	server.handleAuthPacket(protocol.CreateAuthPacket(0, 1, provenAuthOptions(t, nil, 0, time.Time{})), clientAddr)
+
+	client, err := server.clientManager.GetClient(1)
+	if err != nil {
+		t.Fatalf("Expected client to be added, got error: %v", err)
+	}
+	if !bytes.Equal(client.Key, seed[:32]) {
+		t.Errorf("Expected key %x, got %x", seed[:32], client.Key)
+	}
+
+	// A source that runs dry rejects the client rather than handing out a
+	// short key
+	server.random = bytes.NewReader(seed[:16])
+	otherAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:12346")
+	server.handleAuthPacket(protocol.CreateAuthPacket(0, 1, provenAuthOptions(t, nil, 0, time.Time{})), otherAddr)
+
+	if len(server.clientManager.ListClients()) != 1 {
+		t.Errorf("Expected 1 client after the source ran out, got %d", len(server.clientManager.ListClients()))
+	}
+}
+
+// TestLoadConfig_Validation tests that invalid settings are rejected at load time
+func TestLoadConfig_Validation(t *testing.T) {
+	validKey := "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456"
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"negative timeout", "server:\n  port: \":1194\"\n  timeout_minutes: -1\n"},
+		{"non-numeric port", "server:\n  port: \"invalid_port\"\n  timeout_minutes: 30\n"},
+		{"port out of range", "server:\n  port: \"70000\"\n  timeout_minutes: 30\n"},
+		{"invalid hex key", "clients:\n  - id: 1\n    key: \"invalid_key\"\n"},
+		{"short key", "clients:\n  - id: 1\n    key: \"a1b2c3\"\n"},
+		{"mtu too small", "server:\n  mtu: 100\n"},
+		{"mtu too large for a datagram", "server:\n  mtu: 65500\n"},
+		{"negative stats interval", "server:\n  stats_interval: -1m\n"},
+		{"negative key grace period", "server:\n  key_grace_period: -1m\n"},
+		{"dscp too large", "server:\n  dscp: 64\n"},
+		{"negative dscp", "server:\n  dscp: -1\n"},
+		{"data_port out of range", "server:\n  data_port: \"70000\"\n"},
+		{"data_port same as port", "server:\n  port: \"1194\"\n  data_port: \"1194\"\n"},
+		{"listen_address not an IP", "server:\n  listen_address: eth0\n"},
+		{"max_udp_payload too small", "server:\n  max_udp_payload: 500\n"},
+		{"max_udp_payload too large", "server:\n  max_udp_payload: 70000\n"},
+		{"invalid hex network key", "server:\n  network_key: \"not hex\"\n"},
+		{"short network key", "server:\n  network_key: \"a1b2c3\"\n"},
+		{"invalid hex identity key", "server:\n  identity_key: \"not hex\"\n"},
+		{"short identity key", "server:\n  identity_key: \"a1b2c3\"\n"},
+		{"interface name too long", "server:\n  interface_name: fvp-interface-name\n"},
+		{"invalid allowed_ips", "clients:\n  - id: 1\n    key: \"" + validKey + "\"\n    allowed_ips: [\"192.168.50.0\"]\n"},
+		{"reserved ip outside subnet", "clients:\n  - id: 1\n    key: \"" + validKey + "\"\n    ip: 192.168.50.1\n"},
+		{"reserved ip is broadcast address", "clients:\n  - id: 1\n    key: \"" + validKey + "\"\n    ip: 10.0.0.255\n"},
+		{"reserved ip is server address", "clients:\n  - id: 1\n    key: \"" + validKey + "\"\n    ip: 10.0.0.1\n"},
+		{"duplicate reserved ip", "clients:\n  - id: 1\n    key: \"" + validKey + "\"\n    ip: 10.0.0.9\n  - id: 2\n    key: \"" + validKey + "\"\n    ip: 10.0.0.9\n"},
+		{"negative log_max_size_mb", "server:\n  log_max_size_mb: -1\n"},
+		{"negative log_max_backups", "server:\n  log_max_backups: -1\n"},
+		{"negative debug_pcap_max_size_mb", "server:\n  debug_pcap_max_size_mb: -1\n"},
+		{"duplicate client ID", "clients:\n  - id: 1\n    key: \"" + validKey + "\"\n  - id: 1\n    key: \"" + validKey + "\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "server.yaml")
+			err := os.WriteFile(configPath, []byte(tt.config), 0644)
+			if err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+
+			err = NewServer().LoadConfig(configPath)
+			if err == nil {
+				t.Fatal("Expected LoadConfig to fail")
+			}
+			if !strings.Contains(err.Error(), "invalid") {
+				t.Errorf("Expected error to mention 'invalid', got: %v", err)
+			}
+		})
+	}
+}
+
+// TestLoadConfig_InsecureNoEncryption tests that disabling encryption needs
+// the environment variable as well as the config flag
+func TestLoadConfig_InsecureNoEncryption(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(configPath, []byte("server:\n  insecure_no_encryption: true\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	t.Setenv(crypto.InsecureEnvVar, "")
+	err = NewServer().LoadConfig(configPath)
+	if err == nil || !strings.Contains(err.Error(), crypto.InsecureEnvVar) {
+		t.Errorf("Expected LoadConfig to require %s, got %v", crypto.InsecureEnvVar, err)
+	}
+
+	t.Setenv(crypto.InsecureEnvVar, "1")
+	server := NewServer()
+	err = server.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if server.cipher.ID() != crypto.CipherNone {
+		t.Errorf("Expected encryption to be disabled, got %s", server.cipher.Name())
+	}
+}
+
+// TestLoadConfig_NormalizesPort tests that a bare port number is accepted
+func TestLoadConfig_NormalizesPort(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(configPath, []byte("server:\n  port: \"1194\"\n  timeout_minutes: 30\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	server := NewServer()
+	err = server.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if server.GetPort() != ":1194" {
+		t.Errorf("Expected port :1194, got %s", server.GetPort())
+	}
+}
+
+// TestLoadConfig_ZeroTimeout tests that timeout_minutes: 0 is taken as unset
+// and keeps the default timeout
+func TestLoadConfig_ZeroTimeout(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(configPath, []byte("server:\n  timeout_minutes: 0\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	server := NewServer()
+	err = server.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if server.timeout != DefaultTimeout {
+		t.Errorf("Expected timeout %v, got %v", DefaultTimeout, server.timeout)
+	}
+}
+
+// TestListenAddress tests binding a listen address to an IP address
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		ip       string
+		port     string
+		expected string
+	}{
+		{"127.0.0.1", "1194", "127.0.0.1:1194"},
+		{"10.1.2.3", "", "10.1.2.3:1194"},
+		{"::1", ":5000", "[::1]:5000"},
+		{"[::1]", "5000", "[::1]:5000"},
+		{"127.0.0.1", "127.0.0.1:53", "127.0.0.1:53"},
+	}
+
+	for _, test := range tests {
+		address, err := ListenAddress(test.ip, test.port)
+		if err != nil {
+			t.Errorf("%s and %q: unexpected error: %v", test.ip, test.port, err)
+			continue
+		}
+		if address != test.expected {
+			t.Errorf("%s and %q: expected %s, got %s", test.ip, test.port, test.expected, address)
+		}
+	}
+
+	for _, invalid := range [][2]string{{"eth0", "1194"}, {"127.0.0.1", "10.0.0.1:1194"}, {"127.0.0.1", "70000"}} {
+		_, err := ListenAddress(invalid[0], invalid[1])
+		if err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("%s and %q: expected an invalid address error, got %v", invalid[0], invalid[1], err)
+		}
+	}
+}
+
+// TestListenAddress_Binds tests that the server binds only the listen
+// address when one is set, and every interface otherwise
+func TestListenAddress_Binds(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       ServerOptions
+		loopback   bool
+		unspecified bool
+	}{
+		{"listen address", ServerOptions{Port: "0", ListenAddress: "127.0.0.1"}, true, false},
+		{"all interfaces", ServerOptions{Port: ":0"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.TUN = network.NewMockTunManager()
+			server, err := NewServerWithOptions(tt.opts)
+			if err != nil {
+				t.Fatalf("NewServerWithOptions failed: %v", err)
+			}
+			err = server.Serve()
+			if err != nil {
+				t.Fatalf("Serve failed: %v", err)
+			}
+			defer server.Stop()
+
+			ip := server.GetAddr().(*net.UDPAddr).IP
+			if ip.IsLoopback() != tt.loopback || ip.IsUnspecified() != tt.unspecified {
+				t.Errorf("Expected loopback %t and unspecified %t, got bound to %s", tt.loopback, tt.unspecified, ip)
+			}
+		})
+	}
+}
+
+// TestStartRollback tests that a start failing at the UDP step closes the
+// TUN interface it already created, and leaves a server that can be started
+// again
+func TestStartRollback(t *testing.T) {
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer taken.Close()
+
+	tun := network.NewMockTunManager()
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: taken.LocalAddr().String(),
+		TUN:  tun,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err == nil {
+		server.Stop()
+		t.Fatal("Expected Serve to fail on a port in use")
+	}
+	if tun.IsCreated() {
+		t.Error("Expected the TUN interface to be closed after the failed start")
+	}
+	if server.udpConn != nil {
+		t.Error("Expected no UDP socket after the failed start")
+	}
+
+	taken.Close()
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Expected Serve to succeed once the port is free, got %v", err)
+	}
+	defer server.Stop()
+	if status := server.GetServerStatus().Status; status != "running" {
+		t.Errorf("Expected status running after the second start, got %s", status)
+	}
+}
+
+// TestDSCP tests that the server marks its UDP socket with the configured DSCP
+func TestDSCP(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port: "127.0.0.1:0",
+		TUN:  network.NewMockTunManager(),
+		DSCP: 46,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	tos, err := ipv4.NewConn(server.udpConn).TOS()
+	if err != nil {
+		t.Fatalf("Failed to read the ToS: %v", err)
+	}
+	if tos != 46<<2 {
+		t.Errorf("Expected ToS %d for DSCP 46, got %d", 46<<2, tos)
+	}
+}
+
+// TestSubnetCapacity tests the server address and client limit for a subnet
+func TestSubnetCapacity(t *testing.T) {
+	tests := []struct {
+		subnet   string
+		serverIP string
+		usable   int
+	}{
+		{"10.0.0.0/24", "10.0.0.1", 253},
+		{"10.8.0.0/29", "10.8.0.1", 5},
+		{"10.8.0.0/16", "10.8.0.1", 255},
+		{"10.8.0.0/31", "10.8.0.1", 0},
+	}
+
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		serverIP, usable := SubnetCapacity(subnet)
+		if serverIP != test.serverIP {
+			t.Errorf("%s: expected server IP %s, got %s", test.subnet, test.serverIP, serverIP)
+		}
+		if usable != test.usable {
+			t.Errorf("%s: expected %d usable addresses, got %d", test.subnet, test.usable, usable)
+		}
+	}
+}
+
+// TestResolveServerIP tests defaulting and validating the server tunnel address
+func TestResolveServerIP(t *testing.T) {
+	tests := []struct {
+		subnet   string
+		serverIP string
+		expected string
+		valid    bool
+	}{
+		{"10.0.0.0/24", "", "10.0.0.1", true},
+		{"10.8.0.0/16", "", "10.8.0.1", true},
+		{"10.8.0.0/16", "10.8.3.254", "10.8.3.254", true},
+		{"10.8.0.0/24", "10.8.0.0", "", false},
+		{"10.8.0.0/24", "10.8.0.255", "", false},
+		{"10.8.0.0/24", "10.9.0.1", "", false},
+		{"10.8.0.0/24", "not-an-ip", "", false},
+	}
+
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		serverIP, err := ResolveServerIP(subnet, test.serverIP)
+		if test.valid && err != nil {
+			t.Errorf("%s in %s: unexpected error: %v", test.serverIP, test.subnet, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s in %s: expected an error", test.serverIP, test.subnet)
+		}
+		if serverIP != test.expected {
+			t.Errorf("%s in %s: expected %q, got %q", test.serverIP, test.subnet, test.expected, serverIP)
+		}
+	}
+}
+
+// TestNewServerWithOptions_ServerIP tests that the server tunnel address
+// follows the subnet unless overridden, and reaches the client manager
+func TestNewServerWithOptions_ServerIP(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{Subnet: "10.8.0.0/16"})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	if server.tunnelAddress() != "10.8.0.1/16" {
+		t.Errorf("Expected tunnel address 10.8.0.1/16, got %s", server.tunnelAddress())
+	}
+
+	server, err = NewServerWithOptions(ServerOptions{Subnet: "10.8.0.0/16", ServerIP: "10.8.255.1"})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+	if server.tunnelAddress() != "10.8.255.1/16" {
+		t.Errorf("Expected tunnel address 10.8.255.1/16, got %s", server.tunnelAddress())
+	}
+
+	err = server.CreateClientManager()
+	if err != nil {
+		t.Fatalf("CreateClientManager failed: %v", err)
+	}
+	defer server.clientManager.Close()
+	if server.clientManager.serverIP() != "10.8.255.1" {
+		t.Errorf("Expected client manager server IP 10.8.255.1, got %s", server.clientManager.serverIP())
+	}
+
+	_, err = NewServerWithOptions(ServerOptions{Subnet: "10.8.0.0/16", ServerIP: "10.9.0.1"})
+	if err == nil {
+		t.Error("Expected error for server IP outside the subnet")
+	}
+}
+
+// TestGetServerStatus_InterfaceName tests that status reports the configured
+// TUN interface rather than the default
+func TestGetServerStatus_InterfaceName(t *testing.T) {
+	server, err := NewServerWithOptions(ServerOptions{
+		Port:          "127.0.0.1:0",
+		InterfaceName: "fvp7",
+		TUN:           network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithOptions failed: %v", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	defer server.Stop()
+
+	if name := server.GetServerStatus().TUNInterface; name != "fvp7" {
+		t.Errorf("Expected TUN interface fvp7, got %s", name)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// SetPacketTrace makes the server log a line for every packet it sends or
+// receives: its type, client ID, sequence and length, whether a data packet
+// decrypted, and the addresses and ports of the IP packet inside. Payload
+// contents are never logged. It is meant for debugging tunnels, not for
+// production, and must be called before the server is started.
+func (s *Server) SetPacketTrace(enabled bool) {
+	s.packetTrace = enabled
+}
+
+// tracePacket logs a packet for the packet trace. result says what became of
+// a data packet, and ipData is the IP packet it carries, nil if unknown.
+func tracePacket(direction string, peer net.Addr, packet *protocol.Packet, result string, ipData []byte) {
+	line := fmt.Sprintf("TRACE %s %s: %s", direction, peer, packet)
+	if result != "" {
+		line += ", " + result
+	}
+	if ipData != nil {
+		line += ", " + network.DescribeFlow(ipData)
+	}
+	log.Print(line)
+}
+
+// tracingTransport traces the control packets the server sends. Data packets
+// are traced by the packet processor, which also knows what they carry.
+type tracingTransport struct {
+	network.Transport
+}
+
+func (t *tracingTransport) WriteTo(data []byte, addr net.Addr) (int, error) {
+	packet, err := protocol.ParsePacket(data)
+	if err == nil && packet.Type != protocol.PacketTypeData {
+		tracePacket("send", addr, packet, "", nil)
+	}
+	return t.Transport.WriteTo(data, addr)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+	"gopkg.in/yaml.v3"
+)
+
+// verifyClient is a client entry read with a wider ID type than
+// crypto.ClientConfig, so an ID out of range is reported as such rather
+// than failing the whole parse
+type verifyClient struct {
+	ID  int    `yaml:"id"`
+	Key string `yaml:"key"`
+}
+
+// VerifyConfig statically checks a configuration file before it is
+// deployed: that it and its clients.d files parse, every client key is 32 bytes of hex, client IDs
+// are unique and between 1 and MaxClients, the subnet has an address for
+// every client, the timeout is not negative, the remaining settings are valid
+// and the ports parse and are free. Unlike Preflight it never creates a TUN
+// interface, so it needs no root. Checks after a failed parse are skipped.
+func VerifyConfig(configPath string) []PreflightCheck {
+	config, clients, err := readVerifyConfig(configPath)
+	checks := []PreflightCheck{{Name: "parse " + configPath, Err: err}}
+	if err != nil {
+		return checks
+	}
+
+	checks = append(checks,
+		PreflightCheck{Name: fmt.Sprintf("client keys (%d)", len(clients)), Err: verifyClientKeys(clients)},
+		PreflightCheck{Name: "client IDs", Err: verifyClientIDs(clients)},
+		verifySubnetCapacity(config.Server.Subnet, len(clients)),
+		verifyTimeout(config.Server.TimeoutMinutes),
+	)
+
+	// Everything else the server checks when it starts
+	opts, err := LoadServerOptions(configPath)
+	if err == nil {
+		_, err = NewServerWithOptions(opts)
+	}
+	checks = append(checks, PreflightCheck{Name: "settings", Err: err})
+
+	checks = append(checks, verifyPort("port", config.Server.Port, config.Server.ListenAddress))
+	if config.Server.DataPort != "" {
+		checks = append(checks, verifyPort("data_port", config.Server.DataPort, config.Server.ListenAddress))
+	}
+
+	return checks
+}
+
+// readVerifyConfig reads the server settings of a configuration file and
+// the clients listed in it and its clients.d files
+func readVerifyConfig(configPath string) (ServerConfig, []verifyClient, error) {
+	var config ServerConfig
+	var raw struct {
+		Server  yaml.Node      `yaml:"server"`
+		Clients []verifyClient `yaml:"clients"`
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return config, nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if !raw.Server.IsZero() {
+		err = raw.Server.Decode(&config.Server)
+		if err != nil {
+			return config, nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	}
+
+	files, err := crypto.ClientsDirFiles(configPath)
+	if err != nil {
+		return config, nil, err
+	}
+
+	clients := raw.Clients
+	for _, file := range files {
+		var clientFile struct {
+			Clients []verifyClient `yaml:"clients"`
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return config, nil, fmt.Errorf("failed to read client file: %w", err)
+		}
+		err = yaml.Unmarshal(data, &clientFile)
+		if err != nil {
+			return config, nil, fmt.Errorf("failed to parse client file %s: %w", file, err)
+		}
+		clients = append(clients, clientFile.Clients...)
+	}
+
+	return config, clients, nil
+}
+
+// verifyClientKeys checks that every client key is 32 bytes of hex,
+// reporting each bad one
+func verifyClientKeys(clients []verifyClient) error {
+	keyManager := crypto.NewKeyManager()
+
+	var errs []error
+	for _, client := range clients {
+		key, err := hex.DecodeString(client.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid hex key for client %d: %w", client.ID, err))
+			continue
+		}
+		if keyManager.AddClientKey(uint8(client.ID), key) != nil {
+			errs = append(errs, fmt.Errorf("invalid key for client %d: must be exactly 32 bytes (64 hex chars), got %d bytes", client.ID, len(key)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// verifyClientIDs checks that client IDs are unique and fit in the single
+// byte the protocol gives them, zero being reserved
+func verifyClientIDs(clients []verifyClient) error {
+	seen := make(map[int]bool)
+
+	var errs []error
+	for _, client := range clients {
+		if client.ID < 1 || client.ID > MaxClients {
+			errs = append(errs, fmt.Errorf("invalid client ID %d: must be between 1 and %d", client.ID, MaxClients))
+			continue
+		}
+		if seen[client.ID] {
+			errs = append(errs, fmt.Errorf("invalid client list: duplicate client ID %d", client.ID))
+		}
+		seen[client.ID] = true
+	}
+	return errors.Join(errs...)
+}
+
+// verifySubnetCapacity checks that the subnet has an address for each of
+// the configured clients
+func verifySubnetCapacity(subnet string, clients int) PreflightCheck {
+	if subnet == "" {
+		subnet = DefaultSubnet
+	}
+	name := "subnet " + subnet
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return PreflightCheck{Name: name, Err: fmt.Errorf("invalid subnet %q: must be an IPv4 CIDR", subnet)}
+	}
+
+	_, usable := SubnetCapacity(ipNet)
+	name = fmt.Sprintf("subnet %s (%d addresses, %d clients)", subnet, usable, clients)
+	if clients > usable {
+		return PreflightCheck{Name: name, Err: fmt.Errorf("subnet %s has %d client addresses, too few for %d clients", subnet, usable, clients)}
+	}
+	return PreflightCheck{Name: name}
+}
+
+// verifyTimeout checks timeout_minutes, zero selecting DefaultTimeout
+func verifyTimeout(minutes int) PreflightCheck {
+	if minutes < 0 {
+		return PreflightCheck{Name: "timeout", Err: fmt.Errorf("invalid timeout_minutes %d: must not be negative; 0 or unset keeps the default of %v", minutes, DefaultTimeout)}
+	}
+
+	timeout := DefaultTimeout
+	if minutes > 0 {
+		timeout = time.Duration(minutes) * time.Minute
+	}
+	return PreflightCheck{Name: fmt.Sprintf("timeout %s", timeout)}
+}
+
+// verifyPort checks that the port setting called setting parses and that
+// nothing else holds it, by binding it for a moment
+func verifyPort(setting, port, listenAddress string) PreflightCheck {
+	address, err := normalizePort(port)
+	if err == nil && listenAddress != "" {
+		address, err = ListenAddress(listenAddress, address)
+	}
+	if address == "" {
+		address = DefaultPort
+	}
+	name := setting + " " + address
+	if err != nil {
+		return PreflightCheck{Name: setting, Err: err}
+	}
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return PreflightCheck{Name: name, Err: fmt.Errorf("failed to bind %s: %w", address, err)}
+	}
+	conn.Close()
+	return PreflightCheck{Name: name}
+}
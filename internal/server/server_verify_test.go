@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const verifyTestKey = "a1b2c3d4e5f6789012345678901234567890abcdef1234567890abcdef123456"
+
+func writeVerifyConfig(t *testing.T, config string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	err := os.WriteFile(path, []byte(config), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// failedChecks returns the names of the checks that failed
+func failedChecks(checks []PreflightCheck) []string {
+	var failed []string
+	for _, check := range checks {
+		if check.Err != nil {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
+
+func TestVerifyConfig_Passes(t *testing.T) {
+	path := writeVerifyConfig(t, "server:\n  port: \"127.0.0.1:0\"\n  timeout_minutes: 30\n"+
+		"clients:\n  - id: 1\n    key: \""+verifyTestKey+"\"\n  - id: 2\n    key: \""+verifyTestKey+"\"\n")
+
+	checks := VerifyConfig(path)
+
+	if len(checks) != 7 {
+		t.Fatalf("Expected 7 checks, got %d", len(checks))
+	}
+	if failed := failedChecks(checks); len(failed) != 0 {
+		for _, check := range checks {
+			t.Logf("%s: %v", check.Name, check.Err)
+		}
+		t.Errorf("Expected every check to pass, got failures in %v", failed)
+	}
+}
+
+func TestVerifyConfig_Failures(t *testing.T) {
+	client := func(id string) string {
+		return "  - id: " + id + "\n    key: \"" + verifyTestKey + "\"\n"
+	}
+
+	tests := []struct {
+		name     string
+		settings string // Lines under server, after the port
+		clients  string
+		failed   string // Prefix of the check that must fail
+	}{
+		{"bad hex key", "", "  - id: 1\n    key: \"zz\"\n", "client keys"},
+		{"short key", "", "  - id: 1\n    key: \"a1b2c3\"\n", "client keys"},
+		{"duplicate ID", "", client("1") + client("1"), "client IDs"},
+		{"ID out of range", "", client("300"), "client IDs"},
+		{"ID zero", "", client("0"), "client IDs"},
+		{"subnet too small", "  subnet: 10.9.0.0/30\n", client("1") + client("2") + client("3"), "subnet"},
+		{"negative timeout", "  timeout_minutes: -1\n", "", "timeout"},
+		{"bad cipher", "  cipher: rot13\n", "", "settings"},
+		{"data_port out of range", "  data_port: \"70000\"\n", "", "data_port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := "server:\n  port: \"127.0.0.1:0\"\n" + tt.settings + "clients:\n" + tt.clients
+
+			checks := VerifyConfig(writeVerifyConfig(t, config))
+
+			found := false
+			for _, name := range failedChecks(checks) {
+				found = found || strings.HasPrefix(name, tt.failed)
+			}
+			if !found {
+				t.Errorf("Expected the %s check to fail, got failures in %v", tt.failed, failedChecks(checks))
+			}
+		})
+	}
+}
+
+func TestVerifyConfig_PortInUse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to occupy port: %v", err)
+	}
+	defer conn.Close()
+
+	checks := VerifyConfig(writeVerifyConfig(t, "server:\n  port: \""+conn.LocalAddr().String()+"\"\n"))
+
+	failed := failedChecks(checks)
+	if len(failed) != 1 || !strings.HasPrefix(failed[0], "port") {
+		t.Errorf("Expected only the port check to fail, got failures in %v", failed)
+	}
+}
+
+func TestVerifyConfig_Unparseable(t *testing.T) {
+	checks := VerifyConfig(writeVerifyConfig(t, "server: [\n"))
+
+	if len(checks) != 1 || checks[0].Err == nil {
+		t.Errorf("Expected a single failed parse check, got %v", checks)
+	}
+}
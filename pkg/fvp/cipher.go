@@ -0,0 +1,41 @@
+package fvp
+
+import (
+	"github.com/pepalonsocosta/fvp/internal/crypto"
+)
+
+// Cipher encrypts and decrypts tunnel payloads with a 32-byte key, deriving
+// the nonce from the packet sequence number
+type Cipher = crypto.Cipher
+
+// Cipher suite identifiers as carried in the handshake
+const (
+	CipherChaCha20Poly1305 = crypto.CipherChaCha20Poly1305
+	CipherAES256GCM        = crypto.CipherAES256GCM
+)
+
+// CipherOverhead is the authentication tag every supported cipher appends to
+// an encrypted payload
+const CipherOverhead = crypto.CipherOverhead
+
+// DefaultCipher returns ChaCha20-Poly1305, which every server accepts
+func DefaultCipher() Cipher {
+	return crypto.DefaultCipher()
+}
+
+// SupportedCiphers returns every cipher a client can offer, in order of
+// preference
+func SupportedCiphers() []Cipher {
+	return crypto.SupportedCiphers()
+}
+
+// CipherByName returns the cipher named as in server.cipher, e.g.
+// "aes-256-gcm"
+func CipherByName(name string) (Cipher, error) {
+	return crypto.CipherByName(name)
+}
+
+// CipherByID returns the cipher with a handshake identifier
+func CipherByID(id uint8) (Cipher, error) {
+	return crypto.CipherByID(id)
+}
@@ -0,0 +1,53 @@
+package fvp
+
+import (
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/network"
+)
+
+// Client connects to an fvps server and carries the traffic of a TUN
+// interface over the tunnel. Configure it with its Set methods, then call
+// Connect or ConnectContext.
+type Client = client.Client
+
+// DialFunc opens the connection a Client sends its datagrams over; see
+// Client.SetDialer
+type DialFunc = client.DialFunc
+
+// TUNInterface is the interface a Client reads outgoing IP packets from and
+// writes incoming ones to. Implement it to run the tunnel over something
+// other than a system TUN device, such as a userspace network stack.
+type TUNInterface = network.TUNInterface
+
+// ServerError is returned by Connect when the server refuses the handshake
+type ServerError = client.ServerError
+
+var (
+	// ErrServerFull matches a ServerError from a server with no client IDs
+	// or tunnel addresses left
+	ErrServerFull = client.ErrServerFull
+
+	// ErrAuthTimeout is returned by Connect when the server never answers
+	// the auth request
+	ErrAuthTimeout = client.ErrAuthTimeout
+
+	// ErrLocalAddrInUse is returned by Connect when the port set with
+	// SetLocalPort is taken
+	ErrLocalAddrInUse = client.ErrLocalAddrInUse
+
+	// ErrNotConnected is returned by Client.Send outside a session
+	ErrNotConnected = client.ErrNotConnected
+)
+
+// NewClient returns a client for serverAddr, host:port or a comma-separated
+// list of fallbacks, that creates a system TUN interface when it connects.
+// That needs root, or CAP_NET_ADMIN on Linux.
+func NewClient(serverAddr string) *Client {
+	return client.NewClient(serverAddr)
+}
+
+// NewClientWithTUN returns a client for serverAddr that uses tun instead of
+// creating a system TUN interface
+func NewClientWithTUN(serverAddr string, tun TUNInterface) *Client {
+	return client.NewClientWithTUN(serverAddr, tun)
+}
@@ -0,0 +1,22 @@
+// Package fvp is the public API of the Fast VPN Protocol: the packet format,
+// the payload ciphers and a client that connects to an fvps server. It is
+// meant for building alternative clients and tools; the server stays
+// internal.
+//
+// # Stability
+//
+// Within a major version of this module, nothing exported from this package
+// is removed or changes signature, and exported struct fields keep their
+// meaning. New identifiers, methods and struct fields may be added in minor
+// releases, so don't rely on unkeyed Packet literals or embed Cipher in an
+// interface you expect to stay fixed.
+//
+// The wire format is versioned separately, by the protocol major version in
+// every packet header; see docs/protocol.md. A client built against this
+// package talks to any server of the same protocol major.
+//
+// Types here are aliases of the implementation's types, so the methods
+// documented on them are part of the contract too. Anything not reachable
+// from this package, such as the server, TUN setup or config file layouts,
+// may change in any release.
+package fvp
@@ -0,0 +1,93 @@
+package fvp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packet := NewDataPacket(7, 42, []byte("payload"))
+
+	data, err := EncodePacket(packet)
+	if err != nil {
+		t.Fatalf("EncodePacket failed: %v", err)
+	}
+	if len(data) != HeaderLen(1)+len("payload") {
+		t.Errorf("Expected %d bytes, got %d", HeaderLen(1)+len("payload"), len(data))
+	}
+
+	decoded, err := DecodePacket(data)
+	if err != nil {
+		t.Fatalf("DecodePacket failed: %v", err)
+	}
+	if decoded.Type != PacketTypeData || decoded.ClientID != 7 || decoded.Sequence != 42 {
+		t.Errorf("Expected data packet from client 7 with sequence 42, got %s", DescribeHeader(decoded))
+	}
+	if !bytes.Equal(decoded.Payload, []byte("payload")) {
+		t.Errorf("Expected payload %q, got %q", "payload", decoded.Payload)
+	}
+}
+
+func TestCiphers(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	for _, cipher := range SupportedCiphers() {
+		t.Run(cipher.Name(), func(t *testing.T) {
+			byID, err := CipherByID(cipher.ID())
+			if err != nil || byID.Name() != cipher.Name() {
+				t.Fatalf("Expected CipherByID to find %s, got %v, %v", cipher.Name(), byID, err)
+			}
+
+			sealed, err := cipher.EncryptPayload([]byte("secret"), key, 1)
+			if err != nil {
+				t.Fatalf("EncryptPayload failed: %v", err)
+			}
+			if len(sealed) != len("secret")+CipherOverhead {
+				t.Errorf("Expected %d bytes, got %d", len("secret")+CipherOverhead, len(sealed))
+			}
+
+			opened, err := cipher.DecryptPayload(sealed, key, 1)
+			if err != nil || string(opened) != "secret" {
+				t.Errorf("Expected %q back, got %q, %v", "secret", opened, err)
+			}
+		})
+	}
+
+	if DefaultCipher().ID() != CipherChaCha20Poly1305 {
+		t.Errorf("Expected ChaCha20-Poly1305 by default, got %s", DefaultCipher().Name())
+	}
+}
+
+// TestErrors tests that the re-exported sentinels match the client's errors
+func TestErrors(t *testing.T) {
+	err := fmt.Errorf("failed to connect: %w", client.ErrAuthTimeout)
+	if !errors.Is(err, ErrAuthTimeout) {
+		t.Error("Expected ErrAuthTimeout to match the client's error")
+	}
+
+	var serverErr error = &ServerError{Code: protocol.ErrorCodeServerFull}
+	if !errors.Is(serverErr, ErrServerFull) {
+		t.Error("Expected a server full error to match ErrServerFull")
+	}
+}
+
+func ExampleEncodePacket() {
+	data, err := EncodePacket(NewPingPacket(3, 1))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	packet, err := DecodePacket(data)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(len(data), DescribeHeader(packet))
+	// Output: 12 ping client 3 seq 1 len 0
+}
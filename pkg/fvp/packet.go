@@ -0,0 +1,69 @@
+package fvp
+
+import (
+	"github.com/pepalonsocosta/fvp/internal/protocol"
+)
+
+// Packet is a decoded FVP packet: its header fields and payload
+type Packet = protocol.Packet
+
+const (
+	MagicBytes         = protocol.MagicBytes
+	HeaderSize         = protocol.HeaderSize         // Header length for protocol major 1
+	ExtendedHeaderSize = protocol.ExtendedHeaderSize // Header length from protocol major 2 on
+	MaxHeaderSize      = protocol.MaxHeaderSize
+	MaxPayloadSize     = protocol.MaxPayloadSize
+
+	PacketTypeData       = protocol.PacketTypeData
+	PacketTypeAuth       = protocol.PacketTypeAuth
+	PacketTypePing       = protocol.PacketTypePing
+	PacketTypePong       = protocol.PacketTypePong
+	PacketTypeError      = protocol.PacketTypeError
+	PacketTypeDisconnect = protocol.PacketTypeDisconnect
+
+	// PacketFlagCompressed marks a data packet whose payload was compressed
+	// before encryption
+	PacketFlagCompressed = protocol.PacketFlagCompressed
+)
+
+// InitProtocolVersion sets the version new packets advertise from a
+// major.minor.patch string; an empty string means 1.0.0, the default
+func InitProtocolVersion(version string) error {
+	return protocol.InitProtocolVersion(version)
+}
+
+// EncodePacket returns the wire form of a packet
+func EncodePacket(packet *Packet) ([]byte, error) {
+	return protocol.EncodePacket(packet)
+}
+
+// DecodePacket parses and validates a packet received from the wire
+func DecodePacket(data []byte) (*Packet, error) {
+	return protocol.DecodePacket(data)
+}
+
+// HeaderLen returns the header length for a protocol major version
+func HeaderLen(major int) int {
+	return protocol.HeaderLen(major)
+}
+
+// NewDataPacket returns a data packet carrying an encrypted payload
+func NewDataPacket(clientID uint8, sequence uint32, payload []byte) *Packet {
+	return protocol.CreateDataPacket(clientID, sequence, payload)
+}
+
+// NewAuthPacket returns an auth packet carrying encoded auth options
+func NewAuthPacket(clientID uint8, sequence uint32, payload []byte) *Packet {
+	return protocol.CreateAuthPacket(clientID, sequence, payload)
+}
+
+// NewPingPacket returns a keepalive ping. Servers drop pings whose payload
+// isn't sealed like a data payload, so set one before sending it.
+func NewPingPacket(clientID uint8, sequence uint32) *Packet {
+	return protocol.CreatePingPacket(clientID, sequence)
+}
+
+// DescribeHeader summarizes a packet's header for logs, never its payload
+func DescribeHeader(packet *Packet) string {
+	return protocol.DescribeHeader(packet)
+}
@@ -1,6 +1,8 @@
 package e2e
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -86,6 +88,46 @@ func TestCLIIntegration(t *testing.T) {
 	})
 }
 
+// TestCLIConfigPath tests commands against a config file outside the working
+// directory, given with --config before or after the command
+func TestCLIConfigPath(t *testing.T) {
+	env := SetupTestEnvironment(t)
+	defer env.CleanupTestEnvironment()
+
+	env.ConfigPath = filepath.Join(env.TestDir, "etc", "fvp", "fvps.yaml")
+	err := os.MkdirAll(filepath.Dir(env.ConfigPath), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+
+	output := env.RunCommandExpectSuccess(t, "setup", "--config", env.ConfigPath, "--port", "1194", "--timeout", "30")
+	AssertOutputContains(t, output, "Configuration created: "+env.ConfigPath)
+	env.AssertConfigFileValid(t)
+	if _, err := os.Stat(filepath.Join(env.TestDir, "server.yaml")); err == nil {
+		t.Error("Expected no server.yaml in the working directory")
+	}
+
+	output = env.RunCommandExpectSuccess(t, "--config", env.ConfigPath, "add-client")
+	AssertOutputContains(t, output, "Client ID: 1")
+	env.RunCommandExpectSuccess(t, "add-client", "--config", env.ConfigPath)
+	env.AssertClientCount(t, 2)
+
+	output = env.RunCommandExpectSuccess(t, "list-clients", "--config", env.ConfigPath)
+	AssertOutputContains(t, output, "1   10.0.0.2   Disconnected Never")
+	AssertOutputContains(t, output, "2   10.0.0.3   Disconnected Never")
+
+	output = env.RunCommandExpectSuccess(t, "info", "--config", env.ConfigPath)
+	AssertOutputContains(t, output, "Server Configuration ("+env.ConfigPath+")")
+
+	env.RunCommandExpectSuccess(t, "--config", env.ConfigPath, "remove-client", "--id", "2")
+	env.AssertClientCount(t, 1)
+	env.AssertClientNotExists(t, 2)
+
+	// Without --config, commands still look for server.yaml
+	output = env.RunCommandExpectFailure(t, "list-clients")
+	AssertOutputContains(t, output, "no configuration found, run 'fvps setup' first")
+}
+
 // TestCLIErrorHandling tests error conditions
 func TestCLIErrorHandling(t *testing.T) {
 	// Setup test environment
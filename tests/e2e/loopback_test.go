@@ -0,0 +1,85 @@
+package e2e
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pepalonsocosta/fvp/internal/client"
+	"github.com/pepalonsocosta/fvp/internal/network"
+	"github.com/pepalonsocosta/fvp/internal/server"
+)
+
+// TestLoopbackDataPath tests that IP packets cross the tunnel in both
+// directions, decrypted on arrival, without root or real TUN devices
+func TestLoopbackDataPath(t *testing.T) {
+	le := SetupLoopback(t, server.ServerOptions{})
+	vpnClient, clientTUN := le.ConnectClient(t, nil)
+
+	outbound := BuildUDPPacket(vpnClient.GetAssignedIP(), "8.8.8.8", []byte("client to server"))
+	clientTUN.QueueReadPacket(outbound)
+	if received := WaitForTUNPacket(t, le.ServerTUN); !bytes.Equal(received, outbound) {
+		t.Errorf("Server TUN got %x, expected %x", received, outbound)
+	}
+
+	inbound := BuildUDPPacket("8.8.8.8", vpnClient.GetAssignedIP(), []byte("server to client"))
+	le.ServerTUN.QueueReadPacket(inbound)
+	if received := WaitForTUNPacket(t, clientTUN); !bytes.Equal(received, inbound) {
+		t.Errorf("Client TUN got %x, expected %x", received, inbound)
+	}
+
+	status := le.Server.GetClientStatus()
+	if len(status) != 1 || status[0].PacketsRx != 1 || status[0].PacketsTx != 1 {
+		t.Errorf("Expected one client with one packet each way, got %+v", status)
+	}
+}
+
+// TestLoopbackPreSharedKeys tests two clients with pre-shared keys, one with
+// AES-256-GCM and compression negotiated, each getting only its own traffic
+func TestLoopbackPreSharedKeys(t *testing.T) {
+	keys := map[uint8][]byte{
+		1: bytes.Repeat([]byte{0x11}, 32),
+		2: bytes.Repeat([]byte{0x22}, 32),
+	}
+	le := SetupLoopback(t, server.ServerOptions{
+		ClientKeys:  keys,
+		ReservedIPs: map[uint8]string{1: "10.0.0.10", 2: "10.0.0.20"},
+		Cipher:      "aes-256-gcm",
+	})
+
+	first, firstTUN := le.ConnectClient(t, func(c *client.Client) {
+		c.SetPreSharedKey(1, keys[1])
+	})
+	second, secondTUN := le.ConnectClient(t, func(c *client.Client) {
+		c.SetPreSharedKey(2, keys[2])
+		c.SetCompression(true)
+	})
+
+	if first.GetAssignedIP() != "10.0.0.10" || second.GetAssignedIP() != "10.0.0.20" {
+		t.Fatalf("Expected reserved IPs 10.0.0.10 and 10.0.0.20, got %s and %s", first.GetAssignedIP(), second.GetAssignedIP())
+	}
+
+	// A compressible payload, so the second client's packets shrink
+	payload := bytes.Repeat([]byte("compress me "), 40)
+	for _, tt := range []struct {
+		ip  string
+		tun *network.MockTunManager
+	}{
+		{"10.0.0.10", firstTUN},
+		{"10.0.0.20", secondTUN},
+	} {
+		outbound := BuildUDPPacket(tt.ip, "192.0.2.53", payload)
+		tt.tun.QueueReadPacket(outbound)
+		if received := WaitForTUNPacket(t, le.ServerTUN); !bytes.Equal(received, outbound) {
+			t.Errorf("Server TUN got %x from %s, expected %x", received, tt.ip, outbound)
+		}
+	}
+
+	inbound := BuildUDPPacket("192.0.2.53", "10.0.0.20", payload)
+	le.ServerTUN.QueueReadPacket(inbound)
+	if received := WaitForTUNPacket(t, secondTUN); !bytes.Equal(received, inbound) {
+		t.Errorf("Second client TUN got %x, expected %x", received, inbound)
+	}
+	if leaked := firstTUN.GetWriteQueue(); len(leaked) != 0 {
+		t.Errorf("Expected nothing for the first client, got %d packets", len(leaked))
+	}
+}
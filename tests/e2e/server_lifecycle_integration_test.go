@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/pepalonsocosta/fvp/internal/network"
 	"github.com/pepalonsocosta/fvp/internal/server"
 )
 
@@ -353,11 +354,12 @@ func TestServerErrorHandlingIntegration(t *testing.T) {
 
 // Helper function to create a test server with mock TUN interface
 func createTestServer(t *testing.T) *server.Server {
-	srv := server.NewServer()
-	
-	// For testing, we need to modify the server to use mock TUN interface
-	// Since we can't access unexported fields, we'll create a test-specific approach
-	// by creating a config that the server can load and then testing individual components
+	srv, err := server.NewServerWithOptions(server.ServerOptions{
+		TUN: network.NewMockTunManager(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create test server: %v", err)
+	}
 	
 	return srv
 }